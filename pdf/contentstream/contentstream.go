@@ -10,6 +10,7 @@ import (
 	"fmt"
 
 	. "github.com/unidoc/unidoc/pdf/core"
+	"github.com/unidoc/unidoc/pdf/internal/balance"
 )
 
 type ContentStreamOperation struct {
@@ -19,56 +20,66 @@ type ContentStreamOperation struct {
 
 type ContentStreamOperations []*ContentStreamOperation
 
-// Check if the content stream operations are fully wrapped (within q ... Q)
-func (this *ContentStreamOperations) isWrapped() bool {
-	if len(*this) < 2 {
-		return false
-	}
+// ContentStreamBalance describes the nesting of the graphics state (q/Q) and text object (BT/ET)
+// operators of content stream operations.
+type ContentStreamBalance struct {
+	UnclosedSaves     int  // Number of q operators without a matching Q.
+	UnmatchedRestores int  // Number of Q operators without a preceding q.
+	UnclosedText      bool // Whether the operations end inside a text object (BT without ET).
+	UnmatchedTextEnds int  // Number of ET operators outside a text object.
+	NestedText        int  // Number of BT operators inside a text object.
+}
+
+// IsBalanced returns true if all q/Q and BT/ET operators are matched.
+func (this ContentStreamBalance) IsBalanced() bool {
+	return balance.Result(this).IsBalanced()
+}
+
+// CheckBalance counts the nesting of the q/Q and BT/ET operators, reporting any imbalance.
+func (this *ContentStreamOperations) CheckBalance() ContentStreamBalance {
+	return ContentStreamBalance(balance.Check(this.operands()))
+}
 
-	depth := 0
+// operands returns the operand names of the operations.
+func (this *ContentStreamOperations) operands() []string {
+	operands := make([]string, 0, len(*this))
 	for _, op := range *this {
-		if op.Operand == "q" {
-			depth++
-		} else if op.Operand == "Q" {
-			depth--
-		} else {
-			if depth < 1 {
-				return false
-			}
+		if op != nil {
+			operands = append(operands, op.Operand)
 		}
 	}
+	return operands
+}
 
-	// Should end at depth == 0
-	return depth == 0
+// Check if the content stream operations are fully wrapped (within q ... Q)
+func (this *ContentStreamOperations) isWrapped() bool {
+	return balance.IsWrapped(this.operands())
 }
 
-// Wrap entire contents within q ... Q.  If unbalanced, then adds extra Qs at the end.
+// Wrap entire contents within q ... Q.  If unbalanced, then adds extra qs at the start for
+// unmatched Qs, closes an open text object and adds extra Qs at the end.
 // Only does if needed. Ensures that when adding new content, one start with all states
-// in the default condition.
+// in the default condition and outside a text object.
 func (this *ContentStreamOperations) WrapIfNeeded() *ContentStreamOperations {
 	if len(*this) == 0 {
 		// No need to wrap if empty.
 		return this
 	}
-	if this.isWrapped() {
+	result := balance.Check(this.operands())
+	if result.IsBalanced() && this.isWrapped() {
 		return this
 	}
 
-	*this = append([]*ContentStreamOperation{{Operand: "q"}}, *this...)
-
-	depth := 0
-	for _, op := range *this {
-		if op.Operand == "q" {
-			depth++
-		} else if op.Operand == "Q" {
-			depth--
-		}
+	prefix, suffix := result.Repair()
+	wrapped := ContentStreamOperations{}
+	for _, operand := range prefix {
+		wrapped = append(wrapped, &ContentStreamOperation{Operand: operand})
 	}
-
-	for depth > 0 {
-		*this = append(*this, &ContentStreamOperation{Operand: "Q"})
-		depth--
+	wrapped = append(wrapped, *this...)
+	for _, operand := range suffix {
+		wrapped = append(wrapped, &ContentStreamOperation{Operand: operand})
 	}
+	*this = wrapped
 
 	return this
 }
@@ -76,6 +87,12 @@ func (this *ContentStreamOperations) WrapIfNeeded() *ContentStreamOperations {
 // Convert a set of content stream operations to a content stream byte presentation, i.e. the kind that can be
 // stored as a PDF stream or string format.
 func (this *ContentStreamOperations) Bytes() []byte {
+	return this.bytesWithFloatPrecision(0)
+}
+
+// bytesWithFloatPrecision returns the content stream of the operations with the real operands
+// rounded to `digits` significant digits, not rounded if 0.
+func (this *ContentStreamOperations) bytesWithFloatPrecision(digits int) []byte {
 	var buf bytes.Buffer
 
 	for _, op := range *this {
@@ -91,7 +108,7 @@ func (this *ContentStreamOperations) Bytes() []byte {
 		} else {
 			// Default handler.
 			for _, param := range op.Params {
-				buf.WriteString(param.DefaultWriteString())
+				buf.WriteString(RoundFloats(param, digits).DefaultWriteString())
 				buf.WriteString(" ")
 
 			}
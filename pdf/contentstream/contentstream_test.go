@@ -1,7 +1,13 @@
 package contentstream
 
 import (
+	"fmt"
+	"math"
+	"math/rand"
 	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+	"github.com/unidoc/unidoc/pdf/model"
 )
 
 func TestOperandTJSpacing(t *testing.T) {
@@ -23,3 +29,279 @@ func TestOperandTJSpacing(t *testing.T) {
 	}
 
 }
+
+// Test parsing operands with exponents and '+' signs in lenient and strict mode.
+func TestParseNumbersLenient(t *testing.T) {
+	content := "1.0E-5 0 0 +1 .5 5. cm"
+	ops, err := NewContentStreamParser(content).Parse()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(*ops) != 1 || (*ops)[0].Operand != "cm" || len((*ops)[0].Params) != 6 {
+		t.Fatalf("Unexpected operations %v", ops)
+	}
+	expected := []PdfObject{MakeFloat(1e-5), MakeInteger(0), MakeInteger(0), MakeInteger(1), MakeFloat(0.5), MakeFloat(5)}
+	for i, param := range (*ops)[0].Params {
+		if fmt.Sprintf("%T %s", param, param) != fmt.Sprintf("%T %s", expected[i], expected[i]) {
+			t.Errorf("Param %d: %T %s != %T %s", i, param, param, expected[i], expected[i])
+		}
+	}
+
+	strict := &ContentStreamParserOpts{StrictNumbers: true}
+	if _, err := NewContentStreamParserWithOpts(content, strict).Parse(); err == nil {
+		t.Errorf("Strict mode should reject 1.0E-5")
+	}
+	if _, err := NewContentStreamParserWithOpts("1 0 0 +1 .5 5. cm", strict).Parse(); err != nil {
+		t.Errorf("Strict mode should accept legal numbers: %v", err)
+	}
+}
+
+// Test that wrapping operations which end inside a text object and an unclosed q closes both.
+func TestWrapIfNeededUnbalanced(t *testing.T) {
+	cStreamParser := NewContentStreamParser("Q q 0.5 0 0 0.5 100 100 cm BT /F1 12 Tf (Hello) Tj")
+	operations, err := cStreamParser.Parse()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	balance := operations.CheckBalance()
+	expected := ContentStreamBalance{UnclosedSaves: 1, UnmatchedRestores: 1, UnclosedText: true}
+	if balance != expected {
+		t.Fatalf("%+v != %+v", balance, expected)
+	}
+
+	operations.WrapIfNeeded()
+	if balance := operations.CheckBalance(); !balance.IsBalanced() {
+		t.Fatalf("Not balanced after wrapping: %+v", balance)
+	}
+	if !operations.isWrapped() {
+		t.Fatalf("Not wrapped")
+	}
+	ops := *operations
+	if len(ops) != 11 || ops[0].Operand != "q" || ops[1].Operand != "q" || ops[8].Operand != "ET" {
+		t.Errorf("Unexpected wrapped operations: %s", operations.Bytes())
+	}
+
+	// Balanced and wrapped operations are left unchanged.
+	n := len(ops)
+	operations.WrapIfNeeded()
+	if len(*operations) != n {
+		t.Errorf("Wrapped operations changed")
+	}
+}
+
+// Test that a watermark added to a page with unbalanced contents (an unclosed q after a cm and an
+// unclosed text object) is drawn with the default transformation, i.e. lands at the expected
+// position only after the page contents are repaired.
+func TestWatermarkUnbalancedPage(t *testing.T) {
+	fixture := "q 0.5 0 0 0.5 100 100 cm BT /F1 12 Tf (Hello) Tj"
+
+	page := model.NewPdfPage()
+	page.MediaBox = &model.PdfRectangle{Urx: 200, Ury: 300}
+	page.AddContentStreamByString(fixture)
+
+	img := &model.Image{Width: 100, Height: 100, BitsPerComponent: 8, ColorComponents: 1,
+		Data: make([]byte, 100*100)}
+	ximg, err := model.NewXObjectImageFromImage(img, nil, NewRawEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	err = page.AddWatermarkImage(ximg, model.WatermarkImageOptions{Alpha: 0.5})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	contents, err := page.GetContentStreams()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(contents) != 4 || contents[1] != fixture {
+		t.Fatalf("Unexpected content streams: %q", contents)
+	}
+	watermark := contents[3]
+
+	// Unrepaired: the watermark is scaled and offset by the fixture's cm.
+	ctm, err := getXObjectCTM(fixture + " " + watermark)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expected := [6]float64{100, 0, 0, 300, 50, 0}
+	if ctm == expected {
+		t.Fatalf("Watermark position not affected by unbalanced contents")
+	}
+
+	// Repaired.
+	all, err := page.GetAllContentStreams()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	ctm, err = getXObjectCTM(all)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if ctm != expected {
+		t.Errorf("Watermark CTM %v != %v", ctm, expected)
+	}
+	operations, err := NewContentStreamParser(all).Parse()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if balance := operations.CheckBalance(); !balance.IsBalanced() {
+		t.Errorf("Contents unbalanced: %+v", balance)
+	}
+
+	// Already repaired contents are not wrapped again.
+	if err := page.WrapContentsIfNeeded(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if contents, _ := page.GetContentStreams(); len(contents) != 4 {
+		t.Errorf("Repaired contents wrapped again: %q", contents)
+	}
+}
+
+// getXObjectCTM returns the current transformation matrix [a b c d e f] at the first Do operator of
+// the content stream `content`.
+func getXObjectCTM(content string) ([6]float64, error) {
+	operations, err := NewContentStreamParser(content).Parse()
+	if err != nil {
+		return [6]float64{}, err
+	}
+
+	ctm := [6]float64{1, 0, 0, 1, 0, 0}
+	var stack [][6]float64
+	for _, op := range *operations {
+		switch op.Operand {
+		case "q":
+			stack = append(stack, ctm)
+		case "Q":
+			if len(stack) > 0 {
+				ctm = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+		case "cm":
+			var m [6]float64
+			for i, param := range op.Params {
+				switch t := param.(type) {
+				case *PdfObjectInteger:
+					m[i] = float64(*t)
+				case *PdfObjectFloat:
+					m[i] = float64(*t)
+				}
+			}
+			ctm = [6]float64{
+				m[0]*ctm[0] + m[1]*ctm[2],
+				m[0]*ctm[1] + m[1]*ctm[3],
+				m[2]*ctm[0] + m[3]*ctm[2],
+				m[2]*ctm[1] + m[3]*ctm[3],
+				m[4]*ctm[0] + m[5]*ctm[2] + ctm[4],
+				m[4]*ctm[1] + m[5]*ctm[3] + ctm[5],
+			}
+		case "Do":
+			return ctm, nil
+		}
+	}
+	return ctm, nil
+}
+
+// Test that an inline image and an image XObject with the same (abbreviated) entries load as the
+// same image, with BitsPerComponent missing.
+func TestInlineImageMatchesXObject(t *testing.T) {
+	parser := NewContentStreamParser("q BI /W 2 /H 1 /CS /RGB ID abcdef EI Q")
+	ops, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(*ops) != 3 || len((*ops)[1].Params) != 1 {
+		t.Fatalf("Unexpected operations: %v", *ops)
+	}
+	inline, ok := (*ops)[1].Params[0].(*ContentStreamInlineImage)
+	if !ok {
+		t.Fatalf("Not an inline image: %T", (*ops)[1].Params[0])
+	}
+	inlineImg, err := inline.ToImage(nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	stream, err := MakeStream([]byte("abcdef"), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	stream.Set("Width", MakeInteger(2))
+	stream.Set("Height", MakeInteger(1))
+	stream.Set("ColorSpace", MakeName("DeviceRGB"))
+	ximg, err := model.NewXObjectImageFromStream(stream)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	img, err := ximg.ToImage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	for _, im := range []*model.Image{inlineImg, img} {
+		if im.Width != 2 || im.Height != 1 || im.BitsPerComponent != 8 || im.ColorComponents != 3 ||
+			string(im.Data) != "abcdef" {
+			t.Errorf("Unexpected image: %+v", *im)
+		}
+	}
+}
+
+// Test that content with many transformation matrices reads back exactly by default, and with
+// rounded reals reads back within the precision of the written reals, does not drift when written
+// again, and is smaller than with the fixed 6 decimal formatting used before.
+func TestMatrixRoundTrip(t *testing.T) {
+	const digits = 6
+
+	rnd := rand.New(rand.NewSource(1))
+	cc := NewContentCreator()
+	var values []float64
+	fixedSize := 0
+	for i := 0; i < 200; i++ {
+		// Rotation and scaling, with scale factors from 1e-4 to 1e4, and a translation.
+		angle := rnd.Float64() * 2 * math.Pi
+		scale := math.Pow(10, rnd.Float64()*8-4)
+		m := []float64{
+			scale * math.Cos(angle), scale * math.Sin(angle), -scale * math.Sin(angle),
+			scale * math.Cos(angle), rnd.Float64() * 1000, rnd.Float64() * 1000,
+		}
+		cc.Add_cm(m[0], m[1], m[2], m[3], m[4], m[5])
+		values = append(values, m...)
+		fixedSize += len(fmt.Sprintf("%f %f %f %f %f %f cm\n", m[0], m[1], m[2], m[3], m[4], m[5]))
+	}
+
+	check := func(data []byte, maxError float64) *ContentStreamOperations {
+		ops, err := NewContentStreamParser(string(data)).Parse()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if len(*ops) != 200 {
+			t.Fatalf("%d operations, expected 200", len(*ops))
+		}
+		for i, op := range *ops {
+			arr := PdfObjectArray(op.Params)
+			params, err := arr.ToFloat64Array()
+			if err != nil || len(params) != 6 {
+				t.Fatalf("Invalid cm operands %v", op.Params)
+			}
+			for j, v := range params {
+				expected := values[6*i+j]
+				if math.Abs(v-expected) > maxError*math.Abs(expected) {
+					t.Errorf("cm %d operand %d: %v != %v", i, j, v, expected)
+				}
+			}
+		}
+		return ops
+	}
+
+	check(cc.Bytes(), 0)
+
+	cc.SetFloatPrecision(digits)
+	data := cc.Bytes()
+	if len(data) >= fixedSize {
+		t.Errorf("Size %d not smaller than with fixed formatting (%d)", len(data), fixedSize)
+	}
+	ops := check(data, 0.5*math.Pow(10, 1-digits))
+	if again := ops.Bytes(); string(again) != string(data) {
+		t.Errorf("Written content changed when written again")
+	}
+}
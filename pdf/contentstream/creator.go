@@ -13,6 +13,9 @@ import (
 
 type ContentCreator struct {
 	operands ContentStreamOperations
+
+	// Maximum number of significant digits of the real operands written, 0 if not limited.
+	floatPrecision int
 }
 
 func NewContentCreator() *ContentCreator {
@@ -29,12 +32,21 @@ func (this *ContentCreator) Operations() *ContentStreamOperations {
 // Convert a set of content stream operations to a content stream byte presentation, i.e. the kind that can be
 // stored as a PDF stream or string format.
 func (this *ContentCreator) Bytes() []byte {
-	return this.operands.Bytes()
+	return this.operands.bytesWithFloatPrecision(this.floatPrecision)
 }
 
 // Same as Bytes() except returns as a string for convenience.
 func (this *ContentCreator) String() string {
-	return string(this.operands.Bytes())
+	return string(this.Bytes())
+}
+
+// SetFloatPrecision sets the maximum number of significant digits of the real operands written by
+// Bytes, e.g. 6 for compact transformation matrices.  By default (0) reals are not rounded.
+func (this *ContentCreator) SetFloatPrecision(digits int) {
+	if digits < 0 {
+		digits = 0
+	}
+	this.floatPrecision = digits
 }
 
 /* Graphics state operators. */
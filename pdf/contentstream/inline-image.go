@@ -232,64 +232,23 @@ func (this *ContentStreamInlineImage) ToImage(resources *model.PdfPageResources)
 		return nil, err
 	}
 
-	image := &model.Image{}
-
-	// Height.
-	if this.Height == nil {
-		return nil, errors.New("Height attribute missing")
-	}
-	height, ok := this.Height.(*core.PdfObjectInteger)
-	if !ok {
-		return nil, errors.New("Invalid height")
-	}
-	image.Height = int64(*height)
-
-	// Width.
-	if this.Width == nil {
-		return nil, errors.New("Width attribute missing")
-	}
-	width, ok := this.Width.(*core.PdfObjectInteger)
-	if !ok {
-		return nil, errors.New("Invalid width")
-	}
-	image.Width = int64(*width)
-
-	// Image mask?
-	isMask, err := this.IsMask()
+	params, err := core.NewImageParamsFromDict(this.toDict())
 	if err != nil {
 		return nil, err
 	}
 
-	if isMask {
-		// Masks are grayscale 1bpc.
-		image.BitsPerComponent = 1
-		image.ColorComponents = 1
-	} else {
-		// BPC.
-		if this.BitsPerComponent == nil {
-			common.Log.Debug("Inline Bits per component missing - assuming 8")
-			image.BitsPerComponent = 8
-		} else {
-			bpc, ok := this.BitsPerComponent.(*core.PdfObjectInteger)
-			if !ok {
-				common.Log.Debug("Error invalid bits per component value, type %T", this.BitsPerComponent)
-				return nil, errors.New("BPC Type error")
-			}
-			image.BitsPerComponent = int64(*bpc)
-		}
-
-		// Color components.
-		if this.ColorSpace != nil {
-			cs, err := this.GetColorSpace(resources)
-			if err != nil {
-				return nil, err
-			}
-			image.ColorComponents = cs.GetNumComponents()
-		} else {
-			// Default gray if not specified.
-			common.Log.Debug("Inline Image colorspace not specified - assuming 1 color component")
-			image.ColorComponents = 1
+	image := &model.Image{}
+	image.Width = params.Width
+	image.Height = params.Height
+	image.BitsPerComponent = params.BitsPerComponent
+	image.ColorComponents = params.ColorComponents
+	if image.ColorComponents == 0 {
+		// Named colorspace in the page resources.
+		cs, err := this.GetColorSpace(resources)
+		if err != nil {
+			return nil, err
 		}
+		image.ColorComponents = cs.GetNumComponents()
 	}
 
 	image.Data = decoded
@@ -297,6 +256,22 @@ func (this *ContentStreamInlineImage) ToImage(resources *model.PdfPageResources)
 	return image, nil
 }
 
+// toDict returns the image dictionary of the inline image with the abbreviated keys.
+func (this *ContentStreamInlineImage) toDict() *core.PdfObjectDictionary {
+	dict := core.MakeDict()
+	dict.SetIfNotNil("BPC", this.BitsPerComponent)
+	dict.SetIfNotNil("CS", this.ColorSpace)
+	dict.SetIfNotNil("D", this.Decode)
+	dict.SetIfNotNil("DP", this.DecodeParms)
+	dict.SetIfNotNil("F", this.Filter)
+	dict.SetIfNotNil("H", this.Height)
+	dict.SetIfNotNil("IM", this.ImageMask)
+	dict.SetIfNotNil("Intent", this.Intent)
+	dict.SetIfNotNil("I", this.Interpolate)
+	dict.SetIfNotNil("W", this.Width)
+	return dict
+}
+
 // Parse an inline image from a content stream, both read its properties and binary data.
 // When called, "BI" has already been read from the stream.  This function
 // finishes reading through "EI" and then returns the ContentStreamInlineImage.
@@ -21,13 +21,30 @@ import (
 // Content stream parser.
 type ContentStreamParser struct {
 	reader *bufio.Reader
+	opts   ContentStreamParserOpts
+}
+
+// ContentStreamParserOpts are the options of NewContentStreamParserWithOpts.
+type ContentStreamParserOpts struct {
+	// StrictNumbers makes the parser reject numbers in exponential format such as 1.0E-5, which
+	// the PDF syntax does not allow (7.3.3).  By default they are read as real numbers.
+	StrictNumbers bool
 }
 
 // Create a new instance of the content stream parser from an input content
 // stream string.
 func NewContentStreamParser(contentStr string) *ContentStreamParser {
+	return NewContentStreamParserWithOpts(contentStr, nil)
+}
+
+// NewContentStreamParserWithOpts creates a content stream parser for `contentStr` as
+// NewContentStreamParser, with options `opts`, which can be nil for the defaults.
+func NewContentStreamParserWithOpts(contentStr string, opts *ContentStreamParserOpts) *ContentStreamParser {
 	// Each command has parameters and an operand (command).
 	parser := ContentStreamParser{}
+	if opts != nil {
+		parser.opts = *opts
+	}
 
 	buffer := bytes.NewBufferString(contentStr + "\n") // Add newline at end to get last operand without EOF error.
 	parser.reader = bufio.NewReader(buffer)
@@ -187,11 +204,12 @@ func (this *ContentStreamParser) parseName() (PdfObjectName, error) {
 // A conforming writer shall not use the PostScript syntax for numbers
 // with non-decimal radices (such as 16#FFFE) or in exponential format
 // (such as 6.02E23).
-// Nonetheless, we sometimes get numbers with exponential format, so
-// we will support it in the reader (no confusion with other types, so
-// no compromise).
+// Nonetheless, we sometimes get numbers with exponential format (e.g. 1.0E-5),
+// so we support it in the reader unless strict number parsing is enabled
+// (see ContentStreamParserOpts).
 func (this *ContentStreamParser) parseNumber() (PdfObject, error) {
 	isFloat := false
+	hasExponent := false
 	allowSigns := true
 	numStr := ""
 	for {
@@ -215,21 +233,33 @@ func (this *ContentStreamParser) parseNumber() (PdfObject, error) {
 		} else if IsDecimalDigit(bb[0]) {
 			b, _ := this.reader.ReadByte()
 			numStr += string(b)
+			allowSigns = false
 		} else if bb[0] == '.' {
 			b, _ := this.reader.ReadByte()
 			numStr += string(b)
 			isFloat = true
-		} else if bb[0] == 'e' {
-			// Exponential number format.
+			allowSigns = false
+		} else if (bb[0] == 'e' || bb[0] == 'E') && !hasExponent && len(numStr) > 0 {
+			// Exponential number format, if the exponent has digits.
+			peek, _ := this.reader.Peek(3)
+			if !IsExponent(peek) {
+				break
+			}
 			b, _ := this.reader.ReadByte()
 			numStr += string(b)
 			isFloat = true
+			hasExponent = true
 			allowSigns = true
 		} else {
 			break
 		}
 	}
 
+	if hasExponent && this.opts.StrictNumbers {
+		common.Log.Debug("ERROR: Number in exponential format %q (strict mode)", numStr)
+		return nil, fmt.Errorf("Invalid number %q: exponential format not allowed", numStr)
+	}
+
 	if isFloat {
 		fVal, err := strconv.ParseFloat(numStr, 64)
 		if err != nil {
@@ -552,7 +582,7 @@ func (this *ContentStreamParser) parseObject() (PdfObject, error, bool) {
 			common.Log.Trace("->Array!")
 			arr, err := this.parseArray()
 			return &arr, err, false
-		} else if IsFloatDigit(bb[0]) || (bb[0] == '-' && IsFloatDigit(bb[1])) {
+		} else if IsFloatDigit(bb[0]) || ((bb[0] == '-' || bb[0] == '+') && IsFloatDigit(bb[1])) {
 			common.Log.Trace("->Number!")
 			number, err := this.parseNumber()
 			return number, err, false
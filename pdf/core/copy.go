@@ -0,0 +1,133 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package core
+
+import (
+	"github.com/unidoc/unidoc/common"
+)
+
+// DeepCopy returns a copy of `obj` and of the objects it contains, e.g. to keep the original of a
+// loaded document while modifying it.  The aliasing rules are:
+//   - Dictionaries, arrays, names, numbers, strings, booleans and nulls are copied by value, so
+//     modifying the copy never modifies the original and vice versa.  Dictionary key order is kept.
+//   - Indirect objects and streams contained in `obj` are copied once each, keeping their object
+//     and generation numbers: an object reached several times (or through a cycle) is copied to a
+//     single object reached the same way in the copy.
+//   - References (PdfObjectReference) are copied as references, not resolved; the objects they
+//     refer to are not copied.
+//   - The Stream data of a copied stream is shared with the original until either is modified
+//     through MutableStream, which first gives the stream its own copy of the data.  Assigning a new
+//     slice to Stream is always safe, but writing into the bytes of Stream directly modifies both
+//     the original and the copy.  The decoded data cache is not copied.
+//
+// `obj` and the objects it contains are only read, so they can be copied concurrently.
+func DeepCopy(obj PdfObject) PdfObject {
+	return deepCopy(obj, map[PdfObject]PdfObject{})
+}
+
+// deepCopy copies `obj`, with the copies of the indirect objects and streams made so far in
+// `copies`.
+func deepCopy(obj PdfObject, copies map[PdfObject]PdfObject) PdfObject {
+	if obj == nil {
+		return nil
+	}
+	if copied, has := copies[obj]; has {
+		return copied
+	}
+
+	switch t := obj.(type) {
+	case *PdfIndirectObject:
+		// Registered before copying the contents, which may refer back to the object.
+		ind := &PdfIndirectObject{PdfObjectReference: t.PdfObjectReference}
+		copies[t] = ind
+		ind.PdfObject = deepCopy(t.PdfObject, copies)
+		return ind
+	case *PdfObjectStream:
+		stream := &PdfObjectStream{
+			PdfObjectReference:  t.PdfObjectReference,
+			PdfObjectDictionary: MakeDict(),
+			Stream:              t.Stream,
+			parser:              t.parser,
+			decoding:            t.decoding,
+			lengthSource:        t.lengthSource,
+			encrypted:           t.encrypted,
+		}
+		if t.ownsStream() {
+			// The original may modify its data in place, so it is not shared.
+			stream.Stream = append([]byte(nil), t.Stream...)
+			stream.ownStream = stream.Stream
+		}
+		copies[t] = stream
+		if t.PdfObjectDictionary != nil {
+			deepCopyDict(t.PdfObjectDictionary, stream.PdfObjectDictionary, copies)
+		}
+		return stream
+	case *PdfObjectDictionary:
+		dict := MakeDict()
+		deepCopyDict(t, dict, copies)
+		return dict
+	case *PdfObjectArray:
+		arr := make(PdfObjectArray, len(*t))
+		for i, item := range *t {
+			arr[i] = deepCopy(item, copies)
+		}
+		return &arr
+	case *PdfObjectString:
+		return MakeString(string(*t))
+	case *PdfObjectName:
+		return MakeName(string(*t))
+	case *PdfObjectInteger:
+		return MakeInteger(int64(*t))
+	case *PdfObjectFloat:
+		return MakeFloat(float64(*t))
+	case *PdfObjectBool:
+		return MakeBool(bool(*t))
+	case *PdfObjectNull:
+		return MakeNull()
+	case *PdfObjectReference:
+		ref := *t
+		return &ref
+	}
+	common.Log.Debug("ERROR: DeepCopy of unexpected object type %T", obj)
+	return obj
+}
+
+// deepCopyDict copies the entries of dictionary `src` into `dst`.
+func deepCopyDict(src, dst *PdfObjectDictionary, copies map[PdfObject]PdfObject) {
+	for _, key := range src.Keys() {
+		dst.Set(key, deepCopy(src.Get(key), copies))
+	}
+}
+
+// MutableStream returns the Stream data for modifying it in place.  As the data may be shared with
+// a stream copied by DeepCopy, the stream first gets its own copy of the data, so that the other
+// stream is not modified; the copy is kept for later calls while Stream is unchanged.  Data left
+// encrypted by ReadOnlyDecryption (ParserOpts) is replaced with its decrypted form.  Decoded data
+// cached for the stream is dropped.
+func (stream *PdfObjectStream) MutableStream() []byte {
+	if stream.encryptedData() != nil {
+		if err := stream.decryptData(); err != nil {
+			common.Log.Debug("ERROR: Unable to decrypt stream %d: %v", stream.ObjectNumber, err)
+		}
+	}
+	if !stream.ownsStream() {
+		stream.Stream = append([]byte(nil), stream.Stream...)
+		stream.ownStream = stream.Stream
+	}
+	if stream.decoding != nil {
+		stream.decoding.invalidate(stream)
+	}
+	return stream.Stream
+}
+
+// ownsStream returns true if Stream is the data allocated for the stream by MutableStream.
+func (stream *PdfObjectStream) ownsStream() bool {
+	own := stream.ownStream
+	if len(own) == 0 || len(own) != len(stream.Stream) {
+		return false
+	}
+	return &own[0] == &stream.Stream[0]
+}
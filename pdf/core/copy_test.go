@@ -0,0 +1,144 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+// makeCatalogTree returns a catalog with a page tree of one page, whose Parent refers back to the
+// page tree node, and the content streams of the page.
+func makeCatalogTree() (*PdfIndirectObject, *PdfObjectStream, *PdfObjectStream) {
+	content1 := &PdfObjectStream{PdfObjectDictionary: MakeDict(), Stream: []byte("BT (one) Tj ET")}
+	content1.Set("Length", MakeInteger(14))
+	content2 := &PdfObjectStream{PdfObjectDictionary: MakeDict(), Stream: []byte("BT (two) Tj ET")}
+	content2.Set("Length", MakeInteger(14))
+
+	pages := MakeIndirectObject(MakeDict())
+	pages.ObjectNumber = 2
+	page := MakeIndirectObject(MakeDict())
+	page.ObjectNumber = 3
+	pageDict := page.PdfObject.(*PdfObjectDictionary)
+	pageDict.Set("Type", MakeName("Page"))
+	pageDict.Set("Parent", pages)
+	pageDict.Set("MediaBox", MakeArrayFromFloats([]float64{0, 0, 612, 792}))
+	pageDict.Set("Contents", MakeArray(content1, content2))
+	pagesDict := pages.PdfObject.(*PdfObjectDictionary)
+	pagesDict.Set("Type", MakeName("Pages"))
+	pagesDict.Set("Kids", MakeArray(page))
+	pagesDict.Set("Count", MakeInteger(1))
+
+	catalog := MakeIndirectObject(MakeDict())
+	catalog.ObjectNumber = 1
+	catalogDict := catalog.PdfObject.(*PdfObjectDictionary)
+	catalogDict.Set("Type", MakeName("Catalog"))
+	catalogDict.Set("Pages", pages)
+	catalogDict.Set("Metadata", &PdfObjectReference{ObjectNumber: 10})
+	return catalog, content1, content2
+}
+
+// Test that modifying a deep copy of a catalog leaves the original untouched, with the stream data
+// shared until modified.
+func TestDeepCopy(t *testing.T) {
+	catalog, content1, content2 := makeCatalogTree()
+	original := catalog.String()
+	originalTree := catalog.PdfObject.DefaultWriteString()
+
+	copied, ok := DeepCopy(catalog).(*PdfIndirectObject)
+	if !ok || copied == catalog || copied.ObjectNumber != 1 {
+		t.Fatalf("Copy %v", copied)
+	}
+	if s := copied.PdfObject.DefaultWriteString(); s != originalTree {
+		t.Errorf("Copy %s, expected %s", s, originalTree)
+	}
+
+	copiedPages := copied.PdfObject.(*PdfObjectDictionary).Get("Pages").(*PdfIndirectObject)
+	copiedPage := (*copiedPages.PdfObject.(*PdfObjectDictionary).Get("Kids").(*PdfObjectArray))[0].(*PdfIndirectObject)
+	copiedPageDict := copiedPage.PdfObject.(*PdfObjectDictionary)
+	if copiedPageDict.Get("Parent") != copiedPages {
+		t.Errorf("Parent cycle not kept in the copy")
+	}
+	contents := *copiedPageDict.Get("Contents").(*PdfObjectArray)
+	copied1 := contents[0].(*PdfObjectStream)
+	copied2 := contents[1].(*PdfObjectStream)
+	if copied1 == content1 || &copied1.Stream[0] != &content1.Stream[0] {
+		t.Errorf("Stream data not shared")
+	}
+
+	// Modify the copy.
+	copied.PdfObject.(*PdfObjectDictionary).Set("Lang", MakeString("en"))
+	*copiedPageDict.Get("Type").(*PdfObjectName) = "Modified"
+	copiedPageDict.Get("MediaBox").(*PdfObjectArray).Append(MakeInteger(0))
+	data := copied2.MutableStream()
+	copy(data, "BT (TWO)")
+	copied2.Set("Length", MakeInteger(99))
+
+	if s := catalog.String(); s != original {
+		t.Errorf("Original %s modified", s)
+	}
+	if s := catalog.PdfObject.DefaultWriteString(); s != originalTree {
+		t.Errorf("Original %s modified, expected %s", s, originalTree)
+	}
+	if string(content2.Stream) != "BT (two) Tj ET" || string(copied2.Stream) != "BT (TWO) Tj ET" {
+		t.Errorf("Stream data %q, copy %q", content2.Stream, copied2.Stream)
+	}
+	if length, ok := content2.Get("Length").(*PdfObjectInteger); !ok || *length != 14 {
+		t.Errorf("Original Length %v", content2.Get("Length"))
+	}
+	if &copied1.Stream[0] != &content1.Stream[0] {
+		t.Errorf("Unmodified stream data not shared")
+	}
+
+	// Modifying the original after copying does not modify the copy either.
+	copy(content1.MutableStream(), "ET")
+	if string(copied1.Stream) != "BT (one) Tj ET" {
+		t.Errorf("Copy modified with the original: %q", copied1.Stream)
+	}
+
+	// Nor does modifying it again after copying it once more, as the data it modifies in place is
+	// not shared.
+	copied3 := DeepCopy(content1).(*PdfObjectStream)
+	copy(content1.MutableStream(), "XX")
+	if string(copied3.Stream) != "ET (one) Tj ET" || string(content1.Stream) != "XX (one) Tj ET" {
+		t.Errorf("Stream data %q, copy %q", content1.Stream, copied3.Stream)
+	}
+}
+
+// Test that encrypting and decrypting a copied stream leaves the stream data of the original
+// untouched, with the RC4 and AES crypt filters.
+func TestDeepCopyCrypt(t *testing.T) {
+	for _, cf := range []CryptFilter{NewCryptFilterV2(16), NewCryptFilterAESV2()} {
+		crypter := &PdfCrypt{V: 4, R: 4, Length: 128}
+		crypter.CryptFilters = CryptFilters{StandardCryptFilter: cf}
+		crypter.StreamFilter = StandardCryptFilter
+		crypter.StringFilter = StandardCryptFilter
+		crypter.EncryptionKey = []byte("0123456789abcdef")
+		crypter.EncryptedObjects = map[PdfObject]bool{}
+		crypter.DecryptedObjects = map[PdfObject]bool{}
+
+		// Spare capacity, which padding must not write into either.
+		data := make([]byte, 14, 64)
+		copy(data, "BT (one) Tj ET")
+		original := &PdfObjectStream{PdfObjectDictionary: MakeDict(), Stream: data}
+		original.ObjectNumber = 5
+		copied := DeepCopy(original).(*PdfObjectStream)
+		if err := crypter.Encrypt(copied, 0, 0); err != nil {
+			t.Fatalf("%s: Error: %v", cf.Cfm, err)
+		}
+		if string(data[:cap(data)]) != "BT (one) Tj ET"+string(make([]byte, 50)) {
+			t.Errorf("%s: Original modified by encryption: %q", cf.Cfm, data[:cap(data)])
+		}
+		encrypted := append([]byte(nil), copied.Stream...)
+		copied2 := DeepCopy(copied).(*PdfObjectStream)
+		if err := crypter.Decrypt(copied2, 0, 0); err != nil {
+			t.Fatalf("%s: Error: %v", cf.Cfm, err)
+		}
+		if string(copied2.Stream) != "BT (one) Tj ET" || !bytes.Equal(copied.Stream, encrypted) {
+			t.Errorf("%s: Decrypted %q, encrypted copy modified", cf.Cfm, copied2.Stream)
+		}
+	}
+}
@@ -9,7 +9,9 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/unidoc/unidoc/common"
@@ -45,6 +47,90 @@ type XrefObject struct {
 // TODO: Consider changing to a slice, so can maintain the object order without sorting when analyzing.
 type XrefTable map[int]XrefObject
 
+// DuplicateObjectPolicy determines which entry is used when a cross-reference section has more than
+// one entry for the same object number.  This only occurs in malformed files: object numbers are
+// legally redefined by the sections of later revisions (incremental updates), which always take
+// precedence over the sections of earlier revisions.
+type DuplicateObjectPolicy int
+
+const (
+	// DuplicateObjectLaterWins uses the entry appearing last in the section (default).
+	DuplicateObjectLaterWins DuplicateObjectPolicy = iota
+
+	// DuplicateObjectEarlierWins uses the entry appearing first in the section.
+	DuplicateObjectEarlierWins
+)
+
+// duplicateObjectPolicy returns the policy for object numbers with more than one entry in a
+// cross-reference section, see ParserOpts.DuplicateObjects.
+func (parser *PdfParser) duplicateObjectPolicy() DuplicateObjectPolicy {
+	if parser.decoding == nil {
+		return DuplicateObjectLaterWins
+	}
+	return parser.decoding.opts.DuplicateObjects
+}
+
+// xrefFree is the type of free entries in an xrefSection.
+const xrefFree = -1
+
+// xrefSection holds the entries of a cross-reference section by object number while it is parsed.
+type xrefSection map[int]XrefObject
+
+// addSectionEntry adds entry `xref` to cross-reference section `section`.  If the section already
+// has an entry for the object number, the duplicate is resolved by the duplicate object policy and
+// recorded in the load errors of the parser.
+func (parser *PdfParser) addSectionEntry(section xrefSection, xref XrefObject) {
+	prev, dup := section[xref.objectNumber]
+	if dup {
+		err := fmt.Errorf("object %d has more than one cross-reference entry: %s and %s",
+			xref.objectNumber, describeXrefEntry(prev), describeXrefEntry(xref))
+		common.Log.Warning("%v", err)
+		parser.duplicates++
+		parser.loadErrors = append(parser.loadErrors, err)
+		if parser.duplicateObjectPolicy() == DuplicateObjectEarlierWins {
+			return
+		}
+	}
+	section[xref.objectNumber] = xref
+}
+
+// loadSection merges the entries of cross-reference section `section` into the xref table and the
+// free objects.  The sections are loaded from the newest revision, whose entries take precedence
+// unless an older in-use entry has a higher generation number.
+func (parser *PdfParser) loadSection(section xrefSection) {
+	if parser.xrefs == nil {
+		parser.xrefs = make(XrefTable)
+	}
+	for objNum, xref := range section {
+		if xref.xtype == xrefFree {
+			parser.addFreeObject(objNum, xref.generation)
+			continue
+		}
+		if x, ok := parser.xrefs[objNum]; !ok || xref.generation > x.generation {
+			parser.xrefs[objNum] = xref
+		}
+	}
+}
+
+// describeXrefEntry returns a description of cross-reference entry `xref` for messages.
+func describeXrefEntry(xref XrefObject) string {
+	switch xref.xtype {
+	case xrefFree:
+		return fmt.Sprintf("free (gen %d)", xref.generation)
+	case XREF_OBJECT_STREAM:
+		return fmt.Sprintf("index %d of object stream %d", xref.osObjIndex, xref.osObjNumber)
+	}
+	return fmt.Sprintf("offset %d (gen %d)", xref.offset, xref.generation)
+}
+
+// ParserStats are statistics of the objects of a file loaded by a parser, for diagnostics.
+type ParserStats struct {
+	Objects      int // Object numbers in use.
+	Duplicates   int // Extra entries for object numbers with more than one entry in a cross-reference section.
+	FreeEntries  int // Object numbers free and not in use, excluding object number 0 (see GetFreeObjects).
+	FreeListOnly int // Object numbers free in a revision but still in use in an older one, and loaded from it.
+}
+
 // ObjectStream represents an object stream's information which can contain multiple indirect objects.
 // The information specifies the number of objects and has information about offset locations for
 // each object.
@@ -115,6 +201,16 @@ func (parser *PdfParser) lookupObjectViaOS(sobjNumber int, objNum int) (PdfObjec
 
 		common.Log.Trace("Decoded: %s", ds)
 
+		// Each object takes at least one byte of the decoded data.
+		n, err := ToInt("object stream N", int64(*N), 0, int64(len(ds)))
+		if err != nil {
+			return nil, err
+		}
+		first, err := ToInt("object stream First", int64(*firstOffset), 0, int64(len(ds)))
+		if err != nil {
+			return nil, err
+		}
+
 		// Temporarily change the reader object to this decoded buffer.
 		// Change back afterwards.
 		bakOffset := parser.GetFileOffset()
@@ -127,7 +223,7 @@ func (parser *PdfParser) lookupObjectViaOS(sobjNumber int, objNum int) (PdfObjec
 		// Load the offset map (relative to the beginning of the stream...)
 		offsets := map[int]int64{}
 		// Object list and offsets.
-		for i := 0; i < int(*N); i++ {
+		for i := 0; i < n; i++ {
 			parser.skipSpaces()
 			// Object number.
 			obj, err := parser.parseNumber()
@@ -151,10 +247,18 @@ func (parser *PdfParser) lookupObjectViaOS(sobjNumber int, objNum int) (PdfObjec
 			}
 
 			common.Log.Trace("obj %d offset %d", *onum, *offset)
-			offsets[int(*onum)] = int64(*firstOffset + *offset)
+			objNum, err := ToInt("object number", int64(*onum), 0, MaxInt)
+			if err != nil {
+				return nil, err
+			}
+			off, err := ToInt("object stream offset", int64(*offset), 0, int64(len(ds)-first))
+			if err != nil {
+				return nil, err
+			}
+			offsets[objNum] = int64(first + off)
 		}
 
-		objstm = ObjectStream{N: int(*N), ds: ds, offsets: offsets}
+		objstm = ObjectStream{N: n, ds: ds, offsets: offsets}
 		parser.objstms[sobjNumber] = objstm
 	} else {
 		// Temporarily change the reader object to this decoded buffer.
@@ -331,7 +435,12 @@ func (parser *PdfParser) lookupByNumber(objNumber int, attemptRepairs bool) (Pdf
 // LookupByReference looks up a PdfObject by a reference.
 func (parser *PdfParser) LookupByReference(ref PdfObjectReference) (PdfObject, error) {
 	common.Log.Trace("Looking up reference %s", ref.String())
-	return parser.LookupByNumber(int(ref.ObjectNumber))
+	// A truncated object number would refer to another object on 32-bit platforms.
+	objNum, err := ToInt("object number", ref.ObjectNumber, -MaxInt-1, MaxInt)
+	if err != nil {
+		return nil, err
+	}
+	return parser.LookupByNumber(objNum)
 }
 
 // Trace traces a PdfObject to direct object, looking up and resolving references as needed (unlike TraceToDirect).
@@ -365,6 +474,75 @@ func (parser *PdfParser) Trace(obj PdfObject) (PdfObject, error) {
 	return o, nil
 }
 
+// GetObjectByteSpan returns the byte span of object number `objNum` in the file: the offset of the
+// "N G obj" header, as declared by the cross-reference table, and the offset just after the
+// closing "endobj" keyword.  For objects compressed in an object stream, the span of the
+// containing object stream is returned with `inObjStm` true.  An error is returned if the object
+// is not in the cross-reference table or the declared offset does not point to the object.
+func (parser *PdfParser) GetObjectByteSpan(objNum int) (start, end int64, inObjStm bool, err error) {
+	xref, ok := parser.xrefs[objNum]
+	if !ok {
+		return 0, 0, false, fmt.Errorf("object %d not in xref table", objNum)
+	}
+	if xref.xtype == XREF_OBJECT_STREAM {
+		if xref.osObjNumber == objNum {
+			return 0, 0, true, errors.New("Xref circular reference")
+		}
+		osXref, ok := parser.xrefs[xref.osObjNumber]
+		if !ok || osXref.xtype != XREF_TABLE_ENTRY {
+			return 0, 0, true, fmt.Errorf("object stream %d of object %d not in xref table", xref.osObjNumber, objNum)
+		}
+		start, end, _, err = parser.GetObjectByteSpan(xref.osObjNumber)
+		return start, end, true, err
+	}
+
+	offset := parser.GetFileOffset()
+	defer parser.SetFileOffset(offset)
+
+	// The header must be at the declared offset, so that the span can be overwritten in place.
+	parser.SetFileOffset(xref.offset)
+	bb, _ := parser.reader.Peek(20)
+	result := reIndirectObject.FindSubmatch(bb)
+	if len(result) < 3 || !bytes.HasPrefix(bb, result[0]) {
+		return 0, 0, false, fmt.Errorf("object %d not at declared offset %d", objNum, xref.offset)
+	}
+	if num, _ := strconv.Atoi(string(result[1])); num != objNum {
+		return 0, 0, false, fmt.Errorf("object %d not at declared offset %d", objNum, xref.offset)
+	}
+
+	// Parse the object to skip over its content, which may contain the endobj keyword in strings
+	// or stream data.  Stream objects are parsed up to after endstream.
+	obj, err := parser.ParseIndirectObject()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if _, isStream := obj.(*PdfObjectStream); !isStream {
+		parser.SetFileOffset(xref.offset)
+		parser.reader.Discard(len(result[0]))
+		parser.skipComments()
+		if _, err := parser.parseObject(); err != nil {
+			return 0, 0, false, err
+		}
+	}
+
+	for {
+		parser.skipSpaces()
+		bb, err := parser.reader.Peek(6)
+		if err != nil {
+			return 0, 0, false, fmt.Errorf("endobj of object %d not found", objNum)
+		}
+		if bb[0] == '%' {
+			parser.skipComments()
+			continue
+		}
+		if string(bb) != "endobj" {
+			return 0, 0, false, fmt.Errorf("endobj of object %d not found", objNum)
+		}
+		break
+	}
+	return xref.offset, parser.GetFileOffset() + 6, false, nil
+}
+
 func printXrefTable(xrefTable XrefTable) {
 	common.Log.Debug("=X=X=X=")
 	common.Log.Debug("Xref table:")
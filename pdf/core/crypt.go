@@ -20,10 +20,21 @@ import (
 	"hash"
 	"io"
 	"math"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/unidoc/unidoc/common"
 )
 
+// DefaultCryptMaxNesting is the default maximum nesting depth of arrays and dictionaries within an
+// object that is encrypted or decrypted.
+const DefaultCryptMaxNesting = 10000
+
+// ErrCryptNestingTooDeep is returned when encrypting or decrypting an object whose arrays and
+// dictionaries are nested deeper than PdfCrypt.MaxNesting.
+var ErrCryptNestingTooDeep = errors.New("Objects nested too deep for encryption")
+
 // PdfCrypt provides PDF encryption/decryption support.
 // The PDF standard supports encryption of strings and streams (Section 7.6).
 // TODO (v3): Consider unexporting.
@@ -49,9 +60,23 @@ type PdfCrypt struct {
 	CryptFilters CryptFilters
 	StreamFilter string
 	StringFilter string
+	// Crypt filter of embedded file streams (EFF), e.g. DefEmbeddedFile as written for the public-key
+	// security handler.  StreamFilter applies if empty.
+	EmbeddedFileFilter string
+	// MaxNesting is the maximum nesting depth of arrays and dictionaries within an object that is
+	// encrypted or decrypted, DefaultCryptMaxNesting if not set.  Deeper objects, which only occur
+	// in malicious files, fail with ErrCryptNestingTooDeep.  Indirect objects referred to from an
+	// object do not count towards its depth.
+	MaxNesting int
+	// OperationHook is called after each decryption and encryption of a string or of stream data
+	// (optional).
+	OperationHook OperationHook
 
 	parser *PdfParser
 
+	// Set if authenticated with the owner password.
+	ownerAuthenticated bool
+
 	ivAESZero []byte // a zero buffer used as an initialization vector for AES
 }
 
@@ -274,6 +299,55 @@ func (crypt *PdfCrypt) LoadCryptFilters(ed *PdfObjectDictionary) error {
 		crypt.StreamFilter = string(*stmf)
 	}
 
+	// EFF embedded file streams filter.
+	crypt.EmbeddedFileFilter = ""
+	if eff, ok := ed.Get("EFF").(*PdfObjectName); ok {
+		if _, exists := crypt.CryptFilters[string(*eff)]; !exists {
+			return fmt.Errorf("Crypt filter for EFF not specified in CF dictionary (%s)", *eff)
+		}
+		crypt.EmbeddedFileFilter = string(*eff)
+	}
+
+	return nil
+}
+
+// setV4KeyLength sets Length, the length in bits of the file encryption key (Algorithm 2), from
+// the crypt filters of streams and strings of V 4 encryption: 128 bits for AESV2 and the Length of
+// V2 filters.  The top-level Length is only used for V2 filters without a Length, as writers give
+// it inconsistently (e.g. 40 with AESV2).  Returns an error if the filters need different lengths.
+func (crypt *PdfCrypt) setV4KeyLength() error {
+	length := 0
+	for _, name := range []string{crypt.StreamFilter, crypt.StringFilter, crypt.EmbeddedFileFilter} {
+		filter, has := crypt.CryptFilters[name]
+		if !has || name == "Identity" {
+			continue
+		}
+		filterLength := 0
+		switch filter.Cfm {
+		case CryptFilterAESV2:
+			if filter.Length != 0 && filter.Length != 16 {
+				return fmt.Errorf("AESV2 crypt filter %s with Length %d, expected 16", name, filter.Length)
+			}
+			filterLength = 128
+		case CryptFilterV2:
+			filterLength = 8 * filter.Length
+			if filterLength == 0 {
+				filterLength = crypt.Length
+			}
+		default:
+			continue
+		}
+		if length != 0 && filterLength != length {
+			return fmt.Errorf("Crypt filters with contradictory key lengths (%d and %d bits)", length, filterLength)
+		}
+		length = filterLength
+	}
+
+	if length != 0 && length != crypt.Length {
+		common.Log.Debug("Incompatibility: Encryption Length %d contradicts crypt filters, using %d",
+			crypt.Length, length)
+		crypt.Length = length
+	}
 	return nil
 }
 
@@ -300,6 +374,9 @@ func (crypt *PdfCrypt) SaveCryptFilters(ed *PdfObjectDictionary) error {
 	}
 	ed.Set("StrF", MakeName(crypt.StringFilter))
 	ed.Set("StmF", MakeName(crypt.StreamFilter))
+	if crypt.EmbeddedFileFilter != "" {
+		ed.Set("EFF", MakeName(crypt.EmbeddedFileFilter))
+	}
 	return nil
 }
 
@@ -343,13 +420,19 @@ func PdfCryptMakeNew(parser *PdfParser, ed, trailer *PdfObjectDictionary) (PdfCr
 	if v, ok := ed.Get("V").(*PdfObjectInteger); ok {
 		V := int(*v)
 		crypter.V = V
-		if V >= 1 && V <= 2 {
-			// Default algorithm is V2.
+		if V >= 1 && V <= 3 {
+			// Default algorithm is V2.  The unpublished V=3 algorithm is RC4 with a key of Length
+			// bits as well.
 			crypter.CryptFilters = newCryptFiltersV2(crypter.Length)
 		} else if V >= 4 && V <= 5 {
 			if err := crypter.LoadCryptFilters(ed); err != nil {
 				return crypter, err
 			}
+			if V == 4 {
+				if err := crypter.setV4KeyLength(); err != nil {
+					return crypter, err
+				}
+			}
 		} else {
 			common.Log.Debug("ERROR Unsupported encryption algo V = %d", V)
 			return crypter, errors.New("Unsupported algorithm")
@@ -381,7 +464,11 @@ func PdfCryptMakeNew(parser *PdfParser, ed, trailer *PdfObjectDictionary) (PdfCr
 	crypter.O = []byte(*O)
 
 	U, ok := ed.Get("U").(*PdfObjectString)
-	if !ok {
+	if !ok && crypter.R < 5 {
+		// The owner password can still be authenticated, by O alone (Alg7).
+		common.Log.Debug("Incompatibility: Encrypt dictionary missing U - only the owner password can be authenticated")
+		U = MakeString("")
+	} else if !ok {
 		return crypter, errors.New("Encrypt dictionary missing U")
 	}
 	if crypter.R == 5 || crypter.R == 6 {
@@ -444,9 +531,11 @@ func PdfCryptMakeNew(parser *PdfParser, ed, trailer *PdfObjectDictionary) (PdfCr
 	// Default: empty ID.
 	// Strictly, if file is encrypted, the ID should always be specified
 	// but clearly not everyone is following the specification.
+	// The ID strings (usually hex strings, decoded by the parser) are used as raw bytes in the key
+	// derivation, whatever their length: not necessarily 16 bytes.
 	id0 := PdfObjectString("")
-	if idArray, ok := trailer.Get("ID").(*PdfObjectArray); ok && len(*idArray) >= 1 {
-		id0obj, ok := (*idArray)[0].(*PdfObjectString)
+	if idArray, ok := crypter.traceObject(trailer.Get("ID")).(*PdfObjectArray); ok && len(*idArray) >= 1 {
+		id0obj, ok := crypter.traceObject((*idArray)[0]).(*PdfObjectString)
 		if !ok {
 			return crypter, errors.New("Invalid trailer ID")
 		}
@@ -454,11 +543,69 @@ func PdfCryptMakeNew(parser *PdfParser, ed, trailer *PdfObjectDictionary) (PdfCr
 	} else {
 		common.Log.Debug("Trailer ID array missing or invalid!")
 	}
+	if len(id0) != 16 {
+		common.Log.Debug("Trailer ID[0] length %d (not 16)", len(id0))
+	}
 	crypter.Id0 = string(id0)
 
 	return crypter, nil
 }
 
+// traceObject returns the direct object `obj` refers to, looking up references with the parser if
+// available.
+func (crypt *PdfCrypt) traceObject(obj PdfObject) PdfObject {
+	if ref, ok := obj.(*PdfObjectReference); ok && crypt.parser != nil {
+		resolved, err := crypt.parser.Trace(ref)
+		if err != nil {
+			common.Log.Debug("Unable to resolve %s: %v", ref, err)
+			return nil
+		}
+		return resolved
+	}
+	return TraceToDirectObject(obj)
+}
+
+// KeyLengthBits returns the length in bits of the encryption key of the active scheme: the Length
+// of RC4 encryption (40 to 128 bits), 128 for AESV2 and 256 for AESV3.  For crypt filters (V >= 4)
+// the filter of streams is used, or of strings if streams are not encrypted.  Returns 0 if no
+// encryption is applied (Identity crypt filters).
+func (crypt *PdfCrypt) KeyLengthBits() int {
+	if crypt.V < 4 {
+		if crypt.Length == 0 {
+			return 40
+		}
+		return crypt.Length
+	}
+	if crypt.V >= 5 && len(crypt.CryptFilters) == 0 {
+		return 256
+	}
+
+	filterName := crypt.StreamFilter
+	if filterName == "" || filterName == "Identity" {
+		filterName = crypt.StringFilter
+	}
+	if filterName == "" || filterName == "Identity" {
+		return 0
+	}
+	filter, has := crypt.CryptFilters[filterName]
+	if !has {
+		common.Log.Debug("ERROR: Unknown crypt filter %s", filterName)
+		return 0
+	}
+	switch filter.Cfm {
+	case CryptFilterAESV2:
+		return 128
+	case CryptFilterAESV3:
+		return 256
+	case CryptFilterV2:
+		if filter.Length > 0 {
+			return 8 * filter.Length
+		}
+		return crypt.Length
+	}
+	return 0
+}
+
 // GetAccessPermissions returns the PDF access permissions as an AccessPermissions object.
 func (crypt *PdfCrypt) GetAccessPermissions() AccessPermissions {
 	perms := AccessPermissions{}
@@ -527,12 +674,16 @@ func (crypt *PdfCrypt) authenticate(password []byte) (bool, error) {
 	// Also build the encryption/decryption key.
 
 	crypt.Authenticated = false
+	crypt.ownerAuthenticated = false
 	if crypt.R >= 5 {
 		authenticated, err := crypt.alg2a(password)
 		if err != nil {
 			return false, err
 		}
 		crypt.Authenticated = authenticated
+		if authenticated {
+			crypt.ownerAuthenticated, _ = crypt.CheckOwnerPassword(password)
+		}
 		return authenticated, err
 	}
 
@@ -545,6 +696,8 @@ func (crypt *PdfCrypt) authenticate(password []byte) (bool, error) {
 	if authenticated {
 		common.Log.Trace("this.Authenticated = True")
 		crypt.Authenticated = true
+		// The user and owner passwords may be the same.
+		crypt.ownerAuthenticated, _ = crypt.CheckOwnerPassword(password)
 		return true, nil
 	}
 
@@ -559,12 +712,42 @@ func (crypt *PdfCrypt) authenticate(password []byte) (bool, error) {
 	if authenticated {
 		common.Log.Trace("this.Authenticated = True")
 		crypt.Authenticated = true
+		crypt.ownerAuthenticated = true
 		return true, nil
 	}
 
 	return false, nil
 }
 
+// TryPassword returns true if `password` is the user or owner password of the document.  Unlike
+// authentication for decrypting, the state of `crypt` is not changed: the password is checked on a
+// copy, so that Authenticated and EncryptionKey keep their values.  Useful for testing candidate
+// passwords.
+func (crypt *PdfCrypt) TryPassword(password []byte) (bool, error) {
+	probe := *crypt
+	return probe.authenticate(password)
+}
+
+// CheckOwnerPassword returns true if `password` is the owner password of the document.  As with
+// TryPassword, the state of `crypt` is not changed.
+func (crypt *PdfCrypt) CheckOwnerPassword(password []byte) (bool, error) {
+	probe := *crypt
+	if probe.R >= 5 {
+		if len(password) > 127 {
+			password = password[:127]
+		}
+		h, err := probe.alg12(password)
+		return len(h) != 0, err
+	}
+	return probe.Alg7(password)
+}
+
+// IsOwnerAuthenticated returns true if the document was authenticated with the owner password,
+// giving full access rights.
+func (crypt *PdfCrypt) IsOwnerAuthenticated() bool {
+	return crypt.Authenticated && crypt.ownerAuthenticated
+}
+
 // Check access rights and permissions for a specified password.  If either user/owner password is specified,
 // full rights are granted, otherwise the access rights are specified by the Permissions flag.
 //
@@ -678,166 +861,459 @@ func (crypt *PdfCrypt) decryptBytes(buf []byte, filter string, okey []byte) ([]b
 	return f.DecryptBytes(buf, okey)
 }
 
+// decryptObjectBytes decrypts `buf` of object number `objNum` and generation number `genNum` as
+// decryptBytes, reporting the operation to OperationHook.
+func (crypt *PdfCrypt) decryptObjectBytes(buf []byte, filter string, okey []byte, objNum, genNum int64) ([]byte, error) {
+	if crypt.OperationHook == nil {
+		return crypt.decryptBytes(buf, filter, okey)
+	}
+	start := time.Now()
+	size := len(buf)
+	decrypted, err := crypt.decryptBytes(buf, filter, okey)
+	reportOperation(crypt.OperationHook, OperationInfo{
+		Operation:        OperationDecrypt,
+		ObjectNumber:     objNum,
+		GenerationNumber: genNum,
+		Filter:           filter,
+		InputSize:        size,
+		OutputSize:       len(decrypted),
+		Err:              err,
+	}, start)
+	return decrypted, err
+}
+
 // Decrypt an object with specified key. For numbered objects,
 // the key argument is not used and a new one is generated based
 // on the object and generation number.
 // Traverses through all the subobjects (recursive).
 //
 // Does not look up references..  That should be done prior to calling.
+//
+// Modifies the objects in place: strings and stream data are replaced and the Length of streams
+// updated. Decrypted data of a stream without modifying it is returned by DecryptStreamBytes.
 func (crypt *PdfCrypt) Decrypt(obj PdfObject, parentObjNum, parentGenNum int64) error {
+	return crypt.decrypt(obj, parentObjNum, parentGenNum, true)
+}
+
+// DecryptObject decrypts the object `obj` and its direct subobjects with the key of object number
+// `objNum` and generation number `genNum`, which are also used when `obj` is an indirect or stream
+// object.  Unlike Decrypt, other indirect and stream objects referred to from `obj` are not
+// decrypted.
+func (crypt *PdfCrypt) DecryptObject(obj PdfObject, objNum, genNum int64) error {
+	if crypt.DecryptedObjects == nil {
+		crypt.DecryptedObjects = map[PdfObject]bool{}
+	}
 	if crypt.isDecrypted(obj) {
 		return nil
 	}
 
-	switch obj := obj.(type) {
+	switch t := obj.(type) {
 	case *PdfIndirectObject:
-		crypt.DecryptedObjects[obj] = true
-
-		common.Log.Trace("Decrypting indirect %d %d obj!", obj.ObjectNumber, obj.GenerationNumber)
-
-		objNum := obj.ObjectNumber
-		genNum := obj.GenerationNumber
-
-		err := crypt.Decrypt(obj.PdfObject, objNum, genNum)
+		crypt.DecryptedObjects[t] = true
+		err := crypt.decrypt(t.PdfObject, objNum, genNum, false)
 		if err != nil {
 			return err
 		}
+		delete(crypt.EncryptedObjects, t)
 		return nil
 	case *PdfObjectStream:
-		// Mark as decrypted first to avoid recursive issues.
-		crypt.DecryptedObjects[obj] = true
-		dict := obj.PdfObjectDictionary
-
-		if s, ok := dict.Get("Type").(*PdfObjectName); ok && *s == "XRef" {
-			return nil // Cross-reference streams should not be encrypted
-		}
-
-		objNum := obj.ObjectNumber
-		genNum := obj.GenerationNumber
-		common.Log.Trace("Decrypting stream %d %d !", objNum, genNum)
-
-		// TODO: Check for crypt filter (V4).
-		// The Crypt filter shall be the first filter in the Filter array entry.
-
-		streamFilter := StandardCryptFilter // Default RC4.
-		if crypt.V >= 4 {
-			streamFilter = crypt.StreamFilter
-			common.Log.Trace("this.StreamFilter = %s", crypt.StreamFilter)
-
-			if filters, ok := dict.Get("Filter").(*PdfObjectArray); ok {
-				// Crypt filter can only be the first entry.
-				if firstFilter, ok := (*filters)[0].(*PdfObjectName); ok {
-					if *firstFilter == "Crypt" {
-						// Crypt filter overriding the default.
-						// Default option is Identity.
-						streamFilter = "Identity"
-
-						// Check if valid crypt filter specified in the decode params.
-						if decodeParams, ok := dict.Get("DecodeParms").(*PdfObjectDictionary); ok {
-							if filterName, ok := decodeParams.Get("Name").(*PdfObjectName); ok {
-								if _, ok := crypt.CryptFilters[string(*filterName)]; ok {
-									common.Log.Trace("Using stream filter %s", *filterName)
-									streamFilter = string(*filterName)
-								}
-							}
-						}
-					}
-				}
+		return crypt.decryptStream(t, objNum, genNum, false)
+	}
+	return crypt.decrypt(obj, objNum, genNum, false)
+}
+
+// decrypt decrypts `obj` and its subobjects, including the indirect and stream objects referred to
+// if `follow` is true.  The objects are traversed depth-first with an explicit stack, in the order
+// of the array elements and dictionary keys.
+func (crypt *PdfCrypt) decrypt(obj PdfObject, parentObjNum, parentGenNum int64, follow bool) error {
+	stack := []cryptItem{{obj: obj, objNum: parentObjNum, genNum: parentGenNum}}
+	for len(stack) > 0 {
+		item := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if crypt.isDecrypted(item.obj) {
+			continue
+		}
+
+		switch obj := item.obj.(type) {
+		case *PdfIndirectObject:
+			if !follow {
+				continue
 			}
+			crypt.DecryptedObjects[obj] = true
+			common.Log.Trace("Decrypting indirect %d %d obj!", obj.ObjectNumber, obj.GenerationNumber)
+			delete(crypt.EncryptedObjects, obj)
+			stack = append(stack, cryptItem{obj: obj.PdfObject, objNum: obj.ObjectNumber, genNum: obj.GenerationNumber})
+		case *PdfObjectStream:
+			if !follow {
+				continue
+			}
+			decrypted, err := crypt.decryptStreamData(obj, obj.ObjectNumber, obj.GenerationNumber)
+			if err != nil {
+				return err
+			}
+			if decrypted {
+				stack = append(stack, cryptItem{obj: obj.PdfObjectDictionary, objNum: obj.ObjectNumber, genNum: obj.GenerationNumber})
+			}
+		case *PdfObjectString:
+			if err := crypt.decryptString(obj, item.objNum, item.genNum); err != nil {
+				return err
+			}
+		case *PdfObjectArray, *PdfObjectDictionary:
+			var err error
+			stack, err = pushCryptSubobjects(stack, item, crypt.maxNesting())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// decryptString decrypts string `obj` in place with the key of object number `objNum` and generation
+// number `genNum`.
+func (crypt *PdfCrypt) decryptString(obj *PdfObjectString, objNum, genNum int64) error {
+	common.Log.Trace("Decrypting string!")
+
+	stringFilter := StandardCryptFilter
+	if crypt.V >= 4 {
+		// Currently only support Identity / RC4.
+		common.Log.Trace("with %s filter", crypt.StringFilter)
+		if crypt.StringFilter == "Identity" {
+			// Identity: pass unchanged: No action.
+			return nil
+		}
+		stringFilter = crypt.StringFilter
+	}
+
+	key, err := crypt.makeKey(stringFilter, uint32(objNum), uint32(genNum), crypt.EncryptionKey)
+	if err != nil {
+		return err
+	}
+
+	// Overwrite the encrypted with decrypted string.
+	decrypted := make([]byte, len(*obj))
+	for i := 0; i < len(*obj); i++ {
+		decrypted[i] = (*obj)[i]
+	}
+	common.Log.Trace("Decrypt string: %s : % x", decrypted, decrypted)
+	decrypted, err = crypt.decryptObjectBytes(decrypted, stringFilter, key, objNum, genNum)
+	if err != nil {
+		return err
+	}
+	*obj = PdfObjectString(decrypted)
+
+	return nil
+}
+
+// decryptStream decrypts the stream object `obj` and its dictionary with the key of object number
+// `objNum` and generation number `genNum`.
+func (crypt *PdfCrypt) decryptStream(obj *PdfObjectStream, objNum, genNum int64, follow bool) error {
+	decrypted, err := crypt.decryptStreamData(obj, objNum, genNum)
+	if err != nil || !decrypted {
+		return err
+	}
+	return crypt.decrypt(obj.PdfObjectDictionary, objNum, genNum, follow)
+}
 
-			common.Log.Trace("with %s filter", streamFilter)
-			if streamFilter == "Identity" {
-				// Identity: pass unchanged.
-				return nil
+// decryptStreamData decrypts the data of stream object `obj` with the key of object number `objNum`
+// and generation number `genNum`, and marks the stream as decrypted.  Returns false if the stream
+// is not encrypted (cross-reference streams and the Identity crypt filter), in which case its
+// dictionary is not encrypted either.
+func (crypt *PdfCrypt) decryptStreamData(obj *PdfObjectStream, objNum, genNum int64) (bool, error) {
+	// Mark as decrypted first to avoid recursive issues.
+	crypt.DecryptedObjects[obj] = true
+	dict := obj.PdfObjectDictionary
+
+	if s, ok := dict.Get("Type").(*PdfObjectName); ok && *s == "XRef" {
+		return false, nil // Cross-reference streams should not be encrypted
+	}
+
+	common.Log.Trace("Decrypting stream %d %d !", objNum, genNum)
+
+	streamFilter := crypt.streamFilterName(dict)
+	if streamFilter == "Identity" {
+		// Identity: pass unchanged.
+		return false, nil
+	}
+
+	if crypt.readOnlyDecryption() {
+		// Decrypted on demand, see DecryptedStream.
+		obj.encrypted = &encryptedStream{crypt: crypt, data: obj.Stream, objNum: objNum, genNum: genNum}
+		return true, nil
+	}
+
+	okey, err := crypt.makeKey(streamFilter, uint32(objNum), uint32(genNum), crypt.EncryptionKey)
+	if err != nil {
+		return false, err
+	}
+
+	obj.Stream, err = crypt.decryptObjectBytes(obj.Stream, streamFilter, okey, objNum, genNum)
+	if err != nil {
+		return false, err
+	}
+	delete(crypt.EncryptedObjects, obj)
+	// Update the length based on the decrypted stream.
+	dict.Set("Length", MakeInteger(int64(len(obj.Stream))))
+
+	return true, nil
+}
+
+// readOnlyDecryption returns true if the stream data is left encrypted by decryption, see
+// ParserOpts.ReadOnlyDecryption.
+func (crypt *PdfCrypt) readOnlyDecryption() bool {
+	return crypt.parser != nil && crypt.parser.decoding != nil && crypt.parser.decoding.opts.ReadOnlyDecryption
+}
+
+// encryptedStream is the encrypted data of a stream that was decrypted with ReadOnlyDecryption,
+// along with what is needed to decrypt it.
+type encryptedStream struct {
+	crypt          *PdfCrypt
+	data           []byte
+	objNum, genNum int64
+}
+
+// encryptedData returns the encrypted data record of `stream` if its Stream is still the encrypted
+// data, or nil.  The data is compared by position and length only, as for the decode cache.
+func (stream *PdfObjectStream) encryptedData() *encryptedStream {
+	enc := stream.encrypted
+	if enc == nil || len(enc.data) != len(stream.Stream) {
+		return nil
+	}
+	if len(enc.data) > 0 && &enc.data[0] != &stream.Stream[0] {
+		return nil
+	}
+	return enc
+}
+
+// DecryptedStream returns the decrypted data of the stream.  This is Stream itself, except for
+// streams loaded by a parser with ReadOnlyDecryption, whose data is still encrypted: for those a
+// decrypted copy is returned and the stream is not modified.
+func (stream *PdfObjectStream) DecryptedStream() ([]byte, error) {
+	enc := stream.encryptedData()
+	if enc == nil {
+		return stream.Stream, nil
+	}
+	return enc.crypt.DecryptStreamBytes(stream, enc.objNum, enc.genNum)
+}
+
+// decryptData replaces the still encrypted data of a stream loaded with ReadOnlyDecryption with
+// its decrypted form, updating Length.
+func (stream *PdfObjectStream) decryptData() error {
+	data, err := stream.DecryptedStream()
+	if err != nil {
+		return err
+	}
+	stream.Stream = data
+	stream.encrypted = nil
+	stream.ownStream = data
+	stream.PdfObjectDictionary.Set("Length", MakeInteger(int64(len(data))))
+	return nil
+}
+
+// streamFilterName returns the name of the crypt filter of the stream with dictionary `dict`.
+func (crypt *PdfCrypt) streamFilterName(dict *PdfObjectDictionary) string {
+	if crypt.V < 4 {
+		return StandardCryptFilter // Default RC4.
+	}
+	streamFilter := crypt.streamCryptFilter(dict)
+	common.Log.Trace("with %s filter", streamFilter)
+	return streamFilter
+}
+
+// DecryptStreamBytes returns the decrypted data of the encrypted stream object `obj` with object
+// number `objNum` and generation number `genNum`.  Unlike Decrypt and DecryptObject, neither the
+// stream data nor its dictionary (e.g. Length) is modified and `obj` is not marked as decrypted,
+// so the object can still be written out unchanged, e.g. to preserve a digital signature.
+func (crypt *PdfCrypt) DecryptStreamBytes(obj *PdfObjectStream, objNum, genNum int64) ([]byte, error) {
+	data := make([]byte, len(obj.Stream))
+	copy(data, obj.Stream)
+
+	if s, ok := obj.PdfObjectDictionary.Get("Type").(*PdfObjectName); ok && *s == "XRef" {
+		return data, nil // Cross-reference streams are not encrypted.
+	}
+	streamFilter := crypt.streamFilterName(obj.PdfObjectDictionary)
+	if streamFilter == "Identity" {
+		return data, nil
+	}
+
+	okey, err := crypt.makeKey(streamFilter, uint32(objNum), uint32(genNum), crypt.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return crypt.decryptObjectBytes(data, streamFilter, okey, objNum, genNum)
+}
+
+// DecryptDocument decrypts all the top-level indirect and stream objects in `objs`, each with its
+// own object and generation number. Object streams are decrypted as a whole and the objects
+// contained in them, which are not encrypted individually, are left unchanged. Other objects in
+// `objs` are skipped, as is the Encrypt dictionary if referenced from the trailer of the parser.
+func (crypt *PdfCrypt) DecryptDocument(objs []PdfObject) error {
+	if crypt.DecryptedObjects == nil {
+		crypt.DecryptedObjects = map[PdfObject]bool{}
+	}
+	if crypt.parser != nil && crypt.parser.trailer != nil {
+		if ref, ok := crypt.parser.trailer.Get("Encrypt").(*PdfObjectReference); ok {
+			for _, obj := range objs {
+				if ind, ok := obj.(*PdfIndirectObject); ok && ind.ObjectNumber == ref.ObjectNumber {
+					crypt.DecryptedObjects[ind] = true
+				}
 			}
 		}
+	}
 
-		err := crypt.Decrypt(dict, objNum, genNum)
+	// Object streams first, collecting the numbers of the objects they contain.
+	inObjStm := map[int64]bool{}
+	for _, obj := range objs {
+		stream, ok := obj.(*PdfObjectStream)
+		if !ok {
+			continue
+		}
+		if name, ok := stream.Get("Type").(*PdfObjectName); !ok || *name != "ObjStm" {
+			continue
+		}
+		err := crypt.Decrypt(stream, 0, 0)
 		if err != nil {
 			return err
 		}
-
-		okey, err := crypt.makeKey(streamFilter, uint32(objNum), uint32(genNum), crypt.EncryptionKey)
+		objNums, err := objectStreamObjNums(stream)
 		if err != nil {
 			return err
 		}
+		for _, objNum := range objNums {
+			inObjStm[objNum] = true
+		}
+	}
 
-		obj.Stream, err = crypt.decryptBytes(obj.Stream, streamFilter, okey)
-		if err != nil {
-			return err
+	// The objects in object streams are marked before decrypting any other object, as Decrypt
+	// follows the references to them.
+	var toDecrypt []PdfObject
+	for _, obj := range objs {
+		var objNum int64
+		switch t := obj.(type) {
+		case *PdfIndirectObject:
+			objNum = t.ObjectNumber
+		case *PdfObjectStream:
+			objNum = t.ObjectNumber
+		default:
+			common.Log.Debug("Skipping top-level object that is not indirect (%T)", obj)
+			continue
 		}
-		// Update the length based on the decrypted stream.
-		dict.Set("Length", MakeInteger(int64(len(obj.Stream))))
 
-		return nil
-	case *PdfObjectString:
-		common.Log.Trace("Decrypting string!")
-
-		stringFilter := StandardCryptFilter
-		if crypt.V >= 4 {
-			// Currently only support Identity / RC4.
-			common.Log.Trace("with %s filter", crypt.StringFilter)
-			if crypt.StringFilter == "Identity" {
-				// Identity: pass unchanged: No action.
-				return nil
-			}
-			stringFilter = crypt.StringFilter
+		if inObjStm[objNum] {
+			common.Log.Trace("Object %d in object stream - not decrypting", objNum)
+			crypt.DecryptedObjects[obj] = true
+			continue
 		}
+		toDecrypt = append(toDecrypt, obj)
+	}
 
-		key, err := crypt.makeKey(stringFilter, uint32(parentObjNum), uint32(parentGenNum), crypt.EncryptionKey)
+	for _, obj := range toDecrypt {
+		err := crypt.Decrypt(obj, 0, 0)
 		if err != nil {
 			return err
 		}
+	}
 
-		// Overwrite the encrypted with decrypted string.
-		decrypted := make([]byte, len(*obj))
-		for i := 0; i < len(*obj); i++ {
-			decrypted[i] = (*obj)[i]
-		}
-		common.Log.Trace("Decrypt string: %s : % x", decrypted, decrypted)
-		decrypted, err = crypt.decryptBytes(decrypted, stringFilter, key)
+	return nil
+}
+
+// objectStreamObjNums returns the numbers of the objects contained in the (decrypted) object
+// stream `stream`, as listed in its header.
+func objectStreamObjNums(stream *PdfObjectStream) ([]int64, error) {
+	n, ok := stream.Get("N").(*PdfObjectInteger)
+	if !ok {
+		return nil, errors.New("Object stream missing N")
+	}
+	first, ok := stream.Get("First").(*PdfObjectInteger)
+	if !ok {
+		return nil, errors.New("Object stream missing First")
+	}
+
+	decoded, err := DecodeStream(stream)
+	if err != nil {
+		return nil, err
+	}
+	if int(*first) > len(decoded) || *first < 0 {
+		return nil, errors.New("Object stream First out of range")
+	}
+
+	fields := strings.Fields(string(decoded[:*first]))
+	if len(fields) < 2*int(*n) {
+		return nil, errors.New("Object stream header too short")
+	}
+	var objNums []int64
+	for i := 0; i < int(*n); i++ {
+		objNum, err := strconv.ParseInt(fields[2*i], 10, 64)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		*obj = PdfObjectString(decrypted)
+		objNums = append(objNums, objNum)
+	}
+	return objNums, nil
+}
 
-		return nil
+// streamCryptFilter returns the name of the crypt filter that applies to a stream with the
+// specified dictionary (V>=4): the EFF filter for embedded file streams if given, otherwise the
+// default stream filter.  A Crypt filter in the stream's Filter entry (a name or an array)
+// overrides the default stream filter, selecting the crypt filter given by the Name entry of the
+// corresponding DecodeParms (a dictionary, or an element of an array), or Identity if none.
+func (crypt *PdfCrypt) streamCryptFilter(dict *PdfObjectDictionary) string {
+	var filters []PdfObject
+	switch t := TraceToDirectObject(dict.Get("Filter")).(type) {
+	case *PdfObjectName:
+		filters = []PdfObject{t}
 	case *PdfObjectArray:
-		for _, o := range *obj {
-			err := crypt.Decrypt(o, parentObjNum, parentGenNum)
-			if err != nil {
-				return err
+		filters = *t
+	}
+
+	pos := -1
+	for i, filter := range filters {
+		if name, ok := TraceToDirectObject(filter).(*PdfObjectName); ok && *name == "Crypt" {
+			pos = i
+			break
+		}
+	}
+	if pos < 0 {
+		if crypt.EmbeddedFileFilter != "" {
+			if name, ok := TraceToDirectObject(dict.Get("Type")).(*PdfObjectName); ok && *name == "EmbeddedFile" {
+				common.Log.Trace("this.EmbeddedFileFilter = %s", crypt.EmbeddedFileFilter)
+				return crypt.EmbeddedFileFilter
 			}
 		}
-		return nil
+		common.Log.Trace("this.StreamFilter = %s", crypt.StreamFilter)
+		return crypt.StreamFilter
+	}
+	if pos > 0 {
+		common.Log.Warning("Crypt filter should be the first filter (position %d)", pos)
+	}
+
+	// Crypt filter overriding the default.  Default option is Identity.
+	var decodeParams *PdfObjectDictionary
+	switch t := TraceToDirectObject(dict.Get("DecodeParms")).(type) {
 	case *PdfObjectDictionary:
-		isSig := false
-		if t := obj.Get("Type"); t != nil {
-			typeStr, ok := t.(*PdfObjectName)
-			if ok && *typeStr == "Sig" {
-				isSig = true
-			}
+		decodeParams = t
+	case *PdfObjectArray:
+		if pos < len(*t) {
+			decodeParams, _ = TraceToDirectObject((*t)[pos]).(*PdfObjectDictionary)
 		}
-		for _, keyidx := range obj.Keys() {
-			o := obj.Get(keyidx)
-			// How can we avoid this check, i.e. implement a more smart
-			// traversal system?
-			if isSig && string(keyidx) == "Contents" {
-				// Leave the Contents of a Signature dictionary.
-				continue
-			}
+	}
+	if decodeParams == nil {
+		return "Identity"
+	}
 
-			if string(keyidx) != "Parent" && string(keyidx) != "Prev" && string(keyidx) != "Last" { // Check not needed?
-				err := crypt.Decrypt(o, parentObjNum, parentGenNum)
-				if err != nil {
-					return err
-				}
-			}
+	filterName, ok := TraceToDirectObject(decodeParams.Get("Name")).(*PdfObjectName)
+	if !ok {
+		return "Identity"
+	}
+	if _, ok := crypt.CryptFilters[string(*filterName)]; !ok {
+		if *filterName != "Identity" {
+			common.Log.Debug("ERROR: Unknown crypt filter %s - using Identity", *filterName)
 		}
-		return nil
+		return "Identity"
 	}
 
-	return nil
+	common.Log.Trace("Using stream filter %s", *filterName)
+	return string(*filterName)
 }
 
 // Check if object has already been processed.
@@ -852,6 +1328,75 @@ func (crypt *PdfCrypt) isEncrypted(obj PdfObject) bool {
 	return false
 }
 
+// MarkEncrypted marks the specified objects as already encrypted, so that Encrypt leaves them (and
+// their subobjects) untouched.  Useful when the objects are the encrypted originals of a document
+// that is being updated incrementally.
+func (crypt *PdfCrypt) MarkEncrypted(objs ...PdfObject) {
+	if crypt.EncryptedObjects == nil {
+		crypt.EncryptedObjects = map[PdfObject]bool{}
+	}
+	for _, obj := range objs {
+		crypt.EncryptedObjects[obj] = true
+	}
+}
+
+// IsEncrypted returns true if `obj` is marked as encrypted: encrypted by the PdfCrypt, or marked
+// with MarkEncrypted or MarkEncryptedBy, and neither decrypted nor unmarked since.
+func (crypt *PdfCrypt) IsEncrypted(obj PdfObject) bool {
+	return crypt.EncryptedObjects[obj]
+}
+
+// MarkEncryptedBy marks the objects encrypted by `other` as already encrypted, so that Encrypt
+// leaves them untouched.  Useful when reusing objects of a document encrypted in a previous run,
+// whose stream data and strings are ciphertext already.  Objects modified since must be unmarked
+// with UnmarkEncrypted to be encrypted again.
+func (crypt *PdfCrypt) MarkEncryptedBy(other *PdfCrypt) {
+	for obj, encrypted := range other.EncryptedObjects {
+		if encrypted {
+			crypt.MarkEncrypted(obj)
+		}
+	}
+}
+
+// EncryptSubset encrypts only the indirect and stream objects in `objs` whose object numbers are in
+// `objNums` (along with their direct subobjects).  All other objects in `objs` are considered to be
+// already encrypted and are marked as such, so that references to them from the encrypted objects
+// are not followed.  Intended for incremental updates, where only new and modified objects need
+// encryption.
+func (crypt *PdfCrypt) EncryptSubset(objs []PdfObject, objNums map[int64]bool) error {
+	if crypt.EncryptedObjects == nil {
+		crypt.EncryptedObjects = map[PdfObject]bool{}
+	}
+
+	var toEncrypt []PdfObject
+	for _, obj := range objs {
+		var objNum int64
+		switch t := obj.(type) {
+		case *PdfIndirectObject:
+			objNum = t.ObjectNumber
+		case *PdfObjectStream:
+			objNum = t.ObjectNumber
+		default:
+			continue
+		}
+
+		if objNums[objNum] {
+			toEncrypt = append(toEncrypt, obj)
+		} else {
+			crypt.MarkEncrypted(obj)
+		}
+	}
+
+	for _, obj := range toEncrypt {
+		err := crypt.Encrypt(obj, 0, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Encrypt a buffer with the specified crypt filter and key.
 func (crypt *PdfCrypt) encryptBytes(buf []byte, filter string, okey []byte) ([]byte, error) {
 	common.Log.Trace("Encrypt bytes")
@@ -862,164 +1407,258 @@ func (crypt *PdfCrypt) encryptBytes(buf []byte, filter string, okey []byte) ([]b
 	return f.EncryptBytes(buf, okey)
 }
 
+// encryptObjectBytes encrypts `buf` of object number `objNum` and generation number `genNum` as
+// encryptBytes, reporting the operation to OperationHook.
+func (crypt *PdfCrypt) encryptObjectBytes(buf []byte, filter string, okey []byte, objNum, genNum int64) ([]byte, error) {
+	if crypt.OperationHook == nil {
+		return crypt.encryptBytes(buf, filter, okey)
+	}
+	start := time.Now()
+	size := len(buf)
+	encrypted, err := crypt.encryptBytes(buf, filter, okey)
+	reportOperation(crypt.OperationHook, OperationInfo{
+		Operation:        OperationEncrypt,
+		ObjectNumber:     objNum,
+		GenerationNumber: genNum,
+		Filter:           filter,
+		InputSize:        size,
+		OutputSize:       len(encrypted),
+		Err:              err,
+	}, start)
+	return encrypted, err
+}
+
 // Encrypt an object with specified key. For numbered objects,
 // the key argument is not used and a new one is generated based
 // on the object and generation number.
 // Traverses through all the subobjects (recursive).
 //
 // Does not look up references..  That should be done prior to calling.
+//
+// Modifies the objects in place: strings and stream data are replaced and the Length of streams
+// updated.
 func (crypt *PdfCrypt) Encrypt(obj PdfObject, parentObjNum, parentGenNum int64) error {
+	return crypt.encrypt(obj, parentObjNum, parentGenNum, true)
+}
+
+// EncryptObject encrypts the object `obj` and its direct subobjects with the key of object number
+// `objNum` and generation number `genNum`, which are also used when `obj` is an indirect or stream
+// object.  Unlike Encrypt, other indirect and stream objects referred to from `obj` are not
+// encrypted, which allows encrypting objects added after the main encryption pass, e.g. an
+// annotation referring to its (already encrypted) page.
+func (crypt *PdfCrypt) EncryptObject(obj PdfObject, objNum, genNum int64) error {
+	if crypt.EncryptedObjects == nil {
+		crypt.EncryptedObjects = map[PdfObject]bool{}
+	}
 	if crypt.isEncrypted(obj) {
 		return nil
 	}
-	switch obj := obj.(type) {
-	case *PdfIndirectObject:
-		crypt.EncryptedObjects[obj] = true
 
-		common.Log.Trace("Encrypting indirect %d %d obj!", obj.ObjectNumber, obj.GenerationNumber)
+	switch t := obj.(type) {
+	case *PdfIndirectObject:
+		crypt.EncryptedObjects[t] = true
+		return crypt.encrypt(t.PdfObject, objNum, genNum, false)
+	case *PdfObjectStream:
+		return crypt.encryptStream(t, objNum, genNum, false)
+	}
+	return crypt.encrypt(obj, objNum, genNum, false)
+}
 
-		objNum := obj.ObjectNumber
-		genNum := obj.GenerationNumber
+// UnmarkEncrypted removes the specified objects from the encryption bookkeeping, so that they are
+// encrypted again by Encrypt or EncryptObject.
+// Intended for objects modified after having been encrypted, whose contents have been replaced
+// with unencrypted data.
+func (crypt *PdfCrypt) UnmarkEncrypted(objs ...PdfObject) {
+	for _, obj := range objs {
+		delete(crypt.EncryptedObjects, obj)
+	}
+}
 
-		err := crypt.Encrypt(obj.PdfObject, objNum, genNum)
-		if err != nil {
-			return err
+// encrypt encrypts `obj` and its subobjects, including the indirect and stream objects referred to
+// if `follow` is true.  The objects are traversed depth-first with an explicit stack, in the order
+// of the array elements and dictionary keys.
+func (crypt *PdfCrypt) encrypt(obj PdfObject, parentObjNum, parentGenNum int64, follow bool) error {
+	stack := []cryptItem{{obj: obj, objNum: parentObjNum, genNum: parentGenNum}}
+	for len(stack) > 0 {
+		item := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if crypt.isEncrypted(item.obj) {
+			continue
 		}
-		return nil
-	case *PdfObjectStream:
-		crypt.EncryptedObjects[obj] = true
-		dict := obj.PdfObjectDictionary
-
-		if s, ok := dict.Get("Type").(*PdfObjectName); ok && *s == "XRef" {
-			return nil // Cross-reference streams should not be encrypted
-		}
-
-		objNum := obj.ObjectNumber
-		genNum := obj.GenerationNumber
-		common.Log.Trace("Encrypting stream %d %d !", objNum, genNum)
-
-		// TODO: Check for crypt filter (V4).
-		// The Crypt filter shall be the first filter in the Filter array entry.
-
-		streamFilter := StandardCryptFilter // Default RC4.
-		if crypt.V >= 4 {
-			// For now.  Need to change when we add support for more than
-			// Identity / RC4.
-			streamFilter = crypt.StreamFilter
-			common.Log.Trace("this.StreamFilter = %s", crypt.StreamFilter)
-
-			if filters, ok := dict.Get("Filter").(*PdfObjectArray); ok {
-				// Crypt filter can only be the first entry.
-				if firstFilter, ok := (*filters)[0].(*PdfObjectName); ok {
-					if *firstFilter == "Crypt" {
-						// Crypt filter overriding the default.
-						// Default option is Identity.
-						streamFilter = "Identity"
-
-						// Check if valid crypt filter specified in the decode params.
-						if decodeParams, ok := dict.Get("DecodeParms").(*PdfObjectDictionary); ok {
-							if filterName, ok := decodeParams.Get("Name").(*PdfObjectName); ok {
-								if _, ok := crypt.CryptFilters[string(*filterName)]; ok {
-									common.Log.Trace("Using stream filter %s", *filterName)
-									streamFilter = string(*filterName)
-								}
-							}
-						}
-					}
-				}
-			}
 
-			common.Log.Trace("with %s filter", streamFilter)
-			if streamFilter == "Identity" {
-				// Identity: pass unchanged.
-				return nil
+		switch obj := item.obj.(type) {
+		case *PdfIndirectObject:
+			if !follow {
+				continue
+			}
+			crypt.EncryptedObjects[obj] = true
+			common.Log.Trace("Encrypting indirect %d %d obj!", obj.ObjectNumber, obj.GenerationNumber)
+			stack = append(stack, cryptItem{obj: obj.PdfObject, objNum: obj.ObjectNumber, genNum: obj.GenerationNumber})
+		case *PdfObjectStream:
+			if !follow {
+				continue
+			}
+			streamEncrypted, err := crypt.encryptStreamData(obj, obj.ObjectNumber, obj.GenerationNumber)
+			if err != nil {
+				return err
+			}
+			if streamEncrypted {
+				stack = append(stack, cryptItem{obj: obj.PdfObjectDictionary, objNum: obj.ObjectNumber, genNum: obj.GenerationNumber})
+			}
+		case *PdfObjectString:
+			if err := crypt.encryptString(obj, item.objNum, item.genNum); err != nil {
+				return err
+			}
+		case *PdfObjectArray, *PdfObjectDictionary:
+			var err error
+			stack, err = pushCryptSubobjects(stack, item, crypt.maxNesting())
+			if err != nil {
+				return err
 			}
 		}
+	}
+	return nil
+}
 
-		err := crypt.Encrypt(obj.PdfObjectDictionary, objNum, genNum)
-		if err != nil {
-			return err
-		}
+// encryptString encrypts string `obj` in place with the key of object number `objNum` and generation
+// number `genNum`.
+func (crypt *PdfCrypt) encryptString(obj *PdfObjectString, objNum, genNum int64) error {
+	common.Log.Trace("Encrypting string!")
 
-		okey, err := crypt.makeKey(streamFilter, uint32(objNum), uint32(genNum), crypt.EncryptionKey)
-		if err != nil {
-			return err
+	stringFilter := StandardCryptFilter
+	if crypt.V >= 4 {
+		common.Log.Trace("with %s filter", crypt.StringFilter)
+		if crypt.StringFilter == "Identity" {
+			// Identity: pass unchanged: No action.
+			return nil
 		}
+		stringFilter = crypt.StringFilter
+	}
 
-		obj.Stream, err = crypt.encryptBytes(obj.Stream, streamFilter, okey)
-		if err != nil {
-			return err
-		}
-		// Update the length based on the encrypted stream.
-		dict.Set("Length", MakeInteger(int64(len(obj.Stream))))
+	key, err := crypt.makeKey(stringFilter, uint32(objNum), uint32(genNum), crypt.EncryptionKey)
+	if err != nil {
+		return err
+	}
 
-		return nil
-	case *PdfObjectString:
-		common.Log.Trace("Encrypting string!")
-
-		stringFilter := StandardCryptFilter
-		if crypt.V >= 4 {
-			common.Log.Trace("with %s filter", crypt.StringFilter)
-			if crypt.StringFilter == "Identity" {
-				// Identity: pass unchanged: No action.
-				return nil
-			}
-			stringFilter = crypt.StringFilter
-		}
+	encrypted := make([]byte, len(*obj))
+	for i := 0; i < len(*obj); i++ {
+		encrypted[i] = (*obj)[i]
+	}
+	common.Log.Trace("Encrypt string: %s : % x", encrypted, encrypted)
+	encrypted, err = crypt.encryptObjectBytes(encrypted, stringFilter, key, objNum, genNum)
+	if err != nil {
+		return err
+	}
+	*obj = PdfObjectString(encrypted)
 
-		key, err := crypt.makeKey(stringFilter, uint32(parentObjNum), uint32(parentGenNum), crypt.EncryptionKey)
-		if err != nil {
-			return err
-		}
+	return nil
+}
+
+// encryptStream encrypts the stream object `obj` and its dictionary with the key of object number
+// `objNum` and generation number `genNum`.
+func (crypt *PdfCrypt) encryptStream(obj *PdfObjectStream, objNum, genNum int64, follow bool) error {
+	encrypted, err := crypt.encryptStreamData(obj, objNum, genNum)
+	if err != nil || !encrypted {
+		return err
+	}
+	return crypt.encrypt(obj.PdfObjectDictionary, objNum, genNum, follow)
+}
 
-		encrypted := make([]byte, len(*obj))
-		for i := 0; i < len(*obj); i++ {
-			encrypted[i] = (*obj)[i]
+// encryptStreamData encrypts the data of stream object `obj` with the key of object number `objNum`
+// and generation number `genNum`, and marks the stream as encrypted.  Returns false if the stream
+// is not to be encrypted (cross-reference streams and the Identity crypt filter), in which case
+// its dictionary is not encrypted either.
+func (crypt *PdfCrypt) encryptStreamData(obj *PdfObjectStream, objNum, genNum int64) (bool, error) {
+	crypt.EncryptedObjects[obj] = true
+	dict := obj.PdfObjectDictionary
+
+	if s, ok := dict.Get("Type").(*PdfObjectName); ok && *s == "XRef" {
+		return false, nil // Cross-reference streams should not be encrypted
+	}
+
+	common.Log.Trace("Encrypting stream %d %d !", objNum, genNum)
+
+	if obj.encryptedData() != nil {
+		// Still encrypted by the crypter of the parser that loaded it (ReadOnlyDecryption).
+		if err := obj.decryptData(); err != nil {
+			return false, err
 		}
-		common.Log.Trace("Encrypt string: %s : % x", encrypted, encrypted)
-		encrypted, err = crypt.encryptBytes(encrypted, stringFilter, key)
-		if err != nil {
-			return err
+	}
+
+	streamFilter := StandardCryptFilter // Default RC4.
+	if crypt.V >= 4 {
+		streamFilter = crypt.streamCryptFilter(dict)
+		common.Log.Trace("with %s filter", streamFilter)
+		if streamFilter == "Identity" {
+			// Identity: pass unchanged.
+			return false, nil
 		}
-		*obj = PdfObjectString(encrypted)
+	}
 
-		return nil
+	okey, err := crypt.makeKey(streamFilter, uint32(objNum), uint32(genNum), crypt.EncryptionKey)
+	if err != nil {
+		return false, err
+	}
+
+	obj.Stream, err = crypt.encryptObjectBytes(obj.Stream, streamFilter, okey, objNum, genNum)
+	if err != nil {
+		return false, err
+	}
+	// Update the length based on the encrypted stream.
+	dict.Set("Length", MakeInteger(int64(len(obj.Stream))))
+
+	return true, nil
+}
+
+// maxNesting returns the maximum nesting depth of the objects encrypted or decrypted, see
+// MaxNesting.
+func (crypt *PdfCrypt) maxNesting() int {
+	if crypt.MaxNesting > 0 {
+		return crypt.MaxNesting
+	}
+	return DefaultCryptMaxNesting
+}
+
+// cryptItem is an object to be encrypted or decrypted with the key of object number `objNum` and
+// generation number `genNum`, nested `depth` arrays and dictionaries deep within that object.
+type cryptItem struct {
+	obj            PdfObject
+	objNum, genNum int64
+	depth          int
+}
+
+// pushCryptSubobjects pushes the subobjects of the array or dictionary of `item` on `stack` in
+// reverse order, so that they are popped in order.  Parent, Prev and Last entries (back links) and
+// the Contents of signature dictionaries are left out.  Returns ErrCryptNestingTooDeep if the
+// subobjects are nested deeper than `maxNesting`.
+func pushCryptSubobjects(stack []cryptItem, item cryptItem, maxNesting int) ([]cryptItem, error) {
+	if item.depth >= maxNesting {
+		common.Log.Debug("ERROR: Objects nested deeper than %d levels in object %d", maxNesting, item.objNum)
+		return stack, ErrCryptNestingTooDeep
+	}
+	var subobjects []PdfObject
+	switch obj := item.obj.(type) {
 	case *PdfObjectArray:
-		for _, o := range *obj {
-			err := crypt.Encrypt(o, parentObjNum, parentGenNum)
-			if err != nil {
-				return err
-			}
-		}
-		return nil
+		subobjects = *obj
 	case *PdfObjectDictionary:
 		isSig := false
-		if t := obj.Get("Type"); t != nil {
-			typeStr, ok := t.(*PdfObjectName)
-			if ok && *typeStr == "Sig" {
-				isSig = true
-			}
+		if typeStr, ok := obj.Get("Type").(*PdfObjectName); ok && *typeStr == "Sig" {
+			isSig = true
 		}
-
-		for _, keyidx := range obj.Keys() {
-			o := obj.Get(keyidx)
-			// How can we avoid this check, i.e. implement a more smart
-			// traversal system?
-			if isSig && string(keyidx) == "Contents" {
+		for _, key := range obj.Keys() {
+			if isSig && key == "Contents" {
 				// Leave the Contents of a Signature dictionary.
 				continue
 			}
-			if string(keyidx) != "Parent" && string(keyidx) != "Prev" && string(keyidx) != "Last" { // Check not needed?
-				err := crypt.Encrypt(o, parentObjNum, parentGenNum)
-				if err != nil {
-					return err
-				}
+			if key != "Parent" && key != "Prev" && key != "Last" {
+				subobjects = append(subobjects, obj.Get(key))
 			}
 		}
-		return nil
 	}
-
-	return nil
+	for i := len(subobjects) - 1; i >= 0; i-- {
+		stack = append(stack, cryptItem{obj: subobjects[i], objNum: item.objNum, genNum: item.genNum, depth: item.depth + 1})
+	}
+	return stack, nil
 }
 
 // aesZeroIV allocates a zero-filled buffer that serves as an initialization vector for AESv3.
@@ -1346,10 +1985,35 @@ func (crypt *PdfCrypt) Alg4(upass []byte) (PdfObjectString, []byte, error) {
 }
 
 // Alg5 computes the encryption dictionary’s U (user password) value (Security handlers of revision 3 or greater).
+// The first 16 bytes are computed by alg5Hash and are followed by 16 bytes of arbitrary (random) padding.
 // TODO (v3): Unexport.
 func (crypt *PdfCrypt) Alg5(upass []byte) (PdfObjectString, []byte, error) {
 	U := PdfObjectString("")
 
+	hash, ekey, err := crypt.alg5Hash(upass)
+	if err != nil {
+		return U, ekey, err
+	}
+
+	bb := make([]byte, 32)
+	copy(bb, hash)
+
+	// Append 16 bytes of arbitrary padding to the output from the final
+	// invocation of the RC4 function and store the 32-byte result as
+	// the value of the U entry in the encryption dictionary.
+	_, err = rand.Read(bb[16:32])
+	if err != nil {
+		return U, ekey, errors.New("Failed to gen rand number")
+	}
+
+	U = PdfObjectString(bb)
+	return U, ekey, nil
+}
+
+// alg5Hash computes the meaningful first 16 bytes of the U value for revision 3 or greater (Algorithm 5
+// steps a-e) and the encryption key.  Unlike the U value, the result only depends on the password and
+// the encryption parameters, so it is used to verify the user password.
+func (crypt *PdfCrypt) alg5Hash(upass []byte) ([]byte, []byte, error) {
 	ekey := crypt.Alg2(upass)
 
 	h := md5.New()
@@ -1362,12 +2026,12 @@ func (crypt *PdfCrypt) Alg5(upass []byte) (PdfObjectString, []byte, error) {
 	common.Log.Trace("ID: % x", crypt.Id0)
 
 	if len(hash) != 16 {
-		return U, ekey, errors.New("Hash length not 16 bytes")
+		return nil, ekey, errors.New("Hash length not 16 bytes")
 	}
 
 	ciph, err := rc4.NewCipher(ekey)
 	if err != nil {
-		return U, ekey, errors.New("Failed rc4 ciph")
+		return nil, ekey, errors.New("Failed rc4 ciph")
 	}
 	encrypted := make([]byte, 16)
 	ciph.XORKeyStream(encrypted, hash)
@@ -1385,28 +2049,14 @@ func (crypt *PdfCrypt) Alg5(upass []byte) (PdfObjectString, []byte, error) {
 		}
 		ciph, err = rc4.NewCipher(ekey2)
 		if err != nil {
-			return U, ekey, errors.New("Failed rc4 ciph")
+			return nil, ekey, errors.New("Failed rc4 ciph")
 		}
 		ciph.XORKeyStream(encrypted, encrypted)
 		common.Log.Trace("i = %d, ekey: % x", i, ekey2)
 		common.Log.Trace("i = %d -> % x", i, encrypted)
 	}
 
-	bb := make([]byte, 32)
-	for i := 0; i < 16; i++ {
-		bb[i] = encrypted[i]
-	}
-
-	// Append 16 bytes of arbitrary padding to the output from the final
-	// invocation of the RC4 function and store the 32-byte result as
-	// the value of the U entry in the encryption dictionary.
-	_, err = rand.Read(bb[16:32])
-	if err != nil {
-		return U, ekey, errors.New("Failed to gen rand number")
-	}
-
-	U = PdfObjectString(bb)
-	return U, ekey, nil
+	return encrypted, ekey, nil
 }
 
 // Alg6 authenticates the user password.
@@ -1418,7 +2068,9 @@ func (crypt *PdfCrypt) Alg6(upass []byte) (bool, error) {
 	if crypt.R == 2 {
 		uo, key, err = crypt.Alg4(upass)
 	} else if crypt.R >= 3 {
-		uo, key, err = crypt.Alg5(upass)
+		var hash []byte
+		hash, key, err = crypt.alg5Hash(upass)
+		uo = PdfObjectString(hash)
 	} else {
 		return false, errors.New("invalid R")
 	}
@@ -1450,6 +2102,39 @@ func (crypt *PdfCrypt) Alg6(upass []byte) (bool, error) {
 	return false, nil
 }
 
+// CheckPasswords returns true if `upass` and `opass` are the user and owner passwords of the document,
+// i.e. if encrypting with these passwords would give equivalent O and U entries.
+func (crypt *PdfCrypt) CheckPasswords(upass, opass []byte) (bool, error) {
+	if crypt.R >= 5 {
+		if len(crypt.U) < 48 || len(crypt.O) < 48 {
+			return false, errors.New("Invalid U or O length")
+		}
+		if len(upass) > 127 {
+			upass = upass[:127]
+		}
+		if len(opass) > 127 {
+			opass = opass[:127]
+		}
+		if h, err := crypt.alg11(upass); h == nil || err != nil {
+			return false, err
+		}
+		h, err := crypt.alg12(opass)
+		return h != nil, err
+	}
+
+	key := crypt.EncryptionKey
+	userOk, err := crypt.Alg6(upass)
+	crypt.EncryptionKey = key
+	if !userOk || err != nil {
+		return false, err
+	}
+	O, err := crypt.Alg3(upass, opass)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal([]byte(O), crypt.O), nil
+}
+
 // Alg7 authenticates the owner password.
 // TODO (v3): Unexport.
 func (crypt *PdfCrypt) Alg7(opass []byte) (bool, error) {
@@ -1485,10 +2170,53 @@ func (crypt *PdfCrypt) Alg7(opass []byte) (bool, error) {
 	if err != nil {
 		return false, nil
 	}
+	if !auth && crypt.isUDamaged() {
+		// The user password derived from O cannot be verified by a damaged or missing U.
+		auth = crypt.authenticateByPaddedPass(decrypted)
+	}
 
 	return auth, nil
 }
 
+// minPaddingMatch is the minimum number of padding bytes of the user password decrypted from O for
+// accepting the owner password without U.  Decrypting O with a wrong owner password matches them by
+// chance with a probability of about 2^-32.
+const minPaddingMatch = 4
+
+// isUDamaged returns true if U of an R<5 encryption dictionary is missing, of the wrong length
+// or all zeros, so that it cannot verify a user password.
+func (crypt *PdfCrypt) isUDamaged() bool {
+	if len(crypt.U) != 32 {
+		return true
+	}
+	for _, b := range crypt.U {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// authenticateByPaddedPass authenticates the owner password when U is damaged or missing (see
+// isUDamaged), so that the user password `padded` decrypted from O (Alg7) cannot be verified: the
+// password is accepted if `padded` is a user password padded with at least minPaddingMatch bytes of
+// the padding string, and the encryption key is computed from it.  User passwords of more than
+// 32 - minPaddingMatch bytes cannot be recovered this way.
+func (crypt *PdfCrypt) authenticateByPaddedPass(padded []byte) bool {
+	if len(padded) != 32 {
+		return false
+	}
+	for n := 0; n <= 32-minPaddingMatch; n++ {
+		if string(padded[n:]) == padding[:32-n] {
+			common.Log.Debug("Incompatibility: U does not match the user password derived from O - " +
+				"authenticated with the owner password only")
+			crypt.EncryptionKey = crypt.Alg2(padded[:n])
+			return true
+		}
+	}
+	return false
+}
+
 // GenerateParams generates encryption parameters for specified passwords.
 // Can be called only for R>=5.
 func (crypt *PdfCrypt) GenerateParams(upass, opass []byte) error {
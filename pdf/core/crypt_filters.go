@@ -106,9 +106,11 @@ func (cryptFilterV2) EncryptBytes(buf []byte, okey []byte) ([]byte, error) {
 		return nil, err
 	}
 	common.Log.Trace("RC4 Encrypt: % x", buf)
-	ciph.XORKeyStream(buf, buf)
-	common.Log.Trace("to: % x", buf)
-	return buf, nil
+	// Into a new buffer, as `buf` may be shared, e.g. the Stream data of a copied stream.
+	out := make([]byte, len(buf))
+	ciph.XORKeyStream(out, buf)
+	common.Log.Trace("to: % x", out)
+	return out, nil
 }
 
 func (cryptFilterV2) DecryptBytes(buf []byte, okey []byte) ([]byte, error) {
@@ -118,9 +120,10 @@ func (cryptFilterV2) DecryptBytes(buf []byte, okey []byte) ([]byte, error) {
 		return nil, err
 	}
 	common.Log.Trace("RC4 Decrypt: % x", buf)
-	ciph.XORKeyStream(buf, buf)
-	common.Log.Trace("to: % x", buf)
-	return buf, nil
+	out := make([]byte, len(buf))
+	ciph.XORKeyStream(out, buf)
+	common.Log.Trace("to: % x", out)
+	return out, nil
 }
 
 // cryptFilterAES implements a generic AES encryption and decryption algorithm used by AESV2 and AESV3 filter methods.
@@ -155,21 +158,23 @@ func (cryptFilterAES) EncryptBytes(buf []byte, okey []byte) ([]byte, error) {
 
 	const block = aes.BlockSize // 16
 
+	// Padded into the new buffer rather than appended to `buf`, whose spare capacity may be shared.
 	pad := block - len(buf)%block
-	for i := 0; i < pad; i++ {
-		buf = append(buf, byte(pad))
+	ciphertext := make([]byte, block+len(buf)+pad)
+	n := copy(ciphertext[block:], buf)
+	for i := block + n; i < len(ciphertext); i++ {
+		ciphertext[i] = byte(pad)
 	}
-	common.Log.Trace("Padded to %d bytes", len(buf))
+	common.Log.Trace("Padded to %d bytes", len(buf)+pad)
 
 	// Generate random 16 bytes, place in beginning of buffer.
-	ciphertext := make([]byte, block+len(buf))
 	iv := ciphertext[:block]
 	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
 		return nil, err
 	}
 
 	mode := cipher.NewCBCEncrypter(ciph, iv)
-	mode.CryptBlocks(ciphertext[block:], buf)
+	mode.CryptBlocks(ciphertext[block:], ciphertext[block:])
 
 	buf = ciphertext
 	common.Log.Trace("to (%d): % x", len(buf), buf)
@@ -201,6 +206,11 @@ func (cryptFilterAES) DecryptBytes(buf []byte, okey []byte) ([]byte, error) {
 	// block size parameter is set to 16 bytes, and the initialization
 	// vector is a 16-byte random number that is stored as the first
 	// 16 bytes of the encrypted stream or string.
+	// Some writers emit empty encrypted strings and streams without the initialization vector.
+	if len(buf) == 0 {
+		common.Log.Trace("Empty AES buf without IV, returning empty data")
+		return buf, nil
+	}
 	if len(buf) < 16 {
 		common.Log.Debug("ERROR AES invalid buf %s", buf)
 		return buf, fmt.Errorf("AES: Buf len < 16 (%d)", len(buf))
@@ -219,7 +229,9 @@ func (cryptFilterAES) DecryptBytes(buf []byte, okey []byte) ([]byte, error) {
 
 	common.Log.Trace("AES Decrypt (%d): % x", len(buf), buf)
 	common.Log.Trace("chop AES Decrypt (%d): % x", len(buf), buf)
-	mode.CryptBlocks(buf, buf)
+	out := make([]byte, len(buf))
+	mode.CryptBlocks(out, buf)
+	buf = out
 	common.Log.Trace("to (%d): % x", len(buf), buf)
 
 	if len(buf) == 0 {
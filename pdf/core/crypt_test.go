@@ -9,9 +9,11 @@ package core
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/binary"
 	"fmt"
-	"math"
 	"math/rand"
+	"runtime/debug"
 	"strings"
 	"testing"
 	"time"
@@ -309,7 +311,7 @@ func TestAESv3(t *testing.T) {
 					}
 
 					// try to elevate user permissions
-					crypt.P = math.MaxUint32
+					crypt.P = int(int32(-1))
 
 					crypt.EncryptionKey = nil
 					ok, err = crypt.alg2a([]byte(c.UserPass))
@@ -329,3 +331,989 @@ func TestAESv3(t *testing.T) {
 		})
 	}
 }
+
+// Test encrypting only a subset of objects, as for an incremental update.
+func TestEncryptSubset(t *testing.T) {
+	crypter := PdfCrypt{}
+	crypter.V = 2
+	crypter.R = 3
+	crypter.Length = 128
+	crypter.CryptFilters = newCryptFiltersV2(16)
+	crypter.EncryptionKey = []byte("0123456789abcdef")
+
+	// Object 1 is an original (already encrypted), object 2 is new and refers to object 1.
+	origStr := MakeString("original")
+	orig := MakeIndirectObject(MakeDict())
+	orig.ObjectNumber = 1
+	orig.PdfObject.(*PdfObjectDictionary).Set("Title", origStr)
+
+	newStr := MakeString("new")
+	newDict := MakeDict()
+	newDict.Set("Title", newStr)
+	newDict.Set("Prev", orig)
+	newDict.Set("Ref", orig)
+	added := MakeIndirectObject(newDict)
+	added.ObjectNumber = 2
+
+	stream, err := MakeStream([]byte("stream data"), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	stream.ObjectNumber = 3
+
+	err = crypter.EncryptSubset([]PdfObject{orig, added, stream}, map[int64]bool{2: true, 3: true})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if string(*origStr) != "original" {
+		t.Errorf("Original object should not be modified (%q)", *origStr)
+	}
+	if string(*newStr) == "new" {
+		t.Errorf("New object not encrypted")
+	}
+	if string(stream.Stream) == "stream data" {
+		t.Errorf("New stream not encrypted")
+	}
+
+	// Check decryption with the object number of the new object.
+	key, err := crypter.makeKey(StandardCryptFilter, 2, 0, crypter.EncryptionKey)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	decrypted, err := crypter.decryptBytes([]byte(*newStr), StandardCryptFilter, key)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if string(decrypted) != "new" {
+		t.Errorf("Decrypted string mismatch (%q)", decrypted)
+	}
+
+	// Objects marked as encrypted are skipped by Encrypt.
+	other := MakeString("other")
+	crypter.MarkEncrypted(other)
+	if err := crypter.Encrypt(other, 4, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if string(*other) != "other" {
+		t.Errorf("Marked object should not be encrypted (%q)", *other)
+	}
+}
+
+// Test decrypting a set of top-level objects, including an object stream whose contained objects
+// are not encrypted individually.
+func TestDecryptDocument(t *testing.T) {
+	newCrypter := func() *PdfCrypt {
+		crypter := &PdfCrypt{V: 2, R: 3, Length: 128}
+		crypter.CryptFilters = newCryptFiltersV2(16)
+		crypter.EncryptionKey = []byte("0123456789abcdef")
+		crypter.EncryptedObjects = map[PdfObject]bool{}
+		return crypter
+	}
+
+	title := MakeString("Title")
+	info := MakeIndirectObject(MakeDict())
+	info.ObjectNumber = 1
+	info.PdfObject.(*PdfObjectDictionary).Set("Title", title)
+
+	content, err := MakeStream([]byte("BT (Hello) Tj ET"), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	content.ObjectNumber = 2
+
+	objStm, err := MakeStream([]byte("4 0 (inside)"), NewFlateEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	objStm.ObjectNumber = 3
+	objStm.Set("Type", MakeName("ObjStm"))
+	objStm.Set("N", MakeInteger(1))
+	objStm.Set("First", MakeInteger(4))
+
+	// Object 4 as loaded from the object stream.
+	inside := MakeString("inside")
+	contained := MakeIndirectObject(inside)
+	contained.ObjectNumber = 4
+	// Referred to from an object decrypted before it is reached in `objs`.
+	info.PdfObject.(*PdfObjectDictionary).Set("Inside", contained)
+
+	// Same string value in two objects: encrypted differently with each object number.
+	other := MakeString("Title")
+	otherObj := MakeIndirectObject(other)
+	otherObj.ObjectNumber = 5
+	otherObj.GenerationNumber = 2
+
+	objs := []PdfObject{info, content, objStm, contained, otherObj, MakeInteger(6)}
+	encrypter := newCrypter()
+	encrypter.MarkEncrypted(contained)
+	for _, obj := range objs {
+		if err := encrypter.Encrypt(obj, 0, 0); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if string(*title) == "Title" || string(content.Stream) == "BT (Hello) Tj ET" || *title == *other {
+		t.Fatalf("Objects not encrypted")
+	}
+
+	err = newCrypter().DecryptDocument(objs)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if string(*title) != "Title" || string(*other) != "Title" {
+		t.Errorf("Strings not decrypted: %q %q", *title, *other)
+	}
+	if string(content.Stream) != "BT (Hello) Tj ET" {
+		t.Errorf("Stream not decrypted: %q", content.Stream)
+	}
+	decoded, err := DecodeStream(objStm)
+	if err != nil || string(decoded) != "4 0 (inside)" {
+		t.Errorf("Object stream not decrypted: %q (%v)", decoded, err)
+	}
+	if string(*inside) != "inside" {
+		t.Errorf("Object in object stream modified: %q", *inside)
+	}
+}
+
+// Test encrypting an annotation added after the main encryption pass, which should give the same
+// result as a full pass, without encrypting the page it refers to again.
+func TestEncryptObjectPostHoc(t *testing.T) {
+	newCrypter := func() *PdfCrypt {
+		crypter := &PdfCrypt{V: 2, R: 3, Length: 128}
+		crypter.CryptFilters = newCryptFiltersV2(16)
+		crypter.EncryptionKey = []byte("0123456789abcdef")
+		crypter.EncryptedObjects = map[PdfObject]bool{}
+		return crypter
+	}
+	makeObjects := func() (*PdfIndirectObject, *PdfIndirectObject) {
+		page := MakeIndirectObject(MakeDict())
+		page.ObjectNumber = 3
+		page.PdfObject.(*PdfObjectDictionary).Set("PieceInfo", MakeString("page data"))
+		annotDict := MakeDict()
+		annotDict.Set("Contents", MakeString("Note"))
+		annotDict.Set("NM", MakeString("annot-1"))
+		annotDict.Set("P", page)
+		annot := MakeIndirectObject(annotDict)
+		annot.ObjectNumber = 7
+		return page, annot
+	}
+	getString := func(obj *PdfIndirectObject, key PdfObjectName) string {
+		return string(*obj.PdfObject.(*PdfObjectDictionary).Get(key).(*PdfObjectString))
+	}
+
+	// Full pass.
+	page, annot := makeObjects()
+	full := newCrypter()
+	for _, obj := range []PdfObject{page, annot} {
+		if err := full.Encrypt(obj, 0, 0); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	expectedPage := getString(page, "PieceInfo")
+	expectedContents := getString(annot, "Contents")
+
+	// Main pass without the annotation, which is encrypted afterwards.
+	page, annot = makeObjects()
+	crypter := newCrypter()
+	if err := crypter.Encrypt(page, 0, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	other := newCrypter()
+	if err := other.EncryptObject(annot, 7, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if getString(page, "PieceInfo") != expectedPage {
+		t.Errorf("Page referred to by the annotation encrypted again")
+	}
+	if getString(annot, "Contents") != expectedContents {
+		t.Errorf("Annotation encryption mismatch: % x != % x", getString(annot, "Contents"), expectedContents)
+	}
+
+	// Encrypting again has no effect, unless unmarked after modification.
+	if err := other.EncryptObject(annot, 7, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if getString(annot, "Contents") != expectedContents {
+		t.Errorf("Annotation encrypted twice")
+	}
+	annot.PdfObject.(*PdfObjectDictionary).Set("Contents", MakeString("Note"))
+	annot.PdfObject.(*PdfObjectDictionary).Set("NM", MakeString("annot-1"))
+	other.UnmarkEncrypted(annot)
+	if err := other.EncryptObject(annot, 7, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if getString(annot, "Contents") != expectedContents {
+		t.Errorf("Modified annotation not encrypted")
+	}
+
+	// Decrypting the annotation alone.
+	if err := newCrypter().DecryptObject(annot, 7, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if getString(annot, "Contents") != "Note" || getString(annot, "NM") != "annot-1" {
+		t.Errorf("Annotation not decrypted: %q", getString(annot, "Contents"))
+	}
+	if getString(page, "PieceInfo") != expectedPage {
+		t.Errorf("Page referred to by the annotation decrypted")
+	}
+}
+
+// Test that streams encrypted in a previous run are not encrypted again.
+func TestEncryptPreEncrypted(t *testing.T) {
+	makeCrypter := func() *PdfCrypt {
+		crypter := &PdfCrypt{}
+		crypter.V = 2
+		crypter.R = 3
+		crypter.Length = 128
+		crypter.CryptFilters = newCryptFiltersV2(16)
+		crypter.EncryptionKey = []byte("0123456789abcdef")
+		crypter.EncryptedObjects = map[PdfObject]bool{}
+		crypter.DecryptedObjects = map[PdfObject]bool{}
+		return crypter
+	}
+
+	stream, err := MakeStream([]byte("stream data"), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	stream.ObjectNumber = 5
+
+	// First run encrypts and marks the stream.
+	first := makeCrypter()
+	if err := first.Encrypt(stream, 0, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !first.IsEncrypted(stream) {
+		t.Fatalf("Encrypted stream should be marked")
+	}
+	encrypted := string(stream.Stream)
+	if encrypted == "stream data" {
+		t.Fatalf("Stream not encrypted")
+	}
+
+	// Second run (new crypter) taking over the marks of the first leaves it alone.
+	second := makeCrypter()
+	second.MarkEncryptedBy(first)
+	if err := second.Encrypt(stream, 0, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if string(stream.Stream) != encrypted {
+		t.Errorf("Pre-encrypted stream was encrypted again")
+	}
+
+	// Decrypting removes the mark.
+	if err := second.Decrypt(stream, 0, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if second.IsEncrypted(stream) || string(stream.Stream) != "stream data" {
+		t.Errorf("Invalid decrypted stream (%q, %v)", stream.Stream, second.IsEncrypted(stream))
+	}
+
+	// Explicitly marked objects, e.g. reused ciphertext, are skipped.
+	reused, err := MakeStream([]byte("ciphertext"), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	reused.ObjectNumber = 6
+	crypter := makeCrypter()
+	crypter.MarkEncrypted(reused)
+	if err := crypter.Encrypt(reused, 0, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if string(reused.Stream) != "ciphertext" {
+		t.Errorf("Marked stream was encrypted (%q)", reused.Stream)
+	}
+
+	// Modified objects are unmarked, so that the new contents are encrypted.
+	copy(reused.MutableStream(), "plaintext!")
+	crypter.UnmarkEncrypted(reused)
+	if err := crypter.Encrypt(reused, 0, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if string(reused.Stream) == "plaintext!" || !crypter.IsEncrypted(reused) {
+		t.Errorf("Modified stream not encrypted")
+	}
+}
+
+// Test detection of the Crypt filter in stream dictionaries (V>=4).
+func TestStreamCryptFilter(t *testing.T) {
+	crypter := PdfCrypt{}
+	crypter.V = 4
+	crypter.R = 4
+	crypter.CryptFilters = CryptFilters{StandardCryptFilter: NewCryptFilterV2(16), "Other": NewCryptFilterV2(16)}
+	crypter.StreamFilter = StandardCryptFilter
+	crypter.StringFilter = StandardCryptFilter
+	crypter.EncryptionKey = []byte("0123456789abcdef")
+
+	testcases := []struct {
+		dict     string
+		expected string
+	}{
+		{"<< /Filter /FlateDecode >>", StandardCryptFilter},
+		{"<< >>", StandardCryptFilter},
+		{"<< /Filter [] >>", StandardCryptFilter},
+		// Name form.
+		{"<< /Filter /Crypt >>", "Identity"},
+		{"<< /Filter /Crypt /DecodeParms << /Name /Other >> >>", "Other"},
+		// Array form.
+		{"<< /Filter [/Crypt /FlateDecode] /DecodeParms << /Name /Other >> >>", "Other"},
+		{"<< /Filter [/Crypt /FlateDecode] /DecodeParms [<< /Name /Other >> null] >>", "Other"},
+		{"<< /Filter [/Crypt /FlateDecode] /DecodeParms [null << /Predictor 12 >>] >>", "Identity"},
+		{"<< /Filter [/Crypt] /DecodeParms [<< /Name /Unknown >>] >>", "Identity"},
+		// Crypt not first.
+		{"<< /Filter [/FlateDecode /Crypt] /DecodeParms [null << /Name /Other >>] >>", "Other"},
+	}
+
+	for _, tc := range testcases {
+		parser := makeParserForText(tc.dict)
+		dict, err := parser.ParseDict()
+		if err != nil {
+			t.Fatalf("Error parsing %s: %v", tc.dict, err)
+		}
+		filter := crypter.streamCryptFilter(dict)
+		if filter != tc.expected {
+			t.Errorf("%s: filter %s != %s", tc.dict, filter, tc.expected)
+		}
+	}
+
+	// A stream with name-form Crypt filter (Identity) is left unchanged.
+	parser := makeParserForText("<< /Filter /Crypt /Length 4 >>")
+	dict, err := parser.ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	crypter.EncryptedObjects = map[PdfObject]bool{}
+	stream := &PdfObjectStream{PdfObjectDictionary: dict, Stream: []byte("data")}
+	stream.ObjectNumber = 1
+	if err := crypter.Encrypt(stream, 0, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if string(stream.Stream) != "data" {
+		t.Errorf("Identity crypt filter stream was encrypted")
+	}
+	crypter.DecryptedObjects = map[PdfObject]bool{}
+	if err := crypter.Decrypt(stream, 0, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if string(stream.Stream) != "data" {
+		t.Errorf("Identity crypt filter stream was decrypted")
+	}
+}
+
+// Test the crypt filter of embedded file streams given by EFF, e.g. DefEmbeddedFile, and that EFF
+// is kept when saving the crypt filters.
+func TestEmbeddedFileCryptFilter(t *testing.T) {
+	crypter := PdfCrypt{V: 4, R: 4, Length: 128}
+	crypter.CryptFilters = CryptFilters{StandardCryptFilter: NewCryptFilterAESV2(), "DefEmbeddedFile": NewCryptFilterV2(16)}
+	crypter.StreamFilter = StandardCryptFilter
+	crypter.StringFilter = StandardCryptFilter
+	crypter.EmbeddedFileFilter = "DefEmbeddedFile"
+	crypter.EncryptionKey = []byte("0123456789abcdef")
+
+	testcases := []struct {
+		dict     string
+		expected string
+	}{
+		{"<< /Type /EmbeddedFile /Length 4 >>", "DefEmbeddedFile"},
+		{"<< /Type /XObject /Length 4 >>", StandardCryptFilter},
+		{"<< /Length 4 >>", StandardCryptFilter},
+		// A Crypt filter of the stream takes precedence.
+		{"<< /Type /EmbeddedFile /Filter /Crypt >>", "Identity"},
+	}
+	for _, tc := range testcases {
+		dict, err := makeParserForText(tc.dict).ParseDict()
+		if err != nil {
+			t.Fatalf("Error parsing %s: %v", tc.dict, err)
+		}
+		if filter := crypter.streamCryptFilter(dict); filter != tc.expected {
+			t.Errorf("%s: filter %s != %s", tc.dict, filter, tc.expected)
+		}
+	}
+
+	ed := MakeDict()
+	if err := crypter.SaveCryptFilters(ed); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	loaded := PdfCrypt{V: 4, R: 4, Length: 128}
+	if err := loaded.LoadCryptFilters(ed); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if loaded.EmbeddedFileFilter != "DefEmbeddedFile" || loaded.CryptFilters["DefEmbeddedFile"].Cfm != CryptFilterV2 {
+		t.Errorf("EFF %q loaded from %s", loaded.EmbeddedFileFilter, ed.DefaultWriteString())
+	}
+	ed.Set("EFF", MakeName("Missing"))
+	if err := loaded.LoadCryptFilters(ed); err == nil {
+		t.Errorf("EFF not in CF: no error")
+	}
+
+	// An Identity EFF leaves embedded files unencrypted while other streams are encrypted.
+	crypter.EmbeddedFileFilter = "Identity"
+	crypter.EncryptedObjects = map[PdfObject]bool{}
+	for _, tc := range []struct {
+		dict      string
+		encrypted bool
+	}{
+		{"<< /Type /EmbeddedFile /Length 4 >>", false},
+		{"<< /Length 4 >>", true},
+	} {
+		dict, err := makeParserForText(tc.dict).ParseDict()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		stream := &PdfObjectStream{PdfObjectDictionary: dict, Stream: []byte("data")}
+		stream.ObjectNumber = 1
+		if err := crypter.Encrypt(stream, 0, 0); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if encrypted := string(stream.Stream) != "data"; encrypted != tc.encrypted {
+			t.Errorf("%s: encrypted %t, expected %t", tc.dict, encrypted, tc.encrypted)
+		}
+	}
+}
+
+// Test that decrypting and decoding a stream in read-only mode leaves the stream object unchanged,
+// as needed to keep signed byte ranges intact.
+func TestReadOnlyStreamDecode(t *testing.T) {
+	crypter := &PdfCrypt{V: 4, R: 4, Length: 128}
+	crypter.CryptFilters = CryptFilters{StandardCryptFilter: NewCryptFilterAESV2()}
+	crypter.StreamFilter = StandardCryptFilter
+	crypter.StringFilter = StandardCryptFilter
+	crypter.EncryptionKey = []byte("0123456789abcdef")
+	crypter.EncryptedObjects = map[PdfObject]bool{}
+	crypter.DecryptedObjects = map[PdfObject]bool{}
+
+	raw := []byte("BT /F1 12 Tf (Signed content) Tj ET")
+	stream, err := MakeStream(raw, NewFlateEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	stream.ObjectNumber = 7
+	if err := crypter.Encrypt(stream, 0, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	encrypted := append([]byte{}, stream.Stream...)
+	dictStr := stream.PdfObjectDictionary.DefaultWriteString()
+
+	data, err := crypter.DecryptStreamBytes(stream, 7, 0)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	decrypted := &PdfObjectStream{PdfObjectDictionary: stream.PdfObjectDictionary, Stream: data}
+	decoded, err := DecodeStreamReadOnly(decrypted)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !compareSlices(decoded, raw) {
+		t.Errorf("Decoded %q != %q", decoded, raw)
+	}
+
+	if !compareSlices(stream.Stream, encrypted) {
+		t.Errorf("Stream data modified")
+	}
+	if s := stream.PdfObjectDictionary.DefaultWriteString(); s != dictStr {
+		t.Errorf("Stream dictionary modified: %s != %s", s, dictStr)
+	}
+	if crypter.isDecrypted(stream) {
+		t.Errorf("Stream marked as decrypted")
+	}
+
+	// The decoded data of an unfiltered stream does not share memory with the stream data.
+	plain, err := MakeStream([]byte("data"), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	decoded, err = DecodeStreamReadOnly(plain)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	decoded[0] = 'X'
+	if string(plain.Stream) != "data" {
+		t.Errorf("Stream data modified through decoded data: %q", plain.Stream)
+	}
+}
+
+// Test decrypting an empty AESV2 stream stored without an initialization vector.
+func TestDecryptEmptyAESStream(t *testing.T) {
+	crypter := &PdfCrypt{V: 4, R: 4, Length: 128}
+	crypter.CryptFilters = CryptFilters{StandardCryptFilter: NewCryptFilterAESV2()}
+	crypter.StreamFilter = StandardCryptFilter
+	crypter.StringFilter = StandardCryptFilter
+	crypter.EncryptionKey = []byte("0123456789abcdef")
+	crypter.DecryptedObjects = map[PdfObject]bool{}
+
+	stream := &PdfObjectStream{PdfObjectDictionary: MakeDict(), Stream: []byte{}}
+	stream.ObjectNumber = 3
+	stream.Set("Length", MakeInteger(0))
+	if err := crypter.Decrypt(stream, 0, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(stream.Stream) != 0 {
+		t.Errorf("Decrypted empty stream not empty: % x", stream.Stream)
+	}
+
+	// A non-empty stream shorter than the IV is still invalid.
+	short := &PdfObjectStream{PdfObjectDictionary: MakeDict(), Stream: []byte("short")}
+	short.ObjectNumber = 4
+	if err := crypter.Decrypt(short, 0, 0); err == nil {
+		t.Errorf("Expected error for stream shorter than IV")
+	}
+}
+
+func TestKeyLengthBits(t *testing.T) {
+	testcases := []struct {
+		Name     string
+		Crypt    PdfCrypt
+		Expected int
+	}{
+		{"RC4 V1", PdfCrypt{V: 1, Length: 40}, 40},
+		{"RC4 V1 default", PdfCrypt{V: 1}, 40},
+		{"RC4 V2", PdfCrypt{V: 2, Length: 128}, 128},
+		{"RC4 crypt filter", PdfCrypt{V: 4, Length: 128, StreamFilter: StandardCryptFilter,
+			CryptFilters: CryptFilters{StandardCryptFilter: NewCryptFilterV2(16)}}, 128},
+		{"AESV2", PdfCrypt{V: 4, Length: 128, StreamFilter: StandardCryptFilter, StringFilter: StandardCryptFilter,
+			CryptFilters: CryptFilters{StandardCryptFilter: NewCryptFilterAESV2()}}, 128},
+		{"AESV3", PdfCrypt{V: 5, Length: 256, StreamFilter: StandardCryptFilter, StringFilter: StandardCryptFilter,
+			CryptFilters: CryptFilters{StandardCryptFilter: NewCryptFilterAESV3()}}, 256},
+		{"AESV2 strings only", PdfCrypt{V: 4, StreamFilter: "Identity", StringFilter: StandardCryptFilter,
+			CryptFilters: CryptFilters{StandardCryptFilter: NewCryptFilterAESV2()}}, 128},
+		{"Identity", PdfCrypt{V: 4, StreamFilter: "Identity", StringFilter: "Identity"}, 0},
+	}
+	for _, tcase := range testcases {
+		if bits := tcase.Crypt.KeyLengthBits(); bits != tcase.Expected {
+			t.Errorf("%s: %d bits, expected %d", tcase.Name, bits, tcase.Expected)
+		}
+	}
+}
+
+// Test authenticating a document encrypted with the unpublished V=3 algorithm (RC4 with a 96 bit key, R=3).
+func TestDecryptionV3(t *testing.T) {
+	id0 := string([]byte{0x5f, 0x91, 0xff, 0xf2, 0x00, 0x88, 0x13, 0x5f,
+		0x30, 0x24, 0xd1, 0x0f, 0x28, 0x31, 0xc6, 0xfa})
+
+	// Generate the O and U entries for the user and owner passwords.
+	gen := PdfCrypt{V: 3, R: 3, Length: 96, P: -3904, Id0: id0, EncryptMetadata: true}
+	O, err := gen.Alg3([]byte("user"), []byte("owner"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	gen.O = []byte(O)
+	U, key, err := gen.Alg5([]byte("user"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	ed := MakeDict()
+	ed.Set("Filter", MakeName("Standard"))
+	ed.Set("V", MakeInteger(3))
+	ed.Set("R", MakeInteger(3))
+	ed.Set("Length", MakeInteger(96))
+	ed.Set("P", MakeInteger(-3904))
+	ed.Set("O", &O)
+	ed.Set("U", &U)
+	trailer := MakeDict()
+	trailer.Set("ID", &PdfObjectArray{MakeString(id0), MakeString(id0)})
+
+	crypter, err := PdfCryptMakeNew(nil, ed, trailer)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if crypter.V != 3 || crypter.Length != 96 {
+		t.Fatalf("Invalid V or Length: %d %d", crypter.V, crypter.Length)
+	}
+
+	if ok, err := crypter.authenticate([]byte("wrong")); ok || err != nil {
+		t.Fatalf("Authenticated with wrong password (%v)", err)
+	}
+	if ok, err := crypter.authenticate([]byte("user")); !ok || err != nil {
+		t.Fatalf("Failed to authenticate user (%v)", err)
+	}
+	if !bytes.Equal(crypter.EncryptionKey, key) || len(key) != 12 {
+		t.Fatalf("Invalid key % x", crypter.EncryptionKey)
+	}
+	if ok, err := crypter.authenticate([]byte("owner")); !ok || err != nil {
+		t.Fatalf("Failed to authenticate owner (%v)", err)
+	}
+
+	// Round trip of a string object.
+	crypter.EncryptedObjects = map[PdfObject]bool{}
+	str := MakeString("Hello World")
+	obj := MakeIndirectObject(str)
+	obj.ObjectNumber = 5
+	if err := crypter.Encrypt(obj, 0, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if string(*str) == "Hello World" {
+		t.Fatalf("String not encrypted")
+	}
+	if err := crypter.Decrypt(obj, 0, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if string(*str) != "Hello World" {
+		t.Fatalf("Round trip failed: %q", string(*str))
+	}
+}
+
+// Test authenticating with trailer IDs that are not 16 bytes long, given as hex strings.  The ID
+// bytes are used as is in the key derivation (7.6.3.3 Algorithm 2).
+func TestDecryptionIDLength(t *testing.T) {
+	for _, hexID := range []string{"0102030405060708F", strings.Repeat("a1b2c3d4", 8)} {
+		parser := NewParserFromString(fmt.Sprintf("<< /ID [<%s> <%s>] >>", hexID, hexID))
+		trailer, err := parser.ParseDict()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		id0 := string(*(*trailer.Get("ID").(*PdfObjectArray))[0].(*PdfObjectString))
+		if len(id0) != (len(hexID)+1)/2 {
+			t.Fatalf("ID length %d for %s", len(id0), hexID)
+		}
+
+		gen := PdfCrypt{V: 2, R: 3, Length: 128, P: -3904, Id0: id0, EncryptMetadata: true}
+		O, err := gen.Alg3([]byte("user"), []byte("owner"))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		gen.O = []byte(O)
+		U, _, err := gen.Alg5([]byte("user"))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		ed := MakeDict()
+		ed.Set("Filter", MakeName("Standard"))
+		ed.Set("V", MakeInteger(2))
+		ed.Set("R", MakeInteger(3))
+		ed.Set("Length", MakeInteger(128))
+		ed.Set("P", MakeInteger(-3904))
+		ed.Set("O", &O)
+		ed.Set("U", &U)
+
+		crypter, err := PdfCryptMakeNew(nil, ed, trailer)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if crypter.Id0 != id0 {
+			t.Fatalf("Id0 mismatch: % x", crypter.Id0)
+		}
+		if ok, err := crypter.authenticate([]byte("user")); !ok || err != nil {
+			t.Fatalf("Failed to authenticate user with %d byte ID (%v)", len(id0), err)
+		}
+
+		// Expected key computed directly from the specification.
+		h := md5.New()
+		h.Write([]byte("user" + padding[:28]))
+		h.Write(gen.O)
+		pb := make([]byte, 4)
+		binary.LittleEndian.PutUint32(pb, uint32(int32(gen.P)))
+		h.Write(pb)
+		h.Write([]byte(id0))
+		key := h.Sum(nil)
+		for i := 0; i < 50; i++ {
+			sum := md5.Sum(key)
+			key = sum[:]
+		}
+		if !bytes.Equal(crypter.EncryptionKey, key) {
+			t.Errorf("Key mismatch for %d byte ID: % x != % x", len(id0), crypter.EncryptionKey, key)
+		}
+	}
+}
+
+// Test that the key length of V4 AESV2 encryption is 128 bits whatever the top-level Length says,
+// and that crypt filters with contradictory key lengths are rejected.
+func TestDecryptionAESV2Length(t *testing.T) {
+	id0 := "0123456789abcdef"
+	gen := PdfCrypt{V: 4, R: 4, Length: 128, P: -3904, Id0: id0, EncryptMetadata: true,
+		StreamFilter: StandardCryptFilter, StringFilter: StandardCryptFilter,
+		CryptFilters: CryptFilters{StandardCryptFilter: NewCryptFilterAESV2()}}
+	O, err := gen.Alg3([]byte("user"), []byte("owner"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	gen.O = []byte(O)
+	U, key, err := gen.Alg5([]byte("user"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	gen.EncryptionKey = key
+	gen.EncryptedObjects = map[PdfObject]bool{}
+
+	makeDict := func(filters CryptFilters, strf string) *PdfObjectDictionary {
+		ed := MakeDict()
+		ed.Set("Filter", MakeName("Standard"))
+		ed.Set("V", MakeInteger(4))
+		ed.Set("R", MakeInteger(4))
+		ed.Set("P", MakeInteger(-3904))
+		ed.Set("O", &O)
+		ed.Set("U", &U)
+		crypt := PdfCrypt{V: 4, CryptFilters: filters, StreamFilter: StandardCryptFilter, StringFilter: strf}
+		crypt.SaveCryptFilters(ed)
+		ed.Set("Length", MakeInteger(40))
+		return ed
+	}
+	trailer := MakeDict()
+	trailer.Set("ID", &PdfObjectArray{MakeString(id0), MakeString(id0)})
+
+	crypter, err := PdfCryptMakeNew(nil, makeDict(gen.CryptFilters, StandardCryptFilter), trailer)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if crypter.Length != 128 {
+		t.Errorf("Length %d, expected 128", crypter.Length)
+	}
+	if ok, err := crypter.authenticate([]byte("user")); !ok || err != nil {
+		t.Fatalf("Failed to authenticate user (%v)", err)
+	}
+	if !bytes.Equal(crypter.EncryptionKey, key) || len(key) != 16 {
+		t.Fatalf("Invalid key % x", crypter.EncryptionKey)
+	}
+
+	str := MakeString("Hello World")
+	obj := MakeIndirectObject(str)
+	obj.ObjectNumber = 5
+	if err := gen.Encrypt(obj, 0, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := crypter.Decrypt(obj, 0, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if string(*str) != "Hello World" {
+		t.Errorf("Decryption failed: %q", string(*str))
+	}
+
+	aes := NewCryptFilterAESV2()
+	aes.Length = 5
+	if _, err := PdfCryptMakeNew(nil, makeDict(CryptFilters{StandardCryptFilter: aes}, StandardCryptFilter), trailer); err == nil {
+		t.Errorf("AESV2 filter with 40 bit Length accepted")
+	}
+	mixed := CryptFilters{StandardCryptFilter: NewCryptFilterAESV2(), "RC4": NewCryptFilterV2(5)}
+	if _, err := PdfCryptMakeNew(nil, makeDict(mixed, "RC4"), trailer); err == nil {
+		t.Errorf("Crypt filters with 128 and 40 bit keys accepted")
+	}
+}
+
+// Test that TryPassword reports the user and owner passwords without changing Authenticated and
+// EncryptionKey, before and after authenticating.
+func TestTryPassword(t *testing.T) {
+	id0 := "0123456789abcdef"
+
+	gen := PdfCrypt{V: 2, R: 3, Length: 128, P: -3904, Id0: id0, EncryptMetadata: true}
+	O, err := gen.Alg3([]byte("user"), []byte("owner"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	gen.O = []byte(O)
+	U, _, err := gen.Alg5([]byte("user"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	gen.U = []byte(U)
+
+	gen6 := PdfCrypt{V: 5, R: 6, P: -3904, EncryptionKey: make([]byte, 32), EncryptMetadata: true}
+	if err := gen6.generateR6([]byte("user"), []byte("owner")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	for _, crypt := range []PdfCrypt{gen, gen6} {
+		crypt.EncryptionKey = nil
+		crypt.Authenticated = false
+
+		for _, authenticated := range []bool{false, true} {
+			if authenticated {
+				if ok, err := crypt.authenticate([]byte("user")); !ok || err != nil {
+					t.Fatalf("R=%d: Authentication failed: %v", crypt.R, err)
+				}
+			}
+			key := append([]byte{}, crypt.EncryptionKey...)
+
+			for _, pass := range []string{"wrong", "user", "owner"} {
+				ok, err := crypt.TryPassword([]byte(pass))
+				if err != nil {
+					t.Fatalf("R=%d: Error: %v", crypt.R, err)
+				}
+				if ok != (pass != "wrong") {
+					t.Errorf("R=%d: Password %q: %v", crypt.R, pass, ok)
+				}
+				if crypt.Authenticated != authenticated || !bytes.Equal(crypt.EncryptionKey, key) {
+					t.Errorf("R=%d: State changed by password %q (authenticated %v)", crypt.R, pass, authenticated)
+				}
+			}
+		}
+	}
+}
+
+// Test authenticating the owner password of documents with a zeroed or missing U, by the user
+// password derived from O.
+func TestDecryptionDamagedU(t *testing.T) {
+	id0 := "0123456789abcdef"
+
+	for _, r := range []int{2, 3} {
+		gen := PdfCrypt{V: 2, R: r, Length: 128, P: -3904, Id0: id0, EncryptMetadata: true}
+		if r == 2 {
+			gen.V, gen.Length = 1, 40
+		}
+		O, err := gen.Alg3([]byte("user"), []byte("owner"))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		gen.O = []byte(O)
+		key := gen.Alg2([]byte("user"))
+
+		ed := MakeDict()
+		ed.Set("Filter", MakeName("Standard"))
+		ed.Set("V", MakeInteger(int64(gen.V)))
+		ed.Set("R", MakeInteger(int64(r)))
+		ed.Set("Length", MakeInteger(int64(gen.Length)))
+		ed.Set("P", MakeInteger(-3904))
+		ed.Set("O", &O)
+		trailer := MakeDict()
+		trailer.Set("ID", &PdfObjectArray{MakeString(id0), MakeString(id0)})
+
+		for _, zeroed := range []bool{true, false} {
+			ed.Remove("U")
+			if zeroed {
+				ed.Set("U", MakeString(string(make([]byte, 32))))
+			}
+			crypter, err := PdfCryptMakeNew(nil, ed, trailer)
+			if err != nil {
+				t.Fatalf("R=%d: Error: %v", r, err)
+			}
+
+			for _, pass := range []string{"wrong", "user", ""} {
+				if ok, err := crypter.authenticate([]byte(pass)); ok || err != nil {
+					t.Errorf("R=%d zeroed U %t: authenticated with password %q (%v)", r, zeroed, pass, err)
+				}
+			}
+			if ok, err := crypter.authenticate([]byte("owner")); !ok || err != nil {
+				t.Fatalf("R=%d zeroed U %t: failed to authenticate owner (%v)", r, zeroed, err)
+			}
+			if !bytes.Equal(crypter.EncryptionKey, key) || !crypter.IsOwnerAuthenticated() {
+				t.Errorf("R=%d zeroed U %t: invalid key % x", r, zeroed, crypter.EncryptionKey)
+			}
+		}
+
+		// An intact U that does not verify the user password derived from O rejects the owner
+		// password.
+		var U PdfObjectString
+		if r == 2 {
+			U, _, err = gen.Alg4([]byte("other"))
+		} else {
+			U, _, err = gen.Alg5([]byte("other"))
+		}
+		if err != nil {
+			t.Fatalf("R=%d: Error: %v", r, err)
+		}
+		ed.Set("U", &U)
+		crypter, err := PdfCryptMakeNew(nil, ed, trailer)
+		if err != nil {
+			t.Fatalf("R=%d: Error: %v", r, err)
+		}
+		if ok, err := crypter.authenticate([]byte("owner")); ok || err != nil {
+			t.Errorf("R=%d mismatched U: authenticated owner (%v)", r, err)
+		}
+	}
+}
+
+// makeNestedArrayObject returns indirect object 1 holding string `str` nested in `depth` arrays.
+func makeNestedArrayObject(str *PdfObjectString, depth int) *PdfIndirectObject {
+	var obj PdfObject = str
+	for i := 0; i < depth; i++ {
+		obj = MakeArray(obj)
+	}
+	ind := MakeIndirectObject(obj)
+	ind.ObjectNumber = 1
+	return ind
+}
+
+// Test that deeply nested arrays fail cleanly, without growing the stack with the nesting depth:
+// the traversal runs with a maximum stack size that a recursive traversal would exceed.
+func TestCryptNestingDepth(t *testing.T) {
+	newCrypter := func() *PdfCrypt {
+		crypter := &PdfCrypt{V: 2, R: 3, Length: 128}
+		crypter.CryptFilters = newCryptFiltersV2(16)
+		crypter.EncryptionKey = []byte("0123456789abcdef")
+		crypter.EncryptedObjects = map[PdfObject]bool{}
+		crypter.DecryptedObjects = map[PdfObject]bool{}
+		return crypter
+	}
+
+	malicious := makeNestedArrayObject(MakeString("secret"), 100000)
+	defer debug.SetMaxStack(debug.SetMaxStack(1 << 20))
+	if err := newCrypter().Encrypt(malicious, 0, 0); err != ErrCryptNestingTooDeep {
+		t.Errorf("Encrypt: expected ErrCryptNestingTooDeep, got %v", err)
+	}
+	if err := newCrypter().Decrypt(malicious, 0, 0); err != ErrCryptNestingTooDeep {
+		t.Errorf("Decrypt: expected ErrCryptNestingTooDeep, got %v", err)
+	}
+
+	str := MakeString("secret")
+	deep := makeNestedArrayObject(str, DefaultCryptMaxNesting)
+	if err := newCrypter().Encrypt(deep, 0, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if string(*str) == "secret" {
+		t.Errorf("String not encrypted")
+	}
+	if err := newCrypter().Decrypt(deep, 0, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if string(*str) != "secret" {
+		t.Errorf("Decrypted string mismatch (%q)", *str)
+	}
+
+	crypter := newCrypter()
+	crypter.MaxNesting = 10
+	if err := crypter.Encrypt(makeNestedArrayObject(MakeString("x"), 10), 0, 0); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	crypter = newCrypter()
+	crypter.MaxNesting = 10
+	if err := crypter.Encrypt(makeNestedArrayObject(MakeString("x"), 11), 0, 0); err != ErrCryptNestingTooDeep {
+		t.Errorf("Expected ErrCryptNestingTooDeep, got %v", err)
+	}
+}
+
+// recordingCryptFilter is a crypt filter method that leaves the data unchanged and records it.
+type recordingCryptFilter struct {
+	cryptFilterV2
+	data *[]string
+}
+
+func (f recordingCryptFilter) EncryptBytes(p []byte, okey []byte) ([]byte, error) {
+	*f.data = append(*f.data, string(p))
+	return p, nil
+}
+
+// Test that the objects are encrypted in the order of the array elements and dictionary keys,
+// following references except Parent, Prev and Last.
+func TestCryptTraversalOrder(t *testing.T) {
+	var encrypted []string
+	crypter := &PdfCrypt{V: 2, R: 3, Length: 128}
+	crypter.CryptFilters = CryptFilters{StandardCryptFilter: CryptFilter{Cfm: CryptFilterV2, Length: 16,
+		cfm: recordingCryptFilter{data: &encrypted}}}
+	crypter.EncryptionKey = []byte("0123456789abcdef")
+	crypter.EncryptedObjects = map[PdfObject]bool{}
+
+	ref := func(num int64, obj PdfObject) *PdfIndirectObject {
+		ind := MakeIndirectObject(obj)
+		ind.ObjectNumber = num
+		return ind
+	}
+	stream, err := MakeStream([]byte("5 stream"), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	stream.ObjectNumber = 5
+	stream.Set("Name", MakeString("5 dict"))
+	dict := MakeDict()
+	dict.Set("Z", MakeString("1 Z"))
+	dict.Set("A", MakeArray(ref(2, MakeString("2")), MakeDict(), MakeString("1 A"), stream))
+	dict.Set("Parent", ref(3, MakeString("3")))
+	dict.Set("M", ref(4, MakeArray(MakeString("4"), ref(6, MakeString("6")))))
+	if err := crypter.Encrypt(ref(1, dict), 0, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	expected := "[1 Z 2 1 A 5 stream 5 dict 4 6]"
+	if fmt.Sprint(encrypted) != expected {
+		t.Errorf("Encryption order %v, expected %s", encrypted, expected)
+	}
+}
@@ -19,6 +19,7 @@ package core
 
 import (
 	"bytes"
+	"compress/flate"
 	"compress/zlib"
 	"encoding/hex"
 	"errors"
@@ -70,6 +71,16 @@ type FlateEncoder struct {
 	// For predictors
 	Columns int
 	Colors  int
+	// Compression level for encoding, from 1 (best speed) to 9 (best compression).  0 selects the
+	// default level.
+	CompressionLevel int
+	// ConcatenatedSegments makes decoding continue with any zlib streams following the first one
+	// until the end of the data, concatenating the decoded outputs.  Some broken generators write
+	// streams this way.  By default decoding stops after the first zlib stream.
+	ConcatenatedSegments bool
+	// RecoverTruncated makes decoding a truncated zlib stream, or one with a wrong Adler-32
+	// checksum, return the data inflated up to the error.  By default the error is returned.
+	RecoverTruncated bool
 }
 
 // Make a new flate encoder with default parameters, predictor 1 and bits per component 8.
@@ -91,8 +102,8 @@ func NewFlateEncoder() *FlateEncoder {
 // Set the predictor function.  Specify the number of columns per row.
 // The columns indicates the number of samples per row.
 // Used for grouping data together for compression.
+// Sets the PNG Sub predictor (11); the other PNG predictors (10 to 15) can be set with Predictor.
 func (this *FlateEncoder) SetPredictor(columns int) {
-	// Only supporting PNG sub predictor for encoding.
 	this.Predictor = 11
 	this.Columns = columns
 }
@@ -136,10 +147,27 @@ func (this *FlateEncoder) MakeStreamDict() *PdfObjectDictionary {
 	return dict
 }
 
+// traceDecodeParam returns the direct object of `obj`, an entry of the decode parameters of stream
+// `streamObj`.  References are looked up with the parser that loaded the stream, if any.
+func traceDecodeParam(streamObj *PdfObjectStream, obj PdfObject) PdfObject {
+	if ref, isRef := obj.(*PdfObjectReference); isRef && streamObj.parser != nil {
+		resolved, err := streamObj.parser.Trace(ref)
+		if err != nil {
+			common.Log.Debug("ERROR: Unable to resolve decode parameter %s: %v", ref, err)
+			return obj
+		}
+		obj = resolved
+	}
+	return TraceToDirectObject(obj)
+}
+
 // Create a new flate decoder from a stream object, getting all the encoding parameters
 // from the DecodeParms stream object dictionary entry.
 func newFlateEncoderFromStream(streamObj *PdfObjectStream, decodeParams *PdfObjectDictionary) (*FlateEncoder, error) {
 	encoder := NewFlateEncoder()
+	encoder.ConcatenatedSegments = decodingOpts(streamObj).FlateConcatenatedSegments
+	encoder.RecoverTruncated = decodingOpts(streamObj).FlateRecoverTruncated
+	var err error
 
 	encDict := streamObj.PdfObjectDictionary
 	if encDict == nil {
@@ -149,14 +177,14 @@ func newFlateEncoderFromStream(streamObj *PdfObjectStream, decodeParams *PdfObje
 
 	// If decodeParams not provided, see if we can get from the stream.
 	if decodeParams == nil {
-		obj := TraceToDirectObject(encDict.Get("DecodeParms"))
+		obj := traceDecodeParam(streamObj, encDict.Get("DecodeParms"))
 		if obj != nil {
 			if arr, isArr := obj.(*PdfObjectArray); isArr {
 				if len(*arr) != 1 {
 					common.Log.Debug("Error: DecodeParms array length != 1 (%d)", len(*arr))
 					return nil, errors.New("Range check error")
 				}
-				obj = TraceToDirectObject((*arr)[0])
+				obj = traceDecodeParam(streamObj, (*arr)[0])
 			}
 
 			dp, isDict := obj.(*PdfObjectDictionary)
@@ -173,7 +201,7 @@ func newFlateEncoderFromStream(streamObj *PdfObjectStream, decodeParams *PdfObje
 	}
 
 	common.Log.Trace("decode params: %s", decodeParams.String())
-	obj := decodeParams.Get("Predictor")
+	obj := traceDecodeParam(streamObj, decodeParams.Get("Predictor"))
 	if obj == nil {
 		common.Log.Debug("Error: Predictor missing from DecodeParms - Continue with default (1)")
 	} else {
@@ -182,43 +210,58 @@ func newFlateEncoderFromStream(streamObj *PdfObjectStream, decodeParams *PdfObje
 			common.Log.Debug("Error: Predictor specified but not numeric (%T)", obj)
 			return nil, fmt.Errorf("Invalid Predictor")
 		}
-		encoder.Predictor = int(*predictor)
+		encoder.Predictor, err = ToInt("Predictor", int64(*predictor), 0, MaxInt)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Bits per component.  Use default if not specified (8).
-	obj = decodeParams.Get("BitsPerComponent")
+	obj = traceDecodeParam(streamObj, decodeParams.Get("BitsPerComponent"))
 	if obj != nil {
 		bpc, ok := obj.(*PdfObjectInteger)
 		if !ok {
 			common.Log.Debug("ERROR: Invalid BitsPerComponent")
 			return nil, fmt.Errorf("Invalid BitsPerComponent")
 		}
-		encoder.BitsPerComponent = int(*bpc)
+		encoder.BitsPerComponent, err = ToInt("BitsPerComponent", int64(*bpc), 1, 16)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if encoder.Predictor > 1 {
 		// Columns.
 		encoder.Columns = 1
-		obj = decodeParams.Get("Columns")
+		obj = traceDecodeParam(streamObj, decodeParams.Get("Columns"))
 		if obj != nil {
 			columns, ok := obj.(*PdfObjectInteger)
 			if !ok {
 				return nil, fmt.Errorf("Predictor column invalid")
 			}
 
-			encoder.Columns = int(*columns)
+			encoder.Columns, err = ToInt("Columns", int64(*columns), 1, MaxInt)
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		// Colors.
 		// Number of interleaved color components per sample (Default 1 if not specified)
 		encoder.Colors = 1
-		obj = decodeParams.Get("Colors")
+		obj = traceDecodeParam(streamObj, decodeParams.Get("Colors"))
 		if obj != nil {
 			colors, ok := obj.(*PdfObjectInteger)
 			if !ok {
 				return nil, fmt.Errorf("Predictor colors not an integer")
 			}
-			encoder.Colors = int(*colors)
+			encoder.Colors, err = ToInt("Colors", int64(*colors), 1, MaxInt)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := checkRowLength(encoder.Columns, encoder.Colors, encoder.BitsPerComponent); err != nil {
+			return nil, err
 		}
 	}
 
@@ -230,6 +273,14 @@ func (this *FlateEncoder) DecodeBytes(encoded []byte) ([]byte, error) {
 
 	bufReader := bytes.NewReader(encoded)
 	r, err := zlib.NewReader(bufReader)
+	if err == zlib.ErrHeader {
+		// Some generators write raw deflate data without the zlib wrapper.
+		decoded, rawErr := inflateRaw(encoded)
+		if rawErr == nil {
+			common.Log.Debug("Flate stream missing zlib header - decoded as raw deflate data")
+			return decoded, nil
+		}
+	}
 	if err != nil {
 		common.Log.Debug("Decoding error %v\n", err)
 		common.Log.Debug("Stream (%d) % x", len(encoded), encoded)
@@ -238,7 +289,28 @@ func (this *FlateEncoder) DecodeBytes(encoded []byte) ([]byte, error) {
 	defer r.Close()
 
 	var outBuf bytes.Buffer
-	outBuf.ReadFrom(r)
+	_, err = outBuf.ReadFrom(r)
+	for err == nil && this.ConcatenatedSegments && skipZlibSeparator(bufReader) {
+		// Malformed stream with another zlib stream following the first one.
+		var next io.ReadCloser
+		next, err = zlib.NewReader(bufReader)
+		if err != nil {
+			common.Log.Debug("Ignoring %d bytes after flate stream: %v", bufReader.Len(), err)
+			err = nil
+			break
+		}
+		common.Log.Debug("Flate stream with concatenated zlib stream at %d decoded bytes", outBuf.Len())
+		_, err = outBuf.ReadFrom(next)
+		next.Close()
+	}
+	if err != nil {
+		// Truncated stream or wrong Adler-32 checksum.
+		if !this.RecoverTruncated {
+			common.Log.Debug("Flate stream error after %d decoded bytes: %v", outBuf.Len(), err)
+			return nil, err
+		}
+		common.Log.Debug("Flate stream error after %d decoded bytes: %v - using decoded data", outBuf.Len(), err)
+	}
 
 	common.Log.Trace("En: % x\n", encoded)
 	common.Log.Trace("De: % x\n", outBuf.Bytes())
@@ -246,6 +318,34 @@ func (this *FlateEncoder) DecodeBytes(encoded []byte) ([]byte, error) {
 	return outBuf.Bytes(), nil
 }
 
+// skipZlibSeparator skips white space in `r` following a zlib stream and returns true if more data
+// follows.
+func skipZlibSeparator(r *bytes.Reader) bool {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return false
+		}
+		if !IsWhiteSpace(b) {
+			r.UnreadByte()
+			return true
+		}
+	}
+}
+
+// inflateRaw decodes raw deflate data (without zlib header and checksum).
+func inflateRaw(encoded []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(encoded))
+	defer r.Close()
+
+	var outBuf bytes.Buffer
+	_, err := outBuf.ReadFrom(r)
+	if err != nil {
+		return nil, err
+	}
+	return outBuf.Bytes(), nil
+}
+
 // Decode a FlateEncoded stream object and give back decoded bytes.
 func (this *FlateEncoder) DecodeStream(streamObj *PdfObjectStream) ([]byte, error) {
 	// TODO: Handle more filter bytes and support more values of BitsPerComponent.
@@ -304,147 +404,298 @@ func (this *FlateEncoder) DecodeStream(streamObj *PdfObjectStream) ([]byte, erro
 			return pOutData, nil
 		} else if this.Predictor >= 10 && this.Predictor <= 15 {
 			common.Log.Trace("PNG Encoding")
-			// Columns represents the number of samples per row; Each sample can contain multiple color
-			// components.
-			rowLength := int(this.Columns*this.Colors + 1) // 1 byte to specify predictor algorithms per row.
-			rows := len(outData) / rowLength
-			if len(outData)%rowLength != 0 {
-				return nil, fmt.Errorf("Invalid row length (%d/%d)", len(outData), rowLength)
-			}
-			if rowLength > len(outData) {
-				common.Log.Debug("Row length cannot be longer than data length (%d/%d)", rowLength, len(outData))
-				return nil, errors.New("Range check error")
-			}
-
-			pOutBuffer := bytes.NewBuffer(nil)
-
 			common.Log.Trace("Predictor columns: %d", this.Columns)
-			common.Log.Trace("Length: %d / %d = %d rows", len(outData), rowLength, rows)
-			prevRowData := make([]byte, rowLength)
-			for i := 0; i < rowLength; i++ {
-				prevRowData[i] = 0
-			}
+			rowLength, bpp := this.pngRowLength()
+			return pngUnpredict(outData, rowLength, bpp)
+		} else {
+			common.Log.Debug("ERROR: Unsupported predictor (%d)", this.Predictor)
+			return nil, fmt.Errorf("Unsupported predictor (%d)", this.Predictor)
+		}
+	}
 
-			for i := 0; i < rows; i++ {
-				rowData := outData[rowLength*i : rowLength*(i+1)]
+	return outData, nil
+}
 
-				fb := rowData[0]
-				switch fb {
-				case 0:
-					// No prediction. (No operation).
-				case 1:
-					// Sub: Predicts the same as the sample to the left.
-					for j := 2; j < rowLength; j++ {
-						rowData[j] = byte(int(rowData[j]+rowData[j-1]) % 256)
-					}
-				case 2:
-					// Up: Predicts the same as the sample above
-					for j := 1; j < rowLength; j++ {
-						rowData[j] = byte(int(rowData[j]+prevRowData[j]) % 256)
-					}
-				case 3:
-					// Avg: Predicts the same as the average of the sample to the left and above.
-					for j := 1; j < rowLength; j++ {
-						if j == 1 {
-							rowData[j] = byte(int(rowData[j]+prevRowData[j]) % 256)
-						} else {
-							avg := (rowData[j-1] + prevRowData[j]) / 2
-							rowData[j] = byte(int(rowData[j]+avg) % 256)
-						}
-					}
-				case 4:
-					// Paeth: a nonlinear function of the sample above, the sample to the left and the sample
-					// to the upper left.
-					for j := 2; j < rowLength; j++ {
-						a := rowData[j-1]     // left
-						b := prevRowData[j]   // above
-						c := prevRowData[j-1] // upper left
-
-						p := int(a + b - c)
-						pa := absInt(p - int(a))
-						pb := absInt(p - int(b))
-						pc := absInt(p - int(c))
-
-						if pa <= pb && pa <= pc {
-							// Use a (left).
-							rowData[j] = byte(int(rowData[j]+a) % 256)
-						} else if pb <= pc {
-							// Use b (upper).
-							rowData[j] = byte(int(rowData[j]+b) % 256)
-						} else {
-							// Use c (upper left).
-							rowData[j] = byte(int(rowData[j]+c) % 256)
-						}
-					}
+// DecodeBytesDownscaled decodes the flate data of an image of `width` x `height` samples of
+// `colors` 8 bit components and downscales it by 1/`scale` in each dimension, averaging each
+// scale x scale block of samples, e.g. for generating previews.  Returns the samples along with the
+// reduced width and height (rounded up).  The data is inflated and its predictor reversed a row at
+// a time, so the full resolution image is never held in memory.  With a predictor, the Columns
+// and Colors of the encoder must be `width` and `colors`.
+func (this *FlateEncoder) DecodeBytesDownscaled(encoded []byte, width, height, colors, scale int) ([]byte, int, int, error) {
+	if err := checkDownscale(width, height, colors, scale); err != nil {
+		return nil, 0, 0, err
+	}
+	if this.BitsPerComponent != 8 {
+		return nil, 0, 0, errors.New("Downscaled decoding requires 8 bits per component")
+	}
+	png := this.Predictor >= 10 && this.Predictor <= 15
+	if this.Predictor > 1 {
+		if this.Predictor != 2 && !png {
+			common.Log.Debug("ERROR: Unsupported predictor (%d)", this.Predictor)
+			return nil, 0, 0, fmt.Errorf("Unsupported predictor (%d)", this.Predictor)
+		}
+		if this.Columns != width || this.Colors != colors {
+			return nil, 0, 0, fmt.Errorf("Predictor rows of %d columns of %d colors for image %dx%d of %d colors",
+				this.Columns, this.Colors, width, height, colors)
+		}
+	}
 
-				default:
-					common.Log.Debug("ERROR: Invalid filter byte (%d) @row %d", fb, i)
-					return nil, fmt.Errorf("Invalid filter byte (%d)", fb)
-				}
+	var r io.ReadCloser
+	r, err := zlib.NewReader(bytes.NewReader(encoded))
+	if err == zlib.ErrHeader {
+		// Raw deflate data without the zlib wrapper, as in DecodeBytes.
+		r, err = flate.NewReader(bytes.NewReader(encoded)), nil
+	}
+	if err != nil {
+		common.Log.Debug("Decoding error %v", err)
+		return nil, 0, 0, err
+	}
+	defer r.Close()
 
-				for i := 0; i < rowLength; i++ {
-					prevRowData[i] = rowData[i]
-				}
-				pOutBuffer.Write(rowData[1:])
+	rowLength := width * colors
+	var buf, row, prev []byte
+	if png {
+		// Each row is preceded by its filter type byte.
+		buf = make([]byte, rowLength+1)
+		row = buf[1:]
+		prev = make([]byte, rowLength)
+	} else {
+		buf = make([]byte, rowLength)
+		row = buf
+	}
+	d := newRowDownscaler(width, colors, scale)
+	for y := 0; y < height; y++ {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			common.Log.Debug("Flate image data ends at row %d of %d: %v", y, height, err)
+			return nil, 0, 0, err
+		}
+		if this.Predictor == 2 {
+			for j := colors; j < rowLength; j++ {
+				row[j] += row[j-colors]
 			}
-			pOutData := pOutBuffer.Bytes()
-			return pOutData, nil
-		} else {
-			common.Log.Debug("ERROR: Unsupported predictor (%d)", this.Predictor)
-			return nil, fmt.Errorf("Unsupported predictor (%d)", this.Predictor)
+		} else if png {
+			if !pngUnfilterRow(buf[0], row, prev, colors) {
+				common.Log.Debug("ERROR: Invalid filter byte (%d) @row %d", buf[0], y)
+				return nil, 0, 0, fmt.Errorf("Invalid filter byte (%d)", buf[0])
+			}
+			copy(prev, row)
 		}
+		d.addRow(row)
 	}
 
-	return outData, nil
+	return d.samples(), d.scaledWidth, (height + scale - 1) / scale, nil
 }
 
 // Encode a bytes array and return the encoded value based on the encoder parameters.
 func (this *FlateEncoder) EncodeBytes(data []byte) ([]byte, error) {
-	if this.Predictor != 1 && this.Predictor != 11 {
-		common.Log.Debug("Encoding error: FlateEncoder Predictor = 1, 11 only supported")
+	if this.Predictor != 1 && (this.Predictor < 10 || this.Predictor > 15) {
+		common.Log.Debug("Encoding error: FlateEncoder Predictor = 1, 10-15 only supported")
 		return nil, ErrUnsupportedEncodingParameters
 	}
 
-	if this.Predictor == 11 {
-		// The length of each output row in number of samples.
-		// N.B. Each output row has one extra sample as compared to the input to indicate the
-		// predictor type.
-		rowLength := int(this.Columns)
-		rows := len(data) / rowLength
-		if len(data)%rowLength != 0 {
+	if this.Predictor >= 10 {
+		// The length of each input row in bytes.
+		// N.B. Each output row has one extra byte as compared to the input to indicate the
+		// filter type.
+		rowLength, bpp := this.pngRowLength()
+		if rowLength < 1 || len(data)%rowLength != 0 {
 			common.Log.Error("Invalid column length")
 			return nil, errors.New("Invalid row length")
 		}
+		rows := len(data) / rowLength
 
 		pOutBuffer := bytes.NewBuffer(nil)
 
+		// Filter types of the predictors 10 (None) to 14 (Paeth).  Predictor 15 (optimum) chooses
+		// the filter type per row.
+		filter := byte(this.Predictor - 10)
 		tmpData := make([]byte, rowLength)
+		bestData := make([]byte, rowLength)
+		prevRowData := make([]byte, rowLength)
 
 		for i := 0; i < rows; i++ {
 			rowData := data[rowLength*i : rowLength*(i+1)]
 
-			// PNG SUB method.
-			// Sub: Predicts the same as the sample to the left.
-			tmpData[0] = rowData[0]
-			for j := 1; j < rowLength; j++ {
-				tmpData[j] = byte(int(rowData[j]-rowData[j-1]) % 256)
+			if this.Predictor != 15 {
+				pngFilterRow(filter, rowData, prevRowData, tmpData, bpp)
+				pOutBuffer.WriteByte(filter)
+				pOutBuffer.Write(tmpData)
+				prevRowData = rowData
+				continue
 			}
 
-			pOutBuffer.WriteByte(1) // sub method
-			pOutBuffer.Write(tmpData)
+			// Optimum: the filter type giving the smallest sum of absolute differences (taken as
+			// signed bytes), as suggested by the PNG specification.
+			bestFilter, bestSum := byte(0), -1
+			for f := byte(0); f <= 4; f++ {
+				pngFilterRow(f, rowData, prevRowData, tmpData, bpp)
+				sum := 0
+				for _, b := range tmpData {
+					sum += absInt(int(int8(b)))
+				}
+				if bestSum < 0 || sum < bestSum {
+					bestFilter, bestSum = f, sum
+					copy(bestData, tmpData)
+				}
+			}
+			pOutBuffer.WriteByte(bestFilter)
+			pOutBuffer.Write(bestData)
+			prevRowData = rowData
 		}
 
 		data = pOutBuffer.Bytes()
 	}
 
 	var b bytes.Buffer
-	w := zlib.NewWriter(&b)
+	level := zlib.DefaultCompression
+	if this.CompressionLevel >= zlib.BestSpeed && this.CompressionLevel <= zlib.BestCompression {
+		level = this.CompressionLevel
+	}
+	w, err := zlib.NewWriterLevel(&b, level)
+	if err != nil {
+		return nil, err
+	}
 	w.Write(data)
 	w.Close()
 
 	return b.Bytes(), nil
 }
 
+// checkRowLength checks that the number of bits of a row of `columns` samples of `colors`
+// components of `bpc` bits, as used by the predictors, fits an int.
+func checkRowLength(columns, colors, bpc int) error {
+	bits, ok := mulInt64(int64(columns), int64(colors))
+	if ok {
+		bits, ok = mulInt64(bits, int64(bpc))
+	}
+	if !ok {
+		bits = 1<<63 - 1
+	}
+	_, err := ToInt("predictor row bits", bits, 0, maxInt-8)
+	return err
+}
+
+// pngRowLength returns the number of bytes per row of data for the PNG predictors (excluding the
+// filter type byte) and the number of bytes per pixel, which is the distance to the byte to the
+// left used by the prediction (at least 1).
+func (this *FlateEncoder) pngRowLength() (rowLength int, bpp int) {
+	return pngRowLength(this.Columns, this.Colors, this.BitsPerComponent)
+}
+
+// pngRowLength returns the number of bytes per row and per pixel of the PNG predictors for
+// `columns` samples per row of `colors` components of `bitsPerComponent` bits (see
+// FlateEncoder.pngRowLength).
+func pngRowLength(columns, colors, bitsPerComponent int) (rowLength int, bpp int) {
+	bitsPerPixel := colors * bitsPerComponent
+	rowLength = (columns*bitsPerPixel + 7) / 8
+	bpp = (bitsPerPixel + 7) / 8
+	if bpp < 1 {
+		bpp = 1
+	}
+	return rowLength, bpp
+}
+
+// pngUnpredict reverses the PNG predictors on `data`, rows of `rowLength` bytes each preceded by
+// the filter type byte of the row, with `bpp` bytes per pixel.  The previous row of the first row
+// is all zeros, and the bytes to the left of the first pixel of each row are zeros, as for PNG
+// images.  Returns the rows without their filter type bytes.
+func pngUnpredict(data []byte, rowLength, bpp int) ([]byte, error) {
+	// Each row has 1 byte to specify the predictor algorithm (filter type) of the row.
+	rowLength++
+	rows := len(data) / rowLength
+	if len(data)%rowLength != 0 {
+		return nil, fmt.Errorf("Invalid row length (%d/%d)", len(data), rowLength)
+	}
+	if rowLength > len(data) {
+		common.Log.Debug("Row length cannot be longer than data length (%d/%d)", rowLength, len(data))
+		return nil, errors.New("Range check error")
+	}
+
+	pOutBuffer := bytes.NewBuffer(nil)
+
+	common.Log.Trace("Length: %d / %d = %d rows", len(data), rowLength, rows)
+	prevRowData := make([]byte, rowLength-1)
+	for i := 0; i < rows; i++ {
+		rowData := data[rowLength*i : rowLength*(i+1)]
+
+		fb := rowData[0]
+		if !pngUnfilterRow(fb, rowData[1:], prevRowData, bpp) {
+			common.Log.Debug("ERROR: Invalid filter byte (%d) @row %d", fb, i)
+			return nil, fmt.Errorf("Invalid filter byte (%d)", fb)
+		}
+
+		prevRowData = rowData[1:]
+		pOutBuffer.Write(rowData[1:])
+	}
+	return pOutBuffer.Bytes(), nil
+}
+
+// pngFilterRow applies the PNG filter type `filter` (0 None, 1 Sub, 2 Up, 3 Average, 4 Paeth) to the
+// row `row` with the previous row `prev` (all zeros for the first row) and `bpp` bytes per pixel,
+// writing the result to `out`.
+func pngFilterRow(filter byte, row, prev, out []byte, bpp int) {
+	for j := range row {
+		var left, upperLeft byte
+		if j >= bpp {
+			left, upperLeft = row[j-bpp], prev[j-bpp]
+		}
+		out[j] = row[j] - pngPrediction(filter, left, prev[j], upperLeft)
+	}
+}
+
+// pngUnfilterRow reverses the PNG filter type `filter` on `row` in place, with the previous
+// (decoded) row `prev` and `bpp` bytes per pixel.  Returns false if the filter type is invalid.
+func pngUnfilterRow(filter byte, row, prev []byte, bpp int) bool {
+	if filter > 4 {
+		return false
+	}
+	for j := range row {
+		var left, upperLeft byte
+		if j >= bpp {
+			left, upperLeft = row[j-bpp], prev[j-bpp]
+		}
+		row[j] += pngPrediction(filter, left, prev[j], upperLeft)
+	}
+	return true
+}
+
+// pngPrediction returns the prediction of PNG filter type `filter` for a byte from the byte to the
+// left `a`, the byte above `b` and the byte to the upper left `c`.
+func pngPrediction(filter byte, a, b, c byte) byte {
+	switch filter {
+	case 1:
+		// Sub: Predicts the same as the sample to the left.
+		return a
+	case 2:
+		// Up: Predicts the same as the sample above.
+		return b
+	case 3:
+		// Avg: Predicts the average of the sample to the left and above.
+		return byte((int(a) + int(b)) / 2)
+	case 4:
+		// Paeth: a nonlinear function of the sample above, the sample to the left and the sample
+		// to the upper left.
+		p := int(a) + int(b) - int(c)
+		pa := absInt(p - int(a))
+		pb := absInt(p - int(b))
+		pc := absInt(p - int(c))
+		if pa <= pb && pa <= pc {
+			return a
+		} else if pb <= pc {
+			return b
+		}
+		return c
+	}
+	// None.
+	return 0
+}
+
+// EncodeStream encodes `data` and returns a new stream object containing it, with Length set.
+func (this *FlateEncoder) EncodeStream(data []byte) (*PdfObjectStream, error) {
+	return MakeStream(data, this)
+}
+
 // LZW encoding/decoding functionality.
 type LZWEncoder struct {
 	Predictor        int
@@ -478,8 +729,8 @@ func (this *LZWEncoder) GetFilterName() string {
 }
 
 func (this *LZWEncoder) MakeDecodeParams() PdfObject {
+	decodeParams := MakeDict()
 	if this.Predictor > 1 {
-		decodeParams := MakeDict()
 		decodeParams.Set("Predictor", MakeInteger(int64(this.Predictor)))
 
 		// Only add if not default option.
@@ -492,9 +743,16 @@ func (this *LZWEncoder) MakeDecodeParams() PdfObject {
 		if this.Colors != 1 {
 			decodeParams.Set("Colors", MakeInteger(int64(this.Colors)))
 		}
-		return decodeParams
 	}
-	return nil
+	// EarlyChange is also set in the stream dictionary (MakeStreamDict), but belongs to the
+	// decode parameters of the filter, which keeps it apart from other filters in a filter array.
+	if this.EarlyChange != 1 {
+		decodeParams.Set("EarlyChange", MakeInteger(int64(this.EarlyChange)))
+	}
+	if len(decodeParams.Keys()) == 0 {
+		return nil
+	}
+	return decodeParams
 }
 
 // Make a new instance of an encoding dictionary for a stream object.
@@ -519,6 +777,7 @@ func (this *LZWEncoder) MakeStreamDict() *PdfObjectDictionary {
 func newLZWEncoderFromStream(streamObj *PdfObjectStream, decodeParams *PdfObjectDictionary) (*LZWEncoder, error) {
 	// Start with default settings.
 	encoder := NewLZWEncoder()
+	var err error
 
 	encDict := streamObj.PdfObjectDictionary
 	if encDict == nil {
@@ -528,13 +787,13 @@ func newLZWEncoderFromStream(streamObj *PdfObjectStream, decodeParams *PdfObject
 
 	// If decodeParams not provided, see if we can get from the stream.
 	if decodeParams == nil {
-		obj := encDict.Get("DecodeParms")
+		obj := traceDecodeParam(streamObj, encDict.Get("DecodeParms"))
 		if obj != nil {
 			if dp, isDict := obj.(*PdfObjectDictionary); isDict {
 				decodeParams = dp
 			} else if a, isArr := obj.(*PdfObjectArray); isArr {
 				if len(*a) == 1 {
-					if dp, isDict := (*a)[0].(*PdfObjectDictionary); isDict {
+					if dp, isDict := traceDecodeParam(streamObj, (*a)[0]).(*PdfObjectDictionary); isDict {
 						decodeParams = dp
 					}
 				}
@@ -572,50 +831,76 @@ func newLZWEncoderFromStream(streamObj *PdfObjectStream, decodeParams *PdfObject
 		return encoder, nil
 	}
 
-	obj = decodeParams.Get("Predictor")
+	// EarlyChange in the decode parameters (where specified by the standard) takes precedence.
+	obj = traceDecodeParam(streamObj, decodeParams.Get("EarlyChange"))
+	if obj != nil {
+		earlyChange, ok := obj.(*PdfObjectInteger)
+		if !ok || (*earlyChange != 0 && *earlyChange != 1) {
+			common.Log.Debug("Error: Invalid EarlyChange in DecodeParms (%v)", obj)
+			return nil, fmt.Errorf("Invalid EarlyChange")
+		}
+		encoder.EarlyChange = int(*earlyChange)
+	}
+
+	obj = traceDecodeParam(streamObj, decodeParams.Get("Predictor"))
 	if obj != nil {
 		predictor, ok := obj.(*PdfObjectInteger)
 		if !ok {
 			common.Log.Debug("Error: Predictor specified but not numeric (%T)", obj)
 			return nil, fmt.Errorf("Invalid Predictor")
 		}
-		encoder.Predictor = int(*predictor)
+		encoder.Predictor, err = ToInt("Predictor", int64(*predictor), 0, MaxInt)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Bits per component.  Use default if not specified (8).
-	obj = decodeParams.Get("BitsPerComponent")
+	obj = traceDecodeParam(streamObj, decodeParams.Get("BitsPerComponent"))
 	if obj != nil {
 		bpc, ok := obj.(*PdfObjectInteger)
 		if !ok {
 			common.Log.Debug("ERROR: Invalid BitsPerComponent")
 			return nil, fmt.Errorf("Invalid BitsPerComponent")
 		}
-		encoder.BitsPerComponent = int(*bpc)
+		encoder.BitsPerComponent, err = ToInt("BitsPerComponent", int64(*bpc), 1, 16)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if encoder.Predictor > 1 {
 		// Columns.
 		encoder.Columns = 1
-		obj = decodeParams.Get("Columns")
+		obj = traceDecodeParam(streamObj, decodeParams.Get("Columns"))
 		if obj != nil {
 			columns, ok := obj.(*PdfObjectInteger)
 			if !ok {
 				return nil, fmt.Errorf("Predictor column invalid")
 			}
 
-			encoder.Columns = int(*columns)
+			encoder.Columns, err = ToInt("Columns", int64(*columns), 1, MaxInt)
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		// Colors.
 		// Number of interleaved color components per sample (Default 1 if not specified)
 		encoder.Colors = 1
-		obj = decodeParams.Get("Colors")
+		obj = traceDecodeParam(streamObj, decodeParams.Get("Colors"))
 		if obj != nil {
 			colors, ok := obj.(*PdfObjectInteger)
 			if !ok {
 				return nil, fmt.Errorf("Predictor colors not an integer")
 			}
-			encoder.Colors = int(*colors)
+			encoder.Colors, err = ToInt("Colors", int64(*colors), 1, MaxInt)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := checkRowLength(encoder.Columns, encoder.Colors, encoder.BitsPerComponent); err != nil {
+			return nil, err
 		}
 	}
 
@@ -707,60 +992,9 @@ func (this *LZWEncoder) DecodeStream(streamObj *PdfObjectStream) ([]byte, error)
 			return pOutData, nil
 		} else if this.Predictor >= 10 && this.Predictor <= 15 {
 			common.Log.Trace("PNG Encoding")
-			// Columns represents the number of samples per row; Each sample can contain multiple color
-			// components.
-			rowLength := int(this.Columns*this.Colors + 1) // 1 byte to specify predictor algorithms per row.
-			if rowLength < 1 {
-				// No data. Return empty set.
-				return []byte{}, nil
-			}
-			rows := len(outData) / rowLength
-			if len(outData)%rowLength != 0 {
-				return nil, fmt.Errorf("Invalid row length (%d/%d)", len(outData), rowLength)
-			}
-			if rowLength > len(outData) {
-				common.Log.Debug("Row length cannot be longer than data length (%d/%d)", rowLength, len(outData))
-				return nil, errors.New("Range check error")
-			}
-
-			pOutBuffer := bytes.NewBuffer(nil)
-
 			common.Log.Trace("Predictor columns: %d", this.Columns)
-			common.Log.Trace("Length: %d / %d = %d rows", len(outData), rowLength, rows)
-			prevRowData := make([]byte, rowLength)
-			for i := 0; i < rowLength; i++ {
-				prevRowData[i] = 0
-			}
-
-			for i := 0; i < rows; i++ {
-				rowData := outData[rowLength*i : rowLength*(i+1)]
-
-				fb := rowData[0]
-				switch fb {
-				case 0:
-					// No prediction. (No operation).
-				case 1:
-					// Sub: Predicts the same as the sample to the left.
-					for j := 2; j < rowLength; j++ {
-						rowData[j] = byte(int(rowData[j]+rowData[j-1]) % 256)
-					}
-				case 2:
-					// Up: Predicts the same as the sample above
-					for j := 1; j < rowLength; j++ {
-						rowData[j] = byte(int(rowData[j]+prevRowData[j]) % 256)
-					}
-				default:
-					common.Log.Debug("ERROR: Invalid filter byte (%d)", fb)
-					return nil, fmt.Errorf("Invalid filter byte (%d)", fb)
-				}
-
-				for i := 0; i < rowLength; i++ {
-					prevRowData[i] = rowData[i]
-				}
-				pOutBuffer.Write(rowData[1:])
-			}
-			pOutData := pOutBuffer.Bytes()
-			return pOutData, nil
+			rowLength, bpp := pngRowLength(this.Columns, this.Colors, this.BitsPerComponent)
+			return pngUnpredict(outData, rowLength, bpp)
 		} else {
 			common.Log.Debug("ERROR: Unsupported predictor (%d)", this.Predictor)
 			return nil, fmt.Errorf("Unsupported predictor (%d)", this.Predictor)
@@ -791,14 +1025,27 @@ func (this *LZWEncoder) EncodeBytes(data []byte) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
+// EncodeStream encodes `data` and returns a new stream object containing it, with Length set.
+func (this *LZWEncoder) EncodeStream(data []byte) (*PdfObjectStream, error) {
+	return MakeStream(data, this)
+}
+
+// ErrDCTDimensionMismatch is returned when the dimensions in a JPEG header differ from the
+// Width/Height of the stream dictionary and strict dimension checking is enabled
+// (ParserOpts.DCTStrictDimensions).
+var ErrDCTDimensionMismatch = errors.New("JPEG dimensions do not match stream dictionary")
+
 //
 // DCT (JPG) encoding/decoding functionality for images.
 type DCTEncoder struct {
 	ColorComponents  int // 1 (gray), 3 (rgb), 4 (cmyk)
 	BitsPerComponent int // 8 or 16 bit
-	Width            int
-	Height           int
+	Width            int // When loaded from a stream, the width from the JPEG header.
+	Height           int // When loaded from a stream, the height from the JPEG header.
 	Quality          int
+	// ColorTransform from DecodeParms: 0 (no transform), 1 (YCbCr to RGB), or -1 if not specified,
+	// in which case the transform is determined by the JPEG data (APP14 marker).
+	ColorTransform int
 }
 
 // Make a new DCT encoder with default parameters.
@@ -809,6 +1056,7 @@ func NewDCTEncoder() *DCTEncoder {
 	encoder.BitsPerComponent = 8
 
 	encoder.Quality = DefaultJPEGQuality
+	encoder.ColorTransform = -1
 
 	return encoder
 }
@@ -836,7 +1084,7 @@ func (this *DCTEncoder) MakeStreamDict() *PdfObjectDictionary {
 // from the stream object dictionary entry and the image data itself.
 // TODO: Support if used with other filters [ASCII85Decode FlateDecode DCTDecode]...
 // need to apply the other filters prior to this one...
-func newDCTEncoderFromStream(streamObj *PdfObjectStream, multiEnc *MultiEncoder) (*DCTEncoder, error) {
+func newDCTEncoderFromStream(streamObj *PdfObjectStream, multiEnc *MultiEncoder, decodeParams *PdfObjectDictionary) (*DCTEncoder, error) {
 	// Start with default settings.
 	encoder := NewDCTEncoder()
 
@@ -846,6 +1094,25 @@ func newDCTEncoderFromStream(streamObj *PdfObjectStream, multiEnc *MultiEncoder)
 		return encoder, nil
 	}
 
+	// If decodeParams not provided, see if we can get from the stream.
+	if decodeParams == nil {
+		obj := TraceToDirectObject(encDict.Get("DecodeParms"))
+		if arr, isArr := obj.(*PdfObjectArray); isArr && len(*arr) == 1 {
+			obj = TraceToDirectObject((*arr)[0])
+		}
+		decodeParams, _ = obj.(*PdfObjectDictionary)
+	}
+	if decodeParams != nil {
+		if obj := TraceToDirectObject(decodeParams.Get("ColorTransform")); obj != nil {
+			ct, ok := obj.(*PdfObjectInteger)
+			if ok && (*ct == 0 || *ct == 1) {
+				encoder.ColorTransform = int(*ct)
+			} else {
+				common.Log.Debug("Invalid DCT ColorTransform %v - ignoring", obj)
+			}
+		}
+	}
+
 	// If using DCTDecode in combination with other filters, make sure to decode that first...
 	encoded := streamObj.Stream
 	if multiEnc != nil {
@@ -895,9 +1162,29 @@ func newDCTEncoderFromStream(streamObj *PdfObjectStream, multiEnc *MultiEncoder)
 	common.Log.Trace("DCT Encoder: %+v", encoder)
 	encoder.Quality = DefaultJPEGQuality
 
+	// Cross-check against the dimensions in the stream dictionary (if present).
+	if params, err := NewImageParamsFromDict(encDict); err == nil {
+		if err := encoder.CheckDimensions(params.Width, params.Height); err != nil && decodingOpts(streamObj).DCTStrictDimensions {
+			return nil, err
+		}
+	}
+
 	return encoder, nil
 }
 
+// CheckDimensions checks whether the encoder's dimensions match `width` and `height`, typically the
+// Width and Height entries of an image XObject.  A mismatch in a loaded stream indicates corruption,
+// as the decoded data follows the JPEG header dimensions.  Returns ErrDCTDimensionMismatch if the
+// dimensions differ.
+func (this *DCTEncoder) CheckDimensions(width, height int64) error {
+	if int64(this.Width) == width && int64(this.Height) == height {
+		return nil
+	}
+	common.Log.Debug("WARNING: JPEG dimensions %dx%d differ from dictionary %dx%d",
+		this.Width, this.Height, width, height)
+	return ErrDCTDimensionMismatch
+}
+
 func (this *DCTEncoder) DecodeBytes(encoded []byte) ([]byte, error) {
 	bufReader := bytes.NewReader(encoded)
 	//img, _, err := goimage.Decode(bufReader)
@@ -907,114 +1194,270 @@ func (this *DCTEncoder) DecodeBytes(encoded []byte) ([]byte, error) {
 		return nil, err
 	}
 	bounds := img.Bounds()
+	if bounds.Empty() {
+		// Zero-area images (placeholders) decode to empty data.
+		common.Log.Debug("DCT image has zero area (%dx%d)", bounds.Dx(), bounds.Dy())
+		return []byte{}, nil
+	}
 
-	var decoded = make([]byte, bounds.Dx()*bounds.Dy()*this.ColorComponents*this.BitsPerComponent/8)
+	rowLen := bounds.Dx() * this.ColorComponents * this.BitsPerComponent / 8
+	var decoded = make([]byte, bounds.Dy()*rowLen)
+	for j := bounds.Min.Y; j < bounds.Max.Y; j++ {
+		offset := (j - bounds.Min.Y) * rowLen
+		if err := this.decodeRow(img, j, decoded[offset:offset+rowLen]); err != nil {
+			return nil, err
+		}
+	}
+
+	return decoded, nil
+}
+
+// decodeRow converts row `j` of the decoded JPEG image `img` to samples, stored in `decoded`.
+func (this *DCTEncoder) decodeRow(img goimage.Image, j int, decoded []byte) error {
+	bounds := img.Bounds()
 	index := 0
+	for i := bounds.Min.X; i < bounds.Max.X; i++ {
+		color := img.At(i, j)
 
-	for j := bounds.Min.Y; j < bounds.Max.Y; j++ {
-		for i := bounds.Min.X; i < bounds.Max.X; i++ {
-			color := img.At(i, j)
-
-			// Gray scale.
-			if this.ColorComponents == 1 {
-				if this.BitsPerComponent == 16 {
-					// Gray - 16 bit.
-					val, ok := color.(gocolor.Gray16)
-					if !ok {
-						return nil, errors.New("Color type error")
-					}
-					decoded[index] = byte((val.Y >> 8) & 0xff)
-					index++
-					decoded[index] = byte(val.Y & 0xff)
-					index++
-				} else {
-					// Gray - 8 bit.
-					val, ok := color.(gocolor.Gray)
-					if !ok {
-						return nil, errors.New("Color type error")
-					}
-					decoded[index] = byte(val.Y & 0xff)
-					index++
+		// Gray scale.
+		if this.ColorComponents == 1 {
+			if this.BitsPerComponent == 16 {
+				// Gray - 16 bit.
+				val, ok := color.(gocolor.Gray16)
+				if !ok {
+					return errors.New("Color type error")
 				}
-			} else if this.ColorComponents == 3 {
-				if this.BitsPerComponent == 16 {
-					val, ok := color.(gocolor.RGBA64)
-					if !ok {
-						return nil, errors.New("Color type error")
+				decoded[index] = byte((val.Y >> 8) & 0xff)
+				index++
+				decoded[index] = byte(val.Y & 0xff)
+				index++
+			} else {
+				// Gray - 8 bit.
+				val, ok := color.(gocolor.Gray)
+				if !ok {
+					return errors.New("Color type error")
+				}
+				decoded[index] = byte(val.Y & 0xff)
+				index++
+			}
+		} else if this.ColorComponents == 3 {
+			if this.BitsPerComponent == 16 {
+				val, ok := color.(gocolor.RGBA64)
+				if !ok {
+					return errors.New("Color type error")
+				}
+				decoded[index] = byte((val.R >> 8) & 0xff)
+				index++
+				decoded[index] = byte(val.R & 0xff)
+				index++
+				decoded[index] = byte((val.G >> 8) & 0xff)
+				index++
+				decoded[index] = byte(val.G & 0xff)
+				index++
+				decoded[index] = byte((val.B >> 8) & 0xff)
+				index++
+				decoded[index] = byte(val.B & 0xff)
+				index++
+			} else {
+				// RGB - 8 bit.
+				val, isRGB := color.(gocolor.RGBA)
+				if isRGB {
+					r, g, b := val.R, val.G, val.B
+					if this.ColorTransform == 1 {
+						// The JPEG data is not marked as transformed, but DecodeParms says so.
+						r, g, b = gocolor.YCbCrToRGB(r, g, b)
 					}
-					decoded[index] = byte((val.R >> 8) & 0xff)
-					index++
-					decoded[index] = byte(val.R & 0xff)
+					decoded[index] = r
 					index++
-					decoded[index] = byte((val.G >> 8) & 0xff)
+					decoded[index] = g
 					index++
-					decoded[index] = byte(val.G & 0xff)
-					index++
-					decoded[index] = byte((val.B >> 8) & 0xff)
-					index++
-					decoded[index] = byte(val.B & 0xff)
+					decoded[index] = b
 					index++
 				} else {
-					// RGB - 8 bit.
-					val, isRGB := color.(gocolor.RGBA)
-					if isRGB {
-						decoded[index] = val.R & 0xff
-						index++
-						decoded[index] = val.G & 0xff
-						index++
-						decoded[index] = val.B & 0xff
-						index++
-					} else {
-						// Hack around YCbCr from go jpeg package.
-						val, ok := color.(gocolor.YCbCr)
-						if !ok {
-							return nil, errors.New("Color type error")
-						}
-						r, g, b, _ := val.RGBA()
-						// The fact that we cannot use the Y, Cb, Cr values directly,
-						// indicates that either the jpeg package is converting the raw
-						// data into YCbCr with some kind of mapping, or that the original
-						// data is not in R,G,B...
-						// XXX: This is not good as it means we end up with R, G, B... even
-						// if the original colormap was different.  Unless calling the RGBA()
-						// call exactly reverses the previous conversion to YCbCr (even if
-						// real data is not rgb)... ?
-						// TODO: Test more. Consider whether we need to implement our own jpeg filter.
-						decoded[index] = byte(r >> 8) //byte(val.Y & 0xff)
+					// Hack around YCbCr from go jpeg package.
+					val, ok := color.(gocolor.YCbCr)
+					if !ok {
+						return errors.New("Color type error")
+					}
+					if this.ColorTransform == 0 {
+						// No transform per DecodeParms: the components are the raw values.
+						decoded[index] = val.Y
 						index++
-						decoded[index] = byte(g >> 8) //val.Cb & 0xff)
+						decoded[index] = val.Cb
 						index++
-						decoded[index] = byte(b >> 8) //val.Cr & 0xff)
+						decoded[index] = val.Cr
 						index++
+						continue
 					}
+					r, g, b, _ := val.RGBA()
+					// The fact that we cannot use the Y, Cb, Cr values directly,
+					// indicates that either the jpeg package is converting the raw
+					// data into YCbCr with some kind of mapping, or that the original
+					// data is not in R,G,B...
+					// XXX: This is not good as it means we end up with R, G, B... even
+					// if the original colormap was different.  Unless calling the RGBA()
+					// call exactly reverses the previous conversion to YCbCr (even if
+					// real data is not rgb)... ?
+					// TODO: Test more. Consider whether we need to implement our own jpeg filter.
+					decoded[index] = byte(r >> 8) //byte(val.Y & 0xff)
+					index++
+					decoded[index] = byte(g >> 8) //val.Cb & 0xff)
+					index++
+					decoded[index] = byte(b >> 8) //val.Cr & 0xff)
+					index++
 				}
-			} else if this.ColorComponents == 4 {
-				// CMYK - 8 bit.
-				val, ok := color.(gocolor.CMYK)
-				if !ok {
-					return nil, errors.New("Color type error")
-				}
-				// TODO: Is the inversion not handled right in the JPEG package for APP14?
-				// Should not need to invert here...
-				decoded[index] = 255 - val.C&0xff
-				index++
-				decoded[index] = 255 - val.M&0xff
-				index++
-				decoded[index] = 255 - val.Y&0xff
-				index++
-				decoded[index] = 255 - val.K&0xff
-				index++
 			}
+		} else if this.ColorComponents == 4 {
+			// CMYK - 8 bit.
+			val, ok := color.(gocolor.CMYK)
+			if !ok {
+				return errors.New("Color type error")
+			}
+			// The JPEG package undoes the Adobe inversion of CMYK data marked by an APP14
+			// marker.  Invert again so the decoded samples are the component values stored in
+			// the JPEG data, as written by EncodeBytes.
+			decoded[index] = 255 - val.C&0xff
+			index++
+			decoded[index] = 255 - val.M&0xff
+			index++
+			decoded[index] = 255 - val.Y&0xff
+			index++
+			decoded[index] = 255 - val.K&0xff
+			index++
 		}
 	}
 
-	return decoded, nil
+	return nil
 }
 
 func (this *DCTEncoder) DecodeStream(streamObj *PdfObjectStream) ([]byte, error) {
 	return this.DecodeBytes(streamObj.Stream)
 }
 
+// DecodeBytesDownscaled decodes JPEG data and downscales it by 1/`scale` (1, 2, 4 or 8) in each
+// dimension, e.g. for generating previews.  Returns the samples along with the reduced width and
+// height (rounded up as for DCT scaling).
+// The Go JPEG decoder does not support DCT-domain scaling, so this is a full decode followed by a
+// downscale: the decoded image is held in memory at full resolution and each scale x scale block
+// is averaged into one sample.  Only the output samples are smaller; decoding time and peak memory
+// use are those of DecodeBytes.  Only 8 bits per component is supported.
+func (this *DCTEncoder) DecodeBytesDownscaled(encoded []byte, scale int) ([]byte, int, int, error) {
+	if scale != 1 && scale != 2 && scale != 4 && scale != 8 {
+		return nil, 0, 0, fmt.Errorf("Invalid downscale factor 1/%d", scale)
+	}
+	if scale == 1 {
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(encoded))
+		if err != nil {
+			common.Log.Debug("Error decoding image config: %s", err)
+			return nil, 0, 0, err
+		}
+		decoded, err := this.DecodeBytes(encoded)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		return decoded, cfg.Width, cfg.Height, nil
+	}
+	if this.BitsPerComponent != 8 {
+		return nil, 0, 0, errors.New("Downscaled decoding requires 8 bits per component")
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		common.Log.Debug("Error decoding image: %s", err)
+		return nil, 0, 0, err
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	numComps := this.ColorComponents
+
+	d := newRowDownscaler(width, numComps, scale)
+	row := make([]byte, width*numComps)
+	for y := 0; y < height; y++ {
+		if err := this.decodeRow(img, bounds.Min.Y+y, row); err != nil {
+			return nil, 0, 0, err
+		}
+		d.addRow(row)
+	}
+
+	return d.samples(), d.scaledWidth, (height + scale - 1) / scale, nil
+}
+
+// rowDownscaler averages the rows of 8 bit samples of an image `width` samples wide of `numComps`
+// components over blocks of scale x scale samples, partial at the right and bottom edges.  The
+// rows are added one at a time and only the sums of a row of blocks are kept.
+type rowDownscaler struct {
+	width       int
+	numComps    int
+	scale       int
+	scaledWidth int
+	sums        []int
+	rows        int // Rows added to the current row of blocks.
+	out         []byte
+}
+
+func newRowDownscaler(width, numComps, scale int) *rowDownscaler {
+	scaledWidth := (width + scale - 1) / scale
+	return &rowDownscaler{
+		width:       width,
+		numComps:    numComps,
+		scale:       scale,
+		scaledWidth: scaledWidth,
+		sums:        make([]int, scaledWidth*numComps),
+	}
+}
+
+// addRow adds the samples of the next row `row`.
+func (d *rowDownscaler) addRow(row []byte) {
+	for x := 0; x < d.width; x++ {
+		for c := 0; c < d.numComps; c++ {
+			d.sums[(x/d.scale)*d.numComps+c] += int(row[x*d.numComps+c])
+		}
+	}
+	d.rows++
+	if d.rows == d.scale {
+		d.flush()
+	}
+}
+
+// flush appends the averages of the current row of blocks to the output.
+func (d *rowDownscaler) flush() {
+	if d.rows == 0 {
+		return
+	}
+	for sx := 0; sx < d.scaledWidth; sx++ {
+		cols := d.scale
+		if (sx+1)*d.scale > d.width {
+			cols = d.width - sx*d.scale
+		}
+		count := d.rows * cols
+		for c := 0; c < d.numComps; c++ {
+			sum := &d.sums[sx*d.numComps+c]
+			d.out = append(d.out, byte((*sum+count/2)/count))
+			*sum = 0
+		}
+	}
+	d.rows = 0
+}
+
+// samples returns the downscaled samples of the rows added, the last row of blocks averaged over
+// the rows added to it.
+func (d *rowDownscaler) samples() []byte {
+	d.flush()
+	return d.out
+}
+
+// checkDownscale checks the dimensions `width` x `height` and number of components `colors` of an
+// image of 8 bit samples and the downscale factor `scale` of a downscaled decoding.
+func checkDownscale(width, height, colors, scale int) error {
+	if width <= 0 || height <= 0 || colors <= 0 {
+		return fmt.Errorf("Invalid image dimensions %dx%d with %d colors", width, height, colors)
+	}
+	if scale < 1 {
+		return fmt.Errorf("Invalid downscale factor 1/%d", scale)
+	}
+	return checkRowLength(width, colors, 8)
+}
+
 type DrawableImage interface {
 	ColorModel() gocolor.Model
 	Bounds() goimage.Rectangle
@@ -1023,6 +1466,15 @@ type DrawableImage interface {
 }
 
 func (this *DCTEncoder) EncodeBytes(data []byte) ([]byte, error) {
+	if this.Width <= 0 || this.Height <= 0 {
+		common.Log.Debug("ERROR: DCT encoding of image with invalid dimensions (%dx%d)", this.Width, this.Height)
+		return nil, fmt.Errorf("Cannot DCT encode image with zero dimension (%dx%d)", this.Width, this.Height)
+	}
+
+	if this.ColorComponents == 4 {
+		return this.encodeCMYK(data)
+	}
+
 	bounds := goimage.Rect(0, 0, this.Width, this.Height)
 	var img DrawableImage
 	if this.ColorComponents == 1 {
@@ -1037,8 +1489,6 @@ func (this *DCTEncoder) EncodeBytes(data []byte) ([]byte, error) {
 		} else {
 			img = goimage.NewRGBA(bounds)
 		}
-	} else if this.ColorComponents == 4 {
-		img = goimage.NewCMYK(bounds)
 	} else {
 		return nil, errors.New("Unsupported")
 	}
@@ -1069,12 +1519,6 @@ func (this *DCTEncoder) EncodeBytes(data []byte) ([]byte, error) {
 				b := uint8(data[i+2] & 0xff)
 				c = gocolor.RGBA{R: r, G: g, B: b, A: 0}
 			}
-		} else if this.ColorComponents == 4 {
-			c1 := uint8(data[i] & 0xff)
-			m1 := uint8(data[i+1] & 0xff)
-			y1 := uint8(data[i+2] & 0xff)
-			k1 := uint8(data[i+3] & 0xff)
-			c = gocolor.CMYK{C: c1, M: m1, Y: y1, K: k1}
 		}
 
 		img.Set(x, y, c)
@@ -1082,6 +1526,10 @@ func (this *DCTEncoder) EncodeBytes(data []byte) ([]byte, error) {
 		if x == this.Width {
 			x = 0
 			y++
+			if y == this.Height {
+				// Ignore any trailing data.
+				break
+			}
 		}
 	}
 
@@ -1101,6 +1549,81 @@ func (this *DCTEncoder) EncodeBytes(data []byte) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// encodeCMYK encodes 8 bit CMYK `data`.  The JPEG package only writes gray and YCbCr images, so
+// each component is encoded as a gray image and the scans are combined into a four component
+// frame.  The frame has an Adobe APP14 marker with transform 0 (no color transform), which
+// decoders require to interpret four component data.  The samples are stored as given, so
+// DecodeBytes returns `data` (up to compression losses).
+func (this *DCTEncoder) encodeCMYK(data []byte) ([]byte, error) {
+	if this.BitsPerComponent != 8 {
+		return nil, errors.New("Unsupported")
+	}
+
+	opt := jpeg.Options{Quality: this.Quality}
+	var tables [][]byte
+	var scans [][]byte
+	numPixels := this.Width * this.Height
+	for comp := 0; comp < 4; comp++ {
+		img := goimage.NewGray(goimage.Rect(0, 0, this.Width, this.Height))
+		for i := 0; i < numPixels && 4*i+comp < len(data); i++ {
+			img.Pix[i] = data[4*i+comp]
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &opt); err != nil {
+			return nil, err
+		}
+
+		// The gray JPEG is SOI, DQT, SOF0, DHT, SOS with the entropy coded data, and EOI.  The
+		// quantization and Huffman tables are the same for all the components.
+		jpg := buf.Bytes()
+		for pos := 2; pos+4 <= len(jpg); {
+			marker := jpg[pos+1]
+			length := int(jpg[pos+2])<<8 | int(jpg[pos+3])
+			switch marker {
+			case 0xdb, 0xc4: // DQT, DHT.
+				if comp == 0 {
+					tables = append(tables, jpg[pos:pos+2+length])
+				}
+			case 0xda: // SOS.
+				scan := append([]byte{}, jpg[pos:len(jpg)-2]...)
+				scan[5] = byte(comp + 1) // Component selector.
+				scans = append(scans, scan)
+				pos = len(jpg)
+				continue
+			}
+			pos += 2 + length
+		}
+		if len(scans) != comp+1 {
+			return nil, errors.New("Unexpected JPEG data")
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0xff, 0xd8})
+	// APP14: "Adobe", version 100, flags 0 and 0, transform 0.
+	buf.Write([]byte{0xff, 0xee, 0x00, 0x0e, 'A', 'd', 'o', 'b', 'e', 0x00, 0x64, 0, 0, 0, 0, 0})
+	buf.Write(tables[0])
+	// SOF0: 8 bit precision, height, width, 4 components with sampling 1x1 and quantization table 0.
+	buf.Write([]byte{0xff, 0xc0, 0x00, 0x14, 0x08,
+		byte(this.Height >> 8), byte(this.Height), byte(this.Width >> 8), byte(this.Width), 0x04})
+	for comp := 1; comp <= 4; comp++ {
+		buf.Write([]byte{byte(comp), 0x11, 0x00})
+	}
+	for _, table := range tables[1:] {
+		buf.Write(table)
+	}
+	for _, scan := range scans {
+		buf.Write(scan)
+	}
+	buf.Write([]byte{0xff, 0xd9})
+	return buf.Bytes(), nil
+}
+
+// EncodeStream encodes `data` and returns a new stream object containing it, with Length set.
+func (this *DCTEncoder) EncodeStream(data []byte) (*PdfObjectStream, error) {
+	return MakeStream(data, this)
+}
+
 // Run length encoding.
 type RunLengthEncoder struct {
 }
@@ -1232,6 +1755,11 @@ func (this *RunLengthEncoder) EncodeBytes(data []byte) ([]byte, error) {
 	return inb, nil
 }
 
+// EncodeStream encodes `data` and returns a new stream object containing it, with Length set.
+func (this *RunLengthEncoder) EncodeStream(data []byte) (*PdfObjectStream, error) {
+	return MakeStream(data, this)
+}
+
 func (this *RunLengthEncoder) MakeDecodeParams() PdfObject {
 	return nil
 }
@@ -1246,6 +1774,9 @@ func (this *RunLengthEncoder) MakeStreamDict() *PdfObjectDictionary {
 /////
 // ASCII hex encoder/decoder.
 type ASCIIHexEncoder struct {
+	// SkipPunctuation makes decoding lenient, skipping isolated punctuation characters (e.g.
+	// "DE,AD") which some generators insert.  By default they are errors.
+	SkipPunctuation bool
 }
 
 // Make a new ASCII hex encoder.
@@ -1262,6 +1793,14 @@ func (this *ASCIIHexEncoder) MakeDecodeParams() PdfObject {
 	return nil
 }
 
+// newASCIIHexEncoderFromStream returns an ASCII hex encoder for decoding stream `streamObj`, lenient
+// if the parser that loaded the stream has ParserOpts.ASCIIHexSkipPunctuation set.
+func newASCIIHexEncoderFromStream(streamObj *PdfObjectStream) *ASCIIHexEncoder {
+	encoder := NewASCIIHexEncoder()
+	encoder.SkipPunctuation = decodingOpts(streamObj).ASCIIHexSkipPunctuation
+	return encoder
+}
+
 // Make a new instance of an encoding dictionary for a stream object.
 func (this *ASCIIHexEncoder) MakeStreamDict() *PdfObjectDictionary {
 	dict := MakeDict()
@@ -1269,26 +1808,35 @@ func (this *ASCIIHexEncoder) MakeStreamDict() *PdfObjectDictionary {
 	return dict
 }
 
+// DecodeBytes decodes ASCIIHexDecode data `encoded` up to the EOD marker (>) or the end of the data
+// if the marker is missing.  An odd number of digits is completed by a 0.  White space is ignored,
+// and isolated punctuation characters too in lenient mode (see SkipPunctuation).  Other
+// characters give an error with their offset and context.
 func (this *ASCIIHexEncoder) DecodeBytes(encoded []byte) ([]byte, error) {
-	bufReader := bytes.NewReader(encoded)
 	inb := []byte{}
-	for {
-		b, err := bufReader.ReadByte()
-		if err != nil {
-			return nil, err
-		}
+	eod := false
+	for i, b := range encoded {
 		if b == '>' {
+			eod = true
 			break
 		}
 		if IsWhiteSpace(b) {
 			continue
 		}
-		if (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F') || (b >= '0' && b <= '9') {
+		if isHexDigit(b) {
 			inb = append(inb, b)
-		} else {
-			common.Log.Debug("ERROR: Invalid ascii hex character (%c)", b)
-			return nil, fmt.Errorf("Invalid ascii hex character (%c)", b)
+			continue
 		}
+		if this.SkipPunctuation && isIsolatedPunctuation(encoded, i) {
+			common.Log.Debug("Incompatibility: Skipping %q in ASCIIHexDecode data at offset %d", b, i)
+			continue
+		}
+		common.Log.Debug("ERROR: Invalid ascii hex character %q at offset %d", b, i)
+		return nil, fmt.Errorf("Invalid ascii hex character %q at offset %d: %q", b, i, byteContext(encoded, i))
+	}
+	if !eod {
+		// Tolerate a missing EOD marker, as other readers do.
+		common.Log.Debug("ASCIIHexDecode data missing EOD (>)")
 	}
 	if len(inb)%2 == 1 {
 		inb = append(inb, '0')
@@ -1302,6 +1850,39 @@ func (this *ASCIIHexEncoder) DecodeBytes(encoded []byte) ([]byte, error) {
 	return outb, nil
 }
 
+// isHexDigit returns true if `b` is a hexadecimal digit.
+func isHexDigit(b byte) bool {
+	return (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F') || (b >= '0' && b <= '9')
+}
+
+// isIsolatedPunctuation returns true if `data[i]` is an ASCII punctuation character whose neighbors
+// are hex digits, white space, the EOD marker or the ends of the data.
+func isIsolatedPunctuation(data []byte, i int) bool {
+	isPunct := func(b byte) bool {
+		return b > ' ' && b < 0x7f && !isHexDigit(b) && !(b >= 'g' && b <= 'z') && !(b >= 'G' && b <= 'Z')
+	}
+	isValid := func(b byte) bool {
+		return isHexDigit(b) || IsWhiteSpace(b) || b == '>'
+	}
+	if !isPunct(data[i]) {
+		return false
+	}
+	return (i == 0 || isValid(data[i-1])) && (i+1 == len(data) || isValid(data[i+1]))
+}
+
+// byteContext returns the bytes of `data` around offset `i`, for error messages.
+func byteContext(data []byte, i int) []byte {
+	const size = 16
+	start, end := i-size, i+size+1
+	if start < 0 {
+		start = 0
+	}
+	if end > len(data) {
+		end = len(data)
+	}
+	return data[start:end]
+}
+
 // ASCII hex decoding.
 func (this *ASCIIHexEncoder) DecodeStream(streamObj *PdfObjectStream) ([]byte, error) {
 	return this.DecodeBytes(streamObj.Stream)
@@ -1318,6 +1899,11 @@ func (this *ASCIIHexEncoder) EncodeBytes(data []byte) ([]byte, error) {
 	return encoded.Bytes(), nil
 }
 
+// EncodeStream encodes `data` and returns a new stream object containing it, with Length set.
+func (this *ASCIIHexEncoder) EncodeStream(data []byte) (*PdfObjectStream, error) {
+	return MakeStream(data, this)
+}
+
 //
 // ASCII85 encoder/decoder.
 //
@@ -1490,6 +2076,11 @@ func (this *ASCII85Encoder) EncodeBytes(data []byte) ([]byte, error) {
 	return encoded.Bytes(), nil
 }
 
+// EncodeStream encodes `data` and returns a new stream object containing it, with Length set.
+func (this *ASCII85Encoder) EncodeStream(data []byte) (*PdfObjectStream, error) {
+	return MakeStream(data, this)
+}
+
 //
 // Raw encoder/decoder (no encoding, pass through)
 //
@@ -1520,10 +2111,34 @@ func (this *RawEncoder) DecodeStream(streamObj *PdfObjectStream) ([]byte, error)
 	return streamObj.Stream, nil
 }
 
+// DecodeBytesDownscaled downscales the image data `encoded` of `width` x `height` samples of
+// `colors` 8 bit components by 1/`scale` in each dimension, as FlateEncoder.DecodeBytesDownscaled.
+func (this *RawEncoder) DecodeBytesDownscaled(encoded []byte, width, height, colors, scale int) ([]byte, int, int, error) {
+	if err := checkDownscale(width, height, colors, scale); err != nil {
+		return nil, 0, 0, err
+	}
+	rowLength := width * colors
+	if len(encoded)/rowLength < height {
+		return nil, 0, 0, fmt.Errorf("Image data too short (%d bytes) for %dx%d samples of %d colors",
+			len(encoded), width, height, colors)
+	}
+
+	d := newRowDownscaler(width, colors, scale)
+	for y := 0; y < height; y++ {
+		d.addRow(encoded[y*rowLength : (y+1)*rowLength])
+	}
+	return d.samples(), d.scaledWidth, (height + scale - 1) / scale, nil
+}
+
 func (this *RawEncoder) EncodeBytes(data []byte) ([]byte, error) {
 	return data, nil
 }
 
+// EncodeStream encodes `data` and returns a new stream object containing it, with Length set.
+func (this *RawEncoder) EncodeStream(data []byte) (*PdfObjectStream, error) {
+	return MakeStream(data, this)
+}
+
 //
 // CCITTFax encoder/decoder (dummy, for now)
 //
@@ -1561,6 +2176,11 @@ func (this *CCITTFaxEncoder) EncodeBytes(data []byte) ([]byte, error) {
 	return data, ErrNoCCITTFaxDecode
 }
 
+// EncodeStream encodes `data` and returns a new stream object containing it, with Length set.
+func (this *CCITTFaxEncoder) EncodeStream(data []byte) (*PdfObjectStream, error) {
+	return MakeStream(data, this)
+}
+
 //
 // JBIG2 encoder/decoder (dummy, for now)
 //
@@ -1598,6 +2218,11 @@ func (this *JBIG2Encoder) EncodeBytes(data []byte) ([]byte, error) {
 	return data, ErrNoJBIG2Decode
 }
 
+// EncodeStream encodes `data` and returns a new stream object containing it, with Length set.
+func (this *JBIG2Encoder) EncodeStream(data []byte) (*PdfObjectStream, error) {
+	return MakeStream(data, this)
+}
+
 //
 // JPX encoder/decoder (dummy, for now)
 //
@@ -1635,6 +2260,11 @@ func (this *JPXEncoder) EncodeBytes(data []byte) ([]byte, error) {
 	return data, ErrNoJPXDecode
 }
 
+// EncodeStream encodes `data` and returns a new stream object containing it, with Length set.
+func (this *JPXEncoder) EncodeStream(data []byte) (*PdfObjectStream, error) {
+	return MakeStream(data, this)
+}
+
 //
 // Multi encoder: support serial encoding.
 //
@@ -1710,10 +2340,16 @@ func newMultiEncoderFromStream(streamObj *PdfObjectStream) (*MultiEncoder, error
 			// Only get the dp if provided.  Oftentimes there is no decode params dict
 			// provided.
 			if len(decodeParamsArray) > 0 {
-				if idx >= len(decodeParamsArray) {
-					return nil, fmt.Errorf("Missing elements in decode params array")
+				if idx < len(decodeParamsArray) {
+					dp = decodeParamsArray[idx]
+				} else {
+					// Some writers omit the trailing entries of filters with default parameters.
+					// An empty dictionary, as the encoders would otherwise take the parameters of
+					// the stream.
+					common.Log.Debug("Incompatibility: DecodeParms array shorter than Filter array (%d < %d)",
+						len(decodeParamsArray), len(*array))
+					dp = MakeDict()
 				}
-				dp = decodeParamsArray[idx]
 			}
 		}
 
@@ -1737,13 +2373,13 @@ func newMultiEncoderFromStream(streamObj *PdfObjectStream) (*MultiEncoder, error
 			}
 			mencoder.AddEncoder(encoder)
 		} else if *name == StreamEncodingFilterNameASCIIHex {
-			encoder := NewASCIIHexEncoder()
+			encoder := newASCIIHexEncoderFromStream(streamObj)
 			mencoder.AddEncoder(encoder)
 		} else if *name == StreamEncodingFilterNameASCII85 {
 			encoder := NewASCII85Encoder()
 			mencoder.AddEncoder(encoder)
 		} else if *name == StreamEncodingFilterNameDCT {
-			encoder, err := newDCTEncoderFromStream(streamObj, mencoder)
+			encoder, err := newDCTEncoderFromStream(streamObj, mencoder, dParams)
 			if err != nil {
 				return nil, err
 			}
@@ -1780,14 +2416,19 @@ func (this *MultiEncoder) MakeDecodeParams() PdfObject {
 	}
 
 	array := PdfObjectArray{}
+	hasParams := false
 	for _, encoder := range this.encoders {
 		decodeParams := encoder.MakeDecodeParams()
 		if decodeParams == nil {
 			array = append(array, MakeNull())
 		} else {
 			array = append(array, decodeParams)
+			hasParams = true
 		}
 	}
+	if !hasParams {
+		return nil
+	}
 
 	return &array
 }
@@ -1796,16 +2437,33 @@ func (this *MultiEncoder) AddEncoder(encoder StreamEncoder) {
 	this.encoders = append(this.encoders, encoder)
 }
 
+// GetEncoders returns the encoders of the multi encoder in the order of the Filter array, i.e. the
+// order in which they are applied for decoding.
+func (this *MultiEncoder) GetEncoders() []StreamEncoder {
+	return this.encoders
+}
+
 func (this *MultiEncoder) MakeStreamDict() *PdfObjectDictionary {
 	dict := MakeDict()
-	dict.Set("Filter", MakeName(this.GetFilterName()))
+
+	// Filter array with one name per encoder.
+	filters := PdfObjectArray{}
+	for _, encoder := range this.encoders {
+		filters = append(filters, MakeName(encoder.GetFilterName()))
+	}
+	dict.Set("Filter", &filters)
 
 	// Pass all values from children, except Filter and DecodeParms.
+	// Filter specific values (e.g. EarlyChange) are also in the filters' DecodeParms.
 	for _, encoder := range this.encoders {
 		encDict := encoder.MakeStreamDict()
 		for _, key := range encDict.Keys() {
 			val := encDict.Get(key)
 			if key != "Filter" && key != "DecodeParms" {
+				if prev := dict.Get(key); prev != nil && prev.DefaultWriteString() != val.DefaultWriteString() {
+					common.Log.Debug("Conflicting %s values in multi filter stream dictionary (%s, %s)",
+						key, prev.DefaultWriteString(), val.DefaultWriteString())
+				}
 				dict.Set(key, val)
 			}
 		}
@@ -1855,3 +2513,8 @@ func (this *MultiEncoder) EncodeBytes(data []byte) ([]byte, error) {
 
 	return encoded, nil
 }
+
+// EncodeStream encodes `data` and returns a new stream object containing it, with Length set.
+func (this *MultiEncoder) EncodeStream(data []byte) (*PdfObjectStream, error) {
+	return MakeStream(data, this)
+}
@@ -6,7 +6,16 @@
 package core
 
 import (
+	"bytes"
+	"compress/zlib"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	gocolor "image/color"
+	"image/png"
+	"strings"
 	"testing"
 
 	"github.com/unidoc/unidoc/common"
@@ -43,6 +52,417 @@ func TestFlateEncoding(t *testing.T) {
 	}
 }
 
+// Test building a flate encoded stream object, decoded again based on its dictionary.
+func TestFlateEncodeStream(t *testing.T) {
+	rawStream := []byte("this is a dummy text with some \x01\x02\x03 binary data")
+
+	encoder := NewFlateEncoder()
+	stream, err := encoder.EncodeStream(rawStream)
+	if err != nil {
+		t.Fatalf("Failed to encode stream: %v", err)
+	}
+
+	if filter, ok := stream.Get("Filter").(*PdfObjectName); !ok || *filter != StreamEncodingFilterNameFlate {
+		t.Errorf("Invalid Filter: %v", stream.Get("Filter"))
+	}
+	length, ok := stream.Get("Length").(*PdfObjectInteger)
+	if !ok || int(*length) != len(stream.Stream) {
+		t.Errorf("Invalid Length: %v (%d)", stream.Get("Length"), len(stream.Stream))
+	}
+
+	decoded, err := DecodeStream(stream)
+	if err != nil {
+		t.Fatalf("Failed to decode stream: %v", err)
+	}
+	if !compareSlices(decoded, rawStream) {
+		t.Errorf("Slices not matching")
+	}
+}
+
+// Test building stream objects with the EncodeStream methods of the encoders.  The encoders that
+// cannot encode (CCITTFax, JBIG2 and JPX) return an error.
+func TestEncodeStream(t *testing.T) {
+	raw := bytes.Repeat([]byte{0x10, 0x80, 0x80, 0xff}, 16)
+
+	dct := NewDCTEncoder()
+	dct.Width, dct.Height, dct.ColorComponents = 8, 8, 1
+	lzw := NewLZWEncoder()
+	lzw.EarlyChange = 0
+	multi := NewMultiEncoder()
+	multi.AddEncoder(NewASCIIHexEncoder())
+	multi.AddEncoder(NewFlateEncoder())
+
+	testcases := []struct {
+		Name    string
+		Encode  func([]byte) (*PdfObjectStream, error)
+		Filter  string
+		Lossy   bool
+		Failing bool
+	}{
+		{"Flate", NewFlateEncoder().EncodeStream, "/FlateDecode", false, false},
+		{"LZW", lzw.EncodeStream, "/LZWDecode", false, false},
+		{"DCT", dct.EncodeStream, "/DCTDecode", true, false},
+		{"RunLength", NewRunLengthEncoder().EncodeStream, "/RunLengthDecode", false, false},
+		{"ASCIIHex", NewASCIIHexEncoder().EncodeStream, "/ASCIIHexDecode", false, false},
+		{"ASCII85", NewASCII85Encoder().EncodeStream, "/ASCII85Decode", false, false},
+		{"Raw", NewRawEncoder().EncodeStream, "", false, false},
+		{"Multi", multi.EncodeStream, "[/ASCIIHexDecode /FlateDecode]", false, false},
+		{"CCITTFax", NewCCITTFaxEncoder().EncodeStream, "", false, true},
+		{"JBIG2", NewJBIG2Encoder().EncodeStream, "", false, true},
+		{"JPX", NewJPXEncoder().EncodeStream, "", false, true},
+	}
+	for _, tcase := range testcases {
+		stream, err := tcase.Encode(raw)
+		if tcase.Failing {
+			if err == nil {
+				t.Errorf("%s: expected an error", tcase.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed to encode: %v", tcase.Name, err)
+			continue
+		}
+		filter := ""
+		if obj := stream.Get("Filter"); obj != nil {
+			filter = obj.DefaultWriteString()
+		}
+		if filter != tcase.Filter {
+			t.Errorf("%s: Filter %q, expected %q", tcase.Name, filter, tcase.Filter)
+		}
+		length, ok := stream.Get("Length").(*PdfObjectInteger)
+		if !ok || int(*length) != len(stream.Stream) {
+			t.Errorf("%s: invalid Length: %v (%d)", tcase.Name, stream.Get("Length"), len(stream.Stream))
+		}
+		decoded, err := DecodeStream(stream)
+		if err != nil {
+			t.Errorf("%s: failed to decode: %v", tcase.Name, err)
+			continue
+		}
+		if len(decoded) != len(raw) || !tcase.Lossy && !bytes.Equal(decoded, raw) {
+			t.Errorf("%s: decoded data differs: % x", tcase.Name, decoded)
+		}
+	}
+}
+
+// Test decoding malformed flate data: raw deflate data without the zlib header, and zlib data with
+// a wrong Adler-32 checksum or truncated, which is only decoded in lenient mode.
+func TestFlateDecodeMalformed(t *testing.T) {
+	expected := "BT /F1 12 Tf 72 712 Td (Hello World) Tj ET"
+	testcases := []struct {
+		Name     string
+		Encoded  string
+		Lenient  bool
+		Expected string
+	}{
+		{"raw deflate", "730a51d07733543034520849533037523007b15214343c527372f215c2f38b7252341542b2145c4300", false, expected},
+		{"bad checksum", "78da730a51d07733543034520849533037523007b15214343c527372f215c2f38b7252341542b2145c4300d7b80a06", false, ""},
+		{"bad checksum", "78da730a51d07733543034520849533037523007b15214343c527372f215c2f38b7252341542b2145c4300d7b80a06", true, expected},
+		{"truncated", "78da730a51d07733543034520849533037523007b15214343c527372f215c2f38b7252341542b2145c4300", false, ""},
+		{"truncated", "78da730a51d07733543034520849533037523007b15214343c527372f215c2f38b7252341542b2145c4300", true, expected},
+	}
+	for _, tcase := range testcases {
+		encoded, _ := hex.DecodeString(tcase.Encoded)
+		encoder := NewFlateEncoder()
+		encoder.RecoverTruncated = tcase.Lenient
+		decoded, err := encoder.DecodeBytes(encoded)
+		if tcase.Expected == "" {
+			if err == nil {
+				t.Errorf("%s: decoded %q without error", tcase.Name, decoded)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s (lenient %t): Error: %v", tcase.Name, tcase.Lenient, err)
+			continue
+		}
+		if string(decoded) != tcase.Expected {
+			t.Errorf("%s (lenient %t): %q != %q", tcase.Name, tcase.Lenient, decoded, tcase.Expected)
+		}
+	}
+
+	// Lenient mode of the parser that loaded the stream.
+	encoded, _ := hex.DecodeString(testcases[3].Encoded)
+	stream := &PdfObjectStream{PdfObjectDictionary: MakeDict(), Stream: encoded}
+	stream.Set("Filter", MakeName(StreamEncodingFilterNameFlate))
+	if _, err := DecodeStream(stream); err == nil {
+		t.Errorf("Truncated stream decoded without error")
+	}
+	stream.decoding = newStreamDecoding(ParserOpts{FlateRecoverTruncated: true})
+	decoded, err := DecodeStream(stream)
+	if err != nil || string(decoded) != expected {
+		t.Errorf("Parser option: %q (%v) != %q", decoded, err, expected)
+	}
+
+	// Neither zlib nor raw deflate data.
+	if _, err := NewFlateEncoder().DecodeBytes([]byte("not compressed")); err == nil {
+		t.Errorf("Invalid data decoded")
+	}
+}
+
+// Test decoding flate data with two concatenated zlib streams, which is only decoded completely in
+// lenient mode.
+func TestFlateDecodeConcatenated(t *testing.T) {
+	encoder := NewFlateEncoder()
+	var encoded []byte
+	for _, part := range []string{"BT /F1 12 Tf ", "72 712 Td (Hello World) Tj ET"} {
+		data, err := encoder.EncodeBytes([]byte(part))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		encoded = append(encoded, data...)
+	}
+	// Trailing end-of-line, as included in the stream Length by some writers.
+	encoded = append(encoded, '\r', '\n')
+
+	testcases := []struct {
+		Lenient  bool
+		Expected string
+	}{
+		{false, "BT /F1 12 Tf "},
+		{true, "BT /F1 12 Tf 72 712 Td (Hello World) Tj ET"},
+	}
+	for _, tcase := range testcases {
+		encoder.ConcatenatedSegments = tcase.Lenient
+		decoded, err := encoder.DecodeBytes(encoded)
+		if err != nil {
+			t.Errorf("Lenient %t: Error: %v", tcase.Lenient, err)
+			continue
+		}
+		if string(decoded) != tcase.Expected {
+			t.Errorf("Lenient %t: %q != %q", tcase.Lenient, decoded, tcase.Expected)
+		}
+	}
+	// Lenient mode of the parser that loaded the stream.
+	stream := &PdfObjectStream{PdfObjectDictionary: MakeDict(), Stream: encoded}
+	stream.Set("Filter", MakeName(StreamEncodingFilterNameFlate))
+	stream.decoding = newStreamDecoding(ParserOpts{FlateConcatenatedSegments: true})
+	decoded, err := DecodeStream(stream)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if expected := testcases[1].Expected; string(decoded) != expected {
+		t.Errorf("Parser option: %q != %q", decoded, expected)
+	}
+}
+
+// Test round trips of the PNG predictors with multiple rows, for 1 and 3 colors, and the filter
+// type bytes written per row.
+func TestFlatePNGPredictors(t *testing.T) {
+	for _, colors := range []int{1, 3} {
+		columns, rows := 7, 5
+		raw := make([]byte, columns*colors*rows)
+		for i := range raw {
+			raw[i] = byte(i*i*7 + i/3)
+		}
+
+		for predictor := 10; predictor <= 15; predictor++ {
+			encoder := NewFlateEncoder()
+			encoder.Predictor = predictor
+			encoder.Columns = columns
+			encoder.Colors = colors
+			stream, err := MakeStream(raw, encoder)
+			if err != nil {
+				t.Fatalf("Predictor %d: Failed to encode: %v", predictor, err)
+			}
+
+			filtered, err := encoder.DecodeBytes(stream.Stream)
+			if err != nil {
+				t.Fatalf("Predictor %d: Failed to inflate: %v", predictor, err)
+			}
+			if len(filtered) != rows*(columns*colors+1) {
+				t.Fatalf("Predictor %d: Invalid filtered length %d", predictor, len(filtered))
+			}
+			for row := 0; row < rows; row++ {
+				fb := filtered[row*(columns*colors+1)]
+				if predictor < 15 && int(fb) != predictor-10 || fb > 4 {
+					t.Errorf("Predictor %d: Invalid filter byte %d in row %d", predictor, fb, row)
+				}
+			}
+
+			decoded, err := DecodeStream(stream)
+			if err != nil {
+				t.Fatalf("Predictor %d: Failed to decode: %v", predictor, err)
+			}
+			if !compareSlices(decoded, raw) {
+				t.Errorf("Predictor %d, colors %d: Slices not matching", predictor, colors)
+				t.Errorf("Decoded (%d): % x", len(decoded), decoded)
+				t.Errorf("Raw     (%d): % x", len(raw), raw)
+			}
+		}
+	}
+}
+
+// Test decoding a Flate stream with a PNG predictor whose Columns in the DecodeParms is an indirect
+// integer object, resolved with the parser that loaded the stream.
+func TestFlateDecodeParmsIndirect(t *testing.T) {
+	raw := make([]byte, 4*6)
+	for i := range raw {
+		raw[i] = byte(i * 37)
+	}
+	encoder := NewFlateEncoder()
+	encoder.Predictor = 12
+	encoder.Columns = 4
+	data, err := encoder.EncodeBytes(raw)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := []int{buf.Len()}
+	buf.WriteString("1 0 obj\n4\nendobj\n")
+	offsets = append(offsets, buf.Len())
+	fmt.Fprintf(&buf, "2 0 obj\n<< /Filter /FlateDecode /DecodeParms << /Predictor 12 /Columns 1 0 R >> /Length %d >>\nstream\n", len(data))
+	buf.Write(data)
+	buf.WriteString("\nendstream\nendobj\n")
+	xrefOffset := buf.Len()
+	buf.WriteString("xref\n0 3\n0000000000 65535 f\r\n")
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n\r\n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size 3 >>\nstartxref\n%d\n%%%%EOF\n", xrefOffset)
+
+	parser, err := NewParser(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	obj, err := parser.LookupByNumber(2)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	stream, ok := obj.(*PdfObjectStream)
+	if !ok {
+		t.Fatalf("Not a stream (%T)", obj)
+	}
+	decoded, err := DecodeStream(stream)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !bytes.Equal(decoded, raw) {
+		t.Errorf("Decoded % x, expected % x", decoded, raw)
+	}
+
+	// Reading and decoding the stream leaves the reference in its dictionary.
+	dp, ok := stream.Get("DecodeParms").(*PdfObjectDictionary)
+	if !ok {
+		t.Fatalf("DecodeParms not a dictionary (%v)", stream.Get("DecodeParms"))
+	}
+	if _, isRef := dp.Get("Columns").(*PdfObjectReference); !isRef {
+		t.Errorf("Columns replaced by %v", dp.Get("Columns"))
+	}
+}
+
+// Test the PNG filters on rows with hand computed results.
+func TestPNGFilterRows(t *testing.T) {
+	rows := [][]byte{{10, 20, 30}, {15, 25, 40}}
+	testcases := []struct {
+		Filter   byte
+		Expected [][]byte
+	}{
+		{0, [][]byte{{10, 20, 30}, {15, 25, 40}}},
+		{1, [][]byte{{10, 10, 10}, {15, 10, 15}}},
+		{2, [][]byte{{10, 20, 30}, {5, 5, 10}}},
+		{3, [][]byte{{10, 15, 20}, {10, 8, 13}}},
+		{4, [][]byte{{10, 10, 10}, {5, 5, 10}}},
+	}
+	for _, tcase := range testcases {
+		prev := make([]byte, 3)
+		for i, row := range rows {
+			out := make([]byte, 3)
+			pngFilterRow(tcase.Filter, row, prev, out, 1)
+			if !compareSlices(out, tcase.Expected[i]) {
+				t.Errorf("Filter %d row %d: % d != % d", tcase.Filter, i, out, tcase.Expected[i])
+			}
+			if !pngUnfilterRow(tcase.Filter, out, prev, 1) || !compareSlices(out, row) {
+				t.Errorf("Filter %d row %d: unfiltered % d != % d", tcase.Filter, i, out, row)
+			}
+			prev = row
+		}
+	}
+}
+
+// makeOneRowPNG returns a PNG image of one row of 8 bit RGB pixels with the zlib compressed image
+// data `idat`, i.e. one filter type byte and the filtered row.
+func makeOneRowPNG(width int, idat []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	chunk := func(typ string, data []byte) {
+		binary.Write(&buf, binary.BigEndian, uint32(len(data)))
+		crc := crc32.NewIEEE()
+		crc.Write([]byte(typ))
+		crc.Write(data)
+		buf.WriteString(typ)
+		buf.Write(data)
+		binary.Write(&buf, binary.BigEndian, crc.Sum32())
+	}
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:], 1)
+	ihdr[8] = 8 // Bit depth.
+	ihdr[9] = 2 // Truecolor.
+	chunk("IHDR", ihdr)
+	chunk("IDAT", idat)
+	chunk("IEND", nil)
+	return buf.Bytes()
+}
+
+// Test that single row RGB images with the PNG predictor 15 decode as by a PNG decoder for each
+// filter type, in particular the first pixel, whose bytes to the left and above are zeros, and the
+// bytes to the left of the next pixels, 3 bytes before.
+func TestPNGPredictorFirstRow(t *testing.T) {
+	const width = 3
+	for filter := byte(0); filter <= 4; filter++ {
+		filtered := []byte{filter}
+		for i := 0; i < width*3; i++ {
+			filtered = append(filtered, byte(200+i*37))
+		}
+		var idat bytes.Buffer
+		zw := zlib.NewWriter(&idat)
+		zw.Write(filtered)
+		zw.Close()
+
+		img, err := png.Decode(bytes.NewReader(makeOneRowPNG(width, idat.Bytes())))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		var expected []byte
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(x, 0).RGBA()
+			expected = append(expected, byte(r>>8), byte(g>>8), byte(b>>8))
+		}
+
+		flate := NewFlateEncoder()
+		flate.Predictor = 15
+		flate.Colors = 3
+		flate.Columns = width
+		decoded, err := flate.DecodeStream(&PdfObjectStream{Stream: idat.Bytes()})
+		if err != nil {
+			t.Fatalf("Flate, filter %d: Error: %v", filter, err)
+		}
+		if !bytes.Equal(decoded, expected) {
+			t.Errorf("Flate, filter %d: % x, expected % x", filter, decoded, expected)
+		}
+
+		lzw := NewLZWEncoder()
+		lzw.EarlyChange = 0
+		encoded, err := lzw.EncodeBytes(filtered)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		lzw.Predictor = 15
+		lzw.Colors = 3
+		lzw.Columns = width
+		decoded, err = lzw.DecodeStream(&PdfObjectStream{Stream: encoded})
+		if err != nil {
+			t.Fatalf("LZW, filter %d: Error: %v", filter, err)
+		}
+		if !bytes.Equal(decoded, expected) {
+			t.Errorf("LZW, filter %d: % x, expected % x", filter, decoded, expected)
+		}
+	}
+}
+
 // Test LZW encoding.
 func TestLZWEncoding(t *testing.T) {
 	rawStream := []byte("this is a dummy text with some \x01\x02\x03 binary data")
@@ -113,6 +533,116 @@ func TestASCIIHexEncoding(t *testing.T) {
 	}
 }
 
+// Test exact round trips of ASCIIHexDecode for empty, single byte and longer inputs, and decoding
+// data without the EOD marker.
+func TestASCIIHexRoundTrip(t *testing.T) {
+	long := make([]byte, 255)
+	for i := range long {
+		long[i] = byte(i)
+	}
+	testcases := []struct {
+		Data    []byte
+		Encoded string
+	}{
+		{[]byte{}, ">"},
+		{[]byte{0x0a}, "0A >"},
+		{long, ""},
+	}
+
+	encoder := NewASCIIHexEncoder()
+	for _, tcase := range testcases {
+		encoded, err := encoder.EncodeBytes(tcase.Data)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if tcase.Encoded != "" && string(encoded) != tcase.Encoded {
+			t.Errorf("Encoded %q, expected %q", encoded, tcase.Encoded)
+		}
+		decoded, err := encoder.DecodeBytes(encoded)
+		if err != nil {
+			t.Fatalf("Error decoding %q: %v", encoded, err)
+		}
+		if !bytes.Equal(decoded, tcase.Data) {
+			t.Errorf("%d bytes: decoded % x", len(tcase.Data), decoded)
+		}
+	}
+
+	// Missing EOD, with an odd number of digits completed by a 0.
+	for encoded, expected := range map[string][]byte{"": {}, "DEA": {0xde, 0xa0}} {
+		decoded, err := encoder.DecodeBytes([]byte(encoded))
+		if err != nil || !bytes.Equal(decoded, expected) {
+			t.Errorf("Decoded %q without EOD: % x (%v)", encoded, decoded, err)
+		}
+	}
+}
+
+// Test decoding malformed ASCIIHexDecode data, strictly and skipping isolated punctuation.
+func TestASCIIHexDecodeMalformed(t *testing.T) {
+	deAD := []byte{0xde, 0xad}
+	testcases := []struct {
+		Encoded string
+		Strict  []byte // nil for an error.
+		Lenient []byte // nil for an error.
+	}{
+		{"", []byte{}, []byte{}},
+		{">", []byte{}, []byte{}},
+		{"0>", []byte{0}, []byte{0}},
+		{"DEA", []byte{0xde, 0xa0}, []byte{0xde, 0xa0}},
+		{"DEA>", []byte{0xde, 0xa0}, []byte{0xde, 0xa0}},
+		{"D E\tA\r\nD>", deAD, deAD},
+		{"de ad>", deAD, deAD},
+		{"DE\x00AD>", deAD, deAD},
+		{"DEAD>garbage,", deAD, deAD},
+		{"DE,AD>", nil, deAD},
+		{"DE;AD", nil, deAD},
+		{",DEAD>", nil, deAD},
+		{"DEAD,", nil, deAD},
+		{"DE - AD>", nil, deAD},
+		{"DE,,AD>", nil, nil},
+		{"DE,x>", nil, nil},
+		{"DEXAD>", nil, nil},
+		{"DE G>", nil, nil},
+		{"DE\x80AD>", nil, nil},
+	}
+
+	encoder := NewASCIIHexEncoder()
+	for _, lenient := range []bool{false, true} {
+		encoder.SkipPunctuation = lenient
+		for _, tcase := range testcases {
+			expected := tcase.Strict
+			if lenient {
+				expected = tcase.Lenient
+			}
+			decoded, err := encoder.DecodeBytes([]byte(tcase.Encoded))
+			if expected == nil {
+				if err == nil {
+					t.Errorf("%q (lenient %v): decoded % x, expected an error", tcase.Encoded, lenient, decoded)
+				}
+				continue
+			}
+			if err != nil || !bytes.Equal(decoded, expected) {
+				t.Errorf("%q (lenient %v): decoded % x (%v), expected % x", tcase.Encoded, lenient, decoded, err,
+					expected)
+			}
+		}
+	}
+
+	// Lenient mode of the parser that loaded the stream.
+	stream := &PdfObjectStream{PdfObjectDictionary: MakeDict(), Stream: []byte("DE,AD>")}
+	stream.Set("Filter", MakeName(StreamEncodingFilterNameASCIIHex))
+	stream.decoding = newStreamDecoding(ParserOpts{ASCIIHexSkipPunctuation: true})
+	if decoded, err := DecodeStream(stream); err != nil || !bytes.Equal(decoded, deAD) {
+		t.Errorf("Parser option: decoded % x (%v), expected % x", decoded, err, deAD)
+	}
+
+	// The error gives the offset and the data around it.
+	encoder.SkipPunctuation = false
+	_, err := encoder.DecodeBytes([]byte("00 11 22 33 44 55 66 77 88 99 AA BB CC DD X EE FF >"))
+	if err == nil || !strings.Contains(err.Error(), "offset 42") || !strings.Contains(err.Error(), "CC DD X EE") {
+		t.Errorf("Error %v", err)
+	}
+}
+
 // ASCII85.
 func TestASCII85EncodingWikipediaExample(t *testing.T) {
 	expected := `Man is distinguished, not only by his reason, but by this singular passion from other animals, which is a lust of the mind, that by a perseverance of delight in the continued and indefatigable generation of knowledge, exceeds the short vehemence of any carnal pleasure.`
@@ -208,6 +738,100 @@ func TestASCII85Decoding(t *testing.T) {
 	}
 }
 
+// Test that the stream dictionary of a multi encoder with ASCII85Decode and LZWDecode filters
+// reloads into an equivalent encoder, keeping the LZW EarlyChange.
+func TestMultiEncoderDecodeParms(t *testing.T) {
+	for _, earlyChange := range []int{1, 0} {
+		encoder := NewMultiEncoder()
+		encoder.AddEncoder(NewASCII85Encoder())
+		lzw := NewLZWEncoder()
+		lzw.EarlyChange = earlyChange
+		encoder.AddEncoder(lzw)
+
+		dict := encoder.MakeStreamDict()
+		filters, ok := dict.Get("Filter").(*PdfObjectArray)
+		if !ok || len(*filters) != 2 {
+			t.Fatalf("Filter not an array of 2 names: %v", dict.Get("Filter"))
+		}
+		if name, ok := (*filters)[1].(*PdfObjectName); !ok || *name != StreamEncodingFilterNameLZW {
+			t.Errorf("Invalid Filter: %s", filters.DefaultWriteString())
+		}
+		if ec, ok := dict.Get("EarlyChange").(*PdfObjectInteger); !ok || int(*ec) != earlyChange {
+			t.Errorf("EarlyChange %v != %d", dict.Get("EarlyChange"), earlyChange)
+		}
+
+		stream := &PdfObjectStream{PdfObjectDictionary: dict}
+		reloaded, err := NewEncoderFromStream(stream)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		menc, ok := reloaded.(*MultiEncoder)
+		if !ok || len(menc.encoders) != 2 {
+			t.Fatalf("Not reloaded as a multi encoder with 2 filters (%T)", reloaded)
+		}
+		if _, ok := menc.encoders[0].(*ASCII85Encoder); !ok {
+			t.Errorf("First filter not ASCII85 (%T)", menc.encoders[0])
+		}
+		lzwReloaded, ok := menc.encoders[1].(*LZWEncoder)
+		if !ok || lzwReloaded.EarlyChange != earlyChange {
+			t.Errorf("LZW filter not reloaded with EarlyChange %d (%#v)", earlyChange, menc.encoders[1])
+		}
+		if dict.Get("Filter").DefaultWriteString() != menc.MakeStreamDict().Get("Filter").DefaultWriteString() {
+			t.Errorf("Filter changed on round trip")
+		}
+	}
+
+	// Data round trip (LZW encoding only supports EarlyChange 0).
+	rawStream := []byte("this is a dummy text with some \x01\x02\x03 binary data")
+	encoder := NewMultiEncoder()
+	encoder.AddEncoder(NewASCII85Encoder())
+	lzw := NewLZWEncoder()
+	lzw.EarlyChange = 0
+	encoder.AddEncoder(lzw)
+	stream, err := MakeStream(rawStream, encoder)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	decoded, err := DecodeStream(stream)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !compareSlices(decoded, rawStream) {
+		t.Errorf("Round trip mismatch: %q", decoded)
+	}
+}
+
+// Test a DecodeParms array shorter than the Filter array, whose missing entries are defaults.  The
+// parameters of the first filter must not be applied to the FlateDecode filter.
+func TestMultiEncoderShortDecodeParms(t *testing.T) {
+	rawStream := []byte("this is a dummy text with some \x01\x02\x03 binary data")
+	flate := NewFlateEncoder()
+	encoded, err := flate.EncodeBytes(rawStream)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	encoded, err = NewASCIIHexEncoder().EncodeBytes(encoded)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	dict := MakeDict()
+	dict.Set("Filter", MakeArray(MakeName(StreamEncodingFilterNameASCIIHex), MakeName(StreamEncodingFilterNameFlate)))
+	params := MakeDict()
+	params.Set("Predictor", MakeInteger(12))
+	params.Set("Columns", MakeInteger(3))
+	dict.Set("DecodeParms", MakeArray(params))
+	stream := &PdfObjectStream{PdfObjectDictionary: dict, Stream: encoded}
+
+	decoded, err := DecodeStream(stream)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !compareSlices(decoded, rawStream) {
+		t.Errorf("Decoded %q, expected %q", decoded, rawStream)
+	}
+}
+
 // Test multi encoder with FlateDecode and ASCIIHexDecode.
 func TestMultiEncoder(t *testing.T) {
 	rawStream := []byte("this is a dummy text with some \x01\x02\x03 binary data")
@@ -245,3 +869,315 @@ func TestMultiEncoder(t *testing.T) {
 		return
 	}
 }
+
+// Fixture: 1x1 gray JPEG with the SOF0 frame dimensions zeroed out.
+const zeroAreaJPEGHex = "ffd8ffdb008400080606070605080707070909080a0c140d0c0b0b0c1912130f141d1a1f1e1d1a1c1c20242e2720222c" +
+	"231c1c2837292c30313434341f27393d38323c2e333432010909090c0b0c180d0d1832211c2132323232323232323232" +
+	"32323232323232323232323232323232323232323232323232323232323232323232323232323232ffc0000b08000000" +
+	"0001011100ffc400d20000010501010101010100000000000000000102030405060708090a0b10000201030302040305" +
+	"0504040000017d01020300041105122131410613516107227114328191a1082342b1c11552d1f02433627282090a1617" +
+	"18191a25262728292a3435363738393a434445464748494a535455565758595a636465666768696a737475767778797a" +
+	"838485868788898a92939495969798999aa2a3a4a5a6a7a8a9aab2b3b4b5b6b7b8b9bac2c3c4c5c6c7c8c9cad2d3d4d5" +
+	"d6d7d8d9dae1e2e3e4e5e6e7e8e9eaf1f2f3f4f5f6f7f8f9faffda0008010100003f00f9febfffd9"
+
+func TestDCTDegenerateImages(t *testing.T) {
+	// Zero dimensions cannot be encoded.
+	encoder := NewDCTEncoder()
+	encoder.ColorComponents = 1
+	encoder.Width = 0
+	encoder.Height = 10
+	if _, err := encoder.EncodeBytes([]byte{1, 2, 3}); err == nil {
+		t.Errorf("Encoding zero width image should fail")
+	}
+
+	// Zero-area image decodes to empty, non-nil data.
+	encoded, err := hex.DecodeString(zeroAreaJPEGHex)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	decoded, err := encoder.DecodeBytes(encoded)
+	if err != nil {
+		t.Fatalf("Error decoding zero-area image: %v", err)
+	}
+	if decoded == nil || len(decoded) != 0 {
+		t.Errorf("Zero-area image should decode to empty data (%v)", decoded)
+	}
+
+	// 1x1 tracking pixel with trailing padding bytes.
+	encoder.Width = 1
+	encoder.Height = 1
+	encoded, err = encoder.EncodeBytes([]byte{0x80, 0, 0, 0})
+	if err != nil {
+		t.Fatalf("Error encoding 1x1 image: %v", err)
+	}
+	decoded, err = encoder.DecodeBytes(encoded)
+	if err != nil {
+		t.Fatalf("Error decoding 1x1 image: %v", err)
+	}
+	if len(decoded) != 1 || decoded[0] < 0x7c || decoded[0] > 0x84 {
+		t.Errorf("Invalid 1x1 decoded data (% x)", decoded)
+	}
+}
+
+func TestDCTDimensionMismatch(t *testing.T) {
+	// 4x2 grayscale JPEG.
+	encoder := NewDCTEncoder()
+	encoder.ColorComponents = 1
+	encoder.Width = 4
+	encoder.Height = 2
+	encoded, err := encoder.EncodeBytes(make([]byte, 8))
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+
+	// Dictionary claims 8x2.
+	stream := &PdfObjectStream{Stream: encoded}
+	stream.PdfObjectDictionary = MakeDict()
+	stream.Set("Filter", MakeName(StreamEncodingFilterNameDCT))
+	stream.Set("Width", MakeInteger(8))
+	stream.Set("Height", MakeInteger(2))
+
+	dct, err := newDCTEncoderFromStream(stream, nil, nil)
+	if err != nil {
+		t.Fatalf("Mismatch should not fail by default: %v", err)
+	}
+	if dct.Width != 4 || dct.Height != 2 {
+		t.Errorf("Expected JPEG dimensions 4x2, got %dx%d", dct.Width, dct.Height)
+	}
+	if dct.CheckDimensions(8, 2) != ErrDCTDimensionMismatch {
+		t.Errorf("Expected dimension mismatch")
+	}
+	if dct.CheckDimensions(4, 2) != nil {
+		t.Errorf("Expected matching dimensions")
+	}
+
+	// Strict mode of the parser that loaded the stream.
+	stream.decoding = newStreamDecoding(ParserOpts{DCTStrictDimensions: true})
+	if _, err := newDCTEncoderFromStream(stream, nil, nil); err != ErrDCTDimensionMismatch {
+		t.Errorf("Expected ErrDCTDimensionMismatch in strict mode, got %v", err)
+	}
+
+	// Matching dimensions pass in strict mode.
+	stream.Set("Width", MakeInteger(4))
+	if _, err := newDCTEncoderFromStream(stream, nil, nil); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+}
+
+// Test that CMYK data encoded as JPEG decodes to the original samples, without inversion.
+func TestDCTCMYKRoundTrip(t *testing.T) {
+	encoder := NewDCTEncoder()
+	encoder.ColorComponents = 4
+	encoder.Width = 20
+	encoder.Height = 11
+	encoder.Quality = 95
+	data := make([]byte, 4*encoder.Width*encoder.Height)
+	for i := 0; i < encoder.Width*encoder.Height; i++ {
+		x, y := i%encoder.Width, i/encoder.Width
+		data[4*i] = byte(10 * x)
+		data[4*i+1] = byte(20 * y)
+		data[4*i+2] = 200
+		data[4*i+3] = byte(5 * (x + y))
+	}
+	encoded, err := encoder.EncodeBytes(data)
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	if !bytes.Contains(encoded, []byte("\xff\xee\x00\x0eAdobe")) {
+		t.Errorf("Missing APP14 marker")
+	}
+
+	stream := &PdfObjectStream{PdfObjectDictionary: encoder.MakeStreamDict(), Stream: encoded}
+	dct, err := newDCTEncoderFromStream(stream, nil, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if dct.ColorComponents != 4 || dct.Width != 20 || dct.Height != 11 {
+		t.Fatalf("Unexpected JPEG parameters %+v", dct)
+	}
+	decoded, err := dct.DecodeBytes(encoded)
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	if len(decoded) != len(data) {
+		t.Fatalf("Length mismatch %d != %d", len(decoded), len(data))
+	}
+	for i := range data {
+		if diff := int(decoded[i]) - int(data[i]); diff < -6 || diff > 6 {
+			t.Fatalf("Sample %d: %d != %d", i, decoded[i], data[i])
+		}
+	}
+}
+
+func TestDCTColorTransform(t *testing.T) {
+	// Solid red 2x2 RGB JPEG, stored as YCbCr.
+	encoder := NewDCTEncoder()
+	encoder.Width = 2
+	encoder.Height = 2
+	data := []byte{}
+	for i := 0; i < 4; i++ {
+		data = append(data, 255, 0, 0)
+	}
+	encoded, err := encoder.EncodeBytes(data)
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+
+	near := func(a, b byte) bool {
+		return int(a)+4 >= int(b) && int(b)+4 >= int(a)
+	}
+
+	stream := &PdfObjectStream{Stream: encoded}
+	stream.PdfObjectDictionary = MakeDict()
+	stream.Set("Filter", MakeName(StreamEncodingFilterNameDCT))
+
+	// Default: YCbCr converted to RGB.
+	decoded, err := DecodeStream(stream)
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	if len(decoded) != 12 || !near(decoded[0], 255) || !near(decoded[1], 0) || !near(decoded[2], 0) {
+		t.Errorf("Invalid decoded RGB data (% x)", decoded)
+	}
+
+	// ColorTransform 0: no YCbCr to RGB conversion.
+	decodeParms := MakeDict()
+	decodeParms.Set("ColorTransform", MakeInteger(0))
+	stream.Set("DecodeParms", decodeParms)
+	dct, err := newDCTEncoderFromStream(stream, nil, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if dct.ColorTransform != 0 {
+		t.Errorf("ColorTransform %d != 0", dct.ColorTransform)
+	}
+	decoded, err = DecodeStream(stream)
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	y, cb, cr := gocolor.RGBToYCbCr(255, 0, 0)
+	if len(decoded) != 12 || !near(decoded[0], y) || !near(decoded[1], cb) || !near(decoded[2], cr) {
+		t.Errorf("Expected raw YCbCr values (%d %d %d), got (% x)", y, cb, cr, decoded)
+	}
+}
+
+func TestDCTDecodeDownscaled(t *testing.T) {
+	// 20x12 grayscale JPEG with a left-right gradient.
+	encoder := NewDCTEncoder()
+	encoder.ColorComponents = 1
+	encoder.Width = 20
+	encoder.Height = 12
+	data := make([]byte, 20*12)
+	for i := range data {
+		data[i] = byte((i % 20) * 12)
+	}
+	encoded, err := encoder.EncodeBytes(data)
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+
+	scaled, width, height, err := encoder.DecodeBytesDownscaled(encoded, 8)
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	if width != 3 || height != 2 {
+		t.Errorf("Scaled dimensions %dx%d != 3x2", width, height)
+	}
+	if len(scaled) != 6 {
+		t.Fatalf("Scaled data length %d != 6", len(scaled))
+	}
+	if !(scaled[0] < scaled[1] && scaled[1] < scaled[2]) {
+		t.Errorf("Gradient not preserved (% x)", scaled)
+	}
+
+	// Each sample is the average of its (possibly partial) block in the full resolution image.
+	full, err := encoder.DecodeBytes(encoded)
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	for sy := 0; sy < height; sy++ {
+		for sx := 0; sx < width; sx++ {
+			sum, count := 0, 0
+			for y := sy * 8; y < (sy+1)*8 && y < 12; y++ {
+				for x := sx * 8; x < (sx+1)*8 && x < 20; x++ {
+					sum += int(full[y*20+x])
+					count++
+				}
+			}
+			if avg := byte((sum + count/2) / count); scaled[sy*width+sx] != avg {
+				t.Errorf("Sample (%d,%d) %d != block average %d", sx, sy, scaled[sy*width+sx], avg)
+			}
+		}
+	}
+
+	if _, _, _, err := encoder.DecodeBytesDownscaled(encoded, 3); err == nil {
+		t.Errorf("Scale 1/3 should fail")
+	}
+}
+
+// Test downscaled decoding of flate data, without and with a PNG predictor, and of raw data, with
+// partial blocks at the right and bottom edges.
+func TestFlateDecodeDownscaled(t *testing.T) {
+	// 13x7 RGB image.
+	const width, height, colors, scale = 13, 7, 3, 4
+	raw := make([]byte, width*height*colors)
+	for i := range raw {
+		raw[i] = byte(i*7 + i/(width*colors)*31)
+	}
+	expected := make([]byte, 0, 4*2*colors)
+	for sy := 0; sy < 2; sy++ {
+		for sx := 0; sx < 4; sx++ {
+			for c := 0; c < colors; c++ {
+				sum, count := 0, 0
+				for y := sy * scale; y < (sy+1)*scale && y < height; y++ {
+					for x := sx * scale; x < (sx+1)*scale && x < width; x++ {
+						sum += int(raw[(y*width+x)*colors+c])
+						count++
+					}
+				}
+				expected = append(expected, byte((sum+count/2)/count))
+			}
+		}
+	}
+
+	for _, predictor := range []int{1, 15} {
+		encoder := NewFlateEncoder()
+		encoder.Predictor = predictor
+		encoder.Columns = width
+		encoder.Colors = colors
+		encoded, err := encoder.EncodeBytes(raw)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		scaled, w, h, err := encoder.DecodeBytesDownscaled(encoded, width, height, colors, scale)
+		if err != nil {
+			t.Errorf("Predictor %d: Error: %v", predictor, err)
+			continue
+		}
+		if w != 4 || h != 2 || !bytes.Equal(scaled, expected) {
+			t.Errorf("Predictor %d: %dx%d % x, expected 4x2 % x", predictor, w, h, scaled, expected)
+		}
+
+		// Truncated data.
+		if _, _, _, err := encoder.DecodeBytesDownscaled(encoded, width, height+1, colors, scale); err == nil {
+			t.Errorf("Predictor %d: rows missing from the data decoded", predictor)
+		}
+		// Predictor rows other than the image rows.
+		if predictor > 1 {
+			if _, _, _, err := encoder.DecodeBytesDownscaled(encoded, width-1, height, colors, scale); err == nil {
+				t.Errorf("Predictor rows of another width decoded")
+			}
+		}
+	}
+
+	scaled, w, h, err := NewRawEncoder().DecodeBytesDownscaled(raw, width, height, colors, scale)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if w != 4 || h != 2 || !bytes.Equal(scaled, expected) {
+		t.Errorf("Raw: %dx%d % x, expected 4x2 % x", w, h, scaled, expected)
+	}
+	if _, _, _, err := NewRawEncoder().DecodeBytesDownscaled(raw[1:], width, height, colors, scale); err == nil {
+		t.Errorf("Raw: short data decoded")
+	}
+}
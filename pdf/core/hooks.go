@@ -0,0 +1,98 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package core
+
+import (
+	"time"
+)
+
+// OperationType identifies the operations on objects reported to the operation hook.
+type OperationType int
+
+const (
+	// OperationDecode is the decoding of stream data (DecodeStream, DecodeStreamReadOnly).
+	OperationDecode OperationType = iota
+	// OperationEncode is the encoding of stream data (EncodeStream).
+	OperationEncode
+	// OperationDecrypt is the decryption of a string or of stream data.
+	OperationDecrypt
+	// OperationEncrypt is the encryption of a string or of stream data.
+	OperationEncrypt
+)
+
+// String returns the name of the operation.
+func (op OperationType) String() string {
+	switch op {
+	case OperationDecode:
+		return "decode"
+	case OperationEncode:
+		return "encode"
+	case OperationDecrypt:
+		return "decrypt"
+	case OperationEncrypt:
+		return "encrypt"
+	}
+	return "unknown"
+}
+
+// OperationInfo describes an operation on an object, as reported to the operation hook.
+type OperationInfo struct {
+	Operation OperationType
+
+	// Object and generation number of the object (or of the object containing the string), 0 for
+	// objects created in memory.
+	ObjectNumber     int64
+	GenerationNumber int64
+
+	// Filter is the stream filters applied for decoding and encoding, e.g. "FlateDecode", or
+	// "ASCII85Decode FlateDecode" for several filters, and empty for unfiltered data.  For encryption
+	// and decryption it is the crypt filter, e.g. StdCF for V>=4.
+	Filter string
+
+	InputSize  int           // Size of the input data in bytes.
+	OutputSize int           // Size of the output data in bytes, 0 on failure.
+	Duration   time.Duration // Duration of the operation.
+	Err        error         // Error of the operation, nil on success.
+}
+
+// OperationHook is called after each operation on an object, with the description of the
+// operation, e.g. for gathering metrics.  It is called from the goroutine performing the operation.
+// Set with ParserOpts.OperationHook for the streams and strings of a parsed document, and with
+// PdfCrypt.OperationHook for encryption.
+type OperationHook func(info OperationInfo)
+
+// reportOperation reports the operation `info` started at `start` to `hook`.
+func reportOperation(hook OperationHook, info OperationInfo, start time.Time) {
+	info.Duration = time.Since(start)
+	if info.Err != nil {
+		info.OutputSize = 0
+	}
+	hook(info)
+}
+
+// streamFilterNames returns the names of the filters of the stream with dictionary `dict`,
+// separated by spaces.
+func streamFilterNames(dict *PdfObjectDictionary) string {
+	if dict == nil {
+		return ""
+	}
+	switch t := TraceToDirectObject(dict.Get("Filter")).(type) {
+	case *PdfObjectName:
+		return string(*t)
+	case *PdfObjectArray:
+		names := ""
+		for i, obj := range *t {
+			if i > 0 {
+				names += " "
+			}
+			if name, ok := TraceToDirectObject(obj).(*PdfObjectName); ok {
+				names += string(*name)
+			}
+		}
+		return names
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package core
+
+import (
+	"testing"
+)
+
+// Test that the operation hook reports the decoding, encoding, encryption and decryption of
+// streams with their sizes.
+func TestOperationHook(t *testing.T) {
+	var infos []OperationInfo
+	hook := func(info OperationInfo) { infos = append(infos, info) }
+
+	raw := []byte("BT /F1 12 Tf (Hello Hello Hello Hello) Tj ET")
+	stream, err := MakeStream(raw, NewFlateEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	stream.ObjectNumber = 7
+	stream.decoding = newStreamDecoding(ParserOpts{OperationHook: hook})
+	encodedSize := len(stream.Stream)
+
+	crypter := &PdfCrypt{V: 4, R: 4, Length: 128}
+	crypter.CryptFilters = CryptFilters{StandardCryptFilter: NewCryptFilterAESV2()}
+	crypter.StreamFilter = StandardCryptFilter
+	crypter.StringFilter = StandardCryptFilter
+	crypter.EncryptionKey = []byte("0123456789abcdef")
+	crypter.EncryptedObjects = map[PdfObject]bool{}
+	crypter.DecryptedObjects = map[PdfObject]bool{}
+	crypter.OperationHook = hook
+	if err := crypter.Encrypt(stream, 0, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	encryptedSize := len(stream.Stream)
+	if err := crypter.Decrypt(stream, 0, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := DecodeStream(stream); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	stream.Stream = raw
+	stream.ObjectNumber = 8
+	if err := EncodeStream(stream); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	expected := []OperationInfo{
+		{Operation: OperationEncrypt, ObjectNumber: 7, Filter: StandardCryptFilter, InputSize: encodedSize, OutputSize: encryptedSize},
+		{Operation: OperationDecrypt, ObjectNumber: 7, Filter: StandardCryptFilter, InputSize: encryptedSize, OutputSize: encodedSize},
+		{Operation: OperationDecode, ObjectNumber: 7, Filter: "FlateDecode", InputSize: encodedSize, OutputSize: len(raw)},
+		{Operation: OperationEncode, ObjectNumber: 8, Filter: "FlateDecode", InputSize: len(raw), OutputSize: encodedSize},
+	}
+	if len(infos) != len(expected) {
+		t.Fatalf("%d operations reported, expected %d: %+v", len(infos), len(expected), infos)
+	}
+	for i, info := range infos {
+		if info.Duration < 0 || info.Err != nil {
+			t.Errorf("Operation %d: duration %v, error %v", i, info.Duration, info.Err)
+		}
+		info.Duration = 0
+		if info != expected[i] {
+			t.Errorf("Operation %d: %+v, expected %+v", i, info, expected[i])
+		}
+	}
+	if encryptedSize <= encodedSize {
+		t.Errorf("AES encrypted size %d not above %d", encryptedSize, encodedSize)
+	}
+
+	// Failures are reported with their errors.
+	infos = nil
+	stream.Set("Filter", MakeName(StreamEncodingFilterNameJBIG2))
+	if _, err := DecodeStream(stream); err == nil {
+		t.Fatalf("JBIG2 decoded")
+	}
+	if len(infos) != 1 || infos[0].Err != ErrNoJBIG2Decode || infos[0].Filter != "JBIG2Decode" || infos[0].OutputSize != 0 {
+		t.Errorf("Failed decoding reported as %+v", infos)
+	}
+
+	// No reports without a hook.
+	infos = nil
+	stream.decoding = nil
+	crypter.OperationHook = nil
+	if _, err := DecodeStream(stream); err == nil {
+		t.Fatalf("JBIG2 decoded")
+	}
+	if err := crypter.Encrypt(MakeString("secret"), 7, 0); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(infos) != 0 {
+		t.Errorf("Reported without a hook: %+v", infos)
+	}
+}
@@ -0,0 +1,266 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/unidoc/unidoc/common"
+)
+
+// ImageParams are the parameters of an image as given by an image XObject dictionary or the
+// dictionary of an inline image, normalized by NewImageParamsFromDict.
+type ImageParams struct {
+	Width            int64
+	Height           int64
+	BitsPerComponent int64     // 0 if determined by the JPXDecode data.
+	ColorComponents  int       // 0 if unknown, e.g. a named colorspace resource of an inline image.
+	ColorSpace       PdfObject // Direct object with abbreviations expanded, nil if none.
+	Decode           []float64 // The Decode array or its default, nil if ColorComponents is unknown.
+	ImageMask        bool
+	Interpolate      bool
+}
+
+// Abbreviations of the keys of inline image dictionaries (Table 93 in 8.9.7), and of the colorspace
+// names (Table 94).
+var (
+	imageKeyAbbreviations = map[PdfObjectName]PdfObjectName{
+		"Width":            "W",
+		"Height":           "H",
+		"BitsPerComponent": "BPC",
+		"ColorSpace":       "CS",
+		"Decode":           "D",
+		"ImageMask":        "IM",
+		"Interpolate":      "I",
+		"Filter":           "F",
+	}
+	colorspaceAbbreviations = map[PdfObjectName]PdfObjectName{
+		"G":    "DeviceGray",
+		"RGB":  "DeviceRGB",
+		"CMYK": "DeviceCMYK",
+		"I":    "Indexed",
+	}
+)
+
+// NewImageParamsFromDict returns the parameters of the image with dictionary `dict`, which may use
+// the abbreviated keys and colorspace names of inline images.  The defaults applied (8.9.5 "Image
+// Dictionaries") are:
+//   - Width and Height are required.  Zero is accepted, as for the empty placeholder images found
+//     in some files, but not negative values.
+//   - ImageMask and Interpolate default to false.
+//   - An image mask has 1 bit per component, 1 color component and no colorspace.
+//   - BitsPerComponent is required except for image masks and JPXDecode images, where the JPEG2000
+//     data determines it.  If it is missing otherwise, 8 is assumed.  Values other than 1, 2, 4, 8
+//     and 16 are accepted up to 32, 8 is assumed for values out of that range.
+//   - ColorSpace is required except for image masks and JPXDecode images.  If it is missing
+//     otherwise, DeviceGray is assumed.
+//   - Decode defaults to [0 1] per color component, [0 2^BitsPerComponent-1] for Indexed and
+//     [0 100 amin amax bmin bmax] for Lab.  An invalid Decode array is replaced by the default.
+func NewImageParamsFromDict(dict *PdfObjectDictionary) (*ImageParams, error) {
+	get := func(key PdfObjectName) PdfObject {
+		if obj := dict.Get(key); obj != nil {
+			return TraceToDirectObject(obj)
+		}
+		if abbr, has := imageKeyAbbreviations[key]; has {
+			return TraceToDirectObject(dict.Get(abbr))
+		}
+		return nil
+	}
+	getBool := func(key PdfObjectName) bool {
+		b, ok := get(key).(*PdfObjectBool)
+		return ok && bool(*b)
+	}
+
+	params := &ImageParams{}
+	for _, key := range []PdfObjectName{"Width", "Height"} {
+		obj := get(key)
+		if obj == nil {
+			return nil, fmt.Errorf("%s missing", key)
+		}
+		val, ok := obj.(*PdfObjectInteger)
+		if !ok || *val < 0 {
+			common.Log.Debug("ERROR: Invalid image %s: %v", key, obj)
+			return nil, fmt.Errorf("Invalid image %s", key)
+		}
+		if key == "Width" {
+			params.Width = int64(*val)
+		} else {
+			params.Height = int64(*val)
+		}
+	}
+	params.ImageMask = getBool("ImageMask")
+	params.Interpolate = getBool("Interpolate")
+	isJPX := hasImageFilter(get("Filter"), StreamEncodingFilterNameJPX)
+
+	if obj := get("BitsPerComponent"); obj != nil {
+		bpc, ok := obj.(*PdfObjectInteger)
+		if !ok {
+			return nil, errors.New("Invalid BitsPerComponent")
+		}
+		switch {
+		case *bpc == 1 || *bpc == 2 || *bpc == 4 || *bpc == 8 || *bpc == 16:
+			params.BitsPerComponent = int64(*bpc)
+		case *bpc > 0 && *bpc <= 32:
+			// Not allowed by the spec, but accepted as by earlier versions.
+			common.Log.Debug("Nonstandard BitsPerComponent %d", *bpc)
+			params.BitsPerComponent = int64(*bpc)
+		default:
+			common.Log.Debug("Invalid BitsPerComponent %d - assuming 8", *bpc)
+			params.BitsPerComponent = 8
+		}
+	}
+
+	if params.ImageMask {
+		if params.BitsPerComponent != 0 && params.BitsPerComponent != 1 {
+			common.Log.Debug("Image mask with BitsPerComponent %d - using 1", params.BitsPerComponent)
+		}
+		params.BitsPerComponent = 1
+		params.ColorComponents = 1
+		if get("ColorSpace") != nil {
+			common.Log.Debug("Image mask with ColorSpace - ignoring")
+		}
+	} else {
+		if params.BitsPerComponent == 0 && !isJPX {
+			common.Log.Debug("Image BitsPerComponent missing - assuming 8")
+			params.BitsPerComponent = 8
+		}
+		if obj := get("ColorSpace"); obj != nil {
+			params.ColorSpace = expandColorspaceAbbreviations(obj)
+		} else if !isJPX {
+			common.Log.Debug("Image ColorSpace missing - assuming DeviceGray")
+			params.ColorSpace = MakeName("DeviceGray")
+		}
+		if params.ColorSpace != nil {
+			params.ColorComponents = colorspaceComponents(params.ColorSpace)
+		}
+	}
+
+	params.Decode = params.defaultDecode()
+	if arr, ok := get("Decode").(*PdfObjectArray); ok {
+		decode, err := arr.GetAsFloat64Slice()
+		if err == nil && (params.Decode == nil || len(decode) == len(params.Decode)) {
+			params.Decode = decode
+		} else {
+			common.Log.Debug("Invalid image Decode %s - using default", arr)
+		}
+	}
+
+	return params, nil
+}
+
+// defaultDecode returns the default Decode array of the image, or nil if the number of color
+// components is not known.
+func (params *ImageParams) defaultDecode() []float64 {
+	if params.ColorComponents == 0 {
+		return nil
+	}
+	if arr, ok := params.ColorSpace.(*PdfObjectArray); ok && len(*arr) > 0 {
+		family, _ := TraceToDirectObject((*arr)[0]).(*PdfObjectName)
+		if family != nil && *family == "Indexed" {
+			return []float64{0, float64(int64(1)<<uint(params.BitsPerComponent) - 1)}
+		}
+		if family != nil && *family == "Lab" {
+			ranges := []float64{-100, 100, -100, 100}
+			if len(*arr) > 1 {
+				if d, ok := TraceToDirectObject((*arr)[1]).(*PdfObjectDictionary); ok {
+					if r, ok := TraceToDirectObject(d.Get("Range")).(*PdfObjectArray); ok {
+						if vals, err := r.GetAsFloat64Slice(); err == nil && len(vals) == 4 {
+							ranges = vals
+						}
+					}
+				}
+			}
+			return append([]float64{0, 100}, ranges...)
+		}
+	}
+	decode := make([]float64, 0, 2*params.ColorComponents)
+	for i := 0; i < params.ColorComponents; i++ {
+		decode = append(decode, 0, 1)
+	}
+	return decode
+}
+
+// hasImageFilter returns true if `filter`, a filter name or array of filter names, contains `name`.
+func hasImageFilter(filter PdfObject, name string) bool {
+	switch t := filter.(type) {
+	case *PdfObjectName:
+		return string(*t) == name
+	case *PdfObjectArray:
+		for _, obj := range *t {
+			if n, ok := TraceToDirectObject(obj).(*PdfObjectName); ok && string(*n) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expandColorspaceAbbreviations returns the colorspace `obj` with the abbreviated names of inline
+// images replaced by the full names, e.g. [/Indexed /DeviceRGB 1 <...>] for [/I /RGB 1 <...>].
+func expandColorspaceAbbreviations(obj PdfObject) PdfObject {
+	switch t := obj.(type) {
+	case *PdfObjectName:
+		if name, has := colorspaceAbbreviations[*t]; has {
+			return MakeName(string(name))
+		}
+	case *PdfObjectArray:
+		if len(*t) > 1 {
+			if family, ok := TraceToDirectObject((*t)[0]).(*PdfObjectName); ok && (*family == "I" || *family == "Indexed") {
+				expanded := PdfObjectArray{MakeName("Indexed"), expandColorspaceAbbreviations(TraceToDirectObject((*t)[1]))}
+				expanded = append(expanded, (*t)[2:]...)
+				return &expanded
+			}
+		}
+	}
+	return obj
+}
+
+// colorspaceComponents returns the number of color components of colorspace `obj`, or 0 if not
+// known, e.g. for a named colorspace resource.
+func colorspaceComponents(obj PdfObject) int {
+	var family PdfObjectName
+	var arr *PdfObjectArray
+	switch t := obj.(type) {
+	case *PdfObjectName:
+		family = *t
+	case *PdfObjectArray:
+		if len(*t) == 0 {
+			return 0
+		}
+		name, ok := TraceToDirectObject((*t)[0]).(*PdfObjectName)
+		if !ok {
+			return 0
+		}
+		family, arr = *name, t
+	default:
+		return 0
+	}
+
+	switch family {
+	case "DeviceGray", "CalGray", "Indexed", "Separation":
+		return 1
+	case "DeviceRGB", "CalRGB", "Lab":
+		return 3
+	case "DeviceCMYK":
+		return 4
+	case "DeviceN":
+		if arr != nil && len(*arr) > 1 {
+			if names, ok := TraceToDirectObject((*arr)[1]).(*PdfObjectArray); ok {
+				return len(*names)
+			}
+		}
+	case "ICCBased":
+		if arr != nil && len(*arr) > 1 {
+			if stream, ok := TraceToDirectObject((*arr)[1]).(*PdfObjectStream); ok {
+				if n, ok := TraceToDirectObject(stream.Get("N")).(*PdfObjectInteger); ok {
+					return int(*n)
+				}
+			}
+		}
+	}
+	return 0
+}
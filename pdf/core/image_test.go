@@ -0,0 +1,146 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package core
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Test the defaults applied to image dictionaries, both of image XObjects and inline images.
+func TestNewImageParamsFromDict(t *testing.T) {
+	iccDict := MakeDict()
+	iccDict.Set("N", MakeInteger(4))
+	icc := &PdfObjectStream{PdfObjectDictionary: iccDict}
+	labDict := MakeDict()
+	labDict.Set("Range", MakeArrayFromFloats([]float64{-50, 50, -60, 60}))
+
+	testcases := []struct {
+		Name     string
+		Dict     map[PdfObjectName]PdfObject
+		Expected ImageParams
+	}{
+		{
+			"Complete",
+			map[PdfObjectName]PdfObject{"Width": MakeInteger(10), "Height": MakeInteger(20),
+				"BitsPerComponent": MakeInteger(8), "ColorSpace": MakeName("DeviceRGB"),
+				"Interpolate": MakeBool(true)},
+			ImageParams{Width: 10, Height: 20, BitsPerComponent: 8, ColorComponents: 3,
+				ColorSpace: MakeName("DeviceRGB"), Decode: []float64{0, 1, 0, 1, 0, 1}, Interpolate: true},
+		},
+		{
+			"Missing BitsPerComponent and ColorSpace",
+			map[PdfObjectName]PdfObject{"Width": MakeInteger(1), "Height": MakeInteger(1)},
+			ImageParams{Width: 1, Height: 1, BitsPerComponent: 8, ColorComponents: 1,
+				ColorSpace: MakeName("DeviceGray"), Decode: []float64{0, 1}},
+		},
+		{
+			"Image mask",
+			map[PdfObjectName]PdfObject{"Width": MakeInteger(1), "Height": MakeInteger(1),
+				"ImageMask": MakeBool(true), "Decode": MakeArray(MakeInteger(1), MakeInteger(0))},
+			ImageParams{Width: 1, Height: 1, BitsPerComponent: 1, ColorComponents: 1,
+				Decode: []float64{1, 0}, ImageMask: true},
+		},
+		{
+			"JPXDecode",
+			map[PdfObjectName]PdfObject{"Width": MakeInteger(1), "Height": MakeInteger(1),
+				"Filter": MakeArray(MakeName("JPXDecode"))},
+			ImageParams{Width: 1, Height: 1},
+		},
+		{
+			"Indexed",
+			map[PdfObjectName]PdfObject{"Width": MakeInteger(1), "Height": MakeInteger(1),
+				"BitsPerComponent": MakeInteger(4),
+				"ColorSpace":       MakeArray(MakeName("Indexed"), MakeName("DeviceRGB"), MakeInteger(1), MakeString("abcdef"))},
+			ImageParams{Width: 1, Height: 1, BitsPerComponent: 4, ColorComponents: 1,
+				ColorSpace: MakeArray(MakeName("Indexed"), MakeName("DeviceRGB"), MakeInteger(1), MakeString("abcdef")),
+				Decode:     []float64{0, 15}},
+		},
+		{
+			"Lab",
+			map[PdfObjectName]PdfObject{"Width": MakeInteger(1), "Height": MakeInteger(1),
+				"BitsPerComponent": MakeInteger(8), "ColorSpace": MakeArray(MakeName("Lab"), labDict)},
+			ImageParams{Width: 1, Height: 1, BitsPerComponent: 8, ColorComponents: 3,
+				ColorSpace: MakeArray(MakeName("Lab"), labDict), Decode: []float64{0, 100, -50, 50, -60, 60}},
+		},
+		{
+			"ICCBased with invalid Decode",
+			map[PdfObjectName]PdfObject{"Width": MakeInteger(1), "Height": MakeInteger(1),
+				"BitsPerComponent": MakeInteger(8), "ColorSpace": MakeArray(MakeName("ICCBased"), icc),
+				"Decode": MakeArray(MakeInteger(0), MakeInteger(1))},
+			ImageParams{Width: 1, Height: 1, BitsPerComponent: 8, ColorComponents: 4,
+				ColorSpace: MakeArray(MakeName("ICCBased"), icc), Decode: []float64{0, 1, 0, 1, 0, 1, 0, 1}},
+		},
+		{
+			"Inline image abbreviations",
+			map[PdfObjectName]PdfObject{"W": MakeInteger(2), "H": MakeInteger(3), "BPC": MakeInteger(2),
+				"CS": MakeArray(MakeName("I"), MakeName("G"), MakeInteger(3), MakeString("abcd")),
+				"I":  MakeBool(true)},
+			ImageParams{Width: 2, Height: 3, BitsPerComponent: 2, ColorComponents: 1,
+				ColorSpace: MakeArray(MakeName("Indexed"), MakeName("DeviceGray"), MakeInteger(3), MakeString("abcd")),
+				Decode:     []float64{0, 3}, Interpolate: true},
+		},
+		{
+			"Inline image named colorspace",
+			map[PdfObjectName]PdfObject{"W": MakeInteger(2), "H": MakeInteger(3), "CS": MakeName("CS0")},
+			ImageParams{Width: 2, Height: 3, BitsPerComponent: 8, ColorSpace: MakeName("CS0")},
+		},
+		{
+			"Nonstandard BitsPerComponent",
+			map[PdfObjectName]PdfObject{"Width": MakeInteger(1), "Height": MakeInteger(1),
+				"BitsPerComponent": MakeInteger(3)},
+			ImageParams{Width: 1, Height: 1, BitsPerComponent: 3, ColorComponents: 1,
+				ColorSpace: MakeName("DeviceGray"), Decode: []float64{0, 1}},
+		},
+		{
+			"Empty placeholder",
+			map[PdfObjectName]PdfObject{"Width": MakeInteger(0), "Height": MakeInteger(0),
+				"BitsPerComponent": MakeInteger(8), "ColorSpace": MakeName("DeviceRGB")},
+			ImageParams{BitsPerComponent: 8, ColorComponents: 3, ColorSpace: MakeName("DeviceRGB"),
+				Decode: []float64{0, 1, 0, 1, 0, 1}},
+		},
+		{
+			"Invalid BitsPerComponent",
+			map[PdfObjectName]PdfObject{"Width": MakeInteger(1), "Height": MakeInteger(1),
+				"BitsPerComponent": MakeInteger(0)},
+			ImageParams{Width: 1, Height: 1, BitsPerComponent: 8, ColorComponents: 1,
+				ColorSpace: MakeName("DeviceGray"), Decode: []float64{0, 1}},
+		},
+	}
+
+	for _, tcase := range testcases {
+		dict := MakeDict()
+		for key, val := range tcase.Dict {
+			dict.Set(key, val)
+		}
+		params, err := NewImageParamsFromDict(dict)
+		if err != nil {
+			t.Errorf("%s: error %v", tcase.Name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*params, tcase.Expected) {
+			t.Errorf("%s: %+v != %+v", tcase.Name, *params, tcase.Expected)
+		}
+	}
+}
+
+func TestNewImageParamsFromDictInvalid(t *testing.T) {
+	testcases := []map[PdfObjectName]PdfObject{
+		{"Height": MakeInteger(1)},
+		{"Width": MakeInteger(1), "Height": MakeFloat(1.5)},
+		{"Width": MakeInteger(-1), "Height": MakeInteger(1)},
+		{"Width": MakeInteger(1), "Height": MakeInteger(1), "BitsPerComponent": MakeName("8")},
+	}
+	for _, entries := range testcases {
+		dict := MakeDict()
+		for key, val := range entries {
+			dict.Set(key, val)
+		}
+		if _, err := NewImageParamsFromDict(dict); err == nil {
+			t.Errorf("%s: expected error", dict)
+		}
+	}
+}
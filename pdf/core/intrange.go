@@ -0,0 +1,51 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package core
+
+import (
+	"fmt"
+)
+
+// MaxInt is the largest int of the platform: 2^31-1 on 32-bit and 2^63-1 on 64-bit platforms.
+const MaxInt = int64(^uint(0) >> 1)
+
+// maxInt is the largest value converted by ToInt.  It is MaxInt except in tests simulating a 32-bit
+// platform.
+var maxInt = MaxInt
+
+// IntRangeError is returned when a length, offset, count or object number read from a file is out
+// of the range allowed, which is limited by the range of int when the value is used as an int,
+// e.g. to allocate a slice.
+type IntRangeError struct {
+	Name  string // What the value is, e.g. "stream Length".
+	Value int64
+	Min   int64
+	Max   int64
+}
+
+func (e *IntRangeError) Error() string {
+	return fmt.Sprintf("%s %d out of range [%d, %d]", e.Name, e.Value, e.Min, e.Max)
+}
+
+// ToInt converts `val` named `name` to int, returning an *IntRangeError if `val` is not in the range
+// [min, max] or does not fit in an int on the platform.
+func ToInt(name string, val, min, max int64) (int, error) {
+	if max > maxInt {
+		max = maxInt
+	}
+	if val < min || val > max {
+		return 0, &IntRangeError{Name: name, Value: val, Min: min, Max: max}
+	}
+	return int(val), nil
+}
+
+// mulInt64 returns the product of non-negative values `a` and `b`, or false if it overflows int64.
+func mulInt64(a, b int64) (int64, bool) {
+	if a != 0 && b > (1<<63-1)/a {
+		return 0, false
+	}
+	return a * b, true
+}
@@ -0,0 +1,130 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package core
+
+import (
+	"fmt"
+	"testing"
+)
+
+// simulate32Bit limits the values converted by ToInt to the int range of 32-bit platforms until
+// the returned function is called.
+func simulate32Bit() func() {
+	maxInt = 1<<31 - 1
+	return func() { maxInt = MaxInt }
+}
+
+// Values at the boundaries of the 32-bit int range.
+var intRangeBoundaries = []int64{1<<31 - 1, 1 << 31, 1 << 32}
+
+func isIntRangeError(err error) bool {
+	_, ok := err.(*IntRangeError)
+	return ok
+}
+
+func TestToInt(t *testing.T) {
+	defer simulate32Bit()()
+
+	if v, err := ToInt("value", 1<<31-1, 0, MaxInt); err != nil || v != 1<<31-1 {
+		t.Errorf("2^31-1: %d, %v", v, err)
+	}
+	for _, val := range []int64{1 << 31, 1 << 32, -1} {
+		if _, err := ToInt("value", val, 0, MaxInt); !isIntRangeError(err) {
+			t.Errorf("%d: Error %v, expected an IntRangeError", val, err)
+		}
+	}
+	if _, err := ToInt("value", 11, 0, 10); !isIntRangeError(err) {
+		t.Errorf("Value above max: error %v", err)
+	}
+}
+
+// Test that stream lengths beyond the file or the int range fail before allocating the data.
+func TestStreamLengthRange(t *testing.T) {
+	for _, length := range intRangeBoundaries {
+		text := fmt.Sprintf("1 0 obj\n<< /Length %d >>\nstream\nabc", length)
+		parser := makeParserForText(text)
+		if _, err := parser.ParseIndirectObject(); !isIntRangeError(err) {
+			t.Errorf("Length %d: Error %v, expected an IntRangeError", length, err)
+		}
+	}
+
+	text := "1 0 obj\n<< /Length 10 >>\nstream\n0123456789\nendstream\nendobj\n"
+	parser := makeParserForText(text)
+	parser.SetTokenLimits(TokenLimits{MaxStreamLength: 4})
+	if _, err := parser.ParseIndirectObject(); !isIntRangeError(err) {
+		t.Errorf("Length above MaxStreamLength: Error %v", err)
+	}
+	parser = makeParserForText(text)
+	if _, err := parser.ParseIndirectObject(); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	// A wrong Length makes the parser scan for endstream, which is not used beyond the limit either.
+	text = "1 0 obj\n<< /Length 3 >>\nstream\n0123456789\nendstream\nendobj\n"
+	parser = makeParserForText(text)
+	parser.SetTokenLimits(TokenLimits{MaxStreamLength: 4})
+	obj, err := parser.ParseIndirectObject()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if stream := obj.(*PdfObjectStream); string(stream.Stream) != "012" || stream.GetLengthSource() != StreamLengthDeclared {
+		t.Errorf("Stream data %q (%s), expected the declared length", stream.Stream, stream.GetLengthSource())
+	}
+}
+
+// Test predictor parameters whose row size overflows int on 32-bit platforms.
+func TestPredictorParamsRange(t *testing.T) {
+	defer simulate32Bit()()
+
+	for _, filter := range []string{"FlateDecode", "LZWDecode"} {
+		for _, columns := range intRangeBoundaries {
+			text := fmt.Sprintf("1 0 obj\n<< /Length 0 /Filter /%s /DecodeParms << /Predictor 12 /Columns %d >> >>\n"+
+				"stream\n\nendstream\nendobj\n", filter, columns)
+			obj, err := makeParserForText(text).ParseIndirectObject()
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			_, err = NewEncoderFromStream(obj.(*PdfObjectStream))
+			if !isIntRangeError(err) {
+				t.Errorf("%s Columns %d: Error %v, expected an IntRangeError", filter, columns, err)
+			}
+		}
+	}
+}
+
+// Test that object numbers which do not fit int are not truncated to other objects.
+func TestObjectNumberRange(t *testing.T) {
+	defer simulate32Bit()()
+
+	parser := makeParserForText("1 0 obj\n(one)\nendobj\n")
+	parser.xrefs = XrefTable{1: XrefObject{xtype: XREF_TABLE_ENTRY, objectNumber: 1, offset: 0}}
+	parser.ObjCache = ObjectCache{}
+	if _, err := parser.LookupByReference(PdfObjectReference{ObjectNumber: 1<<32 + 1}); !isIntRangeError(err) {
+		t.Errorf("Object number 2^32+1: Error %v, expected an IntRangeError", err)
+	}
+	obj, err := parser.LookupByReference(PdfObjectReference{ObjectNumber: 1})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if ind, ok := obj.(*PdfIndirectObject); !ok || ind.PdfObject.String() != "one" {
+		t.Errorf("Object 1: %v", obj)
+	}
+
+	arr := MakeArray(MakeInteger(1), MakeInteger(1<<31))
+	if _, err := arr.ToIntegerArray(); !isIntRangeError(err) {
+		t.Errorf("Integer array with 2^31: Error %v", err)
+	}
+
+	for _, first := range intRangeBoundaries {
+		text := fmt.Sprintf("xref\n%d 2\n0000000000 65535 f \n0000000010 00000 n \ntrailer\n<< /Size 2 >>\n", first)
+		parser := makeParserForText(text)
+		parser.xrefs = XrefTable{}
+		parser.ObjCache = ObjectCache{}
+		if _, err := parser.parseXrefTable(); !isIntRangeError(err) {
+			t.Errorf("Xref subsection %d: Error %v, expected an IntRangeError", first, err)
+		}
+	}
+}
@@ -8,6 +8,7 @@ package core
 import (
 	"bufio"
 	"errors"
+	"io"
 	"os"
 
 	"github.com/unidoc/unidoc/common"
@@ -47,3 +48,16 @@ func (parser *PdfParser) SetFileOffset(offset int64) {
 	parser.rs.Seek(offset, os.SEEK_SET)
 	parser.reader = bufio.NewReader(parser.rs)
 }
+
+// WriteOriginal writes the whole underlying file the parser was loaded from to `w`, for example as the
+// base of an incremental update.  The file offset of the parser is preserved.
+func (parser *PdfParser) WriteOriginal(w io.Writer) (int64, error) {
+	offset := parser.GetFileOffset()
+	defer parser.SetFileOffset(offset)
+
+	_, err := parser.rs.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(w, parser.rs)
+}
@@ -32,6 +32,28 @@ var reIndirectObject = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj`)
 var reXrefSubsection = regexp.MustCompile(`(\d+)\s+(\d+)\s*$`)
 var reXrefEntry = regexp.MustCompile(`(\d+)\s+(\d+)\s+([nf])\s*$`)
 
+// ErrTokenTooLarge is returned when a string or name token exceeds the token limits of the parser.
+var ErrTokenTooLarge = errors.New("Token too large")
+
+// Default token limits of a parser.
+const (
+	DefaultMaxStringLength = 10 * 1024 * 1024
+	DefaultMaxNameLength   = 64 * 1024
+)
+
+// TokenLimits are the maximum sizes of the lexical tokens read by a parser, which bound the memory
+// used for a corrupt file where e.g. a missing closing parenthesis makes the rest of the file one
+// string.  Zero values stand for the defaults.
+type TokenLimits struct {
+	MaxStringLength int   // Maximum length of literal and hex strings (decoded bytes).
+	MaxNameLength   int   // Maximum length of names (decoded bytes).
+	MaxStreamLength int64 // Maximum length of stream data, no limit besides the file size if 0.
+
+	// Truncate oversized tokens and resynchronize at the next delimiter instead of failing with
+	// ErrTokenTooLarge (lenient mode).
+	Truncate bool
+}
+
 // PdfParser parses a PDF file and provides access to the object structure of the PDF.
 type PdfParser struct {
 	majorVersion int
@@ -41,17 +63,129 @@ type PdfParser struct {
 	reader           *bufio.Reader
 	fileSize         int64
 	xrefs            XrefTable
+	freeObjects      map[int]int // Generation numbers of the free objects, by object number.
 	objstms          ObjectStreams
 	trailer          *PdfObjectDictionary
+	xrefOffset       int64       // Offset of the last cross-reference section (startxref).
 	ObjCache         ObjectCache // TODO: Unexport (v3).
 	crypter          *PdfCrypt
-	repairsAttempted bool // Avoid multiple attempts for repair.
+	repairsAttempted bool    // Avoid multiple attempts for repair.
+	duplicates       int     // Extra entries for object numbers within cross-reference sections.
+	loadErrors       []error // Problems recovered from while loading the cross-reference sections.
 
 	// Tracker for reference lookups when looking up Length entry of stream objects.
 	// The Length entries of stream objects are a special case, as they can require recursive parsing, i.e. look up
 	// the length reference (if not object) prior to reading the actual stream.  This has risks of endless looping.
 	// Tracking is necessary to avoid recursive loops.
 	streamLengthReferenceLookupInProgress map[int64]bool
+
+	tokenLimits TokenLimits
+
+	// Decoding options and decoded data cache of the streams loaded by the parser.
+	decoding *streamDecoding
+}
+
+// ParserOpts are the options of NewParserWithOpts.
+type ParserOpts struct {
+	// DecodeCaching enables caching the decoded data of the streams loaded by the parser: the data
+	// decoded by DecodeStream is kept by object number, and repeated calls return a copy of it, as
+	// long as the stream data and filter entries are unchanged.  Trades memory for speed.
+	DecodeCaching bool
+
+	// DCTStrictDimensions makes decoding a DCTDecode stream fail with ErrDCTDimensionMismatch when
+	// the JPEG header dimensions differ from the Width and Height of the stream dictionary, which
+	// is otherwise only logged.
+	DCTStrictDimensions bool
+
+	// StrictNumbers makes the parser reject numbers in exponential format such as 1.0E-5, which
+	// the PDF syntax does not allow (7.3.3).  By default they are read as real numbers.
+	StrictNumbers bool
+
+	// ReadOnlyDecryption leaves the data and Length of the encrypted streams loaded by the parser
+	// as stored in the file, e.g. to keep the byte ranges covered by a digital signature intact.
+	// Only the strings of the stream dictionaries are decrypted.  DecodeStream and
+	// DecodeStreamReadOnly decrypt a copy of the data, DecryptedStream returns it, and
+	// MutableStream replaces the data with its decrypted form.
+	ReadOnlyDecryption bool
+
+	// TokenLimits are the maximum sizes of the tokens read by the parser, from the cross-reference
+	// sections and trailer on.
+	TokenLimits TokenLimits
+
+	// CryptMaxNesting is the maximum nesting depth of arrays and dictionaries within the objects
+	// of an encrypted document, DefaultCryptMaxNesting if not set (see PdfCrypt.MaxNesting).
+	CryptMaxNesting int
+
+	// DuplicateObjects is the policy for object numbers with more than one entry in a
+	// cross-reference section, or defined more than once within a revision of a file whose
+	// cross-reference table is rebuilt.  DuplicateObjectLaterWins by default.
+	DuplicateObjects DuplicateObjectPolicy
+
+	// FlateConcatenatedSegments makes decoding FlateDecode streams continue with any zlib streams
+	// following the first one (see FlateEncoder.ConcatenatedSegments).
+	FlateConcatenatedSegments bool
+
+	// FlateRecoverTruncated makes decoding truncated FlateDecode streams, or ones with a wrong
+	// Adler-32 checksum, return the data inflated up to the error (see
+	// FlateEncoder.RecoverTruncated).
+	FlateRecoverTruncated bool
+
+	// ASCIIHexSkipPunctuation makes decoding ASCIIHexDecode streams skip isolated punctuation
+	// characters (see ASCIIHexEncoder.SkipPunctuation).
+	ASCIIHexSkipPunctuation bool
+
+	// OperationHook is called after each decoding of the streams loaded by the parser (DecodeStream,
+	// DecodeStreamReadOnly), each encoding of them (EncodeStream) and each decryption and
+	// encryption of the document's strings and streams (see PdfCrypt.OperationHook).  Nil (the
+	// default) disables the reports, with no overhead.
+	OperationHook OperationHook
+}
+
+// SetTokenLimits sets the maximum sizes of string and name tokens read by the parser from then on,
+// e.g. for parsers of NewParserFromString.  The limits of a parser of a file are set with
+// ParserOpts.TokenLimits, as the cross-reference sections are read by NewParserWithOpts.
+func (parser *PdfParser) SetTokenLimits(limits TokenLimits) {
+	parser.tokenLimits = limits
+}
+
+// strictNumbers returns true if numbers in exponential format are rejected, see
+// ParserOpts.StrictNumbers.
+func (parser *PdfParser) strictNumbers() bool {
+	return parser.decoding != nil && parser.decoding.opts.StrictNumbers
+}
+
+// maxStringLength returns the maximum length of string tokens.
+func (parser *PdfParser) maxStringLength() int {
+	if parser.tokenLimits.MaxStringLength > 0 {
+		return parser.tokenLimits.MaxStringLength
+	}
+	return DefaultMaxStringLength
+}
+
+// maxNameLength returns the maximum length of name tokens.
+func (parser *PdfParser) maxNameLength() int {
+	if parser.tokenLimits.MaxNameLength > 0 {
+		return parser.tokenLimits.MaxNameLength
+	}
+	return DefaultMaxNameLength
+}
+
+// maxStreamLength returns the maximum length of stream data.
+func (parser *PdfParser) maxStreamLength() int64 {
+	if parser.tokenLimits.MaxStreamLength > 0 {
+		return parser.tokenLimits.MaxStreamLength
+	}
+	return MaxInt
+}
+
+// streamLengthLimit returns the maximum length of the data of a stream starting at `offset`: the
+// rest of the file, and at most the MaxStreamLength token limit.
+func (parser *PdfParser) streamLengthLimit(offset int64) int64 {
+	limit := parser.maxStreamLength()
+	if parser.fileSize > 0 && parser.fileSize-offset < limit {
+		limit = parser.fileSize - offset
+	}
+	return limit
 }
 
 // GetCrypter returns the PdfCrypt instance which has information about the PDFs encryption.
@@ -64,6 +198,12 @@ func (parser *PdfParser) IsAuthenticated() bool {
 	return parser.crypter.Authenticated
 }
 
+// GetXrefOffset returns the offset of the last cross-reference section in the file, as referenced by
+// startxref.  An incremental update refers to it as Prev.
+func (parser *PdfParser) GetXrefOffset() int64 {
+	return parser.xrefOffset
+}
+
 // GetTrailer returns the PDFs trailer dictionary. The trailer dictionary is typically the starting point for a PDF,
 // referencing other key objects that are important in the document structure.
 func (parser *PdfParser) GetTrailer() *PdfObjectDictionary {
@@ -215,11 +355,33 @@ func (parser *PdfParser) parseName() (PdfObjectName, error) {
 				b, _ := parser.reader.ReadByte()
 				r.WriteByte(b)
 			}
+
+			if r.Len() > parser.maxNameLength() {
+				common.Log.Debug("ERROR: Name longer than %d bytes", parser.maxNameLength())
+				if !parser.tokenLimits.Truncate {
+					return PdfObjectName(""), ErrTokenTooLarge
+				}
+				r.Truncate(parser.maxNameLength())
+				parser.skipToken()
+				break
+			}
 		}
 	}
 	return PdfObjectName(r.String()), nil
 }
 
+// skipToken skips the bytes up to the next white space or delimiter, the rest of an oversized
+// name token.
+func (parser *PdfParser) skipToken() {
+	for {
+		bb, err := parser.reader.Peek(1)
+		if err != nil || IsWhiteSpace(bb[0]) || IsDelimiter(bb[0]) {
+			return
+		}
+		parser.reader.ReadByte()
+	}
+}
+
 // Numeric objects.
 // Section 7.3.3.
 // Integer or Float.
@@ -237,11 +399,12 @@ func (parser *PdfParser) parseName() (PdfObjectName, error) {
 // A conforming writer shall not use the PostScript syntax for numbers
 // with non-decimal radices (such as 16#FFFE) or in exponential format
 // (such as 6.02E23).
-// Nonetheless, we sometimes get numbers with exponential format, so
-// we will support it in the reader (no confusion with other types, so
-// no compromise).
+// Nonetheless, we sometimes get numbers with exponential format (e.g. 1.0E-5),
+// so we support it in the reader unless strict number parsing is enabled
+// (see ParserOpts.StrictNumbers).
 func (parser *PdfParser) parseNumber() (PdfObject, error) {
 	isFloat := false
+	hasExponent := false
 	allowSigns := true
 	var r bytes.Buffer
 	for {
@@ -265,21 +428,33 @@ func (parser *PdfParser) parseNumber() (PdfObject, error) {
 		} else if IsDecimalDigit(bb[0]) {
 			b, _ := parser.reader.ReadByte()
 			r.WriteByte(b)
+			allowSigns = false
 		} else if bb[0] == '.' {
 			b, _ := parser.reader.ReadByte()
 			r.WriteByte(b)
 			isFloat = true
-		} else if bb[0] == 'e' {
-			// Exponential number format.
+			allowSigns = false
+		} else if (bb[0] == 'e' || bb[0] == 'E') && !hasExponent && r.Len() > 0 {
+			// Exponential number format, if the exponent has digits.
+			peek, _ := parser.reader.Peek(3)
+			if !IsExponent(peek) {
+				break
+			}
 			b, _ := parser.reader.ReadByte()
 			r.WriteByte(b)
 			isFloat = true
+			hasExponent = true
 			allowSigns = true
 		} else {
 			break
 		}
 	}
 
+	if hasExponent && parser.strictNumbers() {
+		common.Log.Debug("ERROR: Number in exponential format %q (strict mode)", r.String())
+		return nil, fmt.Errorf("Invalid number %q: exponential format not allowed", r.String())
+	}
+
 	if isFloat {
 		fVal, err := strconv.ParseFloat(r.String(), 64)
 		if err != nil {
@@ -303,6 +478,17 @@ func (parser *PdfParser) parseString() (PdfObjectString, error) {
 	var r bytes.Buffer
 	count := 1
 	for {
+		if r.Len() > parser.maxStringLength() {
+			common.Log.Debug("ERROR: String longer than %d bytes", parser.maxStringLength())
+			if !parser.tokenLimits.Truncate {
+				return PdfObjectString(""), ErrTokenTooLarge
+			}
+			// The string is taken to end at the next closing parenthesis.
+			r.Truncate(parser.maxStringLength())
+			parser.skipPast(')')
+			break
+		}
+
 		bb, err := parser.reader.Peek(1)
 		if err != nil {
 			return PdfObjectString(r.String()), err
@@ -379,6 +565,16 @@ func (parser *PdfParser) parseString() (PdfObjectString, error) {
 	return PdfObjectString(r.String()), nil
 }
 
+// skipPast skips the bytes up to and including the next `delim` byte, or to the end of the data.
+func (parser *PdfParser) skipPast(delim byte) {
+	for {
+		b, err := parser.reader.ReadByte()
+		if err != nil || b == delim {
+			return
+		}
+	}
+}
+
 // Starts with '<' ends with '>'.
 // Currently not converting the hex codes to characters.
 func (parser *PdfParser) parseHexString() (PdfObjectString, error) {
@@ -400,6 +596,16 @@ func (parser *PdfParser) parseHexString() (PdfObjectString, error) {
 		if !IsWhiteSpace(b) {
 			r.WriteByte(b)
 		}
+
+		if r.Len() > 2*parser.maxStringLength() {
+			common.Log.Debug("ERROR: Hex string longer than %d bytes", parser.maxStringLength())
+			if !parser.tokenLimits.Truncate {
+				return PdfObjectString(""), ErrTokenTooLarge
+			}
+			r.Truncate(2 * parser.maxStringLength())
+			parser.skipPast('>')
+			break
+		}
 	}
 
 	if r.Len()%2 == 1 {
@@ -690,6 +896,8 @@ func (parser *PdfParser) parseXrefTable() (*PdfObjectDictionary, error) {
 	}
 
 	common.Log.Trace("xref first line: %s", txt)
+	section := xrefSection{}
+	defer parser.loadSection(section)
 	curObjNum := -1
 	secObjects := 0
 	insideSubsection := false
@@ -708,10 +916,21 @@ func (parser *PdfParser) parseXrefTable() (*PdfObjectDictionary, error) {
 		result1 := reXrefSubsection.FindStringSubmatch(txt)
 		if len(result1) == 3 {
 			// Match
-			first, _ := strconv.Atoi(result1[1])
-			second, _ := strconv.Atoi(result1[2])
-			curObjNum = first
-			secObjects = second
+			first, err1 := strconv.ParseInt(result1[1], 10, 64)
+			second, err2 := strconv.ParseInt(result1[2], 10, 64)
+			if err1 != nil || err2 != nil {
+				common.Log.Debug("ERROR: Invalid xref subsection: %s", txt)
+				return nil, errors.New("Invalid xref subsection")
+			}
+			// The object numbers of the subsection must fit an int.
+			secObjects, err = ToInt("xref subsection count", second, 0, MaxInt)
+			if err != nil {
+				return nil, err
+			}
+			curObjNum, err = ToInt("xref subsection object number", first, 0, maxInt-second)
+			if err != nil {
+				return nil, err
+			}
 			insideSubsection = true
 			common.Log.Trace("xref subsection: first object: %d objects: %d", curObjNum, secObjects)
 			continue
@@ -738,17 +957,12 @@ func (parser *PdfParser) parseXrefTable() (*PdfObjectDictionary, error) {
 				// Some malformed writers even seem to have values such as
 				// 1.. Assume null object for those also. That is referring
 				// to within the PDF version in the header clearly.
-				//
-				// Load if not existing or higher generation number than previous.
-				// Usually should not happen, lower generation numbers
-				// would be marked as free.  But can still happen!
-				x, ok := parser.xrefs[curObjNum]
-				if !ok || gen > x.generation {
-					obj := XrefObject{objectNumber: curObjNum,
-						xtype:  XREF_TABLE_ENTRY,
-						offset: first, generation: gen}
-					parser.xrefs[curObjNum] = obj
-				}
+				obj := XrefObject{objectNumber: curObjNum,
+					xtype:  XREF_TABLE_ENTRY,
+					offset: first, generation: gen}
+				parser.addSectionEntry(section, obj)
+			} else if strings.ToLower(third) == "f" {
+				parser.addSectionEntry(section, XrefObject{objectNumber: curObjNum, xtype: xrefFree, generation: gen})
 			}
 
 			curObjNum++
@@ -823,8 +1037,10 @@ func (parser *PdfParser) parseXrefStream(xstm *PdfObjectInteger) (*PdfObjectDict
 		return nil, errors.New("Range check error")
 	}
 
-	wObj := xs.PdfObjectDictionary.Get("W")
-	wArr, ok := wObj.(*PdfObjectArray)
+	// Table 17: W is an array of 3 integers giving the byte widths of the entry fields.  A zero
+	// width means the field is absent and takes its default: type 1 for the first field and 0 for
+	// the others.
+	wArr, ok := TraceToDirectObject(xs.PdfObjectDictionary.Get("W")).(*PdfObjectArray)
 	if !ok {
 		return nil, errors.New("Invalid W in xref stream")
 	}
@@ -837,14 +1053,15 @@ func (parser *PdfParser) parseXrefStream(xstm *PdfObjectInteger) (*PdfObjectDict
 
 	var b []int64
 	for i := 0; i < 3; i++ {
-		w, ok := (*wArr)[i].(PdfObject)
-		if !ok {
-			return nil, errors.New("Invalid W")
-		}
-		wVal, ok := w.(*PdfObjectInteger)
+		wVal, ok := TraceToDirectObject((*wArr)[i]).(*PdfObjectInteger)
 		if !ok {
 			return nil, errors.New("Invalid w object type")
 		}
+		// The fields are read into int64 values.
+		if *wVal < 0 || *wVal > 8 {
+			common.Log.Debug("ERROR: Invalid xref stm field width W[%d] = %d", i, *wVal)
+			return nil, fmt.Errorf("Invalid xref stm field width W[%d] = %d", i, *wVal)
+		}
 
 		b = append(b, int64(*wVal))
 	}
@@ -860,10 +1077,6 @@ func (parser *PdfParser) parseXrefStream(xstm *PdfObjectInteger) (*PdfObjectDict
 	s2 := int(b[0] + b[1] + b[2])
 	deltab := int(b[0] + b[1] + b[2])
 
-	if s0 < 0 || s1 < 0 || s2 < 0 {
-		common.Log.Debug("Error s value < 0 (%d,%d,%d)", s0, s1, s2)
-		return nil, errors.New("Range check error")
-	}
 	if deltab == 0 {
 		common.Log.Debug("No xref objects in stream (deltab == 0)")
 		return trailerDict, nil
@@ -875,7 +1088,7 @@ func (parser *PdfParser) parseXrefStream(xstm *PdfObjectInteger) (*PdfObjectDict
 	// Get the object indices.
 
 	objCount := 0
-	indexObj := xs.PdfObjectDictionary.Get("Index")
+	indexObj := TraceToDirectObject(xs.PdfObjectDictionary.Get("Index"))
 	// Table 17 (7.5.8.2 Cross-Reference Stream Dictionary)
 	// (Optional) An array containing a pair of integers for each
 	// subsection in this section. The first integer shall be the first
@@ -913,6 +1126,12 @@ func (parser *PdfParser) parseXrefStream(xstm *PdfObjectInteger) (*PdfObjectDict
 
 			startIdx := indices[i]
 			numObjs := indices[i+1]
+			if startIdx < 0 || numObjs < 0 || objCount+numObjs > entries+1 || int64(startIdx)+int64(numObjs) > maxInt {
+				common.Log.Debug("ERROR: Invalid xref stm Index subsection [%d %d] (%d entries in stream)",
+					startIdx, numObjs, entries)
+				return nil, fmt.Errorf("Invalid xref stm Index subsection [%d %d]: %d entries of %d bytes in stream (%d bytes)",
+					startIdx, numObjs, entries, deltab, len(ds))
+			}
 			for j := 0; j < numObjs; j++ {
 				indexList = append(indexList, startIdx+j)
 			}
@@ -926,34 +1145,46 @@ func (parser *PdfParser) parseXrefStream(xstm *PdfObjectInteger) (*PdfObjectDict
 		objCount = int(*sizeObj)
 	}
 
-	if entries == objCount+1 {
+	if len(ds)%deltab != 0 {
+		// Some writers pad the stream data, e.g. to a multiple of the predictor row size.
+		common.Log.Debug("xref stm: ignoring %d trailing bytes (length %d not a multiple of entry size %d)",
+			len(ds)%deltab, len(ds), deltab)
+	}
+
+	if entries == objCount+1 && indexObj == nil {
 		// For compatibility, expand the object count.
 		common.Log.Debug("BAD file: allowing compatibility (append one object to xref stm)")
 		indexList = append(indexList, objCount)
 		objCount++
 	}
 
-	if entries != len(indexList) {
-		// If mismatch -> error (already allowing mismatch of 1 if Index not specified).
+	if entries < len(indexList) {
 		common.Log.Debug("ERROR: xref stm: num entries != len(indices) (%d != %d)", entries, len(indexList))
-		return nil, errors.New("Xref stm num entries != len(indices)")
+		return nil, fmt.Errorf("Xref stm num entries != len(indices): %d entries of %d bytes (W %v) in %d bytes, %d required by Index",
+			entries, deltab, b, len(ds), len(indexList))
+	}
+	if entries > len(indexList) {
+		common.Log.Debug("xref stm: ignoring %d entries beyond Index/Size (%d)", entries-len(indexList), len(indexList))
+		entries = len(indexList)
 	}
 
 	common.Log.Trace("Objects count %d", objCount)
 	common.Log.Trace("Indices: % d", indexList)
 
-	// Convert byte array to a larger integer, little-endian.
+	// Convert byte array to a larger integer, big-endian.
 	convertBytes := func(v []byte) int64 {
-		var tmp int64 = 0
+		var tmp int64
 		for i := 0; i < len(v); i++ {
-			tmp += int64(v[i]) * (1 << uint(8*(len(v)-i-1)))
+			tmp = tmp<<8 | int64(v[i])
 		}
 		return tmp
 	}
 
 	common.Log.Trace("Decoded stream length: %d", len(ds))
+	section := xrefSection{}
+	defer parser.loadSection(section)
 	objIndex := 0
-	for i := 0; i < len(ds); i += deltab {
+	for i := 0; i < entries*deltab; i += deltab {
 		err := checkBounds(len(ds), i, i+s0)
 		if err != nil {
 			common.Log.Debug("Invalid slice range: %v", err)
@@ -998,27 +1229,21 @@ func (parser *PdfParser) parseXrefStream(xstm *PdfObjectInteger) (*PdfObjectDict
 
 		common.Log.Trace("%d. xref: %d %d %d", objNum, ftype, n2, n3)
 		if ftype == 0 {
-			common.Log.Trace("- Free object - can probably ignore")
+			common.Log.Trace("- Free object")
+			parser.addSectionEntry(section, XrefObject{objectNumber: objNum, xtype: xrefFree, generation: int(n3)})
 		} else if ftype == 1 {
 			common.Log.Trace("- In use - uncompressed via offset %b", p2)
 			// Object type 1: Objects that are in use but are not
 			// compressed, i.e. defined by an offset (normal entry)
-			if xr, ok := parser.xrefs[objNum]; !ok || int(n3) > xr.generation {
-				// Only overload if not already loaded!
-				// or has a newer generation number. (should not happen)
-				obj := XrefObject{objectNumber: objNum,
-					xtype: XREF_TABLE_ENTRY, offset: n2, generation: int(n3)}
-				parser.xrefs[objNum] = obj
-			}
+			obj := XrefObject{objectNumber: objNum,
+				xtype: XREF_TABLE_ENTRY, offset: n2, generation: int(n3)}
+			parser.addSectionEntry(section, obj)
 		} else if ftype == 2 {
 			// Object type 2: Compressed object.
 			common.Log.Trace("- In use - compressed object")
-			if _, ok := parser.xrefs[objNum]; !ok {
-				obj := XrefObject{objectNumber: objNum,
-					xtype: XREF_OBJECT_STREAM, osObjNumber: int(n2), osObjIndex: int(n3)}
-				parser.xrefs[objNum] = obj
-				common.Log.Trace("entry: %s", parser.xrefs[objNum])
-			}
+			obj := XrefObject{objectNumber: objNum,
+				xtype: XREF_OBJECT_STREAM, osObjNumber: int(n2), osObjIndex: int(n3)}
+			parser.addSectionEntry(section, obj)
 		} else {
 			common.Log.Debug("ERROR: --------INVALID TYPE XrefStm invalid?-------")
 			// Continue, we do not define anything -> null object.
@@ -1137,6 +1362,7 @@ func (parser *PdfParser) seekToEOFMarker(fSize int64) error {
 //
 func (parser *PdfParser) loadXrefs() (*PdfObjectDictionary, error) {
 	parser.xrefs = make(XrefTable)
+	parser.freeObjects = map[int]int{}
 	parser.objstms = make(ObjectStreams)
 
 	// Get the file size.
@@ -1200,6 +1426,7 @@ func (parser *PdfParser) loadXrefs() (*PdfObjectDictionary, error) {
 		}
 	}
 	// Read the xref.
+	parser.xrefOffset = offsetXref
 	parser.rs.Seek(int64(offsetXref), io.SeekStart)
 	parser.reader = bufio.NewReader(parser.rs)
 
@@ -1273,6 +1500,20 @@ func (parser *PdfParser) loadXrefs() (*PdfObjectDictionary, error) {
 	return trailerDict, nil
 }
 
+// addFreeObject records the free entry for object number `objNum` with generation number `gen`,
+// unless a newer cross-reference section (loaded first) has an entry for it.
+func (parser *PdfParser) addFreeObject(objNum, gen int) {
+	if _, inUse := parser.xrefs[objNum]; inUse {
+		return
+	}
+	if parser.freeObjects == nil {
+		parser.freeObjects = map[int]int{}
+	}
+	if _, has := parser.freeObjects[objNum]; !has {
+		parser.freeObjects[objNum] = gen
+	}
+}
+
 // Return the closest object following offset from the xrefs table.
 func (parser *PdfParser) xrefNextObjectOffset(offset int64) int64 {
 	nextOffset := int64(0)
@@ -1435,33 +1676,24 @@ func (parser *PdfParser) ParseIndirectObject() (PdfObject, error) {
 						return nil, errors.New("Stream needs to be longer than 0")
 					}
 
-					// Validate the stream length based on the cross references.
-					// Find next object with closest offset to current object and calculate
-					// the expected stream length based on that.
 					streamStartOffset := parser.GetFileOffset()
-					nextObjectOffset := parser.xrefNextObjectOffset(streamStartOffset)
-					if streamStartOffset+int64(streamLength) > nextObjectOffset && nextObjectOffset > streamStartOffset {
-						common.Log.Debug("Expected ending at %d", streamStartOffset+int64(streamLength))
-						common.Log.Debug("Next object starting at %d", nextObjectOffset)
-						// endstream + "\n" endobj + "\n" (17)
-						newLength := nextObjectOffset - streamStartOffset - 17
-						if newLength < 0 {
-							return nil, errors.New("Invalid stream length, going past boundaries")
-						}
-
-						common.Log.Debug("Attempting a length correction to %d...", newLength)
-						streamLength = PdfObjectInteger(newLength)
-						dict.Set("Length", MakeInteger(newLength))
+					length, source := parser.findStreamExtent(dict, streamStartOffset, int64(streamLength))
+					if length != int64(streamLength) {
+						common.Log.Debug("Stream length corrected from %d to %d (%s)", streamLength, length, source)
+						dict.Set("Length", MakeInteger(length))
 					}
 
-					// Make sure is less than actual file size.
-					if int64(streamLength) > parser.fileSize {
-						common.Log.Debug("ERROR: Stream length cannot be larger than file size")
-						return nil, errors.New("Invalid stream length, larger than file size")
+					// Check the length before allocating: it can be a crafted huge value or not fit
+					// an int on 32-bit platforms.
+					size, err := ToInt("stream Length", length, 0, parser.streamLengthLimit(streamStartOffset))
+					if err != nil {
+						common.Log.Debug("ERROR: %v", err)
+						return nil, err
 					}
 
-					stream := make([]byte, streamLength)
-					_, err = parser.ReadAtLeast(stream, int(streamLength))
+					parser.SetFileOffset(streamStartOffset)
+					stream := make([]byte, size)
+					_, err = parser.ReadAtLeast(stream, size)
 					if err != nil {
 						common.Log.Debug("ERROR stream (%d): %X", len(stream), stream)
 						common.Log.Debug("ERROR: %v", err)
@@ -1473,6 +1705,9 @@ func (parser *PdfParser) ParseIndirectObject() (PdfObject, error) {
 					streamobj.PdfObjectDictionary = indirect.PdfObject.(*PdfObjectDictionary)
 					streamobj.ObjectNumber = indirect.ObjectNumber
 					streamobj.GenerationNumber = indirect.GenerationNumber
+					streamobj.parser = parser
+					streamobj.decoding = parser.decoding
+					streamobj.lengthSource = source
 
 					parser.skipSpaces()
 					parser.reader.Discard(9) // endstream
@@ -1509,11 +1744,22 @@ func NewParserFromString(txt string) *PdfParser {
 // NewParser creates a new parser for a PDF file via ReadSeeker. Loads the cross reference stream and trailer.
 // An error is returned on failure.
 func NewParser(rs io.ReadSeeker) (*PdfParser, error) {
+	return NewParserWithOpts(rs, nil)
+}
+
+// NewParserWithOpts creates a new parser for a PDF file as NewParser, with options `opts`, which
+// can be nil for the defaults.
+func NewParserWithOpts(rs io.ReadSeeker, opts *ParserOpts) (*PdfParser, error) {
 	parser := &PdfParser{}
+	if opts == nil {
+		opts = &ParserOpts{}
+	}
 
 	parser.rs = rs
 	parser.ObjCache = make(ObjectCache)
 	parser.streamLengthReferenceLookupInProgress = map[int64]bool{}
+	parser.decoding = newStreamDecoding(*opts)
+	parser.tokenLimits = opts.TokenLimits
 
 	// Start by reading the xrefs (from bottom).
 	trailer, err := parser.loadXrefs()
@@ -1599,6 +1845,10 @@ func (parser *PdfParser) IsEncrypted() (bool, error) {
 		crypter.DecryptedObjects[dictIndirect] = true
 	}
 
+	if parser.decoding != nil {
+		crypter.MaxNesting = parser.decoding.opts.CryptMaxNesting
+		crypter.OperationHook = parser.decoding.opts.OperationHook
+	}
 	parser.crypter = &crypter
 	common.Log.Trace("Crypter object %b", crypter)
 	return true, nil
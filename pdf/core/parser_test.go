@@ -9,9 +9,11 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/hex"
-	//"fmt"
+	"fmt"
 	"io"
 	//"os"
+	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/unidoc/unidoc/common"
@@ -335,6 +337,157 @@ func TestNumericParsing3(t *testing.T) {
 	}
 }
 
+// Test lenient parsing of numbers with exponents and leading '+' signs as generated by some
+// producers, and that strict mode rejects the exponential format.
+func TestNumericParsingLenient(t *testing.T) {
+	txt := "<< /W [+12 600 .5 5.] /Matrix [1.0E-5 0 0 -1.5e+2 2E3 +.25] /Name /E >>"
+	parser := makeParserForText(txt)
+	dict, err := parser.ParseDict()
+	if err != nil {
+		t.Fatalf("Error parsing dict: %v", err)
+	}
+
+	expected := []struct {
+		Key   PdfObjectName
+		Index int
+		Obj   PdfObject
+	}{
+		{"W", 0, MakeInteger(12)},
+		{"W", 1, MakeInteger(600)},
+		{"W", 2, MakeFloat(0.5)},
+		{"W", 3, MakeFloat(5)},
+		{"Matrix", 0, MakeFloat(1e-5)},
+		{"Matrix", 3, MakeFloat(-150)},
+		{"Matrix", 4, MakeFloat(2000)},
+		{"Matrix", 5, MakeFloat(0.25)},
+	}
+	for _, exp := range expected {
+		arr, ok := dict.Get(exp.Key).(*PdfObjectArray)
+		if !ok {
+			t.Fatalf("/%s not an array (%v)", exp.Key, dict.Get(exp.Key))
+		}
+		obj := (*arr)[exp.Index]
+		if fmt.Sprintf("%T %s", obj, obj) != fmt.Sprintf("%T %s", exp.Obj, exp.Obj) {
+			t.Errorf("/%s[%d]: %T %s != %T %s", exp.Key, exp.Index, obj, obj, exp.Obj, exp.Obj)
+		}
+	}
+	if name, ok := dict.Get("Name").(*PdfObjectName); !ok || *name != "E" {
+		t.Errorf("Invalid /Name %v", dict.Get("Name"))
+	}
+
+	// Written without exponent.
+	if str := MakeFloat(1e-5).DefaultWriteString(); strings.ContainsAny(str, "eE") {
+		t.Errorf("Float written as %s", str)
+	}
+
+	strict := newStreamDecoding(ParserOpts{StrictNumbers: true})
+	parser = makeParserForText("[+12 .5 5.]")
+	parser.decoding = strict
+	if _, err := parser.parseArray(); err != nil {
+		t.Errorf("Strict mode should accept legal numbers: %v", err)
+	}
+	parser = makeParserForText("[0 1.0E-5]")
+	parser.decoding = strict
+	if _, err := parser.parseArray(); err == nil || !strings.Contains(err.Error(), `"1.0E-5"`) {
+		t.Errorf("Strict mode should reject 1.0E-5 (%v)", err)
+	}
+}
+
+// Test that an unterminated string spanning the rest of a large file fails with ErrTokenTooLarge,
+// or is truncated in lenient mode, after reading up to the string limit without buffering the
+// whole token.
+func TestTokenLimitUnterminatedString(t *testing.T) {
+	data := append([]byte("("), bytes.Repeat([]byte("a"), 16*1024*1024)...)
+
+	for _, truncate := range []bool{false, true} {
+		parser := NewParserFromString("")
+		parser.rs = bytes.NewReader(data)
+		parser.reader = bufio.NewReader(parser.rs)
+		parser.fileSize = int64(len(data))
+		parser.SetTokenLimits(TokenLimits{MaxStringLength: 64 * 1024, Truncate: truncate})
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		str, err := parser.parseString()
+		runtime.ReadMemStats(&after)
+
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 2*1024*1024 {
+			t.Errorf("Truncate=%v: %d bytes allocated", truncate, allocated)
+		}
+		if !truncate {
+			if err != ErrTokenTooLarge {
+				t.Errorf("Expected ErrTokenTooLarge, got %v", err)
+			}
+			continue
+		}
+		if err != nil || len(str) != 64*1024 {
+			t.Errorf("Truncated string length %d (%v)", len(str), err)
+		}
+	}
+}
+
+// Test that the token limits of the parser options apply to the trailer.
+func TestTokenLimitsOption(t *testing.T) {
+	long := strings.Repeat("x", 200)
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offset := buf.Len()
+	buf.WriteString("1 0 obj\n<< /Type /Catalog >>\nendobj\n")
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 2\n0000000000 65535 f\r\n%010d 00000 n\r\n", offset)
+	fmt.Fprintf(&buf, "trailer\n<< /Size 2 /Root 1 0 R /Private (%s) >>\nstartxref\n%d\n%%%%EOF\n", long, xref)
+
+	for _, limit := range []int{0, 100} {
+		opts := &ParserOpts{TokenLimits: TokenLimits{MaxStringLength: limit, Truncate: true}}
+		parser, err := NewParserWithOpts(bytes.NewReader(buf.Bytes()), opts)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		expected := long
+		if limit > 0 {
+			expected = long[:limit]
+		}
+		if str, ok := parser.GetTrailer().Get("Private").(*PdfObjectString); !ok || string(*str) != expected {
+			t.Errorf("Limit %d: Invalid /Private %v", limit, parser.GetTrailer().Get("Private"))
+		}
+	}
+}
+
+// Test the string, hex string and name limits, with truncated tokens resynchronizing at the next
+// delimiter in lenient mode.
+func TestTokenLimits(t *testing.T) {
+	long := strings.Repeat("x", 200)
+	txt := "<< /A (" + long + ") /B <" + strings.Repeat("41", 200) + "> /" + long + " 1 /C 2 >>"
+
+	parser := makeParserForText(txt)
+	parser.SetTokenLimits(TokenLimits{MaxStringLength: 100, MaxNameLength: 50})
+	if _, err := parser.ParseDict(); err != ErrTokenTooLarge {
+		t.Errorf("Expected ErrTokenTooLarge, got %v", err)
+	}
+
+	parser = makeParserForText(txt)
+	parser.SetTokenLimits(TokenLimits{MaxStringLength: 100, MaxNameLength: 50, Truncate: true})
+	dict, err := parser.ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if str, ok := dict.Get("A").(*PdfObjectString); !ok || string(*str) != long[:100] {
+		t.Errorf("Invalid /A %v", dict.Get("A"))
+	}
+	if str, ok := dict.Get("B").(*PdfObjectString); !ok || string(*str) != strings.Repeat("A", 100) {
+		t.Errorf("Invalid /B %v", dict.Get("B"))
+	}
+	if dict.Get(PdfObjectName(long[:50])) == nil || dict.Get("C") == nil {
+		t.Errorf("Invalid dict after truncated name: %s", dict)
+	}
+
+	// Tokens within the default limits are not affected.
+	parser = makeParserForText(txt)
+	if _, err := parser.ParseDict(); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+}
+
 func BenchmarkHexStringParsing(b *testing.B) {
 	var ref bytes.Buffer
 	for i := 0; i < 0xff; i++ {
@@ -500,6 +653,82 @@ func TestStreamParsing(t *testing.T) {
 	// TODO
 }
 
+// Test reading the data of streams with EOL pathologies before the endstream keyword and wrong
+// Length entries: the data must be byte exact, and parsing must resume after the stream object.
+func TestStreamExtent(t *testing.T) {
+	content := "BT /F1 12 Tf (Hello) Tj ET"
+	flate, err := NewFlateEncoder().EncodeBytes([]byte(content))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// Flate data ending with a LF byte, which is not an EOL marker.
+	var flateLF []byte
+	for i := 0; flateLF == nil; i++ {
+		data, err := NewFlateEncoder().EncodeBytes([]byte(fmt.Sprintf("%s %d", content, i)))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if data[len(data)-1] == '\n' {
+			flateLF = data
+		}
+	}
+
+	testcases := []struct {
+		Name     string
+		Filter   string
+		Length   int
+		Stream   string // From the stream keyword on.
+		Expected string
+		Source   StreamLengthSource
+	}{
+		{"CRLF", "", len(content), "stream\r\n" + content + "\r\nendstream\n", content, StreamLengthDeclared},
+		{"No EOL", "", len(content), "stream\n" + content + "endstream\n", content, StreamLengthDeclared},
+		{"Stray white space", "", len(content), "stream\n" + content + " \n \r\nendstream\n", content, StreamLengthDeclared},
+		{"Length too long, CR", "", len(content) + 10, "stream\n" + content + "\rendstream\n", content, StreamLengthScannedUnverified},
+		{"Length too short, LF", "/FlateDecode", len(flate) - 5, "stream\n" + string(flate) + "\nendstream\n", string(flate), StreamLengthScanned},
+		{"Data ending with LF, no EOL", "/FlateDecode", len(flateLF) + 3, "stream\n" + string(flateLF) + "endstream\n", string(flateLF), StreamLengthScanned},
+		{"Length 0, CRLF", "/ASCIIHexDecode", 0, "stream\r\n48656C6C6F>\r\nendstream\n", "48656C6C6F>", StreamLengthScanned},
+	}
+	for _, tcase := range testcases {
+		filter := ""
+		if tcase.Filter != "" {
+			filter = " /Filter " + tcase.Filter
+		}
+		text := fmt.Sprintf("1 0 obj\n<< /Length %d%s >>\n%sendobj\n2 0 obj\n(next)\nendobj\n",
+			tcase.Length, filter, tcase.Stream)
+		parser := makeParserForText(text)
+
+		obj, err := parser.ParseIndirectObject()
+		if err != nil {
+			t.Errorf("%s: Error: %v", tcase.Name, err)
+			continue
+		}
+		stream, ok := obj.(*PdfObjectStream)
+		if !ok {
+			t.Errorf("%s: Not a stream (%T)", tcase.Name, obj)
+			continue
+		}
+		if string(stream.Stream) != tcase.Expected {
+			t.Errorf("%s: Stream data %q, expected %q", tcase.Name, stream.Stream, tcase.Expected)
+		}
+		if source := stream.GetLengthSource(); source != tcase.Source {
+			t.Errorf("%s: Length source %s, expected %s", tcase.Name, source, tcase.Source)
+		}
+		if length, ok := stream.Get("Length").(*PdfObjectInteger); !ok || int(*length) != len(tcase.Expected) {
+			t.Errorf("%s: Length %v", tcase.Name, stream.Get("Length"))
+		}
+
+		obj, err = parser.ParseIndirectObject()
+		if err != nil {
+			t.Errorf("%s: Error parsing the next object: %v", tcase.Name, err)
+			continue
+		}
+		if ind, ok := obj.(*PdfIndirectObject); !ok || ind.ObjectNumber != 2 || ind.PdfObject.String() != "next" {
+			t.Errorf("%s: Invalid next object %v", tcase.Name, obj)
+		}
+	}
+}
+
 func TestIndirectObjParsing1(t *testing.T) {
 	rawText := `1 0 obj
 <<
@@ -594,6 +823,206 @@ endobj`
 	common.Log.Debug("Xref dict: %s", xrefDict)
 }
 
+// Test xref streams with zero width fields, multiple Index subsections, wide offsets and padding.
+func TestXrefStreamWidths(t *testing.T) {
+	makeXrefStream := func(dict, data string) string {
+		return fmt.Sprintf("99 0 obj\n<< /Type /XRef /Filter /ASCIIHexDecode %s /Length %d >>\nstream\n%s>\nendstream\nendobj",
+			dict, len(data)+1, data)
+	}
+
+	testcases := []struct {
+		Name     string
+		Dict     string
+		Data     string
+		Expected map[int]XrefObject
+	}{
+		{
+			"Zero width type and generation fields, no Index",
+			"/Size 3 /W [0 3 0]",
+			"000000 000010 000123",
+			map[int]XrefObject{
+				0: {objectNumber: 0, xtype: XREF_TABLE_ENTRY, offset: 0},
+				1: {objectNumber: 1, xtype: XREF_TABLE_ENTRY, offset: 0x10},
+				2: {objectNumber: 2, xtype: XREF_TABLE_ENTRY, offset: 0x123},
+			},
+		},
+		{
+			"Zero width third field",
+			"/Size 12 /Index [10 2] /W [1 3 0]",
+			"01 0001F4 02 000007",
+			map[int]XrefObject{
+				10: {objectNumber: 10, xtype: XREF_TABLE_ENTRY, offset: 500},
+				11: {objectNumber: 11, xtype: XREF_OBJECT_STREAM, osObjNumber: 7},
+			},
+		},
+		{
+			"Multiple Index subsections",
+			"/Size 31 /Index [0 1 5 2 30 1] /W [2 4 2]",
+			"0000 00000000 FFFF 0001 00000100 0000 0002 0000000C 0003 0001 00001000 0002",
+			map[int]XrefObject{
+				5:  {objectNumber: 5, xtype: XREF_TABLE_ENTRY, offset: 0x100},
+				6:  {objectNumber: 6, xtype: XREF_OBJECT_STREAM, osObjNumber: 12, osObjIndex: 3},
+				30: {objectNumber: 30, xtype: XREF_TABLE_ENTRY, offset: 0x1000, generation: 2},
+			},
+		},
+		{
+			"5 byte offsets beyond 4GB",
+			"/Size 2 /Index [1 1] /W [1 5 1]",
+			"01 0123456789 00",
+			map[int]XrefObject{
+				1: {objectNumber: 1, xtype: XREF_TABLE_ENTRY, offset: 0x0123456789},
+			},
+		},
+		{
+			"Entries padded to the predictor row size",
+			"/Size 2 /W [1 2 1]",
+			"00 0000 FF 01 0020 00 00 00 00 00 00 00",
+			map[int]XrefObject{
+				1: {objectNumber: 1, xtype: XREF_TABLE_ENTRY, offset: 0x20},
+			},
+		},
+	}
+
+	for _, tcase := range testcases {
+		parser := makeParserForText(makeXrefStream(tcase.Dict, tcase.Data))
+		parser.xrefs = make(XrefTable)
+		parser.objstms = make(ObjectStreams)
+		if _, err := parser.parseXrefStream(nil); err != nil {
+			t.Errorf("%s: error %v", tcase.Name, err)
+			continue
+		}
+		if len(parser.xrefs) != len(tcase.Expected) {
+			t.Errorf("%s: %d xrefs, expected %d: %v", tcase.Name, len(parser.xrefs), len(tcase.Expected), parser.xrefs)
+		}
+		for objNum, expected := range tcase.Expected {
+			if xref, has := parser.xrefs[objNum]; !has || xref != expected {
+				t.Errorf("%s: object %d: %+v != %+v", tcase.Name, objNum, xref, expected)
+			}
+		}
+	}
+
+	invalid := map[string][2]string{
+		"Too few entries for Size":  {"/Size 4 /W [1 2 1]", "01 0010 00 01 0020 00"},
+		"Too few entries for Index": {"/Size 20 /Index [0 1 10 3] /W [1 2 1]", "01 0010 00 01 0020 00"},
+		"Negative width":            {"/Size 1 /W [1 -2 1]", "01 0010 00"},
+		"Width over 8 bytes":        {"/Size 1 /W [1 9 1]", "01 000000000000000010 00"},
+	}
+	for name, tcase := range invalid {
+		parser := makeParserForText(makeXrefStream(tcase[0], tcase[1]))
+		parser.xrefs = make(XrefTable)
+		parser.objstms = make(ObjectStreams)
+		if _, err := parser.parseXrefStream(nil); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+// makeDuplicateObjectFile returns a file with two revisions.  The cross-reference table of the first
+// revision has two entries for object 2, the second revision redefines object 3 and frees object 4.
+func makeDuplicateObjectFile() ([]byte, []int) {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	var offsets []int
+	for _, obj := range []string{"1 0 obj\n(one)\nendobj\n", "2 0 obj\n(old)\nendobj\n",
+		"2 0 obj\n(new)\nendobj\n", "3 0 obj\n(three)\nendobj\n", "4 0 obj\n(four)\nendobj\n"} {
+		offsets = append(offsets, buf.Len())
+		buf.WriteString(obj)
+	}
+	xref1 := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 4\n0000000000 65535 f\r\n%010d 00000 n\r\n%010d 00000 n\r\n%010d 00000 n\r\n",
+		offsets[0], offsets[1], offsets[3])
+	fmt.Fprintf(&buf, "2 1\n%010d 00000 n\r\n4 1\n%010d 00000 n\r\n", offsets[2], offsets[4])
+	fmt.Fprintf(&buf, "trailer\n<< /Size 5 >>\nstartxref\n%d\n%%%%EOF\n", xref1)
+
+	offsets = append(offsets, buf.Len())
+	buf.WriteString("3 0 obj\n(three v2)\nendobj\n")
+	xref2 := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 1\n0000000000 65535 f\r\n3 2\n%010d 00000 n\r\n0000000000 00001 f\r\n",
+		offsets[5])
+	fmt.Fprintf(&buf, "trailer\n<< /Size 5 /Prev %d >>\nstartxref\n%d\n%%%%EOF\n", xref1, xref2)
+	return buf.Bytes(), offsets
+}
+
+// Test the resolution of an object number with two entries in a cross-reference section, and the
+// parser statistics.
+func TestDuplicateObjects(t *testing.T) {
+	data, offsets := makeDuplicateObjectFile()
+
+	testcases := []struct {
+		Policy   DuplicateObjectPolicy
+		Expected string
+	}{
+		{DuplicateObjectLaterWins, "new"},
+		{DuplicateObjectEarlierWins, "old"},
+	}
+	for _, tcase := range testcases {
+		parser, err := NewParserWithOpts(bytes.NewReader(data), &ParserOpts{DuplicateObjects: tcase.Policy})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		expected := map[int]string{1: "one", 2: tcase.Expected, 3: "three v2", 4: "four"}
+		for objNum, str := range expected {
+			obj, err := parser.LookupByNumber(objNum)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if s, ok := TraceToDirectObject(obj).(*PdfObjectString); !ok || s.String() != str {
+				t.Errorf("Object %d: %v, expected %q", objNum, obj, str)
+			}
+		}
+
+		errs := parser.LoadErrors()
+		if len(errs) != 1 {
+			t.Fatalf("Load errors %v, expected 1", errs)
+		}
+		for _, offset := range offsets[1:3] {
+			if !strings.Contains(errs[0].Error(), fmt.Sprintf("offset %d ", offset)) {
+				t.Errorf("Offset %d missing from %q", offset, errs[0])
+			}
+		}
+
+		stats := parser.GetStats()
+		expectedStats := ParserStats{Objects: 4, Duplicates: 1, FreeEntries: 0, FreeListOnly: 1}
+		if stats != expectedStats {
+			t.Errorf("Stats %+v, expected %+v", stats, expectedStats)
+		}
+	}
+}
+
+// Test that the duplicate object policy of a rebuilt cross-reference table only applies within a
+// revision: the definitions of later revisions always take precedence.
+func TestRepairDuplicateObjects(t *testing.T) {
+	rawText := "1 0 obj\n(a)\nendobj\n1 0 obj\n(b)\nendobj\n%%EOF\n" +
+		"1 0 obj\n(c)\nendobj\n2 0 obj\n(d)\nendobj\n2 0 obj\n(e)\nendobj\n%%EOF\n"
+	testcases := []struct {
+		Policy   DuplicateObjectPolicy
+		Expected map[int]string
+	}{
+		{DuplicateObjectLaterWins, map[int]string{1: "c", 2: "e"}},
+		{DuplicateObjectEarlierWins, map[int]string{1: "c", 2: "d"}},
+	}
+	for _, tcase := range testcases {
+		parser := PdfParser{}
+		parser.rs, parser.reader, parser.fileSize = makeReaderForText(rawText)
+		parser.decoding = newStreamDecoding(ParserOpts{DuplicateObjects: tcase.Policy})
+		xrefs, err := parser.repairRebuildXrefsTopDown()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		for objNum, str := range tcase.Expected {
+			xref, ok := (*xrefs)[objNum]
+			if !ok {
+				t.Fatalf("Policy %d: object %d missing", tcase.Policy, objNum)
+			}
+			expected := strings.Index(rawText, "("+str+")") - len("1 0 obj\n")
+			if xref.offset != int64(expected) {
+				t.Errorf("Policy %d: object %d at offset %d, expected %d", tcase.Policy, objNum,
+					xref.offset, expected)
+			}
+		}
+	}
+}
+
 func TestObjectParse(t *testing.T) {
 	parser := PdfParser{}
 
@@ -8,6 +8,9 @@ package core
 import (
 	"bytes"
 	"fmt"
+	"math"
+	"strconv"
+	"sync/atomic"
 
 	"github.com/unidoc/unidoc/common"
 )
@@ -28,6 +31,7 @@ type PdfObjectBool bool
 type PdfObjectInteger int64
 
 // PdfObjectFloat represents the primitive PDF floating point numerical object.
+// TODO (v3): Change to a struct and keep the token of parsed numbers for exact round trips.
 type PdfObjectFloat float64
 
 // PdfObjectString represents the primitive PDF string object.
@@ -41,9 +45,21 @@ type PdfObjectName string
 type PdfObjectArray []PdfObject
 
 // PdfObjectDictionary represents the primitive PDF dictionary/map object.
+// The key order is preserved.  Get, Set and Remove are O(1) (amortized), so that huge dictionaries
+// (e.g. name tree nodes) scale.
 type PdfObjectDictionary struct {
 	dict map[PdfObjectName]PdfObject
 	keys []PdfObjectName
+
+	// Position of each key in keys.  Entries in keys whose position does not match are stale
+	// (removed keys), and are dropped when compacting.
+	index map[PdfObjectName]int
+	stale int
+	// The key list without the stale entries ([]PdfObjectName), built by Keys and reset when keys
+	// are added or removed.  Atomic so that concurrent readers can build it.
+	live atomic.Value
+	// Number of modifications with Set and Remove.
+	changes uint64
 }
 
 // PdfObjectNull represents the primitive PDF null object.
@@ -66,6 +82,19 @@ type PdfObjectStream struct {
 	PdfObjectReference
 	*PdfObjectDictionary
 	Stream []byte
+
+	// Decoding options and decoded data cache of the parser that loaded the stream.
+	decoding *streamDecoding
+	// Data allocated by MutableStream for the stream, modifiable in place while Stream is still this
+	// data and it has not been shared by DeepCopy since.
+	ownStream []byte
+	// Set if Stream is still encrypted, for streams loaded with ReadOnlyDecryption (ParserOpts).
+	encrypted *encryptedStream
+
+	// Parser that loaded the stream, for resolving references in the stream dictionary.
+	parser *PdfParser
+	// How the extent of the stream data was determined by the parser.
+	lengthSource StreamLengthSource
 }
 
 // MakeDict creates and returns an empty PdfObjectDictionary.
@@ -73,6 +102,7 @@ func MakeDict() *PdfObjectDictionary {
 	d := &PdfObjectDictionary{}
 	d.dict = map[PdfObjectName]PdfObject{}
 	d.keys = []PdfObjectName{}
+	d.index = map[PdfObjectName]int{}
 	return d
 }
 
@@ -159,7 +189,8 @@ func MakeIndirectObject(obj PdfObject) *PdfIndirectObject {
 }
 
 // MakeStream creates an PdfObjectStream with specified contents and encoding. If encoding is nil, then raw encoding
-// will be used (i.e. no encoding applied).
+// will be used (i.e. no encoding applied).  The stream dictionary has the filter and decode parameters of the
+// encoder and the Length of the encoded data, so that the stream is ready to be written or decoded.
 func MakeStream(contents []byte, encoder StreamEncoder) (*PdfObjectStream, error) {
 	stream := &PdfObjectStream{}
 
@@ -209,9 +240,81 @@ func (float *PdfObjectFloat) String() string {
 	return fmt.Sprintf("%f", *float)
 }
 
-// DefaultWriteString outputs the object as it is to be written to file.
+// DefaultWriteString outputs the object as it is to be written to file.  The value is written with
+// the fewest digits that read back as the same value (see FormatFloat).
 func (float *PdfObjectFloat) DefaultWriteString() string {
-	return fmt.Sprintf("%f", *float)
+	return FormatFloat(float64(*float), 0)
+}
+
+// FormatFloat returns the PDF representation of the real `val`, rounded to `digits` significant
+// digits.  With `digits` 0 the value is not rounded and is written with the fewest digits that
+// read back as the same value, so that parsed values are kept exactly.  Trailing zeros are dropped
+// and exponential notation, which PDF does not allow (7.3.3), is never used.
+func FormatFloat(val float64, digits int) string {
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		common.Log.Debug("ERROR: Invalid real %v - writing 0", val)
+		return "0"
+	}
+	if digits > 0 {
+		rounded, err := strconv.ParseFloat(strconv.FormatFloat(val, 'e', digits-1, 64), 64)
+		if err == nil {
+			val = rounded
+		}
+	}
+	if val == 0 {
+		// Also for -0.
+		return "0"
+	}
+	return strconv.FormatFloat(val, 'f', -1, 64)
+}
+
+// RoundFloats returns `obj` with its reals rounded to `digits` significant digits (see
+// FormatFloat).  The arrays and dictionaries containing reals are copied rather than modified.
+// Indirect and stream objects referred to are kept as they are.
+func RoundFloats(obj PdfObject, digits int) PdfObject {
+	if digits <= 0 {
+		return obj
+	}
+	switch t := obj.(type) {
+	case *PdfObjectFloat:
+		rounded, err := strconv.ParseFloat(FormatFloat(float64(*t), digits), 64)
+		if err != nil || rounded == float64(*t) {
+			return obj
+		}
+		return MakeFloat(rounded)
+	case *PdfObjectArray:
+		var arr *PdfObjectArray
+		for i, item := range *t {
+			if rounded := RoundFloats(item, digits); rounded != item {
+				if arr == nil {
+					arr = &PdfObjectArray{}
+					*arr = append(*arr, (*t)...)
+				}
+				(*arr)[i] = rounded
+			}
+		}
+		if arr == nil {
+			return obj
+		}
+		return arr
+	case *PdfObjectDictionary:
+		var dict *PdfObjectDictionary
+		for _, key := range t.Keys() {
+			item := t.Get(key)
+			if rounded := RoundFloats(item, digits); rounded != item {
+				if dict == nil {
+					dict = MakeDict()
+					dict.Merge(t)
+				}
+				dict.Set(key, rounded)
+			}
+		}
+		if dict == nil {
+			return obj
+		}
+		return dict
+	}
+	return obj
 }
 
 func (str *PdfObjectString) String() string {
@@ -291,13 +394,18 @@ func (array *PdfObjectArray) ToFloat64Array() ([]float64, error) {
 }
 
 // ToIntegerArray returns a slice of all array elements as an int slice. An error is returned if the array contains
-// non-integer objects. Each element can only be PdfObjectInteger.
+// non-integer objects, or integers which do not fit an int on the platform (*IntRangeError). Each element can only
+// be PdfObjectInteger.
 func (array *PdfObjectArray) ToIntegerArray() ([]int, error) {
 	vals := []int{}
 
 	for _, obj := range *array {
 		if number, is := obj.(*PdfObjectInteger); is {
-			vals = append(vals, int(*number))
+			val, err := ToInt("array element", int64(*number), -MaxInt-1, MaxInt)
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, val)
 		} else {
 			return nil, fmt.Errorf("Type error")
 		}
@@ -377,7 +485,7 @@ func (d *PdfObjectDictionary) Merge(another *PdfObjectDictionary) {
 
 func (d *PdfObjectDictionary) String() string {
 	outStr := "Dict("
-	for _, k := range d.keys {
+	for _, k := range d.Keys() {
 		v := d.dict[k]
 		outStr += fmt.Sprintf("\"%s\": %s, ", k, v.String())
 	}
@@ -388,7 +496,7 @@ func (d *PdfObjectDictionary) String() string {
 // DefaultWriteString outputs the object as it is to be written to file.
 func (d *PdfObjectDictionary) DefaultWriteString() string {
 	outStr := "<<"
-	for _, k := range d.keys {
+	for _, k := range d.Keys() {
 		v := d.dict[k]
 		common.Log.Trace("Writing k: %s %T %v %v", k, v, k, v)
 		outStr += k.DefaultWriteString()
@@ -401,19 +509,20 @@ func (d *PdfObjectDictionary) DefaultWriteString() string {
 
 // Set sets the dictionary's key -> val mapping entry. Overwrites if key already set.
 func (d *PdfObjectDictionary) Set(key PdfObjectName, val PdfObject) {
-	found := false
-	for _, k := range d.keys {
-		if k == key {
-			found = true
-			break
-		}
+	if d.index == nil {
+		d.buildIndex()
 	}
 
-	if !found {
+	if _, found := d.dict[key]; !found {
+		d.index[key] = len(d.keys)
 		d.keys = append(d.keys, key)
+		if d.stale > 0 {
+			d.live.Store([]PdfObjectName(nil))
+		}
 	}
 
 	d.dict[key] = val
+	d.changes++
 }
 
 // Get returns the PdfObject corresponding to the specified key.
@@ -431,25 +540,76 @@ func (d *PdfObjectDictionary) Get(key PdfObjectName) PdfObject {
 	return val
 }
 
-// Keys returns the list of keys in the dictionary.
+// Keys returns the list of keys in the dictionary, in order.
+// The returned slice may be shared with the dictionary and must not be modified by the caller
+// (make a copy for sorting etc).  Remains valid when the dictionary is modified during iteration.
+// Can be called concurrently as long as the dictionary is not modified.
 func (d *PdfObjectDictionary) Keys() []PdfObjectName {
-	return d.keys
+	if d.stale == 0 {
+		return d.keys
+	}
+	if keys, _ := d.live.Load().([]PdfObjectName); keys != nil {
+		return keys
+	}
+	keys := make([]PdfObjectName, 0, len(d.keys)-d.stale)
+	for i, k := range d.keys {
+		if pos, has := d.index[k]; has && pos == i {
+			keys = append(keys, k)
+		}
+	}
+	d.live.Store(keys)
+	return keys
+}
+
+// ChangeCount returns the number of times the dictionary has been modified with Set or Remove
+// (including Merge and SetIfNotNil).  Values derived from the dictionary can be cached while the
+// count is unchanged.  Modifications of the objects it contains are not counted.
+func (d *PdfObjectDictionary) ChangeCount() uint64 {
+	return d.changes
 }
 
 // Remove removes an element specified by key.
 func (d *PdfObjectDictionary) Remove(key PdfObjectName) {
-	idx := -1
+	if _, found := d.dict[key]; !found {
+		return
+	}
+	if d.index == nil {
+		d.buildIndex()
+	}
+
+	// Leave a stale entry in the key list, compacted once stale entries make up half of it.
+	delete(d.dict, key)
+	delete(d.index, key)
+	d.stale++
+	d.live.Store([]PdfObjectName(nil))
+	d.changes++
+	if d.stale > len(d.keys)/2 {
+		d.compact()
+	}
+}
+
+// compact drops the stale entries from the key list.  Makes a new list, leaving any previously
+// returned key lists unchanged.
+func (d *PdfObjectDictionary) compact() {
+	keys := make([]PdfObjectName, 0, len(d.keys)-d.stale)
 	for i, k := range d.keys {
-		if k == key {
-			idx = i
-			break
+		if pos, has := d.index[k]; has && pos == i {
+			d.index[k] = len(keys)
+			keys = append(keys, k)
 		}
 	}
+	d.keys = keys
+	d.stale = 0
+}
 
-	if idx >= 0 {
-		// Found. Remove from key list and map.
-		d.keys = append(d.keys[:idx], d.keys[idx+1:]...)
-		delete(d.dict, key)
+// buildIndex builds the key position index (for dictionaries not made by MakeDict).
+func (d *PdfObjectDictionary) buildIndex() {
+	if d.dict == nil {
+		d.dict = map[PdfObjectName]PdfObject{}
+	}
+	d.index = make(map[PdfObjectName]int, len(d.keys))
+	for i, k := range d.keys {
+		d.index[k] = i
 	}
 }
 
@@ -528,7 +688,7 @@ func (ind *PdfIndirectObject) String() string {
 
 // DefaultWriteString outputs the object as it is to be written to file.
 func (ind *PdfIndirectObject) DefaultWriteString() string {
-	outStr := fmt.Sprintf("%d 0 R", (*ind).ObjectNumber)
+	outStr := fmt.Sprintf("%d %d R", (*ind).ObjectNumber, (*ind).GenerationNumber)
 	return outStr
 }
 
@@ -538,7 +698,7 @@ func (stream *PdfObjectStream) String() string {
 
 // DefaultWriteString outputs the object as it is to be written to file.
 func (stream *PdfObjectStream) DefaultWriteString() string {
-	outStr := fmt.Sprintf("%d 0 R", (*stream).ObjectNumber)
+	outStr := fmt.Sprintf("%d %d R", (*stream).ObjectNumber, (*stream).GenerationNumber)
 	return outStr
 }
 
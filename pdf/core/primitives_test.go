@@ -0,0 +1,193 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package core
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+)
+
+func TestDictionaryKeyOrder(t *testing.T) {
+	d := MakeDict()
+	d.Set("A", MakeInteger(1))
+	d.Set("B", MakeInteger(2))
+	d.Set("C", MakeInteger(3))
+	d.Set("B", MakeInteger(4)) // Overwrite keeps position.
+
+	if s := d.DefaultWriteString(); s != "<</A 1/B 4/C 3>>" {
+		t.Errorf("Incorrect output: %s", s)
+	}
+
+	keys := d.Keys()
+	changes := d.ChangeCount()
+	d.Remove("A")
+	d.Remove("X") // Not present.
+	d.Set("A", MakeInteger(5))
+	if d.ChangeCount() != changes+2 {
+		t.Errorf("Change count %d != %d", d.ChangeCount(), changes+2)
+	}
+	if s := d.DefaultWriteString(); s != "<</B 4/C 3/A 5>>" {
+		t.Errorf("Incorrect output after remove/set: %s", s)
+	}
+
+	// Previously returned key list is unaffected by the changes.
+	if len(keys) != 3 || keys[0] != "A" || keys[1] != "B" || keys[2] != "C" {
+		t.Errorf("Previously returned keys modified: %v", keys)
+	}
+
+	keys = d.Keys()
+	if len(keys) != 3 || keys[0] != "B" || keys[1] != "C" || keys[2] != "A" {
+		t.Errorf("Incorrect keys: %v", keys)
+	}
+	// The key list is cached until keys are added or removed.
+	if again := d.Keys(); &again[0] != &keys[0] {
+		t.Errorf("Key list not cached")
+	}
+	d.Set("D", MakeInteger(6))
+	if keys = d.Keys(); len(keys) != 4 || keys[3] != "D" {
+		t.Errorf("Incorrect keys after set: %v", keys)
+	}
+
+	// Removing while iterating.
+	for _, k := range d.Keys() {
+		d.Remove(k)
+	}
+	if len(d.Keys()) != 0 || d.Get("B") != nil {
+		t.Errorf("Dictionary not empty: %s", d)
+	}
+
+	// Zero-value dictionary.
+	d = &PdfObjectDictionary{}
+	d.Set("A", MakeNull())
+	d.Remove("A")
+	if len(d.Keys()) != 0 {
+		t.Errorf("Dictionary not empty: %s", d)
+	}
+}
+
+// Test that reading a dictionary with removed keys does not modify it, so that it can be read
+// concurrently.  Run with -race.
+func TestDictionaryConcurrentKeys(t *testing.T) {
+	d := MakeDict()
+	for _, k := range makeDictKeys(10) {
+		d.Set(k, MakeInteger(1))
+	}
+	d.Remove("K3")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if keys := d.Keys(); len(keys) != 9 || keys[3] != "K4" {
+				t.Errorf("Incorrect keys: %v", keys)
+			}
+			d.DefaultWriteString()
+		}()
+	}
+	wg.Wait()
+	if d.stale != 1 {
+		t.Errorf("Dictionary compacted by reading")
+	}
+}
+
+func makeDictKeys(n int) []PdfObjectName {
+	keys := make([]PdfObjectName, n)
+	for i := range keys {
+		keys[i] = PdfObjectName(fmt.Sprintf("K%d", i))
+	}
+	return keys
+}
+
+// Set, Get and Remove on a dictionary with 100k keys.
+func BenchmarkDictionary100k(b *testing.B) {
+	keys := makeDictKeys(100000)
+	val := MakeInteger(1)
+
+	for i := 0; i < b.N; i++ {
+		d := MakeDict()
+		for _, k := range keys {
+			d.Set(k, val)
+		}
+		for _, k := range keys {
+			if d.Get(k) == nil {
+				b.Fatalf("Key missing: %s", k)
+			}
+		}
+		for _, k := range keys[:len(keys)/2] {
+			d.Remove(k)
+		}
+		if len(d.Keys()) != len(keys)/2 {
+			b.Fatalf("Incorrect number of keys")
+		}
+	}
+}
+
+// Test the formatting of written reals with and without rounding.
+func TestFormatFloat(t *testing.T) {
+	testcases := []struct {
+		Digits   int
+		Val      float64
+		Expected string
+	}{
+		{6, 0.1, "0.1"},
+		{6, 1, "1"},
+		{6, -2.5, "-2.5"},
+		{6, math.Copysign(0, -1), "0"},
+		{6, 1.0 / 3, "0.333333"},
+		{6, 612.0000001, "612"},
+		{6, 123456789, "123457000"},
+		{6, 1.23456789e-7, "0.000000123457"},
+		{6, 1e21, "1000000000000000000000"},
+		{6, math.NaN(), "0"},
+		{6, math.Inf(1), "0"},
+		{3, 0.70710678, "0.707"},
+		{3, 9999.5, "10000"},
+		{0, 1.0 / 3, "0.3333333333333333"},
+		{0, 0.70710678, "0.70710678"},
+		{0, 1234567.5, "1234567.5"},
+		{0, 1.23456789e-7, "0.000000123456789"},
+	}
+	for _, tcase := range testcases {
+		if s := FormatFloat(tcase.Val, tcase.Digits); s != tcase.Expected {
+			t.Errorf("%v (%d digits): %q != %q", tcase.Val, tcase.Digits, s, tcase.Expected)
+		}
+	}
+
+	// Parsed reals are written back exactly.
+	for _, token := range []string{"1234567.5", "0.70710678", "-0.000123456789", "612"} {
+		obj, err := NewParserFromString(token).parseObject()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if s := obj.DefaultWriteString(); s != token {
+			t.Errorf("%s written as %s", token, s)
+		}
+	}
+}
+
+// Test rounding the reals of objects without modifying them.
+func TestRoundFloats(t *testing.T) {
+	inner := MakeArray(MakeFloat(0.70710678), MakeInteger(1))
+	dict := MakeDict()
+	dict.Set("Matrix", inner)
+	dict.Set("Name", MakeName("N"))
+
+	rounded := RoundFloats(dict, 3)
+	if s := rounded.DefaultWriteString(); s != "<</Matrix [0.707 1]/Name /N>>" {
+		t.Errorf("Rounded %s", s)
+	}
+	if s := dict.DefaultWriteString(); s != "<</Matrix [0.70710678 1]/Name /N>>" {
+		t.Errorf("Source modified: %s", s)
+	}
+	plain := MakeDict()
+	plain.Set("Size", MakeInteger(1))
+	if RoundFloats(dict, 0) != dict || RoundFloats(plain, 3) != plain {
+		t.Errorf("Objects without rounding should be returned as they are")
+	}
+}
@@ -8,6 +8,7 @@
 package core
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
@@ -113,6 +114,10 @@ func (parser *PdfParser) repairRebuildXrefsTopDown() (*XrefTable, error) {
 	last := make([]byte, bufLen)
 
 	xrefTable := XrefTable{}
+	// The revision of the file, counted by %%EOF markers, and the revision of each entry.
+	revision := 0
+	revisions := map[int]int{}
+	policy := parser.duplicateObjectPolicy()
 	for {
 		b, err := parser.reader.ReadByte()
 		if err != nil {
@@ -123,6 +128,10 @@ func (parser *PdfParser) repairRebuildXrefsTopDown() (*XrefTable, error) {
 			}
 		}
 
+		if b == 'F' && string(last[bufLen-4:]) == "%%EO" {
+			revision++
+		}
+
 		// Format:
 		// object number - whitespace - generation number - obj
 		// e.g. "12 0 obj"
@@ -167,7 +176,13 @@ func (parser *PdfParser) repairRebuildXrefsTopDown() (*XrefTable, error) {
 			}
 
 			// Create and insert the XREF entry if not existing, or the generation number is higher.
-			if curXref, has := xrefTable[objNum]; !has || curXref.generation < genNum {
+			// For the same generation number, the definition from a later revision is used, as is
+			// a later definition within a revision unless the duplicate object policy is
+			// DuplicateObjectEarlierWins.
+			curXref, has := xrefTable[objNum]
+			later := curXref.generation == genNum &&
+				(policy == DuplicateObjectLaterWins || revisions[objNum] < revision)
+			if !has || curXref.generation < genNum || later {
 				// Make the entry for the cross ref table.
 				xrefEntry := XrefObject{}
 				xrefEntry.xtype = XREF_TABLE_ENTRY
@@ -175,6 +190,7 @@ func (parser *PdfParser) repairRebuildXrefsTopDown() (*XrefTable, error) {
 				xrefEntry.generation = int(genNum)
 				xrefEntry.offset = objOffset
 				xrefTable[objNum] = xrefEntry
+				revisions[objNum] = revision
 			}
 		}
 
@@ -284,3 +300,108 @@ func (parser *PdfParser) seekPdfVersionTopDown() (int, int, error) {
 
 	return 0, 0, errors.New("Version not found")
 }
+
+// maxEndstreamCandidates limits the endstream keywords considered when scanning for the end of a
+// stream, as binary stream data can contain the keyword.
+const maxEndstreamCandidates = 8
+
+// findStreamExtent returns the length of the data of the stream with dictionary `dict` starting
+// at `offset`, and how it was determined.  The declared `length` is trusted if it is followed by
+// the endstream keyword, allowing for white space such as an EOL marker.  Otherwise the data is
+// assumed to end at an endstream keyword found by scanning: for each keyword, the data without the
+// EOL marker preceding it and then with it are checked against the outermost filter, and the first
+// candidate that passes is chosen.  If none passes, the first keyword is used without the EOL.
+// Keywords beyond the stream length limit (streamLengthLimit) are not considered, and the declared
+// length is returned if there are none, for the caller to reject it before allocating the data.
+func (parser *PdfParser) findStreamExtent(dict *PdfObjectDictionary, offset int64, length int64) (int64, StreamLengthSource) {
+	// Compare the length to the limit, as a crafted length can overflow offset+length.
+	limit := parser.streamLengthLimit(offset)
+	end := offset + length
+	nextObjectOffset := parser.xrefNextObjectOffset(offset)
+	if length <= limit && (nextObjectOffset <= offset || end <= nextObjectOffset) && parser.isEndstreamAt(end) {
+		return length, StreamLengthDeclared
+	}
+	common.Log.Debug("Stream at %d: Length %d not followed by endstream - scanning", offset, length)
+
+	candidates := parser.scanForKeyword(offset, []byte("endstream"), maxEndstreamCandidates)
+	if len(candidates) == 0 {
+		common.Log.Debug("ERROR: endstream not found - using Length")
+		return length, StreamLengthDeclared
+	}
+	// Encrypted data cannot be checked against the filters before it is decrypted.
+	checkable := parser.crypter == nil
+
+	var fallback int64 = -1
+	for _, keyword := range candidates {
+		if keyword-offset > limit {
+			break
+		}
+		data := make([]byte, keyword-offset)
+		parser.SetFileOffset(offset)
+		if _, err := io.ReadFull(parser.reader, data); err != nil {
+			break
+		}
+		trimmed := bytes.TrimSuffix(data, []byte("\n"))
+		if len(trimmed) == len(data) {
+			trimmed = bytes.TrimSuffix(data, []byte("\r"))
+		} else {
+			trimmed = bytes.TrimSuffix(trimmed, []byte("\r"))
+		}
+		if fallback < 0 {
+			fallback = int64(len(trimmed))
+		}
+		if !checkable {
+			break
+		}
+		for _, candidate := range [][]byte{trimmed, data} {
+			ok, checked := checkStreamData(dict, candidate)
+			if !checked {
+				return int64(len(trimmed)), StreamLengthScannedUnverified
+			}
+			if ok {
+				return int64(len(candidate)), StreamLengthScanned
+			}
+		}
+	}
+	if fallback < 0 {
+		common.Log.Debug("ERROR: No endstream within the stream length limit - using Length")
+		return length, StreamLengthDeclared
+	}
+	return fallback, StreamLengthScannedUnverified
+}
+
+// isEndstreamAt returns true if the endstream keyword follows `offset`, after optional white space.
+func (parser *PdfParser) isEndstreamAt(offset int64) bool {
+	parser.SetFileOffset(offset)
+	bb, _ := parser.reader.Peek(64)
+	i := 0
+	for i < len(bb) && IsWhiteSpace(bb[i]) {
+		i++
+	}
+	return bytes.HasPrefix(bb[i:], []byte("endstream"))
+}
+
+// scanForKeyword returns the offsets of the first `max` occurrences of `keyword` from `offset` on.
+func (parser *PdfParser) scanForKeyword(offset int64, keyword []byte, max int) []int64 {
+	var found []int64
+	chunk := make([]byte, 4096)
+	for offset < parser.fileSize && len(found) < max {
+		parser.SetFileOffset(offset)
+		n, err := io.ReadFull(parser.reader, chunk)
+		data := chunk[:n]
+		for i := 0; len(found) < max; {
+			idx := bytes.Index(data[i:], keyword)
+			if idx < 0 {
+				break
+			}
+			found = append(found, offset+int64(i+idx))
+			i += idx + len(keyword)
+		}
+		if err != nil || n < len(keyword) {
+			break
+		}
+		// Overlap the chunks so that keywords across chunk boundaries are found once.
+		offset += int64(n - len(keyword) + 1)
+	}
+	return found
+}
@@ -6,11 +6,102 @@
 package core
 
 import (
+	"bytes"
+	"compress/zlib"
 	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
 
 	"github.com/unidoc/unidoc/common"
 )
 
+// streamDecoding holds the decoding options and the decoded data cache of the streams loaded by a
+// parser (see ParserOpts), which refer to it.  Streams created in memory have none and are decoded
+// with the default options, without caching.
+type streamDecoding struct {
+	opts ParserOpts
+
+	lock  sync.Mutex
+	cache map[int64]decodedStream // Decoded data by object number.
+}
+
+// newStreamDecoding returns the stream decoding of the parser options `opts`.
+func newStreamDecoding(opts ParserOpts) *streamDecoding {
+	return &streamDecoding{opts: opts}
+}
+
+// decodingOpts returns the options for decoding `streamObj`: those of the parser that loaded it,
+// or the defaults.
+func decodingOpts(streamObj *PdfObjectStream) ParserOpts {
+	if streamObj.decoding == nil {
+		return ParserOpts{}
+	}
+	return streamObj.decoding.opts
+}
+
+// decodedStream is the decoded data of a stream, along with the state of the stream it was decoded
+// from: the encoded data and the Filter and DecodeParms entries.
+type decodedStream struct {
+	stream      *PdfObjectStream
+	data        []byte
+	filter      PdfObject
+	decodeParms PdfObject
+	decoded     []byte
+}
+
+// matches returns true if the cached data was decoded from `streamObj` in its current state.  The
+// encoded data is compared by position and length only: data modified in place must be modified
+// through MutableStream, which invalidates the cached data.
+func (cached decodedStream) matches(streamObj *PdfObjectStream) bool {
+	if cached.stream != streamObj || len(cached.data) != len(streamObj.Stream) {
+		return false
+	}
+	if len(cached.data) > 0 && &cached.data[0] != &streamObj.Stream[0] {
+		return false
+	}
+	return cached.filter == streamObj.Get("Filter") && cached.decodeParms == streamObj.Get("DecodeParms")
+}
+
+// get returns a copy of the cached decoded data of `streamObj`, if decoded from its current state.
+func (decoding *streamDecoding) get(streamObj *PdfObjectStream) ([]byte, bool) {
+	decoding.lock.Lock()
+	defer decoding.lock.Unlock()
+
+	cached, has := decoding.cache[streamObj.ObjectNumber]
+	if !has || !cached.matches(streamObj) {
+		return nil, false
+	}
+	return append([]byte(nil), cached.decoded...), true
+}
+
+// set caches a copy of the data `decoded` from `streamObj` in its current state.
+func (decoding *streamDecoding) set(streamObj *PdfObjectStream, decoded []byte) {
+	decoding.lock.Lock()
+	defer decoding.lock.Unlock()
+
+	if decoding.cache == nil {
+		decoding.cache = map[int64]decodedStream{}
+	}
+	decoding.cache[streamObj.ObjectNumber] = decodedStream{
+		stream:      streamObj,
+		data:        streamObj.Stream,
+		filter:      streamObj.Get("Filter"),
+		decodeParms: streamObj.Get("DecodeParms"),
+		decoded:     append([]byte(nil), decoded...),
+	}
+}
+
+// invalidate drops the cached decoded data of `streamObj`.
+func (decoding *streamDecoding) invalidate(streamObj *PdfObjectStream) {
+	decoding.lock.Lock()
+	defer decoding.lock.Unlock()
+
+	if cached, has := decoding.cache[streamObj.ObjectNumber]; has && cached.stream == streamObj {
+		delete(decoding.cache, streamObj.ObjectNumber)
+	}
+}
+
 // NewEncoderFromStream creates a StreamEncoder based on the stream's dictionary.
 func NewEncoderFromStream(streamObj *PdfObjectStream) (StreamEncoder, error) {
 	filterObj := TraceToDirectObject(streamObj.PdfObjectDictionary.Get("Filter"))
@@ -60,11 +151,11 @@ func NewEncoderFromStream(streamObj *PdfObjectStream) (StreamEncoder, error) {
 	} else if *method == StreamEncodingFilterNameLZW {
 		return newLZWEncoderFromStream(streamObj, nil)
 	} else if *method == StreamEncodingFilterNameDCT {
-		return newDCTEncoderFromStream(streamObj, nil)
+		return newDCTEncoderFromStream(streamObj, nil, nil)
 	} else if *method == StreamEncodingFilterNameRunLength {
 		return newRunLengthEncoderFromStream(streamObj, nil)
 	} else if *method == StreamEncodingFilterNameASCIIHex {
-		return NewASCIIHexEncoder(), nil
+		return newASCIIHexEncoderFromStream(streamObj), nil
 	} else if *method == StreamEncodingFilterNameASCII85 || *method == "A85" {
 		return NewASCII85Encoder(), nil
 	} else if *method == StreamEncodingFilterNameCCITTFax {
@@ -79,29 +170,234 @@ func NewEncoderFromStream(streamObj *PdfObjectStream) (StreamEncoder, error) {
 	}
 }
 
+// decodableFilters are the filters decoded by the encoders of NewEncoderFromStream for a single
+// filter, and multiDecodableFilters those supported in a filter array of several filters.
+var (
+	decodableFilters = map[PdfObjectName]bool{
+		StreamEncodingFilterNameFlate:     true,
+		StreamEncodingFilterNameLZW:       true,
+		StreamEncodingFilterNameDCT:       true,
+		StreamEncodingFilterNameRunLength: true,
+		StreamEncodingFilterNameASCIIHex:  true,
+		StreamEncodingFilterNameASCII85:   true,
+		"A85":                             true,
+	}
+	multiDecodableFilters = map[PdfObjectName]bool{
+		StreamEncodingFilterNameFlate:    true,
+		StreamEncodingFilterNameLZW:      true,
+		StreamEncodingFilterNameDCT:      true,
+		StreamEncodingFilterNameASCIIHex: true,
+		StreamEncodingFilterNameASCII85:  true,
+	}
+)
+
+// IsDecodable returns whether the data of stream `streamObj` can be decoded with DecodeStream, that
+// is whether all its filters are implemented, and the names of the filters that are not, e.g.
+// JBIG2Decode, CCITTFaxDecode, JPXDecode or Crypt.  This allows skipping or flagging such streams
+// up front, rather than failing with ErrNoJBIG2Decode etc. when decoding them.
+// A Filter entry of an invalid type is not decodable, with no filter names returned.
+func IsDecodable(streamObj *PdfObjectStream) (bool, []string) {
+	if streamObj.PdfObjectDictionary == nil {
+		return true, nil
+	}
+
+	var filters PdfObjectArray
+	switch t := TraceToDirectObject(streamObj.PdfObjectDictionary.Get("Filter")).(type) {
+	case nil, *PdfObjectNull:
+		return true, nil
+	case *PdfObjectName:
+		filters = PdfObjectArray{t}
+	case *PdfObjectArray:
+		filters = *t
+	default:
+		common.Log.Debug("Filter not a Name or Array object (%T)", t)
+		return false, nil
+	}
+
+	supported := decodableFilters
+	if len(filters) > 1 {
+		supported = multiDecodableFilters
+	}
+	decodable := true
+	var unsupported []string
+	listed := map[PdfObjectName]bool{}
+	for _, obj := range filters {
+		name, ok := obj.(*PdfObjectName)
+		if !ok {
+			common.Log.Debug("Filter array member not a Name object (%T)", obj)
+			decodable = false
+			continue
+		}
+		if supported[*name] {
+			continue
+		}
+		decodable = false
+		if !listed[*name] {
+			listed[*name] = true
+			unsupported = append(unsupported, string(*name))
+		}
+	}
+	return decodable, unsupported
+}
+
 // DecodeStream decodes the stream data and returns the decoded data.
 // An error is returned upon failure.
+// If decode caching is enabled for the parser that loaded the stream (ParserOpts), the decoded data
+// is cached by the parser.
+// The stream data and dictionary are not modified, but for some filters (e.g. no filter) the
+// returned slice is the stream data itself; use DecodeStreamReadOnly if it may be modified.
 func DecodeStream(streamObj *PdfObjectStream) ([]byte, error) {
+	hook := decodingOpts(streamObj).OperationHook
+	if hook == nil {
+		return decodeStream(streamObj)
+	}
+	start := time.Now()
+	decoded, err := decodeStream(streamObj)
+	reportOperation(hook, OperationInfo{
+		Operation:        OperationDecode,
+		ObjectNumber:     streamObj.ObjectNumber,
+		GenerationNumber: streamObj.GenerationNumber,
+		Filter:           streamFilterNames(streamObj.PdfObjectDictionary),
+		InputSize:        len(streamObj.Stream),
+		OutputSize:       len(decoded),
+		Err:              err,
+	}, start)
+	return decoded, err
+}
+
+// decodeStream decodes the stream data as DecodeStream.
+func decodeStream(streamObj *PdfObjectStream) ([]byte, error) {
 	common.Log.Trace("Decode stream")
 
-	encoder, err := NewEncoderFromStream(streamObj)
+	caching := decodingOpts(streamObj).DecodeCaching
+	if caching {
+		if decoded, ok := streamObj.decoding.get(streamObj); ok {
+			common.Log.Trace("Using cached decoded stream")
+			return decoded, nil
+		}
+	}
+
+	source := streamObj
+	if streamObj.encryptedData() != nil {
+		data, err := streamObj.DecryptedStream()
+		if err != nil {
+			common.Log.Debug("Stream decryption failed: %v", err)
+			return nil, err
+		}
+		source = streamObj.withData(data)
+	}
+
+	encoder, err := NewEncoderFromStream(source)
 	if err != nil {
 		common.Log.Debug("Stream decoding failed: %v", err)
 		return nil, err
 	}
 	common.Log.Trace("Encoder: %#v\n", encoder)
 
-	decoded, err := encoder.DecodeStream(streamObj)
+	decoded, err := encoder.DecodeStream(source)
 	if err != nil {
 		common.Log.Debug("Stream decoding failed: %v", err)
 		return nil, err
 	}
 
+	if caching {
+		streamObj.decoding.set(streamObj, decoded)
+	}
+
+	return decoded, nil
+}
+
+// withData returns a stream with the dictionary of `stream` and data `data`, for decoding without
+// modifying `stream`.
+func (stream *PdfObjectStream) withData(data []byte) *PdfObjectStream {
+	return &PdfObjectStream{
+		PdfObjectReference:  stream.PdfObjectReference,
+		PdfObjectDictionary: stream.PdfObjectDictionary,
+		Stream:              data,
+		parser:              stream.parser,
+		decoding:            stream.decoding,
+	}
+}
+
+// DecodeStreamReadOnly decodes the stream data like DecodeStream but leaves the stream object
+// untouched: the decoded data never shares memory with the stream data and the decode cache is
+// neither used nor updated.  This suits workflows that must write the object out byte for byte,
+// e.g. to preserve digital signatures, along with ReadOnlyDecryption (ParserOpts) for encrypted
+// documents.  Other encrypted data must be decrypted first, see PdfCrypt.DecryptStreamBytes.
+func DecodeStreamReadOnly(streamObj *PdfObjectStream) ([]byte, error) {
+	hook := decodingOpts(streamObj).OperationHook
+	if hook == nil {
+		return decodeStreamReadOnly(streamObj)
+	}
+	start := time.Now()
+	decoded, err := decodeStreamReadOnly(streamObj)
+	reportOperation(hook, OperationInfo{
+		Operation:        OperationDecode,
+		ObjectNumber:     streamObj.ObjectNumber,
+		GenerationNumber: streamObj.GenerationNumber,
+		Filter:           streamFilterNames(streamObj.PdfObjectDictionary),
+		InputSize:        len(streamObj.Stream),
+		OutputSize:       len(decoded),
+		Err:              err,
+	}, start)
+	return decoded, err
+}
+
+// decodeStreamReadOnly decodes the stream data as DecodeStreamReadOnly.
+func decodeStreamReadOnly(streamObj *PdfObjectStream) ([]byte, error) {
+	common.Log.Trace("Decode stream (read-only)")
+
+	var data []byte
+	if streamObj.encryptedData() != nil {
+		decrypted, err := streamObj.DecryptedStream()
+		if err != nil {
+			common.Log.Debug("Stream decryption failed: %v", err)
+			return nil, err
+		}
+		data = decrypted
+	} else {
+		data = make([]byte, len(streamObj.Stream))
+		copy(data, streamObj.Stream)
+	}
+	clone := streamObj.withData(data)
+
+	encoder, err := NewEncoderFromStream(clone)
+	if err != nil {
+		common.Log.Debug("Stream decoding failed: %v", err)
+		return nil, err
+	}
+	decoded, err := encoder.DecodeStream(clone)
+	if err != nil {
+		common.Log.Debug("Stream decoding failed: %v", err)
+		return nil, err
+	}
 	return decoded, nil
 }
 
 // EncodeStream encodes the stream data using the encoded specified by the stream's dictionary.
+// Modifies the stream object: the data is replaced by the encoded data and Length is updated.
 func EncodeStream(streamObj *PdfObjectStream) error {
+	hook := decodingOpts(streamObj).OperationHook
+	if hook == nil {
+		return encodeStream(streamObj)
+	}
+	start := time.Now()
+	size := len(streamObj.Stream)
+	err := encodeStream(streamObj)
+	reportOperation(hook, OperationInfo{
+		Operation:        OperationEncode,
+		ObjectNumber:     streamObj.ObjectNumber,
+		GenerationNumber: streamObj.GenerationNumber,
+		Filter:           streamFilterNames(streamObj.PdfObjectDictionary),
+		InputSize:        size,
+		OutputSize:       len(streamObj.Stream),
+		Err:              err,
+	}, start)
+	return err
+}
+
+// encodeStream encodes the stream data as EncodeStream.
+func encodeStream(streamObj *PdfObjectStream) error {
 	common.Log.Trace("Encode stream")
 
 	encoder, err := NewEncoderFromStream(streamObj)
@@ -131,3 +427,86 @@ func EncodeStream(streamObj *PdfObjectStream) error {
 
 	return nil
 }
+
+// StreamLengthSource tells how the extent of the data of a stream was determined when parsing it.
+type StreamLengthSource int
+
+const (
+	// StreamLengthNone is the source of streams that were not loaded by the parser.
+	StreamLengthNone StreamLengthSource = iota
+	// StreamLengthDeclared is the Length entry, followed by the endstream keyword.
+	StreamLengthDeclared
+	// StreamLengthScanned is an endstream keyword found by scanning, with the stream data checked
+	// against the outermost filter.
+	StreamLengthScanned
+	// StreamLengthScannedUnverified is an endstream keyword found by scanning, where the stream data
+	// could not be checked (no checkable filter, or encrypted data) or no candidate passed.
+	StreamLengthScannedUnverified
+)
+
+func (source StreamLengthSource) String() string {
+	switch source {
+	case StreamLengthDeclared:
+		return "declared Length"
+	case StreamLengthScanned:
+		return "scanned endstream"
+	case StreamLengthScannedUnverified:
+		return "scanned endstream (unverified)"
+	}
+	return "none"
+}
+
+// GetLengthSource returns how the extent of the stream data was determined by the parser, for
+// diagnosing malformed files.
+func (stream *PdfObjectStream) GetLengthSource() StreamLengthSource {
+	return stream.lengthSource
+}
+
+// checkStreamData checks whether `data` is complete, well formed data for the outermost filter of
+// the stream dictionary `dict`.  The second return value is false if the filter cannot be checked,
+// such as for unfiltered data.
+func checkStreamData(dict *PdfObjectDictionary, data []byte) (bool, bool) {
+	filter := TraceToDirectObject(dict.Get("Filter"))
+	if arr, ok := filter.(*PdfObjectArray); ok && len(*arr) > 0 {
+		filter = TraceToDirectObject((*arr)[0])
+	}
+	name, ok := filter.(*PdfObjectName)
+	if !ok {
+		return false, false
+	}
+
+	switch *name {
+	case StreamEncodingFilterNameFlate:
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err == zlib.ErrHeader {
+			_, err = inflateRaw(data)
+			return err == nil, true
+		}
+		if err != nil {
+			return false, true
+		}
+		defer r.Close()
+		_, err = ioutil.ReadAll(r)
+		return err == nil, true
+	case StreamEncodingFilterNameASCIIHex:
+		return bytes.HasSuffix(bytes.TrimRight(data, " \t\r\n\f\x00"), []byte(">")), true
+	case StreamEncodingFilterNameASCII85, "A85":
+		return bytes.HasSuffix(bytes.TrimRight(data, " \t\r\n\f\x00"), []byte("~>")), true
+	case StreamEncodingFilterNameRunLength:
+		// Runs up to the EOD marker (128), which must be the last byte.
+		for i := 0; i < len(data); {
+			switch l := int(data[i]); {
+			case l == 128:
+				return i == len(data)-1, true
+			case l < 128:
+				i += l + 2
+			default:
+				i += 2
+			}
+		}
+		return false, true
+	case StreamEncodingFilterNameDCT:
+		return bytes.HasSuffix(data, []byte{0xff, 0xd9}), true
+	}
+	return false, false
+}
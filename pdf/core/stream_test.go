@@ -175,3 +175,200 @@ endobj`
 	}
 
 }
+
+// makeFlateTestStream returns a Flate encoded stream object with compressible content.
+func makeFlateTestStream(size int) (*PdfObjectStream, []byte, error) {
+	raw := bytes.Repeat([]byte("BT /F1 12 Tf 10 10 Td (Hello World) Tj ET\n"), size/42+1)
+	stream, err := MakeStream(raw, NewFlateEncoder())
+	return stream, raw, err
+}
+
+// makeStreamTestFile returns a file with the Flate encoded stream of `raw` as object 1.
+func makeStreamTestFile(raw []byte) ([]byte, error) {
+	encoded, err := NewFlateEncoder().EncodeBytes(raw)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offset := buf.Len()
+	fmt.Fprintf(&buf, "1 0 obj\n<< /Length %d /Filter /FlateDecode >>\nstream\n", len(encoded))
+	buf.Write(encoded)
+	buf.WriteString("\nendstream\nendobj\n")
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 2\n0000000000 65535 f\r\n%010d 00000 n\r\n", offset)
+	fmt.Fprintf(&buf, "trailer\n<< /Size 2 >>\nstartxref\n%d\n%%%%EOF\n", xref)
+	return buf.Bytes(), nil
+}
+
+// loadTestStream returns object 1 of `data`, loaded by a parser with options `opts`.
+func loadTestStream(data []byte, opts *ParserOpts) (*PdfObjectStream, error) {
+	parser, err := NewParserWithOpts(bytes.NewReader(data), opts)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := parser.LookupByNumber(1)
+	if err != nil {
+		return nil, err
+	}
+	stream, ok := obj.(*PdfObjectStream)
+	if !ok {
+		return nil, fmt.Errorf("Not a stream (%T)", obj)
+	}
+	return stream, nil
+}
+
+func TestDecodeStreamCache(t *testing.T) {
+	raw := bytes.Repeat([]byte("BT /F1 12 Tf 10 10 Td (Hello World) Tj ET\n"), 25)
+	data, err := makeStreamTestFile(raw)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	stream, err := loadTestStream(data, &ParserOpts{DecodeCaching: true})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	decoded, err := DecodeStream(stream)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !compareSlices(decoded, raw) {
+		t.Fatalf("decoded != raw")
+	}
+	if _, cached := stream.decoding.get(stream); !cached {
+		t.Fatalf("Decoded data not cached")
+	}
+
+	// Modifying the returned data does not affect the cache.
+	decoded[0] = 'X'
+	decoded, err = DecodeStream(stream)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !compareSlices(decoded, raw) {
+		t.Fatalf("Cached data modified by caller")
+	}
+
+	// Modifying the stream data through MutableStream invalidates the cache.
+	other := []byte("q 1 0 0 1 0 0 cm Q")
+	encoded, err := NewFlateEncoder().EncodeBytes(other)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data = stream.MutableStream()
+	copy(data, encoded)
+	stream.Stream = data[:len(encoded)]
+	decoded, err = DecodeStream(stream)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !compareSlices(decoded, other) {
+		t.Fatalf("Stale cache after modification: %q", decoded)
+	}
+
+	// Changing the filter invalidates the cache.
+	stream.Stream = []byte("unfiltered")
+	stream.PdfObjectDictionary.Remove("Filter")
+	decoded, err = DecodeStream(stream)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if string(decoded) != "unfiltered" {
+		t.Fatalf("Stale cache after filter change: %q", decoded)
+	}
+
+	// No caching by default.
+	data, err = makeStreamTestFile(raw)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	stream, err = loadTestStream(data, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := DecodeStream(stream); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, cached := stream.decoding.get(stream); cached {
+		t.Errorf("Decoded data cached by default")
+	}
+}
+
+func benchmarkDecodeStream(b *testing.B, caching bool) {
+	_, raw, err := makeFlateTestStream(64 * 1024)
+	if err != nil {
+		b.Fatalf("Error: %v", err)
+	}
+	data, err := makeStreamTestFile(raw)
+	if err != nil {
+		b.Fatalf("Error: %v", err)
+	}
+	stream, err := loadTestStream(data, &ParserOpts{DecodeCaching: caching})
+	if err != nil {
+		b.Fatalf("Error: %v", err)
+	}
+	if _, err := DecodeStream(stream); err != nil {
+		b.Fatalf("Error: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := DecodeStream(stream)
+		if err != nil {
+			b.Fatalf("Error: %v", err)
+		}
+	}
+}
+
+func BenchmarkDecodeStreamUncached(b *testing.B) {
+	benchmarkDecodeStream(b, false)
+}
+
+// Repeated decoding of the same stream is served from the cache.
+func BenchmarkDecodeStreamCached(b *testing.B) {
+	benchmarkDecodeStream(b, true)
+}
+
+// Test detecting the filters of a stream which are not implemented.
+func TestIsDecodable(t *testing.T) {
+	testcases := []struct {
+		dict        string
+		decodable   bool
+		unsupported []string
+	}{
+		{"<< /Length 4 >>", true, nil},
+		{"<< /Filter null >>", true, nil},
+		{"<< /Filter /FlateDecode >>", true, nil},
+		{"<< /Filter [/ASCII85Decode /FlateDecode] >>", true, nil},
+		{"<< /Filter /JBIG2Decode >>", false, []string{"JBIG2Decode"}},
+		{"<< /Filter [/FlateDecode /JBIG2Decode] >>", false, []string{"JBIG2Decode"}},
+		{"<< /Filter [/CCITTFaxDecode /JPXDecode /CCITTFaxDecode] >>", false, []string{"CCITTFaxDecode", "JPXDecode"}},
+		{"<< /Filter /Crypt >>", false, []string{"Crypt"}},
+		// RunLengthDecode is only supported alone.
+		{"<< /Filter /RunLengthDecode >>", true, nil},
+		{"<< /Filter [/RunLengthDecode /FlateDecode] >>", false, []string{"RunLengthDecode"}},
+		{"<< /Filter 1 >>", false, nil},
+	}
+
+	for _, tc := range testcases {
+		dict, err := makeParserForText(tc.dict).ParseDict()
+		if err != nil {
+			t.Fatalf("Error parsing %s: %v", tc.dict, err)
+		}
+		decodable, unsupported := IsDecodable(&PdfObjectStream{PdfObjectDictionary: dict})
+		if decodable != tc.decodable || fmt.Sprint(unsupported) != fmt.Sprint(tc.unsupported) {
+			t.Errorf("%s: %t %v, expected %t %v", tc.dict, decodable, unsupported, tc.decodable, tc.unsupported)
+		}
+	}
+
+	// A JBIG2 stream which is not decodable fails to decode.
+	stream := &PdfObjectStream{PdfObjectDictionary: MakeDict(), Stream: []byte{0x97, 0x4a}}
+	stream.Set("Filter", MakeName(StreamEncodingFilterNameJBIG2))
+	if decodable, unsupported := IsDecodable(stream); decodable || len(unsupported) != 1 || unsupported[0] != "JBIG2Decode" {
+		t.Errorf("JBIG2 stream: %t %v", decodable, unsupported)
+	}
+	if _, err := DecodeStream(stream); err != ErrNoJBIG2Decode {
+		t.Errorf("JBIG2 stream decode error: %v", err)
+	}
+}
@@ -32,6 +32,19 @@ func IsDecimalDigit(c byte) bool {
 	}
 }
 
+// IsExponent checks if `bb` starts with the exponent of a number in exponential format: 'e' or 'E'
+// followed by a digit or a sign and a digit.
+// TODO (v3): Unexport.
+func IsExponent(bb []byte) bool {
+	if len(bb) < 2 || (bb[0] != 'e' && bb[0] != 'E') {
+		return false
+	}
+	if bb[1] == '+' || bb[1] == '-' {
+		return len(bb) > 2 && IsDecimalDigit(bb[2])
+	}
+	return IsDecimalDigit(bb[1])
+}
+
 // IsOctalDigit checks if a character can be part of an octal digit string.
 // TODO (v3): Unexport.
 func IsOctalDigit(c byte) bool {
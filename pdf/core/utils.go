@@ -48,6 +48,47 @@ func (parser *PdfParser) GetObjectNums() []int {
 	return objNums
 }
 
+// GetFreeObjects returns the object numbers marked free in the cross-reference table, mapped to the
+// generation number to be used when the object number is reused (65535 if it must not be reused).
+// Object number 0, the head of the free list, and object numbers in use are not included.
+func (parser *PdfParser) GetFreeObjects() map[int64]int64 {
+	free := map[int64]int64{}
+	for objNum, gen := range parser.freeObjects {
+		if _, inUse := parser.xrefs[objNum]; inUse || objNum == 0 {
+			continue
+		}
+		free[int64(objNum)] = int64(gen)
+	}
+	return free
+}
+
+// GetStats returns statistics of the objects of the file, from its cross-reference sections.
+func (parser *PdfParser) GetStats() ParserStats {
+	stats := ParserStats{Duplicates: parser.duplicates}
+	for objNum := range parser.xrefs {
+		if objNum != 0 {
+			stats.Objects++
+		}
+	}
+	for objNum := range parser.freeObjects {
+		if objNum == 0 {
+			continue
+		}
+		if _, inUse := parser.xrefs[objNum]; inUse {
+			stats.FreeListOnly++
+		} else {
+			stats.FreeEntries++
+		}
+	}
+	return stats
+}
+
+// LoadErrors returns the problems found while loading the cross-reference sections of the file
+// which did not prevent loading it, such as object numbers with more than one entry in a section.
+func (parser *PdfParser) LoadErrors() []error {
+	return parser.loadErrors
+}
+
 func getUniDocVersion() string {
 	return common.Version
 }
@@ -6,3 +6,10 @@
 package extractor
 
 var isTesting = false
+
+// The font encoding is logged for debugging when more than maxMissRatio of the character codes shown
+// with a font (at least minCodesForMissCheck) are not mapped to text.
+const (
+	maxMissRatio         = 0.25
+	minCodesForMissCheck = 10
+)
@@ -5,12 +5,24 @@
 
 package extractor
 
-import "github.com/unidoc/unidoc/pdf/model"
+import (
+	"github.com/unidoc/unidoc/pdf/core"
+	"github.com/unidoc/unidoc/pdf/model"
+)
 
 // Extractor stores and offers functionality for extracting content from PDF pages.
 type Extractor struct {
 	contents  string
 	resources *model.PdfPageResources
+
+	// Text written for character codes not mapped by the font's ToUnicode CMap.
+	missingCodeText string
+
+	// Leave out invisible text duplicating visible text.
+	dedupeInvisible bool
+
+	// Fonts loaded for the glyph widths, by font resource object (see loadFont).
+	fontCache map[core.PdfObject]*model.PdfFont
 }
 
 // New returns an Extractor instance for extracting content from the input PDF page.
@@ -20,9 +32,28 @@ func New(page *model.PdfPage) (*Extractor, error) {
 		return nil, err
 	}
 
+	resources, err := page.EffectiveResources()
+	if err != nil {
+		return nil, err
+	}
+
 	e := &Extractor{}
 	e.contents = contents
-	e.resources = page.Resources
+	e.resources = resources
 
 	return e, nil
 }
+
+// SetMissingCodeText sets the text that is extracted in place of each character code that the
+// ToUnicode CMap of its font does not map, e.g. "\uFFFD".  By default such codes are omitted.
+func (e *Extractor) SetMissingCodeText(text string) {
+	e.missingCodeText = text
+}
+
+// SetDedupeInvisibleText sets whether invisible text (rendering mode 3 or 7) that overlaps visible
+// text with near-identical content is left out of the extracted text, keeping only the visible text.
+// This avoids extracting sentences twice from documents with both a text layer and a legacy
+// invisible OCR layer.  Invisible text without a visible counterpart, as in OCRed scans, is kept.
+func (e *Extractor) SetDedupeInvisibleText(dedupe bool) {
+	e.dedupeInvisible = dedupe
+}
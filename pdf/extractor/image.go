@@ -0,0 +1,332 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package extractor
+
+import (
+	"errors"
+	"math"
+
+	"github.com/unidoc/unidoc/common"
+	"github.com/unidoc/unidoc/pdf/contentstream"
+	"github.com/unidoc/unidoc/pdf/core"
+	"github.com/unidoc/unidoc/pdf/model"
+)
+
+// ExtractedImage is an image painted on the page, by the Do operator with an image XObject or as
+// an inline image (BI/ID/EI), with its placement on the page.
+type ExtractedImage struct {
+	// Image is the decoded image.
+	Image *model.Image
+
+	// Name is the resource name of the image XObject, empty for inline images.
+	Name string
+
+	// Inline is true for inline images.
+	Inline bool
+
+	// CTM is the current transformation matrix [a b c d e f] when the image was painted, mapping
+	// the unit square of image space to the default user space of the page.
+	CTM [6]float64
+
+	// BBox is the bounding box of the image in the default user space of the page.
+	BBox model.PdfRectangle
+
+	// Index is the position of the paint in content stream order, counting from 0.
+	Index int
+
+	// SoftMask is the mask given by the soft mask (SMask) of the graphics state when the image was
+	// painted, an image of 1 color component whose samples are the mask values, mapped by the
+	// transfer function TR of the soft mask.  Only set if the transparency group of the soft mask
+	// paints a single image XObject, whose luminosity or alpha (SMask) gives the mask values.
+	SoftMask *model.Image
+}
+
+// ExtractImages returns the images painted on the page in content stream order, including inline
+// images and images painted by form XObjects.  An image painted several times is returned once
+// for each time it is painted, and images in the resources that are never painted are left out.
+func (e *Extractor) ExtractImages() ([]ExtractedImage, error) {
+	var images []ExtractedImage
+	err := e.extractImages(e.contents, e.resources, identityMatrix, map[*core.PdfObjectStream]bool{}, &images)
+	return images, err
+}
+
+// extractImages appends the images painted by the content stream `contents` with resources
+// `resources` to `images`, with the CTM starting at `ctm`.  The form XObjects being processed are
+// in `forms`, guarding against forms painting themselves.
+func (e *Extractor) extractImages(contents string, resources *model.PdfPageResources, ctm matrix,
+	forms map[*core.PdfObjectStream]bool, images *[]ExtractedImage) error {
+	cstreamParser := contentstream.NewContentStreamParser(contents)
+	operations, err := cstreamParser.Parse()
+	if err != nil {
+		return err
+	}
+
+	state := newTextState()
+	state.ctm = ctm
+
+	// Masks of the soft masks of the graphics state, computed when first used.
+	masks := map[core.PdfObject]*model.Image{}
+	add := func(img *model.Image, name string, inline bool) error {
+		var mask *model.Image
+		if state.softMask != nil {
+			var has bool
+			mask, has = masks[state.softMask]
+			if !has {
+				var err error
+				mask, err = softMaskImage(state.softMask)
+				if err != nil {
+					return err
+				}
+				masks[state.softMask] = mask
+			}
+		}
+		*images = append(*images, ExtractedImage{
+			Image:    img,
+			Name:     name,
+			Inline:   inline,
+			CTM:      [6]float64(state.ctm),
+			BBox:     unitSquareBBox(state.ctm),
+			Index:    len(*images),
+			SoftMask: mask,
+		})
+		return nil
+	}
+
+	processor := contentstream.NewContentStreamProcessor(*operations)
+	processor.AddHandler(contentstream.HandlerConditionEnumAllOperands, "",
+		func(op *contentstream.ContentStreamOperation, gs contentstream.GraphicsState, resources *model.PdfPageResources) error {
+			state.apply(op)
+			switch op.Operand {
+			case "gs":
+				if len(op.Params) != 1 || resources == nil {
+					return nil
+				}
+				name, ok := op.Params[0].(*core.PdfObjectName)
+				if !ok {
+					return nil
+				}
+				obj, found := resources.GetExtGState(*name)
+				if !found {
+					common.Log.Debug("ExtGState %s not found", *name)
+					return nil
+				}
+				gs, err := model.NewPdfExtGStateFromPdfObject(obj)
+				if err != nil {
+					return err
+				}
+				if gs.SMask != nil {
+					state.softMask = gs.SMask
+					if name, ok := core.TraceToDirectObject(gs.SMask).(*core.PdfObjectName); ok && *name == "None" {
+						state.softMask = nil
+					}
+				}
+			case "BI":
+				if len(op.Params) != 1 {
+					common.Log.Debug("BI without inline image")
+					return nil
+				}
+				iimg, ok := op.Params[0].(*contentstream.ContentStreamInlineImage)
+				if !ok {
+					return nil
+				}
+				img, err := iimg.ToImage(resources)
+				if err != nil {
+					return err
+				}
+				return add(img, "", true)
+			case "Do":
+				if len(op.Params) != 1 {
+					common.Log.Debug("Do should only get 1 input param, got %d", len(op.Params))
+					return errors.New("Incorrect parameter count")
+				}
+				name, ok := op.Params[0].(*core.PdfObjectName)
+				if !ok {
+					common.Log.Debug("Do XObject input not a name")
+					return errors.New("Do range error")
+				}
+				if resources == nil {
+					return nil
+				}
+
+				stream, xtype := resources.GetXObjectByName(*name)
+				switch xtype {
+				case model.XObjectTypeImage:
+					ximg, err := model.NewXObjectImageFromStream(stream)
+					if err != nil {
+						return err
+					}
+					img, err := ximg.ToImage()
+					if err != nil {
+						return err
+					}
+					return add(img, string(*name), false)
+				case model.XObjectTypeForm:
+					if forms[stream] {
+						common.Log.Debug("Form XObject %s paints itself, skipping", *name)
+						return nil
+					}
+					xform, err := model.NewXObjectFormFromStream(stream)
+					if err != nil {
+						return err
+					}
+					formContents, err := xform.GetContentStream()
+					if err != nil {
+						return err
+					}
+					formResources := xform.Resources
+					if formResources == nil {
+						// Forms without resources use those of the page (7.8.3).
+						formResources = resources
+					}
+					formCTM := getFormMatrix(xform).mult(state.ctm)
+
+					forms[stream] = true
+					err = e.extractImages(string(formContents), formResources, formCTM, forms, images)
+					delete(forms, stream)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+
+	return processor.Process(resources)
+}
+
+// softMaskImage returns the mask values of soft mask dictionary `obj` as an image of 1 color
+// component, mapped by its transfer function TR.  The mask values are the luminosity (S Luminosity)
+// or the alpha (S Alpha, the SMask of the image) of the image painted by the transparency group G
+// of the soft mask.  Returns nil if the group does not paint a single image XObject.  The backdrop
+// color BC is not needed as the image covers the group.
+func softMaskImage(obj core.PdfObject) (*model.Image, error) {
+	sm, err := model.NewPdfSoftMaskFromPdfObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	stream, ok := core.TraceToDirectObject(sm.G).(*core.PdfObjectStream)
+	if !ok {
+		common.Log.Debug("Soft mask group not a stream (%T)", sm.G)
+		return nil, nil
+	}
+	group, err := model.NewXObjectFormFromStream(stream)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := group.GetContentStream()
+	if err != nil {
+		return nil, err
+	}
+	operations, err := contentstream.NewContentStreamParser(string(contents)).Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	var ximg *model.XObjectImage
+	for _, op := range *operations {
+		if op.Operand != "Do" {
+			continue
+		}
+		if ximg != nil {
+			common.Log.Debug("Soft mask group paints several XObjects - mask not computed")
+			return nil, nil
+		}
+		if len(op.Params) != 1 || group.Resources == nil {
+			return nil, nil
+		}
+		name, ok := op.Params[0].(*core.PdfObjectName)
+		if !ok {
+			return nil, nil
+		}
+		stream, xtype := group.Resources.GetXObjectByName(*name)
+		if xtype != model.XObjectTypeImage {
+			common.Log.Debug("Soft mask group paints a non-image XObject - mask not computed")
+			return nil, nil
+		}
+		ximg, err = model.NewXObjectImageFromStream(stream)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ximg == nil {
+		return nil, nil
+	}
+
+	var mask *model.Image
+	switch sm.S {
+	case "Luminosity":
+		img, err := ximg.ToImage()
+		if err != nil {
+			return nil, err
+		}
+		if _, isGray := ximg.ColorSpace.(*model.PdfColorspaceDeviceGray); isGray {
+			mask = img
+			break
+		}
+		rgb, err := ximg.ColorSpace.ImageToRGB(*img)
+		if err != nil {
+			return nil, err
+		}
+		gray, err := model.NewPdfColorspaceDeviceRGB().ImageToGray(rgb)
+		if err != nil {
+			return nil, err
+		}
+		mask = &gray
+	case "Alpha":
+		stream, ok := core.TraceToDirectObject(ximg.SMask).(*core.PdfObjectStream)
+		if !ok {
+			// Opaque image.
+			return nil, nil
+		}
+		smask, err := model.NewXObjectImageFromStream(stream)
+		if err != nil {
+			return nil, err
+		}
+		mask, err = smask.ToImage()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		common.Log.Debug("Invalid soft mask subtype %s", sm.S)
+		return nil, nil
+	}
+
+	if err := sm.ApplyTransfer(mask); err != nil {
+		return nil, err
+	}
+	return mask, nil
+}
+
+// getFormMatrix returns the Matrix of form XObject `xform`, mapping form space to user space.
+func getFormMatrix(xform *model.XObjectForm) matrix {
+	arr, ok := core.TraceToDirectObject(xform.Matrix).(*core.PdfObjectArray)
+	if !ok || len(*arr) != 6 {
+		return identityMatrix
+	}
+	var m matrix
+	for i, obj := range *arr {
+		v, err := getNumberAsFloat(core.TraceToDirectObject(obj))
+		if err != nil {
+			common.Log.Debug("Invalid form Matrix %s, using identity", arr)
+			return identityMatrix
+		}
+		m[i] = v
+	}
+	return m
+}
+
+// unitSquareBBox returns the bounding box of the unit square transformed by `m`.
+func unitSquareBBox(m matrix) model.PdfRectangle {
+	bbox := model.PdfRectangle{Llx: math.Inf(1), Lly: math.Inf(1), Urx: math.Inf(-1), Ury: math.Inf(-1)}
+	for _, corner := range [][2]float64{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+		x, y := m.transform(corner[0], corner[1])
+		bbox.Llx = math.Min(bbox.Llx, x)
+		bbox.Lly = math.Min(bbox.Lly, y)
+		bbox.Urx = math.Max(bbox.Urx, x)
+		bbox.Ury = math.Max(bbox.Ury, y)
+	}
+	return bbox
+}
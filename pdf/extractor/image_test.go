@@ -0,0 +1,151 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package extractor
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/unidoc/unidoc/pdf/core"
+	"github.com/unidoc/unidoc/pdf/model"
+)
+
+// makeTestImageResources returns resources with the 2x1 gray image XObjects Im1 and Im2.
+func makeTestImageResources(t *testing.T) *model.PdfPageResources {
+	resources := model.NewPdfPageResources()
+	for i, name := range []core.PdfObjectName{"Im1", "Im2"} {
+		img := &model.Image{Width: 2, Height: 1, BitsPerComponent: 8, ColorComponents: 1, Data: []byte{byte(i), 0xff}}
+		ximg, err := model.NewXObjectImageFromImage(img, nil, core.NewFlateEncoder())
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := resources.SetXObjectImageByName(name, ximg); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	return resources
+}
+
+// Test that an image painted twice is extracted once per paint with its placement, and an image
+// that is never painted is left out.
+func TestImageExtraction(t *testing.T) {
+	contents := "q 100 0 0 50 10 20 cm /Im1 Do Q\nq 0 -30 60 0 200 300 cm /Im1 Do Q\n"
+	e := Extractor{contents: contents, resources: makeTestImageResources(t)}
+	images, err := e.ExtractImages()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("%d images, expected 2", len(images))
+	}
+
+	expected := []struct {
+		CTM  [6]float64
+		BBox model.PdfRectangle
+	}{
+		{[6]float64{100, 0, 0, 50, 10, 20}, model.PdfRectangle{Llx: 10, Lly: 20, Urx: 110, Ury: 70}},
+		{[6]float64{0, -30, 60, 0, 200, 300}, model.PdfRectangle{Llx: 200, Lly: 270, Urx: 260, Ury: 300}},
+	}
+	for i, image := range images {
+		if image.Index != i || image.Name != "Im1" || image.Inline {
+			t.Errorf("Image %d: index %d, name %q, inline %t", i, image.Index, image.Name, image.Inline)
+		}
+		if image.CTM != expected[i].CTM || image.BBox != expected[i].BBox {
+			t.Errorf("Image %d: CTM %v, bbox %+v, expected %v, %+v", i, image.CTM, image.BBox,
+				expected[i].CTM, expected[i].BBox)
+		}
+		if image.Image == nil || !bytes.Equal(image.Image.Data, []byte{0, 0xff}) {
+			t.Errorf("Image %d: unexpected image %+v", i, image.Image)
+		}
+	}
+}
+
+// Test extracting inline images and images painted by nested form XObjects, in paint order.
+func TestImageExtractionInlineAndForms(t *testing.T) {
+	resources := makeTestImageResources(t)
+
+	// Form Fm2 paints Im2 and the form Fm1 that paints Fm2 does so with a Matrix.
+	inner := model.NewXObjectForm()
+	inner.Resources = resources
+	if err := inner.SetContentStream([]byte("q 10 0 0 10 0 0 cm /Im2 Do Q"), nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	formResources := model.NewPdfPageResources()
+	if err := formResources.SetXObjectFormByName("Fm2", inner); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	outer := model.NewXObjectForm()
+	outer.Resources = formResources
+	outer.Matrix = core.MakeArrayFromFloats([]float64{2, 0, 0, 2, 5, 5})
+	if err := outer.SetContentStream([]byte("/Fm2 Do"), nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := resources.SetXObjectFormByName("Fm1", outer); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	contents := "q 20 0 0 10 0 0 cm BI /W 2 /H 1 /BPC 8 /CS /G ID \x07\x08 EI Q\n" +
+		"q 1 0 0 1 100 100 cm /Fm1 Do Q\n"
+	e := Extractor{contents: contents, resources: resources}
+	images, err := e.ExtractImages()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("%d images, expected 2", len(images))
+	}
+
+	if !images[0].Inline || images[0].Name != "" || !bytes.Equal(images[0].Image.Data, []byte{7, 8}) {
+		t.Errorf("Unexpected inline image %+v", images[0])
+	}
+	if bbox := (model.PdfRectangle{Urx: 20, Ury: 10}); images[0].BBox != bbox {
+		t.Errorf("Inline image bbox %+v, expected %+v", images[0].BBox, bbox)
+	}
+	if images[1].Inline || images[1].Name != "Im2" || images[1].Index != 1 {
+		t.Errorf("Unexpected form image %+v", images[1])
+	}
+	if bbox := (model.PdfRectangle{Llx: 105, Lly: 105, Urx: 125, Ury: 125}); images[1].BBox != bbox {
+		t.Errorf("Form image bbox %+v, expected %+v", images[1].BBox, bbox)
+	}
+}
+
+// Test the soft mask of the graphics state of a painted image, from the luminosity of the image
+// painted by its group, mapped by its transfer function.
+func TestImageExtractionSoftMask(t *testing.T) {
+	resources := makeTestImageResources(t)
+	group := model.NewXObjectForm()
+	group.Resources = resources
+	if err := group.SetContentStream([]byte("/Im2 Do"), nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	gsDict, err := core.NewParserFromString("<< /SMask << /Type /Mask /S /Luminosity " +
+		"/TR << /FunctionType 2 /Domain [0 1] /C0 [1] /C1 [0] /N 1 >> >> >>").ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	core.TraceToDirectObject(gsDict.Get("SMask")).(*core.PdfObjectDictionary).Set("G", group.ToPdfObject())
+	if err := resources.AddExtGState("GS1", gsDict); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	contents := "q /GS1 gs /Im1 Do Q /Im1 Do"
+	e := Extractor{contents: contents, resources: resources}
+	images, err := e.ExtractImages()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("%d images, expected 2", len(images))
+	}
+	// Im2 has the samples 1 and 255, inverted by the transfer function.
+	mask := images[0].SoftMask
+	if mask == nil || mask.ColorComponents != 1 || !bytes.Equal(mask.Data, []byte{254, 0}) {
+		t.Errorf("Soft mask %+v", mask)
+	}
+	if images[1].SoftMask != nil {
+		t.Errorf("Soft mask outside of q/Q: %+v", images[1].SoftMask)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package extractor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/unidoc/unidoc/pdf/model"
+)
+
+// PageRange is a range of page numbers, from First to Last inclusive, starting at 1.
+type PageRange struct {
+	First int
+	Last  int
+}
+
+// PageText is the text extracted from a page by ExtractTextByPages.
+type PageText struct {
+	PageNumber int
+	Text       string
+	Stats      PageTextStats
+	// Error of the extraction of the page, or the context error if the page was not extracted
+	// before the context was done.  Text holds the text extracted before the error, if any.
+	Err error
+}
+
+// PageTextStats are statistics of the text extraction of a page.
+type PageTextStats struct {
+	Runs     int           // Number of text runs (text showing operators) shown.
+	Chars    int           // Number of characters of the extracted text.
+	Duration time.Duration // Time taken to extract the text of the page.
+}
+
+// ExtractTextByPages extracts the text of the pages in `pageRange` of the document loaded by
+// `reader` with `workers` pages extracted concurrently (at least 1).  The results are in page
+// order, one per page.  The extraction of each page is independent: the error of a page is set in
+// its PageText, without stopping the others.  When `ctx` is done, no further pages are extracted
+// and the context error is returned along with the results, the pages not extracted having the
+// context error.  An error is also returned if the page range is not within the document.
+//
+// The reader must not be modified during the extraction.
+func ExtractTextByPages(ctx context.Context, reader *model.PdfReader, pageRange PageRange, workers int) ([]PageText, error) {
+	numPages, err := reader.GetNumPages()
+	if err != nil {
+		return nil, err
+	}
+	if pageRange.First < 1 || pageRange.Last > numPages || pageRange.First > pageRange.Last {
+		return nil, fmt.Errorf("Invalid page range %d-%d (%d pages)", pageRange.First, pageRange.Last, numPages)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]PageText, pageRange.Last-pageRange.First+1)
+	for i := range results {
+		results[i].PageNumber = pageRange.First + i
+	}
+
+	// The indices of the results to extract, handed out to the workers in page order.
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				extractPageText(reader, &results[i])
+			}
+		}()
+	}
+
+	var ctxErr error
+	for i := range results {
+		if ctxErr = ctx.Err(); ctxErr == nil {
+			select {
+			case indices <- i:
+				continue
+			case <-ctx.Done():
+				ctxErr = ctx.Err()
+			}
+		}
+		for j := i; j < len(results); j++ {
+			results[j].Err = ctxErr
+		}
+		break
+	}
+	close(indices)
+	wg.Wait()
+	return results, ctxErr
+}
+
+// extractPageText extracts the text of page `result.PageNumber` of `reader` into `result`.
+func extractPageText(reader *model.PdfReader, result *PageText) {
+	start := time.Now()
+	defer func() {
+		result.Stats.Duration = time.Since(start)
+	}()
+
+	page, err := reader.GetPage(result.PageNumber)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	e, err := New(page)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	result.Text, result.Stats.Runs, result.Err = e.extractTextAndRuns()
+	result.Stats.Chars = utf8.RuneCountInString(result.Text)
+}
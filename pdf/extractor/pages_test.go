@@ -0,0 +1,143 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package extractor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/unidoc/unidoc/pdf/core"
+	"github.com/unidoc/unidoc/pdf/model"
+)
+
+// makeTextPagesReader returns a reader of a document of `numPages` pages showing "Page <n>" and a
+// line of text, with an undecodable content stream on the pages in `bad`.
+func makeTextPagesReader(t testing.TB, numPages int, bad map[int]bool) *model.PdfReader {
+	font := core.MakeDict()
+	font.Set("Type", core.MakeName("Font"))
+	font.Set("Subtype", core.MakeName("Type1"))
+	font.Set("BaseFont", core.MakeName("Helvetica"))
+	fontObj := core.MakeIndirectObject(font)
+
+	w := model.NewPdfWriter()
+	for i := 1; i <= numPages; i++ {
+		page := model.NewPdfPage()
+		page.MediaBox = &model.PdfRectangle{Urx: 612, Ury: 792}
+		page.Resources = model.NewPdfPageResources()
+		page.Resources.SetFontByName("F1", fontObj)
+		if bad[i] {
+			stream := &core.PdfObjectStream{PdfObjectDictionary: core.MakeDict(), Stream: []byte("not flate data")}
+			stream.Set("Filter", core.MakeName("FlateDecode"))
+			stream.Set("Length", core.MakeInteger(int64(len(stream.Stream))))
+			page.Contents = stream
+		} else {
+			page.AddContentStreamByString(fmt.Sprintf("BT /F1 12 Tf 72 720 Td (Page %d) Tj 0 -14 Td "+
+				"(The quick brown fox jumps over the lazy dog.) Tj ET", i))
+		}
+		if err := w.AddPage(page); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	f, err := ioutil.TempFile("", "unidoc_pages_test")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := w.Write(f); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	reader, err := model.NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return reader
+}
+
+// Test extracting the text of a page range concurrently, in page order, with the error of a bad
+// page in its result.  Run with -race for checking the concurrent extraction.
+func TestExtractTextByPages(t *testing.T) {
+	// Text without the license notice, which the flag check of init misses with newer Go versions.
+	defer func(testing bool) { isTesting = testing }(isTesting)
+	isTesting = true
+	reader := makeTextPagesReader(t, 30, map[int]bool{12: true})
+
+	results, err := ExtractTextByPages(context.Background(), reader, PageRange{First: 5, Last: 25}, 4)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(results) != 21 {
+		t.Fatalf("%d results, expected 21", len(results))
+	}
+	for i, result := range results {
+		pageNum := 5 + i
+		if result.PageNumber != pageNum {
+			t.Errorf("Result %d: page %d, expected %d", i, result.PageNumber, pageNum)
+		}
+		if pageNum == 12 {
+			if result.Err == nil {
+				t.Errorf("Page 12: no error for the undecodable content stream")
+			}
+			continue
+		}
+		if result.Err != nil {
+			t.Errorf("Page %d: Error: %v", pageNum, result.Err)
+		}
+		if !strings.Contains(result.Text, fmt.Sprintf("Page %d\n", pageNum)) {
+			t.Errorf("Page %d: text %q", pageNum, result.Text)
+		}
+		// At least the 2 runs of the page, and the notice added by unlicensed writers.
+		if result.Stats.Runs < 2 || result.Stats.Chars != len(result.Text) {
+			t.Errorf("Page %d: stats %+v", pageNum, result.Stats)
+		}
+	}
+
+	for _, pageRange := range []PageRange{{0, 3}, {3, 31}, {5, 4}} {
+		if _, err := ExtractTextByPages(context.Background(), reader, pageRange, 2); err == nil {
+			t.Errorf("No error for page range %v", pageRange)
+		}
+	}
+
+	// No pages are extracted after the context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err = ExtractTextByPages(ctx, reader, PageRange{First: 1, Last: 30}, 4)
+	if err != context.Canceled || len(results) != 30 {
+		t.Fatalf("Error %v, %d results", err, len(results))
+	}
+	for _, result := range results {
+		if result.Err != context.Canceled || result.Text != "" {
+			t.Errorf("Page %d: extracted after cancellation (%v)", result.PageNumber, result.Err)
+		}
+	}
+}
+
+// Benchmark extracting the text of 500 pages with 1, 2 and 4 workers, which scales with the number
+// of CPUs available.
+func BenchmarkExtractTextByPages(b *testing.B) {
+	defer func(testing bool) { isTesting = testing }(isTesting)
+	isTesting = true
+	reader := makeTextPagesReader(b, 500, nil)
+	for _, workers := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := ExtractTextByPages(context.Background(), reader, PageRange{First: 1, Last: 500}, workers); err != nil {
+					b.Fatalf("Error: %v", err)
+				}
+			}
+		})
+	}
+}
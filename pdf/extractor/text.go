@@ -21,24 +21,117 @@ import (
 // account character encoding via CMaps in the PDF file.
 // The text is processed linearly e.g. in the order in which it appears. A best effort is done to add
 // spaces and newlines.
+// With SetDedupeInvisibleText, invisible text duplicating visible text is left out.
 func (e *Extractor) ExtractText() (string, error) {
+	text, _, err := e.extractTextAndRuns()
+	return text, err
+}
+
+// extractTextAndRuns returns the text as ExtractText, along with the number of text runs shown,
+// without those left out by SetDedupeInvisibleText.
+func (e *Extractor) extractTextAndRuns() (string, int, error) {
+	var suppressed map[int]bool
+	if e.dedupeInvisible {
+		_, runs, err := e.extractText(nil)
+		if err != nil {
+			return "", 0, err
+		}
+		suppressed = duplicateInvisibleRuns(runs)
+	}
+
+	text, runs, err := e.extractText(suppressed)
+	if err != nil {
+		return text, 0, err
+	}
+
+	buf := bytes.NewBufferString(text)
+	procBuf(buf)
+
+	return buf.String(), len(runs) - len(suppressed), nil
+}
+
+// extractText processes the content streams, returning the text and the text runs shown.  The
+// text of the runs whose indices are in `suppressed` is left out.
+func (e *Extractor) extractText(suppressed map[int]bool) (string, []TextRun, error) {
 	var buf bytes.Buffer
+	var runs []TextRun
+	state := newTextState()
 
 	cstreamParser := contentstream.NewContentStreamParser(e.contents)
 	operations, err := cstreamParser.Parse()
 	if err != nil {
-		return buf.String(), err
+		return buf.String(), runs, err
 	}
 
 	processor := contentstream.NewContentStreamProcessor(*operations)
 
 	var codemap *cmap.CMap
+	var fontObj core.PdfObject
+	numCodes, numMisses := 0, 0
 	inText := false
+
+	// Log the encoding of the current font if a large share of its codes were not mapped.
+	checkMisses := func() {
+		if numCodes >= minCodesForMissCheck && float64(numMisses) > maxMissRatio*float64(numCodes) {
+			common.Log.Debug("%d of %d character codes not mapped to text. Font encoding:\n%s",
+				numMisses, numCodes, fontEncodingExplanation{fontObj})
+		}
+		numCodes, numMisses = 0, 0
+	}
+	decode := func(data []byte) string {
+		var str string
+		var n, misses int
+		if state.font != nil && state.font.IsComposite() {
+			// The codes of composite fonts are split by the Encoding CMap, as for the widths.
+			str, n, misses = codemap.CharcodeBytesToUnicodeSplit(data, e.missingCodeText, state.font.NextCharcode)
+		} else {
+			str, n, misses = codemap.CharcodeBytesToUnicodeReplace(data, e.missingCodeText)
+		}
+		numCodes += n
+		numMisses += misses
+		return str
+	}
+
+	// Show the strings of a text showing operator as a run, writing the text unless suppressed.
+	show := func(params []core.PdfObject) {
+		var text bytes.Buffer
+		state.beginRun()
+		for _, obj := range params {
+			switch v := obj.(type) {
+			case *core.PdfObjectString:
+				if codemap != nil {
+					text.WriteString(decode([]byte(*v)))
+				} else if state.font != nil && !state.font.IsComposite() {
+					text.WriteString(decodeSimple(state.font, []byte(*v)))
+				} else {
+					text.WriteString(string(*v))
+				}
+				state.advance([]byte(*v))
+			case *core.PdfObjectFloat:
+				if *v < -100 {
+					text.WriteString(" ")
+				}
+				state.adjust(float64(*v))
+			case *core.PdfObjectInteger:
+				if *v < -100 {
+					text.WriteString(" ")
+				}
+				state.adjust(float64(*v))
+			}
+		}
+		run := state.makeRun(text.String())
+		if !suppressed[len(runs)] {
+			buf.WriteString(run.Text)
+		}
+		runs = append(runs, run)
+	}
+
 	xPos, yPos := float64(-1), float64(-1)
 
 	processor.AddHandler(contentstream.HandlerConditionEnumAllOperands, "",
 		func(op *contentstream.ContentStreamOperation, gs contentstream.GraphicsState, resources *model.PdfPageResources) error {
 			operand := op.Operand
+			state.apply(op)
 			switch operand {
 			case "BT":
 				inText = true
@@ -55,7 +148,10 @@ func (e *Extractor) ExtractText() (string, error) {
 					return errors.New("Incorrect parameter count")
 				}
 
+				checkMisses()
 				codemap = nil
+				fontObj = nil
+				state.font = nil
 
 				fontName, ok := op.Params[0].(*core.PdfObjectName)
 				if !ok {
@@ -67,13 +163,14 @@ func (e *Extractor) ExtractText() (string, error) {
 					return nil
 				}
 
-				fontObj, found := resources.GetFontByName(*fontName)
+				obj, found := resources.GetFontByName(*fontName)
 				if !found {
 					common.Log.Debug("Font not found...")
 					return errors.New("Font not in resources")
 				}
 
-				fontObj = core.TraceToDirectObject(fontObj)
+				fontObj = core.TraceToDirectObject(obj)
+				state.font = e.loadFont(obj)
 				if fontDict, isDict := fontObj.(*core.PdfObjectDictionary); isDict {
 					toUnicode := fontDict.Get("ToUnicode")
 					if toUnicode != nil {
@@ -181,24 +278,7 @@ func (e *Extractor) ExtractText() (string, error) {
 				if !ok {
 					return fmt.Errorf("Invalid parameter type, no array (%T)", op.Params[0])
 				}
-				for _, obj := range *paramList {
-					switch v := obj.(type) {
-					case *core.PdfObjectString:
-						if codemap != nil {
-							buf.WriteString(codemap.CharcodeBytesToUnicode([]byte(*v)))
-						} else {
-							buf.WriteString(string(*v))
-						}
-					case *core.PdfObjectFloat:
-						if *v < -100 {
-							buf.WriteString(" ")
-						}
-					case *core.PdfObjectInteger:
-						if *v < -100 {
-							buf.WriteString(" ")
-						}
-					}
-				}
+				show(*paramList)
 			case "Tj":
 				if !inText {
 					common.Log.Debug("Tj operand outside text")
@@ -211,23 +291,57 @@ func (e *Extractor) ExtractText() (string, error) {
 				if !ok {
 					return fmt.Errorf("Invalid parameter type, not string (%T)", op.Params[0])
 				}
-				if codemap != nil {
-					buf.WriteString(codemap.CharcodeBytesToUnicode([]byte(*param)))
-				} else {
-					buf.WriteString(string(*param))
+				show([]core.PdfObject{param})
+			case "'", "\"":
+				if !inText {
+					common.Log.Debug("%s operand outside text", operand)
+					return nil
+				}
+				if len(op.Params) < 1 {
+					return nil
+				}
+				param, ok := op.Params[len(op.Params)-1].(*core.PdfObjectString)
+				if !ok {
+					return fmt.Errorf("Invalid parameter type, not string (%T)", op.Params[len(op.Params)-1])
 				}
+				buf.WriteString("\n")
+				show([]core.PdfObject{param})
 			}
 
 			return nil
 		})
 
 	err = processor.Process(e.resources)
+	checkMisses()
 	if err != nil {
 		common.Log.Error("Error processing: %v", err)
-		return buf.String(), err
+		return buf.String(), runs, err
 	}
 
-	procBuf(&buf)
+	return buf.String(), runs, nil
+}
+
+// decodeSimple returns the text of string `data` shown with the simple font `font` without a
+// ToUnicode CMap: the runes of the glyphs of the codes in the font encoding.  Codes without a known
+// glyph are kept as they are.
+func decodeSimple(font *model.PdfFont, data []byte) string {
+	var buf bytes.Buffer
+	for _, code := range data {
+		if r, ok := font.CharcodeToRune(code); ok {
+			buf.WriteRune(r)
+		} else {
+			buf.WriteByte(code)
+		}
+	}
+	return buf.String()
+}
+
+// fontEncodingExplanation formats the encoding diagnostics of a font dictionary when logged.  The
+// explanation is only built if the log message is output, not for disabled log levels.
+type fontEncodingExplanation struct {
+	font core.PdfObject
+}
 
-	return buf.String(), nil
+func (e fontEncodingExplanation) String() string {
+	return model.ExplainFontEncoding(e.font)
 }
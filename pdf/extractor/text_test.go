@@ -7,7 +7,12 @@ package extractor
 
 import (
 	"flag"
+	"math"
+	"strings"
 	"testing"
+
+	"github.com/unidoc/unidoc/pdf/core"
+	"github.com/unidoc/unidoc/pdf/model"
 )
 
 func init() {
@@ -41,3 +46,351 @@ func TestTextExtraction1(t *testing.T) {
 		return
 	}
 }
+
+const toUnicodeAB = `
+/CIDInit /ProcSet findresource begin
+12 dict begin
+begincmap
+1 begincodespacerange
+<00> <FF>
+endcodespacerange
+2 beginbfchar
+<41> <0041>
+<42> <0042>
+endbfchar
+endcmap
+end
+end
+`
+
+// Test extracting text shown with a font whose ToUnicode CMap does not map all codes.
+func TestTextExtractionMissingCodes(t *testing.T) {
+	// The test flags may not be registered yet when init runs.
+	isTesting = true
+
+	toUnicode, err := core.MakeStream([]byte(toUnicodeAB), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	font := core.MakeDict()
+	font.Set("Type", core.MakeName("Font"))
+	font.Set("Subtype", core.MakeName("Type1"))
+	font.Set("BaseFont", core.MakeName("Helvetica"))
+	font.Set("ToUnicode", toUnicode)
+	resources := model.NewPdfPageResources()
+	if err := resources.SetFontByName("F1", font); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	testcases := []struct {
+		Missing  string
+		Expected string
+	}{
+		{"", "AB"},
+		{"\uFFFD", "A\uFFFDB\uFFFD"},
+		{"?", "A?B?"},
+	}
+	for _, tcase := range testcases {
+		e := Extractor{contents: "BT /F1 12 Tf (A\\001B) Tj [(\\377)] TJ ET", resources: resources}
+		e.SetMissingCodeText(tcase.Missing)
+		s, err := e.ExtractText()
+		if err != nil {
+			t.Fatalf("Error extracting text: %v", err)
+		}
+		if s != tcase.Expected {
+			t.Errorf("%q: %q != %q", tcase.Missing, s, tcase.Expected)
+		}
+	}
+}
+
+// Test that the ' and " operators output their strings on a new line, as their move to the next
+// line, and that the fonts selected by repeated Tf operators are loaded once.
+func TestTextExtractionQuoteOperators(t *testing.T) {
+	isTesting = true
+
+	font := core.MakeDict()
+	font.Set("Type", core.MakeName("Font"))
+	font.Set("Subtype", core.MakeName("Type1"))
+	font.Set("BaseFont", core.MakeName("Helvetica"))
+	resources := model.NewPdfPageResources()
+	if err := resources.SetFontByName("F1", font); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	contents := `BT /F1 12 Tf 14 TL (Line 1) Tj (Line 2) ' /F1 10 Tf 1 0.5 (Line 3) " ET`
+	e := Extractor{contents: contents, resources: resources}
+	s, err := e.ExtractText()
+	if err != nil {
+		t.Fatalf("Error extracting text: %v", err)
+	}
+	if s != "Line 1\nLine 2\nLine 3" {
+		t.Errorf("Extracted %q", s)
+	}
+	if len(e.fontCache) != 1 {
+		t.Errorf("%d fonts cached, expected 1", len(e.fontCache))
+	}
+}
+
+// Test extracting text of a standard 14 font without Encoding or ToUnicode, whose codes are in the
+// StandardEncoding built into the font rather than in WinAnsiEncoding.
+func TestTextExtractionStandardEncoding(t *testing.T) {
+	isTesting = true
+
+	font := core.MakeDict()
+	font.Set("Type", core.MakeName("Font"))
+	font.Set("Subtype", core.MakeName("Type1"))
+	font.Set("BaseFont", core.MakeName("Helvetica"))
+	resources := model.NewPdfPageResources()
+	if err := resources.SetFontByName("F1", font); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	e := Extractor{contents: `BT /F1 12 Tf (It\047s \256ne) Tj ET`, resources: resources}
+	s, err := e.ExtractText()
+	if err != nil {
+		t.Fatalf("Error extracting text: %v", err)
+	}
+	if s != "It’s ﬁne" {
+		t.Errorf("Extracted %q, expected %q", s, "It’s ﬁne")
+	}
+}
+
+// Test extracting text shown with fonts whose Type is missing or given as a string, which are
+// loaded with their widths in lenient mode.
+func TestTextExtractionMalformedFontType(t *testing.T) {
+	isTesting = true
+
+	for _, fontType := range []core.PdfObject{nil, core.MakeString("Font")} {
+		font := core.MakeDict()
+		font.SetIfNotNil("Type", fontType)
+		font.Set("Subtype", core.MakeName("TrueType"))
+		font.Set("BaseFont", core.MakeName("Arial"))
+		font.Set("FirstChar", core.MakeInteger(65))
+		font.Set("LastChar", core.MakeInteger(66))
+		font.Set("Widths", core.MakeArray(core.MakeInteger(722), core.MakeInteger(556)))
+		font.Set("Encoding", core.MakeName("WinAnsiEncoding"))
+		resources := model.NewPdfPageResources()
+		if err := resources.SetFontByName("F1", font); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		e := Extractor{contents: "BT /F1 10 Tf 72 700 Td (AB) Tj ET", resources: resources}
+		runs, err := e.ExtractTextRuns()
+		if err != nil {
+			t.Fatalf("Type %v: Error: %v", fontType, err)
+		}
+		if len(runs) != 1 || runs[0].Text != "AB" {
+			t.Errorf("Type %v: runs %+v, expected text \"AB\"", fontType, runs)
+			continue
+		}
+		if width := runs[0].BBox.Urx - runs[0].BBox.Llx; math.Abs(width-12.78) > 1e-6 {
+			t.Errorf("Type %v: run width %v, expected 12.78", fontType, width)
+		}
+	}
+}
+
+// Page with a visible text layer and a legacy invisible OCR layer of the scanned page image, in the
+// pixel coordinates of the 300 dpi image.  The caption of a figure is only in the OCR layer.
+const dualLayerContents = `
+q 0.24 0 0 0.24 0 0 cm
+0 0 2550 3300 re W n
+BT 3 Tr /F1 50 Tf 300 2917 Td (The quick brown fox jumps.) Tj 0 -100 Td (Pack my box with five dozen jugs.) Tj ET
+BT 3 Tr /F1 50 Tf 300 1000 Td (Figure caption only in the scan.) Tj ET
+Q
+BT /F1 12 Tf 72 700 Td (The quick brown fox jumps.) Tj 0 -24 Td (Pack my box with five dozen jugs.) Tj ET
+`
+
+// Test extracting a page with visible text and an invisible OCR layer, which gives each sentence
+// twice unless invisible duplicates are left out.
+func TestTextExtractionDedupeInvisible(t *testing.T) {
+	isTesting = true
+
+	font := core.MakeDict()
+	font.Set("Type", core.MakeName("Font"))
+	font.Set("Subtype", core.MakeName("Type1"))
+	font.Set("BaseFont", core.MakeName("Helvetica"))
+	resources := model.NewPdfPageResources()
+	if err := resources.SetFontByName("F1", font); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	sentences := []string{"The quick brown fox jumps.", "Pack my box with five dozen jugs."}
+	for _, dedupe := range []bool{false, true} {
+		e := Extractor{contents: dualLayerContents, resources: resources}
+		e.SetDedupeInvisibleText(dedupe)
+		s, err := e.ExtractText()
+		if err != nil {
+			t.Fatalf("Error extracting text: %v", err)
+		}
+		expected := 2
+		if dedupe {
+			expected = 1
+		}
+		for _, sentence := range sentences {
+			if n := strings.Count(s, sentence); n != expected {
+				t.Errorf("Dedupe %v: %q extracted %d times, expected %d: %q", dedupe, sentence, n, expected, s)
+			}
+		}
+		if !strings.Contains(s, "Figure caption only in the scan.") {
+			t.Errorf("Dedupe %v: invisible text without visible counterpart missing: %q", dedupe, s)
+		}
+	}
+
+	e := Extractor{contents: dualLayerContents, resources: resources}
+	runs, err := e.ExtractTextRuns()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(runs) != 5 {
+		t.Fatalf("%d runs, expected 5", len(runs))
+	}
+	for i, run := range runs {
+		invisible := i < 3
+		if run.IsInvisible() != invisible || run.Clipped != invisible {
+			t.Errorf("Run %d %q: rendering mode %d, clipped %v", i, run.Text, run.RenderingMode, run.Clipped)
+		}
+	}
+	if bbox := runs[3].BBox; math.Abs(bbox.Llx-72) > 0.01 || math.Abs(bbox.Lly-697.6) > 0.01 || bbox.Urx < 200 {
+		t.Errorf("Invalid box of visible run: %+v", bbox)
+	}
+	if bbox := runs[0].BBox; math.Abs(bbox.Llx-72) > 0.01 || math.Abs(bbox.Lly-697.68) > 0.01 {
+		t.Errorf("Invalid box of OCR run: %+v", bbox)
+	}
+
+	e.SetDedupeInvisibleText(true)
+	runs, err = e.ExtractTextRuns()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(runs) != 3 || runs[0].Text != "Figure caption only in the scan." {
+		t.Errorf("Unexpected runs after dedupe: %+v", runs)
+	}
+}
+
+// Test detecting invisible runs that duplicate visible text with OCR errors or split differently.
+func TestDuplicateInvisibleRuns(t *testing.T) {
+	line := model.PdfRectangle{Llx: 72, Lly: 698, Urx: 300, Ury: 710}
+	word := model.PdfRectangle{Llx: 72, Lly: 698, Urx: 100, Ury: 710}
+	elsewhere := model.PdfRectangle{Llx: 72, Lly: 100, Urx: 300, Ury: 112}
+	runs := []TextRun{
+		{Text: "Jumps over the lazy dog.", BBox: line},
+		{Text: "Jumps 0ver the 1azy dog.", BBox: line, RenderingMode: 3},      // 2 OCR errors.
+		{Text: "JUMPS", BBox: word, RenderingMode: 7},                         // Word of the line.
+		{Text: "Something else entirely", BBox: line, RenderingMode: 3},       // Different text.
+		{Text: "Jumps over the lazy dog.", BBox: elsewhere, RenderingMode: 3}, // No overlap.
+	}
+	duplicates := duplicateInvisibleRuns(runs)
+	for i, expected := range []bool{false, true, true, false, false} {
+		if duplicates[i] != expected {
+			t.Errorf("Run %d %q: duplicate %v, expected %v", i, runs[i].Text, duplicates[i], expected)
+		}
+	}
+}
+
+// Test extracting text shown with a Type0 font whose embedded Encoding CMap mixes 1 and 2 byte
+// codes: the codes are split by the codespace ranges, and the run box spans the widths of their
+// CIDs.
+func TestTextExtractionEmbeddedCMap(t *testing.T) {
+	defer func(testing bool) { isTesting = testing }(isTesting)
+	isTesting = true
+
+	encoding, err := core.MakeStream([]byte(`/CIDInit /ProcSet findresource begin
+12 dict begin
+begincmap
+/CMapName /Test-Mixed-CID def
+/CMapType 1 def
+2 begincodespacerange
+<00> <80>
+<8140> <9FFC>
+endcodespacerange
+2 begincidrange
+<20> <7E> 1
+<8140> <817E> 633
+endcidrange
+endcmap
+CMapName currentdict /CMap defineresource pop
+end
+end`), core.NewFlateEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	toUnicode, err := core.MakeStream([]byte(`/CIDInit /ProcSet findresource begin
+12 dict begin
+begincmap
+/CMapName /Test-UCS def
+/CMapType 2 def
+2 begincodespacerange
+<00> <80>
+<8140> <9FFC>
+endcodespacerange
+3 beginbfchar
+<41> <0041>
+<42> <0042>
+<8141> <3042>
+endbfchar
+endcmap
+CMapName currentdict /CMap defineresource pop
+end
+end`), core.NewFlateEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	cidFont, err := core.NewParserFromString(`<< /Type /Font /Subtype /CIDFontType2 /BaseFont /Test
+		/CIDSystemInfo << /Registry (Adobe) /Ordering (Test) /Supplement 0 >>
+		/DW 1000 /W [ 34 [ 600 ] 634 [ 900 ] ] >>`).ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	font := core.MakeDict()
+	font.Set("Type", core.MakeName("Font"))
+	font.Set("Subtype", core.MakeName("Type0"))
+	font.Set("BaseFont", core.MakeName("Test"))
+	font.Set("Encoding", encoding)
+	font.Set("DescendantFonts", core.MakeArray(cidFont))
+	font.Set("ToUnicode", toUnicode)
+	resources := model.NewPdfPageResources()
+	if err := resources.SetFontByName("F1", font); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	e := Extractor{contents: "BT /F1 10 Tf 72 700 Td <41814142> Tj ET", resources: resources}
+	runs, err := e.ExtractTextRuns()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(runs) != 1 || runs[0].Text != "AあB" {
+		t.Fatalf("Runs %+v, expected text \"AあB\"", runs)
+	}
+	// Widths 600, 900 and the default 1000 of CID 35.
+	if bbox := runs[0].BBox; math.Abs(bbox.Llx-72) > 1e-9 || math.Abs(bbox.Urx-97) > 1e-9 {
+		t.Errorf("Run box %+v, expected from x 72 to 97", bbox)
+	}
+
+	// The codes are split by the Encoding CMap rather than by a ToUnicode CMap without codespace
+	// ranges, which on its own would take <81> as a code.
+	toUnicode, err = core.MakeStream([]byte(`4 beginbfchar
+<41> <0041>
+<42> <0042>
+<81> <0058>
+<8141> <3042>
+endbfchar`), core.NewFlateEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	font2 := core.MakeDict()
+	for _, key := range font.Keys() {
+		font2.Set(key, font.Get(key))
+	}
+	font2.Set("ToUnicode", toUnicode)
+	if err := resources.SetFontByName("F2", font2); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	e = Extractor{contents: "BT /F2 10 Tf 72 700 Td <41814142> Tj ET", resources: resources}
+	runs, err = e.ExtractTextRuns()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(runs) != 1 || runs[0].Text != "AあB" {
+		t.Errorf("Runs %+v, expected text \"AあB\"", runs)
+	}
+}
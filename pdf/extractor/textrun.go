@@ -0,0 +1,440 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package extractor
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/unidoc/unidoc/common"
+	"github.com/unidoc/unidoc/pdf/contentstream"
+	"github.com/unidoc/unidoc/pdf/core"
+	"github.com/unidoc/unidoc/pdf/model"
+)
+
+// TextRun is the text shown by a text showing operator (Tj, TJ, ' or "), with its position on the
+// page and how it is rendered.
+type TextRun struct {
+	Text string
+
+	// BBox is the approximate bounding box of the run in the default user space of the page, from
+	// the glyph widths and the font size.
+	BBox model.PdfRectangle
+
+	// RenderingMode is the text rendering mode (Tr operator): 0 to 2 paint the glyphs, 3 is
+	// invisible text, and modes 4 to 7 add the glyphs to the clipping path as well.
+	RenderingMode int
+
+	// Clipped is true if a clipping path was set in the content stream (W or W* operator, or text
+	// shown with a clipping rendering mode) when the run was shown.
+	Clipped bool
+}
+
+// IsInvisible returns true if the run is not painted (rendering modes 3 and 7), as in the text
+// layer of OCRed scans.
+func (run TextRun) IsInvisible() bool {
+	return run.RenderingMode == 3 || run.RenderingMode == 7
+}
+
+// ExtractTextRuns returns the text runs of the page in content stream order, so that callers can
+// filter them, e.g. by rendering mode.  With SetDedupeInvisibleText, invisible runs duplicating
+// visible text are left out.
+func (e *Extractor) ExtractTextRuns() ([]TextRun, error) {
+	_, runs, err := e.extractText(nil)
+	if err != nil || !e.dedupeInvisible {
+		return runs, err
+	}
+
+	suppressed := duplicateInvisibleRuns(runs)
+	var kept []TextRun
+	for i, run := range runs {
+		if !suppressed[i] {
+			kept = append(kept, run)
+		}
+	}
+	return kept, nil
+}
+
+// Minimum share of the smaller of two runs' boxes that must be covered by their intersection for
+// the runs to overlap.
+const minOverlapRatio = 0.5
+
+// Maximum edit distance between the text of an invisible run and the overlapping visible text, as
+// a share of the text length, for the texts to be near-identical (allowing for OCR errors).
+const maxEditRatio = 0.1
+
+// duplicateInvisibleRuns returns the indices of the invisible runs of `runs` that duplicate visible
+// text: runs whose text is near-identical to, or part of, the text of the visible runs overlapping
+// them.  Whitespace and case are ignored.
+func duplicateInvisibleRuns(runs []TextRun) map[int]bool {
+	duplicates := map[int]bool{}
+
+	// The visible runs sorted by the bottom of their boxes, so that the runs that can overlap an
+	// invisible run are found by binary search rather than by comparing all pairs.
+	var visible []int
+	maxHeight := 0.0
+	for i, run := range runs {
+		if !run.IsInvisible() {
+			visible = append(visible, i)
+			maxHeight = math.Max(maxHeight, run.BBox.Ury-run.BBox.Lly)
+		}
+	}
+	sort.Slice(visible, func(i, j int) bool { return runs[visible[i]].BBox.Lly < runs[visible[j]].BBox.Lly })
+
+	for i, run := range runs {
+		if !run.IsInvisible() {
+			continue
+		}
+		text := normalizeRunText(run.Text)
+		if text == "" {
+			continue
+		}
+
+		// Overlapping runs start above run.Lly-maxHeight and below run.Ury.
+		first := sort.Search(len(visible), func(k int) bool { return runs[visible[k]].BBox.Lly > run.BBox.Lly-maxHeight })
+		end := sort.Search(len(visible), func(k int) bool { return runs[visible[k]].BBox.Lly >= run.BBox.Ury })
+		var overlapping []int
+		for _, j := range visible[first:maxInt(first, end)] {
+			if runsOverlap(run, runs[j]) {
+				overlapping = append(overlapping, j)
+			}
+		}
+		if len(overlapping) == 0 {
+			continue
+		}
+		// Join the overlapping text in content stream order.
+		sort.Ints(overlapping)
+		var joined bytes.Buffer
+		for _, j := range overlapping {
+			joined.WriteString(normalizeRunText(runs[j].Text))
+		}
+		if strings.Contains(joined.String(), text) || nearIdentical(text, joined.String()) {
+			duplicates[i] = true
+		}
+	}
+	return duplicates
+}
+
+// runsOverlap returns true if the boxes of runs `a` and `b` overlap by at least minOverlapRatio.
+func runsOverlap(a, b TextRun) bool {
+	w := math.Min(a.BBox.Urx, b.BBox.Urx) - math.Max(a.BBox.Llx, b.BBox.Llx)
+	h := math.Min(a.BBox.Ury, b.BBox.Ury) - math.Max(a.BBox.Lly, b.BBox.Lly)
+	if w <= 0 || h <= 0 {
+		return false
+	}
+	area := func(r model.PdfRectangle) float64 { return (r.Urx - r.Llx) * (r.Ury - r.Lly) }
+	return w*h >= minOverlapRatio*math.Min(area(a.BBox), area(b.BBox))
+}
+
+// normalizeRunText returns `text` in lower case without whitespace.
+func normalizeRunText(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, text)
+}
+
+// nearIdentical returns true if the edit distance between `a` and `b` is within maxEditRatio of the
+// length of the longer one.
+func nearIdentical(a, b string) bool {
+	ra, rb := []rune(a), []rune(b)
+	n := len(ra)
+	if len(rb) > n {
+		n = len(rb)
+	}
+	maxEdits := int(maxEditRatio * float64(n))
+	if d := len(ra) - len(rb); d > maxEdits || -d > maxEdits {
+		return false
+	}
+
+	// Levenshtein distance, row by row.
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)] <= maxEdits
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// matrix is a transformation matrix [a b c d e f], standing for [a b 0; c d 0; e f 1].
+type matrix [6]float64
+
+var identityMatrix = matrix{1, 0, 0, 1, 0, 0}
+
+// mult returns the product m × n.
+func (m matrix) mult(n matrix) matrix {
+	return matrix{
+		m[0]*n[0] + m[1]*n[2],
+		m[0]*n[1] + m[1]*n[3],
+		m[2]*n[0] + m[3]*n[2],
+		m[2]*n[1] + m[3]*n[3],
+		m[4]*n[0] + m[5]*n[2] + n[4],
+		m[4]*n[1] + m[5]*n[3] + n[5],
+	}
+}
+
+// transform returns the point (x, y) transformed by m.
+func (m matrix) transform(x, y float64) (float64, float64) {
+	return m[0]*x + m[2]*y + m[4], m[1]*x + m[3]*y + m[5]
+}
+
+// translation returns the matrix of a translation by (tx, ty).
+func translation(tx, ty float64) matrix {
+	return matrix{1, 0, 0, 1, tx, ty}
+}
+
+// textGState holds the parameters of the graphics state that affect the position and rendering
+// of text, which are saved and restored by the q and Q operators.
+type textGState struct {
+	ctm         matrix
+	font        *model.PdfFont
+	fontSize    float64
+	charSpacing float64
+	wordSpacing float64
+	scaling     float64 // Horizontal scaling (Tz) as a factor.
+	leading     float64
+	rise        float64
+	renderMode  int
+	clipped     bool
+	// Soft mask (SMask) of the graphics state parameters set by gs, nil if none.
+	softMask core.PdfObject
+}
+
+// textState tracks the graphics and text state of a content stream for positioning text runs.
+type textState struct {
+	textGState
+	stack []textGState
+
+	tm, tlm matrix
+	// Set if text was shown with a clipping rendering mode, adding to the clipping path at ET.
+	clipText bool
+
+	// Start and horizontal displacement of the run being shown.
+	runStart   matrix
+	runAdvance float64
+}
+
+func newTextState() *textState {
+	state := &textState{}
+	state.ctm = identityMatrix
+	state.scaling = 1
+	state.tm = identityMatrix
+	state.tlm = identityMatrix
+	return state
+}
+
+// apply updates the state for the operation `op`.
+func (state *textState) apply(op *contentstream.ContentStreamOperation) {
+	nums := func(n int) []float64 {
+		if len(op.Params) < n {
+			return nil
+		}
+		values := make([]float64, n)
+		for i := range values {
+			v, err := getNumberAsFloat(op.Params[len(op.Params)-n+i])
+			if err != nil {
+				return nil
+			}
+			values[i] = v
+		}
+		return values
+	}
+
+	switch op.Operand {
+	case "q":
+		state.stack = append(state.stack, state.textGState)
+	case "Q":
+		if len(state.stack) > 0 {
+			state.textGState = state.stack[len(state.stack)-1]
+			state.stack = state.stack[:len(state.stack)-1]
+		}
+	case "cm":
+		if v := nums(6); v != nil {
+			state.ctm = matrix{v[0], v[1], v[2], v[3], v[4], v[5]}.mult(state.ctm)
+		}
+	case "W", "W*":
+		state.clipped = true
+	case "BT":
+		state.tm = identityMatrix
+		state.tlm = identityMatrix
+		state.clipText = false
+	case "ET":
+		if state.clipText {
+			state.clipped = true
+		}
+	case "Tc":
+		if v := nums(1); v != nil {
+			state.charSpacing = v[0]
+		}
+	case "Tw":
+		if v := nums(1); v != nil {
+			state.wordSpacing = v[0]
+		}
+	case "Tz":
+		if v := nums(1); v != nil {
+			state.scaling = v[0] / 100
+		}
+	case "TL":
+		if v := nums(1); v != nil {
+			state.leading = v[0]
+		}
+	case "Ts":
+		if v := nums(1); v != nil {
+			state.rise = v[0]
+		}
+	case "Tr":
+		if v := nums(1); v != nil {
+			state.renderMode = int(v[0])
+		}
+	case "Tf":
+		if v := nums(1); v != nil {
+			state.fontSize = v[0]
+		}
+	case "Td", "TD":
+		if v := nums(2); v != nil {
+			if op.Operand == "TD" {
+				state.leading = -v[1]
+			}
+			state.nextLine(v[0], v[1])
+		}
+	case "Tm":
+		if v := nums(6); v != nil {
+			state.tlm = matrix{v[0], v[1], v[2], v[3], v[4], v[5]}
+			state.tm = state.tlm
+		}
+	case "T*", "'":
+		state.nextLine(0, -state.leading)
+	case "\"":
+		if v := nums(3); v != nil {
+			state.wordSpacing = v[0]
+			state.charSpacing = v[1]
+		}
+		state.nextLine(0, -state.leading)
+	}
+}
+
+// nextLine moves to the start of the next line, offset by (tx, ty) from the start of the current
+// line.
+func (state *textState) nextLine(tx, ty float64) {
+	state.tlm = translation(tx, ty).mult(state.tlm)
+	state.tm = state.tlm
+}
+
+// beginRun starts a text run at the current text position.
+func (state *textState) beginRun() {
+	state.runStart = state.tm
+	state.runAdvance = 0
+}
+
+// advance moves the text position past the glyphs of the string `data`, split into character codes
+// as by the font (see PdfFont.BytesToCharcodes).
+func (state *textState) advance(data []byte) {
+	composite := state.font != nil && state.font.IsComposite()
+	var codes []uint64
+	if state.font != nil {
+		codes, _ = state.font.BytesToCharcodes(data)
+	} else {
+		for _, b := range data {
+			codes = append(codes, uint64(b))
+		}
+	}
+	for _, c := range codes {
+		code := uint16(c)
+		width := 500.0
+		if state.font != nil && uint64(code) == c {
+			if w, ok := state.font.GetCharcodeWidth(code); ok {
+				width = w
+			}
+		}
+		tx := width/1000*state.fontSize + state.charSpacing
+		if !composite && code == ' ' {
+			tx += state.wordSpacing
+		}
+		state.move(tx * state.scaling)
+	}
+}
+
+// adjust moves the text position by the TJ array number `num`, in thousandths of text space units.
+func (state *textState) adjust(num float64) {
+	state.move(-num / 1000 * state.fontSize * state.scaling)
+}
+
+func (state *textState) move(tx float64) {
+	state.tm = translation(tx, 0).mult(state.tm)
+	state.runAdvance += tx
+}
+
+// makeRun returns the run of text `text` shown since beginRun.  The box spans from 0.2 below to
+// 0.8 above the baseline in units of the font size.
+func (state *textState) makeRun(text string) TextRun {
+	m := state.runStart.mult(state.ctm)
+	bottom := state.rise - 0.2*state.fontSize
+	top := state.rise + 0.8*state.fontSize
+
+	bbox := model.PdfRectangle{Llx: math.Inf(1), Lly: math.Inf(1), Urx: math.Inf(-1), Ury: math.Inf(-1)}
+	for _, corner := range [][2]float64{{0, bottom}, {state.runAdvance, bottom}, {0, top}, {state.runAdvance, top}} {
+		x, y := m.transform(corner[0], corner[1])
+		bbox.Llx, bbox.Urx = math.Min(bbox.Llx, x), math.Max(bbox.Urx, x)
+		bbox.Lly, bbox.Ury = math.Min(bbox.Lly, y), math.Max(bbox.Ury, y)
+	}
+
+	if state.renderMode >= 4 {
+		state.clipText = true
+	}
+	return TextRun{Text: text, BBox: bbox, RenderingMode: state.renderMode, Clipped: state.clipped}
+}
+
+// loadFont loads the font of the font resource `obj` for the glyph widths.  Simple standard 14
+// fonts without Widths get the widths of the standard font metrics.  Returns nil if the font
+// cannot be loaded.  The fonts are cached by resource object, as content streams select the same
+// fonts over and over.
+func (e *Extractor) loadFont(obj core.PdfObject) *model.PdfFont {
+	key := core.TraceToDirectObject(obj)
+	if font, cached := e.fontCache[key]; cached {
+		return font
+	}
+	if e.fontCache == nil {
+		e.fontCache = map[core.PdfObject]*model.PdfFont{}
+	}
+
+	font, err := model.NewPdfFontFromPdfObject(obj)
+	if err != nil {
+		common.Log.Debug("Unable to load font for the glyph widths: %v", err)
+		font = nil
+	}
+	e.fontCache[key] = font
+	return font
+}
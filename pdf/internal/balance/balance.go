@@ -0,0 +1,90 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+// Package balance checks the nesting of the graphics state (q/Q) and text object (BT/ET)
+// operators of content streams.
+package balance
+
+// Result describes the nesting of the q/Q and BT/ET operators of a content stream.
+type Result struct {
+	UnclosedSaves     int  // Number of q operators without a matching Q.
+	UnmatchedRestores int  // Number of Q operators without a preceding q.
+	UnclosedText      bool // Whether the content ends inside a text object (BT without ET).
+	UnmatchedTextEnds int  // Number of ET operators outside a text object.
+	NestedText        int  // Number of BT operators inside a text object.
+}
+
+// IsBalanced returns true if all q/Q and BT/ET operators are matched.
+func (r Result) IsBalanced() bool {
+	return r.UnclosedSaves == 0 && r.UnmatchedRestores == 0 && !r.UnclosedText &&
+		r.UnmatchedTextEnds == 0 && r.NestedText == 0
+}
+
+// Check returns the nesting of the q/Q and BT/ET operators in `operators`.
+func Check(operators []string) Result {
+	r := Result{}
+	for _, op := range operators {
+		switch op {
+		case "q":
+			r.UnclosedSaves++
+		case "Q":
+			if r.UnclosedSaves == 0 {
+				r.UnmatchedRestores++
+			} else {
+				r.UnclosedSaves--
+			}
+		case "BT":
+			if r.UnclosedText {
+				r.NestedText++
+			}
+			r.UnclosedText = true
+		case "ET":
+			if !r.UnclosedText {
+				r.UnmatchedTextEnds++
+			}
+			r.UnclosedText = false
+		}
+	}
+	return r
+}
+
+// IsWrapped returns true if `operators` are fully wrapped within q ... Q, i.e. no operator is
+// applied to the initial graphics state.
+func IsWrapped(operators []string) bool {
+	if len(operators) < 2 {
+		return false
+	}
+
+	depth := 0
+	for _, op := range operators {
+		if op == "q" {
+			depth++
+		} else if op == "Q" {
+			depth--
+		} else if depth < 1 {
+			return false
+		}
+	}
+
+	// Should end at depth == 0
+	return depth == 0
+}
+
+// Repair returns the operators to insert before and after content with nesting `r` so that the
+// content is wrapped within q ... Q, any open text object is closed and content appended
+// afterwards starts in the initial graphics state.
+// Unmatched Qs in the content are absorbed by additional leading qs.
+func (r Result) Repair() (prefix []string, suffix []string) {
+	for i := 0; i < r.UnmatchedRestores+1; i++ {
+		prefix = append(prefix, "q")
+	}
+	if r.UnclosedText {
+		suffix = append(suffix, "ET")
+	}
+	for i := 0; i < r.UnclosedSaves+1; i++ {
+		suffix = append(suffix, "Q")
+	}
+	return prefix, suffix
+}
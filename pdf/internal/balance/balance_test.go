@@ -0,0 +1,70 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package balance
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOperators(t *testing.T) {
+	content := `q 1 0 0 1 10 -2.5 cm % comment Q
+BT /F1 12 Tf [(a\) Q) -20 (b)] TJ <514551> Tj ET
+/P <</MCID 0>> BDC EMC
+BI /W 2 /H 1 /BPC 8 /CS /G ID
+Q EIQ
+EI Q`
+	expected := []string{"q", "cm", "BT", "Tf", "TJ", "Tj", "ET", "BDC", "EMC", "BI", "ID", "EI", "Q"}
+	ops := Operators([]byte(content))
+	if !reflect.DeepEqual(ops, expected) {
+		t.Errorf("%v != %v", ops, expected)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	testcases := []struct {
+		Ops      []string
+		Expected Result
+		Wrapped  bool
+	}{
+		{[]string{"q", "cm", "Q"}, Result{}, true},
+		{[]string{"q", "BT", "Tj", "ET", "Q"}, Result{}, true},
+		{[]string{"cm", "q", "Q"}, Result{}, false},
+		{[]string{"q", "q", "cm", "Q"}, Result{UnclosedSaves: 1}, false},
+		{[]string{"Q", "cm", "q"}, Result{UnclosedSaves: 1, UnmatchedRestores: 1}, false},
+		{[]string{"q", "BT", "Tj"}, Result{UnclosedSaves: 1, UnclosedText: true}, false},
+		{[]string{"BT", "BT", "ET", "ET"}, Result{NestedText: 1, UnmatchedTextEnds: 1}, false},
+	}
+	for _, tcase := range testcases {
+		r := Check(tcase.Ops)
+		if r != tcase.Expected {
+			t.Errorf("%v: %+v != %+v", tcase.Ops, r, tcase.Expected)
+		}
+		if r.IsBalanced() != (tcase.Expected == Result{}) {
+			t.Errorf("%v: unexpected IsBalanced", tcase.Ops)
+		}
+		if IsWrapped(tcase.Ops) != tcase.Wrapped {
+			t.Errorf("%v: IsWrapped != %v", tcase.Ops, tcase.Wrapped)
+		}
+	}
+}
+
+// Test that repairing unbalanced operators yields balanced operators wrapped in q ... Q.
+func TestRepair(t *testing.T) {
+	ops := []string{"Q", "cm", "q", "q", "BT", "Tj"}
+	prefix, suffix := Check(ops).Repair()
+	repaired := append(append(prefix, ops...), suffix...)
+	expected := []string{"q", "q", "Q", "cm", "q", "q", "BT", "Tj", "ET", "Q", "Q", "Q"}
+	if !reflect.DeepEqual(repaired, expected) {
+		t.Fatalf("%v != %v", repaired, expected)
+	}
+	if r := Check(repaired); !r.IsBalanced() {
+		t.Errorf("Not balanced after repair: %+v", r)
+	}
+	if !IsWrapped(repaired) {
+		t.Errorf("Not wrapped after repair")
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package balance
+
+import "bytes"
+
+// Operators returns the operators of the content stream `content` in order, skipping operands,
+// comments and inline image data. It is a lightweight alternative to fully parsing the content
+// stream, suitable for checking the nesting of operators.
+func Operators(content []byte) []string {
+	var operators []string
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case isWhiteSpace(c):
+			i++
+		case c == '%':
+			// Comment until end of line.
+			for i < len(content) && content[i] != '\r' && content[i] != '\n' {
+				i++
+			}
+		case c == '(':
+			i = skipLiteralString(content, i)
+		case c == '<':
+			if i+1 < len(content) && content[i+1] == '<' {
+				i += 2
+			} else {
+				// Hex string.
+				for i < len(content) && content[i] != '>' {
+					i++
+				}
+				i++
+			}
+		case c == '>' || c == '[' || c == ']' || c == '{' || c == '}' || c == ')':
+			i++
+		case c == '/':
+			// Name.
+			i++
+			for i < len(content) && isRegular(content[i]) {
+				i++
+			}
+		default:
+			start := i
+			for i < len(content) && isRegular(content[i]) {
+				i++
+			}
+			token := string(content[start:i])
+			if isOperand(token) {
+				continue
+			}
+			operators = append(operators, token)
+			if token == "ID" {
+				i = skipInlineImageData(content, i)
+			}
+		}
+	}
+	return operators
+}
+
+// skipLiteralString returns the position following the literal string starting at `i`.
+func skipLiteralString(content []byte, i int) int {
+	depth := 0
+	for ; i < len(content); i++ {
+		switch content[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return i
+}
+
+// skipInlineImageData returns the position of the EI operator following the inline image data
+// starting at `i`.
+func skipInlineImageData(content []byte, i int) int {
+	for i < len(content) {
+		idx := bytes.Index(content[i:], []byte("EI"))
+		if idx < 0 {
+			return len(content)
+		}
+		pos := i + idx
+		end := pos + 2
+		if pos > 0 && isWhiteSpace(content[pos-1]) && (end == len(content) || !isRegular(content[end])) {
+			return pos
+		}
+		i = pos + 1
+	}
+	return i
+}
+
+// isOperand returns true if `token` is a number or a boolean/null operand rather than an operator.
+func isOperand(token string) bool {
+	if token == "true" || token == "false" || token == "null" {
+		return true
+	}
+	c := token[0]
+	return c == '+' || c == '-' || c == '.' || ('0' <= c && c <= '9')
+}
+
+func isWhiteSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == 0
+}
+
+func isDelimiter(c byte) bool {
+	return c == '(' || c == ')' || c == '<' || c == '>' || c == '[' || c == ']' ||
+		c == '{' || c == '}' || c == '/' || c == '%'
+}
+
+func isRegular(c byte) bool {
+	return !isWhiteSpace(c) && !isDelimiter(c)
+}
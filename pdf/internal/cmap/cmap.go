@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"sort"
 
 	"github.com/unidoc/unidoc/common"
 	"github.com/unidoc/unidoc/pdf/model/textencoding"
@@ -27,6 +28,10 @@ type CMap struct {
 	name       string
 	ctype      int
 	codespaces []codespace
+
+	// Character code to CID mappings of the cidchar and cidrange sections, in order (a cidchar
+	// is a range of one code).
+	cidRanges []cidRange
 }
 
 // codespace represents a single codespace range used in the CMap.
@@ -36,6 +41,15 @@ type codespace struct {
 	high     uint64
 }
 
+// cidRange maps the character codes of `numBytes` bytes from `low` to `high` to consecutive CIDs
+// starting at `cid`.
+type cidRange struct {
+	numBytes int
+	low      uint64
+	high     uint64
+	cid      uint64
+}
+
 // Name returns the name of the CMap.
 func (cmap *CMap) Name() string {
 	return cmap.name
@@ -48,7 +62,28 @@ func (cmap *CMap) Type() int {
 
 // CharcodeBytesToUnicode converts a byte array of charcodes to a unicode string representation.
 func (cmap *CMap) CharcodeBytesToUnicode(src []byte) string {
+	str, _, _ := cmap.CharcodeBytesToUnicodeStats(src)
+	return str
+}
+
+// CharcodeBytesToUnicodeStats converts a byte array of charcodes to a unicode string representation
+// as CharcodeBytesToUnicode.  Also returns the number of codes in `src` and the number of those
+// that were not mapped (and omitted from the output).
+func (cmap *CMap) CharcodeBytesToUnicodeStats(src []byte) (string, int, int) {
+	return cmap.CharcodeBytesToUnicodeReplace(src, "")
+}
+
+// CharcodeBytesToUnicodeReplace converts a byte array of charcodes to a unicode string
+// representation as CharcodeBytesToUnicodeStats, but writes `missing` to the output for each code
+// that is not mapped, e.g. string(MissingCodeRune) to mark the position of unmapped codes.
+func (cmap *CMap) CharcodeBytesToUnicodeReplace(src []byte, missing string) (string, int, int) {
+	if cmap.codespacesCoverMappings() {
+		// Split codes by the codespace ranges, e.g. 1 byte per code for <00> <FF>.
+		return cmap.CharcodeBytesToUnicodeSplit(src, missing, cmap.NextCode)
+	}
+
 	var buf bytes.Buffer
+	numCodes, numMisses := 0, 0
 
 	// Maximum number of possible bytes per code.
 	maxLen := 4
@@ -68,13 +103,284 @@ func (cmap *CMap) CharcodeBytesToUnicode(src []byte) string {
 				buf.WriteString(tgt)
 				break
 			} else if j == maxLen-1 || i+j == len(src)-1 {
+				buf.WriteString(missing)
+				numMisses++
 				break
 			}
 		}
+		numCodes++
 		i += j + 1
 	}
 
-	return buf.String()
+	return buf.String(), numCodes, numMisses
+}
+
+// codespacesCoverMappings returns true if the CMap defines codespace ranges for all code lengths
+// with mappings, in which case the ranges determine the splitting of byte strings into codes.
+// Otherwise (no or inconsistent codespace ranges) codes are split by the lengths of the mapped codes.
+func (cmap *CMap) codespacesCoverMappings() bool {
+	if len(cmap.codespaces) == 0 {
+		return false
+	}
+	var hasLength [4]bool
+	for _, cspace := range cmap.codespaces {
+		if cspace.numBytes >= 1 && cspace.numBytes <= 4 {
+			hasLength[cspace.numBytes-1] = true
+		}
+	}
+	for i, codes := range cmap.codeMap {
+		if len(codes) > 0 && !hasLength[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// CharcodeBytesToUnicodeSplit converts a byte array of charcodes to a unicode string
+// representation as CharcodeBytesToUnicodeReplace, with `src` split into codes by `nextCode`, which
+// returns the code at the start of its argument and its length in bytes.  This suits the ToUnicode
+// CMaps of composite fonts, whose codes are those of the font's Encoding CMap (e.g. split by
+// PdfFont.NextCharcode).  A code that `src` ends within is counted as not mapped.
+func (cmap *CMap) CharcodeBytesToUnicodeSplit(src []byte, missing string, nextCode func([]byte) (uint64, int)) (string, int, int) {
+	var buf bytes.Buffer
+	numCodes, numMisses := 0, 0
+	for i := 0; i < len(src); {
+		code, n := nextCode(src[i:])
+		if n <= 0 {
+			code, n = uint64(src[i]), 1
+		}
+		numCodes++
+		if tgt, has := cmap.lookupCode(code, n); has && i+n <= len(src) {
+			buf.WriteString(tgt)
+		} else {
+			buf.WriteString(missing)
+			numMisses++
+		}
+		i += n
+	}
+	return buf.String(), numCodes, numMisses
+}
+
+// lookupCode returns the unicode string that the character code `code` of `numBytes` bytes maps to.
+// The bool return flag is false if the code is not mapped.
+func (cmap *CMap) lookupCode(code uint64, numBytes int) (string, bool) {
+	if numBytes < 1 || numBytes > 4 {
+		return "", false
+	}
+	tgt, has := cmap.codeMap[numBytes-1][code]
+	return tgt, has
+}
+
+// matches returns true if each byte of `code` is within the corresponding byte range of the
+// codespace range.
+func (cspace codespace) matches(code []byte) bool {
+	n := len(code)
+	for k, b := range code {
+		shift := uint(8 * (n - 1 - k))
+		if uint64(b) < (cspace.low>>shift)&0xff || uint64(b) > (cspace.high>>shift)&0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// NextCode returns the character code at the start of `data` and its length in bytes, as given by
+// the codespace ranges of the CMap (9.7.6.2 "CMap Mapping"): the code whose bytes are each within
+// the byte ranges of a codespace range of its length.  Of several matching codes (overlapping
+// ranges), the shortest mapped one is chosen, or the shortest one if none is mapped.  A code
+// matching no range has the length of the shortest range whose first byte range contains the first
+// byte, or else of the shortest range; such codes map to notdef.  The length can exceed len(`data`)
+// if `data` ends within a code, whose bytes so far are returned as the code.  The length is 0 if
+// the CMap has no codespace ranges or `data` is empty, in which case the splitting into codes is up
+// to the caller.
+func (cmap *CMap) NextCode(data []byte) (uint64, int) {
+	if len(cmap.codespaces) == 0 || len(data) == 0 {
+		return 0, 0
+	}
+
+	numBytes := 0
+	for n := 1; n <= 4 && n <= len(data); n++ {
+		for _, cspace := range cmap.codespaces {
+			if cspace.numBytes != n || !cspace.matches(data[:n]) {
+				continue
+			}
+			if cmap.isMapped(bytesToCode(data[:n]), n) {
+				return bytesToCode(data[:n]), n
+			}
+			if numBytes == 0 {
+				numBytes = n
+			}
+			break
+		}
+	}
+	if numBytes == 0 {
+		// Not matched: the shortest range whose first byte matches, else the shortest range.
+		shortestFirst, shortest := 0, 0
+		for _, cspace := range cmap.codespaces {
+			if cspace.numBytes < 1 || cspace.numBytes > 4 {
+				continue
+			}
+			if shortest == 0 || cspace.numBytes < shortest {
+				shortest = cspace.numBytes
+			}
+			if (shortestFirst == 0 || cspace.numBytes < shortestFirst) && cspace.matchesFirstByte(data[0]) {
+				shortestFirst = cspace.numBytes
+			}
+		}
+		numBytes = shortest
+		if shortestFirst != 0 {
+			numBytes = shortestFirst
+		}
+		if numBytes == 0 {
+			return 0, 0
+		}
+	}
+
+	if numBytes > len(data) {
+		return bytesToCode(data), numBytes
+	}
+	return bytesToCode(data[:numBytes]), numBytes
+}
+
+// bytesToCode returns the character code of the bytes `data`, most significant byte first.
+func bytesToCode(data []byte) uint64 {
+	var code uint64
+	for _, b := range data {
+		code = code<<8 | uint64(b)
+	}
+	return code
+}
+
+// isMapped returns true if the character code `code` of `numBytes` bytes is mapped to unicode or to
+// a CID.
+func (cmap *CMap) isMapped(code uint64, numBytes int) bool {
+	if _, has := cmap.lookupCode(code, numBytes); has {
+		return true
+	}
+	for _, r := range cmap.cidRanges {
+		if r.numBytes == numBytes && code >= r.low && code <= r.high {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesFirstByte returns true if `b` is within the byte range of the first byte of the codespace
+// range.
+func (cspace codespace) matchesFirstByte(b byte) bool {
+	shift := uint(8 * (cspace.numBytes - 1))
+	return uint64(b) >= (cspace.low>>shift)&0xff && uint64(b) <= (cspace.high>>shift)&0xff
+}
+
+// LookupCharcode returns the unicode string that character code `code` maps to.  The bool return
+// flag is false if the code is not mapped.
+func (cmap *CMap) LookupCharcode(code uint64) (string, bool) {
+	for numBytes := 1; numBytes <= 4; numBytes++ {
+		if c, has := cmap.codeMap[numBytes-1][code]; has {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+// ForEach calls `f` for each mapping of the CMap from a character code of `numBytes` bytes to the
+// unicode string `str`, in order of code length and code.  The mappings are those of the bfchar
+// and bfrange sections, with ranges expanded to the individual codes.
+func (cmap *CMap) ForEach(f func(numBytes int, code uint64, str string)) {
+	for i, codes := range cmap.codeMap {
+		sorted := make([]uint64, 0, len(codes))
+		for code := range codes {
+			sorted = append(sorted, code)
+		}
+		sort.Slice(sorted, func(a, b int) bool { return sorted[a] < sorted[b] })
+		for _, code := range sorted {
+			f(i+1, code, codes[code])
+		}
+	}
+}
+
+// HasCIDMappings returns true if the CMap maps character codes to CIDs (cidchar and cidrange
+// sections), as Encoding CMaps of composite fonts do.
+func (cmap *CMap) HasCIDMappings() bool {
+	return len(cmap.cidRanges) > 0
+}
+
+// CharcodeToCID returns the CID that character code `code` maps to (9.7.6.2).  The length of the
+// code is that of the shortest codespace range matching it, or else any length: as codespace
+// ranges do not overlap, codes of different lengths have different values.  Of several mappings of
+// the code, the last one applies.  The bool return flag is false if the code is not mapped or its
+// CID exceeds 65535, in which case the code maps to notdef (CID 0).
+func (cmap *CMap) CharcodeToCID(code uint64) (uint16, bool) {
+	numBytes := cmap.codeLength(code)
+	for i := len(cmap.cidRanges) - 1; i >= 0; i-- {
+		r := cmap.cidRanges[i]
+		if numBytes != 0 && r.numBytes != numBytes || code < r.low || code > r.high {
+			continue
+		}
+		cid := r.cid + code - r.low
+		if cid > 0xffff {
+			return 0, false
+		}
+		return uint16(cid), true
+	}
+	return 0, false
+}
+
+// codeLength returns the length in bytes of the shortest codespace range matching character code
+// `code`, or 0 if none matches.
+func (cmap *CMap) codeLength(code uint64) int {
+	var b [4]byte
+	for n := 1; n <= 4; n++ {
+		if code >= uint64(1)<<(8*uint(n)) {
+			continue
+		}
+		for k := 0; k < n; k++ {
+			b[k] = byte(code >> uint(8*(n-1-k)))
+		}
+		for _, cspace := range cmap.codespaces {
+			if cspace.numBytes == n && cspace.matches(b[:n]) {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// CodespaceCoverage describes a codespace range of a CMap and how many of its codes are mapped.
+type CodespaceCoverage struct {
+	NumBytes  int
+	Low       uint64
+	High      uint64
+	NumMapped int
+}
+
+// Coverage returns the number of mapped codes for each codespace range of the CMap.  If the CMap
+// does not define codespace ranges, the full range of each code length with mappings is reported.
+func (cmap *CMap) Coverage() []CodespaceCoverage {
+	var coverage []CodespaceCoverage
+	for _, cspace := range cmap.codespaces {
+		cov := CodespaceCoverage{NumBytes: cspace.numBytes, Low: cspace.low, High: cspace.high}
+		if cspace.numBytes >= 1 && cspace.numBytes <= 4 {
+			for code := range cmap.codeMap[cspace.numBytes-1] {
+				if code >= cspace.low && code <= cspace.high {
+					cov.NumMapped++
+				}
+			}
+		}
+		coverage = append(coverage, cov)
+	}
+
+	if len(cmap.codespaces) == 0 {
+		for i, codes := range cmap.codeMap {
+			if len(codes) == 0 {
+				continue
+			}
+			high := uint64(1)<<(8*uint(i+1)) - 1
+			coverage = append(coverage, CodespaceCoverage{NumBytes: i + 1, High: high, NumMapped: len(codes)})
+		}
+	}
+
+	return coverage
 }
 
 // CharcodeToUnicode converts a single character code to unicode string.
@@ -149,6 +455,16 @@ func (cmap *CMap) parse() error {
 				if err != nil {
 					return err
 				}
+			} else if op.Operand == begincidchar {
+				err := cmap.parseCIDMappings(endcidchar, false)
+				if err != nil {
+					return err
+				}
+			} else if op.Operand == begincidrange {
+				err := cmap.parseCIDMappings(endcidrange, true)
+				if err != nil {
+					return err
+				}
 			}
 		} else if n, isName := o.(cmapName); isName {
 			if n.Name == cmapname {
@@ -403,3 +719,61 @@ func (cmap *CMap) parseBfrange() error {
 
 	return nil
 }
+
+// parseCIDMappings parses a cidchar section (<code> cid pairs) or, if `isRange` is true, a cidrange
+// section (<low> <high> cid triples) of a CMap, ending with operand `end`.
+func (cmap *CMap) parseCIDMappings(end string, isRange bool) error {
+	for {
+		var codes [2]cmapHexString
+		numCodes := 1
+		if isRange {
+			numCodes = 2
+		}
+		for i := 0; i < numCodes; i++ {
+			o, err := cmap.parseObject()
+			if err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			switch v := o.(type) {
+			case cmapOperand:
+				if v.Operand == end {
+					return nil
+				}
+				return errors.New("Unexpected operand")
+			case cmapHexString:
+				codes[i] = v
+			default:
+				return errors.New("Unexpected type")
+			}
+		}
+		if !isRange {
+			codes[1] = codes[0]
+		}
+
+		o, err := cmap.parseObject()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		cid, ok := o.(cmapInt)
+		if !ok || cid.val < 0 {
+			return errors.New("Invalid CID")
+		}
+
+		numBytes := codes[0].numBytes
+		if numBytes <= 0 || numBytes > 4 || codes[1].numBytes != numBytes {
+			return errors.New("Invalid code length")
+		}
+		low, high := hexToUint64(codes[0]), hexToUint64(codes[1])
+		if low > high {
+			common.Log.Debug("Invalid CID range 0x%X-0x%X", low, high)
+			continue
+		}
+		cmap.cidRanges = append(cmap.cidRanges, cidRange{numBytes: numBytes, low: low, high: high, cid: uint64(cid.val)})
+	}
+}
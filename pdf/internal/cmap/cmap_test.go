@@ -120,6 +120,19 @@ func TestCMapParser1(t *testing.T) {
 		t.Error("Incorrect charcode bytes -> string mapping")
 		return
 	}
+
+	s, numCodes, numMisses := cmap.CharcodeBytesToUnicodeStats([]byte{0x00, 0x03, 0x00, 0x0F, 0x00, 0x99})
+	if s != " ," || numCodes != 3 || numMisses != 1 {
+		t.Errorf("Incorrect stats: %q %d codes, %d misses", s, numCodes, numMisses)
+		return
+	}
+
+	// 8 bfchar + 34 bfrange codes.
+	coverage := cmap.Coverage()
+	if len(coverage) != 1 || coverage[0].NumBytes != 2 || coverage[0].High != 0xFFFF || coverage[0].NumMapped != 42 {
+		t.Errorf("Incorrect coverage: %+v", coverage)
+		return
+	}
 }
 
 const cmap2Data = `
@@ -324,3 +337,258 @@ func TestCMapParser3(t *testing.T) {
 		}
 	}
 }
+
+// ToUnicode CMap of a simple font with a 1-byte codespace.
+const cmapSimpleFont = `
+/CIDInit /ProcSet findresource begin
+12 dict begin
+begincmap
+/CMapName /Adobe-Identity-UCS def
+/CMapType 2 def
+1 begincodespacerange
+<00> <FF>
+endcodespacerange
+2 beginbfchar
+<41> <0041>
+<42> <0042>
+endbfchar
+1 beginbfrange
+<61> <63> <0061>
+endbfrange
+endcmap
+CMapName currentdict /CMap defineresource pop
+end
+end
+`
+
+// Test that byte strings are split into 1-byte codes per the codespace range of a simple font
+// ToUnicode CMap, also around unmapped codes.
+func TestCMapSimpleFontCodespace(t *testing.T) {
+	cmap, err := LoadCmapFromData([]byte(cmapSimpleFont))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	testcases := []struct {
+		Bytes     []byte
+		Expected  string
+		NumMisses int
+	}{
+		{[]byte("ABabc"), "ABabc", 0},
+		{[]byte("A\x99Bc"), "ABc", 1},
+		{[]byte("\x00\x00a"), "a", 2},
+	}
+	for _, tcase := range testcases {
+		str, numCodes, numMisses := cmap.CharcodeBytesToUnicodeStats(tcase.Bytes)
+		if str != tcase.Expected || numCodes != len(tcase.Bytes) || numMisses != tcase.NumMisses {
+			t.Errorf("% X: %q %d %d != %q %d %d", tcase.Bytes, str, numCodes, numMisses,
+				tcase.Expected, len(tcase.Bytes), tcase.NumMisses)
+		}
+	}
+}
+
+// Test replacing unmapped codes with a placeholder.
+func TestCMapMissingCodeReplacement(t *testing.T) {
+	cmap, err := LoadCmapFromData([]byte(cmapSimpleFont))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	for _, missing := range []string{"", string(MissingCodeRune), "<?>"} {
+		str, numCodes, numMisses := cmap.CharcodeBytesToUnicodeReplace([]byte("A\x99Bc\x00"), missing)
+		expected := "A" + missing + "Bc" + missing
+		if str != expected || numCodes != 5 || numMisses != 2 {
+			t.Errorf("%q: %q %d %d != %q 5 2", missing, str, numCodes, numMisses, expected)
+		}
+	}
+}
+
+// Test iterating the mappings of a ToUnicode CMap with bfchar and bfrange entries.
+func TestCMapForEach(t *testing.T) {
+	cmap, err := LoadCmapFromData([]byte(cmap1Data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// 8 bfchar codes and ranges of 9, 3, 2, 3, 9, 5 and 3 codes.
+	count := 0
+	var last uint64
+	cmap.ForEach(func(numBytes int, code uint64, str string) {
+		if numBytes != 2 {
+			t.Errorf("Code 0x%X: %d bytes", code, numBytes)
+		}
+		if count > 0 && code <= last {
+			t.Errorf("Code 0x%X after 0x%X", code, last)
+		}
+		if tgt, _ := cmap.LookupCharcode(code); tgt != str {
+			t.Errorf("Code 0x%X: %q != %q", code, str, tgt)
+		}
+		last = code
+		count++
+	})
+	if count != 42 {
+		t.Errorf("%d mappings, expected 42", count)
+	}
+}
+
+// cmapMixedData is a CMap with 1 and 2 byte codespace ranges (Shift-JIS like).
+const cmapMixedData = `
+/CIDInit /ProcSet findresource begin
+12 dict begin
+begincmap
+/CMapName /Test-Mixed def
+/CMapType 2 def
+4 begincodespacerange
+<00> <80>
+<8140> <9FFC>
+<A0> <DF>
+<E040> <FCFC>
+endcodespacerange
+3 beginbfchar
+<41> <0041>
+<8140> <3000>
+<A1> <FF61>
+endbfchar
+endcmap
+CMapName currentdict /CMap defineresource pop
+end
+end
+`
+
+// Test splitting a string of mixed 1 and 2 byte codes by the codespace ranges.
+func TestCMapNextCode(t *testing.T) {
+	cmap, err := LoadCmapFromData([]byte(cmapMixedData))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	type code struct {
+		code uint64
+		size int
+	}
+	testcases := []struct {
+		data     []byte
+		expected []code
+	}{
+		{[]byte{0x41, 0x81, 0x40, 0xa1, 0x9f, 0xfc, 0x42},
+			[]code{{0x41, 1}, {0x8140, 2}, {0xa1, 1}, {0x9ffc, 2}, {0x42, 1}}},
+		// 0x81 0x20 matches no range: 2 bytes, as the 2 byte range of first byte 0x81.
+		{[]byte{0x81, 0x20, 0x41}, []code{{0x8120, 2}, {0x41, 1}}},
+		// 0xfd matches no first byte: the shortest range.
+		{[]byte{0xfd, 0x41}, []code{{0xfd, 1}, {0x41, 1}}},
+		// Ends within a code.
+		{[]byte{0x41, 0xe0}, []code{{0x41, 1}, {0xe0, 2}}},
+	}
+	for _, tc := range testcases {
+		var codes []code
+		for i := 0; i < len(tc.data); {
+			c, size := cmap.NextCode(tc.data[i:])
+			if size == 0 {
+				t.Fatalf("% x: no code at %d", tc.data, i)
+			}
+			codes = append(codes, code{c, size})
+			i += size
+		}
+		if len(codes) != len(tc.expected) {
+			t.Errorf("% x: codes %v, expected %v", tc.data, codes, tc.expected)
+			continue
+		}
+		for i := range codes {
+			if codes[i] != tc.expected[i] {
+				t.Errorf("% x: codes %v, expected %v", tc.data, codes, tc.expected)
+				break
+			}
+		}
+	}
+
+	if str := cmap.CharcodeBytesToUnicode([]byte{0x41, 0x81, 0x40, 0xa1}); str != "A　｡" {
+		t.Errorf("Text %q", str)
+	}
+
+	// Split by 2 byte codes, as for a composite font with a predefined Encoding CMap.
+	next2 := func(data []byte) (uint64, int) {
+		if len(data) < 2 {
+			return uint64(data[0]), 2
+		}
+		return uint64(data[0])<<8 | uint64(data[1]), 2
+	}
+	str, numCodes, numMisses := cmap.CharcodeBytesToUnicodeSplit([]byte{0x81, 0x40, 0x00, 0x41, 0x81}, "?", next2)
+	if str != "　??" || numCodes != 3 || numMisses != 2 {
+		t.Errorf("Text %q, %d codes, %d misses", str, numCodes, numMisses)
+	}
+
+	// No codespace ranges.
+	cmap, err = LoadCmapFromData([]byte("1 beginbfchar\n<41> <0041>\nendbfchar\n"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, size := cmap.NextCode([]byte{0x41}); size != 0 {
+		t.Errorf("Code of size %d without codespace ranges", size)
+	}
+}
+
+// cmapMixedCIDData is an Encoding CMap with 1 and 2 byte codes mapped to CIDs.
+const cmapMixedCIDData = `
+/CIDInit /ProcSet findresource begin
+12 dict begin
+begincmap
+/CIDSystemInfo << /Registry (Adobe) /Ordering (Test) /Supplement 0 >> def
+/CMapName /Test-Mixed-CID def
+/CMapType 1 def
+2 begincodespacerange
+<00> <80>
+<8140> <9FFC>
+endcodespacerange
+2 begincidrange
+<20> <7E> 1
+<8140> <817E> 633
+endcidrange
+2 begincidchar
+<41> 200
+<8150> 1000
+endcidchar
+endcmap
+CMapName currentdict /CMap defineresource pop
+end
+end
+`
+
+// Test the CIDs of the 1 and 2 byte codes of an Encoding CMap.
+func TestCMapCharcodeToCID(t *testing.T) {
+	cmap, err := LoadCmapFromData([]byte(cmapMixedCIDData))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !cmap.HasCIDMappings() {
+		t.Fatalf("No CID mappings")
+	}
+
+	testcases := []struct {
+		code   uint64
+		cid    uint16
+		mapped bool
+	}{
+		{0x20, 1, true},
+		{0x42, 35, true},
+		{0x41, 200, true}, // cidchar after the cidrange.
+		{0x8140, 633, true},
+		{0x8141, 634, true},
+		{0x8150, 1000, true},
+		{0x817F, 0, false},
+		{0x10, 0, false},
+	}
+	for _, tcase := range testcases {
+		cid, mapped := cmap.CharcodeToCID(tcase.code)
+		if cid != tcase.cid || mapped != tcase.mapped {
+			t.Errorf("0x%X: CID %d (%t), expected %d (%t)", tcase.code, cid, mapped, tcase.cid, tcase.mapped)
+		}
+	}
+
+	cmap, err = LoadCmapFromData([]byte(cmapMixedData))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if cmap.HasCIDMappings() {
+		t.Errorf("CID mappings in a ToUnicode CMap")
+	}
+}
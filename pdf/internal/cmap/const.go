@@ -15,9 +15,17 @@ const (
 	endbfchar           = "endbfchar"
 	beginbfrange        = "beginbfrange"
 	endbfrange          = "endbfrange"
+	begincidchar        = "begincidchar"
+	endcidchar          = "endcidchar"
+	begincidrange       = "begincidrange"
+	endcidrange         = "endcidrange"
 
 	cmapname = "CMapName"
 	cmaptype = "CMapType"
 )
 
+// MissingCodeRune is the Unicode replacement character, for marking character codes that are not
+// mapped to text.
+const MissingCodeRune = '\ufffd'
+
 var reNumeric = regexp.MustCompile(`^[\+-.]*([0-9.]+)`)
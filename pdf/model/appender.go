@@ -0,0 +1,419 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/unidoc/unidoc/common"
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// PdfAppender writes an incremental update of a loaded PDF document: the original file is kept as is
+// and the new and modified objects are appended, followed by a cross-reference section referring
+// to the previous one.
+//
+// For encrypted documents, the appended objects are encrypted with the key and algorithm of the
+// original document, which therefore must have been decrypted (authenticated) with a password.
+// Copies of the appended objects are encrypted, the objects themselves are left unchanged.
+//
+// The cross-reference section of the update has the format of the last one of the original document:
+// a cross-reference stream if the document uses them, a cross-reference table otherwise.
+type PdfAppender struct {
+	reader *PdfReader
+
+	// Modified objects (loaded from the document, or new).
+	updated    []PdfObject
+	updatedMap map[PdfObject]bool
+
+	// New objects numbered by Write, written again by later calls with the same numbers.
+	numbered map[PdfObject]bool
+}
+
+// NewPdfAppender returns a new PdfAppender for an incremental update of the document loaded by `reader`.
+// Returns an error if the document is encrypted and was not decrypted with a valid password.
+func NewPdfAppender(reader *PdfReader) (*PdfAppender, error) {
+	crypter := reader.parser.GetCrypter()
+	if crypter != nil && !reader.parser.IsAuthenticated() {
+		common.Log.Debug("ERROR: Incremental update of encrypted document without authentication")
+		return nil, errors.New("Encrypted document needs to be decrypted before updating")
+	}
+
+	appender := &PdfAppender{}
+	appender.reader = reader
+	appender.updatedMap = map[PdfObject]bool{}
+	appender.numbered = map[PdfObject]bool{}
+	return appender, nil
+}
+
+// UpdateObject marks `obj` as modified so that it is written in the update.  Objects loaded from
+// the document keep their object number, and any new (unnumbered) indirect and stream objects
+// referenced by it are written as well.
+func (this *PdfAppender) UpdateObject(obj PdfObject) {
+	if this.updatedMap[obj] {
+		return
+	}
+	this.updatedMap[obj] = true
+	this.updated = append(this.updated, obj)
+}
+
+// UpdatePage marks `page` as modified, including any new annotations and content streams.
+func (this *PdfAppender) UpdatePage(page *PdfPage) {
+	this.UpdateObject(page.ToPdfObject())
+}
+
+// collectObjects returns the objects to be written: the updated objects and the new objects
+// reachable from them, including those numbered by a previous Write.  The existing objects
+// referenced by those are left untouched.
+func (this *PdfAppender) collectObjects() []PdfObject {
+	var objects []PdfObject
+	seen := map[PdfObject]bool{}
+
+	var traverse func(obj PdfObject)
+	traverse = func(obj PdfObject) {
+		switch t := obj.(type) {
+		case *PdfIndirectObject:
+			if seen[t] {
+				return
+			}
+			seen[t] = true
+			if t.ObjectNumber != 0 && !this.updatedMap[t] && !this.numbered[t] {
+				return
+			}
+			objects = append(objects, t)
+			traverse(t.PdfObject)
+		case *PdfObjectStream:
+			if seen[t] {
+				return
+			}
+			seen[t] = true
+			if t.ObjectNumber != 0 && !this.updatedMap[t] && !this.numbered[t] {
+				return
+			}
+			objects = append(objects, t)
+			traverse(t.PdfObjectDictionary)
+		case *PdfObjectDictionary:
+			for _, key := range t.Keys() {
+				traverse(t.Get(key))
+			}
+		case *PdfObjectArray:
+			for _, o := range *t {
+				traverse(o)
+			}
+		}
+	}
+
+	for _, obj := range this.updated {
+		traverse(obj)
+	}
+	return objects
+}
+
+// Write writes the original document followed by the incremental update to `w`.  Write can be
+// called again, e.g. after further updates: the new objects keep the numbers assigned by the first
+// call, so the same update is written if nothing changed.
+func (this *PdfAppender) Write(w io.Writer) error {
+	parser := this.reader.parser
+	trailer := parser.GetTrailer()
+	if trailer == nil {
+		return errors.New("Missing trailer")
+	}
+
+	objects := this.collectObjects()
+
+	// Number the new objects, reusing the free object numbers of the document with the generation
+	// number of their free entry first, then following the highest object number in use.  The
+	// numbers assigned by a previous call are kept.
+	free := parser.GetFreeObjects()
+	reused := false
+	for _, obj := range objects {
+		if num := getObjectNumber(obj); this.numbered[obj] {
+			if _, isFree := free[num]; isFree {
+				delete(free, num)
+				reused = true
+			}
+		}
+	}
+	var reusable []int64
+	for num, gen := range free {
+		if gen < 65535 {
+			reusable = append(reusable, num)
+		}
+	}
+	sort.Slice(reusable, func(i, j int) bool { return reusable[i] < reusable[j] })
+	nextNum := int64(1)
+	for _, num := range parser.GetObjectNums() {
+		if int64(num) >= nextNum {
+			nextNum = int64(num) + 1
+		}
+	}
+	if size, ok := TraceToDirectObject(trailer.Get("Size")).(*PdfObjectInteger); ok && int64(*size) > nextNum {
+		nextNum = int64(*size)
+	}
+	for _, obj := range objects {
+		if num := getObjectNumber(obj); this.numbered[obj] && num >= nextNum {
+			nextNum = num + 1
+		}
+	}
+	objNums := map[int64]bool{}
+	for _, obj := range objects {
+		num := getObjectNumber(obj)
+		if num == 0 && len(reusable) > 0 {
+			num = reusable[0]
+			reusable = reusable[1:]
+			setObjectNumber(obj, num)
+			setGenerationNumber(obj, free[num])
+			delete(free, num)
+			reused = true
+			this.numbered[obj] = true
+		} else if num == 0 {
+			num = nextNum
+			nextNum++
+			setObjectNumber(obj, num)
+			setGenerationNumber(obj, 0)
+			this.numbered[obj] = true
+		}
+		objNums[num] = true
+	}
+	sort.SliceStable(objects, func(i, j int) bool {
+		return getObjectNumber(objects[i]) < getObjectNumber(objects[j])
+	})
+
+	// Encrypt copies of the appended objects, using their object numbers, with the original key.
+	// The objects they refer to are not encrypted again.  A copy of the security handler keeps the
+	// bookkeeping of the reader's handler unchanged.
+	if crypter := parser.GetCrypter(); crypter != nil {
+		c := *crypter
+		c.EncryptedObjects = map[PdfObject]bool{}
+		for i, obj := range objects {
+			objects[i] = copyAppendedObject(obj)
+			err := c.EncryptObject(objects[i], getObjectNumber(obj), getGenerationNumber(obj))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	cw := &countingWriter{w: w}
+	if _, err := parser.WriteOriginal(cw); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(cw)
+	bw.WriteString("\n")
+
+	// Cross-reference entries of the appended objects.
+	entries := map[int64]appendedXrefEntry{}
+	for _, obj := range objects {
+		bw.Flush()
+		num, gen := getObjectNumber(obj), getGenerationNumber(obj)
+		entries[num] = appendedXrefEntry{inUse: true, offset: cw.n, gen: gen}
+		writeAppendedObject(bw, num, gen, obj)
+	}
+
+	// If free object numbers were reused, the free list is updated: object number 0 and the
+	// remaining free entries are linked in order by the object number of the next entry.  The
+	// entries are written as type 0 entries of a cross-reference stream, or as table entries.
+	if reused {
+		var freeNums []int64
+		for num := range free {
+			freeNums = append(freeNums, num)
+		}
+		sort.Slice(freeNums, func(i, j int) bool { return freeNums[i] < freeNums[j] })
+		freeNums = append([]int64{0}, freeNums...)
+		for i, num := range freeNums {
+			next, gen := int64(0), int64(65535)
+			if i+1 < len(freeNums) {
+				next = freeNums[i+1]
+			}
+			if num != 0 {
+				gen = free[num]
+			}
+			entries[num] = appendedXrefEntry{offset: next, gen: gen}
+		}
+	}
+
+	newTrailer := MakeDict()
+	newTrailer.Set("Size", MakeInteger(nextNum))
+	newTrailer.Set("Prev", MakeInteger(parser.GetXrefOffset()))
+	for _, key := range []PdfObjectName{"Root", "Info", "Encrypt", "ID"} {
+		newTrailer.SetIfNotNil(key, trailer.Get(key))
+	}
+
+	bw.Flush()
+	xrefOffset := cw.n
+	if name, ok := trailer.Get("Type").(*PdfObjectName); ok && *name == "XRef" {
+		// The cross-reference stream is an object of the update itself.
+		entries[nextNum] = appendedXrefEntry{inUse: true, offset: xrefOffset}
+		newTrailer.Set("Size", MakeInteger(nextNum+1))
+		writeAppendedXrefStream(bw, nextNum, entries, newTrailer)
+	} else {
+		writeAppendedXrefTable(bw, entries, newTrailer)
+	}
+	bw.WriteString(fmt.Sprintf("startxref\n%d\n", xrefOffset))
+	bw.WriteString("%%EOF\n")
+
+	return bw.Flush()
+}
+
+// appendedXrefEntry is a cross-reference entry of an incremental update: the offset and generation
+// number of an object in use, or the next free object number and generation number of a free
+// entry.
+type appendedXrefEntry struct {
+	inUse  bool
+	offset int64
+	gen    int64
+}
+
+// appendedXrefSubsections returns the object numbers of `entries` in order, split into runs of
+// consecutive numbers.
+func appendedXrefSubsections(entries map[int64]appendedXrefEntry) [][]int64 {
+	var nums []int64
+	for num := range entries {
+		nums = append(nums, num)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+
+	var subsections [][]int64
+	for i := 0; i < len(nums); {
+		j := i + 1
+		for j < len(nums) && nums[j] == nums[j-1]+1 {
+			j++
+		}
+		subsections = append(subsections, nums[i:j])
+		i = j
+	}
+	return subsections
+}
+
+// writeAppendedXrefTable writes a cross-reference table with `entries`, followed by `trailer`.
+func writeAppendedXrefTable(w *bufio.Writer, entries map[int64]appendedXrefEntry, trailer *PdfObjectDictionary) {
+	w.WriteString("xref\r\n")
+	for _, nums := range appendedXrefSubsections(entries) {
+		w.WriteString(fmt.Sprintf("%d %d\r\n", nums[0], len(nums)))
+		for _, num := range nums {
+			entry := entries[num]
+			flag := "f"
+			if entry.inUse {
+				flag = "n"
+			}
+			w.WriteString(fmt.Sprintf("%.10d %.5d %s\r\n", entry.offset, entry.gen, flag))
+		}
+	}
+	w.WriteString("trailer\n")
+	w.WriteString(trailer.DefaultWriteString())
+	w.WriteString("\n")
+}
+
+// writeAppendedXrefStream writes a cross-reference stream with object number `num`, holding
+// `entries` and the entries of `trailer`.  The stream is not compressed, nor encrypted.
+func writeAppendedXrefStream(w *bufio.Writer, num int64, entries map[int64]appendedXrefEntry, trailer *PdfObjectDictionary) {
+	var data []byte
+	index := PdfObjectArray{}
+	for _, nums := range appendedXrefSubsections(entries) {
+		index = append(index, MakeInteger(nums[0]), MakeInteger(int64(len(nums))))
+		for _, n := range nums {
+			entry := entries[n]
+			xtype := byte(0)
+			if entry.inUse {
+				xtype = 1
+			}
+			off, gen := entry.offset, entry.gen
+			data = append(data, xtype,
+				byte(off>>56), byte(off>>48), byte(off>>40), byte(off>>32),
+				byte(off>>24), byte(off>>16), byte(off>>8), byte(off),
+				byte(gen>>8), byte(gen))
+		}
+	}
+
+	dict := MakeDict()
+	dict.Set("Type", MakeName("XRef"))
+	for _, key := range trailer.Keys() {
+		dict.Set(key, trailer.Get(key))
+	}
+	dict.Set("Index", &index)
+	dict.Set("W", MakeArray(MakeInteger(1), MakeInteger(8), MakeInteger(2)))
+	dict.Set("Length", MakeInteger(int64(len(data))))
+
+	stream := &PdfObjectStream{PdfObjectDictionary: dict, Stream: data}
+	writeAppendedObject(w, num, 0, stream)
+}
+
+// copyAppendedObject returns a copy of the indirect or stream object `obj` for encrypting it, with
+// its own copy of the strings and stream data to be encrypted.  The indirect and stream objects
+// referred to from `obj` are not copied.
+func copyAppendedObject(obj PdfObject) PdfObject {
+	switch t := obj.(type) {
+	case *PdfIndirectObject:
+		return &PdfIndirectObject{PdfObjectReference: t.PdfObjectReference, PdfObject: copyAppendedDirect(t.PdfObject)}
+	case *PdfObjectStream:
+		stream := &PdfObjectStream{PdfObjectReference: t.PdfObjectReference}
+		stream.PdfObjectDictionary = copyAppendedDirect(t.PdfObjectDictionary).(*PdfObjectDictionary)
+		data, err := t.DecryptedStream()
+		if err != nil {
+			common.Log.Debug("ERROR: Unable to decrypt stream %d: %v", t.ObjectNumber, err)
+			data = t.Stream
+		}
+		stream.Stream = append([]byte(nil), data...)
+		return stream
+	}
+	return obj
+}
+
+// copyAppendedDirect copies the direct object `obj` and its direct subobjects.
+func copyAppendedDirect(obj PdfObject) PdfObject {
+	switch t := obj.(type) {
+	case *PdfObjectDictionary:
+		dict := MakeDict()
+		for _, key := range t.Keys() {
+			dict.Set(key, copyAppendedDirect(t.Get(key)))
+		}
+		return dict
+	case *PdfObjectArray:
+		arr := make(PdfObjectArray, len(*t))
+		for i, item := range *t {
+			arr[i] = copyAppendedDirect(item)
+		}
+		return &arr
+	case *PdfObjectString:
+		return MakeString(string(*t))
+	}
+	return obj
+}
+
+// writeAppendedObject writes the indirect or stream object `obj` with object number `num` and
+// generation number `gen` to `w`.
+func writeAppendedObject(w *bufio.Writer, num, gen int64, obj PdfObject) {
+	if pobj, isIndirect := obj.(*PdfIndirectObject); isIndirect {
+		w.WriteString(fmt.Sprintf("%d %d obj\n", num, gen))
+		w.WriteString(pobj.PdfObject.DefaultWriteString())
+		w.WriteString("\nendobj\n")
+		return
+	}
+
+	if pobj, isStream := obj.(*PdfObjectStream); isStream {
+		w.WriteString(fmt.Sprintf("%d %d obj\n", num, gen))
+		w.WriteString(pobj.PdfObjectDictionary.DefaultWriteString())
+		w.WriteString("\nstream\n")
+		w.Write(pobj.Stream)
+		w.WriteString("\nendstream\nendobj\n")
+	}
+}
+
+// countingWriter counts the bytes written through it, to track object offsets.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
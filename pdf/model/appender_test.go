@@ -0,0 +1,394 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// Test an incremental update of an AES-128 encrypted document adding an annotation.
+func TestAppenderEncryptedAddAnnotation(t *testing.T) {
+	w := NewPdfWriter()
+	page := NewPdfPage()
+	page.Resources = NewPdfPageResources()
+	page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+	page.AddContentStreamByString("BT /F1 12 Tf 10 10 Td (Original text) Tj ET")
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	err := w.Encrypt([]byte("user"), []byte("owner"), &EncryptOptions{Algorithm: AES_128bit})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	original, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	reader, err := NewPdfReader(bytes.NewReader(original))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// Refused without authentication.
+	if _, err := NewPdfAppender(reader); err == nil {
+		t.Fatalf("Appender should require authentication")
+	}
+
+	if ok, err := reader.Decrypt([]byte("user")); !ok || err != nil {
+		t.Fatalf("Decrypt failed (%v)", err)
+	}
+	page, err = reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	annot := NewPdfAnnotationText()
+	annot.Contents = MakeString("New note")
+	annot.Rect = MakeArrayFromFloats([]float64{100, 100, 200, 200})
+	page.Annotations = append(page.Annotations, annot.PdfAnnotation)
+
+	appender, err := NewPdfAppender(reader)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	appender.UpdatePage(page)
+	var buf bytes.Buffer
+	if err := appender.Write(&buf); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	updated := buf.Bytes()
+	if !bytes.HasPrefix(updated, original) {
+		t.Fatalf("Original file not preserved")
+	}
+	if bytes.Contains(updated[len(original):], []byte("New note")) {
+		t.Errorf("Appended string not encrypted")
+	}
+	// The objects of the reader are left unencrypted.
+	if str, ok := annot.Contents.(*PdfObjectString); !ok || string(*str) != "New note" {
+		t.Errorf("Annotation contents modified: %v", annot.Contents)
+	}
+
+	// Reopen with the original password.
+	reader, err = NewPdfReader(bytes.NewReader(updated))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if ok, err := reader.Decrypt([]byte("user")); !ok || err != nil {
+		t.Fatalf("Decrypt failed (%v)", err)
+	}
+	page, err = reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	contents, err := page.GetAllContentStreams()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !strings.Contains(contents, "(Original text)") {
+		t.Errorf("Original content missing: %q", contents)
+	}
+	if len(page.Annotations) != 1 {
+		t.Fatalf("Expected 1 annotation, got %d", len(page.Annotations))
+	}
+	str, ok := TraceToDirectObject(page.Annotations[0].Contents).(*PdfObjectString)
+	if !ok || string(*str) != "New note" {
+		t.Errorf("Invalid annotation contents %v", page.Annotations[0].Contents)
+	}
+}
+
+// Test that generation numbers round trip: the objects with generation 2 of the fixture keep their
+// generation when rewritten and updated, and an incremental update reuses a free object number
+// with the generation of its free entry and relinks the free list.
+func TestAppenderGenerations(t *testing.T) {
+	original, err := ioutil.ReadFile("../../testfiles/generations.pdf")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	reader, err := NewPdfReader(bytes.NewReader(original))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if free := reader.parser.GetFreeObjects(); !reflect.DeepEqual(free, map[int64]int64{5: 3, 6: 1}) {
+		t.Errorf("Free objects %v", free)
+	}
+
+	// Rewritten document.
+	page, err := reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	w := NewPdfWriter()
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	rewritten, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkGenerations := func(data []byte, pageGen int64) *PdfPage {
+		reader, err := NewPdfReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		page, err := reader.GetPage(1)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if gen := page.GetPageAsIndirectObject().GenerationNumber; gen != pageGen {
+			t.Errorf("Page generation %d != %d", gen, pageGen)
+		}
+		contents, err := page.GetAllContentStreams()
+		if err != nil || !strings.Contains(contents, "(Generation two)") {
+			t.Errorf("Content missing: %q (%v)", contents, err)
+		}
+		return page
+	}
+	checkGenerations(rewritten, 2)
+
+	// Incremental update adding an annotation to the page.
+	reader, err = NewPdfReader(bytes.NewReader(original))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	page, err = reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	annot := NewPdfAnnotationText()
+	annot.Contents = MakeString("Note")
+	annot.Rect = MakeArrayFromFloats([]float64{100, 100, 200, 200})
+	page.Annotations = append(page.Annotations, annot.PdfAnnotation)
+	appender, err := NewPdfAppender(reader)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	appender.UpdatePage(page)
+	var buf bytes.Buffer
+	if err := appender.Write(&buf); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	appended := string(buf.Bytes()[len(original):])
+	for _, expected := range []string{
+		"3 2 obj\n", "5 3 obj\n", "/Annots [5 3 R]", "/Contents 4 2 R",
+		"0 1\r\n0000000006 65535 f\r\n", "5 2\r\n", " 00003 n\r\n0000000000 00001 f\r\n",
+	} {
+		if !strings.Contains(appended, expected) {
+			t.Errorf("Missing %q in update:\n%s", expected, appended)
+		}
+	}
+
+	page = checkGenerations(buf.Bytes(), 2)
+	if len(page.Annotations) != 1 {
+		t.Fatalf("Expected 1 annotation, got %d", len(page.Annotations))
+	}
+	container, ok := page.Annotations[0].GetContainingPdfObject().(*PdfIndirectObject)
+	if !ok || container.ObjectNumber != 5 || container.GenerationNumber != 3 {
+		t.Errorf("Annotation object %v", page.Annotations[0].GetContainingPdfObject())
+	}
+	reader, err = NewPdfReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if free := reader.parser.GetFreeObjects(); !reflect.DeepEqual(free, map[int64]int64{6: 1}) {
+		t.Errorf("Free objects after update %v", free)
+	}
+}
+
+// makeXrefStreamPDF returns a one page document with a cross-reference stream, and `free` free
+// object numbers of generation 1 following the objects in use.
+func makeXrefStreamPDF(free int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.5\n")
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] >>",
+	}
+	offsets := []int{}
+	for i, obj := range objects {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xrefOffset := buf.Len()
+	xrefNum := len(objects) + free + 1
+
+	// The free list links object number 0 and the free object numbers in order.
+	entry := func(xtype byte, field int, gen byte) []byte {
+		return []byte{xtype, byte(field >> 24), byte(field >> 16), byte(field >> 8), byte(field), gen}
+	}
+	next := func(num int) int {
+		if num == 0 && free > 0 {
+			return len(objects) + 1
+		}
+		if num > len(objects) && num+1 < xrefNum {
+			return num + 1
+		}
+		return 0
+	}
+	data := entry(0, next(0), 0xff)
+	for _, offset := range offsets {
+		data = append(data, entry(1, offset, 0)...)
+	}
+	for num := len(objects) + 1; num < xrefNum; num++ {
+		data = append(data, entry(0, next(num), 1)...)
+	}
+	data = append(data, entry(1, xrefOffset, 0)...)
+	fmt.Fprintf(&buf, "%d 0 obj\n<< /Type /XRef /Size %d /W [1 4 1] /Root 1 0 R /Length %d >>\nstream\n",
+		xrefNum, xrefNum+1, len(data))
+	buf.Write(data)
+	fmt.Fprintf(&buf, "\nendstream\nendobj\nstartxref\n%d\n%%%%EOF\n", xrefOffset)
+	return buf.Bytes()
+}
+
+// Test that an incremental update of a document with a cross-reference stream has a
+// cross-reference stream as well.
+func TestAppenderXrefStream(t *testing.T) {
+	original := makeXrefStreamPDF(0)
+	reader, err := NewPdfReader(bytes.NewReader(original))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	page, err := reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	annot := NewPdfAnnotationText()
+	annot.Contents = MakeString("Note")
+	annot.Rect = MakeArrayFromFloats([]float64{100, 100, 200, 200})
+	page.Annotations = append(page.Annotations, annot.PdfAnnotation)
+
+	appender, err := NewPdfAppender(reader)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	appender.UpdatePage(page)
+	var buf bytes.Buffer
+	if err := appender.Write(&buf); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	appended := string(buf.Bytes()[len(original):])
+	if strings.Contains(appended, "xref\r\n") || strings.Contains(appended, "trailer") {
+		t.Errorf("Cross-reference table in update:\n%s", appended)
+	}
+	for _, expected := range []string{"/Type /XRef", "/Prev ", "/Size 7", "/Index [3 1 5 2]"} {
+		if !strings.Contains(appended, expected) {
+			t.Errorf("Missing %q in update:\n%q", expected, appended)
+		}
+	}
+
+	reader, err = NewPdfReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	page, err = reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(page.Annotations) != 1 {
+		t.Fatalf("Expected 1 annotation, got %d", len(page.Annotations))
+	}
+	str, ok := TraceToDirectObject(page.Annotations[0].Contents).(*PdfObjectString)
+	if !ok || string(*str) != "Note" {
+		t.Errorf("Invalid annotation contents %v", page.Annotations[0].Contents)
+	}
+}
+
+// Test that an incremental update of a document with a cross-reference stream reusing a free
+// object number updates the free list in the cross-reference stream.
+func TestAppenderXrefStreamFreeList(t *testing.T) {
+	original := makeXrefStreamPDF(2)
+	reader, err := NewPdfReader(bytes.NewReader(original))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if free := reader.parser.GetFreeObjects(); !reflect.DeepEqual(free, map[int64]int64{4: 1, 5: 1}) {
+		t.Fatalf("Free objects %v", free)
+	}
+	page, err := reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	annot := NewPdfAnnotationText()
+	annot.Contents = MakeString("Note")
+	annot.Rect = MakeArrayFromFloats([]float64{100, 100, 200, 200})
+	page.Annotations = append(page.Annotations, annot.PdfAnnotation)
+
+	appender, err := NewPdfAppender(reader)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	appender.UpdatePage(page)
+	var buf bytes.Buffer
+	if err := appender.Write(&buf); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	appended := string(buf.Bytes()[len(original):])
+	if strings.Contains(appended, "xref\r\n") {
+		t.Errorf("Cross-reference table in update:\n%s", appended)
+	}
+	for _, expected := range []string{"4 1 obj\n", "/Annots [4 1 R]", "/Index [0 1 3 3 7 1]", "/Size 8"} {
+		if !strings.Contains(appended, expected) {
+			t.Errorf("Missing %q in update:\n%q", expected, appended)
+		}
+	}
+
+	// Writing again gives the same update, and the objects numbered by the first call keep their
+	// numbers when more objects are added.
+	var again bytes.Buffer
+	if err := appender.Write(&again); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !bytes.Equal(again.Bytes(), buf.Bytes()) {
+		t.Errorf("Second write differs:\n%q", again.Bytes()[len(original):])
+	}
+	annot2 := NewPdfAnnotationText()
+	annot2.Contents = MakeString("Second note")
+	annot2.Rect = MakeArrayFromFloats([]float64{300, 300, 400, 400})
+	page.Annotations = append(page.Annotations, annot2.PdfAnnotation)
+	appender.UpdatePage(page)
+	again.Reset()
+	if err := appender.Write(&again); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	appended2 := string(again.Bytes()[len(original):])
+	for _, expected := range []string{"4 1 obj\n", "5 1 obj\n", "/Annots [4 1 R 5 1 R]", "/Size 8"} {
+		if !strings.Contains(appended2, expected) {
+			t.Errorf("Missing %q in second update:\n%q", expected, appended2)
+		}
+	}
+	if reader2, err := NewPdfReader(bytes.NewReader(again.Bytes())); err != nil {
+		t.Errorf("Error: %v", err)
+	} else if free := reader2.parser.GetFreeObjects(); len(free) != 0 {
+		t.Errorf("Free objects after second update %v", free)
+	}
+
+	reader, err = NewPdfReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if free := reader.parser.GetFreeObjects(); !reflect.DeepEqual(free, map[int64]int64{5: 1}) {
+		t.Errorf("Free objects after update %v", free)
+	}
+	page, err = reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(page.Annotations) != 1 {
+		t.Fatalf("Expected 1 annotation, got %d", len(page.Annotations))
+	}
+	container, ok := page.Annotations[0].GetContainingPdfObject().(*PdfIndirectObject)
+	if !ok || container.ObjectNumber != 4 || container.GenerationNumber != 1 {
+		t.Errorf("Annotation object %v", page.Annotations[0].GetContainingPdfObject())
+	}
+}
@@ -578,15 +578,18 @@ func (this *PdfColorspaceDeviceCMYK) ColorToRGB(color PdfColor) (PdfColor, error
 	y := cmyk.Y()
 	k := cmyk.K()
 
+	r, g, b := cmykToRGB(c, m, y, k)
+
+	return NewPdfColorDeviceRGB(r, g, b), nil
+}
+
+// cmykToRGB converts the CMYK components `c`, `m`, `y` and `k` to RGB components.  All components
+// are in the range 0 to 1.
+func cmykToRGB(c, m, y, k float64) (r, g, b float64) {
 	c = c*(1-k) + k
 	m = m*(1-k) + k
 	y = y*(1-k) + k
-
-	r := 1 - c
-	g := 1 - m
-	b := 1 - y
-
-	return NewPdfColorDeviceRGB(r, g, b), nil
+	return 1 - c, 1 - m, 1 - y
 }
 
 func (this *PdfColorspaceDeviceCMYK) ImageToRGB(img Image) (Image, error) {
@@ -625,13 +628,7 @@ func (this *PdfColorspaceDeviceCMYK) ImageToRGB(img Image) (Image, error) {
 		y := interpolate(float64(samples[i+2]), 0, maxVal, decode[4], decode[5])
 		k := interpolate(float64(samples[i+3]), 0, maxVal, decode[6], decode[7])
 
-		c = c*(1-k) + k
-		m = m*(1-k) + k
-		y = y*(1-k) + k
-
-		r := 1 - c
-		g := 1 - m
-		b := 1 - y
+		r, g, b := cmykToRGB(c, m, y, k)
 
 		// Convert to uint32 format.
 		R := uint32(r * maxVal)
@@ -643,6 +640,8 @@ func (this *PdfColorspaceDeviceCMYK) ImageToRGB(img Image) (Image, error) {
 	}
 	rgbImage.SetSamples(rgbSamples)
 	rgbImage.ColorComponents = 3
+	// The samples are decoded.
+	rgbImage.decode = nil
 
 	return rgbImage, nil
 }
@@ -1618,6 +1617,8 @@ func (this *PdfColorspaceLab) ImageToRGB(img Image) (Image, error) {
 		rgbSamples = append(rgbSamples, R, G, B)
 	}
 	rgbImage.SetSamples(rgbSamples)
+	// The samples are decoded.
+	rgbImage.decode = nil
 	rgbImage.ColorComponents = 3
 
 	return rgbImage, nil
@@ -2280,7 +2281,8 @@ func (this *PdfColorspaceSpecialIndexed) ImageToRGB(img Image) (Image, error) {
 	baseImage.Height = img.Height
 	baseImage.Width = img.Width
 	baseImage.alphaData = img.alphaData
-	baseImage.BitsPerComponent = img.BitsPerComponent
+	// The lookup table has 8 bit components.
+	baseImage.BitsPerComponent = 8
 	baseImage.hasAlpha = img.hasAlpha
 	baseImage.ColorComponents = img.ColorComponents
 
@@ -2490,50 +2492,85 @@ func (this *PdfColorspaceSpecialSeparation) ColorToRGB(color PdfColor) (PdfColor
 // ImageToRGB converts an image with samples in Separation CS to an image with samples specified in
 // DeviceRGB CS.
 func (this *PdfColorspaceSpecialSeparation) ImageToRGB(img Image) (Image, error) {
+	common.Log.Trace("Separation color space -> ToRGB conversion")
+	common.Log.Trace("TintTransform: %+v", this.TintTransform)
+	return tintImageToRGB(img, 1, this.TintTransform, this.AlternateSpace)
+}
+
+// tintImageToRGB converts image `img` with `n` tint components per sample, as used by Separation
+// and DeviceN colorspaces, to the colorspace `alternate` via `tintTransform` and from there to an
+// image with samples in DeviceRGB CS.
+func tintImageToRGB(img Image, n int, tintTransform PdfFunction, alternate PdfColorspace) (Image, error) {
+	if tintTransform == nil || alternate == nil {
+		return img, errors.New("Tint transform or alternate colorspace undefined")
+	}
 	altImage := img
 
 	samples := img.GetSamples()
 	maxVal := math.Pow(2, float64(img.BitsPerComponent)) - 1
-
-	common.Log.Trace("Separation color space -> ToRGB conversion")
 	common.Log.Trace("samples in: %d", len(samples))
-	common.Log.Trace("TintTransform: %+v", this.TintTransform)
 
-	altDecode := this.AlternateSpace.DecodeArray()
+	// The image's Decode array maps the samples to tints, [0 1] per component by default.
+	decode := img.decode
+	if len(decode) != 2*n {
+		decode = nil
+		for i := 0; i < n; i++ {
+			decode = append(decode, 0, 1)
+		}
+	}
+	altDecode := alternate.DecodeArray()
+	numAlt := alternate.GetNumComponents()
 
-	altSamples := []uint32{}
-	// Convert tints to color data in the alternate colorspace.
-	for i := 0; i < len(samples); i++ {
-		// A single tint component is in the range 0.0 - 1.0
-		tint := float64(samples[i]) / maxVal
+	// Tint transforms are often evaluated for few distinct tints, e.g. 256 for an 8 bit Separation
+	// image, so the results are cached.
+	cache := map[string][]uint32{}
+	key := make([]byte, 4*n)
 
-		// Convert the tint value to the alternate space value.
-		outputs, err := this.TintTransform.Evaluate([]float64{tint})
-		//common.Log.Trace("%v Converting tint value: %f -> [% f]", this.AlternateSpace, tint, outputs)
+	altSamples := make([]uint32, 0, len(samples)/n*numAlt)
+	inputs := make([]float64, n)
+	for i := 0; i+n <= len(samples); i += n {
+		for j := 0; j < n; j++ {
+			v := samples[i+j]
+			key[4*j], key[4*j+1], key[4*j+2], key[4*j+3] = byte(v>>24), byte(v>>16), byte(v>>8), byte(v)
+		}
+		if alt, has := cache[string(key)]; has {
+			altSamples = append(altSamples, alt...)
+			continue
+		}
 
+		// Convert the tint values to the alternate space values.
+		for j := 0; j < n; j++ {
+			inputs[j] = interpolate(float64(samples[i+j]), 0, maxVal, decode[2*j], decode[2*j+1])
+		}
+		outputs, err := tintTransform.Evaluate(inputs)
 		if err != nil {
 			return img, err
 		}
+		if len(outputs) != numAlt {
+			common.Log.Debug("ERROR: Tint transform returned %d values, alternate space has %d components",
+				len(outputs), numAlt)
+			return img, errors.New("Range check")
+		}
 
-		for i, val := range outputs {
-			// Convert component value to 0-1 range.
-			altVal := interpolate(val, altDecode[i*2], altDecode[i*2+1], 0, 1)
-
-			// Rescale to [0, maxVal]
-			altComponent := uint32(altVal * maxVal)
-
-			altSamples = append(altSamples, altComponent)
+		alt := make([]uint32, numAlt)
+		for j, val := range outputs {
+			// Convert component value to 0-1 range of the alternate space and rescale to [0, maxVal].
+			altVal := interpolate(val, altDecode[j*2], altDecode[j*2+1], 0, 1)
+			altVal = math.Min(math.Max(altVal, 0), 1)
+			alt[j] = uint32(altVal*maxVal + 0.5)
 		}
+		cache[string(key)] = alt
+		altSamples = append(altSamples, alt...)
 	}
 	common.Log.Trace("Samples out: %d", len(altSamples))
+	altImage.ColorComponents = numAlt
 	altImage.SetSamples(altSamples)
-	altImage.ColorComponents = this.AlternateSpace.GetNumComponents()
 
 	// Set the image's decode parameters for interpretation in the alternative CS.
 	altImage.decode = altDecode
 
 	// Convert to RGB via the alternate colorspace.
-	return this.AlternateSpace.ImageToRGB(altImage)
+	return alternate.ImageToRGB(altImage)
 }
 
 //////////////////////
@@ -2700,44 +2737,10 @@ func (this *PdfColorspaceDeviceN) ColorToRGB(color PdfColor) (PdfColor, error) {
 	return this.AlternateSpace.ColorToRGB(color)
 }
 
+// ImageToRGB converts an image with samples in DeviceN CS to an image with samples specified in
+// DeviceRGB CS.
 func (this *PdfColorspaceDeviceN) ImageToRGB(img Image) (Image, error) {
-	altImage := img
-
-	samples := img.GetSamples()
-	maxVal := math.Pow(2, float64(img.BitsPerComponent)) - 1
-
-	// Convert tints to color data in the alternate colorspace.
-	altSamples := []uint32{}
-	for i := 0; i < len(samples); i += this.GetNumComponents() {
-		// The input to the tint transformation is the tint
-		// for each color component.
-		//
-		// A single tint component is in the range 0.0 - 1.0
-		inputs := []float64{}
-		for j := 0; j < this.GetNumComponents(); j++ {
-			tint := float64(samples[i+j]) / maxVal
-			inputs = append(inputs, tint)
-		}
-
-		// Transform the tints to the alternate colorspace.
-		// (scaled units).
-		outputs, err := this.TintTransform.Evaluate(inputs)
-		if err != nil {
-			return img, err
-		}
-
-		for _, val := range outputs {
-			// Clip.
-			val = math.Min(math.Max(0, val), 1.0)
-			// Rescale to [0, maxVal]
-			altComponent := uint32(val * maxVal)
-			altSamples = append(altSamples, altComponent)
-		}
-	}
-	altImage.SetSamples(altSamples)
-
-	// Convert to RGB via the alternate colorspace.
-	return this.AlternateSpace.ImageToRGB(altImage)
+	return tintImageToRGB(img, this.GetNumComponents(), this.TintTransform, this.AlternateSpace)
 }
 
 // Additional information about the components of colour space that conforming readers may use.
@@ -6,17 +6,39 @@
 package model
 
 import (
-	"fmt"
+	"math"
 	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
 )
 
+// parseTestFunction returns the function object of indirect object `rawText`.
+func parseTestFunction(t *testing.T, rawText string) PdfObject {
+	obj, err := NewParserFromString(rawText).ParseIndirectObject()
+	if err != nil {
+		t.Fatalf("Failed to parse function: %v", err)
+	}
+	return obj
+}
+
+// checkRGBSamples checks that the samples of 8 bit RGB image `img` are within 1 of `expected`.
+func checkRGBSamples(t *testing.T, img Image, expected []uint32) {
+	samples := img.GetSamples()
+	if img.ColorComponents != 3 || len(samples) != len(expected) {
+		t.Fatalf("Unexpected RGB image: %d components, samples %v", img.ColorComponents, samples)
+	}
+	for i := range samples {
+		if d := int(samples[i]) - int(expected[i]); d < -1 || d > 1 {
+			t.Errorf("RGB samples %v, expected %v", samples, expected)
+			return
+		}
+	}
+}
+
+// Test converting an image in a Separation colorspace (spot color) to RGB via the tint transform.
 func TestSeparationCS1(t *testing.T) {
-	rawObject := `
-% Colour space
-5 0 obj
-[ /Separation /LogoGreen /DeviceCMYK 12 0 R ]
-endobj
-% Tint transformation function
+	// Example 1 in 8.6.6.4 "Separation Color Spaces": tint t -> CMYK (0.84t, 0, 0.44t, 0.21t).
+	tintTransform := parseTestFunction(t, `
 12 0 obj
 <<
 	/FunctionType 4
@@ -29,18 +51,91 @@ stream
 exch 0.00 exch dup 0.44 mul exch 0.21 mul
 }
 endstream endobj
-	`
+`)
+	csObj := MakeArray(MakeName("Separation"), MakeName("LogoGreen"), MakeName("DeviceCMYK"), tintTransform)
+	cs, err := NewPdfColorspaceFromPdfObject(csObj)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, ok := cs.(*PdfColorspaceSpecialSeparation); !ok {
+		t.Fatalf("Not a Separation colorspace: %T", cs)
+	}
 
-	// Test a few lookups and see if it is accurate.
-	// Test rgb conversion for a few specific values also.
+	// A 3x1 image with tints 0, 1 and 0.5 loaded as image XObject.
+	dict := MakeDict()
+	dict.Set("Type", MakeName("XObject"))
+	dict.Set("Subtype", MakeName("Image"))
+	dict.Set("Width", MakeInteger(3))
+	dict.Set("Height", MakeInteger(1))
+	dict.Set("BitsPerComponent", MakeInteger(8))
+	dict.Set("ColorSpace", csObj)
+	stream := &PdfObjectStream{PdfObjectDictionary: dict, Stream: []byte{0, 255, 128}}
+	ximg, err := NewXObjectImageFromStream(stream)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	img, err := ximg.ToImage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	rgb, err := ximg.ColorSpace.ImageToRGB(*img)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
 
-	fmt.Println(rawObject)
+	// Tint 0 is white (no ink), tint 1 the full spot color CMYK (0.84 0 0.44 0.21).
+	checkRGBSamples(t, rgb, []uint32{255, 255, 255, 32, 201, 112, 131, 228, 177})
 
-	//t.Errorf("Test not implemented yet")
+	// Colors set with the scn operator convert the same way.
+	color, err := cs.ColorFromFloats([]float64{1})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	rgbColor, err := cs.ColorToRGB(color)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if r, g, b := rgbColor.(*PdfColorDeviceRGB).R(), rgbColor.(*PdfColorDeviceRGB).G(), rgbColor.(*PdfColorDeviceRGB).B(); math.Abs(r-0.1264) > 0.01 || math.Abs(g-0.79) > 0.01 || math.Abs(b-0.4424) > 0.01 {
+		t.Errorf("Unexpected RGB color %.3f %.3f %.3f", r, g, b)
+	}
 }
 
+// Test converting an image in a DeviceN colorspace to RGB, with a sampled (Type 0) tint transform
+// and an inverted Decode array.
 func TestDeviceNCS1(t *testing.T) {
-	// Implement Example 3 on p. 172
+	// Two colorants mapped to RGB: the first to red, the second to blue, sampled at the corners.
+	tintTransform := parseTestFunction(t, `
+13 0 obj
+<<
+	/FunctionType 0
+	/Domain [0 1 0 1]
+	/Range [0 1 0 1 0 1]
+	/Size [2 2]
+	/BitsPerSample 8
+	/Filter /ASCIIHexDecode
+	/Length 37
+>>
+stream
+FFFFFF 00FFFF FFFF00 00FF00>
+endstream endobj
+`)
+	csObj := MakeArray(MakeName("DeviceN"), MakeArray(MakeName("Spot1"), MakeName("Spot2")),
+		MakeName("DeviceRGB"), tintTransform)
+	cs, err := NewPdfColorspaceFromPdfObject(csObj)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if cs.GetNumComponents() != 2 {
+		t.Fatalf("Wrong number of components %d", cs.GetNumComponents())
+	}
 
-	//t.Errorf("Test not implemented yet")
+	img := Image{Width: 3, Height: 1, BitsPerComponent: 8, ColorComponents: 2,
+		Data: []byte{255, 255, 0, 255, 127, 255}}
+	// Inverted Decode: sample 255 is tint 0.
+	img.decode = []float64{1, 0, 1, 0}
+	rgb, err := cs.ImageToRGB(img)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkRGBSamples(t, rgb, []uint32{255, 255, 255, 0, 255, 255, 128, 255, 255})
 }
@@ -16,4 +16,16 @@ var (
 
 	// ErrRangeError typically occurs when an input parameter is out of range or has invalid value.
 	ErrRangeError = errors.New("Range check error")
+
+	// ErrOwnerPasswordRequired occurs when saving a document with new encryption parameters (e.g.
+	// permissions), which needs the owner password of the original document.
+	ErrOwnerPasswordRequired = errors.New("Owner password required")
+
+	// ErrPasswordDeclined occurs when loading an encrypted document whose password callback
+	// declined to provide a password (ReaderOpts).
+	ErrPasswordDeclined = errors.New("Password declined")
+
+	// ErrIncorrectPassword occurs when loading an encrypted document whose password callback did
+	// not provide a correct password within the allowed attempts (ReaderOpts).
+	ErrIncorrectPassword = errors.New("Incorrect password")
 )
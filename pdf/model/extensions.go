@@ -0,0 +1,193 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/unidoc/unidoc/common"
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// PdfDeveloperExtension represents a developer extensions dictionary, declaring the base version
+// and level of a developer's extensions to PDF (7.12.3).
+type PdfDeveloperExtension struct {
+	BaseVersion    string // PDF version the extensions are based on, e.g. "1.7".
+	ExtensionLevel int64
+
+	primitive *PdfObjectDictionary
+}
+
+// NewPdfDeveloperExtension returns a new developer extension with base version `baseVersion` (such
+// as "1.7") and extension level `level`.
+func NewPdfDeveloperExtension(baseVersion string, level int64) *PdfDeveloperExtension {
+	ext := &PdfDeveloperExtension{}
+	ext.BaseVersion = baseVersion
+	ext.ExtensionLevel = level
+	ext.primitive = MakeDict()
+	return ext
+}
+
+func newPdfDeveloperExtensionFromPdfObject(obj PdfObject) (*PdfDeveloperExtension, error) {
+	dict, ok := TraceToDirectObject(obj).(*PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("Developer extensions not a dictionary (%T)", obj)
+		return nil, errors.New("Type check error")
+	}
+
+	ext := &PdfDeveloperExtension{}
+	ext.primitive = dict
+
+	name, ok := TraceToDirectObject(dict.Get("BaseVersion")).(*PdfObjectName)
+	if !ok {
+		common.Log.Debug("ERROR: Developer extensions BaseVersion missing")
+		return nil, errors.New("Required attribute missing")
+	}
+	ext.BaseVersion = string(*name)
+
+	level, ok := TraceToDirectObject(dict.Get("ExtensionLevel")).(*PdfObjectInteger)
+	if !ok {
+		common.Log.Debug("ERROR: Developer extensions ExtensionLevel missing")
+		return nil, errors.New("Required attribute missing")
+	}
+	ext.ExtensionLevel = int64(*level)
+
+	return ext, nil
+}
+
+// GetBaseVersion returns the major and minor version numbers of the base version.
+func (ext *PdfDeveloperExtension) GetBaseVersion() (int, int, error) {
+	var major, minor int
+	if _, err := fmt.Sscanf(ext.BaseVersion, "%d.%d", &major, &minor); err != nil {
+		return 0, 0, fmt.Errorf("Invalid base version %q", ext.BaseVersion)
+	}
+	return major, minor, nil
+}
+
+func (ext *PdfDeveloperExtension) ToPdfObject() PdfObject {
+	dict := ext.primitive
+
+	if dict.Get("Type") != nil {
+		setIfChanged(dict, "Type", MakeName("DeveloperExtensions"))
+	}
+	setIfChanged(dict, "BaseVersion", MakeName(ext.BaseVersion))
+	setIfChanged(dict, "ExtensionLevel", MakeInteger(ext.ExtensionLevel))
+
+	return dict
+}
+
+// PdfExtensions represents the extensions dictionary of the document catalog, which declares the
+// developer extensions to PDF that the document uses (7.12.2).  The extensions of Adobe
+// (prefix ADBE) are given by ADBE, those of other developers are kept as is in Others by prefix.
+//
+// Entries are only regenerated if modified, so that loading and saving leaves the declarations
+// unchanged.
+type PdfExtensions struct {
+	ADBE   *PdfDeveloperExtension
+	Others map[PdfObjectName]PdfObject
+
+	primitive *PdfObjectDictionary
+}
+
+// NewPdfExtensions returns a new empty extensions dictionary.
+func NewPdfExtensions() *PdfExtensions {
+	exts := &PdfExtensions{}
+	exts.Others = map[PdfObjectName]PdfObject{}
+	exts.primitive = MakeDict()
+	return exts
+}
+
+func newPdfExtensionsFromPdfObject(obj PdfObject) (*PdfExtensions, error) {
+	dict, ok := TraceToDirectObject(obj).(*PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("Extensions not a dictionary (%T)", obj)
+		return nil, errors.New("Type check error")
+	}
+
+	exts := &PdfExtensions{}
+	exts.Others = map[PdfObjectName]PdfObject{}
+	exts.primitive = dict
+
+	for _, key := range dict.Keys() {
+		val := dict.Get(key)
+		switch key {
+		case "Type":
+			continue
+		case "ADBE":
+			// PDF 2.0 allows an array of developer extensions dictionaries, which is kept as is.
+			if _, isDict := TraceToDirectObject(val).(*PdfObjectDictionary); isDict {
+				ext, err := newPdfDeveloperExtensionFromPdfObject(val)
+				if err != nil {
+					return nil, err
+				}
+				exts.ADBE = ext
+				continue
+			}
+		}
+		exts.Others[key] = val
+	}
+
+	return exts, nil
+}
+
+// GetMinimumVersion returns the highest base version of the declared extensions, which is the
+// minimum version of a document declaring them.  Returns false if no base version is known.
+func (exts *PdfExtensions) GetMinimumVersion() (int, int, bool) {
+	var devs []*PdfDeveloperExtension
+	if exts.ADBE != nil {
+		devs = append(devs, exts.ADBE)
+	}
+	for _, val := range exts.Others {
+		if ext, err := newPdfDeveloperExtensionFromPdfObject(val); err == nil {
+			devs = append(devs, ext)
+		}
+	}
+
+	found := false
+	var major, minor int
+	for _, ext := range devs {
+		maj, min, err := ext.GetBaseVersion()
+		if err != nil {
+			common.Log.Debug("Ignoring developer extension: %v", err)
+			continue
+		}
+		if !found || maj > major || maj == major && min > minor {
+			major, minor = maj, min
+			found = true
+		}
+	}
+	return major, minor, found
+}
+
+func (exts *PdfExtensions) ToPdfObject() PdfObject {
+	dict := exts.primitive
+
+	for _, key := range append([]PdfObjectName{}, dict.Keys()...) {
+		if _, has := exts.Others[key]; !has && key != "Type" && (key != "ADBE" || exts.ADBE == nil) {
+			dict.Remove(key)
+		}
+	}
+	if exts.ADBE != nil {
+		if TraceToDirectObject(dict.Get("ADBE")) != exts.ADBE.primitive {
+			dict.Set("ADBE", exts.ADBE.primitive)
+		}
+		exts.ADBE.ToPdfObject()
+	}
+	var keys []PdfObjectName
+	for key := range exts.Others {
+		if key != "ADBE" || exts.ADBE == nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	for _, key := range keys {
+		setIfChanged(dict, key, exts.Others[key])
+	}
+
+	return dict
+}
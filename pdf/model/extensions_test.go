@@ -0,0 +1,176 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// Test that the ADBE extension level 8 declaration of an Acrobat file and a private trailer entry
+// are kept through the writer, and that the output version follows the extension base version.
+func TestExtensionsRoundTrip(t *testing.T) {
+	original, err := ioutil.ReadFile("../../testfiles/extensionlevel8.pdf")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	reader, err := NewPdfReader(bytes.NewReader(original))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	exts, err := reader.GetExtensions()
+	if err != nil || exts == nil {
+		t.Fatalf("Error loading extensions: %v", err)
+	}
+	if exts.ADBE == nil || exts.ADBE.BaseVersion != "1.7" || exts.ADBE.ExtensionLevel != 8 || len(exts.Others) != 0 {
+		t.Fatalf("Unexpected extensions %+v", exts)
+	}
+	before := exts.ToPdfObject().DefaultWriteString()
+
+	page, err := reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	trailer, err := reader.GetTrailer()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	w := NewPdfWriter()
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := w.SetExtensions(exts); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := w.SetTrailerEntry("AcroPrivate", trailer.Get("AcroPrivate")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := w.SetTrailerEntry("Root", MakeNull()); err == nil {
+		t.Errorf("Setting reserved trailer entry should fail")
+	}
+	data, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF-1.7\n")) {
+		t.Errorf("Version not raised to extension base version: %q", data[:9])
+	}
+
+	reader, err = NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	exts, err = reader.GetExtensions()
+	if err != nil || exts == nil {
+		t.Fatalf("Extensions lost: %v", err)
+	}
+	if after := exts.ToPdfObject().DefaultWriteString(); after != before {
+		t.Errorf("Extensions changed:\n%s\n%s", before, after)
+	}
+	trailer, err = reader.GetTrailer()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if str, ok := trailer.Get("AcroPrivate").(*PdfObjectString); !ok || string(*str) != "kept" {
+		t.Errorf("Private trailer entry lost: %s", trailer)
+	}
+}
+
+// Test that the extensions and the private trailer entries of the document the pages are loaded
+// from are carried over by default, and can be dropped.
+func TestExtensionsCarriedOver(t *testing.T) {
+	original, err := ioutil.ReadFile("../../testfiles/extensionlevel8.pdf")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for _, drop := range []bool{false, true} {
+		reader, err := NewPdfReader(bytes.NewReader(original))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		page, err := reader.GetPage(1)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		w := NewPdfWriter()
+		if err := w.AddPage(page); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if drop {
+			if err := w.SetExtensions(nil); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if err := w.SetTrailerEntry("AcroPrivate", nil); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+		}
+		data, err := writeToBytes(&w)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		reader, err = NewPdfReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		exts, err := reader.GetExtensions()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		trailer, err := reader.GetTrailer()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		private := trailer.Get("AcroPrivate")
+		if drop {
+			if exts != nil || private != nil {
+				t.Errorf("Dropped entries written: %+v, %v", exts, private)
+			}
+			continue
+		}
+		if exts == nil || exts.ADBE == nil || exts.ADBE.ExtensionLevel != 8 {
+			t.Errorf("Extensions not carried over: %+v", exts)
+		}
+		if str, ok := private.(*PdfObjectString); !ok || string(*str) != "kept" {
+			t.Errorf("Private trailer entry not carried over: %s", trailer)
+		}
+		if !bytes.HasPrefix(data, []byte("%PDF-1.7\n")) {
+			t.Errorf("Version not raised to extension base version: %q", data[:9])
+		}
+	}
+}
+
+// Test declaring extensions of several developers, with the minimum version from the highest
+// base version.
+func TestExtensionsMinimumVersion(t *testing.T) {
+	exts := NewPdfExtensions()
+	if _, _, ok := exts.GetMinimumVersion(); ok {
+		t.Errorf("No version expected without extensions")
+	}
+
+	exts.ADBE = NewPdfDeveloperExtension("1.7", 3)
+	other := NewPdfDeveloperExtension("2.0", 1)
+	exts.Others["XMPL"] = other.ToPdfObject()
+	if major, minor, ok := exts.GetMinimumVersion(); !ok || major != 2 || minor != 0 {
+		t.Errorf("Minimum version %d.%d (%v), expected 2.0", major, minor, ok)
+	}
+
+	expected := "<</ADBE <</BaseVersion /1.7/ExtensionLevel 3>>/XMPL <</BaseVersion /2.0/ExtensionLevel 1>>>>"
+	if str := exts.ToPdfObject().DefaultWriteString(); str != expected {
+		t.Errorf("%s != %s", str, expected)
+	}
+
+	delete(exts.Others, "XMPL")
+	exts.ADBE.ExtensionLevel = 8
+	expected = "<</ADBE <</BaseVersion /1.7/ExtensionLevel 8>>>>"
+	if str := exts.ToPdfObject().DefaultWriteString(); str != expected {
+		t.Errorf("%s != %s", str, expected)
+	}
+}
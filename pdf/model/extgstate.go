@@ -0,0 +1,378 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/unidoc/unidoc/common"
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// Rendering intents (8.6.5.8 - Table 70).
+const (
+	RenderingIntentAbsoluteColorimetric PdfObjectName = "AbsoluteColorimetric"
+	RenderingIntentRelativeColorimetric PdfObjectName = "RelativeColorimetric"
+	RenderingIntentSaturation           PdfObjectName = "Saturation"
+	RenderingIntentPerceptual           PdfObjectName = "Perceptual"
+)
+
+// PdfExtGState is a graphics state parameter dictionary (8.4.5 - Table 58), as given by the
+// ExtGState resources and set with the gs operator.  Unset (nil) parameters are left unchanged by
+// the gs operator.  Entries other than the typed ones are kept as loaded.
+type PdfExtGState struct {
+	LW   *float64        // Line width.
+	LC   *int64          // Line cap style.
+	LJ   *int64          // Line join style.
+	ML   *float64        // Miter limit.
+	D    *PdfObjectArray // Dash pattern: [dashArray dashPhase].
+	RI   *PdfObjectName  // Rendering intent.
+	Font *PdfObjectArray // Font and size: [font size], the font an indirect reference.
+	CA   *float64        // Stroking alpha constant (CA).
+	Ca   *float64        // Nonstroking alpha constant (ca).
+	BM   *PdfObjectName  // Blend mode, e.g. Normal or Multiply.
+	AIS  *bool           // Alpha source flag: alpha constants and soft mask are shape rather than opacity.
+
+	// Soft mask: the name None or a soft mask dictionary.
+	SMask PdfObject
+
+	// Dictionary as loaded, with the entries not typed above.
+	primitive *PdfObjectDictionary
+}
+
+// extGStateKeys are the keys of the typed parameters of PdfExtGState.
+var extGStateKeys = []PdfObjectName{"LW", "LC", "LJ", "ML", "D", "RI", "Font", "CA", "ca", "BM", "AIS", "SMask"}
+
+// NewPdfExtGState returns a new graphics state parameter dictionary with no parameters set.
+func NewPdfExtGState() *PdfExtGState {
+	return &PdfExtGState{primitive: MakeDict()}
+}
+
+// NewPdfExtGStateFromPdfObject loads the graphics state parameter dictionary `obj`, a dictionary or
+// an indirect object containing one.  Parameters of an invalid type are dropped.  A blend mode given
+// by an array (PDF 1.4) is taken as its first name.
+func NewPdfExtGStateFromPdfObject(obj PdfObject) (*PdfExtGState, error) {
+	d, ok := TraceToDirectObject(obj).(*PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("ExtGState not a dictionary (%T)", obj)
+		return nil, ErrTypeError
+	}
+
+	gs := &PdfExtGState{primitive: MakeDict()}
+	for _, key := range d.Keys() {
+		gs.primitive.Set(key, d.Get(key))
+	}
+
+	getFloat := func(key PdfObjectName) *float64 {
+		obj := TraceToDirectObject(d.Get(key))
+		if obj == nil {
+			return nil
+		}
+		val, err := getNumberAsFloat(obj)
+		if err != nil {
+			common.Log.Debug("Incompatibility: ExtGState %s not a number (%T)", key, obj)
+			return nil
+		}
+		return &val
+	}
+	getInt := func(key PdfObjectName) *int64 {
+		obj := TraceToDirectObject(d.Get(key))
+		if obj == nil {
+			return nil
+		}
+		val, err := getNumberAsInt64(obj)
+		if err != nil {
+			common.Log.Debug("Incompatibility: ExtGState %s not a number (%T)", key, obj)
+			return nil
+		}
+		return &val
+	}
+	getArray := func(key PdfObjectName) *PdfObjectArray {
+		obj := TraceToDirectObject(d.Get(key))
+		if obj == nil {
+			return nil
+		}
+		arr, ok := obj.(*PdfObjectArray)
+		if !ok || len(*arr) != 2 {
+			common.Log.Debug("Incompatibility: ExtGState %s not an array of 2 elements (%v)", key, obj)
+			return nil
+		}
+		return arr
+	}
+	getName := func(key PdfObjectName) *PdfObjectName {
+		obj := TraceToDirectObject(d.Get(key))
+		if arr, ok := obj.(*PdfObjectArray); ok && key == "BM" && len(*arr) > 0 {
+			obj = TraceToDirectObject((*arr)[0])
+		}
+		if obj == nil {
+			return nil
+		}
+		name, ok := obj.(*PdfObjectName)
+		if !ok {
+			common.Log.Debug("Incompatibility: ExtGState %s not a name (%T)", key, obj)
+			return nil
+		}
+		return name
+	}
+
+	gs.LW = getFloat("LW")
+	gs.LC = getInt("LC")
+	gs.LJ = getInt("LJ")
+	gs.ML = getFloat("ML")
+	gs.D = getArray("D")
+	gs.RI = getName("RI")
+	gs.Font = getArray("Font")
+	gs.CA = getFloat("CA")
+	gs.Ca = getFloat("ca")
+	gs.BM = getName("BM")
+	if obj := TraceToDirectObject(d.Get("AIS")); obj != nil {
+		if b, ok := obj.(*PdfObjectBool); ok {
+			val := bool(*b)
+			gs.AIS = &val
+		} else {
+			common.Log.Debug("Incompatibility: ExtGState AIS not a boolean (%T)", obj)
+		}
+	}
+	gs.SMask = d.Get("SMask")
+
+	return gs, nil
+}
+
+// GetRenderingIntent returns the rendering intent RI, with RelativeColorimetric used for intents
+// that are not recognized (8.6.5.8).  The bool flag is false if RI is not set.
+func (this *PdfExtGState) GetRenderingIntent() (PdfObjectName, bool) {
+	if this.RI == nil {
+		return "", false
+	}
+	switch *this.RI {
+	case RenderingIntentAbsoluteColorimetric, RenderingIntentRelativeColorimetric,
+		RenderingIntentSaturation, RenderingIntentPerceptual:
+		return *this.RI, true
+	}
+	common.Log.Debug("Unknown rendering intent %s - using %s", *this.RI, RenderingIntentRelativeColorimetric)
+	return RenderingIntentRelativeColorimetric, true
+}
+
+// ToPdfObject returns the graphics state parameter dictionary with the typed parameters and the
+// other entries as loaded.
+func (this *PdfExtGState) ToPdfObject() PdfObject {
+	if this.primitive == nil {
+		this.primitive = MakeDict()
+	}
+	d := this.primitive
+	for _, key := range extGStateKeys {
+		d.Remove(key)
+	}
+
+	if this.LW != nil {
+		d.Set("LW", MakeFloat(*this.LW))
+	}
+	if this.LC != nil {
+		d.Set("LC", MakeInteger(*this.LC))
+	}
+	if this.LJ != nil {
+		d.Set("LJ", MakeInteger(*this.LJ))
+	}
+	if this.ML != nil {
+		d.Set("ML", MakeFloat(*this.ML))
+	}
+	if this.D != nil {
+		d.Set("D", this.D)
+	}
+	if this.RI != nil {
+		d.Set("RI", MakeName(string(*this.RI)))
+	}
+	if this.Font != nil {
+		d.Set("Font", this.Font)
+	}
+	if this.CA != nil {
+		d.Set("CA", MakeFloat(*this.CA))
+	}
+	if this.Ca != nil {
+		d.Set("ca", MakeFloat(*this.Ca))
+	}
+	if this.BM != nil {
+		d.Set("BM", MakeName(string(*this.BM)))
+	}
+	if this.AIS != nil {
+		d.Set("AIS", MakeBool(*this.AIS))
+	}
+	d.SetIfNotNil("SMask", this.SMask)
+
+	return d
+}
+
+// AddPdfExtGState adds graphics state parameter dictionary `gs` to the ExtGState resources under a
+// name which is not used yet, GS0, GS1, etc., and returns the name.  If the dictionary of `gs` is
+// already in the resources, its name is returned.
+func (r *PdfPageResources) AddPdfExtGState(gs *PdfExtGState) (PdfObjectName, error) {
+	if r.ExtGState == nil {
+		r.ExtGState = MakeDict()
+	}
+	dict, ok := TraceToDirectObject(r.ExtGState).(*PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("ExtGState type error (got %T)", r.ExtGState)
+		return "", ErrTypeError
+	}
+
+	gsObj := gs.ToPdfObject()
+	for _, key := range dict.Keys() {
+		if TraceToDirectObject(dict.Get(key)) == gsObj {
+			return key, nil
+		}
+	}
+
+	i := 0
+	name := PdfObjectName(fmt.Sprintf("GS%d", i))
+	for dict.Get(name) != nil {
+		i++
+		name = PdfObjectName(fmt.Sprintf("GS%d", i))
+	}
+	dict.Set(name, gsObj)
+	return name, nil
+}
+
+// GetSoftMask returns the soft mask dictionary SMask, or nil if SMask is not set or None.
+func (this *PdfExtGState) GetSoftMask() (*PdfSoftMask, error) {
+	if name, ok := TraceToDirectObject(this.SMask).(*PdfObjectName); this.SMask == nil || ok && *name == "None" {
+		return nil, nil
+	}
+	return NewPdfSoftMaskFromPdfObject(this.SMask)
+}
+
+// PdfSoftMask is a soft-mask dictionary (11.6.5.2 - Table 144), as given by the SMask parameter of
+// a graphics state parameter dictionary.  The mask values are derived from transparency group G,
+// from its alpha or its luminosity, and mapped by transfer function TR.
+type PdfSoftMask struct {
+	S  PdfObjectName // Subtype: Alpha or Luminosity.
+	G  PdfObject     // Transparency group XObject.
+	BC []float64     // Backdrop color of the group (Luminosity), black if nil.
+	TR PdfFunction   // Transfer function of the mask values, nil for the Identity function.
+
+	primitive *PdfObjectDictionary
+}
+
+// NewPdfSoftMaskFromPdfObject loads the soft mask dictionary `obj`, a dictionary or an indirect
+// object containing one.  The loaded dictionary is not modified by ToPdfObject, which returns a
+// copy with the other entries.
+func NewPdfSoftMaskFromPdfObject(obj PdfObject) (*PdfSoftMask, error) {
+	d, ok := TraceToDirectObject(obj).(*PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("Soft mask not a dictionary (%T)", obj)
+		return nil, ErrTypeError
+	}
+
+	sm := &PdfSoftMask{primitive: MakeDict()}
+	for _, key := range d.Keys() {
+		sm.primitive.Set(key, d.Get(key))
+	}
+	s, ok := TraceToDirectObject(d.Get("S")).(*PdfObjectName)
+	if !ok {
+		common.Log.Debug("Soft mask S missing")
+		return nil, ErrRequiredAttributeMissing
+	}
+	sm.S = *s
+	sm.G = d.Get("G")
+
+	if arr, ok := TraceToDirectObject(d.Get("BC")).(*PdfObjectArray); ok {
+		bc, err := arr.ToFloat64Array()
+		if err != nil {
+			return nil, err
+		}
+		sm.BC = bc
+	}
+
+	if tr := d.Get("TR"); tr != nil {
+		if name, ok := TraceToDirectObject(tr).(*PdfObjectName); ok {
+			if *name != "Identity" {
+				common.Log.Debug("Invalid soft mask TR name %s", *name)
+				return nil, ErrInvalidAttribute
+			}
+		} else {
+			fun, err := newPdfFunctionFromPdfObject(tr)
+			if err != nil {
+				return nil, err
+			}
+			sm.TR = fun
+		}
+	}
+
+	return sm, nil
+}
+
+// Transfer returns mask value `val` mapped by the transfer function TR, clipped to 0 to 1.
+func (this *PdfSoftMask) Transfer(val float64) (float64, error) {
+	if this.TR == nil {
+		return val, nil
+	}
+	out, err := this.TR.Evaluate([]float64{val})
+	if err != nil {
+		return 0, err
+	}
+	if len(out) != 1 {
+		common.Log.Debug("Soft mask TR has %d outputs, expected 1", len(out))
+		return 0, ErrRangeError
+	}
+	return math.Max(0, math.Min(1, out[0])), nil
+}
+
+// ApplyTransfer maps the samples of mask `mask`, an image with 1 color component giving the mask
+// values, by the transfer function TR.  The Decode array of the mask is applied to the samples.
+func (this *PdfSoftMask) ApplyTransfer(mask *Image) error {
+	if mask.ColorComponents != 1 {
+		return errors.New("Soft mask image must have 1 color component")
+	}
+	if this.TR == nil {
+		return nil
+	}
+
+	decode := mask.decode
+	if len(decode) != 2 {
+		decode = []float64{0, 1}
+	}
+	maxVal := float64(uint32(1)<<uint(mask.BitsPerComponent) - 1)
+
+	// Mapped values of the sample values, at most 2^16.
+	mapped := map[uint32]uint32{}
+	samples := mask.GetSamples()
+	for i, sample := range samples {
+		val, has := mapped[sample]
+		if !has {
+			out, err := this.Transfer(decode[0] + float64(sample)*(decode[1]-decode[0])/maxVal)
+			if err != nil {
+				return err
+			}
+			val = uint32(out*maxVal + 0.5)
+			mapped[sample] = val
+		}
+		samples[i] = val
+	}
+	mask.SetSamples(samples)
+	mask.decode = nil
+	return nil
+}
+
+// ToPdfObject returns the soft mask dictionary.
+func (this *PdfSoftMask) ToPdfObject() PdfObject {
+	if this.primitive == nil {
+		this.primitive = MakeDict()
+	}
+	d := this.primitive
+	d.Set("Type", MakeName("Mask"))
+	d.Set("S", MakeName(string(this.S)))
+	d.SetIfNotNil("G", this.G)
+	d.Remove("BC")
+	if this.BC != nil {
+		d.Set("BC", MakeArrayFromFloats(this.BC))
+	}
+	d.Remove("TR")
+	if this.TR != nil {
+		d.Set("TR", this.TR.ToPdfObject())
+	}
+	return d
+}
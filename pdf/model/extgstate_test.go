@@ -0,0 +1,192 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// Test writing and reading back a graphics state parameter dictionary, keeping unknown entries.
+func TestPdfExtGState(t *testing.T) {
+	gs := NewPdfExtGState()
+	alpha := 0.3
+	blendMode := PdfObjectName("Multiply")
+	gs.Ca = &alpha
+	gs.BM = &blendMode
+
+	resources := NewPdfPageResources()
+	resources.AddExtGState("GS0", MakeDict())
+	name, err := resources.AddPdfExtGState(gs)
+	if err != nil || name != "GS1" {
+		t.Fatalf("Name %s (%v), expected GS1", name, err)
+	}
+	if name, _ := resources.AddPdfExtGState(gs); name != "GS1" {
+		t.Errorf("Same ExtGState added as %s", name)
+	}
+	if !resources.HasExtGState("GS1") || resources.HasExtGState("GS2") {
+		t.Errorf("Unexpected ExtGState names")
+	}
+
+	dict := gs.ToPdfObject().(*PdfObjectDictionary)
+	dict.Set("OPM", MakeInteger(1))
+	dict.Set("LW", MakeString("invalid"))
+	loaded, err := NewPdfExtGStateFromPdfObject(MakeIndirectObject(dict))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if loaded.Ca == nil || *loaded.Ca != 0.3 || loaded.BM == nil || *loaded.BM != "Multiply" {
+		t.Errorf("Unexpected ca %v and BM %v", loaded.Ca, loaded.BM)
+	}
+	if loaded.CA != nil || loaded.LW != nil || loaded.SMask != nil {
+		t.Errorf("Unexpected CA %v, LW %v or SMask %v", loaded.CA, loaded.LW, loaded.SMask)
+	}
+
+	width := 2.5
+	loaded.LW = &width
+	loaded.SMask = MakeName("None")
+	expected := "<</OPM 1/LW 2.5/ca 0.3/BM /Multiply/SMask /None>>"
+	if s := loaded.ToPdfObject().DefaultWriteString(); s != expected {
+		t.Errorf("%s, expected %s", s, expected)
+	}
+
+	// Unknown rendering intents fall back to RelativeColorimetric.
+	intent := PdfObjectName("Vivid")
+	loaded.RI = &intent
+	if ri, ok := loaded.GetRenderingIntent(); !ok || ri != RenderingIntentRelativeColorimetric {
+		t.Errorf("Rendering intent %s", ri)
+	}
+	intent = RenderingIntentSaturation
+	if ri, ok := loaded.GetRenderingIntent(); !ok || ri != RenderingIntentSaturation {
+		t.Errorf("Rendering intent %s", ri)
+	}
+}
+
+// Test that a watermark is painted with the alpha of its ExtGState.
+func TestWatermarkExtGState(t *testing.T) {
+	page := NewPdfPage()
+	page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+	page.Resources = NewPdfPageResources()
+	page.Resources.AddExtGState("GS0", MakeDict())
+	img := &Image{Width: 1, Height: 1, BitsPerComponent: 8, ColorComponents: 1, Data: []byte{0x80}}
+	ximg, err := NewXObjectImageFromImage(img, nil, NewRawEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := page.AddWatermarkImage(ximg, WatermarkImageOptions{Alpha: 0.3}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	w := NewPdfWriter()
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	page, err = reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	obj, found := page.Resources.GetExtGState("GS1")
+	if !found {
+		t.Fatalf("Watermark ExtGState not found")
+	}
+	gs, err := NewPdfExtGStateFromPdfObject(obj)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if gs.CA == nil || *gs.CA != 0.3 || gs.Ca == nil || *gs.Ca != 0.3 {
+		t.Errorf("Watermark alpha CA %v ca %v, expected 0.3", gs.CA, gs.Ca)
+	}
+	contents, err := page.GetAllContentStreams()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !strings.Contains(contents, "/GS1 gs") {
+		t.Errorf("Watermark not painted with GS1: %q", contents)
+	}
+}
+
+// Test the transfer function of a soft mask dictionary applied to mask samples.
+func TestSoftMaskTransfer(t *testing.T) {
+	gsDict, err := NewParserFromString("<< /SMask << /Type /Mask /S /Luminosity /BC [0.5] " +
+		"/TR << /FunctionType 2 /Domain [0 1] /C0 [1] /C1 [0] /N 1 >> >> >>").ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	gs, err := NewPdfExtGStateFromPdfObject(gsDict)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	sm, err := gs.GetSoftMask()
+	if err != nil || sm == nil {
+		t.Fatalf("Soft mask %v (%v)", sm, err)
+	}
+	if sm.S != "Luminosity" || len(sm.BC) != 1 || sm.BC[0] != 0.5 || sm.TR == nil {
+		t.Errorf("Unexpected soft mask S %s, BC %v, TR %v", sm.S, sm.BC, sm.TR)
+	}
+
+	// Writing a modified soft mask leaves the loaded dictionary unchanged.
+	sm.BC = nil
+	written := sm.ToPdfObject().(*PdfObjectDictionary)
+	if loaded := TraceToDirectObject(gsDict.Get("SMask")).(*PdfObjectDictionary); loaded.Get("BC") == nil || loaded.Get("Type") == nil {
+		t.Errorf("Loaded soft mask modified: %s", loaded)
+	}
+	if written.Get("BC") != nil || written.Get("TR") == nil {
+		t.Errorf("Written soft mask %s", written)
+	}
+
+	// The inverting transfer function, with a Decode array of the mask.
+	mask := &Image{Width: 4, Height: 1, BitsPerComponent: 8, ColorComponents: 1, Data: []byte{0, 64, 128, 255}}
+	if err := sm.ApplyTransfer(mask); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !bytes.Equal(mask.Data, []byte{255, 191, 127, 0}) {
+		t.Errorf("Mask data %v", mask.Data)
+	}
+	mask = &Image{Width: 2, Height: 1, BitsPerComponent: 8, ColorComponents: 1, Data: []byte{0, 255}, decode: []float64{1, 0}}
+	if err := sm.ApplyTransfer(mask); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !bytes.Equal(mask.Data, []byte{0, 255}) || mask.decode != nil {
+		t.Errorf("Mask data %v, decode %v", mask.Data, mask.decode)
+	}
+
+	// Identity and None.
+	for _, text := range []string{"<< /SMask << /S /Alpha /TR /Identity >> >>", "<< /SMask /None >>"} {
+		gsDict, err := NewParserFromString(text).ParseDict()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		gs, err := NewPdfExtGStateFromPdfObject(gsDict)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		sm, err := gs.GetSoftMask()
+		if err != nil {
+			t.Fatalf("%s: Error: %v", text, err)
+		}
+		if sm == nil {
+			continue
+		}
+		if sm.TR != nil {
+			t.Errorf("%s: TR %v", text, sm.TR)
+		}
+		if v, err := sm.Transfer(0.25); err != nil || v != 0.25 {
+			t.Errorf("%s: Identity transfer %g (%v)", text, v, err)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+
+	"github.com/unidoc/unidoc/common"
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// FilterPolicy decides the filters of the streams written by PdfWriter.  It is consulted for every
+// stream when the document is written, with the object number and dictionary of the stream and
+// the encoder of its current filters.  The returned encoder replaces the current filters, or the
+// stream is kept as is if nil (or `currentEnc` itself) is returned.
+//
+// Encoders that the returned encoder shares with `currentEnc` as innermost filters (e.g. the
+// encoders of a MultiEncoder from GetEncoders) are not decoded and encoded again, so a policy can
+// add outer filters to image data such as DCTDecode without recompressing it.
+//
+// The policy is not applied to streams whose bytes must be preserved: ICC profiles (ICCBased
+// colorspaces and output intent profiles), private application data reachable from PieceInfo
+// dictionaries and, in PDF/A documents, XMP metadata streams.  Documents containing a signature
+// dictionary are written with the filters of all streams as they are, as the streams are covered
+// by the signature.  PdfAppender keeps the signed revisions untouched and does not apply a policy.
+type FilterPolicy interface {
+	StreamEncoder(objNum int64, dict *PdfObjectDictionary, currentEnc StreamEncoder) StreamEncoder
+}
+
+// FilterPolicyFunc is a function implementing FilterPolicy.
+type FilterPolicyFunc func(objNum int64, dict *PdfObjectDictionary, currentEnc StreamEncoder) StreamEncoder
+
+// StreamEncoder returns the encoder for the stream, as returned by the function.
+func (f FilterPolicyFunc) StreamEncoder(objNum int64, dict *PdfObjectDictionary, currentEnc StreamEncoder) StreamEncoder {
+	return f(objNum, dict, currentEnc)
+}
+
+// KeepFiltersPolicy returns a filter policy that keeps the original filters of all streams.
+func KeepFiltersPolicy() FilterPolicy {
+	return FilterPolicyFunc(func(int64, *PdfObjectDictionary, StreamEncoder) StreamEncoder {
+		return nil
+	})
+}
+
+// NoLZWPolicy returns a filter policy that replaces LZWDecode filters with FlateDecode.
+func NoLZWPolicy() FilterPolicy {
+	return FilterPolicyFunc(func(objNum int64, dict *PdfObjectDictionary, currentEnc StreamEncoder) StreamEncoder {
+		hasLZW := false
+		var encoders []StreamEncoder
+		for _, enc := range encoderChain(currentEnc) {
+			if _, isLZW := enc.(*LZWEncoder); isLZW {
+				hasLZW = true
+				enc = NewFlateEncoder()
+			}
+			encoders = append(encoders, enc)
+		}
+		if !hasLZW {
+			return nil
+		}
+		return makeEncoderFromChain(encoders)
+	})
+}
+
+// ASCIIArmorPolicy returns a filter policy that adds an outermost ASCII85Decode filter to all
+// streams that are not ASCII encoded yet, so the output file is 7-bit clean (e.g. email-safe).
+func ASCIIArmorPolicy() FilterPolicy {
+	return FilterPolicyFunc(func(objNum int64, dict *PdfObjectDictionary, currentEnc StreamEncoder) StreamEncoder {
+		encoders := encoderChain(currentEnc)
+		if len(encoders) > 0 {
+			switch encoders[0].(type) {
+			case *ASCII85Encoder, *ASCIIHexEncoder:
+				return nil
+			}
+		}
+		return makeEncoderFromChain(append([]StreamEncoder{NewASCII85Encoder()}, encoders...))
+	})
+}
+
+// FlatePolicy returns a filter policy that compresses all streams with FlateDecode at compression
+// level `level` (1 to 9).  Image data compressed with image specific filters (DCTDecode,
+// JPXDecode, JBIG2Decode and CCITTFaxDecode) is kept as is.
+func FlatePolicy(level int) FilterPolicy {
+	return FilterPolicyFunc(func(objNum int64, dict *PdfObjectDictionary, currentEnc StreamEncoder) StreamEncoder {
+		for _, enc := range encoderChain(currentEnc) {
+			switch enc.(type) {
+			case *DCTEncoder, *JPXEncoder, *JBIG2Encoder, *CCITTFaxEncoder:
+				return nil
+			}
+		}
+		encoder := NewFlateEncoder()
+		encoder.CompressionLevel = level
+		return encoder
+	})
+}
+
+// SetFilterPolicy sets the policy deciding the filters of the streams when writing, or nil to
+// write the streams with their filters as they are.
+func (this *PdfWriter) SetFilterPolicy(policy FilterPolicy) {
+	this.filterPolicy = policy
+}
+
+// streamFilterPolicy returns the filter policy applied when writing, or nil if the streams are
+// written with their filters as they are.  PDF/A-1 documents are written with NoLZWPolicy unless
+// a policy is set.
+func (this *PdfWriter) streamFilterPolicy() FilterPolicy {
+	if this.filterPolicy == nil && this.pdfaProfile != nil {
+		return NoLZWPolicy()
+	}
+	return this.filterPolicy
+}
+
+// encoderChain returns the encoders of `enc` in the order of the Filter array.  Raw (unfiltered)
+// data has no encoders.
+func encoderChain(enc StreamEncoder) []StreamEncoder {
+	switch t := enc.(type) {
+	case nil, *RawEncoder:
+		return nil
+	case *MultiEncoder:
+		var encoders []StreamEncoder
+		for _, e := range t.GetEncoders() {
+			encoders = append(encoders, encoderChain(e)...)
+		}
+		return encoders
+	}
+	return []StreamEncoder{enc}
+}
+
+// makeEncoderFromChain returns an encoder applying the filters `encoders` (in Filter array order).
+func makeEncoderFromChain(encoders []StreamEncoder) StreamEncoder {
+	switch len(encoders) {
+	case 0:
+		return NewRawEncoder()
+	case 1:
+		return encoders[0]
+	}
+	multi := NewMultiEncoder()
+	for _, enc := range encoders {
+		multi.AddEncoder(enc)
+	}
+	return multi
+}
+
+// filterPolicyExemptions returns the streams of `objects` that the filter policy must not change:
+// ICC profiles, private application data under PieceInfo dictionaries, and XMP metadata streams if
+// the document is a PDF/A document.  If the document contains a signature dictionary, all streams
+// are exempt.
+func filterPolicyExemptions(objects []PdfObject) map[*PdfObjectStream]bool {
+	exempt := map[*PdfObjectStream]bool{}
+	var metadata []*PdfObjectStream
+	isPDFA := false
+	isSigned := false
+
+	// Indirect objects are traversed once, as the object graph has cycles (e.g. Parent links).
+	// Objects under a PieceInfo dictionary are traversed again to exempt all their streams.
+	visited := map[PdfObject]bool{}
+	visitedPieceInfo := map[PdfObject]bool{}
+	var traverse func(obj PdfObject, inPieceInfo bool)
+	traverse = func(obj PdfObject, inPieceInfo bool) {
+		seen := visited
+		if inPieceInfo {
+			seen = visitedPieceInfo
+		}
+		switch t := obj.(type) {
+		case *PdfObjectDictionary:
+			if stream, ok := TraceToDirectObject(t.Get("DestOutputProfile")).(*PdfObjectStream); ok {
+				exempt[stream] = true
+			}
+			if isSignatureDict(t) {
+				isSigned = true
+			}
+			for _, key := range t.Keys() {
+				val := t.Get(key)
+				if key == "PieceInfo" {
+					traverse(val, true)
+				} else if _, isStream := val.(*PdfObjectStream); !isStream || inPieceInfo {
+					traverse(val, inPieceInfo)
+				}
+			}
+		case *PdfObjectArray:
+			if len(*t) == 2 {
+				if name, ok := TraceToDirectObject((*t)[0]).(*PdfObjectName); ok && *name == "ICCBased" {
+					if stream, ok := TraceToDirectObject((*t)[1]).(*PdfObjectStream); ok {
+						exempt[stream] = true
+					}
+				}
+			}
+			for _, o := range *t {
+				if _, isStream := o.(*PdfObjectStream); !isStream || inPieceInfo {
+					traverse(o, inPieceInfo)
+				}
+			}
+		case *PdfIndirectObject:
+			if !seen[t] {
+				seen[t] = true
+				traverse(t.PdfObject, inPieceInfo)
+			}
+		case *PdfObjectStream:
+			// Streams are only reached here under PieceInfo: top-level streams are traversed below.
+			if !seen[t] {
+				seen[t] = true
+				exempt[t] = true
+				traverse(t.PdfObjectDictionary, inPieceInfo)
+			}
+		}
+	}
+
+	for _, obj := range objects {
+		switch t := obj.(type) {
+		case *PdfIndirectObject:
+			traverse(t, false)
+		case *PdfObjectStream:
+			traverse(t.PdfObjectDictionary, false)
+			if name, ok := TraceToDirectObject(t.Get("Type")).(*PdfObjectName); ok && *name == "Metadata" {
+				metadata = append(metadata, t)
+				if data, err := DecodeStreamReadOnly(t); err == nil && bytes.Contains(data, []byte("pdfaid:part")) {
+					isPDFA = true
+				}
+			}
+		}
+	}
+	if isSigned {
+		common.Log.Debug("Filter policy: document has a signature, keeping the filters of all streams")
+		for _, obj := range objects {
+			if stream, ok := obj.(*PdfObjectStream); ok {
+				exempt[stream] = true
+			}
+		}
+	}
+	if isPDFA {
+		for _, stream := range metadata {
+			exempt[stream] = true
+		}
+	}
+	return exempt
+}
+
+// isSignatureDict returns true if `dict` is a signature dictionary: a dictionary of type Sig, or
+// one with the ByteRange and Contents entries covering the signed bytes.
+func isSignatureDict(dict *PdfObjectDictionary) bool {
+	if name, ok := TraceToDirectObject(dict.Get("Type")).(*PdfObjectName); ok && *name == "Sig" {
+		return true
+	}
+	return dict.Get("ByteRange") != nil && dict.Get("Contents") != nil
+}
+
+// applyFilterPolicy returns stream `stream` with object number `num` re-encoded as decided by the
+// filter policy, as a copy with its own dictionary and data: `stream` itself is not modified.
+// Streams that are kept as they are, including those that cannot be re-encoded, are returned as
+// is.
+func (this *PdfWriter) applyFilterPolicy(num int64, stream *PdfObjectStream) *PdfObjectStream {
+	currentEnc, err := NewEncoderFromStream(stream)
+	if err != nil {
+		common.Log.Debug("Filter policy: keeping stream %d with unsupported filters: %v", num, err)
+		return stream
+	}
+	newEnc := this.streamFilterPolicy().StreamEncoder(num, stream.PdfObjectDictionary, currentEnc)
+	if newEnc == nil || newEnc == currentEnc {
+		return stream
+	}
+
+	// Innermost encoders shared by the current and new filters are kept encoded.
+	current, next := encoderChain(currentEnc), encoderChain(newEnc)
+	shared := 0
+	for shared < len(current) && shared < len(next) &&
+		current[len(current)-1-shared] == next[len(next)-1-shared] {
+		shared++
+	}
+
+	data, err := stream.DecryptedStream()
+	if err != nil {
+		common.Log.Debug("Filter policy: keeping stream %d, failed decrypting: %v", num, err)
+		return stream
+	}
+	for _, enc := range current[:len(current)-shared] {
+		data, err = enc.DecodeStream(&PdfObjectStream{PdfObjectDictionary: MakeDict(), Stream: data})
+		if err != nil {
+			common.Log.Debug("Filter policy: keeping stream %d, failed decoding %s: %v", num, enc.GetFilterName(), err)
+			return stream
+		}
+	}
+	outer := next[:len(next)-shared]
+	for i := len(outer) - 1; i >= 0; i-- {
+		data, err = outer[i].EncodeBytes(data)
+		if err != nil {
+			common.Log.Debug("Filter policy: keeping stream %d, failed encoding %s: %v", num, outer[i].GetFilterName(), err)
+			return stream
+		}
+	}
+
+	dict := MakeDict()
+	dict.Merge(stream.PdfObjectDictionary)
+	for _, key := range []PdfObjectName{"Filter", "DecodeParms", "DP", "EarlyChange"} {
+		dict.Remove(key)
+	}
+	if len(next) > 0 {
+		encDict := makeEncoderFromChain(next).MakeStreamDict()
+		dict.SetIfNotNil("Filter", encDict.Get("Filter"))
+		dict.SetIfNotNil("DecodeParms", policyDecodeParms(stream, len(current), outer, shared))
+	}
+	dict.Set("Length", MakeInteger(int64(len(data))))
+	return &PdfObjectStream{PdfObjectReference: stream.PdfObjectReference, PdfObjectDictionary: dict, Stream: data}
+}
+
+// policyDecodeParms returns the DecodeParms of a stream re-encoded by the filter policy with the
+// new outer filters `outer` and the `shared` innermost filters of the `numFilters` filters of
+// `stream` kept: the parameters of the new filters, or null, followed by the original parameters
+// of the kept filters, which the encoders of some filters (e.g. CCITTFaxDecode) do not carry.
+// Returns nil if no filter has parameters.
+func policyDecodeParms(stream *PdfObjectStream, numFilters int, outer []StreamEncoder, shared int) PdfObject {
+	original := stream.Get("DecodeParms")
+	if original == nil {
+		original = stream.Get("DP")
+	}
+	kept := make([]PdfObject, numFilters)
+	switch t := TraceToDirectObject(original).(type) {
+	case *PdfObjectArray:
+		copy(kept, *t)
+	case *PdfObjectDictionary:
+		if numFilters == 1 {
+			kept[0] = original
+		}
+	}
+
+	var parms []PdfObject
+	for _, enc := range outer {
+		parms = append(parms, enc.MakeDecodeParams())
+	}
+	parms = append(parms, kept[numFilters-shared:]...)
+
+	hasParms := false
+	for i, obj := range parms {
+		if _, isNull := TraceToDirectObject(obj).(*PdfObjectNull); obj == nil || isNull {
+			parms[i] = MakeNull()
+		} else {
+			hasParms = true
+		}
+	}
+	switch {
+	case !hasParms:
+		return nil
+	case len(parms) == 1:
+		return parms[0]
+	}
+	return MakeArray(parms...)
+}
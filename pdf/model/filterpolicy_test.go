@@ -0,0 +1,298 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// Test writing a document with the ASCII armor filter policy: all streams except the ICC profile,
+// the PieceInfo private data and the PDF/A metadata get an outermost ASCII85Decode filter, and the
+// JPEG data is not recompressed.
+func TestASCIIArmorFilterPolicy(t *testing.T) {
+	content := "BT /F1 12 Tf 10 10 Td (Armored) Tj ET"
+
+	dct := NewDCTEncoder()
+	dct.Width, dct.Height, dct.ColorComponents = 8, 8, 1
+	jpeg, err := dct.EncodeBytes(bytes.Repeat([]byte{0x80}, 64))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	icc := &PdfObjectStream{PdfObjectDictionary: MakeDict(), Stream: []byte("icc profile data")}
+	icc.Set("N", MakeInteger(1))
+	icc.Set("Length", MakeInteger(int64(len(icc.Stream))))
+	image := &PdfObjectStream{PdfObjectDictionary: MakeDict(), Stream: jpeg}
+	for key, val := range map[PdfObjectName]PdfObject{
+		"Type": MakeName("XObject"), "Subtype": MakeName("Image"), "Width": MakeInteger(8),
+		"Height": MakeInteger(8), "BitsPerComponent": MakeInteger(8), "Filter": MakeName("DCTDecode"),
+		"ColorSpace": MakeArray(MakeName("ICCBased"), icc), "Length": MakeInteger(int64(len(jpeg))),
+	} {
+		image.Set(key, val)
+	}
+	xmp := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><pdfaid:part>1</pdfaid:part></x:xmpmeta>`)
+	metadata := &PdfObjectStream{PdfObjectDictionary: MakeDict(), Stream: xmp}
+	metadata.Set("Type", MakeName("Metadata"))
+	metadata.Set("Subtype", MakeName("XML"))
+	metadata.Set("Length", MakeInteger(int64(len(xmp))))
+	private := []byte{0x00, 0xff, 0x80, 'a', 'p', 'p', 0x0a}
+	privateStream := &PdfObjectStream{PdfObjectDictionary: MakeDict(), Stream: private}
+	privateStream.Set("Length", MakeInteger(int64(len(private))))
+	privateStream.Set("MyAppData", MakeBool(true))
+	appData := MakeDict()
+	appData.Set("LastModified", MakeString("D:20100101000000Z"))
+	appData.Set("Private", privateStream)
+	pieceInfo := MakeDict()
+	pieceInfo.Set("MyApp", appData)
+
+	page := NewPdfPage()
+	page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+	page.Resources = NewPdfPageResources()
+	xobjects := MakeDict()
+	xobjects.Set("Im1", image)
+	page.Resources.XObject = xobjects
+	page.Metadata = metadata
+	page.SetPieceInfo(pieceInfo)
+	if err := page.SetContentStreams([]string{content}, NewFlateEncoder()); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	w := NewPdfWriter()
+	w.SetFilterPolicy(ASCIIArmorPolicy())
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	numStreams := 0
+	for _, num := range reader.parser.GetObjectNums() {
+		obj, err := reader.parser.LookupByNumber(num)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		stream, ok := obj.(*PdfObjectStream)
+		if !ok {
+			continue
+		}
+		numStreams++
+		if stream.Get("MyAppData") != nil {
+			if stream.Get("Filter") != nil || !bytes.Equal(stream.Stream, private) {
+				t.Errorf("PieceInfo stream %d filtered: %s", num, stream.PdfObjectDictionary)
+			}
+			continue
+		}
+		if stream.Get("N") != nil || stream.Get("Type") != nil && stream.Get("Type").String() == "Metadata" {
+			if stream.Get("Filter") != nil {
+				t.Errorf("Exempt stream %d filtered: %s", num, stream.PdfObjectDictionary)
+			}
+			continue
+		}
+		var outer PdfObject
+		switch f := stream.Get("Filter").(type) {
+		case *PdfObjectName:
+			outer = f
+		case *PdfObjectArray:
+			outer = (*f)[0]
+		}
+		if outer == nil || outer.String() != StreamEncodingFilterNameASCII85 {
+			t.Errorf("Stream %d not ASCII armored: %s", num, stream.PdfObjectDictionary)
+			continue
+		}
+		if stream.Get("Subtype") != nil && stream.Get("Subtype").String() == "Image" {
+			// The JPEG data is kept byte for byte.
+			unarmored, err := NewASCII85Encoder().DecodeBytes(stream.Stream)
+			if err != nil || !bytes.Equal(unarmored, jpeg) {
+				t.Errorf("JPEG data changed (%v)", err)
+			}
+		}
+		for _, b := range stream.Stream {
+			if b >= 0x80 {
+				t.Errorf("Stream %d not 7-bit clean", num)
+				break
+			}
+		}
+	}
+	// Content, image, ICC profile, private data and metadata (plus the content added by unlicensed
+	// copies).
+	if numStreams < 5 {
+		t.Errorf("%d streams, expected at least 5", numStreams)
+	}
+
+	readPage, err := reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	contents, err := readPage.GetAllContentStreams()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !strings.HasPrefix(contents, content) {
+		t.Errorf("Content stream %q does not start with %q", contents, content)
+	}
+}
+
+// Test that the filter policy is not applied to the streams of a signed document.
+func TestFilterPolicyExemptionsSigned(t *testing.T) {
+	content := &PdfObjectStream{PdfObjectDictionary: MakeDict(), Stream: []byte("0 0 m 1 1 l S")}
+	sig := MakeDict()
+	sig.Set("Type", MakeName("Sig"))
+	sig.Set("ByteRange", MakeArray(MakeInteger(0), MakeInteger(10), MakeInteger(20), MakeInteger(10)))
+	sig.Set("Contents", MakeString("\x00"))
+	field := MakeDict()
+	field.Set("FT", MakeName("Sig"))
+	field.Set("V", MakeIndirectObject(sig))
+
+	exempt := filterPolicyExemptions([]PdfObject{content})
+	if exempt[content] {
+		t.Errorf("Content stream exempt in an unsigned document")
+	}
+	exempt = filterPolicyExemptions([]PdfObject{content, MakeIndirectObject(field)})
+	if !exempt[content] {
+		t.Errorf("Content stream not exempt in a signed document")
+	}
+}
+
+// Test that the LZW and Flate policies re-encode streams, keeping image specific filters.
+func TestFilterPolicies(t *testing.T) {
+	data := bytes.Repeat([]byte("0 0 m 100 100 l S\n"), 20)
+	lzwEnc := NewLZWEncoder()
+	lzwEnc.EarlyChange = 0
+	lzw, err := MakeStream(data, lzwEnc)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	multi := NewMultiEncoder()
+	multi.AddEncoder(NewASCIIHexEncoder())
+	multi.AddEncoder(NewDCTEncoder())
+	dctStream := &PdfObjectStream{PdfObjectDictionary: multi.MakeStreamDict(), Stream: []byte("41>")}
+
+	testcases := []struct {
+		Name     string
+		Policy   FilterPolicy
+		Stream   *PdfObjectStream
+		Expected string
+	}{
+		{"No LZW", NoLZWPolicy(), lzw, "FlateDecode"},
+		{"Flate", FlatePolicy(9), lzw, "FlateDecode"},
+		{"Keep", KeepFiltersPolicy(), lzw, "LZWDecode"},
+		{"Flate skips DCT", FlatePolicy(9), dctStream, "[/ASCIIHexDecode /DCTDecode]"},
+	}
+	for _, tcase := range testcases {
+		dictStr := tcase.Stream.DefaultWriteString()
+		encoded := append([]byte{}, tcase.Stream.Stream...)
+		w := NewPdfWriter()
+		w.SetFilterPolicy(tcase.Policy)
+		stream := w.applyFilterPolicy(1, tcase.Stream)
+		if s := tcase.Stream.DefaultWriteString(); s != dictStr || !bytes.Equal(tcase.Stream.Stream, encoded) {
+			t.Errorf("%s: source stream modified: %s", tcase.Name, s)
+		}
+		if filter := stream.Get("Filter"); filter == nil || filter.DefaultWriteString() != "/"+tcase.Expected && filter.DefaultWriteString() != tcase.Expected {
+			t.Errorf("%s: Filter %v, expected %s", tcase.Name, filter, tcase.Expected)
+			continue
+		}
+		if tcase.Stream == lzw {
+			decoded, err := DecodeStream(stream)
+			if err != nil || !bytes.Equal(decoded, data) {
+				t.Errorf("%s: decoded data differs (%v)", tcase.Name, err)
+			}
+		}
+	}
+}
+
+// Test that the DecodeParms of the image filters kept by the ASCII armor policy are written with
+// them, null for the added ASCII85Decode filter: the CCITTFaxDecode and JBIG2Decode encoders do not
+// carry them.
+func TestFilterPolicyKeepsDecodeParms(t *testing.T) {
+	globals := MakeIndirectObject(MakeString("globals"))
+	ccitt := MakeDict()
+	ccitt.Set("K", MakeInteger(-1))
+	ccitt.Set("Columns", MakeInteger(8))
+	ccitt.Set("BlackIs1", MakeBool(true))
+	jbig2 := MakeDict()
+	jbig2.Set("JBIG2Globals", globals)
+
+	testcases := []struct {
+		Filter string
+		Parms  *PdfObjectDictionary
+	}{
+		{"CCITTFaxDecode", ccitt},
+		{"JBIG2Decode", jbig2},
+	}
+	for _, tcase := range testcases {
+		encoded := []byte{0x26, 0xa0, 0x10, 0x00, 0x8f}
+		image := &PdfObjectStream{PdfObjectDictionary: MakeDict(), Stream: encoded}
+		for key, val := range map[PdfObjectName]PdfObject{
+			"Type": MakeName("XObject"), "Subtype": MakeName("Image"), "Width": MakeInteger(8),
+			"Height": MakeInteger(1), "BitsPerComponent": MakeInteger(1), "ColorSpace": MakeName("DeviceGray"),
+			"Filter": MakeName(tcase.Filter), "DecodeParms": tcase.Parms, "Length": MakeInteger(int64(len(encoded))),
+		} {
+			image.Set(key, val)
+		}
+		page := NewPdfPage()
+		page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+		page.Resources = NewPdfPageResources()
+		xobjects := MakeDict()
+		xobjects.Set("Im1", image)
+		page.Resources.XObject = xobjects
+		w := NewPdfWriter()
+		w.SetFilterPolicy(ASCIIArmorPolicy())
+		if err := w.AddPage(page); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		data, err := writeToBytes(&w)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		reader, err := NewPdfReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		page, err = reader.GetPage(1)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		obj, found := page.GetXObjectByName("Im1")
+		if !found {
+			t.Fatalf("%s: image not found", tcase.Filter)
+		}
+		stream := obj.(*PdfObjectStream)
+		if filter := stream.Get("Filter").DefaultWriteString(); filter != "[/ASCII85Decode /"+tcase.Filter+"]" {
+			t.Errorf("%s: Filter %s", tcase.Filter, filter)
+		}
+		parms, ok := TraceToDirectObject(stream.Get("DecodeParms")).(*PdfObjectArray)
+		if !ok || len(*parms) != 2 {
+			t.Fatalf("%s: DecodeParms %v", tcase.Filter, stream.Get("DecodeParms"))
+		}
+		if _, isNull := (*parms)[0].(*PdfObjectNull); !isNull {
+			t.Errorf("%s: ASCII85Decode parameters %v, expected null", tcase.Filter, (*parms)[0])
+		}
+		kept, ok := TraceToDirectObject((*parms)[1]).(*PdfObjectDictionary)
+		if !ok {
+			t.Fatalf("%s: parameters %v", tcase.Filter, (*parms)[1])
+		}
+		for _, key := range tcase.Parms.Keys() {
+			val := TraceToDirectObject(kept.Get(key))
+			if val == nil || TraceToDirectObject(tcase.Parms.Get(key)).DefaultWriteString() != val.DefaultWriteString() {
+				t.Errorf("%s: %s %v, expected %v", tcase.Filter, key, val, tcase.Parms.Get(key))
+			}
+		}
+		armored, err := NewASCII85Encoder().DecodeBytes(stream.Stream)
+		if err != nil || !bytes.Equal(armored, encoded) {
+			t.Errorf("%s: image data % x (%v), expected % x", tcase.Filter, armored, err, encoded)
+		}
+	}
+}
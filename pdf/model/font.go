@@ -6,7 +6,14 @@
 package model
 
 import (
+	"bytes"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
 
 	"io/ioutil"
 
@@ -30,6 +37,21 @@ func (font PdfFont) SetEncoder(encoder textencoding.TextEncoder) {
 	switch t := font.context.(type) {
 	case *pdfFontTrueType:
 		t.SetEncoder(encoder)
+	case *pdfFontStandard14:
+		t.SetEncoder(encoder)
+	case *pdfFontType3:
+		t.SetEncoder(encoder)
+	}
+}
+
+// SetCIDWidthsFromHmtx sets whether the widths of CIDs that are missing from the W array of the
+// CIDFontType2 descendant of a composite font are taken from the horizontal metrics (hmtx table) of
+// the embedded TrueType font program, with the glyphs given by CIDToGIDMap.  This helps with subset
+// fonts that rely on the font program for their widths.  By default the DW width (1000 if missing)
+// is used, as specified.  Has no effect on other fonts.
+func (font PdfFont) SetCIDWidthsFromHmtx(enabled bool) {
+	if t, ok := font.context.(*pdfFontType0); ok && t.descendant != nil {
+		t.descendant.widthsFromHmtx = enabled
 	}
 }
 
@@ -37,12 +59,323 @@ func (font PdfFont) GetGlyphCharMetrics(glyph string) (fonts.CharMetrics, bool)
 	switch t := font.context.(type) {
 	case *pdfFontTrueType:
 		return t.GetGlyphCharMetrics(glyph)
+	case *pdfFontStandard14:
+		return t.GetGlyphCharMetrics(glyph)
+	case *pdfFontType3:
+		return t.GetGlyphCharMetrics(glyph)
 	}
 
 	return fonts.CharMetrics{}, false
 }
 
+// GetCIDMetrics returns the metrics of the glyph for CID `cid` of a composite (Type0) font, with the
+// width from the W array of the CIDFont (or its embedded CFF font program) and, in vertical writing
+// mode, the vertical displacement Wy from the W2 array.  Composite fonts have no glyph names, so
+// GetGlyphCharMetrics does not apply to them.  Returns false for simple fonts, or if the metrics of
+// `cid` are the CIDFont defaults.
+func (font PdfFont) GetCIDMetrics(cid uint16) (fonts.CharMetrics, bool) {
+	if t, ok := font.context.(*pdfFontType0); ok {
+		return t.GetCIDMetrics(cid)
+	}
+
+	return fonts.CharMetrics{}, false
+}
+
+// GetCharcodeWidth returns the width of the glyph for character code `code` in thousandths of text
+// space units: from the Widths of simple fonts, or the CIDFont metrics of the CID of composite fonts
+// (see CharcodeToCID).  Returns false if the width is not known.
+func (font PdfFont) GetCharcodeWidth(code uint16) (float64, bool) {
+	switch t := font.context.(type) {
+	case *pdfFontTrueType:
+		index := int(code) - t.firstChar
+		if index < 0 || index >= len(t.charWidths) {
+			return 0, false
+		}
+		return t.charWidths[index], true
+	case *pdfFontType3:
+		index := int(code) - t.firstChar
+		if index < 0 || index >= len(t.charWidths) {
+			return 0, false
+		}
+		return t.charWidths[index] * t.scaleX * 1000, true
+	case *pdfFontStandard14:
+		if code > 0xff {
+			return 0, false
+		}
+		glyph, found := t.encoder.CharcodeToGlyph(byte(code))
+		if !found {
+			return 0, false
+		}
+		metrics, found := t.GetGlyphCharMetrics(glyph)
+		return metrics.Wx, found
+	case *pdfFontType0:
+		metrics, _ := t.GetCIDMetrics(t.charcodeToCID(uint64(code)))
+		return metrics.Wx, true
+	}
+	return 0, false
+}
+
+// CharcodeToCID returns the CID of character code `code` of a composite (Type0) font: as mapped by
+// an embedded Encoding CMap, whose unmapped codes map to notdef (CID 0), or else the code itself
+// (Identity-H and Identity-V).  Returns false for simple fonts.
+func (font PdfFont) CharcodeToCID(code uint64) (uint16, bool) {
+	if t, ok := font.context.(*pdfFontType0); ok {
+		return t.charcodeToCID(code), true
+	}
+	return 0, false
+}
+
+// CharcodeToRune returns the rune of the glyph of character code `code` of a simple font, as given
+// by its encoding.  Returns false for composite and Type3 fonts, and codes without a known glyph.
+func (font PdfFont) CharcodeToRune(code byte) (rune, bool) {
+	switch t := font.context.(type) {
+	case *pdfFontTrueType:
+		glyph, found := t.charcodeToGlyph(code)
+		if !found {
+			return 0, false
+		}
+		return textencoding.GlyphToRune(glyph)
+	case *pdfFontStandard14:
+		return t.encoder.CharcodeToRune(code)
+	}
+	return 0, false
+}
+
+// NextCharcode returns the character code at the start of string `data` shown with the font and
+// its length in bytes: a byte for simple fonts; for composite fonts, a code of the length given by
+// the codespace ranges of an embedded Encoding CMap, which can mix 1 to 4 byte codes, otherwise 2
+// bytes (Identity-H and the other predefined CMaps).  The length can exceed len(`data`) if `data`
+// ends within a code, and is 0 if `data` is empty.
+func (font PdfFont) NextCharcode(data []byte) (uint64, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+	if t, ok := font.context.(*pdfFontType0); ok {
+		return t.nextCode(data)
+	}
+	return uint64(data[0]), 1
+}
+
+// BytesToCharcodes splits string `data` shown with the font into its character codes, as given by
+// NextCharcode.  Returns an error if `data` ends in the middle of a code, with the bytes of the
+// incomplete code as the last code.
+func (font PdfFont) BytesToCharcodes(data []byte) ([]uint64, error) {
+	codes := make([]uint64, 0, len(data))
+	for i := 0; i < len(data); {
+		code, size := font.NextCharcode(data[i:])
+		codes = append(codes, code)
+		if i+size > len(data) {
+			return codes, fmt.Errorf("String ends within a %d byte character code (% x)", size, data[i:])
+		}
+		i += size
+	}
+	return codes, nil
+}
+
+// AdvanceWidths returns the horizontal advance in text space of each character code of string
+// `data` shown with the font (9.4.4): (w0 / 1000 × fontSize + charSpacing + wordSpacing) × hScale,
+// where w0 is the glyph width from GetCharcodeWidth and hScale the horizontal scaling as a factor
+// (Tz / 100).  The codes are split by BytesToCharcodes.  Word spacing is only applied to the single
+// byte code 32 of simple fonts.  Returns an error if the width of a code is not known or `data`
+// ends in the middle of a code.
+func (font PdfFont) AdvanceWidths(data []byte, fontSize, charSpacing, wordSpacing, hScale float64) ([]float64, error) {
+	composite := font.IsComposite()
+	codes, err := font.BytesToCharcodes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var advances []float64
+	for _, c := range codes {
+		code := uint16(c)
+		width, ok := font.GetCharcodeWidth(code)
+		if !ok || uint64(code) != c {
+			return nil, fmt.Errorf("Width of character code %d not known", c)
+		}
+		tx := width/1000*fontSize + charSpacing
+		if !composite && code == 32 {
+			tx += wordSpacing
+		}
+		advances = append(advances, tx*hScale)
+	}
+	return advances, nil
+}
+
+// IsComposite returns true for composite (Type0) fonts.
+func (font PdfFont) IsComposite() bool {
+	_, ok := font.context.(*pdfFontType0)
+	return ok
+}
+
+// ToUnicodeData returns the decoded data of the ToUnicode CMap stream of the font, e.g. for
+// auditing or rewriting the CMap.  Returns an error if the font has no ToUnicode stream.
+func (font PdfFont) ToUnicodeData() ([]byte, error) {
+	var toUnicode core.PdfObject
+	switch t := font.context.(type) {
+	case *pdfFontTrueType:
+		toUnicode = t.ToUnicode
+	case *pdfFontType3:
+		toUnicode = t.ToUnicode
+	case *pdfFontType0:
+		toUnicode = t.ToUnicode
+	}
+	if toUnicode == nil {
+		return nil, errors.New("Font has no ToUnicode CMap")
+	}
+
+	stream, ok := core.TraceToDirectObject(toUnicode).(*core.PdfObjectStream)
+	if !ok {
+		common.Log.Debug("ToUnicode not a stream (%T)", toUnicode)
+		return nil, ErrTypeError
+	}
+	return core.DecodeStream(stream)
+}
+
+// HasGlyph returns true if rune `r` can be rendered with the font, i.e. it can be encoded with the
+// font encoding and the font has a glyph for it.  For embedded TrueType fonts, the glyph must be
+// in the font program and have an outline (unless it is whitespace).  For the standard 14 fonts,
+// the glyph must be in the font metrics, and for Type 1 subset fonts in the CharSet of the font
+// descriptor if given.  Non-embedded TrueType fonts are only checked against the
+// encoding.  The results are cached per font, and HasGlyph can be called concurrently.
+//
+// The glyph coverage of composite (Type 0) and Type 3 fonts is not determined: HasGlyph returns
+// false for them, and ValidateText does not report missing runes.
+func (font PdfFont) HasGlyph(r rune) bool {
+	switch t := font.context.(type) {
+	case *pdfFontTrueType:
+		return t.coverage.has(r, t.hasGlyph)
+	case *pdfFontStandard14:
+		return t.coverage.has(r, t.hasGlyph)
+	}
+
+	return false
+}
+
+// hasGlyphCoverage returns true if the glyph coverage of the font is determined by HasGlyph.
+func (font PdfFont) hasGlyphCoverage() bool {
+	switch font.context.(type) {
+	case *pdfFontTrueType, *pdfFontStandard14:
+		return true
+	}
+	return false
+}
+
+// ValidateText returns the runes of `s` that cannot be rendered with the font (see HasGlyph), each
+// listed once in order of first occurrence.  Returns nil if the font covers all of `s`, and for
+// fonts whose glyph coverage is not determined (composite and Type 3 fonts).
+func (font PdfFont) ValidateText(s string) (missing []rune) {
+	if !font.hasGlyphCoverage() {
+		common.Log.Debug("ValidateText: glyph coverage of %T fonts not determined", font.context)
+		return nil
+	}
+	listed := map[rune]bool{}
+	for _, r := range s {
+		if listed[r] || font.HasGlyph(r) {
+			continue
+		}
+		listed[r] = true
+		missing = append(missing, r)
+	}
+	return missing
+}
+
+// glyphCoverage caches whether a font has glyphs for runes.  It is safe for concurrent use.
+type glyphCoverage struct {
+	mutex sync.Mutex
+	runes map[rune]bool
+}
+
+// has returns whether the font has a glyph for `r`, determined by `hasGlyph` unless cached.
+func (c *glyphCoverage) has(r rune, hasGlyph func(rune) bool) bool {
+	c.mutex.Lock()
+	has, ok := c.runes[r]
+	c.mutex.Unlock()
+	if ok {
+		return has
+	}
+
+	has = hasGlyph(r)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.runes == nil {
+		c.runes = map[rune]bool{}
+	}
+	c.runes[r] = has
+	return has
+}
+
+// reset clears the cache, e.g. when the encoding changes.
+func (c *glyphCoverage) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.runes = nil
+}
+
+// FontOpts are the options of NewPdfFontFromPdfObjectWithOpts.  They only apply to fonts loaded
+// with that function: the fonts loaded by the reader and the text extractor use the defaults.
+type FontOpts struct {
+	// StrictType makes loading fail for font dictionaries without Type or with Type given as a
+	// string, which are otherwise accepted when the Subtype is a supported font type.
+	StrictType bool
+}
+
+// NewPdfFontFromPdfObject loads the font given by the font dictionary `obj`, e.g. from the Font
+// resources of a page.
+func NewPdfFontFromPdfObject(obj core.PdfObject) (*PdfFont, error) {
+	return newPdfFontFromPdfObject(obj)
+}
+
+// NewPdfFontFromPdfObjectWithOpts loads the font given by the font dictionary `obj` as
+// NewPdfFontFromPdfObject, with options `opts`, which can be nil.
+func NewPdfFontFromPdfObjectWithOpts(obj core.PdfObject, opts *FontOpts) (*PdfFont, error) {
+	return newPdfFontFromPdfObjectWithOpts(obj, opts)
+}
+
+// FontLoadError is the error of loading the font of a Font resource.
+type FontLoadError struct {
+	// Name is the resource name of the font.
+	Name core.PdfObjectName
+	// Err is the error returned by NewPdfFontFromPdfObject.
+	Err error
+}
+
+func (e FontLoadError) Error() string {
+	return fmt.Sprintf("font %s: %v", e.Name, e.Err)
+}
+
+// LoadFontsTolerant loads the fonts of the Font resource dictionary `fontResources`, e.g. the Font
+// entry of page resources.  Fonts that cannot be loaded, such as malformed fonts or fonts of an
+// unsupported type, do not stop the others from loading: the fonts that were loaded are returned by
+// resource name along with the errors of those that were not, in the order of the dictionary.
+func LoadFontsTolerant(fontResources core.PdfObject) (map[core.PdfObjectName]*PdfFont, []FontLoadError) {
+	loaded := map[core.PdfObjectName]*PdfFont{}
+	d, ok := core.TraceToDirectObject(fontResources).(*core.PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("Font resources not a dictionary (%T)", fontResources)
+		return loaded, nil
+	}
+
+	var failures []FontLoadError
+	for _, name := range d.Keys() {
+		font, err := newPdfFontFromPdfObject(d.Get(name))
+		if err != nil {
+			common.Log.Debug("Skipping font %s: %v", name, err)
+			failures = append(failures, FontLoadError{Name: name, Err: err})
+			continue
+		}
+		loaded[name] = font
+	}
+	return loaded, failures
+}
+
 func newPdfFontFromPdfObject(obj core.PdfObject) (*PdfFont, error) {
+	return newPdfFontFromPdfObjectWithOpts(obj, nil)
+}
+
+func newPdfFontFromPdfObjectWithOpts(obj core.PdfObject, opts *FontOpts) (*PdfFont, error) {
+	if opts == nil {
+		opts = &FontOpts{}
+	}
 	font := &PdfFont{}
 
 	dictObj := obj
@@ -56,38 +389,76 @@ func newPdfFontFromPdfObject(obj core.PdfObject) (*PdfFont, error) {
 		return nil, errors.New("Type check error")
 	}
 
-	if obj := d.Get("Type"); obj != nil {
-		oname, is := obj.(*core.PdfObjectName)
-		if !is || string(*oname) != "Font" {
-			common.Log.Debug("Incompatibility ERROR: Type (Required) defined but not Font name")
-			return nil, errors.New("Range check error")
-		}
-	} else {
-		common.Log.Debug("Incompatibility ERROR: Type (Required) missing")
-		return nil, errors.New("Required attribute missing")
-	}
-
-	obj = d.Get("Subtype")
-	if obj == nil {
+	subtypeObj := d.Get("Subtype")
+	if subtypeObj == nil {
 		common.Log.Debug("Incompatibility ERROR: Subtype (Required) missing")
 		return nil, errors.New("Required attribute missing")
 	}
 
-	subtype, ok := core.TraceToDirectObject(obj).(*core.PdfObjectName)
+	subtype, ok := core.TraceToDirectObject(subtypeObj).(*core.PdfObjectName)
 	if !ok {
-		common.Log.Debug("Incompatibility ERROR: subtype not a name (%T) ", obj)
+		common.Log.Debug("Incompatibility ERROR: subtype not a name (%T) ", subtypeObj)
 		return nil, errors.New("Type check error")
 	}
 
+	// A missing Type, or Type given as a string, is tolerated as the font is identified by the
+	// Subtype, unless strict.  Commonly seen in files from older producers.
+	switch t := core.TraceToDirectObject(d.Get("Type")).(type) {
+	case nil:
+		if opts.StrictType || !isSupportedFontSubtype(subtype.String()) {
+			common.Log.Debug("Incompatibility ERROR: Type (Required) missing")
+			return nil, errors.New("Required attribute missing")
+		}
+		common.Log.Debug("Incompatibility: Type (Required) missing - assuming Font (Subtype %s)", subtype)
+	case *core.PdfObjectName:
+		if string(*t) != "Font" {
+			common.Log.Debug("Incompatibility ERROR: Type (Required) defined but not Font name")
+			return nil, errors.New("Range check error")
+		}
+	case *core.PdfObjectString:
+		if opts.StrictType {
+			common.Log.Debug("Incompatibility ERROR: Type (Required) given as a string, not a name")
+			return nil, errors.New("Type check error")
+		}
+		if string(*t) != "Font" {
+			common.Log.Debug("Incompatibility ERROR: Type (Required) defined but not Font (%q)", string(*t))
+			return nil, errors.New("Range check error")
+		}
+		common.Log.Debug("Incompatibility: Type given as a string, not a name")
+	default:
+		common.Log.Debug("Incompatibility ERROR: Type (Required) defined but not Font name (%T)", t)
+		return nil, errors.New("Range check error")
+	}
+
 	switch subtype.String() {
-	case "TrueType":
+	case "TrueType", "Type1", "MMType1":
+		if std := newStandard14FontFromDict(d); std != nil {
+			font.context = std
+			break
+		}
 		truefont, err := newPdfFontTrueTypeFromPdfObject(obj)
 		if err != nil {
-			common.Log.Debug("Error loading truetype font: %v", truefont)
+			common.Log.Debug("Error loading %s font: %v", subtype, err)
 			return nil, err
 		}
 
 		font.context = truefont
+	case "Type3":
+		type3font, err := newPdfFontType3FromPdfObject(obj)
+		if err != nil {
+			common.Log.Debug("Error loading type3 font: %v", err)
+			return nil, err
+		}
+
+		font.context = type3font
+	case "Type0":
+		type0font, err := newPdfFontType0FromPdfObject(obj)
+		if err != nil {
+			common.Log.Debug("Error loading Type0 font: %v", err)
+			return nil, err
+		}
+
+		font.context = type0font
 	default:
 		common.Log.Debug("Unsupported font type: %s", subtype.String())
 		return nil, errors.New("Unsupported font type")
@@ -96,10 +467,25 @@ func newPdfFontFromPdfObject(obj core.PdfObject) (*PdfFont, error) {
 	return font, nil
 }
 
+// isSupportedFontSubtype returns true if fonts of Subtype `subtype` can be loaded.
+func isSupportedFontSubtype(subtype string) bool {
+	switch subtype {
+	case "TrueType", "Type1", "MMType1", "Type3", "Type0":
+		return true
+	}
+	return false
+}
+
 func (font PdfFont) ToPdfObject() core.PdfObject {
 	switch f := font.context.(type) {
 	case *pdfFontTrueType:
 		return f.ToPdfObject()
+	case *pdfFontStandard14:
+		return f.ToPdfObject()
+	case *pdfFontType3:
+		return f.ToPdfObject()
+	case *pdfFontType0:
+		return f.ToPdfObject()
 	}
 
 	// If not supported, return null..
@@ -117,6 +503,8 @@ type pdfFontTrueType struct {
 	// Subtype shall be TrueType.
 	// Encoding is subject to limitations that are described in 9.6.6, "Character Encoding".
 	// BaseFont is derived differently.
+	// Also used for simple Type1 fonts (subtype Type1 or MMType1), which share the same entries.
+	subtype        string
 	BaseFont       core.PdfObject
 	FirstChar      core.PdfObject
 	LastChar       core.PdfObject
@@ -126,19 +514,41 @@ type pdfFontTrueType struct {
 	ToUnicode      core.PdfObject
 
 	container *core.PdfIndirectObject
+
+	// Glyph names of the character codes in the Encoding Differences.
+	differences map[byte]string
+
+	// Font program (parsed on demand from FontFile2 for loaded fonts).
+	ttf     *fonts.TtfType
+	ttfOnce sync.Once
+
+	// Type 1 font program (parsed on demand from FontFile of Type1 fonts without Widths).
+	t1     *fonts.Type1Type
+	t1Once sync.Once
+
+	coverage glyphCoverage
 }
 
-func (font pdfFontTrueType) SetEncoder(encoder textencoding.TextEncoder) {
+func (font *pdfFontTrueType) SetEncoder(encoder textencoding.TextEncoder) {
 	font.Encoder = encoder
 }
 
-func (font pdfFontTrueType) GetGlyphCharMetrics(glyph string) (fonts.CharMetrics, bool) {
+func (font *pdfFontTrueType) GetGlyphCharMetrics(glyph string) (fonts.CharMetrics, bool) {
 	metrics := fonts.CharMetrics{}
 
+	if font.Encoder == nil {
+		common.Log.Debug("No encoder set for font")
+		return metrics, false
+	}
+
 	code, found := font.Encoder.GlyphToCharcode(glyph)
 	if !found {
 		return metrics, false
 	}
+	if font.FontDescriptor != nil {
+		// Only logs a glyph missing from a subset font, the width is still that of the Widths.
+		font.FontDescriptor.charSetHas(glyph)
+	}
 
 	if int(code) < font.firstChar {
 		common.Log.Debug("Code lower than firstchar (%d < %d)", code, font.firstChar)
@@ -162,6 +572,104 @@ func (font pdfFontTrueType) GetGlyphCharMetrics(glyph string) (fonts.CharMetrics
 	return metrics, true
 }
 
+// hasGlyph returns true if rune `r` can be encoded with the font encoding and, if the font is embedded,
+// has a non-empty glyph in the font program (whitespace glyphs may be empty).
+func (font *pdfFontTrueType) hasGlyph(r rune) bool {
+	if font.Encoder == nil {
+		return false
+	}
+	code, found := font.Encoder.RuneToCharcode(r)
+	if !found || int(code) < font.firstChar || int(code) > font.lastChar {
+		return false
+	}
+	if font.FontDescriptor != nil {
+		// The glyphs of a Type 1 subset font are listed by the CharSet.
+		if glyph, found := font.Encoder.CharcodeToGlyph(code); found && !font.FontDescriptor.charSetHas(glyph) {
+			return false
+		}
+	}
+
+	ttf := font.getFontProgram()
+	if ttf == nil {
+		// Not embedded, the glyphs depend on the font available to the viewer.
+		return true
+	}
+
+	gid, found := font.charcodeToGID(code)
+	if !found || gid == 0 {
+		return false
+	}
+	return ttf.HasOutline(gid) || unicode.IsSpace(r)
+}
+
+// charcodeToGID returns the glyph index (GID) in the embedded font program of character code
+// `code` (9.6.6.4 "Encodings for TrueType Fonts").  Glyph names from the Encoding Differences are
+// resolved through the font program's cmap subtables, including the (3,0) and (1,0) subtables of
+// symbolic fonts, and its post table.  Other codes of symbolic fonts are mapped directly by the
+// (3,0) or (1,0) subtable, and those of non-symbolic fonts through the glyph names of the Encoder.
+// The bool return flag is false if the font is not embedded or the code is not mapped.
+func (font *pdfFontTrueType) charcodeToGID(code byte) (uint16, bool) {
+	ttf := font.getFontProgram()
+	if ttf == nil {
+		return 0, false
+	}
+
+	if glyph, has := font.differences[code]; has {
+		if gid, found := ttf.GetGID(glyph); found {
+			return gid, true
+		}
+		common.Log.Debug("Glyph /%s of Differences code %d not in font program", glyph, code)
+	}
+
+	if font.FontDescriptor != nil && font.FontDescriptor.isSymbolic() {
+		if gid, found := ttf.GetSymbolicGID(code); found {
+			return gid, true
+		}
+	}
+
+	if font.Encoder == nil {
+		return 0, false
+	}
+	glyph, found := font.Encoder.CharcodeToGlyph(code)
+	if !found {
+		return 0, false
+	}
+	return ttf.GetGID(glyph)
+}
+
+// getFontProgram returns the embedded font program (FontFile2), parsing it on first use.
+// Returns nil if the font is not embedded or cannot be parsed.
+func (font *pdfFontTrueType) getFontProgram() *fonts.TtfType {
+	font.ttfOnce.Do(func() {
+		if font.ttf == nil {
+			font.ttf = font.loadFontProgram()
+		}
+	})
+	return font.ttf
+}
+
+// loadFontProgram parses the embedded font program (FontFile2), see getFontProgram.
+func (font *pdfFontTrueType) loadFontProgram() *fonts.TtfType {
+	if font.FontDescriptor == nil {
+		return nil
+	}
+	stream, ok := core.TraceToDirectObject(font.FontDescriptor.FontFile2).(*core.PdfObjectStream)
+	if !ok {
+		return nil
+	}
+	data, err := core.DecodeStream(stream)
+	if err != nil {
+		common.Log.Debug("Error decoding font program: %v", err)
+		return nil
+	}
+	ttf, err := fonts.TtfParseBytes(data)
+	if err != nil {
+		common.Log.Debug("Error parsing font program: %v", err)
+		return nil
+	}
+	return &ttf
+}
+
 func newPdfFontTrueTypeFromPdfObject(obj core.PdfObject) (*pdfFontTrueType, error) {
 	font := &pdfFontTrueType{}
 
@@ -185,7 +693,9 @@ func newPdfFontTrueTypeFromPdfObject(obj core.PdfObject) (*pdfFontTrueType, erro
 
 	if obj := d.Get("Subtype"); obj != nil {
 		oname, is := obj.(*core.PdfObjectName)
-		if !is || oname.String() != "TrueType" {
+		if is && (oname.String() == "Type1" || oname.String() == "MMType1") {
+			font.subtype = oname.String()
+		} else if !is || oname.String() != "TrueType" {
 			common.Log.Debug("Incompatibility: Loading TrueType font but Subtype != TrueType")
 		}
 	}
@@ -201,9 +711,6 @@ func newPdfFontTrueTypeFromPdfObject(obj core.PdfObject) (*pdfFontTrueType, erro
 			return nil, errors.New("Type check error")
 		}
 		font.firstChar = int(*intVal)
-	} else {
-		common.Log.Debug("ERROR: FirstChar attribute missing")
-		return nil, errors.New("Required attribute missing")
 	}
 
 	if obj := d.Get("LastChar"); obj != nil {
@@ -215,9 +722,6 @@ func newPdfFontTrueTypeFromPdfObject(obj core.PdfObject) (*pdfFontTrueType, erro
 			return nil, errors.New("Type check error")
 		}
 		font.lastChar = int(*intVal)
-	} else {
-		common.Log.Debug("ERROR: FirstChar attribute missing")
-		return nil, errors.New("Required attribute missing")
 	}
 
 	font.charWidths = []float64{}
@@ -236,15 +740,25 @@ func newPdfFontTrueTypeFromPdfObject(obj core.PdfObject) (*pdfFontTrueType, erro
 			return nil, err
 		}
 
+		// A missing FirstChar or LastChar is implied by the other one and the number of widths.
+		switch {
+		case font.FirstChar == nil && font.LastChar == nil:
+			common.Log.Debug("Incompatibility: FirstChar and LastChar missing - using 0 and %d", len(widths)-1)
+			font.firstChar, font.lastChar = 0, len(widths)-1
+		case font.FirstChar == nil:
+			font.firstChar = font.lastChar - len(widths) + 1
+			common.Log.Debug("Incompatibility: FirstChar missing - using %d", font.firstChar)
+		case font.LastChar == nil:
+			font.lastChar = font.firstChar + len(widths) - 1
+			common.Log.Debug("Incompatibility: LastChar missing - using %d", font.lastChar)
+		}
+
 		if len(widths) != (font.lastChar - font.firstChar + 1) {
 			common.Log.Debug("Invalid widths length != %d (%d)", font.lastChar-font.firstChar+1, len(widths))
 			return nil, errors.New("Range check error")
 		}
 
 		font.charWidths = widths
-	} else {
-		common.Log.Debug("Widths missing from font")
-		return nil, errors.New("Required attribute missing")
 	}
 
 	if obj := d.Get("FontDescriptor"); obj != nil {
@@ -254,15 +768,252 @@ func newPdfFontTrueTypeFromPdfObject(obj core.PdfObject) (*pdfFontTrueType, erro
 			return nil, err
 		}
 
+		font.FontDescriptor = descriptor
+	} else if descriptor := newPdfFontDescriptorFromFontDict(d); descriptor != nil {
+		common.Log.Debug("Incompatibility: FontDescriptor missing - using descriptor entries of the font")
 		font.FontDescriptor = descriptor
 	}
 
 	font.Encoding = d.Get("Encoding")
 	font.ToUnicode = d.Get("ToUnicode")
 
+	font.addEncoding()
+	for code, glyph := range getDifferences(font.Encoding) {
+		if code < 256 {
+			if font.differences == nil {
+				font.differences = map[byte]string{}
+			}
+			font.differences[byte(code)] = glyph
+		}
+	}
+
+	if font.subtype == "MMType1" {
+		common.Log.Debug("Multiple master font instance %v", font.BaseFont)
+	}
+	if font.Widths == nil {
+		if font.FirstChar == nil {
+			common.Log.Debug("Incompatibility: FirstChar missing - using 0")
+			font.firstChar = 0
+		}
+		if font.LastChar == nil {
+			common.Log.Debug("Incompatibility: LastChar missing - using 255")
+			font.lastChar = 255
+		}
+		// Fonts, other than the standard 14 fonts, should have Widths.  Those of the embedded Type 1
+		// font program, or else of the substitute font of a non-embedded font, are used instead of
+		// a default width.
+		if font.setWidthsFromProgram() {
+			common.Log.Debug("Incompatibility: Widths missing - using widths of the font program")
+		} else if font.setWidthsFromSubstitute() {
+			common.Log.Debug("Incompatibility: Widths missing - using widths of the substitute font")
+		} else {
+			common.Log.Debug("Widths missing from font")
+			return nil, errors.New("Required attribute missing")
+		}
+	}
+
 	return font, nil
 }
 
+// getSubstituteFont returns the standard 14 font closest to a font that is not embedded and not
+// one of the standard 14 fonts, as chosen by its font descriptor (see
+// PdfFontDescriptor.substituteName).  Its metrics stand in for the Widths missing from the font,
+// as a viewer would substitute a font for it.  Returns nil if the font is embedded, has no font
+// descriptor or is a standard 14 font, and for symbolic fonts, whose glyphs the metrics of the
+// Latin text fonts do not cover.
+func (font *pdfFontTrueType) getSubstituteFont() *pdfFontStandard14 {
+	descriptor := font.FontDescriptor
+	if descriptor == nil || descriptor.FontFile != nil || descriptor.FontFile2 != nil || descriptor.FontFile3 != nil {
+		return nil
+	}
+	if descriptor.isSymbolic() {
+		return nil
+	}
+	basefont, _ := core.TraceToDirectObject(font.BaseFont).(*core.PdfObjectName)
+	if basefont != nil {
+		if _, err := NewStandard14Font(string(*basefont)); err == nil {
+			return nil
+		}
+	}
+
+	name := descriptor.substituteName()
+	std, err := NewStandard14Font(name)
+	if err != nil {
+		return nil
+	}
+	common.Log.Debug("Font %v not embedded - substituting metrics of %s", basefont, name)
+	return std.context.(*pdfFontStandard14)
+}
+
+// setWidthsFromSubstitute sets the widths of codes FirstChar to LastChar from the glyph metrics of
+// the substitute font (see getSubstituteFont).  Codes of glyphs not in its metrics get width 0.
+// Returns false if the font has no substitute font.
+func (font *pdfFontTrueType) setWidthsFromSubstitute() bool {
+	first, last := clampCharRange(font.firstChar, font.lastChar)
+	if last < first {
+		return false
+	}
+	std := font.getSubstituteFont()
+	if std == nil {
+		return false
+	}
+
+	font.firstChar, font.lastChar = first, last
+	font.charWidths = make([]float64, last-first+1)
+	for i := range font.charWidths {
+		glyph, has := font.charcodeToGlyph(byte(first + i))
+		if !has {
+			continue
+		}
+		metrics, found := std.GetGlyphCharMetrics(glyph)
+		if !found {
+			metrics, found = std.GetGlyphCharMetrics(textencoding.NormalizeGlyphName(glyph))
+		}
+		if found {
+			font.charWidths[i] = metrics.Wx
+		}
+	}
+	return true
+}
+
+// setWidthsFromProgram sets the widths of codes FirstChar to LastChar from the glyph widths of the
+// embedded Type 1 font program.  Codes of glyphs not in the font program get width 0.  Returns
+// false if the font has no embedded Type 1 font program.
+func (font *pdfFontTrueType) setWidthsFromProgram() bool {
+	first, last := clampCharRange(font.firstChar, font.lastChar)
+	t1 := font.getType1Program()
+	if t1 == nil || last < first {
+		return false
+	}
+
+	font.firstChar, font.lastChar = first, last
+	font.charWidths = make([]float64, last-first+1)
+	for i := range font.charWidths {
+		glyph, has := font.charcodeToGlyph(byte(first + i))
+		if !has {
+			continue
+		}
+		if w, found := t1.GetGlyphWidth(glyph); found {
+			font.charWidths[i] = w
+		}
+	}
+	return true
+}
+
+// clampCharRange returns the range of character codes `first` to `last` of a simple font limited
+// to the single byte codes 0 to 255, for the widths computed for each code of FirstChar to LastChar.
+func clampCharRange(first, last int) (int, int) {
+	if first < 0 {
+		common.Log.Debug("FirstChar %d out of range - using 0", first)
+		first = 0
+	}
+	if last > 255 {
+		common.Log.Debug("LastChar %d out of range - using 255", last)
+		last = 255
+	}
+	return first, last
+}
+
+// charcodeToGlyph returns the glyph name of character code `code`: from the Encoding Differences,
+// or else the Encoder.
+func (font *pdfFontTrueType) charcodeToGlyph(code byte) (string, bool) {
+	if glyph, has := font.differences[code]; has {
+		return glyph, true
+	}
+	if font.Encoder == nil {
+		return "", false
+	}
+	return font.Encoder.CharcodeToGlyph(code)
+}
+
+// getType1Program returns the embedded Type 1 font program (FontFile) of a Type1 or MMType1 font,
+// parsing it on first use.  Returns nil if there is none or it cannot be parsed.
+func (font *pdfFontTrueType) getType1Program() *fonts.Type1Type {
+	font.t1Once.Do(func() {
+		if font.t1 == nil {
+			font.t1 = font.loadType1Program()
+		}
+	})
+	return font.t1
+}
+
+// loadType1Program parses the embedded Type 1 font program (FontFile), see getType1Program.
+func (font *pdfFontTrueType) loadType1Program() *fonts.Type1Type {
+	if font.FontDescriptor == nil {
+		return nil
+	}
+	stream, ok := core.TraceToDirectObject(font.FontDescriptor.FontFile).(*core.PdfObjectStream)
+	if !ok {
+		return nil
+	}
+	data, err := core.DecodeStream(stream)
+	if err != nil {
+		common.Log.Debug("Error decoding font program: %v", err)
+		return nil
+	}
+	length1 := 0
+	if l, ok := core.TraceToDirectObject(stream.Get("Length1")).(*core.PdfObjectInteger); ok {
+		length1 = int(*l)
+	}
+	t1, err := fonts.Type1ParseBytes(data, length1)
+	if err != nil {
+		common.Log.Debug("Error parsing font program: %v", err)
+		return nil
+	}
+	return t1
+}
+
+// addEncoding sets up the font's Encoder from its Encoding entry.  A non-symbolic font with no
+// Encoding (or an Encoding dictionary without BaseEncoding) defaults to StandardEncoding.  Symbolic
+// fonts without an Encoding rely on the built-in encoding of the font program and are left without
+// an Encoder.
+func (font *pdfFontTrueType) addEncoding() {
+	if font.Encoding == nil && font.FontDescriptor != nil && font.FontDescriptor.isSymbolic() {
+		common.Log.Debug("Symbolic font without Encoding - using built-in encoding of font program")
+		return
+	}
+
+	font.Encoder = newBaseEncoder(font.Encoding, textencoding.NewStandardEncoder())
+	if font.Encoder == nil {
+		font.Encoder = textencoding.NewStandardEncoder()
+	}
+}
+
+// newBaseEncoder returns the encoder of the base encoding given by Encoding entry `encoding`: the
+// encoding name, or the BaseEncoding of an Encoding dictionary.  Unsupported base encodings, such
+// as MacRomanEncoding, fall back to `fallback`.  Returns nil if no base encoding is given.
+func newBaseEncoder(encoding core.PdfObject, fallback textencoding.TextEncoder) textencoding.TextEncoder {
+	var baseName *core.PdfObjectName
+	switch t := core.TraceToDirectObject(encoding).(type) {
+	case *core.PdfObjectName:
+		baseName = t
+	case *core.PdfObjectDictionary:
+		if name, ok := core.TraceToDirectObject(t.Get("BaseEncoding")).(*core.PdfObjectName); ok {
+			baseName = name
+		}
+	}
+	if baseName == nil {
+		return nil
+	}
+
+	switch *baseName {
+	case "WinAnsiEncoding":
+		return textencoding.NewWinAnsiTextEncoder()
+	case "StandardEncoding":
+		return textencoding.NewStandardEncoder()
+	}
+	common.Log.Debug("Incompatibility: Unsupported base encoding %s - falling back to %T", *baseName, fallback)
+	return fallback
+}
+
+// subtypeName returns the Subtype of the font: TrueType unless set otherwise.
+func (font *pdfFontTrueType) subtypeName() string {
+	if font.subtype == "" {
+		return "TrueType"
+	}
+	return font.subtype
+}
+
 func (this *pdfFontTrueType) ToPdfObject() core.PdfObject {
 	if this.container == nil {
 		this.container = &core.PdfIndirectObject{}
@@ -271,7 +1022,7 @@ func (this *pdfFontTrueType) ToPdfObject() core.PdfObject {
 	this.container.PdfObject = d
 
 	d.Set("Type", core.MakeName("Font"))
-	d.Set("Subtype", core.MakeName("TrueType"))
+	d.Set("Subtype", core.MakeName(this.subtypeName()))
 
 	if this.BaseFont != nil {
 		d.Set("BaseFont", this.BaseFont)
@@ -306,6 +1057,7 @@ func NewPdfFontFromTTFFile(filePath string) (*PdfFont, error) {
 	}
 
 	truefont := &pdfFontTrueType{}
+	truefont.ttf = &ttf
 
 	truefont.Encoder = textencoding.NewWinAnsiTextEncoder()
 	truefont.firstChar = 32
@@ -325,16 +1077,17 @@ func NewPdfFontFromTTFFile(filePath string) (*PdfFont, error) {
 	vals := []float64{}
 
 	for charcode := 32; charcode <= 255; charcode++ {
-		runeVal, found := truefont.Encoder.CharcodeToRune(byte(charcode))
+		glyph, found := truefont.Encoder.CharcodeToGlyph(byte(charcode))
 		if !found {
-			common.Log.Debug("Rune not found (charcode: %d)", charcode)
+			common.Log.Debug("Glyph not found (charcode: %d)", charcode)
 			vals = append(vals, missingWidth)
 			continue
 		}
 
-		pos, ok := ttf.Chars[uint16(runeVal)]
-		if !ok {
-			common.Log.Debug("Rune not in TTF Chars")
+		// Look up via cmap, falling back to the post table glyph names.
+		pos, ok := ttf.GetGID(glyph)
+		if !ok || int(pos) >= len(ttf.Widths) {
+			common.Log.Debug("Glyph not in TTF (%s)", glyph)
 			vals = append(vals, missingWidth)
 			continue
 		}
@@ -406,6 +1159,398 @@ func NewPdfFontFromTTFFile(filePath string) (*PdfFont, error) {
 	return font, nil
 }
 
+// NewSimplePdfFont returns a simple font with the font descriptor `descriptor`, the encoder
+// `encoder` and the glyph widths `widths` by character code.  FirstChar, LastChar and Widths are
+// derived from `widths`; codes in between without a width get the MissingWidth of the descriptor.
+// The Subtype is Type1 if the descriptor has a Type1 font program (FontFile, or FontFile3 with
+// Subtype Type1C) and TrueType otherwise.
+func NewSimplePdfFont(descriptor *PdfFontDescriptor, encoder textencoding.TextEncoder, widths map[byte]float64) (*PdfFont, error) {
+	if descriptor == nil || encoder == nil {
+		return nil, errors.New("Required attribute missing")
+	}
+	if len(widths) == 0 {
+		common.Log.Debug("No widths for simple font")
+		return nil, errors.New("Required attribute missing (Widths)")
+	}
+
+	firstChar, lastChar := 255, 0
+	for code := range widths {
+		if int(code) < firstChar {
+			firstChar = int(code)
+		}
+		if int(code) > lastChar {
+			lastChar = int(code)
+		}
+	}
+
+	missingWidth := 0.0
+	if descriptor.MissingWidth != nil {
+		if w, err := getNumberAsFloat(core.TraceToDirectObject(descriptor.MissingWidth)); err == nil {
+			missingWidth = w
+		}
+	}
+	vals := []float64{}
+	for code := firstChar; code <= lastChar; code++ {
+		if w, has := widths[byte(code)]; has {
+			vals = append(vals, w)
+		} else {
+			vals = append(vals, missingWidth)
+		}
+	}
+
+	simple := &pdfFontTrueType{}
+	simple.subtype = "TrueType"
+	if descriptor.FontFile != nil {
+		simple.subtype = "Type1"
+	} else if stream, ok := core.TraceToDirectObject(descriptor.FontFile3).(*core.PdfObjectStream); ok {
+		if name, ok := stream.Get("Subtype").(*core.PdfObjectName); ok && *name == "Type1C" {
+			simple.subtype = "Type1"
+		}
+	}
+
+	simple.Encoder = encoder
+	simple.firstChar = firstChar
+	simple.lastChar = lastChar
+	simple.charWidths = vals
+	simple.BaseFont = descriptor.FontName
+	simple.FirstChar = core.MakeInteger(int64(firstChar))
+	simple.LastChar = core.MakeInteger(int64(lastChar))
+	simple.Widths = core.MakeArrayFromFloats(vals)
+	simple.FontDescriptor = descriptor
+	simple.Encoding = encoder.ToPdfObject()
+
+	font := &PdfFont{}
+	font.context = simple
+
+	return font, nil
+}
+
+// pdfFontStandard14 represents one of the standard 14 Type1 fonts, which are not embedded.
+type pdfFontStandard14 struct {
+	fonts.Font
+	encoder textencoding.TextEncoder
+	// Encoding entry of the font dictionary the font was loaded from, if any, written back unless
+	// the encoder is changed (keepEncoding).
+	encoding     core.PdfObject
+	keepEncoding bool
+	// ToUnicode and FontDescriptor entries of the font dictionary the font was loaded from, if any.
+	// The ToUnicode CMap maps the codes of the loaded encoding, so it is dropped with it.
+	toUnicode  core.PdfObject
+	descriptor core.PdfObject
+
+	coverage glyphCoverage
+}
+
+// NewStandard14Font returns the standard 14 font `basefont`, e.g. "Helvetica" or "Times-Bold".
+// Symbol and ZapfDingbats use their built-in encoding, all other fonts use WinAnsiEncoding.
+func NewStandard14Font(basefont string) (*PdfFont, error) {
+	std := &pdfFontStandard14{}
+	std.encoder = textencoding.NewWinAnsiTextEncoder()
+
+	switch basefont {
+	case "Courier":
+		std.Font = fonts.NewFontCourier()
+	case "Courier-Bold":
+		std.Font = fonts.NewFontCourierBold()
+	case "Courier-BoldOblique":
+		std.Font = fonts.NewFontCourierBoldOblique()
+	case "Courier-Oblique":
+		std.Font = fonts.NewFontCourierOblique()
+	case "Helvetica":
+		std.Font = fonts.NewFontHelvetica()
+	case "Helvetica-Bold":
+		std.Font = fonts.NewFontHelveticaBold()
+	case "Helvetica-BoldOblique":
+		std.Font = fonts.NewFontHelveticaBoldOblique()
+	case "Helvetica-Oblique":
+		std.Font = fonts.NewFontHelveticaOblique()
+	case "Times-Roman":
+		std.Font = fonts.NewFontTimesRoman()
+	case "Times-Bold":
+		std.Font = fonts.NewFontTimesBold()
+	case "Times-BoldItalic":
+		std.Font = fonts.NewFontTimesBoldItalic()
+	case "Times-Italic":
+		std.Font = fonts.NewFontTimesItalic()
+	case "Symbol":
+		std.Font = fonts.NewFontSymbol()
+		std.encoder = textencoding.NewSymbolEncoder()
+	case "ZapfDingbats":
+		std.Font = fonts.NewFontZapfDingbats()
+		std.encoder = textencoding.NewZapfDingbatsEncoder()
+	default:
+		common.Log.Debug("Not a standard 14 font: %s", basefont)
+		return nil, errors.New("Unsupported font")
+	}
+
+	font := &PdfFont{}
+	font.context = std
+	return font, nil
+}
+
+// newStandard14FontFromDict returns the standard 14 font of the simple font dictionary `d` if it
+// has a standard 14 BaseFont and neither Widths nor an embedded font program, so that the metrics
+// are those of the standard font.  The encoder is that of the Encoding of `d`, with the Differences
+// applied on the base encoding.  Without a base encoding, it is the built-in encoding of the font:
+// StandardEncoding, or that of the font for Symbol and ZapfDingbats.  Returns nil if `d` is not
+// such a font.
+func newStandard14FontFromDict(d *core.PdfObjectDictionary) *pdfFontStandard14 {
+	if d.Get("Widths") != nil {
+		return nil
+	}
+	basefont, ok := core.TraceToDirectObject(d.Get("BaseFont")).(*core.PdfObjectName)
+	if !ok {
+		return nil
+	}
+	if descriptor, ok := core.TraceToDirectObject(d.Get("FontDescriptor")).(*core.PdfObjectDictionary); ok {
+		for _, key := range []core.PdfObjectName{"FontFile", "FontFile2", "FontFile3"} {
+			if descriptor.Get(key) != nil {
+				return nil
+			}
+		}
+	}
+	font, err := NewStandard14Font(string(*basefont))
+	if err != nil {
+		return nil
+	}
+	std := font.context.(*pdfFontStandard14)
+
+	builtin := std.encoder
+	if name := string(*basefont); name != "Symbol" && name != "ZapfDingbats" {
+		builtin = textencoding.NewStandardEncoder()
+	}
+	encoding := d.Get("Encoding")
+	encoder := newBaseEncoder(encoding, builtin)
+	if encoder == nil {
+		encoder = builtin
+	}
+
+	differences := map[byte]string{}
+	for code, glyph := range getDifferences(encoding) {
+		// Match glyph names of other conventions, such as uni00C4, to the names of the metrics.
+		if _, found := std.GetGlyphCharMetrics(glyph); !found {
+			normalized := textencoding.NormalizeGlyphName(glyph)
+			if _, found := std.GetGlyphCharMetrics(normalized); found {
+				glyph = normalized
+			} else {
+				common.Log.Debug("Glyph /%s of Differences code %d not in %s metrics", glyph, code, *basefont)
+			}
+		}
+		differences[byte(code)] = glyph
+	}
+	if len(differences) > 0 {
+		encoder = textencoding.NewDifferencesEncoder(encoder, differences)
+	}
+	std.SetEncoder(encoder)
+	std.encoding = encoding
+	std.keepEncoding = true
+	std.toUnicode = d.Get("ToUnicode")
+	std.descriptor = d.Get("FontDescriptor")
+	return std
+}
+
+// ToPdfObject returns the font dictionary of the standard font.  A font loaded from a font
+// dictionary keeps its Encoding entry, or its lack of one, and its ToUnicode entry unless its
+// encoder was changed since; otherwise the Encoding is that of the encoder.  Its FontDescriptor
+// entry is kept in any case.
+func (font *pdfFontStandard14) ToPdfObject() core.PdfObject {
+	obj := font.Font.ToPdfObject()
+	ind, ok := obj.(*core.PdfIndirectObject)
+	if !ok {
+		return obj
+	}
+	d, ok := ind.PdfObject.(*core.PdfObjectDictionary)
+	if !ok {
+		return obj
+	}
+	if font.keepEncoding {
+		if font.encoding != nil {
+			d.Set("Encoding", font.encoding)
+		} else {
+			d.Remove("Encoding")
+		}
+		d.SetIfNotNil("ToUnicode", font.toUnicode)
+	}
+	d.SetIfNotNil("FontDescriptor", font.descriptor)
+	return obj
+}
+
+func (font *pdfFontStandard14) SetEncoder(encoder textencoding.TextEncoder) {
+	font.encoder = encoder
+	font.encoding = nil
+	font.keepEncoding = false
+	font.toUnicode = nil
+	font.Font.SetEncoder(encoder)
+	font.coverage.reset()
+}
+
+// hasGlyph returns true if rune `r` can be encoded with the font encoding and the glyph is in the
+// font metrics.
+func (font *pdfFontStandard14) hasGlyph(r rune) bool {
+	glyph, found := font.encoder.RuneToGlyph(r)
+	if !found {
+		return false
+	}
+	if _, found = font.encoder.GlyphToCharcode(glyph); !found {
+		return false
+	}
+	_, found = font.GetGlyphCharMetrics(glyph)
+	return found
+}
+
+// pdfFontType3 represents a Type3 font, whose glyphs are defined by content streams (9.6.5 - Table 112).
+type pdfFontType3 struct {
+	Name           core.PdfObject
+	FontBBox       core.PdfObject
+	FontMatrix     core.PdfObject
+	CharProcs      core.PdfObject
+	Encoding       core.PdfObject
+	FirstChar      core.PdfObject
+	LastChar       core.PdfObject
+	Widths         core.PdfObject
+	FontDescriptor core.PdfObject
+	Resources      core.PdfObject
+	ToUnicode      core.PdfObject
+
+	firstChar  int
+	charWidths []float64
+	// Horizontal scale of the FontMatrix, mapping glyph space to text space.
+	scaleX float64
+	// Character codes of the glyph names in the Encoding Differences.
+	glyphCodes map[string]byte
+	// Encoder of the base encoding, for glyphs not in the Differences.
+	encoder textencoding.TextEncoder
+
+	container *core.PdfIndirectObject
+}
+
+func newPdfFontType3FromPdfObject(obj core.PdfObject) (*pdfFontType3, error) {
+	font := &pdfFontType3{}
+
+	if ind, is := obj.(*core.PdfIndirectObject); is {
+		font.container = ind
+		obj = ind.PdfObject
+	}
+
+	d, ok := obj.(*core.PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("Font object invalid, not a dictionary (%T)", obj)
+		return nil, errors.New("Type check error")
+	}
+
+	font.Name = d.Get("Name")
+	font.FontBBox = d.Get("FontBBox")
+	font.CharProcs = d.Get("CharProcs")
+	font.Encoding = d.Get("Encoding")
+	font.LastChar = d.Get("LastChar")
+	font.FontDescriptor = d.Get("FontDescriptor")
+	font.Resources = d.Get("Resources")
+	font.ToUnicode = d.Get("ToUnicode")
+
+	font.FontMatrix = d.Get("FontMatrix")
+	arr, ok := core.TraceToDirectObject(font.FontMatrix).(*core.PdfObjectArray)
+	if !ok || len(*arr) != 6 {
+		common.Log.Debug("ERROR: Invalid FontMatrix (%v)", font.FontMatrix)
+		return nil, errors.New("Required attribute missing")
+	}
+	matrix, err := arr.ToFloat64Array()
+	if err != nil {
+		common.Log.Debug("Error converting FontMatrix to array")
+		return nil, err
+	}
+	font.scaleX = matrix[0]
+
+	font.FirstChar = d.Get("FirstChar")
+	if intVal, ok := core.TraceToDirectObject(font.FirstChar).(*core.PdfObjectInteger); ok {
+		font.firstChar = int(*intVal)
+	} else {
+		common.Log.Debug("ERROR: FirstChar attribute missing or invalid")
+		return nil, errors.New("Required attribute missing")
+	}
+
+	font.Widths = d.Get("Widths")
+	if arr, ok := core.TraceToDirectObject(font.Widths).(*core.PdfObjectArray); ok {
+		widths, err := arr.ToFloat64Array()
+		if err != nil {
+			common.Log.Debug("Error converting widths to array")
+			return nil, err
+		}
+		font.charWidths = widths
+	} else {
+		common.Log.Debug("ERROR: Widths attribute missing or invalid")
+		return nil, errors.New("Required attribute missing")
+	}
+
+	// Codes in ascending order, so that a glyph listed for several codes maps to the lowest one.
+	differences := getDifferences(font.Encoding)
+	codes := make([]uint64, 0, len(differences))
+	for code := range differences {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	font.glyphCodes = map[string]byte{}
+	for _, code := range codes {
+		glyph := differences[code]
+		if _, has := font.glyphCodes[glyph]; !has {
+			font.glyphCodes[glyph] = byte(code)
+		}
+	}
+	font.encoder = newBaseEncoder(font.Encoding, textencoding.NewStandardEncoder())
+
+	return font, nil
+}
+
+func (font *pdfFontType3) SetEncoder(encoder textencoding.TextEncoder) {
+	font.encoder = encoder
+}
+
+// GetGlyphCharMetrics returns the metrics of `glyph`.  The width is transformed from glyph space by
+// the FontMatrix and given in thousandths of text space units, as for other fonts.
+func (font *pdfFontType3) GetGlyphCharMetrics(glyph string) (fonts.CharMetrics, bool) {
+	metrics := fonts.CharMetrics{GlyphName: glyph}
+
+	code, found := font.glyphCodes[glyph]
+	if !found && font.encoder != nil {
+		code, found = font.encoder.GlyphToCharcode(glyph)
+	}
+	if !found {
+		return metrics, false
+	}
+
+	index := int(code) - font.firstChar
+	if index < 0 || index >= len(font.charWidths) {
+		common.Log.Debug("Code outside of widths range (%d)", code)
+		return metrics, false
+	}
+
+	metrics.Wx = font.charWidths[index] * font.scaleX * 1000
+	return metrics, true
+}
+
+func (font *pdfFontType3) ToPdfObject() core.PdfObject {
+	if font.container == nil {
+		font.container = &core.PdfIndirectObject{}
+	}
+	d := core.MakeDict()
+	font.container.PdfObject = d
+
+	d.Set("Type", core.MakeName("Font"))
+	d.Set("Subtype", core.MakeName("Type3"))
+	d.SetIfNotNil("Name", font.Name)
+	d.SetIfNotNil("FontBBox", font.FontBBox)
+	d.SetIfNotNil("FontMatrix", font.FontMatrix)
+	d.SetIfNotNil("CharProcs", font.CharProcs)
+	d.SetIfNotNil("Encoding", font.Encoding)
+	d.SetIfNotNil("FirstChar", font.FirstChar)
+	d.SetIfNotNil("LastChar", font.LastChar)
+	d.SetIfNotNil("Widths", font.Widths)
+	d.SetIfNotNil("FontDescriptor", font.FontDescriptor)
+	d.SetIfNotNil("Resources", font.Resources)
+	d.SetIfNotNil("ToUnicode", font.ToUnicode)
+
+	return font.container
+}
+
 // Font descriptors specifies metrics and other attributes of a font.
 type PdfFontDescriptor struct {
 	FontName     core.PdfObject
@@ -438,6 +1583,147 @@ type PdfFontDescriptor struct {
 
 	// Container.
 	container *core.PdfIndirectObject
+	// Dictionary of the container as loaded.  The container may be shared by several fonts.
+	loaded *core.PdfObjectDictionary
+
+	// Glyph names of the CharSet, with their normalized names (parsed on demand), nil without a
+	// CharSet.  Only the first glyph missing from the CharSet is logged.
+	charSet     map[string]bool
+	charSetOnce sync.Once
+	missingOnce sync.Once
+}
+
+// isSymbolic returns true if the Symbolic flag (bit 3) is set in the descriptor Flags.
+func (this *PdfFontDescriptor) isSymbolic() bool {
+	flags, ok := core.TraceToDirectObject(this.Flags).(*core.PdfObjectInteger)
+	if !ok {
+		return false
+	}
+	return *flags&(1<<2) != 0
+}
+
+// substituteName returns the name of the standard 14 font closest to the font described: Courier
+// if the FixedPitch flag (bit 1) is set, Times if the Serif flag (bit 2) is set, otherwise
+// Helvetica.  The bold variant is chosen for a FontWeight of at least 600 or the ForceBold flag
+// (bit 19), and the italic (or oblique) variant for a non-zero ItalicAngle or the Italic flag
+// (bit 7).
+func (this *PdfFontDescriptor) substituteName() string {
+	flags := 0
+	if f, ok := core.TraceToDirectObject(this.Flags).(*core.PdfObjectInteger); ok {
+		flags = int(*f)
+	}
+	bold := flags&(1<<18) != 0
+	if weight, err := getNumberAsFloat(core.TraceToDirectObject(this.FontWeight)); err == nil && weight >= 600 {
+		bold = true
+	}
+	italic := flags&(1<<6) != 0
+	if angle, err := getNumberAsFloat(core.TraceToDirectObject(this.ItalicAngle)); err == nil && angle != 0 {
+		italic = true
+	}
+
+	family, italicName := "Helvetica", "Oblique"
+	if flags&(1<<0) != 0 {
+		family = "Courier"
+	} else if flags&(1<<1) != 0 {
+		family, italicName = "Times", "Italic"
+	}
+
+	switch {
+	case bold && italic:
+		return family + "-Bold" + italicName
+	case bold:
+		return family + "-Bold"
+	case italic:
+		return family + "-" + italicName
+	case family == "Times":
+		return "Times-Roman"
+	}
+	return family
+}
+
+// GetLanguage returns the language tag (Lang) of the font, e.g. "en-US", as used for language-aware
+// text processing.  The bool flag is false (and the tag empty) if Lang is not specified.
+func (this *PdfFontDescriptor) GetLanguage() (string, bool) {
+	switch t := core.TraceToDirectObject(this.Lang).(type) {
+	case *core.PdfObjectName:
+		return string(*t), true
+	case *core.PdfObjectString:
+		// Name per the specification, but also found as a string.
+		return string(*t), true
+	}
+	return "", false
+}
+
+// GetCharSet returns the glyph names listed by the CharSet of the font descriptor, the glyphs of a
+// Type 1 font subset (9.8.1 - Table 122), in order.  The bool flag is false if the descriptor has
+// no CharSet.
+func (this *PdfFontDescriptor) GetCharSet() ([]string, bool) {
+	str, ok := core.TraceToDirectObject(this.CharSet).(*core.PdfObjectString)
+	if !ok {
+		return nil, false
+	}
+	return parseCharSet(string(*str)), true
+}
+
+// charSetHas returns true if glyph `glyph` is in the CharSet, directly or by its normalized name
+// (see textencoding.NormalizeGlyphName), or if the descriptor has no CharSet.  A glyph missing from
+// the CharSet is not in the font program of a subset font, so the first one is logged.  Safe for
+// concurrent use by the fonts sharing the descriptor.
+func (this *PdfFontDescriptor) charSetHas(glyph string) bool {
+	this.charSetOnce.Do(func() {
+		names, ok := this.GetCharSet()
+		if !ok {
+			return
+		}
+		charSet := map[string]bool{}
+		for _, name := range names {
+			charSet[name] = true
+			charSet[textencoding.NormalizeGlyphName(name)] = true
+		}
+		this.charSet = charSet
+	})
+	if this.charSet == nil || this.charSet[glyph] || this.charSet[textencoding.NormalizeGlyphName(glyph)] {
+		return true
+	}
+	this.missingOnce.Do(func() {
+		common.Log.Debug("Glyph %q not in the CharSet of subset font %v (further glyphs not logged)",
+			glyph, this.FontName)
+	})
+	return false
+}
+
+// parseCharSet returns the names of CharSet string `charSet`, a sequence of names such as
+// "/A/B/space", with #xx escapes decoded.  Whitespace between the names is tolerated.
+func parseCharSet(charSet string) []string {
+	var names []string
+	for _, name := range strings.Split(charSet, "/") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		names = append(names, decodeNameEscapes(name))
+	}
+	return names
+}
+
+// decodeNameEscapes decodes the #xx hexadecimal escapes of name `name` (7.3.5).  Invalid escapes are
+// kept as they are.
+func decodeNameEscapes(name string) string {
+	if !strings.Contains(name, "#") {
+		return name
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(name); i++ {
+		if name[i] == '#' && i+2 < len(name) {
+			if b, err := hex.DecodeString(name[i+1 : i+3]); err == nil {
+				buf.WriteByte(b[0])
+				i += 2
+				continue
+			}
+		}
+		buf.WriteByte(name[i])
+	}
+	return buf.String()
 }
 
 // Load the font descriptor from a PdfObject.  Can either be a *PdfIndirectObject or
@@ -455,6 +1741,9 @@ func newPdfFontDescriptorFromPdfObject(obj core.PdfObject) (*PdfFontDescriptor,
 		common.Log.Debug("FontDescriptor not given by a dictionary (%T)", obj)
 		return nil, errors.New("Type check error")
 	}
+	if descriptor.container != nil {
+		descriptor.loaded = d
+	}
 
 	if obj := d.Get("Type"); obj != nil {
 		oname, is := obj.(*core.PdfObjectName)
@@ -499,13 +1788,46 @@ func newPdfFontDescriptorFromPdfObject(obj core.PdfObject) (*PdfFontDescriptor,
 	return descriptor, nil
 }
 
+// fontDescriptorKeys are the entries of a font descriptor (9.8.1 - Table 122), except Type and
+// FontName.
+var fontDescriptorKeys = []core.PdfObjectName{
+	"FontFamily", "FontStretch", "FontWeight", "Flags", "FontBBox", "ItalicAngle", "Ascent", "Descent",
+	"Leading", "CapHeight", "XHeight", "StemV", "StemH", "AvgWidth", "MaxWidth", "MissingWidth",
+	"FontFile", "FontFile2", "FontFile3", "CharSet", "Style", "Lang", "FD", "CIDSet",
+}
+
+// newPdfFontDescriptorFromFontDict returns a font descriptor made of the descriptor entries that
+// some malformed fonts place in the font dictionary `d` itself instead of a FontDescriptor.  The
+// FontName is taken from BaseFont.  Returns nil if `d` has none of Flags, FontBBox and Ascent.
+func newPdfFontDescriptorFromFontDict(d *core.PdfObjectDictionary) *PdfFontDescriptor {
+	if d.Get("Flags") == nil && d.Get("FontBBox") == nil && d.Get("Ascent") == nil {
+		return nil
+	}
+
+	dd := core.MakeDict()
+	dd.Set("Type", core.MakeName("FontDescriptor"))
+	dd.SetIfNotNil("FontName", d.Get("BaseFont"))
+	for _, key := range fontDescriptorKeys {
+		dd.SetIfNotNil(key, d.Get(key))
+	}
+
+	descriptor, err := newPdfFontDescriptorFromPdfObject(dd)
+	if err != nil {
+		return nil
+	}
+	return descriptor
+}
+
 // Convert to a PDF dictionary inside an indirect object.
+//
+// A descriptor object loaded from a document can be shared by several fonts (e.g. the variants of a
+// font family), each with its own PdfFontDescriptor.  The loaded object is therefore left unchanged
+// and a modified descriptor is written to a new object.
 func (this *PdfFontDescriptor) ToPdfObject() core.PdfObject {
 	d := core.MakeDict()
 	if this.container == nil {
 		this.container = &core.PdfIndirectObject{}
 	}
-	this.container.PdfObject = d
 
 	d.Set("Type", core.MakeName("FontDescriptor"))
 
@@ -594,7 +1916,7 @@ func (this *PdfFontDescriptor) ToPdfObject() core.PdfObject {
 	}
 
 	if this.Style != nil {
-		d.Set("FontName", this.FontName)
+		d.Set("Style", this.Style)
 	}
 
 	if this.Lang != nil {
@@ -609,5 +1931,15 @@ func (this *PdfFontDescriptor) ToPdfObject() core.PdfObject {
 		d.Set("CIDSet", this.CIDSet)
 	}
 
+	if this.loaded != nil {
+		if equivalentObjects(this.loaded, d) {
+			return this.container
+		}
+		common.Log.Trace("Font descriptor modified - writing to a new object")
+		this.container = &core.PdfIndirectObject{}
+		this.loaded = nil
+	}
+	this.container.PdfObject = d
+
 	return this.container
 }
@@ -0,0 +1,447 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/unidoc/unidoc/common"
+	"github.com/unidoc/unidoc/pdf/core"
+	"github.com/unidoc/unidoc/pdf/internal/cmap"
+	"github.com/unidoc/unidoc/pdf/model/fonts"
+)
+
+// pdfFontType0 represents a composite (Type0) font (9.7.6 - Table 121).  The glyphs and their
+// metrics are given by the descendant CIDFont.
+type pdfFontType0 struct {
+	BaseFont        core.PdfObject
+	Encoding        core.PdfObject
+	DescendantFonts core.PdfObject
+	ToUnicode       core.PdfObject
+
+	// The descendant CIDFont.
+	descendant *pdfCIDFont
+	// Vertical writing mode (WMode 1 of the Encoding CMap).
+	vertical bool
+	// Embedded Encoding CMap, giving the codespace ranges of the character codes and their CIDs.
+	// Nil for predefined CMaps such as Identity-H.
+	encoding *cmap.CMap
+
+	container *core.PdfIndirectObject
+}
+
+func newPdfFontType0FromPdfObject(obj core.PdfObject) (*pdfFontType0, error) {
+	font := &pdfFontType0{}
+
+	if ind, is := obj.(*core.PdfIndirectObject); is {
+		font.container = ind
+		obj = ind.PdfObject
+	}
+
+	d, ok := obj.(*core.PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("Font object invalid, not a dictionary (%T)", obj)
+		return nil, errors.New("Type check error")
+	}
+
+	font.BaseFont = d.Get("BaseFont")
+	font.Encoding = d.Get("Encoding")
+	font.ToUnicode = d.Get("ToUnicode")
+
+	font.DescendantFonts = d.Get("DescendantFonts")
+	arr, ok := core.TraceToDirectObject(font.DescendantFonts).(*core.PdfObjectArray)
+	if !ok || len(*arr) == 0 {
+		common.Log.Debug("ERROR: Invalid DescendantFonts (%v)", font.DescendantFonts)
+		return nil, errors.New("Required attribute missing")
+	}
+	// DescendantFonts must have a single entry, but some files have stray extra entries.  The
+	// first valid descendant is used.
+	if len(*arr) > 1 {
+		common.Log.Debug("Incompatibility: DescendantFonts has %d entries, expected 1", len(*arr))
+	}
+	var err error
+	for i, obj := range *arr {
+		var descendant *pdfCIDFont
+		descendant, err = newPdfCIDFontFromPdfObject(obj)
+		if err != nil {
+			common.Log.Debug("Error loading descendant font %d: %v", i, err)
+			continue
+		}
+		if i > 0 {
+			common.Log.Debug("Incompatibility: Using DescendantFonts entry %d", i)
+		}
+		font.descendant = descendant
+		break
+	}
+	if font.descendant == nil {
+		return nil, err
+	}
+
+	// The writing mode is given by the CMap: the predefined vertical CMaps end with -V, embedded
+	// CMaps have a WMode entry.
+	switch t := core.TraceToDirectObject(font.Encoding).(type) {
+	case *core.PdfObjectName:
+		font.vertical = strings.HasSuffix(string(*t), "-V")
+	case *core.PdfObjectStream:
+		if wmode, ok := core.TraceToDirectObject(t.Get("WMode")).(*core.PdfObjectInteger); ok {
+			font.vertical = *wmode == 1
+		}
+		if decoded, err := core.DecodeStream(t); err != nil {
+			common.Log.Debug("Error decoding Encoding CMap: %v", err)
+		} else if encoding, err := cmap.LoadCmapFromData(decoded); err != nil {
+			common.Log.Debug("Error loading Encoding CMap: %v", err)
+		} else {
+			font.encoding = encoding
+		}
+	}
+
+	return font, nil
+}
+
+// nextCode returns the character code at the start of `data` and its length in bytes, as given by
+// the codespace ranges of the Encoding CMap, or 2 bytes for predefined CMaps (whose ranges are not
+// available) and embedded CMaps without codespace ranges.  The length can exceed len(`data`) if
+// `data` ends within a code.
+func (font *pdfFontType0) nextCode(data []byte) (uint64, int) {
+	if font.encoding != nil {
+		if code, size := font.encoding.NextCode(data); size > 0 {
+			return code, size
+		}
+	}
+	if len(data) < 2 {
+		return uint64(data[0]), 2
+	}
+	return uint64(data[0])<<8 | uint64(data[1]), 2
+}
+
+// charcodeToCID returns the CID of character code `code`: as mapped by an embedded Encoding CMap,
+// with unmapped codes mapped to notdef (CID 0), or else the code itself, as for Identity-H and
+// Identity-V (the CID mappings of the other predefined CMaps are not available) and embedded CMaps
+// without CID mappings (e.g. using a predefined CMap by usecmap).
+func (font *pdfFontType0) charcodeToCID(code uint64) uint16 {
+	if font.encoding == nil || !font.encoding.HasCIDMappings() {
+		return uint16(code)
+	}
+	cid, _ := font.encoding.CharcodeToCID(code)
+	return cid
+}
+
+// GetCIDMetrics returns the metrics of the glyph for CID `cid`, see pdfCIDFont.GetCIDMetrics.  The
+// vertical displacement is only set in vertical writing mode.
+func (font *pdfFontType0) GetCIDMetrics(cid uint16) (fonts.CharMetrics, bool) {
+	return font.descendant.getCIDMetrics(cid, font.vertical)
+}
+
+func (font *pdfFontType0) ToPdfObject() core.PdfObject {
+	if font.container == nil {
+		font.container = &core.PdfIndirectObject{}
+	}
+	d := core.MakeDict()
+	font.container.PdfObject = d
+
+	d.Set("Type", core.MakeName("Font"))
+	d.Set("Subtype", core.MakeName("Type0"))
+	d.SetIfNotNil("BaseFont", font.BaseFont)
+	d.SetIfNotNil("Encoding", font.Encoding)
+	d.SetIfNotNil("DescendantFonts", font.DescendantFonts)
+	d.SetIfNotNil("ToUnicode", font.ToUnicode)
+
+	return font.container
+}
+
+// pdfCIDFont represents a CIDFont (CIDFontType0 or CIDFontType2), the descendant of a Type0 font
+// (9.7.4 - Table 117).
+type pdfCIDFont struct {
+	Subtype        core.PdfObject
+	BaseFont       core.PdfObject
+	CIDSystemInfo  core.PdfObject
+	FontDescriptor core.PdfObject
+	DW             core.PdfObject
+	W              core.PdfObject
+	DW2            core.PdfObject
+	W2             core.PdfObject
+	CIDToGIDMap    core.PdfObject
+
+	// Default and individual horizontal widths.
+	defaultWidth float64
+	widths       map[uint16]float64
+	// Default and individual vertical metrics.
+	defaultVertical cidVerticalMetrics
+	verticals       map[uint16]cidVerticalMetrics
+
+	// CFF font program of CIDFontType0 fonts (parsed on demand from FontFile3).
+	cff     *fonts.CffType
+	cffOnce sync.Once
+
+	// Metrics of the TrueType font program of CIDFontType2 fonts and the CIDToGIDMap stream data
+	// (loaded on demand).
+	ttf      *fonts.TtfType
+	cidToGID []byte
+	ttfOnce  sync.Once
+	// Whether widths missing from W are taken from the TrueType font program (see
+	// PdfFont.SetCIDWidthsFromHmtx).
+	widthsFromHmtx bool
+}
+
+// cidVerticalMetrics are the vertical metrics of a CID: the vertical displacement w1y and the
+// position vector (vx, vy) of the vertical origin.
+type cidVerticalMetrics struct {
+	w1y, vx, vy float64
+}
+
+func newPdfCIDFontFromPdfObject(obj core.PdfObject) (*pdfCIDFont, error) {
+	d, ok := core.TraceToDirectObject(obj).(*core.PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("CIDFont object invalid, not a dictionary (%T)", obj)
+		return nil, errors.New("Type check error")
+	}
+
+	font := &pdfCIDFont{}
+	font.Subtype = d.Get("Subtype")
+	if subtype, ok := core.TraceToDirectObject(font.Subtype).(*core.PdfObjectName); !ok ||
+		(*subtype != "CIDFontType0" && *subtype != "CIDFontType2") {
+		common.Log.Debug("ERROR: Invalid CIDFont Subtype (%v)", font.Subtype)
+		return nil, errors.New("Range check error")
+	}
+	font.BaseFont = d.Get("BaseFont")
+	font.CIDSystemInfo = d.Get("CIDSystemInfo")
+	font.FontDescriptor = d.Get("FontDescriptor")
+	font.CIDToGIDMap = d.Get("CIDToGIDMap")
+
+	font.DW = d.Get("DW")
+	font.defaultWidth = 1000
+	if dw, err := getNumberAsFloat(core.TraceToDirectObject(font.DW)); err == nil {
+		font.defaultWidth = dw
+	}
+
+	font.W = d.Get("W")
+	font.widths = map[uint16]float64{}
+	if font.W != nil {
+		err := parseCIDMetricsArray(font.W, 1, func(cid uint16, values []float64) {
+			font.widths[cid] = values[0]
+		})
+		if err != nil {
+			common.Log.Debug("ERROR: Invalid W array: %v", err)
+			return nil, err
+		}
+	}
+
+	font.DW2 = d.Get("DW2")
+	font.defaultVertical = cidVerticalMetrics{w1y: -1000, vy: 880}
+	if arr, ok := core.TraceToDirectObject(font.DW2).(*core.PdfObjectArray); ok && len(*arr) == 2 {
+		if values, err := arr.ToFloat64Array(); err == nil {
+			font.defaultVertical = cidVerticalMetrics{w1y: values[1], vy: values[0]}
+		}
+	}
+
+	font.W2 = d.Get("W2")
+	font.verticals = map[uint16]cidVerticalMetrics{}
+	if font.W2 != nil {
+		err := parseCIDMetricsArray(font.W2, 3, func(cid uint16, values []float64) {
+			font.verticals[cid] = cidVerticalMetrics{w1y: values[0], vx: values[1], vy: values[2]}
+		})
+		if err != nil {
+			common.Log.Debug("ERROR: Invalid W2 array: %v", err)
+			return nil, err
+		}
+	}
+
+	return font, nil
+}
+
+// parseCIDMetricsArray parses the W or W2 array `obj` (9.7.4.3), whose entries are `n` numbers per
+// CID, given as `c [values of c, c+1, ...]` or `cfirst clast values`.  Calls `set` for each CID.
+func parseCIDMetricsArray(obj core.PdfObject, n int, set func(cid uint16, values []float64)) error {
+	arr, ok := core.TraceToDirectObject(obj).(*core.PdfObjectArray)
+	if !ok {
+		return errors.New("Type check error")
+	}
+
+	for i := 0; i < len(*arr); {
+		first, ok := core.TraceToDirectObject((*arr)[i]).(*core.PdfObjectInteger)
+		if !ok || i+1 >= len(*arr) {
+			return errors.New("Invalid CID")
+		}
+		if list, ok := core.TraceToDirectObject((*arr)[i+1]).(*core.PdfObjectArray); ok {
+			values, err := list.ToFloat64Array()
+			if err != nil {
+				return err
+			}
+			if len(values)%n != 0 {
+				return errors.New("Invalid number of values")
+			}
+			for j := 0; j < len(values); j += n {
+				set(uint16(int64(*first)+int64(j/n)), values[j:j+n])
+			}
+			i += 2
+			continue
+		}
+
+		last, ok := core.TraceToDirectObject((*arr)[i+1]).(*core.PdfObjectInteger)
+		if !ok || *last < *first || i+2+n > len(*arr) {
+			return errors.New("Invalid CID range")
+		}
+		values, err := core.MakeArray((*arr)[i+2 : i+2+n]...).ToFloat64Array()
+		if err != nil {
+			return err
+		}
+		for cid := int64(*first); cid <= int64(*last) && cid <= 0xFFFF; cid++ {
+			set(uint16(cid), values)
+		}
+		i += 2 + n
+	}
+	return nil
+}
+
+// GetCIDMetrics returns the metrics of the glyph for CID `cid` in thousandths of text space units:
+// the width from W, else from the embedded CFF font program of CIDFontType0 fonts (or, if enabled
+// with PdfFont.SetCIDWidthsFromHmtx, the TrueType font program of CIDFontType2 fonts), else DW.
+// Returns false if the DW default is used.
+func (font *pdfCIDFont) GetCIDMetrics(cid uint16) (fonts.CharMetrics, bool) {
+	return font.getCIDMetrics(cid, false)
+}
+
+// getCIDMetrics returns the metrics of CID `cid`, with the vertical displacement Wy from W2 (or
+// DW2) if `vertical`.
+func (font *pdfCIDFont) getCIDMetrics(cid uint16, vertical bool) (fonts.CharMetrics, bool) {
+	metrics := fonts.CharMetrics{}
+	width, found := font.widths[cid]
+	if !found {
+		if cff := font.getFontProgram(); cff != nil {
+			width, found = cff.GetCIDWidth(cid)
+		}
+	}
+	if !found && font.widthsFromHmtx {
+		width, found = font.getTrueTypeWidth(cid)
+	}
+	if !found {
+		width = font.defaultWidth
+	}
+	metrics.Wx = width
+
+	if vertical {
+		v, has := font.verticals[cid]
+		if !has {
+			v = font.defaultVertical
+		}
+		metrics.Wy = v.w1y
+		found = found || has
+	}
+	return metrics, found
+}
+
+// getFontProgram returns the embedded CFF font program (FontFile3 of Subtype CIDFontType0C) of a
+// CIDFontType0 font, parsing it on first use.  Returns nil if there is none or it cannot be parsed.
+func (font *pdfCIDFont) getFontProgram() *fonts.CffType {
+	font.cffOnce.Do(func() {
+		if font.cff == nil {
+			font.cff = font.loadFontProgram()
+		}
+	})
+	return font.cff
+}
+
+// loadFontProgram parses the embedded CFF font program, see getFontProgram.
+func (font *pdfCIDFont) loadFontProgram() *fonts.CffType {
+	if subtype, ok := core.TraceToDirectObject(font.Subtype).(*core.PdfObjectName); !ok || *subtype != "CIDFontType0" {
+		return nil
+	}
+	descriptor, ok := core.TraceToDirectObject(font.FontDescriptor).(*core.PdfObjectDictionary)
+	if !ok {
+		return nil
+	}
+	stream, ok := core.TraceToDirectObject(descriptor.Get("FontFile3")).(*core.PdfObjectStream)
+	if !ok {
+		return nil
+	}
+	if subtype, ok := core.TraceToDirectObject(stream.Get("Subtype")).(*core.PdfObjectName); !ok || *subtype != "CIDFontType0C" {
+		common.Log.Debug("Unsupported CIDFontType0 font program (%v)", stream.Get("Subtype"))
+		return nil
+	}
+	data, err := core.DecodeStream(stream)
+	if err != nil {
+		common.Log.Debug("Error decoding font program: %v", err)
+		return nil
+	}
+	cff, err := fonts.CffParseBytes(data)
+	if err != nil {
+		common.Log.Debug("Error parsing font program: %v", err)
+		return nil
+	}
+	return cff
+}
+
+// getTrueTypeWidth returns the width of CID `cid` from the hmtx table of the embedded TrueType font
+// program (FontFile2) of a CIDFontType2 font.  Returns false if there is no such width.
+func (font *pdfCIDFont) getTrueTypeWidth(cid uint16) (float64, bool) {
+	ttf := font.getTrueTypeProgram()
+	if ttf == nil || ttf.UnitsPerEm == 0 {
+		return 0, false
+	}
+	gid := cid
+	if font.cidToGID != nil {
+		if 2*int(cid)+1 >= len(font.cidToGID) {
+			return 0, false
+		}
+		gid = uint16(font.cidToGID[2*int(cid)])<<8 | uint16(font.cidToGID[2*int(cid)+1])
+	}
+	if int(gid) >= len(ttf.Widths) {
+		return 0, false
+	}
+	return float64(ttf.Widths[gid]) * 1000 / float64(ttf.UnitsPerEm), true
+}
+
+// getTrueTypeProgram returns the metrics of the embedded TrueType font program (FontFile2) of a
+// CIDFontType2 font, loading them and the CIDToGIDMap on first use.  Returns nil if there is no
+// font program or it cannot be parsed.
+func (font *pdfCIDFont) getTrueTypeProgram() *fonts.TtfType {
+	font.ttfOnce.Do(func() {
+		if font.ttf == nil {
+			font.ttf = font.loadTrueTypeProgram()
+		}
+	})
+	return font.ttf
+}
+
+// loadTrueTypeProgram loads the metrics of the embedded TrueType font program and the
+// CIDToGIDMap, see getTrueTypeProgram.
+func (font *pdfCIDFont) loadTrueTypeProgram() *fonts.TtfType {
+	if subtype, ok := core.TraceToDirectObject(font.Subtype).(*core.PdfObjectName); !ok || *subtype != "CIDFontType2" {
+		return nil
+	}
+	descriptor, ok := core.TraceToDirectObject(font.FontDescriptor).(*core.PdfObjectDictionary)
+	if !ok {
+		return nil
+	}
+	stream, ok := core.TraceToDirectObject(descriptor.Get("FontFile2")).(*core.PdfObjectStream)
+	if !ok {
+		return nil
+	}
+
+	// CIDToGIDMap is Identity (the default) or a stream of 2-byte glyph indices by CID.
+	if mapStream, ok := core.TraceToDirectObject(font.CIDToGIDMap).(*core.PdfObjectStream); ok {
+		data, err := core.DecodeStream(mapStream)
+		if err != nil {
+			common.Log.Debug("Error decoding CIDToGIDMap: %v", err)
+			return nil
+		}
+		font.cidToGID = data
+	}
+
+	data, err := core.DecodeStream(stream)
+	if err != nil {
+		common.Log.Debug("Error decoding font program: %v", err)
+		return nil
+	}
+	ttf, err := fonts.TtfParseMetricsBytes(data)
+	if err != nil {
+		common.Log.Debug("Error parsing font program: %v", err)
+		return nil
+	}
+	return &ttf
+}
@@ -0,0 +1,1730 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/unidoc/unidoc/pdf/core"
+	"github.com/unidoc/unidoc/pdf/model/fonts"
+	"github.com/unidoc/unidoc/pdf/model/textencoding"
+)
+
+// makeSubsetTTF returns a copy of the TrueType font data with the outlines of the glyphs of `runes`
+// removed (empty glyph locations), as done by font subsetting.
+func makeSubsetTTF(t *testing.T, data []byte, runes ...rune) []byte {
+	ttf, err := fonts.TtfParseBytes(data)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	out := append([]byte{}, data...)
+	numTables := int(binary.BigEndian.Uint16(data[4:6]))
+	var locaOffset uint32
+	var longLoca bool
+	for i := 0; i < numTables; i++ {
+		entry := 12 + 16*i
+		offset := binary.BigEndian.Uint32(data[entry+8:])
+		switch string(data[entry : entry+4]) {
+		case "head":
+			longLoca = binary.BigEndian.Uint16(data[offset+50:]) == 1
+		case "loca":
+			locaOffset = offset
+		}
+	}
+
+	for _, r := range runes {
+		gid := uint32(ttf.Chars[uint16(r)])
+		// Start the glyph where the next one starts.
+		if longLoca {
+			next := binary.BigEndian.Uint32(out[locaOffset+4*(gid+1):])
+			binary.BigEndian.PutUint32(out[locaOffset+4*gid:], next)
+		} else {
+			next := binary.BigEndian.Uint16(out[locaOffset+2*(gid+1):])
+			binary.BigEndian.PutUint16(out[locaOffset+2*gid:], next)
+		}
+	}
+	return out
+}
+
+func TestFontHasGlyphSubset(t *testing.T) {
+	data, err := ioutil.ReadFile("../../testfiles/roboto/Roboto-Regular.ttf")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data = makeSubsetTTF(t, data, 'B', 'x')
+
+	f, err := ioutil.TempFile("", "unidoc_subset_ttf")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	font, err := NewPdfFontFromTTFFile(f.Name())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if !font.HasGlyph('A') {
+		t.Errorf("Font should have glyph A")
+	}
+	if !font.HasGlyph(' ') {
+		t.Errorf("Font should have glyph space (empty outline)")
+	}
+	if font.HasGlyph('B') {
+		t.Errorf("Font should not have glyph B")
+	}
+
+	missing := font.ValidateText("Box and Bix: Жук")
+	expected := []rune{'B', 'x', 'Ж', 'у', 'к'}
+	if string(missing) != string(expected) {
+		t.Errorf("Missing %q != %q", string(missing), string(expected))
+	}
+
+	// Loaded font: the font program is parsed from FontFile2.
+	loaded, err := newPdfFontFromPdfObject(font.ToPdfObject())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if loaded.HasGlyph('B') || !loaded.HasGlyph('A') {
+		t.Errorf("Invalid glyph coverage of loaded font")
+	}
+}
+
+func TestFontHasGlyphStandard14(t *testing.T) {
+	font, err := NewStandard14Font("Helvetica")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if missing := font.ValidateText("Hello, World! é"); missing != nil {
+		t.Errorf("Unexpected missing glyphs %q", string(missing))
+	}
+	missing := font.ValidateText("Привет")
+	if string(missing) != "Привет" {
+		t.Errorf("Cyrillic should be missing (%q)", string(missing))
+	}
+
+	if _, err := NewStandard14Font("Arial"); err == nil {
+		t.Errorf("Arial is not a standard 14 font")
+	}
+
+	// The coverage cache is filled by concurrent callers.
+	font, err = NewStandard14Font("Times-Roman")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, r := range "Hello, World!" {
+				if !font.HasGlyph(r) {
+					t.Errorf("No glyph for %q", r)
+				}
+			}
+			if font.HasGlyph('Ж') {
+				t.Errorf("Unexpected glyph for Ж")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Test that ValidateText does not report missing runes for composite fonts, whose glyph coverage
+// is not determined.
+func TestFontValidateTextComposite(t *testing.T) {
+	font, err := newPdfFontFromPdfObject(makeMixedEncodingType0(t))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if missing := font.ValidateText("Hello"); missing != nil {
+		t.Errorf("Missing glyphs %q reported for a composite font", string(missing))
+	}
+}
+
+func TestFontDescriptorLanguage(t *testing.T) {
+	d := core.MakeDict()
+	d.Set("Type", core.MakeName("FontDescriptor"))
+	d.Set("FontName", core.MakeName("Roboto"))
+	d.Set("Lang", core.MakeName("en-US"))
+
+	descriptor, err := newPdfFontDescriptorFromPdfObject(d)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	lang, ok := descriptor.GetLanguage()
+	if !ok || lang != "en-US" {
+		t.Errorf("Language %q (%v) != en-US", lang, ok)
+	}
+
+	d.Remove("Lang")
+	descriptor, err = newPdfFontDescriptorFromPdfObject(d)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if lang, ok := descriptor.GetLanguage(); ok || lang != "" {
+		t.Errorf("Language should be empty when absent (%q)", lang)
+	}
+}
+
+// Test parsing the CharSet of a Type 1 subset font and checking the glyphs of the subset.
+func TestFontDescriptorCharSet(t *testing.T) {
+	dict, err := core.NewParserFromString(`<< /Type /Font /Subtype /Type1 /BaseFont /ABCDEF+Garamond
+		/FirstChar 65 /LastChar 68 /Widths [ 600 610 620 630 ]
+		/FontDescriptor << /Type /FontDescriptor /FontName /ABCDEF+Garamond /Flags 32
+			/CharSet (/A /space/uni0043\n/a#23b) >> >>`).ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	font, err := NewPdfFontFromPdfObject(dict)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	descriptor := font.context.(*pdfFontTrueType).FontDescriptor
+	names, ok := descriptor.GetCharSet()
+	expected := []string{"A", "space", "uni0043", "a#b"}
+	if !ok || !reflect.DeepEqual(names, expected) {
+		t.Errorf("CharSet %q (%v), expected %q", names, ok, expected)
+	}
+
+	glyphs := map[string]bool{"A": true, "space": true, "C": true, "a#b": true, "B": false, "D": false}
+	// The CharSet is parsed on first use by fonts sharing the descriptor concurrently.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for glyph, has := range glyphs {
+				if descriptor.charSetHas(glyph) != has {
+					t.Errorf("Glyph %s in CharSet: %v, expected %v", glyph, !has, has)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if missing := font.ValidateText("ABCD"); string(missing) != "BD" {
+		t.Errorf("Missing glyphs %q, expected \"BD\"", string(missing))
+	}
+	if _, found := font.GetGlyphCharMetrics("B"); !found {
+		t.Errorf("No metrics for glyph B")
+	}
+
+	// Without a CharSet, all the glyphs are assumed to be in the font.
+	descriptor = &PdfFontDescriptor{FontName: descriptor.FontName}
+	if _, ok := descriptor.GetCharSet(); ok || !descriptor.charSetHas("B") {
+		t.Errorf("Glyph B not in a font without CharSet")
+	}
+}
+
+// Test loading a font whose descriptor entries are inline in the font dictionary.
+func TestFontInlineDescriptor(t *testing.T) {
+	d, err := core.NewParserFromString("<< /Type /Font /Subtype /TrueType /BaseFont /Inline " +
+		"/FirstChar 32 /LastChar 33 /Widths [250 333] /Flags 4 /FontBBox [0 -200 1000 900] " +
+		"/ItalicAngle 0 /Ascent 718 /Descent -207 /StemV 80 >>").ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	font, err := newPdfFontFromPdfObject(d)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	truefont, ok := font.context.(*pdfFontTrueType)
+	if !ok || truefont.FontDescriptor == nil {
+		t.Fatalf("Font descriptor not synthesized")
+	}
+	descriptor := truefont.FontDescriptor
+	if descriptor.FontName == nil || descriptor.FontName.String() != "Inline" ||
+		descriptor.Ascent == nil || descriptor.Ascent.String() != "718" || descriptor.FontBBox == nil {
+		t.Errorf("Unexpected descriptor (FontName %v Ascent %v FontBBox %v)",
+			descriptor.FontName, descriptor.Ascent, descriptor.FontBBox)
+	}
+	// Symbolic flag from the inline Flags: the built-in encoding is used.
+	if !descriptor.isSymbolic() || truefont.Encoder != nil {
+		t.Errorf("Inline Flags not applied")
+	}
+
+	// Written with a proper FontDescriptor.
+	ind, ok := font.ToPdfObject().(*core.PdfIndirectObject)
+	if !ok {
+		t.Fatalf("Font not an indirect object")
+	}
+	fd, ok := core.TraceToDirectObject(ind.PdfObject.(*core.PdfObjectDictionary).Get("FontDescriptor")).(*core.PdfObjectDictionary)
+	if !ok || fd.Get("StemV") == nil || fd.Get("Flags") == nil {
+		t.Errorf("FontDescriptor not written: %s", ind.PdfObject)
+	}
+
+	// Without descriptor entries, no descriptor.
+	d.Remove("Flags")
+	d.Remove("FontBBox")
+	d.Remove("Ascent")
+	if font, err = newPdfFontFromPdfObject(d); err != nil || font.context.(*pdfFontTrueType).FontDescriptor != nil {
+		t.Errorf("Unexpected descriptor (%v)", err)
+	}
+}
+
+// Test the encoding diagnostics of simple and composite fonts.
+func TestExplainFontEncoding(t *testing.T) {
+	toUnicode := []byte("begincmap\n1 begincodespacerange\n<00> <FF>\nendcodespacerange\n" +
+		"1 beginbfchar\n<20> <0020>\nendbfchar\nendcmap\n")
+	stream := &core.PdfObjectStream{PdfObjectDictionary: core.MakeDict(), Stream: toUnicode}
+	stream.Set("Length", core.MakeInteger(int64(len(toUnicode))))
+
+	encoding := core.MakeDict()
+	encoding.Set("BaseEncoding", core.MakeName("WinAnsiEncoding"))
+	encoding.Set("Differences", &core.PdfObjectArray{core.MakeInteger(65), core.MakeName("B"), core.MakeName("xyz")})
+
+	fontDict := core.MakeDict()
+	fontDict.Set("Type", core.MakeName("Font"))
+	fontDict.Set("Subtype", core.MakeName("TrueType"))
+	fontDict.Set("BaseFont", core.MakeName("Test"))
+	fontDict.Set("FirstChar", core.MakeInteger(32))
+	fontDict.Set("LastChar", core.MakeInteger(32))
+	fontDict.Set("Widths", core.MakeArrayFromFloats([]float64{250}))
+	fontDict.Set("Encoding", encoding)
+	fontDict.Set("ToUnicode", stream)
+
+	font, err := newPdfFontFromPdfObject(fontDict)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for _, explanation := range []string{font.ExplainEncoding(), ExplainFontEncoding(fontDict)} {
+		for _, expected := range []string{
+			"Font: TrueType Test\n",
+			"base WinAnsiEncoding",
+			"Differences: 2 entries: 65=/B 66=/xyz\n",
+			"<00> <FF>: 1 codes mapped\n",
+			`0x20 -> " " (ToUnicode)`,
+			`0x41 -> "B" (Differences)`,
+			`0xE9 -> "é" (Encoder)`,
+		} {
+			if !strings.Contains(explanation, expected) {
+				t.Errorf("Missing %q in:\n%s", expected, explanation)
+			}
+		}
+	}
+
+	cidSystemInfo := core.MakeDict()
+	cidSystemInfo.Set("Registry", core.MakeString("Adobe"))
+	cidSystemInfo.Set("Ordering", core.MakeString("Japan1"))
+	cidSystemInfo.Set("Supplement", core.MakeInteger(6))
+	descendant := core.MakeDict()
+	descendant.Set("CIDSystemInfo", cidSystemInfo)
+	type0 := core.MakeDict()
+	type0.Set("Subtype", core.MakeName("Type0"))
+	type0.Set("DescendantFonts", &core.PdfObjectArray{descendant})
+
+	explanation := ExplainFontEncoding(type0)
+	for _, expected := range []string{"Encoder: none\n", "ToUnicode: none\n", "CIDSystemInfo: Adobe-Japan1-6\n", "(unmapped)"} {
+		if !strings.Contains(explanation, expected) {
+			t.Errorf("Missing %q in:\n%s", expected, explanation)
+		}
+	}
+}
+
+func TestFontToUnicodeData(t *testing.T) {
+	toUnicode := []byte("/CIDInit /ProcSet findresource begin\n12 dict begin\nbegincmap\n" +
+		"1 begincodespacerange\n<0000> <FFFF>\nendcodespacerange\n" +
+		"1 beginbfrange\n<0003> <0005> <0041>\nendbfrange\nendcmap\nend\nend\n")
+	stream, err := core.MakeStream(toUnicode, core.NewFlateEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	descendant := core.MakeDict()
+	descendant.Set("Type", core.MakeName("Font"))
+	descendant.Set("Subtype", core.MakeName("CIDFontType2"))
+	descendant.Set("BaseFont", core.MakeName("Test"))
+	fontDict := core.MakeDict()
+	fontDict.Set("Type", core.MakeName("Font"))
+	fontDict.Set("Subtype", core.MakeName("Type0"))
+	fontDict.Set("BaseFont", core.MakeName("Test"))
+	fontDict.Set("Encoding", core.MakeName("Identity-H"))
+	fontDict.Set("DescendantFonts", &core.PdfObjectArray{descendant})
+	fontDict.Set("ToUnicode", core.MakeIndirectObject(stream))
+
+	font, err := newPdfFontFromPdfObject(fontDict)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data, err := font.ToUnicodeData()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !bytes.Equal(data, toUnicode) {
+		t.Errorf("ToUnicode data %q, expected %q", data, toUnicode)
+	}
+
+	fontDict.Remove("ToUnicode")
+	font, err = newPdfFontFromPdfObject(fontDict)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if data, err := font.ToUnicodeData(); err == nil {
+		t.Errorf("ToUnicode data %q without ToUnicode", data)
+	}
+}
+
+// Test that Type3 glyph widths are transformed from glyph space by the FontMatrix.
+func TestType3FontWidths(t *testing.T) {
+	encoding := core.MakeDict()
+	encoding.Set("Differences", &core.PdfObjectArray{core.MakeInteger(65), core.MakeName("square"), core.MakeName("triangle")})
+
+	fontDict := core.MakeDict()
+	fontDict.Set("Type", core.MakeName("Font"))
+	fontDict.Set("Subtype", core.MakeName("Type3"))
+	fontDict.Set("FontBBox", core.MakeArrayFromFloats([]float64{0, 0, 100, 100}))
+	fontDict.Set("FontMatrix", core.MakeArrayFromFloats([]float64{0.01, 0, 0, 0.01, 0, 0}))
+	fontDict.Set("CharProcs", core.MakeDict())
+	fontDict.Set("Encoding", encoding)
+	fontDict.Set("FirstChar", core.MakeInteger(65))
+	fontDict.Set("LastChar", core.MakeInteger(66))
+	fontDict.Set("Widths", core.MakeArrayFromFloats([]float64{50, 75}))
+
+	font, err := newPdfFontFromPdfObject(core.MakeIndirectObject(fontDict))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	for glyph, expected := range map[string]float64{"square": 500, "triangle": 750} {
+		metrics, found := font.GetGlyphCharMetrics(glyph)
+		if !found {
+			t.Fatalf("Glyph %s not found", glyph)
+		}
+		if math.Abs(metrics.Wx-expected) > 1e-9 {
+			t.Errorf("Glyph %s: Wx %f != %f", glyph, metrics.Wx, expected)
+		}
+	}
+	if _, found := font.GetGlyphCharMetrics("circle"); found {
+		t.Errorf("Glyph circle should not be found")
+	}
+
+	d, ok := core.TraceToDirectObject(font.ToPdfObject()).(*core.PdfObjectDictionary)
+	if !ok || d.Get("FontMatrix") == nil || d.Get("CharProcs") == nil {
+		t.Errorf("Type3 font not written back")
+	}
+
+	// A glyph listed for several codes always maps to the lowest code.
+	encoding.Set("Differences", &core.PdfObjectArray{core.MakeInteger(65), core.MakeName("square"),
+		core.MakeName("triangle"), core.MakeName("square")})
+	fontDict.Set("LastChar", core.MakeInteger(67))
+	fontDict.Set("Widths", core.MakeArrayFromFloats([]float64{50, 75, 90}))
+	for i := 0; i < 20; i++ {
+		font, err := newPdfFontFromPdfObject(core.MakeIndirectObject(fontDict))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		metrics, found := font.GetGlyphCharMetrics("square")
+		if !found || math.Abs(metrics.Wx-500) > 1e-9 {
+			t.Fatalf("Glyph square: Wx %f != 500 (%t)", metrics.Wx, found)
+		}
+	}
+}
+
+// Test writing two fonts sharing one font descriptor object, where one of the descriptors is modified.
+func TestFontSharedDescriptor(t *testing.T) {
+	descDict := core.MakeDict()
+	descDict.Set("Type", core.MakeName("FontDescriptor"))
+	descDict.Set("FontName", core.MakeName("Family"))
+	descDict.Set("Flags", core.MakeInteger(32))
+	descriptor := core.MakeIndirectObject(descDict)
+
+	makeFont := func(name string) *PdfFont {
+		d := core.MakeDict()
+		d.Set("Type", core.MakeName("Font"))
+		d.Set("Subtype", core.MakeName("TrueType"))
+		d.Set("BaseFont", core.MakeName(name))
+		d.Set("FirstChar", core.MakeInteger(32))
+		d.Set("LastChar", core.MakeInteger(32))
+		d.Set("Widths", core.MakeArrayFromFloats([]float64{250}))
+		d.Set("FontDescriptor", descriptor)
+		font, err := newPdfFontFromPdfObject(core.MakeIndirectObject(d))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		return font
+	}
+	regular := makeFont("Family-Regular")
+	bold := makeFont("Family-Bold")
+	italic := makeFont("Family-Italic")
+	bold.context.(*pdfFontTrueType).FontDescriptor.FontName = core.MakeName("Family-Bold")
+
+	page := NewPdfPage()
+	page.Resources = NewPdfPageResources()
+	page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+	page.AddFont("F1", regular.ToPdfObject())
+	page.AddFont("F2", bold.ToPdfObject())
+	page.AddFont("F3", italic.ToPdfObject())
+	w := NewPdfWriter()
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	page, err = reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	descriptors := map[string]*core.PdfIndirectObject{}
+	for _, name := range []string{"F1", "F2", "F3"} {
+		fontObj, found := page.Resources.GetFontByName(core.PdfObjectName(name))
+		if !found {
+			t.Fatalf("Font %s not found", name)
+		}
+		fontDict := core.TraceToDirectObject(fontObj).(*core.PdfObjectDictionary)
+		descriptors[name] = fontDict.Get("FontDescriptor").(*core.PdfIndirectObject)
+	}
+
+	getFontName := func(ind *core.PdfIndirectObject) string {
+		return ind.PdfObject.(*core.PdfObjectDictionary).Get("FontName").String()
+	}
+	if name := getFontName(descriptors["F1"]); name != "Family" {
+		t.Errorf("F1 descriptor FontName %s != Family", name)
+	}
+	if name := getFontName(descriptors["F2"]); name != "Family-Bold" {
+		t.Errorf("F2 descriptor FontName %s != Family-Bold", name)
+	}
+	// Unmodified descriptors remain shared.
+	if descriptors["F1"] != descriptors["F3"] || descriptors["F1"] == descriptors["F2"] {
+		t.Errorf("Unexpected descriptor sharing")
+	}
+}
+
+// Test loading font dictionaries with a missing Type or Type given as a string, which are accepted
+// when the Subtype is recognized unless strict, and with an invalid Type, which is rejected.
+func TestFontMalformedType(t *testing.T) {
+	testcases := []struct {
+		Dict  string
+		Valid bool
+	}{
+		{"<< /Subtype /TrueType /BaseFont /Arial /FirstChar 65 /LastChar 65 /Widths [722] " +
+			"/Encoding /WinAnsiEncoding >>", true},
+		{"<< /Type (Font) /Subtype /TrueType /BaseFont /Arial /FirstChar 65 /LastChar 65 /Widths [722] " +
+			"/Encoding /WinAnsiEncoding >>", true},
+		{"<< /Type /FontDescriptor /Subtype /TrueType /BaseFont /Arial /FirstChar 65 /LastChar 65 " +
+			"/Widths [722] >>", false},
+		{"<< /Type (Other) /Subtype /TrueType /BaseFont /Arial /FirstChar 65 /LastChar 65 /Widths [722] >>", false},
+		{"<< /Subtype /Unknown /BaseFont /Arial >>", false},
+	}
+	for _, tcase := range testcases {
+		parser := core.NewParserFromString(tcase.Dict)
+		dict, err := parser.ParseDict()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		font, err := newPdfFontFromPdfObject(dict)
+		if !tcase.Valid {
+			if err == nil {
+				t.Errorf("%s: invalid font loaded", tcase.Dict)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Error: %v", tcase.Dict, err)
+			continue
+		}
+		metrics, found := font.GetGlyphCharMetrics("A")
+		if !found || metrics.Wx != 722 {
+			t.Errorf("%s: unexpected metrics for A: %v %v", tcase.Dict, metrics, found)
+		}
+		if !strings.Contains(font.ExplainEncoding(), "0x41 -> \"A\"") {
+			t.Errorf("%s: character code not mapped:\n%s", tcase.Dict, font.ExplainEncoding())
+		}
+
+		// Only the Type name Font is accepted in strict mode.
+		_, err = NewPdfFontFromPdfObjectWithOpts(dict, &FontOpts{StrictType: true})
+		if err == nil {
+			t.Errorf("%s: malformed Type accepted in strict mode", tcase.Dict)
+		}
+		dict.Set("Type", core.MakeName("Font"))
+		if _, err := NewPdfFontFromPdfObjectWithOpts(dict, &FontOpts{StrictType: true}); err != nil {
+			t.Errorf("%s: Error in strict mode with Type Font: %v", tcase.Dict, err)
+		}
+	}
+}
+
+// Test creating simple fonts from a font descriptor, writing them and loading them back.
+func TestNewSimplePdfFont(t *testing.T) {
+	fontFile, err := core.MakeStream([]byte("%!PS-AdobeFont-1.0: Custom"), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	testcases := []struct {
+		FontFile core.PdfObject
+		Subtype  string
+	}{
+		{nil, "TrueType"},
+		{fontFile, "Type1"},
+	}
+	for _, tcase := range testcases {
+		descriptor := &PdfFontDescriptor{
+			FontName:     core.MakeName("Custom"),
+			Flags:        core.MakeInteger(32),
+			MissingWidth: core.MakeInteger(300),
+			FontFile:     tcase.FontFile,
+		}
+		widths := map[byte]float64{65: 700, 67: 650, 32: 250}
+		font, err := NewSimplePdfFont(descriptor, textencoding.NewWinAnsiTextEncoder(), widths)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		page := NewPdfPage()
+		page.Resources = NewPdfPageResources()
+		page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+		page.AddFont("F1", font.ToPdfObject())
+		w := NewPdfWriter()
+		if err := w.AddPage(page); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		data, err := writeToBytes(&w)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+
+		reader, err := NewPdfReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		page, err = reader.GetPage(1)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		fontObj, found := page.Resources.GetFontByName("F1")
+		if !found {
+			t.Fatalf("Font not found")
+		}
+		d, ok := core.TraceToDirectObject(fontObj).(*core.PdfObjectDictionary)
+		if !ok {
+			t.Fatalf("Font not a dictionary")
+		}
+		if subtype, ok := d.Get("Subtype").(*core.PdfObjectName); !ok || string(*subtype) != tcase.Subtype {
+			t.Errorf("Subtype %v != %s", d.Get("Subtype"), tcase.Subtype)
+		}
+		first, _ := core.TraceToDirectObject(d.Get("FirstChar")).(*core.PdfObjectInteger)
+		last, _ := core.TraceToDirectObject(d.Get("LastChar")).(*core.PdfObjectInteger)
+		if first == nil || last == nil || *first != 32 || *last != 67 {
+			t.Errorf("FirstChar/LastChar %v %v != 32 67", first, last)
+		}
+
+		loaded, err := newPdfFontFromPdfObject(fontObj)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		for glyph, expected := range map[string]float64{"A": 700, "B": 300, "C": 650, "space": 250} {
+			metrics, found := loaded.GetGlyphCharMetrics(glyph)
+			if !found || metrics.Wx != expected {
+				t.Errorf("%s: glyph %s width %f != %f (%v)", tcase.Subtype, glyph, metrics.Wx, expected, found)
+			}
+		}
+		if _, found := loaded.GetGlyphCharMetrics("D"); found {
+			t.Errorf("Glyph D beyond LastChar found")
+		}
+	}
+}
+
+// Test loading Type1 fonts, which are handled like the simple TrueType fonts: the standard 14
+// font of a real file, and a font with an embedded Type 1 font program, written and loaded back.
+func TestType1FontLoading(t *testing.T) {
+	f, err := os.Open("../../testfiles/minimal.pdf")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer f.Close()
+	reader, err := NewPdfReader(f)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	page, err := reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	fonts, failures := LoadFontsTolerant(page.Resources.Font)
+	if len(fonts) != 1 || len(failures) != 0 {
+		t.Fatalf("%d fonts loaded (%v), expected 1", len(fonts), failures)
+	}
+	for name, font := range fonts {
+		if metrics, found := font.GetGlyphCharMetrics("A"); !found || metrics.Wx != 722 {
+			t.Errorf("Font %s: glyph A width %v (%v), expected 722", name, metrics.Wx, found)
+		}
+	}
+
+	// The multiple master font program without its blend entries is a plain Type 1 font program.
+	data, err := ioutil.ReadFile("../../testfiles/mmtype1.t1")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for _, key := range []string{"/WeightVector", "/BlendDesignPositions", "/BlendAxisTypes"} {
+		start := bytes.Index(data, []byte(key))
+		end := start + bytes.IndexByte(data[start:], '\n') + 1
+		data = append(data[:start:start], data[end:]...)
+	}
+	start := bytes.Index(data, []byte("/Blend "))
+	end := start + bytes.Index(data[start:], []byte("end def\n")) + len("end def\n")
+	data = append(data[:start:start], data[end:]...)
+	program, err := core.MakeStream(data, core.NewFlateEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	program.Set("Length1", core.MakeInteger(int64(bytes.Index(data, []byte("eexec"))+6)))
+
+	dict, err := core.NewParserFromString(`<< /Type /Font /Subtype /Type1 /BaseFont /TestMM
+		/FirstChar 32 /LastChar 69
+		/FontDescriptor << /Type /FontDescriptor /FontName /TestMM /Flags 32 >> >>`).ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	descriptor := core.TraceToDirectObject(dict.Get("FontDescriptor")).(*core.PdfObjectDictionary)
+	descriptor.Set("FontFile", program)
+	font, err := NewPdfFontFromPdfObject(dict)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	page = NewPdfPage()
+	page.Resources = NewPdfPageResources()
+	page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+	page.AddFont("F1", font.ToPdfObject())
+	w := NewPdfWriter()
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data, err = writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	reader, err = NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	page, err = reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	fontObj, found := page.Resources.GetFontByName("F1")
+	if !found {
+		t.Fatalf("Font not found")
+	}
+	if d, ok := core.TraceToDirectObject(fontObj).(*core.PdfObjectDictionary); !ok || d.Get("Subtype").String() != "Type1" {
+		t.Errorf("Subtype not kept: %v", fontObj)
+	}
+	loaded, err := NewPdfFontFromPdfObject(fontObj)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for glyph, width := range map[string]float64{"space": 250, "A": 600, "C": 550, "E": 650} {
+		if metrics, found := loaded.GetGlyphCharMetrics(glyph); !found || metrics.Wx != width {
+			t.Errorf("Glyph %s: width %v (%v), expected %v", glyph, metrics.Wx, found, width)
+		}
+	}
+}
+
+// makeSymbolicTTF returns a copy of the TrueType font data with the cmap table replaced by a (3,0)
+// subtable mapping F041-F05A to the glyphs of A-Z and a (1,0) subtable mapping Mac OS Roman code 80
+// to the glyph of Adieresis, as in symbolic fonts.
+func makeSymbolicTTF(t *testing.T, data []byte) []byte {
+	ttf, err := fonts.TtfParseBytes(data)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// Format 4 subtable with one segment per letter and the final 0xFFFF segment.
+	const numLetters = 26
+	segCount := numLetters + 1
+	format4 := make([]byte, 16+8*segCount)
+	binary.BigEndian.PutUint16(format4[0:], 4)
+	binary.BigEndian.PutUint16(format4[2:], uint16(len(format4)))
+	binary.BigEndian.PutUint16(format4[6:], uint16(2*segCount))
+	for j := 0; j < segCount; j++ {
+		code, delta := uint16(0xFFFF), uint16(1)
+		if j < numLetters {
+			code = 0xF041 + uint16(j)
+			delta = ttf.Chars[uint16('A'+j)] - code
+		}
+		binary.BigEndian.PutUint16(format4[14+2*j:], code)             // endCount
+		binary.BigEndian.PutUint16(format4[16+2*segCount+2*j:], code)  // startCount
+		binary.BigEndian.PutUint16(format4[16+4*segCount+2*j:], delta) // idDelta
+		binary.BigEndian.PutUint16(format4[16+6*segCount+2*j:], 0)     // idRangeOffset
+	}
+
+	// Format 6 subtable.
+	format6 := make([]byte, 12)
+	binary.BigEndian.PutUint16(format6[0:], 6)
+	binary.BigEndian.PutUint16(format6[2:], uint16(len(format6)))
+	binary.BigEndian.PutUint16(format6[6:], 0x80)
+	binary.BigEndian.PutUint16(format6[8:], 1)
+	binary.BigEndian.PutUint16(format6[10:], ttf.Chars[0xC4])
+
+	cmap := make([]byte, 4+2*8)
+	binary.BigEndian.PutUint16(cmap[2:], 2)
+	binary.BigEndian.PutUint16(cmap[4:], 3)
+	binary.BigEndian.PutUint32(cmap[8:], uint32(len(cmap)))
+	binary.BigEndian.PutUint16(cmap[12:], 1)
+	binary.BigEndian.PutUint32(cmap[16:], uint32(len(cmap)+len(format4)))
+	cmap = append(cmap, format4...)
+	cmap = append(cmap, format6...)
+
+	out := append([]byte{}, data...)
+	numTables := int(binary.BigEndian.Uint16(data[4:6]))
+	for i := 0; i < numTables; i++ {
+		entry := 12 + 16*i
+		if string(data[entry:entry+4]) == "cmap" {
+			binary.BigEndian.PutUint32(out[entry+8:], uint32(len(out)))
+			binary.BigEndian.PutUint32(out[entry+12:], uint32(len(cmap)))
+		}
+	}
+	return append(out, cmap...)
+}
+
+// Test resolving the glyphs of a symbolic TrueType font with Differences through the (3,0) and
+// (1,0) cmap subtables.
+func TestTrueTypeSymbolicDifferences(t *testing.T) {
+	data, err := ioutil.ReadFile("../../testfiles/roboto/Roboto-Regular.ttf")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	original, err := fonts.TtfParseBytes(data)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data = makeSymbolicTTF(t, data)
+
+	fontFile, err := core.MakeStream(data, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	descriptor := core.MakeDict()
+	descriptor.Set("Type", core.MakeName("FontDescriptor"))
+	descriptor.Set("FontName", core.MakeName("Symbolic"))
+	descriptor.Set("Flags", core.MakeInteger(4))
+	descriptor.Set("FontFile2", fontFile)
+	encoding := core.MakeDict()
+	encoding.Set("Differences", core.MakeArray(core.MakeInteger(65), core.MakeName("B"), core.MakeName("C"),
+		core.MakeInteger(200), core.MakeName("Adieresis"), core.MakeName("nonexistent")))
+	widths := make([]float64, 224)
+	d := core.MakeDict()
+	d.Set("Type", core.MakeName("Font"))
+	d.Set("Subtype", core.MakeName("TrueType"))
+	d.Set("BaseFont", core.MakeName("Symbolic"))
+	d.Set("FirstChar", core.MakeInteger(32))
+	d.Set("LastChar", core.MakeInteger(255))
+	d.Set("Widths", core.MakeArrayFromFloats(widths))
+	d.Set("FontDescriptor", descriptor)
+	d.Set("Encoding", encoding)
+
+	font, err := newPdfFontFromPdfObject(d)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	truetype, ok := font.context.(*pdfFontTrueType)
+	if !ok {
+		t.Fatalf("Not a TrueType font: %T", font.context)
+	}
+
+	testcases := []struct {
+		Code     byte
+		Expected uint16
+	}{
+		{65, original.Chars['B']},   // Differences, via (3,0).
+		{66, original.Chars['C']},   // Differences, via (3,0).
+		{67, original.Chars['C']},   // Code mapped directly by (3,0).
+		{200, original.Chars[0xC4]}, // Differences, via the Mac OS Roman code of (1,0).
+		{201, 0},                    // Differences glyph not in the font.
+		{90, original.Chars['Z']},   // Code mapped directly by (3,0).
+	}
+	for _, tcase := range testcases {
+		gid, found := truetype.charcodeToGID(tcase.Code)
+		if found != (tcase.Expected != 0) || gid != tcase.Expected {
+			t.Errorf("Code %d: GID %d (%v) != %d", tcase.Code, gid, found, tcase.Expected)
+		}
+	}
+}
+
+// Test the glyph metrics of a composite font with a CIDFontType2 descendant, from the W array and,
+// in vertical writing mode, the W2 array.
+func TestCIDFontMetrics(t *testing.T) {
+	parser := core.NewParserFromString(`<< /Type /Font /Subtype /CIDFontType2 /BaseFont /Test
+		/CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >>
+		/DW 900 /W [ 1 [ 500 600 ] 10 12 750 ]
+		/W2 [ 1 [ -800 250 700 ] 10 11 -900 375 880 ] >>`)
+	cidFont, err := parser.ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	for _, encoding := range []string{"Identity-H", "Identity-V"} {
+		type0 := core.MakeDict()
+		type0.Set("Type", core.MakeName("Font"))
+		type0.Set("Subtype", core.MakeName("Type0"))
+		type0.Set("BaseFont", core.MakeName("Test"))
+		type0.Set("Encoding", core.MakeName(encoding))
+		type0.Set("DescendantFonts", core.MakeArray(core.MakeIndirectObject(cidFont)))
+		font, err := newPdfFontFromPdfObject(type0)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		vertical := encoding == "Identity-V"
+
+		testcases := []struct {
+			CID   uint16
+			Wx    float64
+			Wy    float64
+			Found bool
+		}{
+			{1, 500, -800, true},
+			{2, 600, -1000, true}, // DW2 default.
+			{10, 750, -900, true},
+			{11, 750, -900, true},
+			{12, 750, -1000, true},
+			{3, 900, -1000, false}, // DW.
+		}
+		for _, tcase := range testcases {
+			metrics, found := font.GetCIDMetrics(tcase.CID)
+			wy := 0.0
+			if vertical {
+				wy = tcase.Wy
+			}
+			if found != tcase.Found || metrics.Wx != tcase.Wx || metrics.Wy != wy {
+				t.Errorf("%s CID %d: %v (%v), expected Wx %.0f Wy %.0f (%v)", encoding, tcase.CID,
+					metrics, found, tcase.Wx, wy, tcase.Found)
+			}
+		}
+	}
+
+	// Simple fonts have no CID metrics.
+	helvetica, err := NewStandard14Font("Helvetica")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, found := helvetica.GetCIDMetrics(65); found {
+		t.Errorf("CID metrics for a simple font")
+	}
+}
+
+// Test the advances of character codes against the Tj formula tx = (w0/1000 × Tfs + Tc + Tw) × Th,
+// with word spacing only for the single byte code 32.
+func TestFontAdvanceWidths(t *testing.T) {
+	const fontSize, charSpacing, wordSpacing, hScale = 12.0, 0.5, 3.0, 0.8
+	tx := func(w0 float64, space bool) float64 {
+		tw := 0.0
+		if space {
+			tw = wordSpacing
+		}
+		return (w0/1000*fontSize + charSpacing + tw) * hScale
+	}
+	check := func(name string, advances, expected []float64) {
+		if len(advances) != len(expected) {
+			t.Fatalf("%s: advances %v, expected %v", name, advances, expected)
+		}
+		for i := range expected {
+			if math.Abs(advances[i]-expected[i]) > 1e-9 {
+				t.Errorf("%s: advances %v, expected %v", name, advances, expected)
+				break
+			}
+		}
+	}
+
+	simple := core.MakeDict()
+	simple.Set("Type", core.MakeName("Font"))
+	simple.Set("Subtype", core.MakeName("TrueType"))
+	simple.Set("BaseFont", core.MakeName("Test"))
+	simple.Set("FirstChar", core.MakeInteger(32))
+	simple.Set("LastChar", core.MakeInteger(34))
+	simple.Set("Widths", core.MakeArrayFromFloats([]float64{250, 500, 600}))
+	font, err := newPdfFontFromPdfObject(simple)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	advances, err := font.AdvanceWidths([]byte("! \" "), fontSize, charSpacing, wordSpacing, hScale)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	check("simple", advances, []float64{tx(500, false), tx(250, true), tx(600, false), tx(250, true)})
+	if _, err := font.AdvanceWidths([]byte("A"), fontSize, charSpacing, wordSpacing, hScale); err == nil {
+		t.Errorf("Advance of code without width")
+	}
+
+	parser := core.NewParserFromString(`<< /Type /Font /Subtype /CIDFontType2 /BaseFont /Test
+		/CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >>
+		/DW 1000 /W [ 32 [ 300 ] 288 [ 700 ] ] >>`)
+	cidFont, err := parser.ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	type0 := core.MakeDict()
+	type0.Set("Type", core.MakeName("Font"))
+	type0.Set("Subtype", core.MakeName("Type0"))
+	type0.Set("BaseFont", core.MakeName("Test"))
+	type0.Set("Encoding", core.MakeName("Identity-H"))
+	type0.Set("DescendantFonts", core.MakeArray(cidFont))
+	font, err = newPdfFontFromPdfObject(type0)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// The 2 byte codes 0x0020 and 0x0120 include the byte 32, but are not single byte code 32.
+	advances, err = font.AdvanceWidths([]byte{0x00, 0x20, 0x01, 0x20, 0x00, 0x41}, fontSize, charSpacing, wordSpacing, hScale)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	check("composite", advances, []float64{tx(300, false), tx(700, false), tx(1000, false)})
+	if _, err := font.AdvanceWidths([]byte{0x00, 0x20, 0x20}, fontSize, charSpacing, wordSpacing, hScale); err == nil {
+		t.Errorf("Advances of incomplete 2 byte code")
+	}
+}
+
+// Test splitting strings of a Type0 font into the 1 and 2 byte codes of its embedded Encoding CMap.
+func TestType0EmbeddedCMapCharcodes(t *testing.T) {
+	cmapData := `/CIDInit /ProcSet findresource begin
+12 dict begin
+begincmap
+/CMapName /Test-Mixed def
+/CMapType 1 def
+2 begincodespacerange
+<00> <80>
+<8140> <9FFC>
+endcodespacerange
+endcmap
+CMapName currentdict /CMap defineresource pop
+end
+end`
+	encoding, err := core.MakeStream([]byte(cmapData), core.NewFlateEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	encoding.Set("Type", core.MakeName("CMap"))
+	encoding.Set("CMapName", core.MakeName("Test-Mixed"))
+
+	parser := core.NewParserFromString(`<< /Type /Font /Subtype /CIDFontType2 /BaseFont /Test
+		/CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >>
+		/DW 1000 /W [ 65 [ 500 ] ] >>`)
+	cidFont, err := parser.ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	type0 := core.MakeDict()
+	type0.Set("Type", core.MakeName("Font"))
+	type0.Set("Subtype", core.MakeName("Type0"))
+	type0.Set("BaseFont", core.MakeName("Test"))
+	type0.Set("Encoding", encoding)
+	type0.Set("DescendantFonts", core.MakeArray(cidFont))
+	font, err := newPdfFontFromPdfObject(type0)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	data := []byte{0x41, 0x81, 0x40, 0x42, 0x9f, 0xfc}
+	codes, err := font.BytesToCharcodes(data)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expected := []uint64{0x41, 0x8140, 0x42, 0x9ffc}
+	if !reflect.DeepEqual(codes, expected) {
+		t.Errorf("Codes % x, expected % x", codes, expected)
+	}
+	advances, err := font.AdvanceWidths(data, 10, 0, 0, 1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !reflect.DeepEqual(advances, []float64{5, 10, 10, 10}) {
+		t.Errorf("Advances %v", advances)
+	}
+	if _, err := font.BytesToCharcodes([]byte{0x41, 0x81}); err == nil {
+		t.Errorf("No error for a string ending within a 2 byte code")
+	}
+}
+
+// mixedEncodingCMap is an Encoding CMap with 1 byte codes for ASCII and 2 byte codes from 0x8140,
+// mapped to CIDs 1 and 633 onwards (as in Shift-JIS encodings).
+const mixedEncodingCMap = `/CIDInit /ProcSet findresource begin
+12 dict begin
+begincmap
+/CMapName /Test-Mixed-CID def
+/CMapType 1 def
+2 begincodespacerange
+<00> <80>
+<8140> <9FFC>
+endcodespacerange
+2 begincidrange
+<20> <7E> 1
+<8140> <817E> 633
+endcidrange
+endcmap
+CMapName currentdict /CMap defineresource pop
+end
+end`
+
+// makeMixedEncodingType0 returns a Type0 font dictionary with the embedded Encoding CMap
+// mixedEncodingCMap, whose CIDs 34 ('A') and 634 have the widths 600 and 900.
+func makeMixedEncodingType0(t *testing.T) *core.PdfObjectDictionary {
+	encoding, err := core.MakeStream([]byte(mixedEncodingCMap), core.NewFlateEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	encoding.Set("Type", core.MakeName("CMap"))
+	encoding.Set("CMapName", core.MakeName("Test-Mixed-CID"))
+
+	cidFont, err := core.NewParserFromString(`<< /Type /Font /Subtype /CIDFontType2 /BaseFont /Test
+		/CIDSystemInfo << /Registry (Adobe) /Ordering (Test) /Supplement 0 >>
+		/DW 1000 /W [ 34 [ 600 ] 634 [ 900 ] ] >>`).ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	type0 := core.MakeDict()
+	type0.Set("Type", core.MakeName("Font"))
+	type0.Set("Subtype", core.MakeName("Type0"))
+	type0.Set("BaseFont", core.MakeName("Test"))
+	type0.Set("Encoding", encoding)
+	type0.Set("DescendantFonts", core.MakeArray(cidFont))
+	return type0
+}
+
+// Test the CIDs and widths of the codes of a Type0 font with an embedded Encoding CMap, kept when
+// writing the font.
+func TestType0EmbeddedCMapCIDs(t *testing.T) {
+	font, err := newPdfFontFromPdfObject(makeMixedEncodingType0(t))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		for code, expected := range map[uint64]uint16{0x41: 34, 0x8141: 634, 0x817f: 0} {
+			if cid, ok := font.CharcodeToCID(code); !ok || cid != expected {
+				t.Errorf("0x%X: CID %d, expected %d", code, cid, expected)
+			}
+		}
+		advances, err := font.AdvanceWidths([]byte{0x41, 0x81, 0x41, 0x42}, 10, 0, 0, 1)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !reflect.DeepEqual(advances, []float64{6, 9, 10}) {
+			t.Errorf("Advances %v, expected [6 9 10]", advances)
+		}
+
+		// Reloaded from the written font dictionary.
+		obj := font.ToPdfObject()
+		if _, ok := core.TraceToDirectObject(core.TraceToDirectObject(obj).(*core.PdfObjectDictionary).Get("Encoding")).(*core.PdfObjectStream); !ok {
+			t.Fatalf("Encoding CMap stream not written")
+		}
+		font, err = newPdfFontFromPdfObject(obj)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+}
+
+// Test that Type0 fonts with stray extra DescendantFonts entries use the first valid descendant.
+func TestType0StrayDescendantFonts(t *testing.T) {
+	parser := core.NewParserFromString(`<< /Type /Font /Subtype /CIDFontType2 /BaseFont /Test
+		/CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >>
+		/W [ 1 [ 500 ] ] >>`)
+	cidFont, err := parser.ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	stray := core.MakeDict()
+	stray.Set("Type", core.MakeName("Font"))
+	stray.Set("Subtype", core.MakeName("Type1"))
+	stray.Set("BaseFont", core.MakeName("Helvetica"))
+
+	testcases := []struct {
+		Name        string
+		Descendants *core.PdfObjectArray
+		Valid       bool
+	}{
+		{"stray after", core.MakeArray(core.MakeIndirectObject(cidFont), stray), true},
+		{"stray before", core.MakeArray(core.MakeNull(), stray, core.MakeIndirectObject(cidFont)), true},
+		{"no valid", core.MakeArray(core.MakeNull(), stray), false},
+		{"empty", core.MakeArray(), false},
+	}
+	for _, tcase := range testcases {
+		type0 := core.MakeDict()
+		type0.Set("Type", core.MakeName("Font"))
+		type0.Set("Subtype", core.MakeName("Type0"))
+		type0.Set("BaseFont", core.MakeName("Test"))
+		type0.Set("Encoding", core.MakeName("Identity-H"))
+		type0.Set("DescendantFonts", tcase.Descendants)
+		font, err := newPdfFontFromPdfObject(type0)
+		if !tcase.Valid {
+			if err == nil {
+				t.Errorf("%s: Font without valid descendant loaded", tcase.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Error: %v", tcase.Name, err)
+			continue
+		}
+		if metrics, found := font.GetCIDMetrics(1); !found || metrics.Wx != 500 {
+			t.Errorf("%s: CID 1 metrics %v (%v), expected width 500", tcase.Name, metrics, found)
+		}
+	}
+}
+
+// Test that the widths of a CIDFontType2 font without W and DW are 1000, or the widths of the hmtx
+// table of the embedded font program if enabled.  The font program has no cmap, name, OS/2 and post
+// tables, as in subset fonts.
+func TestCIDFontType2HmtxWidths(t *testing.T) {
+	data, err := ioutil.ReadFile("../../testfiles/roboto/Roboto-Regular.ttf")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	ttf, err := fonts.TtfParseBytes(data)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	numTables := int(binary.BigEndian.Uint16(data[4:6]))
+	for i := 0; i < numTables; i++ {
+		entry := 12 + 16*i
+		switch string(data[entry : entry+4]) {
+		case "cmap", "name", "OS/2", "post":
+			copy(data[entry:], "zzzz")
+		}
+	}
+	program, err := core.MakeStream(data, core.NewFlateEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// CIDs 1 and 2 are the glyphs of 'i' and 'W', CID 3 is past the end of the map.
+	gidI, gidW := ttf.Chars['i'], ttf.Chars['W']
+	cidToGID, err := core.MakeStream([]byte{0, 0, byte(gidI >> 8), byte(gidI), byte(gidW >> 8), byte(gidW)}, core.NewFlateEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	emWidth := func(gid uint16) float64 {
+		return float64(ttf.Widths[gid]) * 1000 / float64(ttf.UnitsPerEm)
+	}
+
+	testcases := []struct {
+		CIDToGIDMap core.PdfObject
+		CID         uint16
+		Width       float64
+		Found       bool
+	}{
+		{cidToGID, 1, emWidth(gidI), true},
+		{cidToGID, 2, emWidth(gidW), true},
+		{cidToGID, 3, 1000, false},
+		{core.MakeName("Identity"), gidW, emWidth(gidW), true},
+		{nil, gidI, emWidth(gidI), true},
+		{nil, ttf.NumGlyphs, 1000, false},
+	}
+	for _, fromHmtx := range []bool{false, true} {
+		for i, tcase := range testcases {
+			descriptor := core.MakeDict()
+			descriptor.Set("Type", core.MakeName("FontDescriptor"))
+			descriptor.Set("FontName", core.MakeName("Roboto"))
+			descriptor.Set("FontFile2", program)
+			cidFont := core.MakeDict()
+			cidFont.Set("Type", core.MakeName("Font"))
+			cidFont.Set("Subtype", core.MakeName("CIDFontType2"))
+			cidFont.Set("BaseFont", core.MakeName("Roboto"))
+			cidFont.Set("FontDescriptor", descriptor)
+			if tcase.CIDToGIDMap != nil {
+				cidFont.Set("CIDToGIDMap", tcase.CIDToGIDMap)
+			}
+			type0 := core.MakeDict()
+			type0.Set("Type", core.MakeName("Font"))
+			type0.Set("Subtype", core.MakeName("Type0"))
+			type0.Set("BaseFont", core.MakeName("Roboto"))
+			type0.Set("Encoding", core.MakeName("Identity-H"))
+			type0.Set("DescendantFonts", core.MakeArray(cidFont))
+			font, err := newPdfFontFromPdfObject(type0)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			font.SetCIDWidthsFromHmtx(fromHmtx)
+
+			width, found := tcase.Width, tcase.Found
+			if !fromHmtx {
+				width, found = 1000, false
+			}
+			metrics, ok := font.GetCIDMetrics(tcase.CID)
+			if ok != found || metrics.Wx != width {
+				t.Errorf("hmtx %v, case %d: CID %d width %v (%v), expected %v (%v)", fromHmtx, i, tcase.CID,
+					metrics.Wx, ok, width, found)
+			}
+		}
+	}
+}
+
+// Test that the widths of a CIDFontType0 font missing from the W array are taken from the embedded
+// CFF font program, before falling back to DW.
+func TestCIDFontType0ProgramWidths(t *testing.T) {
+	data, err := ioutil.ReadFile("../../testfiles/cidfont.cff")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	program, err := core.MakeStream(data, core.NewFlateEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	program.Set("Subtype", core.MakeName("CIDFontType0C"))
+	descriptor := core.MakeDict()
+	descriptor.Set("Type", core.MakeName("FontDescriptor"))
+	descriptor.Set("FontName", core.MakeName("TestCID"))
+	descriptor.Set("FontFile3", program)
+
+	parser := core.NewParserFromString(`<< /Type /Font /Subtype /CIDFontType0 /BaseFont /TestCID
+		/CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >>
+		/DW 900 /W [ 1 [ 555 ] ] >>`)
+	obj, err := parser.ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	obj.Set("FontDescriptor", core.MakeIndirectObject(descriptor))
+	cidFont, err := newPdfCIDFontFromPdfObject(obj)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	testcases := []struct {
+		CID   uint16
+		Wx    float64
+		Found bool
+	}{
+		{1, 555, true},    // W.
+		{2, 400, true},    // Font program.
+		{500, 1234, true}, // Font program, width from a subroutine.
+		{3, 900, false},   // DW, no glyph in the font program.
+	}
+	for _, tcase := range testcases {
+		metrics, found := cidFont.GetCIDMetrics(tcase.CID)
+		if found != tcase.Found || metrics.Wx != tcase.Wx {
+			t.Errorf("CID %d: %v (%v), expected %.0f (%v)", tcase.CID, metrics.Wx, found, tcase.Wx, tcase.Found)
+		}
+	}
+
+	// The font program is loaded once for concurrent lookups.
+	cidFont, err = newPdfCIDFontFromPdfObject(obj)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	var wg sync.WaitGroup
+	widths := make([]float64, 8)
+	for i := range widths {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			metrics, _ := cidFont.GetCIDMetrics(500)
+			widths[i] = metrics.Wx
+		}(i)
+	}
+	wg.Wait()
+	for i, w := range widths {
+		if w != 1234 {
+			t.Errorf("Concurrent lookup %d: width %v, expected 1234", i, w)
+		}
+	}
+}
+
+// Test loading MMType1 fonts like Type1 fonts.  The widths of the base design of the embedded
+// font program are used if the font has no Widths.
+func TestMMType1FontWidths(t *testing.T) {
+	data, err := ioutil.ReadFile("../../testfiles/mmtype1.t1")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	program, err := core.MakeStream(data, core.NewFlateEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	program.Set("Length1", core.MakeInteger(int64(bytes.Index(data, []byte("eexec"))+6)))
+	descriptor := core.MakeDict()
+	descriptor.Set("Type", core.MakeName("FontDescriptor"))
+	descriptor.Set("FontName", core.MakeName("TestMM"))
+	descriptor.Set("Flags", core.MakeInteger(32))
+	descriptor.Set("FontFile", program)
+
+	testcases := []struct {
+		Dict     string
+		Expected map[string]float64
+	}{
+		// Widths of the font program.
+		{`<< /Type /Font /Subtype /MMType1 /BaseFont /TestMM_250_ /FirstChar 32 /LastChar 69 >>`,
+			map[string]float64{"space": 250, "A": 600, "C": 550, "D": 720, "E": 650, "exclam": 0}},
+		// Character code range beyond single bytes.
+		{`<< /Type /Font /Subtype /MMType1 /BaseFont /TestMM_250_ /FirstChar -100 /LastChar 2147483647 >>`,
+			map[string]float64{"space": 250, "A": 600, "E": 650}},
+		// Widths of the instance.
+		{`<< /Type /Font /Subtype /MMType1 /BaseFont /TestMM_250_ /FirstChar 65 /LastChar 66 /Widths [ 610 505 ] >>`,
+			map[string]float64{"A": 610, "B": 505}},
+	}
+	for _, tcase := range testcases {
+		dict, err := core.NewParserFromString(tcase.Dict).ParseDict()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		dict.Set("FontDescriptor", core.MakeIndirectObject(descriptor))
+		font, err := NewPdfFontFromPdfObject(dict)
+		if err != nil {
+			t.Errorf("%s: Error: %v", tcase.Dict, err)
+			continue
+		}
+		for glyph, width := range tcase.Expected {
+			metrics, found := font.GetGlyphCharMetrics(glyph)
+			if !found || metrics.Wx != width {
+				t.Errorf("%s: Glyph %s: width %v (%v), expected %v", tcase.Dict, glyph, metrics.Wx, found, width)
+			}
+		}
+		d, ok := core.TraceToDirectObject(font.ToPdfObject()).(*core.PdfObjectDictionary)
+		if !ok || d.Get("Subtype").String() != "MMType1" {
+			t.Errorf("%s: Subtype not kept", tcase.Dict)
+		}
+	}
+
+	// Without Widths nor font program.
+	dict, err := core.NewParserFromString(`<< /Type /Font /Subtype /MMType1 /BaseFont /TestMM_250_
+		/FirstChar 32 /LastChar 69 >>`).ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := NewPdfFontFromPdfObject(dict); err == nil {
+		t.Errorf("Font without Widths nor font program should fail")
+	}
+}
+
+// Test that a non-embedded font that is not a standard 14 font, and has no Widths, gets the widths
+// of the standard 14 font chosen by its font descriptor.
+func TestFontSubstituteMetrics(t *testing.T) {
+	// A serif font without Widths gets the Times-Roman widths.
+	dict, err := core.NewParserFromString(`<< /Type /Font /Subtype /TrueType /BaseFont /Georgia
+		/FirstChar 32 /LastChar 126 /Encoding /WinAnsiEncoding
+		/FontDescriptor << /Type /FontDescriptor /FontName /Georgia /Flags 34 /FontWeight 400
+			/ItalicAngle 0 /FontBBox [-173 -216 1232 913] >> >>`).ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	font, err := NewPdfFontFromPdfObject(dict)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for glyph, width := range map[string]float64{"space": 250, "A": 722, "a": 444, "W": 944} {
+		metrics, found := font.GetGlyphCharMetrics(glyph)
+		if !found || metrics.Wx != width {
+			t.Errorf("Glyph %s: width %v (%v), expected %v", glyph, metrics.Wx, found, width)
+		}
+	}
+	if width, found := font.GetCharcodeWidth('A'); !found || width != 722 {
+		t.Errorf("Code A: width %v (%v), expected 722", width, found)
+	}
+
+	// The Widths are used when given.
+	dict, err = core.NewParserFromString(`<< /Type /Font /Subtype /Type1 /BaseFont /Georgia
+		/FirstChar 65 /LastChar 65 /Widths [700]
+		/FontDescriptor << /Type /FontDescriptor /FontName /Georgia /Flags 34 >> >>`).ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	font, err = NewPdfFontFromPdfObject(dict)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if metrics, found := font.GetGlyphCharMetrics("A"); !found || metrics.Wx != 700 {
+		t.Errorf("Glyph A: width %v (%v), expected 700", metrics.Wx, found)
+	}
+
+	// A missing FirstChar is implied by LastChar and the Widths.
+	dict, err = core.NewParserFromString(`<< /Type /Font /Subtype /TrueType /BaseFont /Georgia
+		/LastChar 66 /Widths [700 710]
+		/FontDescriptor << /Type /FontDescriptor /FontName /Georgia /Flags 34 >> >>`).ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	font, err = NewPdfFontFromPdfObject(dict)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if width, found := font.GetCharcodeWidth('A'); !found || width != 700 {
+		t.Errorf("Code A: width %v (%v), expected 700", width, found)
+	}
+
+	// Without Widths, a missing or out of range FirstChar and LastChar cover the codes 0 to 255.
+	for _, chars := range []string{"", "/FirstChar -5 /LastChar 300"} {
+		dict, err = core.NewParserFromString(`<< /Type /Font /Subtype /TrueType /BaseFont /Georgia ` + chars + `
+			/Encoding /WinAnsiEncoding
+			/FontDescriptor << /Type /FontDescriptor /FontName /Georgia /Flags 34 >> >>`).ParseDict()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		font, err = NewPdfFontFromPdfObject(dict)
+		if err != nil {
+			t.Fatalf("%q: Error: %v", chars, err)
+		}
+		for code, expected := range map[uint16]float64{'A': 722, 0xe9: 444} {
+			if width, found := font.GetCharcodeWidth(code); !found || width != expected {
+				t.Errorf("%q: code %d: width %v (%v), expected %v", chars, code, width, found, expected)
+			}
+		}
+	}
+
+	// Symbolic fonts get no substitute metrics.
+	dict, err = core.NewParserFromString(`<< /Type /Font /Subtype /TrueType /BaseFont /Wingdings
+		/FirstChar 32 /LastChar 126
+		/FontDescriptor << /Type /FontDescriptor /FontName /Wingdings /Flags 4 >> >>`).ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := NewPdfFontFromPdfObject(dict); err == nil {
+		t.Errorf("Symbolic font without Widths loaded with substitute metrics")
+	}
+
+	testcases := []struct {
+		Descriptor string
+		Expected   string
+	}{
+		{"/Flags 32", "Helvetica"},
+		{"/Flags 34", "Times-Roman"},
+		{"/Flags 34 /FontWeight 700", "Times-Bold"},
+		{"/Flags 98", "Times-Italic"},
+		{"/Flags 34 /FontWeight 600 /ItalicAngle -12", "Times-BoldItalic"},
+		{"/Flags 33", "Courier"},
+		{"/Flags 262177 /ItalicAngle -11.5", "Courier-BoldOblique"},
+		{"/Flags 32 /ItalicAngle -12", "Helvetica-Oblique"},
+		{"/Flags 32 /FontWeight 700.0", "Helvetica-Bold"},
+	}
+	for _, tcase := range testcases {
+		d, err := core.NewParserFromString("<< /Type /FontDescriptor /FontName /Test " + tcase.Descriptor + " >>").ParseDict()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		descriptor, err := newPdfFontDescriptorFromPdfObject(d)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if name := descriptor.substituteName(); name != tcase.Expected {
+			t.Errorf("%s: substitute %s, expected %s", tcase.Descriptor, name, tcase.Expected)
+		}
+	}
+}
+
+// Test a standard 14 font without Widths whose Encoding has Differences on top of WinAnsiEncoding.
+// The encoder must apply the Differences, and the widths come from the standard font metrics.
+func TestStandard14FontDifferences(t *testing.T) {
+	dict, err := core.NewParserFromString(`<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica
+		/Encoding << /Type /Encoding /BaseEncoding /WinAnsiEncoding /Differences [ 65 /Euro 200 /a ] >> >>`).ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	font, err := NewPdfFontFromPdfObject(dict)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	testcases := []struct {
+		Code  uint16
+		Width float64
+	}{
+		{65, 556},  // Euro.
+		{66, 667},  // B of WinAnsiEncoding.
+		{200, 556}, // a.
+		{32, 278},  // space.
+	}
+	for _, tcase := range testcases {
+		if w, found := font.GetCharcodeWidth(tcase.Code); !found || w != tcase.Width {
+			t.Errorf("Code %d: width %v (%v), expected %v", tcase.Code, w, found, tcase.Width)
+		}
+	}
+	if missing := font.ValidateText("€B"); missing != nil {
+		t.Errorf("Unexpected missing glyphs %q", string(missing))
+	}
+
+	d, ok := core.TraceToDirectObject(font.ToPdfObject()).(*core.PdfObjectDictionary)
+	if !ok {
+		t.Fatalf("Font not a dictionary")
+	}
+	encoding, ok := core.TraceToDirectObject(d.Get("Encoding")).(*core.PdfObjectDictionary)
+	if !ok {
+		t.Fatalf("Encoding not a dictionary (%v)", d.Get("Encoding"))
+	}
+	if s := encoding.Get("Differences").DefaultWriteString(); s != "[65 /Euro 200 /a]" {
+		t.Errorf("Differences %s", s)
+	}
+
+	// An unsupported base encoding falls back to the built-in encoding of the standard font, and
+	// the Encoding is written back unchanged.
+	dict, err = core.NewParserFromString(`<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica
+		/Encoding << /BaseEncoding /MacRomanEncoding /Differences [ 65 /uni20AC ] >> >>`).ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	font, err = NewPdfFontFromPdfObject(dict)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if w, found := font.GetCharcodeWidth(65); !found || w != 556 {
+		t.Errorf("Code 65: width %v (%v), expected 556", w, found)
+	}
+	d, ok = core.TraceToDirectObject(font.ToPdfObject()).(*core.PdfObjectDictionary)
+	if !ok {
+		t.Fatalf("Font not a dictionary")
+	}
+	if s := d.Get("Encoding").DefaultWriteString(); s != "<</BaseEncoding /MacRomanEncoding/Differences [65 /uni20AC]>>" {
+		t.Errorf("Encoding changed to %s", s)
+	}
+
+	// Setting another encoder replaces the Encoding.
+	font.SetEncoder(textencoding.NewWinAnsiTextEncoder())
+	d, ok = core.TraceToDirectObject(font.ToPdfObject()).(*core.PdfObjectDictionary)
+	if !ok || d.Get("Encoding").String() != "WinAnsiEncoding" {
+		t.Errorf("Encoding of the encoder not written: %v", d.Get("Encoding"))
+	}
+
+	// Without Encoding the codes are in StandardEncoding, and no Encoding is written back.
+	dict, err = core.NewParserFromString(`<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>`).ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	font, err = NewPdfFontFromPdfObject(dict)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if r, ok := font.CharcodeToRune(0xae); !ok || r != 'ﬁ' {
+		t.Errorf("Code 0xae: %q (%v), expected 'ﬁ'", r, ok)
+	}
+	d, ok = core.TraceToDirectObject(font.ToPdfObject()).(*core.PdfObjectDictionary)
+	if !ok || d.Get("Encoding") != nil {
+		t.Errorf("Encoding written for a font without one: %v", d.Get("Encoding"))
+	}
+}
+
+// Test that the ToUnicode and FontDescriptor entries of a loaded standard 14 font are written back,
+// and that the ToUnicode CMap is dropped with the encoding it maps.
+func TestStandard14FontKeepsEntries(t *testing.T) {
+	toUnicode, err := core.MakeStream([]byte("1 beginbfchar\n<41> <0042>\nendbfchar"), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	descriptor := core.MakeIndirectObject(core.MakeDict())
+	descriptor.PdfObject.(*core.PdfObjectDictionary).Set("FontName", core.MakeName("Helvetica"))
+	dict := core.MakeDict()
+	dict.Set("Type", core.MakeName("Font"))
+	dict.Set("Subtype", core.MakeName("Type1"))
+	dict.Set("BaseFont", core.MakeName("Helvetica"))
+	dict.Set("ToUnicode", toUnicode)
+	dict.Set("FontDescriptor", descriptor)
+	font, err := NewPdfFontFromPdfObject(dict)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	d, ok := core.TraceToDirectObject(font.ToPdfObject()).(*core.PdfObjectDictionary)
+	if !ok {
+		t.Fatalf("Font not a dictionary")
+	}
+	if d.Get("ToUnicode") != toUnicode {
+		t.Errorf("ToUnicode %v not written back", d.Get("ToUnicode"))
+	}
+	if d.Get("FontDescriptor") != descriptor {
+		t.Errorf("FontDescriptor %v not written back", d.Get("FontDescriptor"))
+	}
+
+	font.SetEncoder(textencoding.NewWinAnsiTextEncoder())
+	d, ok = core.TraceToDirectObject(font.ToPdfObject()).(*core.PdfObjectDictionary)
+	if !ok {
+		t.Fatalf("Font not a dictionary")
+	}
+	if d.Get("ToUnicode") != nil {
+		t.Errorf("ToUnicode %v written for another encoder", d.Get("ToUnicode"))
+	}
+	if d.Get("FontDescriptor") != descriptor {
+		t.Errorf("FontDescriptor %v not written back", d.Get("FontDescriptor"))
+	}
+}
+
+// Test a standard 14 font whose Differences have glyph names of other conventions than the names of
+// the font metrics.
+func TestStandard14FontGlyphNames(t *testing.T) {
+	dict, err := core.NewParserFromString(`<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica
+		/Encoding << /Type /Encoding /Differences [ 65 /uni00C4 /u00D6 /O_uni0308 /f_i /xyz ] >> >>`).ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	font, err := NewPdfFontFromPdfObject(dict)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	testcases := []struct {
+		Code  uint16
+		Width float64
+	}{
+		{65, 667}, // Adieresis.
+		{66, 778}, // Odieresis.
+		{67, 778}, // Odieresis.
+		{68, 500}, // fi.
+	}
+	for _, tcase := range testcases {
+		if w, found := font.GetCharcodeWidth(tcase.Code); !found || w != tcase.Width {
+			t.Errorf("Code %d: width %v (%v), expected %v", tcase.Code, w, found, tcase.Width)
+		}
+	}
+	if _, found := font.GetCharcodeWidth(69); found {
+		t.Errorf("Width of unknown glyph xyz")
+	}
+	if missing := font.ValidateText("ÄÖ\ufb01"); missing != nil {
+		t.Errorf("Unexpected missing glyphs %q", string(missing))
+	}
+}
+
+// Test loading the fonts of a Font resource dictionary with valid and invalid fonts.
+func TestLoadFontsTolerant(t *testing.T) {
+	resources, err := core.NewParserFromString(`<<
+		/F1 << /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>
+		/F2 << /Type /Font /Subtype /Unknown /BaseFont /Arial >>
+		/F3 << /Type /Font /Subtype /TrueType /BaseFont /Arial /FirstChar 65 /LastChar 65 /Widths [722] >>
+		/F4 (not a font)
+		/F5 << /Type /Font /Subtype /TrueType /BaseFont /Arial /FirstChar 65 /LastChar 66 /Widths [722] >>
+		/F6 << /Type /Font /Subtype /Type1 /BaseFont /Times-Bold /Encoding /WinAnsiEncoding >>
+		>>`).ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	loaded, failures := LoadFontsTolerant(resources)
+	if len(loaded) != 3 || loaded["F1"] == nil || loaded["F3"] == nil || loaded["F6"] == nil {
+		t.Errorf("Unexpected loaded fonts %v", loaded)
+	}
+	if w, found := loaded["F3"].GetCharcodeWidth(65); !found || w != 722 {
+		t.Errorf("F3: width %v (%v)", w, found)
+	}
+
+	var names []core.PdfObjectName
+	for _, failure := range failures {
+		if failure.Err == nil || !strings.HasPrefix(failure.Error(), "font "+string(failure.Name)) {
+			t.Errorf("Unexpected failure %v", failure)
+		}
+		names = append(names, failure.Name)
+	}
+	if len(names) != 3 || names[0] != "F2" || names[1] != "F4" || names[2] != "F5" {
+		t.Errorf("Unexpected failures %v", names)
+	}
+
+	if loaded, failures := LoadFontsTolerant(nil); len(loaded) != 0 || len(failures) != 0 {
+		t.Errorf("No fonts expected")
+	}
+}
@@ -0,0 +1,281 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/unidoc/unidoc/common"
+	"github.com/unidoc/unidoc/pdf/core"
+	"github.com/unidoc/unidoc/pdf/internal/cmap"
+	"github.com/unidoc/unidoc/pdf/model/textencoding"
+)
+
+// Character codes probed by the encoding diagnostics: space, A, a, eacute (WinAnsi) and bullet (WinAnsi).
+var explainProbeCodes = []uint64{0x20, 0x41, 0x61, 0xE9, 0x95}
+
+// Maximum number of Differences entries listed by the encoding diagnostics.
+const explainMaxDifferences = 8
+
+// fontEncodingInfo gathers the state that determines how a font's character codes map to text.
+type fontEncodingInfo struct {
+	subtype   string
+	baseFont  string
+	encoder   textencoding.TextEncoder
+	encoding  core.PdfObject // Encoding entry (name or dictionary).
+	toUnicode core.PdfObject
+	cidSystem core.PdfObject // CIDSystemInfo of the descendant font (composite fonts).
+}
+
+// ExplainEncoding returns a human readable description of how the font maps character codes to
+// text, intended for debugging text extraction: the encoder and base encoding, the Differences,
+// the ToUnicode CMap and its coverage, CID system info for composite fonts and which source maps a
+// few probe character codes.
+func (font PdfFont) ExplainEncoding() string {
+	info := fontEncodingInfo{}
+	switch t := font.context.(type) {
+	case *pdfFontTrueType:
+		info.subtype = t.subtypeName()
+		if name, ok := core.TraceToDirectObject(t.BaseFont).(*core.PdfObjectName); ok {
+			info.baseFont = string(*name)
+		}
+		info.encoder = t.Encoder
+		info.encoding = t.Encoding
+		info.toUnicode = t.ToUnicode
+	case *pdfFontStandard14:
+		info.subtype = "Type1"
+		if d, ok := core.TraceToDirectObject(t.ToPdfObject()).(*core.PdfObjectDictionary); ok {
+			if name, ok := d.Get("BaseFont").(*core.PdfObjectName); ok {
+				info.baseFont = string(*name)
+			}
+		}
+		info.encoder = t.encoder
+	case *pdfFontType3:
+		info.subtype = "Type3"
+		if name, ok := core.TraceToDirectObject(t.Name).(*core.PdfObjectName); ok {
+			info.baseFont = string(*name)
+		}
+		info.encoder = t.encoder
+		info.encoding = t.Encoding
+		info.toUnicode = t.ToUnicode
+	case *pdfFontType0:
+		info.subtype = "Type0"
+		if name, ok := core.TraceToDirectObject(t.BaseFont).(*core.PdfObjectName); ok {
+			info.baseFont = string(*name)
+		}
+		info.encoding = t.Encoding
+		info.toUnicode = t.ToUnicode
+		info.cidSystem = t.descendant.CIDSystemInfo
+	default:
+		return fmt.Sprintf("Unsupported font (%T)", font.context)
+	}
+	return info.explain()
+}
+
+// ExplainFontEncoding returns a description of the encoding of the font dictionary `fontObj` as
+// PdfFont.ExplainEncoding, also for font types not otherwise supported (e.g. composite fonts).
+func ExplainFontEncoding(fontObj core.PdfObject) string {
+	d, ok := core.TraceToDirectObject(fontObj).(*core.PdfObjectDictionary)
+	if !ok {
+		return fmt.Sprintf("Font not a dictionary (%T)", fontObj)
+	}
+
+	info := fontEncodingInfo{}
+	if name, ok := core.TraceToDirectObject(d.Get("Subtype")).(*core.PdfObjectName); ok {
+		info.subtype = string(*name)
+	}
+	if name, ok := core.TraceToDirectObject(d.Get("BaseFont")).(*core.PdfObjectName); ok {
+		info.baseFont = string(*name)
+	}
+	info.encoding = d.Get("Encoding")
+	info.toUnicode = d.Get("ToUnicode")
+
+	switch info.subtype {
+	case "Type3":
+		info.encoder = newBaseEncoder(info.encoding, textencoding.NewStandardEncoder())
+	case "Type0":
+		if arr, ok := core.TraceToDirectObject(d.Get("DescendantFonts")).(*core.PdfObjectArray); ok && len(*arr) > 0 {
+			if cidFont, ok := core.TraceToDirectObject((*arr)[0]).(*core.PdfObjectDictionary); ok {
+				info.cidSystem = cidFont.Get("CIDSystemInfo")
+			}
+		}
+	default:
+		info.encoder = simpleFontEncoder(fontObj, info.encoding)
+	}
+
+	return info.explain()
+}
+
+// simpleFontEncoder returns the encoder of the simple font `fontObj` with Encoding entry `encoding`,
+// as set up when loading the font.  If the font cannot be loaded, the encoder is set up from the
+// Encoding entry alone.
+func simpleFontEncoder(fontObj, encoding core.PdfObject) textencoding.TextEncoder {
+	if font, err := newPdfFontFromPdfObject(fontObj); err == nil {
+		switch t := font.context.(type) {
+		case *pdfFontTrueType:
+			return t.Encoder
+		case *pdfFontStandard14:
+			return t.encoder
+		}
+	}
+	font := &pdfFontTrueType{Encoding: encoding}
+	font.addEncoding()
+	return font.Encoder
+}
+
+// getDifferences returns the Differences of Encoding dictionary `encoding` as a map from character
+// code to glyph name.
+func getDifferences(encoding core.PdfObject) map[uint64]string {
+	d, ok := core.TraceToDirectObject(encoding).(*core.PdfObjectDictionary)
+	if !ok {
+		return nil
+	}
+	arr, ok := core.TraceToDirectObject(d.Get("Differences")).(*core.PdfObjectArray)
+	if !ok {
+		return nil
+	}
+
+	differences := map[uint64]string{}
+	code := int64(-1)
+	for _, obj := range *arr {
+		switch t := core.TraceToDirectObject(obj).(type) {
+		case *core.PdfObjectInteger:
+			code = int64(*t)
+		case *core.PdfObjectName:
+			if code < 0 || code > 255 {
+				common.Log.Debug("Invalid Differences entry %s - skipping", *t)
+				continue
+			}
+			differences[uint64(code)] = string(*t)
+			code++
+		}
+	}
+	return differences
+}
+
+// loadToUnicode loads the ToUnicode CMap stream `obj`.
+func loadToUnicode(obj core.PdfObject) (*cmap.CMap, error) {
+	stream, ok := core.TraceToDirectObject(obj).(*core.PdfObjectStream)
+	if !ok {
+		return nil, fmt.Errorf("ToUnicode not a stream (%T)", core.TraceToDirectObject(obj))
+	}
+	decoded, err := core.DecodeStream(stream)
+	if err != nil {
+		return nil, err
+	}
+	return cmap.LoadCmapFromData(decoded)
+}
+
+func (info fontEncodingInfo) explain() string {
+	var buf bytes.Buffer
+
+	buf.WriteString(fmt.Sprintf("Font: %s %s\n", info.subtype, info.baseFont))
+
+	if info.encoder != nil {
+		baseEncoding := "-"
+		if name, ok := core.TraceToDirectObject(info.encoder.ToPdfObject()).(*core.PdfObjectName); ok {
+			baseEncoding = string(*name)
+		}
+		buf.WriteString(fmt.Sprintf("Encoder: %T base %s, %d codes mapped\n", info.encoder, baseEncoding,
+			textencoding.NumMappedCharcodes(info.encoder)))
+	} else {
+		buf.WriteString("Encoder: none\n")
+	}
+
+	differences := getDifferences(info.encoding)
+	if len(differences) > 0 {
+		buf.WriteString(fmt.Sprintf("Differences: %d entries:", len(differences)))
+		var codes []uint64
+		for code := range differences {
+			codes = append(codes, code)
+		}
+		sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+		for i, code := range codes {
+			if i == explainMaxDifferences {
+				buf.WriteString(" ...")
+				break
+			}
+			buf.WriteString(fmt.Sprintf(" %d=/%s", code, differences[code]))
+		}
+		buf.WriteString("\n")
+	} else {
+		buf.WriteString("Differences: none\n")
+	}
+
+	var codemap *cmap.CMap
+	if info.toUnicode != nil {
+		var err error
+		codemap, err = loadToUnicode(info.toUnicode)
+		if err != nil {
+			buf.WriteString(fmt.Sprintf("ToUnicode: invalid (%v)\n", err))
+			codemap = nil
+		} else {
+			buf.WriteString(fmt.Sprintf("ToUnicode: %s\n", codemap.Name()))
+			for _, cov := range codemap.Coverage() {
+				buf.WriteString(fmt.Sprintf("  <%0*X> <%0*X>: %d codes mapped\n",
+					2*cov.NumBytes, cov.Low, 2*cov.NumBytes, cov.High, cov.NumMapped))
+			}
+		}
+	} else {
+		buf.WriteString("ToUnicode: none\n")
+	}
+
+	if info.cidSystem != nil {
+		buf.WriteString(fmt.Sprintf("CIDSystemInfo: %s\n", explainCIDSystemInfo(info.cidSystem)))
+	}
+
+	buf.WriteString("Probes:\n")
+	for _, code := range explainProbeCodes {
+		text, source := info.probe(code, codemap, differences)
+		buf.WriteString(fmt.Sprintf("  0x%02X -> %q (%s)\n", code, text, source))
+	}
+
+	return buf.String()
+}
+
+// probe returns the text that character code `code` maps to and the source of the mapping, in the
+// order they are tried: the ToUnicode CMap, the Differences, the encoder.
+func (info fontEncodingInfo) probe(code uint64, codemap *cmap.CMap, differences map[uint64]string) (string, string) {
+	if codemap != nil {
+		if text, has := codemap.LookupCharcode(code); has {
+			return text, "ToUnicode"
+		}
+	}
+	if glyph, has := differences[code]; has {
+		if r, found := textencoding.GlyphToRune(glyph); found {
+			return string(r), "Differences"
+		}
+		return "", fmt.Sprintf("Differences, unknown glyph /%s", glyph)
+	}
+	if info.encoder != nil && code < 256 {
+		if r, found := info.encoder.CharcodeToRune(byte(code)); found {
+			return string(r), "Encoder"
+		}
+	}
+	return "", "unmapped"
+}
+
+// explainCIDSystemInfo returns the Registry-Ordering-Supplement of a CIDSystemInfo dictionary.
+func explainCIDSystemInfo(obj core.PdfObject) string {
+	d, ok := core.TraceToDirectObject(obj).(*core.PdfObjectDictionary)
+	if !ok {
+		return fmt.Sprintf("invalid (%T)", obj)
+	}
+	var registry, ordering string
+	if s, ok := core.TraceToDirectObject(d.Get("Registry")).(*core.PdfObjectString); ok {
+		registry = string(*s)
+	}
+	if s, ok := core.TraceToDirectObject(d.Get("Ordering")).(*core.PdfObjectString); ok {
+		ordering = string(*s)
+	}
+	supplement := int64(0)
+	if i, ok := core.TraceToDirectObject(d.Get("Supplement")).(*core.PdfObjectInteger); ok {
+		supplement = int64(*i)
+	}
+	return fmt.Sprintf("%s-%s-%d", registry, ordering, supplement)
+}
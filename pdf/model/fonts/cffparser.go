@@ -0,0 +1,613 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package fonts
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/unidoc/unidoc/common"
+)
+
+// CffType contains the glyph widths of a CFF font program (Adobe Technical Note #5176), such as the
+// FontFile3 of a CIDFontType0 font (Subtype CIDFontType0C).  Only the tables needed to get the
+// advance widths are read: the charset, the Private DICTs and the width at the start of the Type 2
+// charstrings.
+type CffType struct {
+	// FontName is the name of the font from the Name INDEX.
+	FontName string
+	// IsCIDFont is true for CID-keyed fonts (with an ROS operator in the Top DICT).
+	IsCIDFont bool
+	// Charset holds the CID (CID-keyed fonts) or SID (name-keyed fonts) of each glyph by GID.
+	Charset []uint16
+	// Widths holds the advance widths by GID, in thousandths of an em (the glyph space units of
+	// the default FontMatrix).
+	Widths []float64
+
+	// gids maps CIDs to GIDs for CID-keyed fonts.
+	gids map[uint16]uint16
+}
+
+// NumGlyphs returns the number of glyphs in the font.
+func (cff *CffType) NumGlyphs() int {
+	return len(cff.Widths)
+}
+
+// GetCIDWidth returns the advance width of the glyph for CID `cid`.  For fonts that are not
+// CID-keyed the CID is taken as the GID.  The bool return flag is false if the font has no glyph
+// for the CID.
+func (cff *CffType) GetCIDWidth(cid uint16) (float64, bool) {
+	gid := cid
+	if cff.IsCIDFont {
+		var ok bool
+		if gid, ok = cff.gids[cid]; !ok {
+			return 0, false
+		}
+	}
+	if int(gid) >= len(cff.Widths) {
+		return 0, false
+	}
+	return cff.Widths[gid], true
+}
+
+// CFF DICT operators.  Escaped operators (12 x) are stored as 1200+x.
+const (
+	cffOpCharset      = 15
+	cffOpCharStrings  = 17
+	cffOpPrivate      = 18
+	cffOpSubrs        = 19
+	cffOpDefaultWidth = 20
+	cffOpNominalWidth = 21
+	cffOpCharstrType  = 1206
+	cffOpFontMatrix   = 1207
+	cffOpROS          = 1230
+	cffOpFDArray      = 1236
+	cffOpFDSelect     = 1237
+)
+
+// cffPrivate holds the Private DICT values used to get the glyph widths.
+type cffPrivate struct {
+	defaultWidthX float64
+	nominalWidthX float64
+	subrs         [][]byte
+}
+
+type cffParser struct {
+	data   []byte
+	gsubrs [][]byte
+}
+
+// CffParseBytes extracts the glyph widths from CFF font data.  Only the first font of a FontSet
+// is read.
+func CffParseBytes(data []byte) (*CffType, error) {
+	p := &cffParser{data: data}
+	return p.parse()
+}
+
+func (p *cffParser) parse() (*CffType, error) {
+	if len(p.data) < 4 {
+		return nil, errors.New("CFF header too short")
+	}
+	if p.data[0] != 1 {
+		return nil, fmt.Errorf("unsupported CFF version %d", p.data[0])
+	}
+
+	names, pos, err := p.readIndex(int(p.data[2]))
+	if err != nil {
+		return nil, err
+	}
+	topDicts, pos, err := p.readIndex(pos)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 || len(topDicts) == 0 {
+		return nil, errors.New("CFF font set empty")
+	}
+	// The String INDEX is not needed for the widths.
+	_, pos, err = p.readIndex(pos)
+	if err != nil {
+		return nil, err
+	}
+	p.gsubrs, _, err = p.readIndex(pos)
+	if err != nil {
+		return nil, err
+	}
+
+	top, err := parseCffDict(topDicts[0])
+	if err != nil {
+		return nil, err
+	}
+	if t, has := top[cffOpCharstrType]; has && (len(t) != 1 || t[0] != 2) {
+		return nil, fmt.Errorf("unsupported charstring type %v", t)
+	}
+
+	cff := &CffType{FontName: string(names[0])}
+	_, cff.IsCIDFont = top[cffOpROS]
+
+	offset, err := cffDictInt(top, cffOpCharStrings, -1)
+	if err != nil || offset < 0 {
+		return nil, errors.New("CFF CharStrings missing")
+	}
+	charstrings, _, err := p.readIndex(offset)
+	if err != nil {
+		return nil, err
+	}
+	numGlyphs := len(charstrings)
+	if numGlyphs == 0 {
+		return nil, errors.New("CFF font without glyphs")
+	}
+
+	charsetOffset, err := cffDictInt(top, cffOpCharset, 0)
+	if err != nil {
+		return nil, err
+	}
+	cff.Charset, err = p.readCharset(charsetOffset, numGlyphs)
+	if err != nil {
+		return nil, err
+	}
+
+	// The Private DICT of each glyph: from the Font DICT given by FDSelect for CID-keyed fonts.
+	var privates []*cffPrivate
+	var fdSelect []byte
+	if cff.IsCIDFont {
+		fdArrayOffset, err := cffDictInt(top, cffOpFDArray, -1)
+		if err != nil || fdArrayOffset < 0 {
+			return nil, errors.New("CFF FDArray missing")
+		}
+		fontDicts, _, err := p.readIndex(fdArrayOffset)
+		if err != nil {
+			return nil, err
+		}
+		for _, data := range fontDicts {
+			fd, err := parseCffDict(data)
+			if err != nil {
+				return nil, err
+			}
+			private, err := p.readPrivate(fd)
+			if err != nil {
+				return nil, err
+			}
+			privates = append(privates, private)
+		}
+		fdSelectOffset, err := cffDictInt(top, cffOpFDSelect, -1)
+		if err != nil || fdSelectOffset < 0 {
+			return nil, errors.New("CFF FDSelect missing")
+		}
+		fdSelect, err = p.readFDSelect(fdSelectOffset, numGlyphs, len(privates))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		private, err := p.readPrivate(top)
+		if err != nil {
+			return nil, err
+		}
+		privates = append(privates, private)
+	}
+
+	// Widths in glyph space are scaled to thousandths of an em by the FontMatrix.
+	scale := 1.0
+	if m, has := top[cffOpFontMatrix]; has && len(m) == 6 && m[0] != 0 {
+		scale = m[0] * 1000
+	}
+
+	cff.Widths = make([]float64, numGlyphs)
+	for gid, charstring := range charstrings {
+		private := privates[0]
+		if fdSelect != nil {
+			private = privates[fdSelect[gid]]
+		}
+		width := private.defaultWidthX
+		if w, has := p.charstringWidth(charstring, private); has {
+			width = private.nominalWidthX + w
+		}
+		cff.Widths[gid] = width * scale
+	}
+
+	if cff.IsCIDFont {
+		cff.gids = map[uint16]uint16{}
+		for gid, cid := range cff.Charset {
+			if _, has := cff.gids[cid]; !has {
+				cff.gids[cid] = uint16(gid)
+			}
+		}
+	}
+	return cff, nil
+}
+
+// readIndex reads the INDEX at `offset`, returning its objects and the offset following it.
+func (p *cffParser) readIndex(offset int) ([][]byte, int, error) {
+	if offset < 0 || offset+2 > len(p.data) {
+		return nil, 0, errors.New("CFF INDEX out of range")
+	}
+	count := int(binary.BigEndian.Uint16(p.data[offset:]))
+	if count == 0 {
+		return nil, offset + 2, nil
+	}
+	if offset+3 > len(p.data) {
+		return nil, 0, errors.New("CFF INDEX out of range")
+	}
+	offSize := int(p.data[offset+2])
+	if offSize < 1 || offSize > 4 {
+		return nil, 0, fmt.Errorf("invalid CFF INDEX offset size %d", offSize)
+	}
+	offsetsStart := offset + 3
+	dataStart := offsetsStart + (count+1)*offSize - 1
+	if dataStart >= len(p.data) {
+		return nil, 0, errors.New("CFF INDEX out of range")
+	}
+
+	readOffset := func(i int) int {
+		v := 0
+		for _, b := range p.data[offsetsStart+i*offSize : offsetsStart+(i+1)*offSize] {
+			v = v<<8 | int(b)
+		}
+		return dataStart + v
+	}
+
+	objects := make([][]byte, count)
+	start := readOffset(0)
+	for i := 0; i < count; i++ {
+		end := readOffset(i + 1)
+		if end < start || end > len(p.data) {
+			return nil, 0, errors.New("invalid CFF INDEX offsets")
+		}
+		objects[i] = p.data[start:end]
+		start = end
+	}
+	return objects, start, nil
+}
+
+// readCharset reads the charset at `offset`, returning the CID or SID of each glyph.  The
+// predefined charsets (offsets 0 to 2) only apply to name-keyed fonts, for which the SIDs are not
+// needed and are left 0.
+func (p *cffParser) readCharset(offset int, numGlyphs int) ([]uint16, error) {
+	charset := make([]uint16, numGlyphs)
+	if offset <= 2 {
+		return charset, nil
+	}
+	if offset >= len(p.data) {
+		return nil, errors.New("CFF charset out of range")
+	}
+
+	format := p.data[offset]
+	pos := offset + 1
+	switch format {
+	case 0:
+		if pos+2*(numGlyphs-1) > len(p.data) {
+			return nil, errors.New("CFF charset out of range")
+		}
+		for gid := 1; gid < numGlyphs; gid++ {
+			charset[gid] = binary.BigEndian.Uint16(p.data[pos:])
+			pos += 2
+		}
+	case 1, 2:
+		// Ranges of a first CID (or SID) followed by the number of the ones that follow, with a
+		// Card8 count in format 1 and Card16 in format 2.
+		size := 3 + int(format-1)
+		for gid := 1; gid < numGlyphs; {
+			if pos+size > len(p.data) {
+				return nil, errors.New("CFF charset out of range")
+			}
+			first := int(binary.BigEndian.Uint16(p.data[pos:]))
+			nLeft := int(p.data[pos+2])
+			if format == 2 {
+				nLeft = int(binary.BigEndian.Uint16(p.data[pos+2:]))
+			}
+			pos += size
+			for i := 0; i <= nLeft && gid < numGlyphs; i++ {
+				charset[gid] = uint16(first + i)
+				gid++
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid CFF charset format %d", format)
+	}
+	return charset, nil
+}
+
+// readFDSelect reads the FDSelect at `offset`, returning the Font DICT index of each glyph.
+func (p *cffParser) readFDSelect(offset int, numGlyphs int, numFDs int) ([]byte, error) {
+	if offset >= len(p.data) {
+		return nil, errors.New("CFF FDSelect out of range")
+	}
+	fds := make([]byte, numGlyphs)
+	format := p.data[offset]
+	pos := offset + 1
+	switch format {
+	case 0:
+		if pos+numGlyphs > len(p.data) {
+			return nil, errors.New("CFF FDSelect out of range")
+		}
+		copy(fds, p.data[pos:pos+numGlyphs])
+	case 3:
+		if pos+2 > len(p.data) {
+			return nil, errors.New("CFF FDSelect out of range")
+		}
+		numRanges := int(binary.BigEndian.Uint16(p.data[pos:]))
+		pos += 2
+		if pos+3*numRanges+2 > len(p.data) {
+			return nil, errors.New("CFF FDSelect out of range")
+		}
+		for i := 0; i < numRanges; i++ {
+			first := int(binary.BigEndian.Uint16(p.data[pos:]))
+			fd := p.data[pos+2]
+			// The first GID of the next range, or the sentinel after the last range.
+			next := int(binary.BigEndian.Uint16(p.data[pos+3:]))
+			for gid := first; gid < next && gid < numGlyphs; gid++ {
+				fds[gid] = fd
+			}
+			pos += 3
+		}
+	default:
+		return nil, fmt.Errorf("invalid CFF FDSelect format %d", format)
+	}
+	for _, fd := range fds {
+		if int(fd) >= numFDs {
+			return nil, fmt.Errorf("CFF FDSelect index %d out of range", fd)
+		}
+	}
+	return fds, nil
+}
+
+// readPrivate reads the Private DICT referenced by the Top or Font DICT `dict`, with its local
+// subroutines.
+func (p *cffParser) readPrivate(dict map[int][]float64) (*cffPrivate, error) {
+	private := &cffPrivate{}
+	operands, has := dict[cffOpPrivate]
+	if !has {
+		return private, nil
+	}
+	if len(operands) != 2 {
+		return nil, errors.New("invalid CFF Private operands")
+	}
+	size, offset := int(operands[0]), int(operands[1])
+	if size < 0 || offset < 0 || offset+size > len(p.data) {
+		return nil, errors.New("CFF Private DICT out of range")
+	}
+	pd, err := parseCffDict(p.data[offset : offset+size])
+	if err != nil {
+		return nil, err
+	}
+	if v, has := pd[cffOpDefaultWidth]; has && len(v) == 1 {
+		private.defaultWidthX = v[0]
+	}
+	if v, has := pd[cffOpNominalWidth]; has && len(v) == 1 {
+		private.nominalWidthX = v[0]
+	}
+	// The local subroutines are at an offset relative to the Private DICT.
+	if v, has := pd[cffOpSubrs]; has && len(v) == 1 {
+		private.subrs, _, err = p.readIndex(offset + int(v[0]))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return private, nil
+}
+
+// maxCffSubrDepth is the subroutine nesting limit of Type 2 charstrings.
+const maxCffSubrDepth = 10
+
+// charstringWidth returns the width operand at the start of the Type 2 charstring `data`, which
+// is the difference to nominalWidthX.  The width is the extra operand of the first stack clearing
+// operator.  Returns false if the charstring has no width, so that defaultWidthX applies.
+// Subroutines called before the first stack clearing operator are followed, as subroutinized
+// fonts may hold the width in a subroutine.
+func (p *cffParser) charstringWidth(data []byte, private *cffPrivate) (float64, bool) {
+	var stack []float64
+	done := false
+	var walk func(data []byte, depth int) (float64, bool)
+	walk = func(data []byte, depth int) (float64, bool) {
+		if depth > maxCffSubrDepth {
+			done = true
+			return 0, false
+		}
+		for i := 0; i < len(data) && !done; {
+			b0 := data[i]
+			switch {
+			case b0 == 28:
+				if i+3 > len(data) {
+					done = true
+					return 0, false
+				}
+				stack = append(stack, float64(int16(binary.BigEndian.Uint16(data[i+1:]))))
+				i += 3
+				continue
+			case b0 >= 32 && b0 <= 246:
+				stack = append(stack, float64(int(b0)-139))
+				i++
+				continue
+			case b0 >= 247 && b0 <= 254:
+				if i+2 > len(data) {
+					done = true
+					return 0, false
+				}
+				v := (int(b0)-247)*256 + int(data[i+1]) + 108
+				if b0 >= 251 {
+					v = -(int(b0)-251)*256 - int(data[i+1]) - 108
+				}
+				stack = append(stack, float64(v))
+				i += 2
+				continue
+			case b0 == 255:
+				if i+5 > len(data) {
+					done = true
+					return 0, false
+				}
+				stack = append(stack, float64(int32(binary.BigEndian.Uint32(data[i+1:])))/65536)
+				i += 5
+				continue
+			}
+
+			i++
+			// Number of operands of the stack clearing operators, besides the width.
+			var numArgs int
+			switch b0 {
+			case 1, 3, 18, 23: // hstem, vstem, hstemhm, vstemhm
+				numArgs = len(stack) &^ 1
+			case 19, 20: // hintmask, cntrmask (with an implied vstem)
+				numArgs = len(stack) &^ 1
+			case 21: // rmoveto
+				numArgs = 2
+			case 4, 22: // vmoveto, hmoveto
+				numArgs = 1
+			case 14: // endchar (with the seac operands)
+				numArgs = len(stack)
+				if numArgs == 1 || numArgs == 5 {
+					numArgs--
+				}
+			case 10, 29: // callsubr, callgsubr
+				if len(stack) == 0 {
+					done = true
+					return 0, false
+				}
+				subrs := private.subrs
+				if b0 == 29 {
+					subrs = p.gsubrs
+				}
+				index := int(stack[len(stack)-1]) + cffSubrBias(len(subrs))
+				stack = stack[:len(stack)-1]
+				if index < 0 || index >= len(subrs) {
+					common.Log.Debug("CFF subroutine %d out of range", index)
+					done = true
+					return 0, false
+				}
+				if w, has := walk(subrs[index], depth+1); done {
+					return w, has
+				}
+				continue
+			case 11: // return
+				return 0, false
+			default:
+				// Not expected before the first stack clearing operator.
+				done = true
+				return 0, false
+			}
+			done = true
+			if len(stack) > numArgs {
+				return stack[0], true
+			}
+			return 0, false
+		}
+		return 0, false
+	}
+	return walk(data, 0)
+}
+
+// cffSubrBias returns the bias added to subroutine numbers for a subroutine INDEX of `count`
+// subroutines.
+func cffSubrBias(count int) int {
+	switch {
+	case count < 1240:
+		return 107
+	case count < 33900:
+		return 1131
+	}
+	return 32768
+}
+
+// parseCffDict parses the CFF DICT data, returning the operands by operator.
+func parseCffDict(data []byte) (map[int][]float64, error) {
+	dict := map[int][]float64{}
+	var operands []float64
+	for i := 0; i < len(data); {
+		b0 := data[i]
+		switch {
+		case b0 <= 21:
+			op := int(b0)
+			i++
+			if b0 == 12 {
+				if i >= len(data) {
+					return nil, errors.New("truncated CFF DICT operator")
+				}
+				op = 1200 + int(data[i])
+				i++
+			}
+			dict[op] = operands
+			operands = nil
+		case b0 == 28:
+			if i+3 > len(data) {
+				return nil, errors.New("truncated CFF DICT operand")
+			}
+			operands = append(operands, float64(int16(binary.BigEndian.Uint16(data[i+1:]))))
+			i += 3
+		case b0 == 29:
+			if i+5 > len(data) {
+				return nil, errors.New("truncated CFF DICT operand")
+			}
+			operands = append(operands, float64(int32(binary.BigEndian.Uint32(data[i+1:]))))
+			i += 5
+		case b0 == 30:
+			v, n, err := parseCffReal(data[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			operands = append(operands, v)
+			i += 1 + n
+		case b0 >= 32 && b0 <= 246:
+			operands = append(operands, float64(int(b0)-139))
+			i++
+		case b0 >= 247 && b0 <= 254:
+			if i+2 > len(data) {
+				return nil, errors.New("truncated CFF DICT operand")
+			}
+			v := (int(b0)-247)*256 + int(data[i+1]) + 108
+			if b0 >= 251 {
+				v = -(int(b0)-251)*256 - int(data[i+1]) - 108
+			}
+			operands = append(operands, float64(v))
+			i += 2
+		default:
+			return nil, fmt.Errorf("invalid CFF DICT byte %d", b0)
+		}
+	}
+	return dict, nil
+}
+
+// parseCffReal parses a real number operand of a CFF DICT, encoded as nibbles following the
+// prefix byte 30.  Returns the value and the number of bytes read.
+func parseCffReal(data []byte) (float64, int, error) {
+	str := ""
+	for i, b := range data {
+		for _, nibble := range []byte{b >> 4, b & 0x0f} {
+			switch {
+			case nibble <= 9:
+				str += string('0' + nibble)
+			case nibble == 0xa:
+				str += "."
+			case nibble == 0xb:
+				str += "E"
+			case nibble == 0xc:
+				str += "E-"
+			case nibble == 0xe:
+				str += "-"
+			case nibble == 0xf:
+				v, err := strconv.ParseFloat(str, 64)
+				if err != nil {
+					return 0, 0, fmt.Errorf("invalid CFF real %q", str)
+				}
+				return v, i + 1, nil
+			default:
+				return 0, 0, errors.New("invalid CFF real nibble")
+			}
+		}
+	}
+	return 0, 0, errors.New("truncated CFF real")
+}
+
+// cffDictInt returns the integer operand of `op` in `dict`, or `def` if absent.
+func cffDictInt(dict map[int][]float64, op int, def int) (int, error) {
+	operands, has := dict[op]
+	if !has {
+		return def, nil
+	}
+	if len(operands) != 1 {
+		return 0, fmt.Errorf("invalid CFF DICT operands for operator %d", op)
+	}
+	return int(operands[0]), nil
+}
@@ -0,0 +1,68 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package fonts
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// Test the widths of a CID-keyed CFF font with two Font DICTs of different default and nominal
+// widths, including glyphs whose width operand is in a global or local subroutine.
+func TestCffCIDWidths(t *testing.T) {
+	data, err := ioutil.ReadFile("../../../testfiles/cidfont.cff")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	cff, err := CffParseBytes(data)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if cff.FontName != "TestCID" || !cff.IsCIDFont || cff.NumGlyphs() != 6 {
+		t.Fatalf("Unexpected font %s (CID-keyed: %v, %d glyphs)", cff.FontName, cff.IsCIDFont, cff.NumGlyphs())
+	}
+	if expected := []uint16{0, 1, 2, 100, 101, 500}; !reflect.DeepEqual(cff.Charset, expected) {
+		t.Errorf("Charset %v != %v", cff.Charset, expected)
+	}
+
+	expected := map[uint16]float64{0: 1000, 1: 700, 2: 400, 100: 250, 101: 500, 500: 1234}
+	for cid, width := range expected {
+		w, ok := cff.GetCIDWidth(cid)
+		if !ok || w != width {
+			t.Errorf("CID %d: width %v (%v), expected %v", cid, w, ok, width)
+		}
+	}
+	if _, ok := cff.GetCIDWidth(3); ok {
+		t.Errorf("CID 3 should not be found")
+	}
+
+	if _, err := CffParseBytes(data[:100]); err == nil {
+		t.Errorf("Truncated font should fail")
+	}
+}
+
+// Test the real number operands of CFF DICTs.
+func TestCffReal(t *testing.T) {
+	testcases := []struct {
+		Data     []byte
+		Expected float64
+	}{
+		{[]byte{0x1e, 0xe2, 0xa2, 0x5f}, -2.25},
+		{[]byte{0x1e, 0x0a, 0x14, 0x05, 0x41, 0xc3, 0xff}, 0.140541e-3},
+		{[]byte{0x1e, 0x1b, 0x3f}, 1e3},
+	}
+	for _, tcase := range testcases {
+		dict, err := parseCffDict(append(tcase.Data, cffOpNominalWidth))
+		if err != nil {
+			t.Errorf("%x: %v", tcase.Data, err)
+			continue
+		}
+		if v := dict[cffOpNominalWidth]; len(v) != 1 || v[0] != tcase.Expected {
+			t.Errorf("%x: %v != %v", tcase.Data, v, tcase.Expected)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package fonts
+
+import (
+	"sort"
+	"sync"
+)
+
+// StdFontName is the name of a standard font, i.e. a font with built-in metrics that is not embedded.
+type StdFontName string
+
+// Names of the standard 14 fonts.
+const (
+	CourierName              = StdFontName("Courier")
+	CourierBoldName          = StdFontName("Courier-Bold")
+	CourierObliqueName       = StdFontName("Courier-Oblique")
+	CourierBoldObliqueName   = StdFontName("Courier-BoldOblique")
+	HelveticaName            = StdFontName("Helvetica")
+	HelveticaBoldName        = StdFontName("Helvetica-Bold")
+	HelveticaObliqueName     = StdFontName("Helvetica-Oblique")
+	HelveticaBoldObliqueName = StdFontName("Helvetica-BoldOblique")
+	TimesRomanName           = StdFontName("Times-Roman")
+	TimesBoldName            = StdFontName("Times-Bold")
+	TimesItalicName          = StdFontName("Times-Italic")
+	TimesBoldItalicName      = StdFontName("Times-BoldItalic")
+	SymbolName               = StdFontName("Symbol")
+	ZapfDingbatsName         = StdFontName("ZapfDingbats")
+)
+
+// stdFontFamily holds the style variants of a font family.
+type stdFontFamily struct {
+	regular, bold, italic, boldItalic StdFontName
+}
+
+// stdFontRegistry holds the standard fonts and font families.  Safe for concurrent use.
+type stdFontRegistry struct {
+	lock     sync.RWMutex
+	fonts    map[StdFontName]func() Font
+	families map[StdFontName]stdFontFamily // By the name of each member.
+}
+
+var stdFonts = &stdFontRegistry{
+	fonts:    map[StdFontName]func() Font{},
+	families: map[StdFontName]stdFontFamily{},
+}
+
+func init() {
+	RegisterStdFont(CourierName, func() Font { return NewFontCourier() })
+	RegisterStdFont(CourierBoldName, func() Font { return NewFontCourierBold() })
+	RegisterStdFont(CourierObliqueName, func() Font { return NewFontCourierOblique() })
+	RegisterStdFont(CourierBoldObliqueName, func() Font { return NewFontCourierBoldOblique() })
+	RegisterStdFont(HelveticaName, func() Font { return NewFontHelvetica() })
+	RegisterStdFont(HelveticaBoldName, func() Font { return NewFontHelveticaBold() })
+	RegisterStdFont(HelveticaObliqueName, func() Font { return NewFontHelveticaOblique() })
+	RegisterStdFont(HelveticaBoldObliqueName, func() Font { return NewFontHelveticaBoldOblique() })
+	RegisterStdFont(TimesRomanName, func() Font { return NewFontTimesRoman() })
+	RegisterStdFont(TimesBoldName, func() Font { return NewFontTimesBold() })
+	RegisterStdFont(TimesItalicName, func() Font { return NewFontTimesItalic() })
+	RegisterStdFont(TimesBoldItalicName, func() Font { return NewFontTimesBoldItalic() })
+	RegisterStdFont(SymbolName, func() Font { return NewFontSymbol() })
+	RegisterStdFont(ZapfDingbatsName, func() Font { return NewFontZapfDingbats() })
+
+	RegisterStdFontFamily(CourierName, CourierBoldName, CourierObliqueName, CourierBoldObliqueName)
+	RegisterStdFontFamily(HelveticaName, HelveticaBoldName, HelveticaObliqueName, HelveticaBoldObliqueName)
+	RegisterStdFontFamily(TimesRomanName, TimesBoldName, TimesItalicName, TimesBoldItalicName)
+}
+
+// RegisterStdFont registers the standard font `name`, created by `fnc`, replacing any font
+// registered with the same name.
+func RegisterStdFont(name StdFontName, fnc func() Font) {
+	stdFonts.lock.Lock()
+	defer stdFonts.lock.Unlock()
+	stdFonts.fonts[name] = fnc
+}
+
+// NewStdFontByName returns a new instance of the standard font `name`.  The bool return flag is
+// false if no such font is registered.
+func NewStdFontByName(name StdFontName) (Font, bool) {
+	stdFonts.lock.RLock()
+	fnc, has := stdFonts.fonts[name]
+	stdFonts.lock.RUnlock()
+	if !has {
+		return nil, false
+	}
+	return fnc(), true
+}
+
+// ListStdFonts returns the names of the registered standard fonts in sorted order.
+func ListStdFonts() []StdFontName {
+	stdFonts.lock.RLock()
+	defer stdFonts.lock.RUnlock()
+
+	names := make([]StdFontName, 0, len(stdFonts.fonts))
+	for name := range stdFonts.fonts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
+// RegisterStdFontFamily registers the regular, bold, italic and bold italic variants of a font
+// family, for lookup with GetFontFamily.  Variants that do not exist can be left empty.
+func RegisterStdFontFamily(regular, bold, italic, boldItalic StdFontName) {
+	family := stdFontFamily{regular: regular, bold: bold, italic: italic, boldItalic: boldItalic}
+
+	stdFonts.lock.Lock()
+	defer stdFonts.lock.Unlock()
+	for _, name := range []StdFontName{regular, bold, italic, boldItalic} {
+		if name != "" {
+			stdFonts.families[name] = family
+		}
+	}
+}
+
+// GetFontFamily returns the regular, bold, italic and bold italic variants of the font family that
+// the standard font `name` belongs to, e.g. Helvetica-Bold for the bold variant of
+// Helvetica-Oblique.  The bool return flag is false if the font is not part of a registered family.
+func GetFontFamily(name StdFontName) (regular, bold, italic, boldItalic StdFontName, ok bool) {
+	stdFonts.lock.RLock()
+	defer stdFonts.lock.RUnlock()
+
+	family, has := stdFonts.families[name]
+	if !has {
+		return "", "", "", "", false
+	}
+	return family.regular, family.bold, family.italic, family.boldItalic, true
+}
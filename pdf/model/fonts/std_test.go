@@ -0,0 +1,84 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package fonts
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestStdFontFamily(t *testing.T) {
+	names := ListStdFonts()
+	if len(names) < 14 {
+		t.Fatalf("Standard 14 fonts not registered (%d)", len(names))
+	}
+	for i := 1; i < len(names); i++ {
+		if names[i-1] >= names[i] {
+			t.Errorf("Names not sorted: %s %s", names[i-1], names[i])
+		}
+	}
+
+	font, ok := NewStdFontByName(HelveticaBoldName)
+	if !ok {
+		t.Fatalf("Helvetica-Bold not found")
+	}
+	if metrics, found := font.GetGlyphCharMetrics("A"); !found || metrics.Wx != 722 {
+		t.Errorf("Unexpected metrics for A: %v %v", metrics, found)
+	}
+
+	regular, bold, italic, boldItalic, ok := GetFontFamily(TimesItalicName)
+	if !ok || regular != TimesRomanName || bold != TimesBoldName || italic != TimesItalicName ||
+		boldItalic != TimesBoldItalicName {
+		t.Errorf("Unexpected Times family: %s %s %s %s %v", regular, bold, italic, boldItalic, ok)
+	}
+	_, bold, _, _, ok = GetFontFamily(CourierObliqueName)
+	if !ok || bold != CourierBoldName {
+		t.Errorf("Unexpected bold Courier variant: %s %v", bold, ok)
+	}
+	if _, _, _, _, ok := GetFontFamily(SymbolName); ok {
+		t.Errorf("Symbol should not have a family")
+	}
+}
+
+// Test registering fonts and families concurrently with lookups.
+func TestStdFontConcurrentRegistration(t *testing.T) {
+	const n = 20
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			regular := StdFontName(fmt.Sprintf("Custom%d", i))
+			bold := StdFontName(fmt.Sprintf("Custom%d-Bold", i))
+			RegisterStdFont(regular, func() Font { return NewFontHelvetica() })
+			RegisterStdFont(bold, func() Font { return NewFontHelveticaBold() })
+			RegisterStdFontFamily(regular, bold, "", "")
+		}(i)
+		go func() {
+			defer wg.Done()
+			ListStdFonts()
+			NewStdFontByName(CourierName)
+			GetFontFamily(HelveticaName)
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		name := StdFontName(fmt.Sprintf("Custom%d", i))
+		if _, ok := NewStdFontByName(name); !ok {
+			t.Errorf("%s not registered", name)
+		}
+		regular, bold, italic, _, ok := GetFontFamily(StdFontName(fmt.Sprintf("Custom%d-Bold", i)))
+		if !ok || regular != name || bold != name+"-Bold" || italic != "" {
+			t.Errorf("Unexpected family of %s: %s %s %s %v", name, regular, bold, italic, ok)
+		}
+	}
+	if len(ListStdFonts()) < 14+2*n {
+		t.Errorf("Registered fonts not listed")
+	}
+}
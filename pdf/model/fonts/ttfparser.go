@@ -23,11 +23,16 @@ package fonts
 // Port to Go: Kurt Jung, 2013-07-15
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"regexp"
 	"strings"
+
+	"github.com/unidoc/unidoc/common"
+	"github.com/unidoc/unidoc/pdf/model/textencoding"
 )
 
 // TtfType contains metrics of a TrueType font.
@@ -46,23 +51,118 @@ type TtfType struct {
 	CapHeight              int16
 	Widths                 []uint16
 	Chars                  map[uint16]uint16
+
+	// SymbolChars maps character codes to glyph indices per the (3,0) Microsoft Symbol cmap
+	// subtable, with codes typically in the range F000-F0FF.  Nil if the font has no such subtable.
+	SymbolChars map[uint16]uint16
+
+	// MacChars maps Mac OS Roman character codes to glyph indices per the (1,0) cmap subtable.
+	// Nil if the font has no such subtable.
+	MacChars map[uint16]uint16
+
+	// GlyphNames holds the glyph names by glyph index (GID) from the post table, if the table
+	// is of format 1.0 or 2.0 (nil otherwise).
+	GlyphNames []string
+	// glyphGIDs maps the glyph names of GlyphNames to their GIDs (first GID for duplicate names).
+	glyphGIDs map[string]uint16
+
+	// NumGlyphs is the number of glyphs in the font (maxp table).
+	NumGlyphs uint16
+
+	// emptyGlyphs flags glyphs without outline data by GID (from the loca table, nil if missing).
+	emptyGlyphs []bool
+}
+
+// HasOutline returns true if the glyph with index `gid` has outline data.  Glyphs such as space have
+// no outline, as do glyphs removed by subsetting.  If the font has no glyph location (loca) table,
+// all glyphs within range are assumed to have outlines.
+func (ttf *TtfType) HasOutline(gid uint16) bool {
+	if gid >= ttf.NumGlyphs {
+		return false
+	}
+	if ttf.emptyGlyphs == nil {
+		return true
+	}
+	return !ttf.emptyGlyphs[gid]
+}
+
+// GetGID returns the glyph index (GID) of the named glyph.  The glyph is looked up through its
+// Unicode value in the cmap, falling back to the glyph names of the post table for glyphs that
+// are not covered by the cmap (or have no Unicode value), and then to the (3,0) and (1,0) cmap
+// subtables of symbolic fonts.
+// The bool return flag is true if the glyph was found, and false otherwise.
+func (ttf *TtfType) GetGID(glyph string) (uint16, bool) {
+	if r, ok := textencoding.GlyphToRune(glyph); ok {
+		if gid, ok := ttf.Chars[uint16(r)]; ok {
+			return gid, true
+		}
+	}
+
+	if gid, ok := ttf.glyphGIDs[glyph]; ok {
+		return gid, true
+	}
+
+	return ttf.getGIDFromSymbolicCmaps(glyph)
 }
 
 type ttfParser struct {
 	rec              TtfType
-	f                *os.File
+	f                io.ReadSeeker
 	tables           map[string]uint32
 	numberOfHMetrics uint16
 	numGlyphs        uint16
+	indexToLocFormat int16
 }
 
 // TtfParse extracts various metrics from a TrueType font file.
 func TtfParse(fileStr string) (TtfRec TtfType, err error) {
+	f, err := os.Open(fileStr)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return ttfParse(f)
+}
+
+// TtfParseBytes extracts various metrics from TrueType font data, such as an embedded font program.
+func TtfParseBytes(data []byte) (TtfRec TtfType, err error) {
+	return ttfParse(bytes.NewReader(data))
+}
+
+func ttfParse(f io.ReadSeeker) (TtfRec TtfType, err error) {
 	var t ttfParser
-	t.f, err = os.Open(fileStr)
+	t.f = f
+	err = t.ParseTableDirectory()
+	if err != nil {
+		return
+	}
+	err = t.ParseComponents()
 	if err != nil {
 		return
 	}
+	TtfRec = t.rec
+	return
+}
+
+// TtfParseMetricsBytes extracts the glyph widths and the metrics of the head, hhea and maxp tables
+// from TrueType font data.  Unlike TtfParseBytes it does not need the other tables, which subset
+// fonts embedded in PDF files often lack (e.g. cmap, name and post in CIDFontType2 fonts).
+func TtfParseMetricsBytes(data []byte) (TtfType, error) {
+	var t ttfParser
+	t.f = bytes.NewReader(data)
+	if err := t.ParseTableDirectory(); err != nil {
+		return TtfType{}, err
+	}
+	for _, parse := range []func() error{t.ParseHead, t.ParseHhea, t.ParseMaxp, t.ParseHmtx} {
+		if err := parse(); err != nil {
+			return TtfType{}, err
+		}
+	}
+	return t.rec, nil
+}
+
+// ParseTableDirectory reads the offsets of the tables.
+func (t *ttfParser) ParseTableDirectory() (err error) {
 	version, err := t.ReadStr(4)
 	if err != nil {
 		return
@@ -89,12 +189,6 @@ func TtfParse(fileStr string) (TtfRec TtfType, err error) {
 		t.Skip(4) // length
 		t.tables[tag] = offset
 	}
-	err = t.ParseComponents()
-	if err != nil {
-		return
-	}
-	t.f.Close()
-	TtfRec = t.rec
 	return
 }
 
@@ -114,6 +208,9 @@ func (t *ttfParser) ParseComponents() (err error) {
 							err = t.ParseOS2()
 							if err == nil {
 								err = t.ParsePost()
+								if err == nil {
+									err = t.ParseLoca()
+								}
 							}
 						}
 					}
@@ -139,6 +236,8 @@ func (t *ttfParser) ParseHead() (err error) {
 	t.rec.Ymin = t.ReadShort()
 	t.rec.Xmax = t.ReadShort()
 	t.rec.Ymax = t.ReadShort()
+	t.Skip(3 * 2) // macStyle, lowestRecPPEM, fontDirectionHint
+	t.indexToLocFormat = t.ReadShort()
 	return
 }
 
@@ -156,12 +255,42 @@ func (t *ttfParser) ParseMaxp() (err error) {
 	if err == nil {
 		t.Skip(4)
 		t.numGlyphs = t.ReadUShort()
+		t.rec.NumGlyphs = t.numGlyphs
+	}
+	return
+}
+
+// ParseLoca determines which glyphs have no outline data from the glyph locations (loca table).
+// The table is optional (only present in fonts with TrueType outlines).
+func (t *ttfParser) ParseLoca() (err error) {
+	if _, ok := t.tables["loca"]; !ok {
+		return nil
+	}
+	if err = t.Seek("loca"); err != nil {
+		return
+	}
+
+	offsets := make([]uint32, int(t.numGlyphs)+1)
+	for i := range offsets {
+		if t.indexToLocFormat == 0 {
+			offsets[i] = 2 * uint32(t.ReadUShort())
+		} else {
+			offsets[i] = t.ReadULong()
+		}
+	}
+
+	t.rec.emptyGlyphs = make([]bool, t.numGlyphs)
+	for gid := range t.rec.emptyGlyphs {
+		t.rec.emptyGlyphs[gid] = offsets[gid+1] <= offsets[gid]
 	}
 	return
 }
 
 func (t *ttfParser) ParseHmtx() (err error) {
 	err = t.Seek("hmtx")
+	if err == nil && t.numberOfHMetrics == 0 {
+		err = fmt.Errorf("no horizontal metrics")
+	}
 	if err == nil {
 		t.rec.Widths = make([]uint16, 0, 8)
 		for j := uint16(0); j < t.numberOfHMetrics; j++ {
@@ -185,30 +314,90 @@ func (t *ttfParser) ParseCmap() (err error) {
 	}
 	t.Skip(2) // version
 	numTables := int(t.ReadUShort())
-	offset31 := int64(0)
+	offset31, offset30, offset10 := int64(0), int64(0), int64(0)
 	for j := 0; j < numTables; j++ {
 		platformID := t.ReadUShort()
 		encodingID := t.ReadUShort()
 		offset = int64(t.ReadULong())
-		if platformID == 3 && encodingID == 1 {
+		switch {
+		case platformID == 3 && encodingID == 1:
 			offset31 = offset
+		case platformID == 3 && encodingID == 0:
+			offset30 = offset
+		case platformID == 1 && encodingID == 0:
+			offset10 = offset
 		}
 	}
-	if offset31 == 0 {
-		err = fmt.Errorf("no Unicode encoding found")
+	if offset31 == 0 && offset30 == 0 && offset10 == 0 {
+		err = fmt.Errorf("no Unicode or symbolic encoding found")
 		return
 	}
+
+	t.rec.Chars = make(map[uint16]uint16)
+	if offset31 != 0 {
+		if err = t.parseCmapSubtable(offset31, t.rec.Chars); err != nil {
+			return
+		}
+	}
+	// Symbolic fonts typically have (3,0) and/or (1,0) subtables only.
+	if offset30 != 0 {
+		t.rec.SymbolChars = make(map[uint16]uint16)
+		if err := t.parseCmapSubtable(offset30, t.rec.SymbolChars); err != nil {
+			common.Log.Debug("Skipping (3,0) cmap subtable: %v", err)
+			t.rec.SymbolChars = nil
+		}
+	}
+	if offset10 != 0 {
+		t.rec.MacChars = make(map[uint16]uint16)
+		if err := t.parseCmapSubtable(offset10, t.rec.MacChars); err != nil {
+			common.Log.Debug("Skipping (1,0) cmap subtable: %v", err)
+			t.rec.MacChars = nil
+		}
+	}
+	return
+}
+
+// parseCmapSubtable adds the character code to glyph index mappings of the cmap subtable at
+// `offset` to `chars`.  Formats 0, 4 and 6 are supported.
+func (t *ttfParser) parseCmapSubtable(offset int64, chars map[uint16]uint16) error {
+	t.f.Seek(int64(t.tables["cmap"])+offset, os.SEEK_SET)
+	format := t.ReadUShort()
+	switch format {
+	case 0:
+		t.Skip(2 * 2) // length, language
+		glyphs, err := t.ReadStr(256)
+		if err != nil {
+			return err
+		}
+		for c := 0; c < 256; c++ {
+			if gid := uint16(glyphs[c]); gid > 0 {
+				chars[uint16(c)] = gid
+			}
+		}
+	case 4:
+		t.parseCmapFormat4(chars)
+	case 6:
+		t.Skip(2 * 2) // length, language
+		firstCode := t.ReadUShort()
+		entryCount := t.ReadUShort()
+		for j := uint16(0); j < entryCount; j++ {
+			if gid := t.ReadUShort(); gid > 0 {
+				chars[firstCode+j] = gid
+			}
+		}
+	default:
+		return fmt.Errorf("unexpected subtable format: %d", format)
+	}
+	return nil
+}
+
+// parseCmapFormat4 adds the mappings of a format 4 cmap subtable, following the format field, to
+// `chars`.
+func (t *ttfParser) parseCmapFormat4(chars map[uint16]uint16) {
 	startCount := make([]uint16, 0, 8)
 	endCount := make([]uint16, 0, 8)
 	idDelta := make([]int16, 0, 8)
 	idRangeOffset := make([]uint16, 0, 8)
-	t.rec.Chars = make(map[uint16]uint16)
-	t.f.Seek(int64(t.tables["cmap"])+offset31, os.SEEK_SET)
-	format := t.ReadUShort()
-	if format != 4 {
-		err = fmt.Errorf("unexpected subtable format: %d", format)
-		return
-	}
 	t.Skip(2 * 2) // length, language
 	segCount := int(t.ReadUShort() / 2)
 	t.Skip(3 * 2) // searchRange, entrySelector, rangeShift
@@ -222,7 +411,7 @@ func (t *ttfParser) ParseCmap() (err error) {
 	for j := 0; j < segCount; j++ {
 		idDelta = append(idDelta, t.ReadShort())
 	}
-	offset, _ = t.f.Seek(int64(0), os.SEEK_CUR)
+	offset, _ := t.f.Seek(int64(0), os.SEEK_CUR)
 	for j := 0; j < segCount; j++ {
 		idRangeOffset = append(idRangeOffset, t.ReadUShort())
 	}
@@ -251,11 +440,10 @@ func (t *ttfParser) ParseCmap() (err error) {
 				gid -= 65536
 			}
 			if gid > 0 {
-				t.rec.Chars[c] = uint16(gid)
+				chars[c] = uint16(gid)
 			}
 		}
 	}
-	return
 }
 
 func (t *ttfParser) ParseName() (err error) {
@@ -320,16 +508,113 @@ func (t *ttfParser) ParseOS2() (err error) {
 func (t *ttfParser) ParsePost() (err error) {
 	err = t.Seek("post")
 	if err == nil {
-		t.Skip(4) // version
+		version := t.ReadULong()
 		t.rec.ItalicAngle = t.ReadShort()
 		t.Skip(2) // Skip decimal part
 		t.rec.UnderlinePosition = t.ReadShort()
 		t.rec.UnderlineThickness = t.ReadShort()
 		t.rec.IsFixedPitch = t.ReadULong() != 0
+		t.Skip(4 * 4) // minMemType42, maxMemType42, minMemType1, maxMemType1
+		names, err := t.parsePostGlyphNames(version)
+		if err != nil {
+			// The glyph names are only needed for fonts without a usable cmap.
+			common.Log.Debug("Ignoring post table glyph names: %v", err)
+			return nil
+		}
+		t.rec.GlyphNames = names
+		t.rec.glyphGIDs = make(map[string]uint16, len(names))
+		for gid, name := range names {
+			if _, has := t.rec.glyphGIDs[name]; !has {
+				t.rec.glyphGIDs[name] = uint16(gid)
+			}
+		}
 	}
 	return
 }
 
+// parsePostGlyphNames reads the glyph names of the post table.  Format 1.0 uses the standard
+// Macintosh glyph order, format 2.0 has an index per glyph into the standard names (< 258) or
+// the list of Pascal strings following the index array.  Other formats do not carry glyph names.
+// Assumes the reader is positioned after the post table header.
+func (t *ttfParser) parsePostGlyphNames(version uint32) ([]string, error) {
+	switch version {
+	case 0x00010000:
+		if int(t.numGlyphs) < len(macGlyphNames) {
+			return macGlyphNames[:t.numGlyphs], nil
+		}
+		return macGlyphNames, nil
+	case 0x00020000:
+	default:
+		return nil, nil
+	}
+
+	numGlyphs := int(t.ReadUShort())
+	indices := make([]uint16, numGlyphs)
+	numNames := 0
+	for i := range indices {
+		indices[i] = t.ReadUShort()
+		if int(indices[i]) >= len(macGlyphNames) && int(indices[i])-len(macGlyphNames)+1 > numNames {
+			numNames = int(indices[i]) - len(macGlyphNames) + 1
+		}
+	}
+
+	customNames := make([]string, numNames)
+	for i := range customNames {
+		length := make([]byte, 1)
+		if _, err := t.f.Read(length); err != nil {
+			return nil, fmt.Errorf("post table glyph name %d: %v", i, err)
+		}
+		name, err := t.ReadStr(int(length[0]))
+		if err != nil && length[0] > 0 {
+			return nil, err
+		}
+		customNames[i] = name
+	}
+
+	names := make([]string, numGlyphs)
+	for gid, index := range indices {
+		if int(index) < len(macGlyphNames) {
+			names[gid] = macGlyphNames[index]
+		} else {
+			names[gid] = customNames[int(index)-len(macGlyphNames)]
+		}
+	}
+	return names, nil
+}
+
+// macGlyphNames is the standard Macintosh glyph order used by post table formats 1.0 and 2.0.
+var macGlyphNames = []string{
+	".notdef", ".null", "nonmarkingreturn", "space", "exclam", "quotedbl", "numbersign", "dollar",
+	"percent", "ampersand", "quotesingle", "parenleft", "parenright", "asterisk", "plus", "comma",
+	"hyphen", "period", "slash", "zero", "one", "two", "three", "four", "five", "six", "seven",
+	"eight", "nine", "colon", "semicolon", "less", "equal", "greater", "question", "at", "A", "B",
+	"C", "D", "E", "F", "G", "H", "I", "J", "K", "L", "M", "N", "O", "P", "Q", "R", "S", "T", "U",
+	"V", "W", "X", "Y", "Z", "bracketleft", "backslash", "bracketright", "asciicircum", "underscore",
+	"grave", "a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l", "m", "n", "o", "p", "q", "r",
+	"s", "t", "u", "v", "w", "x", "y", "z", "braceleft", "bar", "braceright", "asciitilde",
+	"Adieresis", "Aring", "Ccedilla", "Eacute", "Ntilde", "Odieresis", "Udieresis", "aacute",
+	"agrave", "acircumflex", "adieresis", "atilde", "aring", "ccedilla", "eacute", "egrave",
+	"ecircumflex", "edieresis", "iacute", "igrave", "icircumflex", "idieresis", "ntilde", "oacute",
+	"ograve", "ocircumflex", "odieresis", "otilde", "uacute", "ugrave", "ucircumflex", "udieresis",
+	"dagger", "degree", "cent", "sterling", "section", "bullet", "paragraph", "germandbls",
+	"registered", "copyright", "trademark", "acute", "dieresis", "notequal", "AE", "Oslash",
+	"infinity", "plusminus", "lessequal", "greaterequal", "yen", "mu", "partialdiff", "summation",
+	"product", "pi", "integral", "ordfeminine", "ordmasculine", "Omega", "ae", "oslash",
+	"questiondown", "exclamdown", "logicalnot", "radical", "florin", "approxequal", "Delta",
+	"guillemotleft", "guillemotright", "ellipsis", "nonbreakingspace", "Agrave", "Atilde", "Otilde",
+	"OE", "oe", "endash", "emdash", "quotedblleft", "quotedblright", "quoteleft", "quoteright",
+	"divide", "lozenge", "ydieresis", "Ydieresis", "fraction", "currency", "guilsinglleft",
+	"guilsinglright", "fi", "fl", "daggerdbl", "periodcentered", "quotesinglbase", "quotedblbase",
+	"perthousand", "Acircumflex", "Ecircumflex", "Aacute", "Edieresis", "Egrave", "Iacute",
+	"Icircumflex", "Idieresis", "Igrave", "Oacute", "Ocircumflex", "apple", "Ograve", "Uacute",
+	"Ucircumflex", "Ugrave", "dotlessi", "circumflex", "tilde", "macron", "breve", "dotaccent",
+	"ring", "cedilla", "hungarumlaut", "ogonek", "caron", "Lslash", "lslash", "Scaron", "scaron",
+	"Zcaron", "zcaron", "brokenbar", "Eth", "eth", "Yacute", "yacute", "Thorn", "thorn", "minus",
+	"multiply", "onesuperior", "twosuperior", "threesuperior", "onehalf", "onequarter",
+	"threequarters", "franc", "Gbreve", "gbreve", "Idotaccent", "Scedilla", "scedilla", "Cacute",
+	"cacute", "Ccaron", "ccaron", "dcroat",
+}
+
 func (t *ttfParser) Seek(tag string) (err error) {
 	ofs, ok := t.tables[tag]
 	if ok {
@@ -0,0 +1,155 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package fonts
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// makeTTFWithPost2 returns a copy of the TrueType font data with the post table replaced by a
+// format 2.0 table, naming glyph 1 by its standard name "space" (index 3), the last glyph "A.alt"
+// and all other glyphs ".notdef".
+func makeTTFWithPost2(data []byte) ([]byte, uint16) {
+	numTables := int(binary.BigEndian.Uint16(data[4:6]))
+	var numGlyphs uint16
+	var postEntry int
+	for i := 0; i < numTables; i++ {
+		entry := 12 + 16*i
+		offset := binary.BigEndian.Uint32(data[entry+8:])
+		switch string(data[entry : entry+4]) {
+		case "maxp":
+			numGlyphs = binary.BigEndian.Uint16(data[offset+4:])
+		case "post":
+			postEntry = entry
+		}
+	}
+
+	postOffset := binary.BigEndian.Uint32(data[postEntry+8:])
+	post := make([]byte, 32)
+	copy(post, data[postOffset:postOffset+32])
+	binary.BigEndian.PutUint32(post[0:], 0x00020000)
+
+	indices := make([]byte, 2+2*int(numGlyphs))
+	binary.BigEndian.PutUint16(indices[0:], numGlyphs)
+	binary.BigEndian.PutUint16(indices[2+2*1:], 3)
+	binary.BigEndian.PutUint16(indices[2+2*(int(numGlyphs)-1):], 258)
+	post = append(post, indices...)
+	post = append(post, byte(len("A.alt")))
+	post = append(post, "A.alt"...)
+
+	out := append([]byte{}, data...)
+	binary.BigEndian.PutUint32(out[postEntry+8:], uint32(len(out)))
+	binary.BigEndian.PutUint32(out[postEntry+12:], uint32(len(post)))
+	out = append(out, post...)
+
+	return out, numGlyphs
+}
+
+func TestTtfPostGlyphNames(t *testing.T) {
+	data, err := ioutil.ReadFile("../../../testfiles/roboto/Roboto-Regular.ttf")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data, numGlyphs := makeTTFWithPost2(data)
+
+	f, err := ioutil.TempFile("", "unidoc_post2_ttf")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	ttf, err := TtfParse(f.Name())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if len(ttf.GlyphNames) != int(numGlyphs) {
+		t.Fatalf("Glyph names length != %d (%d)", numGlyphs, len(ttf.GlyphNames))
+	}
+	if ttf.GlyphNames[1] != "space" {
+		t.Errorf("Glyph 1 name != space (%s)", ttf.GlyphNames[1])
+	}
+
+	// Not in the cmap, resolved via the post table.
+	gid, found := ttf.GetGID("A.alt")
+	if !found || gid != numGlyphs-1 {
+		t.Errorf("A.alt -> %d (%v), expected %d", gid, found, numGlyphs-1)
+	}
+
+	// Resolved via the cmap.
+	gid, found = ttf.GetGID("A")
+	if !found || gid != ttf.Chars['A'] {
+		t.Errorf("A -> %d (%v), expected %d", gid, found, ttf.Chars['A'])
+	}
+
+	if _, found = ttf.GetGID("nonexistent"); found {
+		t.Errorf("Nonexistent glyph should not be found")
+	}
+
+	// A truncated post table only loses the glyph names.
+	ttf, err = TtfParseBytes(data[:len(data)-3])
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if ttf.GlyphNames != nil {
+		t.Errorf("Glyph names of truncated post table: %d", len(ttf.GlyphNames))
+	}
+	if gid, found = ttf.GetGID("A"); !found || gid != ttf.Chars['A'] {
+		t.Errorf("A -> %d (%v), expected %d", gid, found, ttf.Chars['A'])
+	}
+}
+
+// Test the metrics of a font without cmap, name, OS/2 and post tables, as in subset CIDFontType2
+// fonts, which TtfParseBytes cannot parse.
+func TestTtfParseMetricsBytes(t *testing.T) {
+	data, err := ioutil.ReadFile("../../../testfiles/roboto/Roboto-Regular.ttf")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	full, err := TtfParseBytes(data)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// Hide the tables by renaming them in the table directory.
+	stripped := append([]byte{}, data...)
+	numTables := int(binary.BigEndian.Uint16(data[4:6]))
+	for i := 0; i < numTables; i++ {
+		entry := 12 + 16*i
+		switch string(data[entry : entry+4]) {
+		case "cmap", "name", "OS/2", "post":
+			copy(stripped[entry:], "zzzz")
+		}
+	}
+	if _, err := TtfParseBytes(stripped); err == nil {
+		t.Errorf("Font without cmap parsed")
+	}
+
+	ttf, err := TtfParseMetricsBytes(stripped)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if ttf.UnitsPerEm != full.UnitsPerEm || ttf.NumGlyphs != full.NumGlyphs || len(ttf.Widths) != len(full.Widths) {
+		t.Fatalf("Metrics differ: %d units per em, %d glyphs, %d widths", ttf.UnitsPerEm, ttf.NumGlyphs, len(ttf.Widths))
+	}
+	for gid, width := range full.Widths {
+		if ttf.Widths[gid] != width {
+			t.Errorf("GID %d: width %d != %d", gid, ttf.Widths[gid], width)
+		}
+	}
+
+	if _, err := TtfParseMetricsBytes(data[:12]); err == nil {
+		t.Errorf("Truncated font parsed")
+	}
+}
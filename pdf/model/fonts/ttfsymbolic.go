@@ -0,0 +1,82 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package fonts
+
+import "github.com/unidoc/unidoc/pdf/model/textencoding"
+
+// GetSymbolicGID returns the glyph index (GID) of character code `code` of a symbolic TrueType font,
+// which is mapped directly by the font's cmap (9.6.6.4 "Encodings for TrueType Fonts"): through the
+// (3,0) subtable with the code prefixed by F0, F1 or F2 (or as is), or through the (1,0) subtable.
+// The bool return flag is true if the code is mapped, and false otherwise.
+func (ttf *TtfType) GetSymbolicGID(code byte) (uint16, bool) {
+	if ttf.SymbolChars != nil {
+		for _, prefix := range []uint16{0xF000, 0xF100, 0xF200, 0x0000} {
+			if gid, ok := ttf.SymbolChars[prefix|uint16(code)]; ok {
+				return gid, true
+			}
+		}
+	}
+	if gid, ok := ttf.MacChars[uint16(code)]; ok {
+		return gid, true
+	}
+	return 0, false
+}
+
+// getGIDFromSymbolicCmaps returns the glyph index of the named glyph in the (3,0) or (1,0) cmap
+// subtables.  In the (3,0) subtable the glyph's Unicode value (if at most FF) is looked up as a
+// symbol code, in the (1,0) subtable the glyph's Mac OS Roman character code is looked up.
+func (ttf *TtfType) getGIDFromSymbolicCmaps(glyph string) (uint16, bool) {
+	r, ok := textencoding.GlyphToRune(glyph)
+	if !ok {
+		return 0, false
+	}
+	if ttf.SymbolChars != nil && r <= 0xFF {
+		if gid, ok := ttf.GetSymbolicGID(byte(r)); ok {
+			return gid, true
+		}
+	}
+	if ttf.MacChars != nil {
+		if code, ok := runeToMacRoman(r); ok {
+			if gid, ok := ttf.MacChars[uint16(code)]; ok {
+				return gid, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// runeToMacRoman returns the Mac OS Roman character code of `r`.
+func runeToMacRoman(r rune) (byte, bool) {
+	if r < 0x80 {
+		return byte(r), true
+	}
+	for i, m := range macRomanHigh {
+		if m == r {
+			return byte(0x80 + i), true
+		}
+	}
+	return 0, false
+}
+
+// macRomanHigh holds the runes of the Mac OS Roman character codes 80-FF.
+var macRomanHigh = [128]rune{
+	0x00C4, 0x00C5, 0x00C7, 0x00C9, 0x00D1, 0x00D6, 0x00DC, 0x00E1,
+	0x00E0, 0x00E2, 0x00E4, 0x00E3, 0x00E5, 0x00E7, 0x00E9, 0x00E8,
+	0x00EA, 0x00EB, 0x00ED, 0x00EC, 0x00EE, 0x00EF, 0x00F1, 0x00F3,
+	0x00F2, 0x00F4, 0x00F6, 0x00F5, 0x00FA, 0x00F9, 0x00FB, 0x00FC,
+	0x2020, 0x00B0, 0x00A2, 0x00A3, 0x00A7, 0x2022, 0x00B6, 0x00DF,
+	0x00AE, 0x00A9, 0x2122, 0x00B4, 0x00A8, 0x2260, 0x00C6, 0x00D8,
+	0x221E, 0x00B1, 0x2264, 0x2265, 0x00A5, 0x00B5, 0x2202, 0x2211,
+	0x220F, 0x03C0, 0x222B, 0x00AA, 0x00BA, 0x03A9, 0x00E6, 0x00F8,
+	0x00BF, 0x00A1, 0x00AC, 0x221A, 0x0192, 0x2248, 0x2206, 0x00AB,
+	0x00BB, 0x2026, 0x00A0, 0x00C0, 0x00C3, 0x00D5, 0x0152, 0x0153,
+	0x2013, 0x2014, 0x201C, 0x201D, 0x2018, 0x2019, 0x00F7, 0x25CA,
+	0x00FF, 0x0178, 0x2044, 0x20AC, 0x2039, 0x203A, 0xFB01, 0xFB02,
+	0x2021, 0x00B7, 0x201A, 0x201E, 0x2030, 0x00C2, 0x00CA, 0x00C1,
+	0x00CB, 0x00C8, 0x00CD, 0x00CE, 0x00CF, 0x00CC, 0x00D3, 0x00D4,
+	0xF8FF, 0x00D2, 0x00DA, 0x00DB, 0x00D9, 0x0131, 0x02C6, 0x02DC,
+	0x00AF, 0x02D8, 0x02D9, 0x02DA, 0x00B8, 0x02DD, 0x02DB, 0x02C7,
+}
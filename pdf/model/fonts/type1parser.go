@@ -0,0 +1,482 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package fonts
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strconv"
+
+	"github.com/unidoc/unidoc/common"
+)
+
+// Type1Type contains the glyph widths of a Type 1 font program (Adobe Type 1 Font Format), such as
+// the FontFile of a Type1 or MMType1 font.  Only the cleartext font dictionary entries and the
+// side bearing and width operators at the start of the charstrings are read.
+//
+// For multiple master fonts the widths are those of the base design (the first master), as the
+// values of the other masters are only used when blending an instance.
+type Type1Type struct {
+	// FontName is the name of the font from the cleartext font dictionary.
+	FontName string
+	// IsMultipleMaster is true for multiple master fonts (with a Blend dictionary).
+	IsMultipleMaster bool
+	// Widths holds the advance widths by glyph name, in thousandths of an em (the glyph space
+	// units of the default FontMatrix).
+	Widths map[string]float64
+}
+
+// GetGlyphWidth returns the advance width of glyph `glyph`.  The bool return flag is false if the
+// glyph is not in the font.
+func (t1 *Type1Type) GetGlyphWidth(glyph string) (float64, bool) {
+	w, has := t1.Widths[glyph]
+	return w, has
+}
+
+const (
+	// Keys of the eexec and charstring encryption.
+	type1EexecKey       = 55665
+	type1CharstringKey  = 4330
+	maxType1SubrDepth   = 10
+	defaultType1LenIV   = 4
+	pfbSegmentHeaderLen = 6
+)
+
+// Type1ParseBytes parses the Type 1 font program `data`, where `length1` is the length of the
+// cleartext portion (Length1 of the FontFile stream, 0 if not known).  The program may also be in
+// PFB format or have a hexadecimal encrypted portion.
+func Type1ParseBytes(data []byte, length1 int) (*Type1Type, error) {
+	if len(data) > 0 && data[0] == 0x80 {
+		var err error
+		data, length1, err = unpackPfb(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if length1 <= 0 || length1 > len(data) || !bytes.Contains(data[:length1], []byte("eexec")) {
+		i := bytes.Index(data, []byte("eexec"))
+		if i < 0 {
+			return nil, errors.New("eexec section not found")
+		}
+		if length1 > 0 {
+			common.Log.Debug("Invalid Length1 %d - eexec at %d", length1, i)
+		}
+		length1 = i + len("eexec")
+	}
+	clear := data[:length1]
+	encrypted := data[length1:]
+	for len(encrypted) > 0 && isType1Space(encrypted[0]) {
+		encrypted = encrypted[1:]
+	}
+	if isHexPortion(encrypted) {
+		encrypted = decodeType1Hex(encrypted)
+	}
+	private := type1Decrypt(encrypted, type1EexecKey, 4)
+
+	t1 := &Type1Type{Widths: map[string]float64{}}
+	if name, ok := type1DictValue(clear, "/FontName"); ok && len(name) > 1 && name[0] == '/' {
+		t1.FontName = name[1:]
+	}
+	t1.IsMultipleMaster = bytes.Contains(clear, []byte("/Blend"))
+	if t1.IsMultipleMaster {
+		common.Log.Debug("Multiple master font %s - using widths of the base design", t1.FontName)
+	}
+
+	scale := 1.0
+	if m := bytes.Index(clear, []byte("/FontMatrix")); m >= 0 {
+		tk := &type1Tokenizer{data: clear, pos: m + len("/FontMatrix")}
+		tok := bytes.TrimLeft(tk.next(), "[{")
+		if len(tok) == 0 {
+			tok = tk.next()
+		}
+		if v, err := strconv.ParseFloat(string(tok), 64); err == nil && v != 0 {
+			scale = v * 1000
+		}
+	}
+
+	lenIV := defaultType1LenIV
+	if v, ok := type1DictValue(private, "/lenIV"); ok {
+		if n, err := strconv.Atoi(v); err == nil {
+			lenIV = n
+		}
+	}
+
+	subrs := readType1Subrs(private, lenIV)
+	charstrings := readType1CharStrings(private, lenIV)
+	if len(charstrings) == 0 {
+		return nil, errors.New("no charstrings in font program")
+	}
+
+	blended := false
+	for name, cs := range charstrings {
+		w, ok := type1CharstringWidth(cs, subrs, &blended)
+		if !ok {
+			common.Log.Debug("No width in charstring of glyph /%s", name)
+			continue
+		}
+		t1.Widths[name] = w * scale
+	}
+	if blended {
+		common.Log.Debug("Font %s has blended charstring values - using values of the first master",
+			t1.FontName)
+	}
+
+	return t1, nil
+}
+
+// unpackPfb returns the cleartext and encrypted portions of the PFB font `data` joined together
+// and the length of the cleartext portion.
+func unpackPfb(data []byte) ([]byte, int, error) {
+	var out []byte
+	length1 := 0
+	for len(data) >= 2 && data[0] == 0x80 && data[1] != 3 {
+		if len(data) < pfbSegmentHeaderLen {
+			return nil, 0, errors.New("truncated PFB segment header")
+		}
+		kind := data[1]
+		n := int(data[2]) | int(data[3])<<8 | int(data[4])<<16 | int(data[5])<<24
+		data = data[pfbSegmentHeaderLen:]
+		if n < 0 || n > len(data) {
+			return nil, 0, errors.New("PFB segment out of range")
+		}
+		if kind == 1 && length1 == len(out) {
+			length1 += n
+		}
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return out, length1, nil
+}
+
+// isHexPortion returns true if the encrypted portion `data` is hexadecimal, which is the case if
+// its first 4 bytes are hex digits.
+func isHexPortion(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	for _, b := range data[:4] {
+		if !isType1HexDigit(b) {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeType1Hex decodes the hexadecimal `data`, ignoring whitespace and stopping at the first
+// other non hex digit.
+func decodeType1Hex(data []byte) []byte {
+	digits := make([]byte, 0, len(data))
+	for _, b := range data {
+		if isType1HexDigit(b) {
+			digits = append(digits, b)
+		} else if !isType1Space(b) {
+			break
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = digits[:len(digits)-1]
+	}
+	out := make([]byte, len(digits)/2)
+	hex.Decode(out, digits)
+	return out
+}
+
+// type1Decrypt decrypts `data` with the initial key `r`, dropping the first `skip` plaintext bytes.
+func type1Decrypt(data []byte, r uint16, skip int) []byte {
+	const c1, c2 = 52845, 22719
+	out := make([]byte, len(data))
+	for i, c := range data {
+		out[i] = c ^ byte(r>>8)
+		r = (uint16(c)+r)*c1 + c2
+	}
+	if skip > len(out) {
+		skip = len(out)
+	}
+	return out[skip:]
+}
+
+// type1DictValue returns the token that follows the key `key` in `data`.
+func type1DictValue(data []byte, key string) (string, bool) {
+	i := bytes.Index(data, []byte(key))
+	if i < 0 {
+		return "", false
+	}
+	tk := &type1Tokenizer{data: data, pos: i + len(key)}
+	tok := tk.next()
+	return string(tok), len(tok) > 0
+}
+
+// readType1Subrs returns the decrypted subroutines of the Subrs array of the Private dictionary
+// `private`.  Each entry has the form `dup <index> <length> RD <binary> NP`.
+func readType1Subrs(private []byte, lenIV int) [][]byte {
+	i := bytes.Index(private, []byte("/Subrs"))
+	if i < 0 {
+		return nil
+	}
+	tk := &type1Tokenizer{data: private, pos: i + len("/Subrs")}
+	count, err := strconv.Atoi(string(tk.next()))
+	if err != nil || count < 0 || count > len(private) {
+		return nil
+	}
+	subrs := make([][]byte, count)
+	for {
+		tok := string(tk.next())
+		switch tok {
+		case "dup":
+		case "NP", "|", "noaccess", "put", "array":
+			continue
+		default:
+			return subrs
+		}
+		index, err := strconv.Atoi(string(tk.next()))
+		if err != nil {
+			return subrs
+		}
+		data, ok := tk.binary()
+		if !ok {
+			return subrs
+		}
+		if index >= 0 && index < count {
+			subrs[index] = type1CharstringDecrypt(data, lenIV)
+		}
+	}
+}
+
+// readType1CharStrings returns the decrypted charstrings of the CharStrings dictionary of the
+// Private dictionary `private` by glyph name.  Each entry has the form
+// `/<name> <length> RD <binary> ND`.
+func readType1CharStrings(private []byte, lenIV int) map[string][]byte {
+	charstrings := map[string][]byte{}
+	i := bytes.Index(private, []byte("/CharStrings"))
+	if i < 0 {
+		return charstrings
+	}
+	tk := &type1Tokenizer{data: private, pos: i + len("/CharStrings")}
+	for {
+		tok := tk.next()
+		if len(tok) == 0 || string(tok) == "begin" {
+			break
+		}
+	}
+	for {
+		tok := tk.next()
+		if len(tok) == 0 || string(tok) == "end" {
+			break
+		}
+		if tok[0] != '/' {
+			continue
+		}
+		data, ok := tk.binary()
+		if !ok {
+			break
+		}
+		charstrings[string(tok[1:])] = type1CharstringDecrypt(data, lenIV)
+	}
+	return charstrings
+}
+
+// type1CharstringDecrypt decrypts the charstring `data`, unless `lenIV` is -1 (not encrypted).
+func type1CharstringDecrypt(data []byte, lenIV int) []byte {
+	if lenIV < 0 {
+		return data
+	}
+	return type1Decrypt(data, type1CharstringKey, lenIV)
+}
+
+// type1CharstringWidth returns the width of the hsbw or sbw operator at the start of the Type 1
+// charstring `data`.  The operands may be computed by subroutines, div, or the blend OtherSubrs
+// of multiple master fonts, in which case `blended` is set.
+func type1CharstringWidth(data []byte, subrs [][]byte, blended *bool) (float64, bool) {
+	var stack, psStack []float64
+	done := false
+	pop := func() float64 {
+		if len(stack) == 0 {
+			return 0
+		}
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v
+	}
+
+	var walk func(data []byte, depth int) (float64, bool)
+	walk = func(data []byte, depth int) (float64, bool) {
+		if depth > maxType1SubrDepth {
+			done = true
+			return 0, false
+		}
+		for i := 0; i < len(data) && !done; {
+			b0 := data[i]
+			switch {
+			case b0 >= 32 && b0 <= 246:
+				stack = append(stack, float64(int(b0)-139))
+				i++
+				continue
+			case b0 >= 247 && b0 <= 254:
+				if i+2 > len(data) {
+					done = true
+					return 0, false
+				}
+				v := (int(b0)-247)*256 + int(data[i+1]) + 108
+				if b0 >= 251 {
+					v = -(int(b0)-251)*256 - int(data[i+1]) - 108
+				}
+				stack = append(stack, float64(v))
+				i += 2
+				continue
+			case b0 == 255:
+				if i+5 > len(data) {
+					done = true
+					return 0, false
+				}
+				v := int32(uint32(data[i+1])<<24 | uint32(data[i+2])<<16 | uint32(data[i+3])<<8 | uint32(data[i+4]))
+				stack = append(stack, float64(v))
+				i += 5
+				continue
+			}
+
+			i++
+			op := int(b0)
+			if b0 == 12 {
+				if i >= len(data) {
+					done = true
+					return 0, false
+				}
+				op = 1200 + int(data[i])
+				i++
+			}
+
+			switch op {
+			case 13: // hsbw: sbx wx
+				done = true
+				if len(stack) < 2 {
+					return 0, false
+				}
+				return stack[len(stack)-1], true
+			case 1207: // sbw: sbx sby wx wy
+				done = true
+				if len(stack) < 4 {
+					return 0, false
+				}
+				return stack[len(stack)-2], true
+			case 10: // callsubr
+				index := int(pop())
+				if index < 0 || index >= len(subrs) || subrs[index] == nil {
+					common.Log.Debug("Type 1 subroutine %d out of range", index)
+					done = true
+					return 0, false
+				}
+				if w, has := walk(subrs[index], depth+1); done {
+					return w, has
+				}
+			case 11: // return
+				return 0, false
+			case 1212: // div
+				b, a := pop(), pop()
+				if b == 0 {
+					done = true
+					return 0, false
+				}
+				stack = append(stack, a/b)
+			case 1216: // callothersubr: arg1 ... argn n othersubr#
+				othersubr := int(pop())
+				n := int(pop())
+				if n < 0 || n > len(stack) {
+					done = true
+					return 0, false
+				}
+				args := append([]float64(nil), stack[len(stack)-n:]...)
+				stack = stack[:len(stack)-n]
+				results := args
+				if m := blendResults(othersubr); m > 0 {
+					// The arguments are the m values of the first master followed by the
+					// deltas of the other masters.
+					*blended = true
+					if m > len(args) {
+						m = len(args)
+					}
+					results = args[:m]
+				}
+				// The results are returned in order by the following pop operators.
+				psStack = psStack[:0]
+				for j := len(results) - 1; j >= 0; j-- {
+					psStack = append(psStack, results[j])
+				}
+			case 1217: // pop
+				v := 0.0
+				if len(psStack) > 0 {
+					v = psStack[len(psStack)-1]
+					psStack = psStack[:len(psStack)-1]
+				}
+				stack = append(stack, v)
+			default:
+				// hsbw or sbw must come first.
+				done = true
+				return 0, false
+			}
+		}
+		return 0, false
+	}
+	return walk(data, 0)
+}
+
+// blendResults returns the number of results of the OtherSubr `othersubr` if it is one of the
+// multiple master blend OtherSubrs 14 to 18, or 0 otherwise.
+func blendResults(othersubr int) int {
+	switch othersubr {
+	case 14, 15, 16, 17:
+		return othersubr - 13
+	case 18:
+		return 6
+	}
+	return 0
+}
+
+// type1Tokenizer splits the cleartext or decrypted Private dictionary of a Type 1 font into
+// whitespace separated tokens.
+type type1Tokenizer struct {
+	data []byte
+	pos  int
+}
+
+// next returns the next token, or nil at the end of the data.
+func (tk *type1Tokenizer) next() []byte {
+	for tk.pos < len(tk.data) && isType1Space(tk.data[tk.pos]) {
+		tk.pos++
+	}
+	start := tk.pos
+	for tk.pos < len(tk.data) && !isType1Space(tk.data[tk.pos]) {
+		tk.pos++
+	}
+	return tk.data[start:tk.pos]
+}
+
+// binary reads the `<length> RD <binary>` part of a Subrs or CharStrings entry and returns the
+// binary data.  RD may be named otherwise, such as -|, and is followed by a single space.
+func (tk *type1Tokenizer) binary() ([]byte, bool) {
+	n, err := strconv.Atoi(string(tk.next()))
+	if err != nil || n < 0 {
+		return nil, false
+	}
+	if len(tk.next()) == 0 {
+		return nil, false
+	}
+	start := tk.pos + 1
+	if start+n > len(tk.data) {
+		return nil, false
+	}
+	tk.pos = start + n
+	return tk.data[start:tk.pos], true
+}
+
+func isType1Space(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n' || b == '\f' || b == 0
+}
+
+func isType1HexDigit(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
+}
@@ -0,0 +1,73 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package fonts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"testing"
+)
+
+// Test the widths of a multiple master Type 1 font with two masters.  Glyph A and E get their
+// widths from the blend OtherSubrs 14 and 15, B from a subroutine, C with div and D from a sbw
+// operator blended in a subroutine.  The widths are those of the first master.
+func TestType1MultipleMasterWidths(t *testing.T) {
+	data, err := ioutil.ReadFile("../../../testfiles/mmtype1.t1")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	length1 := bytes.Index(data, []byte("eexec")) + len("eexec\n")
+
+	// Same font with the encrypted portion hex encoded, and as PFB.
+	hexData := append([]byte{}, data[:length1]...)
+	hexData = append(hexData, []byte(hex.EncodeToString(data[length1:]))...)
+	pfbData := append(pfbSegment(1, data[:length1]), pfbSegment(2, data[length1:])...)
+	pfbData = append(pfbData, 0x80, 3)
+
+	testcases := []struct {
+		Name    string
+		Data    []byte
+		Length1 int
+	}{
+		{"binary", data, length1},
+		{"hex", hexData, length1},
+		{"pfb", pfbData, 0},
+		{"wrong Length1", data, 100},
+	}
+
+	expected := map[string]float64{"space": 250, "A": 600, "B": 500, "C": 550, "D": 720, "E": 650}
+	for _, tcase := range testcases {
+		t1, err := Type1ParseBytes(tcase.Data, tcase.Length1)
+		if err != nil {
+			t.Errorf("%s: Error: %v", tcase.Name, err)
+			continue
+		}
+		if t1.FontName != "TestMM" || !t1.IsMultipleMaster {
+			t.Errorf("%s: Unexpected font %s (multiple master: %v)", tcase.Name, t1.FontName, t1.IsMultipleMaster)
+		}
+		if len(t1.Widths) != len(expected) {
+			t.Errorf("%s: %d widths, expected %d", tcase.Name, len(t1.Widths), len(expected))
+		}
+		for glyph, width := range expected {
+			if w, ok := t1.GetGlyphWidth(glyph); !ok || w != width {
+				t.Errorf("%s: Glyph %s: width %v (%v), expected %v", tcase.Name, glyph, w, ok, width)
+			}
+		}
+	}
+
+	if _, err := Type1ParseBytes(data[:200], 0); err == nil {
+		t.Errorf("Font without eexec section should fail")
+	}
+}
+
+// pfbSegment returns the PFB segment of type `kind` holding `data`.
+func pfbSegment(kind byte, data []byte) []byte {
+	header := []byte{0x80, kind, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(header[2:], uint32(len(data)))
+	return append(header, data...)
+}
@@ -0,0 +1,296 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/unidoc/unidoc/common"
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// Merge merges the interactive form `form` of another document into the AcroForm, e.g. when
+// combining the pages of two documents.  The fields of `form` are moved over (so `form` should not
+// be used afterwards):
+//   - Top level fields whose names collide with fields of the AcroForm are placed under a new
+//     non-terminal field named `namespace`, so field "name" becomes "namespace.name" and both
+//     values remain independently addressable.  The namespace must not be the name of a top
+//     level field of either form.
+//   - The default resources (DR) are combined; resources of `form` whose names are taken are added
+//     under new names, and the default appearance (DA) strings of `form` are updated accordingly.
+//   - The DA and Q defaults of `form` are set on its top level fields that have none of their own;
+//     those of the AcroForm are unchanged.
+//   - NeedAppearances is set if either form needs appearances; SigFlags are combined and the
+//     calculation orders (CO) appended.  XFA forms cannot be merged and are dropped.
+//
+// Returns a map from the fully qualified names of the renamed fields of `form` to their new names.
+// JavaScript actions referring to renamed fields are not updated.
+func (this *PdfAcroForm) Merge(form *PdfAcroForm, namespace string) (map[string]string, error) {
+	renames := map[string]string{}
+	if form == nil {
+		return renames, nil
+	}
+
+	var fields, otherFields []*PdfField
+	if this.Fields != nil {
+		fields = *this.Fields
+	}
+	if form.Fields != nil {
+		otherFields = *form.Fields
+	}
+
+	names := map[string]bool{}
+	for _, field := range fields {
+		names[field.PartialName()] = true
+	}
+	otherNames := map[string]bool{}
+	var merged, colliding []*PdfField
+	for _, field := range otherFields {
+		name := field.PartialName()
+		otherNames[name] = true
+		if name != "" && names[name] {
+			colliding = append(colliding, field)
+		} else {
+			merged = append(merged, field)
+		}
+	}
+
+	if len(colliding) > 0 {
+		if namespace == "" || strings.Contains(namespace, ".") {
+			return nil, fmt.Errorf("Invalid namespace %q for colliding field names", namespace)
+		}
+		if names[namespace] || otherNames[namespace] {
+			return nil, fmt.Errorf("Namespace %q collides with an existing field", namespace)
+		}
+		parent := NewPdfField()
+		parent.T = MakeString(namespace)
+		for _, field := range colliding {
+			for _, f := range field.AllFields() {
+				if name := f.FullName(); name != "" {
+					renames[name] = namespace + "." + name
+				}
+			}
+			field.Parent = parent
+			parent.KidsF = append(parent.KidsF, field)
+		}
+		merged = append(merged, parent)
+	}
+
+	// Default resources, renaming fonts in the default appearances of `form` if needed.
+	fontRenames := map[string]string{}
+	if form.DR != nil {
+		if this.DR == nil {
+			this.DR = form.DR
+		} else {
+			fontRenames = this.DR.merge(form.DR)
+		}
+	}
+	if len(fontRenames) > 0 {
+		if form.DA != nil {
+			form.DA = MakeString(renameDAFonts(string(*form.DA), fontRenames))
+		}
+		for _, field := range otherFields {
+			for _, f := range field.AllFields() {
+				if da, ok := TraceToDirectObject(f.DA).(*PdfObjectString); ok {
+					f.DA = MakeString(renameDAFonts(string(*da), fontRenames))
+				}
+			}
+		}
+	}
+
+	// The defaults of `form` are set on its top level fields without their own, as both DA and Q
+	// are inherited.  The defaults of the AcroForm are left unchanged.
+	for _, field := range otherFields {
+		if field.DA == nil && form.DA != nil {
+			field.DA = form.DA
+		}
+		if field.Q == nil && form.Q != nil {
+			field.Q = form.Q
+		}
+	}
+
+	if form.NeedAppearances != nil && (this.NeedAppearances == nil || bool(*form.NeedAppearances)) {
+		this.NeedAppearances = form.NeedAppearances
+	}
+	if form.SigFlags != nil {
+		flags := *form.SigFlags
+		if this.SigFlags != nil {
+			flags |= *this.SigFlags
+		}
+		this.SigFlags = MakeInteger(int64(flags))
+	}
+	if form.CO != nil {
+		co := PdfObjectArray{}
+		if this.CO != nil {
+			co = append(co, *this.CO...)
+		}
+		co = append(co, *form.CO...)
+		this.CO = &co
+	}
+	if this.XFA != nil || form.XFA != nil {
+		common.Log.Debug("XFA forms cannot be merged - dropping XFA")
+		this.XFA = nil
+	}
+
+	fields = append(fields, merged...)
+	this.Fields = &fields
+	return renames, nil
+}
+
+// merge adds the resources of `other` to the resources `r`.  Resources whose names are taken by
+// different resources are added under new names.  Returns a map of the renamed fonts.
+func (r *PdfPageResources) merge(other *PdfPageResources) map[string]string {
+	var fontRenames map[string]string
+	r.Font, fontRenames = mergeResourceDicts(r.Font, other.Font)
+	r.ExtGState, _ = mergeResourceDicts(r.ExtGState, other.ExtGState)
+	r.Pattern, _ = mergeResourceDicts(r.Pattern, other.Pattern)
+	r.Shading, _ = mergeResourceDicts(r.Shading, other.Shading)
+	r.XObject, _ = mergeResourceDicts(r.XObject, other.XObject)
+	r.Properties, _ = mergeResourceDicts(r.Properties, other.Properties)
+	if r.ProcSet == nil {
+		r.ProcSet = other.ProcSet
+	}
+
+	if other.ColorSpace != nil {
+		if r.ColorSpace == nil {
+			r.ColorSpace = other.ColorSpace
+		} else {
+			for _, name := range other.ColorSpace.Names {
+				key := name
+				if existing, has := r.ColorSpace.Colorspaces[name]; has {
+					if existing == other.ColorSpace.Colorspaces[name] {
+						continue
+					}
+					key = uniqueResourceName(name, func(s string) bool {
+						_, has := r.ColorSpace.Colorspaces[s]
+						return has
+					})
+				}
+				r.ColorSpace.Set(PdfObjectName(key), other.ColorSpace.Colorspaces[name])
+			}
+		}
+	}
+
+	return fontRenames
+}
+
+// mergeResourceDicts adds the entries of resource dictionary `src` to `dst` and returns the merged
+// dictionary and a map of the entries added under new names.
+func mergeResourceDicts(dst, src PdfObject) (PdfObject, map[string]string) {
+	renames := map[string]string{}
+	if src == nil {
+		return dst, renames
+	}
+	if dst == nil {
+		return src, renames
+	}
+	dstDict, ok := TraceToDirectObject(dst).(*PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("ERROR: Resource not a dictionary (%T)", dst)
+		return dst, renames
+	}
+	srcDict, ok := TraceToDirectObject(src).(*PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("ERROR: Resource not a dictionary (%T)", src)
+		return dst, renames
+	}
+
+	for _, key := range srcDict.Keys() {
+		val := srcDict.Get(key)
+		if existing := dstDict.Get(key); existing != nil {
+			if existing == val || TraceToDirectObject(existing) == TraceToDirectObject(val) {
+				continue
+			}
+			newKey := uniqueResourceName(string(key), func(s string) bool {
+				return dstDict.Get(PdfObjectName(s)) != nil
+			})
+			renames[string(key)] = newKey
+			key = PdfObjectName(newKey)
+		}
+		dstDict.Set(key, val)
+	}
+	return dst, renames
+}
+
+// uniqueResourceName returns `name` with the lowest numeric suffix for which `taken` is false.
+func uniqueResourceName(name string, taken func(string) bool) string {
+	for i := 1; ; i++ {
+		s := fmt.Sprintf("%s_%d", name, i)
+		if !taken(s) {
+			return s
+		}
+	}
+}
+
+// reDAFont matches the font operand and size of the Tf operator in a default appearance string.
+var reDAFont = regexp.MustCompile(`/([^\s/()<>\[\]{}%]+)(\s+[-+.0-9]+\s+Tf)`)
+
+// renameDAFonts returns the default appearance string `da` with the fonts renamed per `renames`.
+func renameDAFonts(da string, renames map[string]string) string {
+	return reDAFont.ReplaceAllStringFunc(da, func(s string) string {
+		m := reDAFont.FindStringSubmatch(s)
+		if newName, has := renames[m[1]]; has {
+			return "/" + newName + m[2]
+		}
+		return s
+	})
+}
+
+// PartialName returns the partial field name (T) of the field, or "" if it has none.
+func (this *PdfField) PartialName() string {
+	if s, ok := TraceToDirectObject(this.T).(*PdfObjectString); ok {
+		return string(*s)
+	}
+	return ""
+}
+
+// FullName returns the fully qualified name of the field, i.e. the partial names of the field and
+// its ancestors separated by periods (12.7.3.2 "Field Names").
+func (this *PdfField) FullName() string {
+	var parts []string
+	for field := this; field != nil; field = field.Parent {
+		if name := field.PartialName(); name != "" {
+			parts = append([]string{name}, parts...)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// AllFields returns the field and all its descendant fields, parents before their kids.
+func (this *PdfField) AllFields() []*PdfField {
+	fields := []*PdfField{this}
+	for _, kid := range this.KidsF {
+		if field, ok := kid.(*PdfField); ok {
+			fields = append(fields, field.AllFields()...)
+		}
+	}
+	return fields
+}
+
+// AllFields returns all fields of the AcroForm including non-terminal fields, parents before their
+// kids.
+func (this *PdfAcroForm) AllFields() []*PdfField {
+	var fields []*PdfField
+	if this.Fields != nil {
+		for _, field := range *this.Fields {
+			fields = append(fields, field.AllFields()...)
+		}
+	}
+	return fields
+}
+
+// GetFieldByName returns the field with the fully qualified name `name`.  The bool return flag is
+// false if there is no such field.
+func (this *PdfAcroForm) GetFieldByName(name string) (*PdfField, bool) {
+	for _, field := range this.AllFields() {
+		if field.FullName() == name {
+			return field, true
+		}
+	}
+	return nil, false
+}
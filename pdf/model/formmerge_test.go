@@ -0,0 +1,229 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// makeFormTestPdf returns a single page PDF with a form with a filled text field "name" with a
+// widget annotation, and a field "address" with a kid "city".
+func makeFormTestPdf(t *testing.T, name, city string) []byte {
+	font := MakeDict()
+	font.Set("Type", MakeName("Font"))
+	font.Set("Subtype", MakeName("Type1"))
+	font.Set("BaseFont", MakeName("Helvetica"))
+	fonts := MakeDict()
+	fonts.Set("Helv", MakeIndirectObject(font))
+
+	form := NewPdfAcroForm()
+	form.DR = NewPdfPageResources()
+	form.DR.Font = fonts
+	form.DA = MakeString("/Helv 0 Tf 0 g")
+	form.NeedAppearances = MakeBool(false)
+
+	widget := NewPdfAnnotationWidget()
+	widget.Rect = MakeArrayFromFloats([]float64{100, 100, 300, 120})
+	field := NewPdfField()
+	field.FT = MakeName("Tx")
+	field.T = MakeString("name")
+	field.V = MakeString(name)
+	field.KidsA = []*PdfAnnotation{widget.PdfAnnotation}
+	widget.Parent = field.GetContainingPdfObject()
+
+	address := NewPdfField()
+	address.T = MakeString("address")
+	cityField := NewPdfField()
+	cityField.FT = MakeName("Tx")
+	cityField.T = MakeString("city")
+	cityField.V = MakeString(city)
+	cityField.Parent = address
+	address.KidsF = []PdfModel{cityField}
+	form.Fields = &[]*PdfField{field, address}
+
+	w := NewPdfWriter()
+	page := NewPdfPage()
+	page.Resources = NewPdfPageResources()
+	page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+	page.Annotations = []*PdfAnnotation{widget.PdfAnnotation}
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := w.SetForms(form); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return data
+}
+
+// Test merging the filled forms of two documents with the same field names.
+func TestAcroFormMerge(t *testing.T) {
+	var readers []*PdfReader
+	for _, values := range [][2]string{{"Alice", "Oslo"}, {"Bob", "Lima"}} {
+		reader, err := NewPdfReader(bytes.NewReader(makeFormTestPdf(t, values[0], values[1])))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		readers = append(readers, reader)
+	}
+
+	form, other := readers[0].AcroForm, readers[1].AcroForm
+	if form == nil || other == nil {
+		t.Fatalf("Forms not loaded")
+	}
+	other.NeedAppearances = MakeBool(true)
+	other.DA = MakeString("/Helv 10 Tf 1 0 0 rg")
+
+	if _, err := form.Merge(other, ""); err == nil {
+		t.Fatalf("Colliding names merged without namespace")
+	}
+	// The namespace must not be taken by a top level field of the incoming form either.
+	extra := NewPdfField()
+	extra.T = MakeString("doc2")
+	*other.Fields = append(*other.Fields, extra)
+	if _, err := form.Merge(other, "doc2"); err == nil {
+		t.Fatalf("Namespace colliding with an incoming field accepted")
+	}
+	*other.Fields = (*other.Fields)[:len(*other.Fields)-1]
+	renames, err := form.Merge(other, "doc2")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expectedRenames := map[string]string{
+		"name":         "doc2.name",
+		"address":      "doc2.address",
+		"address.city": "doc2.address.city",
+	}
+	if len(renames) != len(expectedRenames) {
+		t.Errorf("Unexpected renames: %v", renames)
+	}
+	for name, newName := range expectedRenames {
+		if renames[name] != newName {
+			t.Errorf("%s renamed to %q, expected %q", name, renames[name], newName)
+		}
+	}
+
+	w := NewPdfWriter()
+	for _, reader := range readers {
+		page, err := reader.GetPage(1)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := w.AddPage(page); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if err := w.SetForms(form); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	merged := reader.AcroForm
+	if merged == nil {
+		t.Fatalf("Merged form not loaded")
+	}
+	if merged.NeedAppearances == nil || !bool(*merged.NeedAppearances) {
+		t.Errorf("NeedAppearances not set")
+	}
+	if merged.DA == nil || string(*merged.DA) != "/Helv 0 Tf 0 g" {
+		t.Errorf("Unexpected DA: %v", merged.DA)
+	}
+
+	values := map[string]string{
+		"name":              "Alice",
+		"address.city":      "Oslo",
+		"doc2.name":         "Bob",
+		"doc2.address.city": "Lima",
+	}
+	for name, value := range values {
+		field, found := merged.GetFieldByName(name)
+		if !found {
+			t.Errorf("Field %s not found", name)
+			continue
+		}
+		if v, ok := TraceToDirectObject(field.V).(*PdfObjectString); !ok || string(*v) != value {
+			t.Errorf("%s: unexpected value %v", name, field.V)
+		}
+	}
+
+	// The fields of the second form keep its default appearance, with its font renamed as distinct
+	// fonts of the same name are both kept in the default resources.
+	field, _ := merged.GetFieldByName("doc2.name")
+	if da, ok := TraceToDirectObject(field.DA).(*PdfObjectString); !ok || string(*da) != "/Helv_1 10 Tf 1 0 0 rg" {
+		t.Errorf("Unexpected DA of doc2.name: %v", field.DA)
+	}
+	fonts, ok := TraceToDirectObject(merged.DR.Font).(*PdfObjectDictionary)
+	if !ok || fonts.Get("Helv") == nil || fonts.Get("Helv_1") == nil {
+		t.Fatalf("Unexpected DR fonts: %v", merged.DR.Font)
+	}
+}
+
+// Test that merging a form into one without DA and Q sets the defaults of the incoming form on its
+// top level fields, leaving those of the AcroForm unset.
+func TestAcroFormMergeDefaults(t *testing.T) {
+	form := NewPdfAcroForm()
+	own := NewPdfField()
+	own.T = MakeString("own")
+	form.Fields = &[]*PdfField{own}
+
+	other := NewPdfAcroForm()
+	other.DA = MakeString("/Helv 10 Tf 0 g")
+	other.Q = MakeInteger(1)
+	plain := NewPdfField()
+	plain.T = MakeString("plain")
+	styled := NewPdfField()
+	styled.T = MakeString("styled")
+	styled.DA = MakeString("/Cour 8 Tf 0 g")
+	styled.Q = MakeInteger(2)
+	other.Fields = &[]*PdfField{plain, styled}
+
+	if _, err := form.Merge(other, ""); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if form.DA != nil || form.Q != nil {
+		t.Errorf("AcroForm defaults changed: DA %v, Q %v", form.DA, form.Q)
+	}
+	if own.DA != nil || own.Q != nil {
+		t.Errorf("Defaults set on a field of the AcroForm: DA %v, Q %v", own.DA, own.Q)
+	}
+	if plain.DA != other.DA || plain.Q != other.Q {
+		t.Errorf("Defaults not set on plain: DA %v, Q %v", plain.DA, plain.Q)
+	}
+	if da, ok := styled.DA.(*PdfObjectString); !ok || string(*da) != "/Cour 8 Tf 0 g" {
+		t.Errorf("DA of styled replaced by %v", styled.DA)
+	}
+	if q, ok := styled.Q.(*PdfObjectInteger); !ok || *q != 2 {
+		t.Errorf("Q of styled replaced by %v", styled.Q)
+	}
+}
+
+func TestRenameDAFonts(t *testing.T) {
+	renames := map[string]string{"Helv": "Helv_1"}
+	testcases := map[string]string{
+		"/Helv 0 Tf 0 g":       "/Helv_1 0 Tf 0 g",
+		"0 g /Helv 12.5 Tf":    "0 g /Helv_1 12.5 Tf",
+		"/HelvBold 9 Tf":       "/HelvBold 9 Tf",
+		"/Cour 10 Tf /Helv cs": "/Cour 10 Tf /Helv cs",
+	}
+	for da, expected := range testcases {
+		if s := renameDAFonts(da, renames); s != expected {
+			t.Errorf("%q: %q != %q", da, s, expected)
+		}
+	}
+}
@@ -96,6 +96,16 @@ func interpolate(x, xmin, xmax, ymin, ymax float64) float64 {
 	return y
 }
 
+// clipToRange clips the outputs `y` of a function to its Range (2*n values), if specified.
+func clipToRange(y []float64, rang []float64) []float64 {
+	for j := range y {
+		if 2*j+1 < len(rang) {
+			y[j] = math.Min(math.Max(y[j], rang[2*j]), rang[2*j+1])
+		}
+	}
+	return y
+}
+
 //
 // Type 0 functions use a sequence of sample values (contained in a stream) to provide an approximation
 // for functions whose domains and ranges are bounded. The samples are organized as an m-dimensional
@@ -302,51 +312,60 @@ func (this *PdfFunctionType0) Evaluate(x []float64) ([]float64, error) {
 		decode = this.Range
 	}
 
-	indices := []int{}
-	// Start with nearest neighbour interpolation.
+	// Encode each input into a real-valued coordinate of the sample table (7.10.2).
+	coords := make([]float64, this.NumInputs)
 	for i := 0; i < len(x); i++ {
-		xi := x[i]
-
-		xip := math.Min(math.Max(xi, this.Domain[2*i]), this.Domain[2*i+1])
-
+		xip := math.Min(math.Max(x[i], this.Domain[2*i]), this.Domain[2*i+1])
 		ei := interpolate(xip, this.Domain[2*i], this.Domain[2*i+1], encode[2*i], encode[2*i+1])
-		eip := math.Min(math.Max(ei, 0), float64(this.Size[i]))
-		// eip represents coordinate into the data table.
-		// At this point it is real values.
-
-		// Interpolation shall be used to to determine output values
-		// from the nearest surrounding values in the sample table.
-
-		// Initial implementation is simply nearest neighbour.
-		// Then will add the linear and possibly bicubic/spline.
-		index := int(math.Floor(eip + 0.5))
-		if index < 0 {
-			index = 0
-		} else if index > this.Size[i] {
-			index = this.Size[i] - 1
-		}
-		indices = append(indices, index)
-
+		coords[i] = math.Min(math.Max(ei, 0), float64(this.Size[i]-1))
 	}
 
-	// Calculate the index
-	m := indices[0]
-	for i := 1; i < this.NumInputs; i++ {
-		add := indices[i]
-		for j := 0; j < i; j++ {
-			add *= this.Size[j]
-		}
-		m += add
+	// Multilinear interpolation between the 2^m surrounding samples.  Cubic spline interpolation
+	// (Order 3) is approximated by linear interpolation.
+	numSamples := 1
+	for _, size := range this.Size {
+		numSamples *= size
+	}
+	if len(this.data) < numSamples*this.NumOutputs {
+		common.Log.Debug("ERROR: Type 0 function has %d samples, %d needed", len(this.data), numSamples*this.NumOutputs)
+		return nil, errors.New("Range check error")
 	}
-	m *= this.NumOutputs
 
-	// Output values.
-	outputs := []float64{}
+	sampleMax := math.Pow(2, float64(this.BitsPerSample)) - 1
+	outputs := make([]float64, this.NumOutputs)
+	for corner := 0; corner < 1<<uint(this.NumInputs); corner++ {
+		weight := 1.0
+		m := 0
+		stride := 1
+		for i := 0; i < this.NumInputs; i++ {
+			e0 := math.Floor(coords[i])
+			frac := coords[i] - e0
+			idx := int(e0)
+			if corner&(1<<uint(i)) != 0 {
+				if frac == 0 {
+					weight = 0
+					break
+				}
+				idx++
+				weight *= frac
+			} else {
+				weight *= 1 - frac
+			}
+			m += idx * stride
+			stride *= this.Size[i]
+		}
+		if weight == 0 {
+			continue
+		}
+		for j := 0; j < this.NumOutputs; j++ {
+			outputs[j] += weight * float64(this.data[m*this.NumOutputs+j])
+		}
+	}
+
+	// Decode the interpolated samples into the output range.
 	for j := 0; j < this.NumOutputs; j++ {
-		rj := this.data[m+j]
-		rjp := interpolate(float64(rj), 0, math.Pow(2, float64(this.BitsPerSample)), decode[2*j], decode[2*j+1])
-		yj := math.Min(math.Max(rjp, this.Range[2*j]), this.Range[2*j+1])
-		outputs = append(outputs, yj)
+		rjp := interpolate(outputs[j], 0, sampleMax, decode[2*j], decode[2*j+1])
+		outputs[j] = math.Min(math.Max(rjp, this.Range[2*j]), this.Range[2*j+1])
 	}
 
 	return outputs, nil
@@ -536,13 +555,18 @@ func (this *PdfFunctionType2) Evaluate(x []float64) ([]float64, error) {
 		c1 = this.C1
 	}
 
+	x0 := x[0]
+	if len(this.Domain) >= 2 {
+		x0 = math.Min(math.Max(x0, this.Domain[0]), this.Domain[1])
+	}
+
 	y := []float64{}
 	for i := 0; i < len(c0); i++ {
-		yi := c0[i] + math.Pow(x[0], this.N)*(c1[i]-c0[i])
+		yi := c0[i] + math.Pow(x0, this.N)*(c1[i]-c0[i])
 		y = append(y, yi)
 	}
 
-	return y, nil
+	return clipToRange(y, this.Range), nil
 }
 
 //
@@ -566,11 +590,29 @@ func (this *PdfFunctionType3) Evaluate(x []float64) ([]float64, error) {
 		return nil, errors.New("Range check")
 	}
 
-	// Determine which function to use
-
-	// Encode
+	// Determine which function to use: function i applies to the subdomain [Bounds[i-1], Bounds[i])
+	// with Domain[0] and Domain[1] as outer bounds.  The last subdomain includes Domain[1].
+	x0 := math.Min(math.Max(x[0], this.Domain[0]), this.Domain[1])
+	k := len(this.Functions)
+	i := 0
+	for i < k-1 && x0 >= this.Bounds[i] {
+		i++
+	}
+	low, high := this.Domain[0], this.Domain[1]
+	if i > 0 {
+		low = this.Bounds[i-1]
+	}
+	if i < k-1 {
+		high = this.Bounds[i]
+	}
 
-	return nil, errors.New("Not implemented yet")
+	// Encode the input into the domain of the subfunction.
+	xi := interpolate(x0, low, high, this.Encode[2*i], this.Encode[2*i+1])
+	y, err := this.Functions[i].Evaluate([]float64{xi})
+	if err != nil {
+		return nil, err
+	}
+	return clipToRange(y, this.Range), nil
 }
 
 func newPdfFunctionType3FromPdfObject(obj PdfObject) (*PdfFunctionType3, error) {
@@ -747,7 +789,10 @@ func (this *PdfFunctionType4) Evaluate(xVec []float64) ([]float64, error) {
 	}
 
 	inputs := []ps.PSObject{}
-	for _, val := range xVec {
+	for i, val := range xVec {
+		if 2*i+1 < len(this.Domain) {
+			val = math.Min(math.Max(val, this.Domain[2*i]), this.Domain[2*i+1])
+		}
 		inputs = append(inputs, ps.MakeReal(val))
 	}
 
@@ -763,7 +808,7 @@ func (this *PdfFunctionType4) Evaluate(xVec []float64) ([]float64, error) {
 		return nil, err
 	}
 
-	return yVec, nil
+	return clipToRange(yVec, this.Range), nil
 }
 
 // Load a type 4 function from a PDF stream object.
@@ -1,6 +1,4 @@
 // Test functions
-// XXX: We need tests of type 0, type 2, type 3, type 4 functions.  Particularly type 0 is complex and
-// needs comprehensive tests.
 
 package model
 
@@ -101,3 +99,166 @@ endobj
 
 	fmt.Printf("%s", stream.Stream)
 }
+
+type functionTestCase struct {
+	Inputs   []float64
+	Expected []float64
+}
+
+// checkFunction evaluates `fun` for the inputs of `testcases` and compares with the expected outputs.
+func checkFunction(t *testing.T, name string, fun PdfFunction, testcases []functionTestCase) {
+	for _, tc := range testcases {
+		outputs, err := fun.Evaluate(tc.Inputs)
+		if err != nil {
+			t.Errorf("%s %v: error %v", name, tc.Inputs, err)
+			continue
+		}
+		if len(outputs) != len(tc.Expected) {
+			t.Errorf("%s %v: %v != %v", name, tc.Inputs, outputs, tc.Expected)
+			continue
+		}
+		for i := range outputs {
+			if math.Abs(outputs[i]-tc.Expected[i]) > 0.0001 {
+				t.Errorf("%s %v: %v != %v", name, tc.Inputs, outputs, tc.Expected)
+				break
+			}
+		}
+	}
+}
+
+// Test sampled functions with linear interpolation between the samples.
+func TestType0Function(t *testing.T) {
+	obj, err := NewParserFromString(`
+1 0 obj
+<< /FunctionType 0 /Domain [0 1] /Range [0 1] /Size [3] /BitsPerSample 8
+   /Filter /ASCIIHexDecode /Length 7 >>
+stream
+00FF80>
+endstream
+endobj
+`).ParseIndirectObject()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	fun, err := newPdfFunctionFromPdfObject(obj)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkFunction(t, "1-in", fun, []functionTestCase{
+		{[]float64{0}, []float64{0}},
+		{[]float64{0.25}, []float64{0.5}},
+		{[]float64{0.5}, []float64{1}},
+		{[]float64{0.75}, []float64{383.0 / 510}},
+		{[]float64{1}, []float64{128.0 / 255}},
+		{[]float64{-1}, []float64{0}},
+	})
+
+	// Two inputs, two outputs, with Encode and Decode: bilinear interpolation of
+	// (x, y) -> (x xor y, x and y) at the corners, outputs decoded to [0 10] and [1 0].
+	obj, err = NewParserFromString(`
+2 0 obj
+<< /FunctionType 0 /Domain [0 2 0 1] /Range [0 10 0 1] /Size [2 2] /BitsPerSample 4
+   /Encode [0 1 0 1] /Decode [0 10 1 0] /Filter /ASCIIHexDecode /Length 9 >>
+stream
+00F0F00F>
+endstream
+endobj
+`).ParseIndirectObject()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	fun, err = newPdfFunctionFromPdfObject(obj)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkFunction(t, "2-in", fun, []functionTestCase{
+		{[]float64{0, 0}, []float64{0, 1}},
+		{[]float64{2, 0}, []float64{10, 1}},
+		{[]float64{0, 1}, []float64{10, 1}},
+		{[]float64{2, 1}, []float64{0, 0}},
+		{[]float64{1, 0.5}, []float64{5, 0.75}},
+		{[]float64{0.5, 0}, []float64{2.5, 1}},
+	})
+}
+
+// Test exponential interpolation functions, including clipping to Domain and Range.
+func TestType2Function(t *testing.T) {
+	dict := MakeDict()
+	dict.Set("FunctionType", MakeInteger(2))
+	dict.Set("Domain", MakeArrayFromFloats([]float64{0, 1}))
+	dict.Set("Range", MakeArrayFromFloats([]float64{0, 1, 0, 0.8}))
+	dict.Set("C0", MakeArrayFromFloats([]float64{0, 0.5}))
+	dict.Set("C1", MakeArrayFromFloats([]float64{1, 1}))
+	dict.Set("N", MakeInteger(2))
+	fun, err := newPdfFunctionFromPdfObject(dict)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkFunction(t, "Type 2", fun, []functionTestCase{
+		{[]float64{0}, []float64{0, 0.5}},
+		{[]float64{0.5}, []float64{0.25, 0.625}},
+		{[]float64{2}, []float64{1, 0.8}},
+	})
+}
+
+// Test stitching functions, with the subdomains mapped by Encode.
+func TestType3Function(t *testing.T) {
+	linear := func(c0, c1 float64) *PdfObjectDictionary {
+		dict := MakeDict()
+		dict.Set("FunctionType", MakeInteger(2))
+		dict.Set("Domain", MakeArrayFromFloats([]float64{0, 1}))
+		dict.Set("C0", MakeArrayFromFloats([]float64{c0}))
+		dict.Set("C1", MakeArrayFromFloats([]float64{c1}))
+		dict.Set("N", MakeInteger(1))
+		return dict
+	}
+	dict := MakeDict()
+	dict.Set("FunctionType", MakeInteger(3))
+	dict.Set("Domain", MakeArrayFromFloats([]float64{0, 1}))
+	dict.Set("Functions", MakeArray(linear(0, 1), linear(0, 1), linear(5, 6)))
+	dict.Set("Bounds", MakeArrayFromFloats([]float64{0.5, 0.75}))
+	dict.Set("Encode", MakeArrayFromFloats([]float64{0, 1, 1, 0, 0, 1}))
+	fun, err := newPdfFunctionFromPdfObject(dict)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkFunction(t, "Type 3", fun, []functionTestCase{
+		{[]float64{0}, []float64{0}},
+		{[]float64{0.25}, []float64{0.5}},
+		{[]float64{0.5}, []float64{1}},
+		{[]float64{0.625}, []float64{0.5}},
+		{[]float64{0.75}, []float64{5}},
+		{[]float64{1}, []float64{6}},
+		{[]float64{-3}, []float64{0}},
+	})
+}
+
+// Test PostScript calculator functions with conditionals, stack and boolean operators, and clipping
+// of the inputs and outputs to Domain and Range.
+func TestType4FunctionOperators(t *testing.T) {
+	obj, err := NewParserFromString(`
+3 0 obj
+<< /FunctionType 4 /Domain [0 1 0 1] /Range [0 1 -1 1 0 10] /Length 117 >>
+stream
+{ 2 copy gt { exch } if
+  1 index 1 index sub exch 2 index add
+  2 index 0.5 ge not { pop 1 index 10 mul 3 add } if
+}
+endstream
+endobj
+`).ParseIndirectObject()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	fun, err := newPdfFunctionFromPdfObject(obj)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// Sorted inputs a <= b -> (a, a - b, a + b if a >= 0.5, else 10a + 3).
+	checkFunction(t, "Type 4", fun, []functionTestCase{
+		{[]float64{0.2, 0.1}, []float64{0.1, -0.1, 4}},
+		{[]float64{0.5, 0.75}, []float64{0.5, -0.25, 1.25}},
+		{[]float64{1.5, 0.6}, []float64{0.6, -0.4, 1.6}},
+		{[]float64{0, 0.9}, []float64{0, -0.9, 3}},
+	})
+}
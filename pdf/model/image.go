@@ -11,11 +11,11 @@ import (
 	gocolor "image/color"
 	"image/draw"
 	_ "image/gif"
-	_ "image/png"
+	"image/png"
 	"io"
+	"math"
 
 	"github.com/unidoc/unidoc/common"
-	. "github.com/unidoc/unidoc/pdf/core"
 	"github.com/unidoc/unidoc/pdf/model/sampling"
 )
 
@@ -33,6 +33,10 @@ type Image struct {
 	alphaData []byte // Alpha channel data.
 	hasAlpha  bool   // Indicates whether the alpha channel data is available.
 
+	// Matte color the color samples are premultiplied with by the alpha channel (the Matte entry of
+	// a soft mask), one value per color component, or nil if not premultiplied.
+	matte []float64
+
 	decode []float64 // [Dmin Dmax ... values for each color component]
 }
 
@@ -47,8 +51,31 @@ func (this Image) AlphaMap(mapFunc AlphaMapFunc) {
 }
 
 // Convert the raw byte slice into samples which are stored in a uint32 bit array.
-// Each sample is represented by BitsPerComponent consecutive bits in the raw data.
+// Each sample is represented by BitsPerComponent consecutive bits in the raw data.  Rows are padded
+// to full bytes, the padding bits are not included in the samples.
 func (this *Image) GetSamples() []uint32 {
+	samplesPerRow := int(this.Width) * this.ColorComponents
+	bitsPerRow := samplesPerRow * int(this.BitsPerComponent)
+	if bitsPerRow%8 != 0 && this.Height > 1 {
+		bytesPerRow := (bitsPerRow + 7) / 8
+		samples := make([]uint32, 0, samplesPerRow*int(this.Height))
+		for i := 0; i < int(this.Height) && i*bytesPerRow < len(this.Data); i++ {
+			end := (i + 1) * bytesPerRow
+			if end > len(this.Data) {
+				end = len(this.Data)
+			}
+			rowSamples := sampling.ResampleBytes(this.Data[i*bytesPerRow:end], int(this.BitsPerComponent))
+			if len(rowSamples) > samplesPerRow {
+				rowSamples = rowSamples[:samplesPerRow]
+			}
+			samples = append(samples, rowSamples...)
+		}
+		if len(samples) < samplesPerRow*int(this.Height) {
+			common.Log.Debug("Error: Too few samples (got %d, expecting %d)", len(samples), samplesPerRow*int(this.Height))
+		}
+		return samples
+	}
+
 	samples := sampling.ResampleBytes(this.Data, int(this.BitsPerComponent))
 
 	expectedLen := int(this.Width) * int(this.Height) * this.ColorComponents
@@ -57,6 +84,12 @@ func (this *Image) GetSamples() []uint32 {
 		common.Log.Debug("Error: Too few samples (got %d, expecting %d)", len(samples), expectedLen)
 		return samples
 	} else if len(samples) > expectedLen {
+		// Rows are padded to full bytes, anything beyond that is trailing data.
+		expectedBytes := (bitsPerRow + 7) / 8 * int(this.Height)
+		if len(this.Data) > expectedBytes {
+			common.Log.Warning("Image data longer than expected (%d > %d bytes) - ignoring trailing data",
+				len(this.Data), expectedBytes)
+		}
 		samples = samples[:expectedLen]
 	}
 	return samples
@@ -112,6 +145,13 @@ func (this *Image) Resample(targetBitsPerComponent int64) {
 		return
 	}
 
+	if this.Width <= 0 || this.Height <= 0 {
+		// Zero-area image, nothing to resample.
+		this.Data = []byte{}
+		this.BitsPerComponent = int64(targetBitsPerComponent)
+		return
+	}
+
 	// Write out row by row...
 	data := []byte{}
 	for i := int64(0); i < this.Height; i++ {
@@ -128,91 +168,276 @@ func (this *Image) Resample(targetBitsPerComponent int64) {
 	this.BitsPerComponent = int64(targetBitsPerComponent)
 }
 
-// Converts the unidoc Image to a golang Image structure.
+// ToGoImage converts the image to a Go image.  The samples are interpreted with the Decode array of
+// the image: 1 color component as gray (Gray, or Gray16 for 16 bits per component), 3 components as
+// RGB (RGBA, or RGBA64 for 16 bits per component) and 4 components as CMYK, converted to RGB (NRGBA,
+// or NRGBA64 for 16 bits per component).  Note that CMYK images used to be returned as CMYK images
+// of the raw samples, ignoring Decode.  Images with alpha data get an alpha channel, giving
+// non-premultiplied NRGBA or NRGBA64 images whatever the color components.  Colors premultiplied
+// with a matte color, such as the data of Go images with alpha, are un-premultiplied.
+//
+// Other color spaces need to be converted first, see XObjectImage.ToGoImage.
 func (this *Image) ToGoImage() (goimage.Image, error) {
-	common.Log.Trace("Converting to go image")
-	bounds := goimage.Rect(0, 0, int(this.Width), int(this.Height))
-	var img DrawableImage
-
-	if this.ColorComponents == 1 {
-		if this.BitsPerComponent == 16 {
-			img = goimage.NewGray16(bounds)
-		} else {
-			img = goimage.NewGray(bounds)
+	var alpha *Image
+	if this.alphaData != nil {
+		alpha = &Image{
+			Width:            this.Width,
+			Height:           this.Height,
+			BitsPerComponent: this.BitsPerComponent,
+			ColorComponents:  1,
+			Data:             this.alphaData,
 		}
-	} else if this.ColorComponents == 3 {
-		if this.BitsPerComponent == 16 {
-			img = goimage.NewRGBA64(bounds)
-		} else {
-			img = goimage.NewRGBA(bounds)
+	}
+	return this.toGoImage(alpha)
+}
+
+// WritePNG writes the image to `w` in PNG format, as converted by ToGoImage.
+func (this *Image) WritePNG(w io.Writer) error {
+	goimg, err := this.ToGoImage()
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, goimg)
+}
+
+// SamplesToGoImage returns the Go image of decoded image samples `data` of `width` x `height`
+// pixels with `colorComponents` components of `bitsPerComponent` bits, rows padded to full bytes,
+// e.g. the data decoded by DCTDecode or FlateDecode.  The samples are mapped by the Decode array
+// `decode` (nil for the default) and converted as by Image.ToGoImage, e.g. to an RGBA image for 3
+// components of 8 bits.  If `palette` is not nil, the image is a Paletted image whose indices are
+// the samples of a single component of up to 8 bits, to which `decode` does not apply; indices
+// beyond the palette are clipped.  Returns an error for other numbers of components or bits, or if
+// `data` is short.
+func SamplesToGoImage(data []byte, width, height, colorComponents, bitsPerComponent int, decode []float64,
+	palette gocolor.Palette) (goimage.Image, error) {
+	n, bpc := colorComponents, bitsPerComponent
+	if n != 1 && n != 3 && n != 4 {
+		return nil, errors.New("Unsupported colors")
+	}
+	if bpc != 1 && bpc != 2 && bpc != 4 && bpc != 8 && bpc != 16 {
+		return nil, errors.New("Unsupported bits per component")
+	}
+	if decode != nil && len(decode) != 2*n {
+		return nil, errors.New("Invalid Decode array")
+	}
+	if palette != nil && (n != 1 || bpc == 16 || len(palette) == 0) {
+		return nil, errors.New("Invalid palette")
+	}
+	if width <= 0 || height <= 0 {
+		return nil, errors.New("Invalid image size")
+	}
+	bytesPerRow := (int64(width)*int64(n)*int64(bpc) + 7) / 8
+	if int64(height) > int64(len(data))/bytesPerRow {
+		return nil, errors.New("Image data too short")
+	}
+
+	img := &Image{
+		Width:            int64(width),
+		Height:           int64(height),
+		BitsPerComponent: int64(bpc),
+		ColorComponents:  n,
+		Data:             data,
+		decode:           decode,
+	}
+	if palette == nil {
+		return img.ToGoImage()
+	}
+
+	img.decode = nil
+	component, err := img.componentReader()
+	if err != nil {
+		return nil, err
+	}
+	maxVal := float64(uint32(1)<<uint(bpc) - 1)
+	paletted := goimage.NewPaletted(goimage.Rect(0, 0, width, height), palette)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			index := int(component(x, y, 0)*maxVal + 0.5)
+			if index >= len(palette) {
+				index = len(palette) - 1
+			}
+			paletted.SetColorIndex(x, y, uint8(index))
 		}
-	} else if this.ColorComponents == 4 {
-		img = goimage.NewCMYK(bounds)
-	} else {
-		// XXX? Force RGB convert?
-		common.Log.Debug("Unsupported number of colors components per sample: %d", this.ColorComponents)
+	}
+	return paletted, nil
+}
+
+// toGoImage converts the image to a Go image as ToGoImage, with the alpha channel given by the
+// single component image `alpha` (nil if opaque).  The alpha image is scaled to the size of the
+// image if needed (nearest neighbor), as a soft mask can have a different resolution.
+func (this *Image) toGoImage(alpha *Image) (goimage.Image, error) {
+	n := this.ColorComponents
+	if n != 1 && n != 3 && n != 4 {
+		common.Log.Debug("Unsupported number of colors components per sample: %d", n)
 		return nil, errors.New("Unsupported colors")
 	}
+	width, height := int(this.Width), int(this.Height)
+	if width < 0 || height < 0 {
+		return nil, errors.New("Invalid image size")
+	}
+	component, err := this.componentReader()
+	if err != nil {
+		return nil, err
+	}
 
-	// Draw the data on the image..
-	x := 0
-	y := 0
-	aidx := 0
+	alphaAt := func(x, y int) float64 { return 1 }
+	sixteen := this.BitsPerComponent == 16
+	if alpha != nil {
+		alphaComponent, err := alpha.componentReader()
+		if err != nil {
+			return nil, err
+		}
+		aw, ah := int(alpha.Width), int(alpha.Height)
+		if aw <= 0 || ah <= 0 {
+			return nil, errors.New("Invalid alpha size")
+		}
+		alphaAt = func(x, y int) float64 {
+			return alphaComponent(x*aw/width, y*ah/height, 0)
+		}
+		sixteen = sixteen || alpha.BitsPerComponent == 16
 
-	samples := this.GetSamples()
-	//bytesPerColor := colorComponents * int(this.BitsPerComponent) / 8
-	bytesPerColor := this.ColorComponents
-	for i := 0; i+bytesPerColor-1 < len(samples); i += bytesPerColor {
-		var c gocolor.Color
-		if this.ColorComponents == 1 {
-			if this.BitsPerComponent == 16 {
-				val := uint16(samples[i])<<8 | uint16(samples[i+1])
-				c = gocolor.Gray16{val}
-			} else {
-				val := uint8(samples[i] & 0xff)
-				c = gocolor.Gray{val}
+		if len(this.matte) == n {
+			premultiplied := component
+			component = func(x, y, c int) float64 {
+				return unpremultiply(premultiplied(x, y, c), alphaAt(x, y), this.matte[c])
 			}
-		} else if this.ColorComponents == 3 {
-			if this.BitsPerComponent == 16 {
-				r := uint16(samples[i])<<8 | uint16(samples[i+1])
-				g := uint16(samples[i+2])<<8 | uint16(samples[i+3])
-				b := uint16(samples[i+4])<<8 | uint16(samples[i+5])
-				a := uint16(0xffff) // Default: solid (0xffff) whereas transparent=0.
-				if this.alphaData != nil && len(this.alphaData) > aidx+1 {
-					a = (uint16(this.alphaData[aidx]) << 8) | uint16(this.alphaData[aidx+1])
-					aidx += 2
+		}
+	}
+
+	bounds := goimage.Rect(0, 0, width, height)
+	if n == 1 && alpha == nil {
+		if sixteen {
+			img := goimage.NewGray16(bounds)
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					img.SetGray16(x, y, gocolor.Gray16{Y: to16Bit(component(x, y, 0))})
 				}
-				c = gocolor.RGBA64{R: r, G: g, B: b, A: a}
-			} else {
-				r := uint8(samples[i] & 0xff)
-				g := uint8(samples[i+1] & 0xff)
-				b := uint8(samples[i+2] & 0xff)
-				a := uint8(0xff) // Default: solid (0xff) whereas transparent=0.
-				if this.alphaData != nil && len(this.alphaData) > aidx {
-					a = uint8(this.alphaData[aidx])
-					aidx++
+			}
+			return img, nil
+		}
+		img := goimage.NewGray(bounds)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				img.SetGray(x, y, gocolor.Gray{Y: to8Bit(component(x, y, 0))})
+			}
+		}
+		return img, nil
+	}
+
+	if n == 3 && alpha == nil {
+		if sixteen {
+			img := goimage.NewRGBA64(bounds)
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					img.SetRGBA64(x, y, gocolor.RGBA64{R: to16Bit(component(x, y, 0)),
+						G: to16Bit(component(x, y, 1)), B: to16Bit(component(x, y, 2)), A: 0xffff})
 				}
-				c = gocolor.RGBA{R: r, G: g, B: b, A: a}
 			}
-		} else if this.ColorComponents == 4 {
-			c1 := uint8(samples[i] & 0xff)
-			m1 := uint8(samples[i+1] & 0xff)
-			y1 := uint8(samples[i+2] & 0xff)
-			k1 := uint8(samples[i+3] & 0xff)
-			c = gocolor.CMYK{C: c1, M: m1, Y: y1, K: k1}
+			return img, nil
+		}
+		img := goimage.NewRGBA(bounds)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				img.SetRGBA(x, y, gocolor.RGBA{R: to8Bit(component(x, y, 0)),
+					G: to8Bit(component(x, y, 1)), B: to8Bit(component(x, y, 2)), A: 0xff})
+			}
 		}
+		return img, nil
+	}
 
-		img.Set(x, y, c)
-		x++
-		if x == int(this.Width) {
-			x = 0
-			y++
+	rgbAt := func(x, y int) (float64, float64, float64) {
+		switch n {
+		case 1:
+			gray := component(x, y, 0)
+			return gray, gray, gray
+		case 3:
+			return component(x, y, 0), component(x, y, 1), component(x, y, 2)
 		}
+		return cmykToRGB(component(x, y, 0), component(x, y, 1), component(x, y, 2), component(x, y, 3))
 	}
 
+	if sixteen {
+		img := goimage.NewNRGBA64(bounds)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				r, g, b := rgbAt(x, y)
+				img.SetNRGBA64(x, y, gocolor.NRGBA64{
+					R: to16Bit(r), G: to16Bit(g), B: to16Bit(b), A: to16Bit(alphaAt(x, y)),
+				})
+			}
+		}
+		return img, nil
+	}
+	img := goimage.NewNRGBA(bounds)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b := rgbAt(x, y)
+			img.SetNRGBA(x, y, gocolor.NRGBA{R: to8Bit(r), G: to8Bit(g), B: to8Bit(b), A: to8Bit(alphaAt(x, y))})
+		}
+	}
 	return img, nil
 }
 
+// componentReader returns a function giving the value of color component `c` of the pixel at
+// (`x`, `y`), mapped by the Decode array and clipped to the range 0 to 1.  Rows of the image data
+// are padded to full bytes.  Samples missing from short data are 0.
+func (this *Image) componentReader() (func(x, y, c int) float64, error) {
+	bpc := int(this.BitsPerComponent)
+	if bpc != 1 && bpc != 2 && bpc != 4 && bpc != 8 && bpc != 16 {
+		common.Log.Debug("Unsupported bits per component: %d", bpc)
+		return nil, errors.New("Unsupported bits per component")
+	}
+	n := this.ColorComponents
+	decode := this.decode
+	if len(decode) != 2*n {
+		decode = make([]float64, 0, 2*n)
+		for i := 0; i < n; i++ {
+			decode = append(decode, 0, 1)
+		}
+	}
+
+	maxVal := float64(uint32(1)<<uint(bpc) - 1)
+	bitsPerRow := (int(this.Width)*n*bpc + 7) / 8 * 8
+	data := this.Data
+	return func(x, y, c int) float64 {
+		offset := y*bitsPerRow + (x*n+c)*bpc
+		if (offset+bpc+7)/8 > len(data) {
+			return math.Max(0, math.Min(1, decode[2*c]))
+		}
+		var sample uint32
+		switch bpc {
+		case 8:
+			sample = uint32(data[offset/8])
+		case 16:
+			sample = uint32(data[offset/8])<<8 | uint32(data[offset/8+1])
+		default:
+			sample = uint32(data[offset/8]>>uint(8-offset%8-bpc)) & uint32(1<<uint(bpc)-1)
+		}
+		val := decode[2*c] + float64(sample)*(decode[2*c+1]-decode[2*c])/maxVal
+		return math.Max(0, math.Min(1, val))
+	}, nil
+}
+
+// unpremultiply returns color component value `val` premultiplied with matte value `matte` by
+// alpha `alpha` (11.6.5.3), un-premultiplied: c = m + (c' - m) / alpha, clipped to 0 to 1.  The
+// value of fully transparent pixels is unchanged.
+func unpremultiply(val, alpha, matte float64) float64 {
+	if alpha <= 0 {
+		return val
+	}
+	return math.Max(0, math.Min(1, matte+(val-matte)/alpha))
+}
+
+// to8Bit converts `val` in the range 0 to 1 to an 8 bit value.
+func to8Bit(val float64) uint8 {
+	return uint8(val*0xff + 0.5)
+}
+
+// to16Bit converts `val` in the range 0 to 1 to a 16 bit value.
+func to16Bit(val float64) uint16 {
+	return uint16(val*0xffff + 0.5)
+}
+
 // The ImageHandler interface implements common image loading and processing tasks.
 // Implementing as an interface allows for the possibility to use non-standard libraries for faster
 // loading and processing of images.
@@ -264,6 +489,8 @@ func (this DefaultImageHandler) NewImageFromGoImage(goimg goimage.Image) (*Image
 	imag.hasAlpha = hasAlpha
 	if hasAlpha {
 		imag.alphaData = alphaData
+		// The colors of RGBA images are premultiplied by alpha (with black).
+		imag.matte = []float64{0, 0, 0}
 	}
 
 	return &imag, nil
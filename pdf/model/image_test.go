@@ -6,7 +6,17 @@
 package model
 
 import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	goimage "image"
+	gocolor "image/color"
+	"image/png"
+	"os"
+	"reflect"
 	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
 )
 
 func TestImageResampling(t *testing.T) {
@@ -64,3 +74,326 @@ func TestImageResampling(t *testing.T) {
 		t.Errorf("Value != 64 (%d)", img.Data[1])
 	}
 }
+
+func TestImageDegenerateSizes(t *testing.T) {
+	// 1x1 tracking pixel with trailing pad bytes.
+	img := Image{}
+	img.BitsPerComponent = 8
+	img.ColorComponents = 3
+	img.Width = 1
+	img.Height = 1
+	img.Data = []byte{10, 20, 30, 0, 0, 0, 0, 0}
+
+	samples := img.GetSamples()
+	if len(samples) != 3 {
+		t.Fatalf("Samples length != 3 (%d)", len(samples))
+	}
+	goimg, err := img.ToGoImage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	r, g, b, _ := goimg.At(0, 0).RGBA()
+	if r>>8 != 10 || g>>8 != 20 || b>>8 != 30 {
+		t.Errorf("Invalid pixel value (%d %d %d)", r>>8, g>>8, b>>8)
+	}
+
+	// Zero-area placeholder.
+	img = Image{}
+	img.BitsPerComponent = 8
+	img.ColorComponents = 1
+	img.Width = 0
+	img.Height = 5
+	img.Data = []byte{}
+
+	goimg, err = img.ToGoImage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !goimg.Bounds().Empty() {
+		t.Errorf("Expecting empty image bounds (%v)", goimg.Bounds())
+	}
+	img.Resample(1)
+	if img.Data == nil || len(img.Data) != 0 || img.BitsPerComponent != 1 {
+		t.Errorf("Invalid resampled zero-area image (%v, %d)", img.Data, img.BitsPerComponent)
+	}
+
+	// 0x0 placeholder image XObject.
+	stream := &PdfObjectStream{PdfObjectDictionary: MakeDict()}
+	stream.Set("Type", MakeName("XObject"))
+	stream.Set("Subtype", MakeName("Image"))
+	stream.Set("Width", MakeInteger(0))
+	stream.Set("Height", MakeInteger(0))
+	stream.Set("BitsPerComponent", MakeInteger(8))
+	stream.Set("ColorSpace", MakeName("DeviceRGB"))
+	stream.Set("Length", MakeInteger(0))
+	ximg, err := NewXObjectImageFromStream(stream)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	goimg, err = ximg.ToGoImage()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !goimg.Bounds().Empty() {
+		t.Errorf("Expecting empty image bounds (%v)", goimg.Bounds())
+	}
+}
+
+// makeTestImageStream returns an unfiltered image XObject stream of 5x3 pixels with the entries
+// `dict` and generated samples, `n` components of `bpc` bits per pixel, rows padded to full bytes.
+func makeTestImageStream(t *testing.T, dict string, n, bpc, seed int) *PdfObjectStream {
+	d, err := NewParserFromString(dict).ParseDict()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	width, height := 5, 3
+	mul := 37
+	if bpc == 16 {
+		mul = 9001
+	}
+	var data []byte
+	i := 0
+	for y := 0; y < height; y++ {
+		row := make([]byte, (width*n*bpc+7)/8)
+		for j := 0; j < width*n; j, i = j+1, i+1 {
+			sample := (i*mul + seed) % (1 << uint(bpc))
+			switch bpc {
+			case 16:
+				row[2*j], row[2*j+1] = byte(sample>>8), byte(sample)
+			default:
+				bit := j * bpc
+				row[bit/8] |= byte(sample << uint(8-bit%8-bpc))
+			}
+		}
+		data = append(data, row...)
+	}
+	d.Set("Type", MakeName("XObject"))
+	d.Set("Subtype", MakeName("Image"))
+	d.Set("Width", MakeInteger(int64(width)))
+	d.Set("Height", MakeInteger(int64(height)))
+	d.Set("Length", MakeInteger(int64(len(data))))
+	return &PdfObjectStream{PdfObjectDictionary: d, Stream: data}
+}
+
+// Test the conversion of image XObjects to Go images and PNG against golden files, comparing the
+// images pixel by pixel.
+func TestImageToGoImageGolden(t *testing.T) {
+	testcases := []struct {
+		Golden   string
+		Dict     string
+		N, BPC   int
+		SMaskBPC int
+		Expected goimage.Image
+	}{
+		{"gray1", "<< /ColorSpace /DeviceGray /BitsPerComponent 1 >>", 1, 1, 0, &goimage.Gray{}},
+		{"gray2", "<< /ColorSpace /DeviceGray /BitsPerComponent 2 >>", 1, 2, 0, &goimage.Gray{}},
+		{"gray4", "<< /ColorSpace /DeviceGray /BitsPerComponent 4 >>", 1, 4, 0, &goimage.Gray{}},
+		{"gray8", "<< /ColorSpace /DeviceGray /BitsPerComponent 8 >>", 1, 8, 0, &goimage.Gray{}},
+		{"gray16", "<< /ColorSpace /DeviceGray /BitsPerComponent 16 >>", 1, 16, 0, &goimage.Gray16{}},
+		{"gray8_decode", "<< /ColorSpace /DeviceGray /BitsPerComponent 8 /Decode [1 0] >>", 1, 8, 0, &goimage.Gray{}},
+		{"rgb8", "<< /ColorSpace /DeviceRGB /BitsPerComponent 8 >>", 3, 8, 0, &goimage.RGBA{}},
+		{"rgb16", "<< /ColorSpace /DeviceRGB /BitsPerComponent 16 >>", 3, 16, 0, &goimage.RGBA64{}},
+		{"cmyk8", "<< /ColorSpace /DeviceCMYK /BitsPerComponent 8 >>", 4, 8, 0, &goimage.NRGBA{}},
+		{"indexed4", "<< /ColorSpace [/Indexed /DeviceRGB 15 <00ff0010ef3520df6a30cf9f40bfd450af09609f3e708f73807fa8906fdda05f12b04f47c03f7cd02fb1e01fe6f00f1b>] /BitsPerComponent 4 >>",
+			1, 4, 0, &goimage.RGBA{}},
+		{"rgb8_smask", "<< /ColorSpace /DeviceRGB /BitsPerComponent 8 >>", 3, 8, 8, &goimage.NRGBA{}},
+		{"rgb16_smask", "<< /ColorSpace /DeviceRGB /BitsPerComponent 16 >>", 3, 16, 16, &goimage.NRGBA64{}},
+		{"rgb8_smask_matte", "<< /ColorSpace /DeviceRGB /BitsPerComponent 8 >>", 3, 8, 8, &goimage.NRGBA{}},
+		{"imagemask", "<< /ImageMask true >>", 1, 1, 0, &goimage.NRGBA{}},
+	}
+
+	// Additional soft mask entries.
+	smaskEntries := map[string]string{"rgb8_smask_matte": "/Matte [1 0.5 0]"}
+
+	for _, tcase := range testcases {
+		seed := map[int]int{1: 11, 3: 5, 4: 3}[tcase.N]
+		if tcase.Golden == "indexed4" {
+			seed = 7
+		}
+		stream := makeTestImageStream(t, tcase.Dict, tcase.N, tcase.BPC, seed)
+		if tcase.SMaskBPC > 0 {
+			smaskDict := fmt.Sprintf("<< /ColorSpace /DeviceGray /BitsPerComponent %d %s >>", tcase.SMaskBPC,
+				smaskEntries[tcase.Golden])
+			stream.Set("SMask", makeTestImageStream(t, smaskDict, 1, tcase.SMaskBPC, 200))
+		}
+		ximg, err := NewXObjectImageFromStream(stream)
+		if err != nil {
+			t.Fatalf("%s: Error: %v", tcase.Golden, err)
+		}
+
+		goimg, err := ximg.ToGoImage()
+		if err != nil {
+			t.Errorf("%s: Error: %v", tcase.Golden, err)
+			continue
+		}
+		if fmt.Sprintf("%T", goimg) != fmt.Sprintf("%T", tcase.Expected) {
+			t.Errorf("%s: Image type %T, expected %T", tcase.Golden, goimg, tcase.Expected)
+		}
+
+		var buf bytes.Buffer
+		if err := ximg.WritePNG(&buf); err != nil {
+			t.Fatalf("%s: Error: %v", tcase.Golden, err)
+		}
+		written, err := png.Decode(&buf)
+		if err != nil {
+			t.Fatalf("%s: Error: %v", tcase.Golden, err)
+		}
+
+		file, err := os.Open("../../testfiles/golden/" + tcase.Golden + ".png")
+		if err != nil {
+			t.Fatalf("%s: Error: %v", tcase.Golden, err)
+		}
+		golden, err := png.Decode(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("%s: Error: %v", tcase.Golden, err)
+		}
+
+		if !golden.Bounds().Eq(written.Bounds()) {
+			t.Errorf("%s: Bounds %v != %v", tcase.Golden, written.Bounds(), golden.Bounds())
+			continue
+		}
+		for y := 0; y < golden.Bounds().Dy(); y++ {
+			for x := 0; x < golden.Bounds().Dx(); x++ {
+				expected := gocolor.NRGBA64Model.Convert(golden.At(x, y))
+				for _, img := range []goimage.Image{goimg, written} {
+					if c := gocolor.NRGBA64Model.Convert(img.At(x, y)); c != expected {
+						t.Errorf("%s: Pixel (%d,%d) %v != %v", tcase.Golden, x, y, c, expected)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Test that the samples of images with rows padded to full bytes are read row by row.
+func TestImageGetSamplesPadded(t *testing.T) {
+	img := Image{Width: 3, Height: 2, BitsPerComponent: 2, ColorComponents: 1}
+	data, _ := hex.DecodeString("e4" + "1b")
+	img.Data = data
+	expected := []uint32{3, 2, 1, 0, 1, 2}
+	samples := img.GetSamples()
+	if len(samples) != len(expected) {
+		t.Fatalf("Samples %v != %v", samples, expected)
+	}
+	for i := range samples {
+		if samples[i] != expected[i] {
+			t.Fatalf("Samples %v != %v", samples, expected)
+		}
+	}
+}
+
+// Test that the colors of a Go image with alpha, premultiplied when loaded, are written with a
+// Matte and extracted unchanged.
+func TestImageMatteRoundTrip(t *testing.T) {
+	goimg := goimage.NewNRGBA(goimage.Rect(0, 0, 2, 1))
+	goimg.SetNRGBA(0, 0, gocolor.NRGBA{R: 255, G: 64, B: 0, A: 128})
+	goimg.SetNRGBA(1, 0, gocolor.NRGBA{R: 0, G: 200, B: 100, A: 255})
+	img, err := DefaultImageHandler{}.NewImageFromGoImage(goimg)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	ximg, err := NewXObjectImageFromImage(img, nil, NewRawEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	smask := ximg.SMask.(*PdfObjectStream)
+	if matte := smask.Get("Matte"); matte == nil || matte.DefaultWriteString() != "[0 0 0]" {
+		t.Errorf("SMask Matte %v, expected [0 0 0]", matte)
+	}
+
+	ximg, err = NewXObjectImageFromStream(ximg.ToPdfObject().(*PdfObjectStream))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for _, conv := range []func() (goimage.Image, error){img.ToGoImage, ximg.ToGoImage} {
+		extracted, err := conv()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		for x := 0; x < 2; x++ {
+			expected := goimg.NRGBAAt(x, 0)
+			c := gocolor.NRGBAModel.Convert(extracted.At(x, 0)).(gocolor.NRGBA)
+			// Within the rounding of the premultiplied samples.
+			for _, d := range []int{int(c.R) - int(expected.R), int(c.G) - int(expected.G), int(c.B) - int(expected.B)} {
+				if d < -2 || d > 2 {
+					t.Errorf("Pixel %d: %v, expected %v", x, c, expected)
+					break
+				}
+			}
+			if c.A != expected.A {
+				t.Errorf("Pixel %d: alpha %d, expected %d", x, c.A, expected.A)
+			}
+		}
+	}
+	// An invalid Matte is ignored.
+	smask.Set("Matte", MakeName("Black"))
+	if _, err := ximg.ToGoImage(); err != nil {
+		t.Errorf("Invalid Matte: %v", err)
+	}
+}
+
+// Test converting decoded samples to Go images.
+func TestSamplesToGoImage(t *testing.T) {
+	// 2x2 RGB, 8 bits per component.
+	rgb := []byte{255, 0, 0, 0, 255, 0, 0, 0, 255, 10, 20, 30}
+	img, err := SamplesToGoImage(rgb, 2, 2, 3, 8, nil, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	rgba, ok := img.(*goimage.RGBA)
+	if !ok {
+		t.Fatalf("Not an RGBA image (%T)", img)
+	}
+	if rgba.Bounds() != goimage.Rect(0, 0, 2, 2) {
+		t.Errorf("Bounds %v", rgba.Bounds())
+	}
+	expected := []gocolor.RGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, {10, 20, 30, 255}}
+	for i, c := range expected {
+		if got := rgba.RGBAAt(i%2, i/2); got != c {
+			t.Errorf("Pixel %d: %v, expected %v", i, got, c)
+		}
+	}
+
+	// 3x1 gray, 4 bits per component with padding of the row, and inverted by Decode.
+	img, err = SamplesToGoImage([]byte{0x0f, 0x80}, 3, 1, 1, 4, nil, nil)
+	if gray, ok := img.(*goimage.Gray); err != nil || !ok || !reflect.DeepEqual(gray.Pix, []byte{0, 255, 136}) {
+		t.Errorf("Gray image %T %v (%v)", img, img, err)
+	}
+	img, err = SamplesToGoImage([]byte{0x0f, 0x80}, 3, 1, 1, 4, []float64{1, 0}, nil)
+	if gray, ok := img.(*goimage.Gray); err != nil || !ok || !reflect.DeepEqual(gray.Pix, []byte{255, 0, 119}) {
+		t.Errorf("Inverted gray image %T %v (%v)", img, img, err)
+	}
+
+	// 1 bit palette indices, with an index beyond the palette of 1 color.
+	palette := gocolor.Palette{gocolor.RGBA{1, 2, 3, 255}}
+	img, err = SamplesToGoImage([]byte{0x40}, 2, 1, 1, 1, nil, palette)
+	if paletted, ok := img.(*goimage.Paletted); err != nil || !ok || !reflect.DeepEqual(paletted.Pix, []byte{0, 0}) {
+		t.Errorf("Paletted image %T %v (%v)", img, img, err)
+	}
+
+	// CMYK converted to RGB.
+	img, err = SamplesToGoImage([]byte{0, 255, 255, 0}, 1, 1, 4, 8, nil, nil)
+	if nrgba, ok := img.(*goimage.NRGBA); err != nil || !ok || nrgba.NRGBAAt(0, 0) != (gocolor.NRGBA{255, 0, 0, 255}) {
+		t.Errorf("CMYK image %T %v (%v)", img, img, err)
+	}
+
+	invalid := []struct {
+		Data          []byte
+		Width, Height int
+		Comps, Bpc    int
+		Decode        []float64
+	}{
+		{rgb, 2, 3, 3, 8, nil}, // Short data.
+		{rgb, 2, 2, 2, 8, nil},
+		{rgb, 2, 2, 3, 3, nil},
+		{rgb, 0, 2, 3, 8, nil},
+		{rgb, 2, 2, 3, 8, []float64{0, 1}},
+	}
+	for _, tcase := range invalid {
+		if _, err := SamplesToGoImage(tcase.Data, tcase.Width, tcase.Height, tcase.Comps, tcase.Bpc, tcase.Decode, nil); err == nil {
+			t.Errorf("%+v: expected error", tcase)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/unidoc/unidoc/common"
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// ImportContext copies objects of a source document into a document written by a PdfWriter, e.g.
+// pages, annotations or fonts for merging or splitting documents.  The copies are deep: each
+// indirect object and stream reached from an imported object is copied once per context, so
+// objects shared in the source (such as a font used by several pages) are shared by the copies,
+// and reference cycles (such as Parent entries) are reproduced.  Streams are copied with their
+// encoded data, without decoding.
+//
+// Pages are only copied when imported themselves: references to other pages of the source, e.g. the
+// destinations of link annotations, refer to the copies of these pages once imported, and are null
+// otherwise.
+type ImportContext struct {
+	// SkipKeys are the dictionary keys dropped from the copies, e.g. StructParent and
+	// StructParents which refer to the structure tree of the source document.
+	SkipKeys map[PdfObjectName]bool
+
+	dst    *PdfWriter
+	src    *PdfReader
+	copies map[PdfObject]PdfObject // Copies of the source indirect objects and streams.
+	// References to source pages not imported (yet), set to the page copies when imported.
+	pageRefs map[*PdfIndirectObject][]importPageRef
+}
+
+// importPageRef is a reference to a source page in a copy: entry `key` of dictionary `dict`, or
+// item `index` of array `arr`.
+type importPageRef struct {
+	dict  *PdfObjectDictionary
+	key   PdfObjectName
+	arr   *PdfObjectArray
+	index int
+}
+
+// pageInheritableKeys are the inheritable page attributes (7.7.3.4).
+var pageInheritableKeys = []PdfObjectName{"Resources", "MediaBox", "CropBox", "Rotate"}
+
+// NewImportContext returns a context for importing objects of the document loaded by `src` into
+// the document written by `dst`.  `src` resolves the references of the source objects, and can be
+// nil if the imported objects have no unresolved references, e.g. pages loaded by a reader.
+func NewImportContext(dst *PdfWriter, src *PdfReader) *ImportContext {
+	return &ImportContext{
+		SkipKeys: map[PdfObjectName]bool{},
+		dst:      dst,
+		src:      src,
+		copies:   map[PdfObject]PdfObject{},
+		pageRefs: map[*PdfIndirectObject][]importPageRef{},
+	}
+}
+
+// ImportObject returns a copy of `obj` of the source document for the target document, with the
+// copies of the objects reached from it.  Page dictionaries are copied without their Parent,
+// which would import the page tree of the source, but with the inherited attributes of their
+// parents.  The copies are not added to the target until referred to, e.g. by an added page.
+func (ctx *ImportContext) ImportObject(obj PdfObject) (PdfObject, error) {
+	obj, err := ctx.resolve(obj)
+	if err != nil || obj == nil {
+		return nil, err
+	}
+	if copied, has := ctx.copies[obj]; has {
+		return copied, nil
+	}
+
+	switch t := obj.(type) {
+	case *PdfIndirectObject:
+		// Registered before copying the contents, which may refer back to the object.
+		ind := &PdfIndirectObject{}
+		ctx.copies[t] = ind
+		for _, ref := range ctx.pageRefs[t] {
+			if ref.dict != nil {
+				ref.dict.Set(ref.key, ind)
+			} else {
+				(*ref.arr)[ref.index] = ind
+			}
+		}
+		delete(ctx.pageRefs, t)
+		contents, err := ctx.ImportObject(t.PdfObject)
+		if err != nil {
+			return nil, err
+		}
+		ind.PdfObject = contents
+		return ind, nil
+	case *PdfObjectStream:
+		stream := &PdfObjectStream{PdfObjectDictionary: MakeDict()}
+		ctx.copies[t] = stream
+		if err := ctx.importDict(t.PdfObjectDictionary, stream.PdfObjectDictionary); err != nil {
+			return nil, err
+		}
+		// Data left encrypted by a reader with ReadOnlyDecryption is imported decrypted.
+		data, err := t.DecryptedStream()
+		if err != nil {
+			return nil, err
+		}
+		stream.Stream = append([]byte{}, data...)
+		stream.Set("Length", MakeInteger(int64(len(data))))
+		return stream, nil
+	case *PdfObjectDictionary:
+		dict := MakeDict()
+		if err := ctx.importDict(t, dict); err != nil {
+			return nil, err
+		}
+		return dict, nil
+	case *PdfObjectArray:
+		arr := &PdfObjectArray{}
+		for _, item := range *t {
+			page, err := ctx.otherPage(item)
+			if err != nil {
+				return nil, err
+			}
+			if page != nil {
+				ctx.pageRefs[page] = append(ctx.pageRefs[page], importPageRef{arr: arr, index: len(*arr)})
+				arr.Append(MakeNull())
+				continue
+			}
+			copied, err := ctx.ImportObject(item)
+			if err != nil {
+				return nil, err
+			}
+			if copied == nil {
+				copied = MakeNull()
+			}
+			arr.Append(copied)
+		}
+		return arr, nil
+	case *PdfObjectString:
+		return MakeString(string(*t)), nil
+	case *PdfObjectName:
+		return MakeName(string(*t)), nil
+	case *PdfObjectInteger:
+		return MakeInteger(int64(*t)), nil
+	case *PdfObjectFloat:
+		return MakeFloat(float64(*t)), nil
+	case *PdfObjectBool:
+		return MakeBool(bool(*t)), nil
+	case *PdfObjectNull:
+		return MakeNull(), nil
+	}
+	common.Log.Debug("ERROR: Unexpected object type %T", obj)
+	return nil, ErrTypeError
+}
+
+// resolve returns the object `obj` refers to if a reference of the source document.
+func (ctx *ImportContext) resolve(obj PdfObject) (PdfObject, error) {
+	ref, ok := obj.(*PdfObjectReference)
+	if !ok {
+		return obj, nil
+	}
+	if ctx.src == nil {
+		return nil, fmt.Errorf("unresolved reference %s", ref)
+	}
+	resolved, _, err := ctx.src.resolveReference(ref)
+	return resolved, err
+}
+
+// otherPage returns the source page `obj` refers to if it is a page that has not been imported, as
+// referred to from within an imported object, otherwise nil.
+func (ctx *ImportContext) otherPage(obj PdfObject) (*PdfIndirectObject, error) {
+	if _, ok := obj.(*PdfObjectReference); ok && ctx.src == nil {
+		return nil, nil
+	}
+	obj, err := ctx.resolve(obj)
+	if err != nil {
+		return nil, err
+	}
+	ind, ok := obj.(*PdfIndirectObject)
+	if !ok {
+		return nil, nil
+	}
+	if _, has := ctx.copies[ind]; has {
+		return nil, nil
+	}
+	dict, ok := ind.PdfObject.(*PdfObjectDictionary)
+	if !ok {
+		return nil, nil
+	}
+	if name, ok := TraceToDirectObject(dict.Get("Type")).(*PdfObjectName); !ok || *name != "Page" {
+		return nil, nil
+	}
+	return ind, nil
+}
+
+// importDict copies the entries of source dictionary `src` into `dst`.
+func (ctx *ImportContext) importDict(src, dst *PdfObjectDictionary) error {
+	isPage := false
+	if name, ok := TraceToDirectObject(src.Get("Type")).(*PdfObjectName); ok && *name == "Page" {
+		isPage = true
+	}
+	for _, key := range src.Keys() {
+		if ctx.SkipKeys[key] || isPage && key == "Parent" {
+			continue
+		}
+		page, err := ctx.otherPage(src.Get(key))
+		if err != nil {
+			return err
+		}
+		if page != nil {
+			ctx.pageRefs[page] = append(ctx.pageRefs[page], importPageRef{dict: dst, key: key})
+			dst.Set(key, MakeNull())
+			continue
+		}
+		copied, err := ctx.ImportObject(src.Get(key))
+		if err != nil {
+			return err
+		}
+		dst.SetIfNotNil(key, copied)
+	}
+	if !isPage {
+		return nil
+	}
+
+	// Attributes inherited from the page tree of the source.
+	parent := src.Get("Parent")
+	for depth := 0; parent != nil && depth < 32; depth++ {
+		if ref, ok := parent.(*PdfObjectReference); ok && ctx.src != nil {
+			resolved, _, err := ctx.src.resolveReference(ref)
+			if err != nil {
+				return err
+			}
+			parent = resolved
+		}
+		parentDict, ok := TraceToDirectObject(parent).(*PdfObjectDictionary)
+		if !ok {
+			break
+		}
+		for _, key := range pageInheritableKeys {
+			if dst.Get(key) != nil || parentDict.Get(key) == nil {
+				continue
+			}
+			copied, err := ctx.ImportObject(parentDict.Get(key))
+			if err != nil {
+				return err
+			}
+			dst.SetIfNotNil(key, copied)
+		}
+		parent = parentDict.Get("Parent")
+	}
+	return nil
+}
+
+// ImportPage imports page `page` of the source document (see ImportObject) and adds it to the
+// target document.  Returns the page added.
+func (ctx *ImportContext) ImportPage(page *PdfPage) (*PdfPage, error) {
+	if ctx.dst == nil {
+		return nil, errors.New("no target document")
+	}
+	copied, err := ctx.ImportObject(page.ToPdfObject())
+	if err != nil {
+		return nil, err
+	}
+	ind, ok := copied.(*PdfIndirectObject)
+	if !ok {
+		return nil, ErrTypeError
+	}
+	dict, ok := ind.PdfObject.(*PdfObjectDictionary)
+	if !ok {
+		return nil, ErrTypeError
+	}
+
+	// The entries of the page model are those of the copied dictionary, besides the fields used
+	// when modifying the page, e.g. by adding content.
+	imported := NewPdfPage()
+	imported.pageDict = dict
+	imported.setContainer(ind)
+	imported.Contents = dict.Get("Contents")
+	if box, ok := TraceToDirectObject(dict.Get("MediaBox")).(*PdfObjectArray); ok {
+		imported.MediaBox, err = NewPdfRectangle(*box)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resources, ok := TraceToDirectObject(dict.Get("Resources")).(*PdfObjectDictionary); ok {
+		imported.Resources, err = NewPdfPageResourcesFromDict(resources)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		imported.Resources = NewPdfPageResources()
+	}
+	if err := ctx.dst.AddPage(imported); err != nil {
+		return nil, err
+	}
+	return imported, nil
+}
+
+// ImportObject returns a copy of `src`, an object of another document, for document `dst` as
+// ImportContext.ImportObject, with the context of `dst.GetImportContext` so that the objects shared
+// by the objects imported with several calls are copied once.  The references of `src` must be
+// resolved, as for objects loaded by a PdfReader, otherwise see NewImportContext.
+func ImportObject(dst *PdfWriter, src PdfObject) (PdfObject, error) {
+	return dst.GetImportContext().ImportObject(src)
+}
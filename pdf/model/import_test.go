@@ -0,0 +1,220 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// makeImportSourceDoc returns a document of two pages sharing a font, each with a link annotation
+// referring back to its page.  The link of the first page goes to the second page.
+func makeImportSourceDoc(t *testing.T) []byte {
+	font := MakeIndirectObject(MakeDict())
+	fontDict := font.PdfObject.(*PdfObjectDictionary)
+	fontDict.Set("Type", MakeName("Font"))
+	fontDict.Set("Subtype", MakeName("Type1"))
+	fontDict.Set("BaseFont", MakeName("Courier"))
+
+	var pages []*PdfPage
+	var links []*PdfAnnotationLink
+	for i := 0; i < 2; i++ {
+		page := NewPdfPage()
+		page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+		page.Resources = NewPdfPageResources()
+		page.Resources.SetFontByName("F1", font)
+		page.StructParents = MakeInteger(int64(i))
+		page.AddContentStreamByString("BT /F1 12 Tf (Page) Tj ET")
+		link := NewPdfAnnotationLink()
+		link.Rect = MakeArrayFromFloats([]float64{0, 0, 50, 50})
+		link.P = page.GetPageAsIndirectObject()
+		page.Annotations = append(page.Annotations, link.PdfAnnotation)
+		pages = append(pages, page)
+		links = append(links, link)
+	}
+	links[0].Dest = MakeArray(pages[1].GetPageAsIndirectObject(), MakeName("Fit"))
+
+	w := NewPdfWriter()
+	for _, page := range pages {
+		if err := w.AddPage(page); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	data, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return data
+}
+
+// Test importing pages of another document, sharing their common font.
+func TestImportPages(t *testing.T) {
+	reader, err := NewPdfReader(bytes.NewReader(makeImportSourceDoc(t)))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	w := NewPdfWriter()
+	ctx := NewImportContext(&w, reader)
+	ctx.SkipKeys["StructParents"] = true
+	for _, page := range reader.PageList {
+		if _, err := ctx.ImportPage(page); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	data, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if n := strings.Count(string(data), "/BaseFont /Courier"); n != 1 {
+		t.Errorf("%d copies of the font, expected 1", n)
+	}
+	if strings.Contains(string(data), "StructParents") {
+		t.Errorf("StructParents not skipped")
+	}
+
+	imported, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(imported.PageList) != 2 {
+		t.Fatalf("%d pages, expected 2", len(imported.PageList))
+	}
+	for i, page := range imported.PageList {
+		if page.MediaBox == nil || page.MediaBox.Urx != 612 {
+			t.Errorf("Page %d: MediaBox %v", i+1, page.MediaBox)
+		}
+		font, found := page.Resources.GetFontByName("F1")
+		if !found {
+			t.Fatalf("Page %d: font F1 missing", i+1)
+		}
+		first, _ := imported.PageList[0].Resources.GetFontByName("F1")
+		if font != first {
+			t.Errorf("Page %d: font not shared", i+1)
+		}
+		contents, err := page.GetAllContentStreams()
+		if err != nil || !strings.Contains(contents, "(Page) Tj") {
+			t.Errorf("Page %d: contents %q (%v)", i+1, contents, err)
+		}
+		// The cycle of the page and its annotation is kept.
+		if len(page.Annotations) != 1 || page.Annotations[0].P != page.GetPageAsIndirectObject() {
+			t.Errorf("Page %d: annotation page not the imported page", i+1)
+		}
+	}
+	// The link destination, imported before its page, goes to the imported page.
+	if dest := importedLinkDest(t, imported); dest == nil || (*dest)[0] != imported.PageList[1].GetPageAsIndirectObject() {
+		t.Errorf("Link destination %v not the imported page", dest)
+	}
+
+	// Objects imported by separate calls share their common objects, with the skipped keys of the
+	// context of the writer.
+	w2 := NewPdfWriter()
+	w2.GetImportContext().SkipKeys["Subtype"] = true
+	var fonts []PdfObject
+	for _, page := range reader.PageList {
+		resources, err := ImportObject(&w2, page.Resources.ToPdfObject())
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		fonts = append(fonts, TraceToDirectObject(resources.(*PdfObjectDictionary).Get("Font")).(*PdfObjectDictionary).Get("F1"))
+	}
+	if fonts[0] != fonts[1] || fonts[0] == reader.PageList[0].Resources.Font {
+		t.Errorf("Imported fonts not shared")
+	}
+	if font := TraceToDirectObject(fonts[0]).(*PdfObjectDictionary); font.Get("Subtype") != nil {
+		t.Errorf("Subtype not skipped: %s", font)
+	}
+}
+
+// importedLinkDest returns the destination of the link annotation of the first page of the
+// document loaded by `reader`.
+func importedLinkDest(t *testing.T, reader *PdfReader) *PdfObjectArray {
+	annots := reader.PageList[0].Annotations
+	if len(annots) != 1 {
+		t.Fatalf("%d annotations", len(annots))
+	}
+	link, ok := annots[0].GetContext().(*PdfAnnotationLink)
+	if !ok {
+		t.Fatalf("Not a link annotation (%T)", annots[0].GetContext())
+	}
+	dest, _ := TraceToDirectObject(link.Dest).(*PdfObjectArray)
+	return dest
+}
+
+// Test that the destination page of a link is not copied when only the page of the link is
+// imported.
+func TestImportLinkToOtherPage(t *testing.T) {
+	reader, err := NewPdfReader(bytes.NewReader(makeImportSourceDoc(t)))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	w := NewPdfWriter()
+	if _, err := NewImportContext(&w, reader).ImportPage(reader.PageList[0]); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if n := strings.Count(string(data), "/Contents"); n != 1 {
+		t.Errorf("%d pages with contents written, expected 1", n)
+	}
+
+	imported, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	dest := importedLinkDest(t, imported)
+	if dest == nil || len(*dest) != 2 {
+		t.Fatalf("Link destination %v", dest)
+	}
+	if _, ok := (*dest)[0].(*PdfObjectNull); !ok {
+		t.Errorf("Destination page %v, expected null", (*dest)[0])
+	}
+}
+
+// Test importing a page of an encrypted document loaded with ReadOnlyDecryption, whose content
+// stream data is still encrypted.
+func TestImportReadOnlyDecryption(t *testing.T) {
+	opts := &ReaderOpts{ParserOpts: ParserOpts{ReadOnlyDecryption: true}}
+	reader, err := NewPdfReaderWithOpts(bytes.NewReader(makeEncryptedTestDoc(t, "", 4, AccessPermissions{})), opts)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if ok, err := reader.Decrypt([]byte("")); !ok || err != nil {
+		t.Fatalf("Decryption failed (%v)", err)
+	}
+	page, err := reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	w := NewPdfWriter()
+	if _, err := NewImportContext(&w, reader).ImportPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	imported, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	page, err = imported.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	const expected = "BT /F1 12 Tf 10 10 Td (Hello) Tj ET"
+	if content, err := page.GetAllContentStreams(); err != nil || !strings.HasPrefix(content, expected) {
+		t.Errorf("Imported content %q (%v), expected %q", content, err, expected)
+	}
+}
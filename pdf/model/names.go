@@ -0,0 +1,153 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/unidoc/unidoc/common"
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// Destination is an explicit destination (12.3.2.2): a page of the document and how to display it.
+type Destination struct {
+	// Page object of the destination, e.g. from PdfPage.GetPageAsIndirectObject.  When writing, the
+	// page with index PageIndex of the written document is used if nil.
+	Page *PdfIndirectObject
+
+	// Index (0-based) of the destination page in the document, -1 if not a page of the document.
+	PageIndex int
+
+	// Display of the page: XYZ, Fit, FitH, FitV, FitR, FitB, FitBH or FitBV.
+	Fit PdfObjectName
+
+	// Parameters of the display, numbers or null, e.g. left, top and zoom for XYZ.
+	Params []PdfObject
+}
+
+// NamedScript is a document-level JavaScript action of the JavaScript name tree of the Names
+// dictionary (12.6.4.16), executed when the document is opened.
+type NamedScript struct {
+	Name   string
+	Script string
+}
+
+// newDestinationFromPdfObject returns the destination of `obj`, an explicit destination array or
+// a dictionary with the array as D entry (12.3.2.3), with the page index resolved from the pages
+// of the document.
+func (this *PdfReader) newDestinationFromPdfObject(obj PdfObject) (Destination, error) {
+	obj, err := this.traceToObject(obj)
+	if err != nil {
+		return Destination{}, err
+	}
+	if dict, ok := TraceToDirectObject(obj).(*PdfObjectDictionary); ok {
+		obj, err = this.traceToObject(dict.Get("D"))
+		if err != nil {
+			return Destination{}, err
+		}
+	}
+	arr, ok := TraceToDirectObject(obj).(*PdfObjectArray)
+	if !ok || len(*arr) < 2 {
+		return Destination{}, ErrTypeError
+	}
+	err = this.traverseObjectData(arr)
+	if err != nil {
+		return Destination{}, err
+	}
+
+	dest := Destination{PageIndex: -1}
+	switch t := (*arr)[0].(type) {
+	case *PdfIndirectObject:
+		dest.Page = t
+		for i, page := range this.pageList {
+			if page == t {
+				dest.PageIndex = i
+				break
+			}
+		}
+	case *PdfObjectInteger:
+		// Page number of a remote destination, also used by some writers for local destinations.
+		if i := int(*t); i >= 0 && i < len(this.pageList) {
+			common.Log.Debug("Incompatibility: Destination page given by index %d", i)
+			dest.Page = this.pageList[i]
+			dest.PageIndex = i
+		}
+	}
+	fit, ok := TraceToDirectObject((*arr)[1]).(*PdfObjectName)
+	if !ok {
+		return Destination{}, ErrTypeError
+	}
+	dest.Fit = *fit
+	dest.Params = append([]PdfObject{}, (*arr)[2:]...)
+	return dest, nil
+}
+
+// makeDestination returns the explicit destination array of `dest` with the page resolved in the
+// pages added to the writer.
+func (this *PdfWriter) makeDestination(dest Destination) (*PdfObjectArray, error) {
+	page := dest.Page
+	if page == nil {
+		kids, ok := this.pages.PdfObject.(*PdfObjectDictionary).Get("Kids").(*PdfObjectArray)
+		if !ok || dest.PageIndex < 0 || dest.PageIndex >= len(*kids) {
+			return nil, fmt.Errorf("destination page index %d out of range", dest.PageIndex)
+		}
+		page, ok = (*kids)[dest.PageIndex].(*PdfIndirectObject)
+		if !ok {
+			return nil, ErrTypeError
+		}
+	} else if !this.hasObject(page) {
+		return nil, errors.New("destination page not added to the document")
+	}
+
+	arr := MakeArray(page, MakeName(string(dest.Fit)))
+	for _, param := range dest.Params {
+		if param == nil {
+			param = MakeNull()
+		}
+		arr.Append(param)
+	}
+	return arr, nil
+}
+
+// newNamedScriptFromPdfObject returns the script of JavaScript action `obj`, whose JS entry is a
+// text string or a stream.
+func (this *PdfReader) newNamedScriptFromPdfObject(name string, obj PdfObject) (NamedScript, error) {
+	obj, err := this.traceToObject(obj)
+	if err != nil {
+		return NamedScript{}, err
+	}
+	action, ok := TraceToDirectObject(obj).(*PdfObjectDictionary)
+	if !ok {
+		return NamedScript{}, ErrTypeError
+	}
+	if s, ok := TraceToDirectObject(action.Get("S")).(*PdfObjectName); !ok || *s != "JavaScript" {
+		return NamedScript{}, fmt.Errorf("not a JavaScript action (%v)", action.Get("S"))
+	}
+	obj, err = this.traceToObject(action.Get("JS"))
+	if err != nil {
+		return NamedScript{}, err
+	}
+	switch t := obj.(type) {
+	case *PdfObjectString:
+		return NamedScript{Name: name, Script: decodePdfTextString(string(*t))}, nil
+	case *PdfObjectStream:
+		data, err := DecodeStream(t)
+		if err != nil {
+			return NamedScript{}, err
+		}
+		return NamedScript{Name: name, Script: decodePdfTextString(string(data))}, nil
+	}
+	return NamedScript{}, ErrTypeError
+}
+
+// makeJavaScriptAction returns the JavaScript action of `script`.
+func makeJavaScriptAction(script NamedScript) *PdfIndirectObject {
+	action := MakeDict()
+	action.Set("S", MakeName("JavaScript"))
+	action.Set("JS", MakeString(encodePdfTextString(script.Script)))
+	return MakeIndirectObject(action)
+}
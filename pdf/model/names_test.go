@@ -0,0 +1,223 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// readNamesTestDoc reads `data` and returns the reader with its named destinations and JavaScript.
+func readNamesTestDoc(t *testing.T, data []byte) (*PdfReader, map[string]Destination, []NamedScript) {
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	dests, err := reader.GetNamedDestinations()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	scripts, err := reader.GetDocumentJavaScript()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return reader, dests, scripts
+}
+
+// Test named destinations and document JavaScript written, read, and kept through a load-modify-save
+// cycle which moves the pages and renumbers the objects.
+func TestNamedDestinations(t *testing.T) {
+	w := NewPdfWriter()
+	var pages []*PdfPage
+	for i := 0; i < 3; i++ {
+		page := NewPdfPage()
+		page.Resources = NewPdfPageResources()
+		page.MediaBox = &PdfRectangle{Urx: float64(100 * (i + 1)), Ury: 792}
+		if i == 0 {
+			link := NewPdfAnnotationLink()
+			link.Rect = MakeArrayFromFloats([]float64{0, 0, 50, 50})
+			link.Dest = MakeString("chap3")
+			page.Annotations = append(page.Annotations, link.PdfAnnotation)
+		}
+		if err := w.AddPage(page); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		pages = append(pages, page)
+	}
+	xyz := []PdfObject{MakeInteger(0), MakeInteger(792), MakeNull()}
+	if err := w.SetNamedDestination("chap3", Destination{PageIndex: 2, Fit: "XYZ", Params: xyz}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := w.SetNamedDestination("chap2", Destination{Page: pages[1].GetPageAsIndirectObject(), Fit: "Fit"}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	scripts := []NamedScript{{"init", "app.alert('Grüße →');"}, {"another", "var x = 1;"}}
+	if err := w.SetDocumentJavaScript(scripts); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := w.SetDocumentJavaScript(append(scripts, scripts[0])); err == nil {
+		t.Errorf("Duplicate script names accepted")
+	}
+	data, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	reader, dests, readScripts := readNamesTestDoc(t, data)
+	if len(dests) != 2 || dests["chap3"].PageIndex != 2 || dests["chap2"].PageIndex != 1 {
+		t.Fatalf("Unexpected destinations %v", dests)
+	}
+	if dest := dests["chap3"]; dest.Fit != "XYZ" || len(dest.Params) != 3 || dest.Page != reader.pageList[2] {
+		t.Errorf("Unexpected chap3 destination %+v", dest)
+	}
+	// In name order.
+	expected := []NamedScript{scripts[1], scripts[0]}
+	if !reflect.DeepEqual(readScripts, expected) {
+		t.Errorf("JavaScript %q, expected %q", readScripts, expected)
+	}
+
+	// Insert a new first page, and keep the destinations and the scripts with one more.
+	w2 := NewPdfWriter()
+	first := NewPdfPage()
+	first.Resources = NewPdfPageResources()
+	first.MediaBox = &PdfRectangle{Urx: 50, Ury: 792}
+	if err := w2.AddPage(first); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for _, page := range reader.PageList {
+		if err := w2.AddPage(page); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	for name, dest := range dests {
+		if err := w2.SetNamedDestination(name, dest); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if err := w2.SetNamedDestination("cover", Destination{PageIndex: 0, Fit: "Fit"}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := w2.SetDocumentJavaScript(append(readScripts, NamedScript{"zz", "var y;"})); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data, err = writeToBytes(&w2)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	reader, dests, readScripts = readNamesTestDoc(t, data)
+	widths := map[string]float64{"cover": 50, "chap2": 200, "chap3": 300}
+	for name, width := range widths {
+		dest, has := dests[name]
+		if !has || dest.PageIndex < 0 {
+			t.Errorf("Destination %s missing (%+v)", name, dest)
+			continue
+		}
+		if w := reader.PageList[dest.PageIndex].MediaBox.Urx; w != width {
+			t.Errorf("Destination %s on page of width %v, expected %v", name, w, width)
+		}
+	}
+	if len(dests) != 3 || len(readScripts) != 3 || readScripts[2].Name != "zz" {
+		t.Errorf("Unexpected destinations %v and JavaScript %q", dests, readScripts)
+	}
+
+	// The link of the original first page still goes to chap3.
+	annots := reader.PageList[1].Annotations
+	if len(annots) != 1 {
+		t.Fatalf("%d annotations", len(annots))
+	}
+	link, ok := annots[0].GetContext().(*PdfAnnotationLink)
+	if !ok {
+		t.Fatalf("Not a link annotation (%T)", annots[0].GetContext())
+	}
+	name, ok := TraceToDirectObject(link.Dest).(*PdfObjectString)
+	if !ok || dests[name.String()].PageIndex != 3 {
+		t.Errorf("Link destination %v", link.Dest)
+	}
+
+	// A destination page which is not in the document.
+	w3 := NewPdfWriter()
+	if err := w3.SetNamedDestination("lost", dests["chap2"]); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := writeToBytes(&w3); err == nil {
+		t.Errorf("Destination to a missing page written")
+	}
+	if !w3.RemoveNamedDestination("lost") || w3.RemoveNamedDestination("lost") {
+		t.Errorf("Destination not removed once")
+	}
+}
+
+// Test that the Names dictionary of the source document is carried over and merged with the
+// destinations set and removed, dropping the destinations to pages that are not written.
+func TestNamedDestinationsCarriedOver(t *testing.T) {
+	w := NewPdfWriter()
+	for i := 0; i < 3; i++ {
+		page := NewPdfPage()
+		page.Resources = NewPdfPageResources()
+		page.MediaBox = &PdfRectangle{Urx: float64(100 * (i + 1)), Ury: 792}
+		if err := w.AddPage(page); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		name := string('a' + byte(i))
+		if err := w.SetNamedDestination(name, Destination{PageIndex: i, Fit: "Fit"}); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if err := w.SetDocumentJavaScript([]NamedScript{{"init", "var x;"}}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	reader, _, _ := readNamesTestDoc(t, data)
+	// Another name tree, carried over as it is.
+	names, err := reader.traceToObject(reader.catalog.Get("Names"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	urls := MakeDict()
+	urls.Set("Names", MakeArray(MakeString("http://example.com"), MakeDict()))
+	TraceToDirectObject(names).(*PdfObjectDictionary).Set("URLS", MakeIndirectObject(urls))
+
+	// Only the first two pages, with page b's destination removed and one added.
+	w2 := NewPdfWriter()
+	for _, page := range reader.PageList[:2] {
+		if err := w2.AddPage(page); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if !w2.RemoveNamedDestination("b") || w2.RemoveNamedDestination("b") || w2.RemoveNamedDestination("x") {
+		t.Errorf("Source destination not removed once")
+	}
+	if err := w2.SetNamedDestination("d", Destination{PageIndex: 1, Fit: "Fit"}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data, err = writeToBytes(&w2)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	reader, dests, scripts := readNamesTestDoc(t, data)
+	if len(dests) != 2 || dests["a"].PageIndex != 0 || dests["d"].PageIndex != 1 {
+		t.Errorf("Unexpected destinations %v", dests)
+	}
+	if len(scripts) != 1 || scripts[0].Name != "init" {
+		t.Errorf("Unexpected JavaScript %q", scripts)
+	}
+	tree, err := reader.GetNameTree("URLS")
+	if err != nil || tree == nil {
+		t.Fatalf("URLS tree missing (%v)", err)
+	}
+	if _, found, err := tree.Lookup("http://example.com"); err != nil || !found {
+		t.Errorf("URLS entry missing (%v)", err)
+	}
+}
@@ -0,0 +1,489 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/unidoc/unidoc/common"
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// Modified trees are written with at most maxTreeNodeEntries entries per leaf node and kids per
+// intermediate node.
+const maxTreeNodeEntries = 64
+
+// treeKey is a key of a name tree (name) or number tree (num).
+type treeKey struct {
+	name string
+	num  int64
+}
+
+type treeEntry struct {
+	key   treeKey
+	value PdfObject
+}
+
+// pdfTree is a name tree (7.9.6) or number tree (7.9.7), depending on `entriesKey` (Names or
+// Nums).  The nodes are loaded as needed through `resolve`.  When modified, the entries are loaded
+// into `entries`, from which the nodes are rebuilt when written.
+type pdfTree struct {
+	root       PdfObject
+	entriesKey PdfObjectName
+	resolve    func(obj PdfObject) (PdfObject, error)
+
+	modified bool
+	entries  []treeEntry // Sorted by key.
+
+	// Called for each node whose Kids or entries are read, for testing.
+	visit func(node *PdfObjectDictionary)
+}
+
+// resolveDirect is the resolver of trees that are fully loaded.
+func resolveDirect(obj PdfObject) (PdfObject, error) {
+	return obj, nil
+}
+
+func (tree *pdfTree) less(a, b treeKey) bool {
+	if tree.entriesKey == "Names" {
+		return a.name < b.name
+	}
+	return a.num < b.num
+}
+
+// parseKey returns the key `obj`, a string for name trees and an integer for number trees.
+func (tree *pdfTree) parseKey(obj PdfObject) (treeKey, error) {
+	obj, err := tree.resolve(obj)
+	if err != nil {
+		return treeKey{}, err
+	}
+	switch key := TraceToDirectObject(obj).(type) {
+	case *PdfObjectString:
+		if tree.entriesKey == "Names" {
+			return treeKey{name: string(*key)}, nil
+		}
+	case *PdfObjectInteger:
+		if tree.entriesKey == "Nums" {
+			return treeKey{num: int64(*key)}, nil
+		}
+	}
+	common.Log.Debug("Invalid %s tree key (%T)", tree.entriesKey, obj)
+	return treeKey{}, ErrTypeError
+}
+
+func (tree *pdfTree) makeKey(key treeKey) PdfObject {
+	if tree.entriesKey == "Names" {
+		return MakeString(key.name)
+	}
+	return MakeInteger(key.num)
+}
+
+func (tree *pdfTree) node(obj PdfObject) (*PdfObjectDictionary, error) {
+	obj, err := tree.resolve(obj)
+	if err != nil {
+		return nil, err
+	}
+	node, ok := TraceToDirectObject(obj).(*PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("Tree node not a dictionary (%T)", obj)
+		return nil, ErrTypeError
+	}
+	return node, nil
+}
+
+func (tree *pdfTree) array(node *PdfObjectDictionary, key PdfObjectName) (*PdfObjectArray, error) {
+	obj := node.Get(key)
+	if obj == nil {
+		return nil, nil
+	}
+	obj, err := tree.resolve(obj)
+	if err != nil {
+		return nil, err
+	}
+	arr, ok := TraceToDirectObject(obj).(*PdfObjectArray)
+	if !ok {
+		common.Log.Debug("Tree node %s not an array (%T)", key, obj)
+		return nil, ErrTypeError
+	}
+	return arr, nil
+}
+
+// limits returns the Limits of `node`, or false if it has none.
+func (tree *pdfTree) limits(node *PdfObjectDictionary) (treeKey, treeKey, bool) {
+	arr, err := tree.array(node, "Limits")
+	if err != nil || arr == nil || len(*arr) != 2 {
+		return treeKey{}, treeKey{}, false
+	}
+	low, err := tree.parseKey((*arr)[0])
+	if err != nil {
+		return treeKey{}, treeKey{}, false
+	}
+	high, err := tree.parseKey((*arr)[1])
+	if err != nil {
+		return treeKey{}, treeKey{}, false
+	}
+	return low, high, true
+}
+
+// lookup returns the value of `key`, descending only into the kids whose Limits include `key`.
+func (tree *pdfTree) lookup(key treeKey) (PdfObject, bool, error) {
+	if tree.modified {
+		i := tree.search(key)
+		if i < len(tree.entries) && tree.entries[i].key == key {
+			return tree.entries[i].value, true, nil
+		}
+		return nil, false, nil
+	}
+	if tree.root == nil {
+		return nil, false, nil
+	}
+
+	visited := map[*PdfObjectDictionary]bool{}
+	var descend func(node *PdfObjectDictionary) (PdfObject, bool, error)
+	descend = func(node *PdfObjectDictionary) (PdfObject, bool, error) {
+		if visited[node] {
+			common.Log.Debug("ERROR: Tree loop")
+			return nil, false, errors.New("Tree loop")
+		}
+		visited[node] = true
+		if tree.visit != nil {
+			tree.visit(node)
+		}
+
+		kids, err := tree.array(node, "Kids")
+		if err != nil {
+			return nil, false, err
+		}
+		if kids != nil {
+			for _, kidObj := range *kids {
+				kid, err := tree.node(kidObj)
+				if err != nil {
+					return nil, false, err
+				}
+				// Kids without Limits are searched too.
+				if low, high, ok := tree.limits(kid); ok && (tree.less(key, low) || tree.less(high, key)) {
+					continue
+				}
+				value, found, err := descend(kid)
+				if found || err != nil {
+					return value, found, err
+				}
+			}
+			return nil, false, nil
+		}
+
+		entries, err := tree.array(node, tree.entriesKey)
+		if err != nil || entries == nil {
+			return nil, false, err
+		}
+		for i := 0; i+1 < len(*entries); i += 2 {
+			k, err := tree.parseKey((*entries)[i])
+			if err != nil {
+				return nil, false, err
+			}
+			if k == key {
+				value, err := tree.resolve((*entries)[i+1])
+				return value, err == nil, err
+			}
+		}
+		return nil, false, nil
+	}
+
+	root, err := tree.node(tree.root)
+	if err != nil {
+		return nil, false, err
+	}
+	return descend(root)
+}
+
+// iterate calls `callback` for the entries of the tree in tree order, stopping at the first error.
+func (tree *pdfTree) iterate(callback func(key treeKey, value PdfObject) error) error {
+	if tree.modified {
+		for _, entry := range tree.entries {
+			if err := callback(entry.key, entry.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if tree.root == nil {
+		return nil
+	}
+
+	visited := map[*PdfObjectDictionary]bool{}
+	var walk func(obj PdfObject) error
+	walk = func(obj PdfObject) error {
+		node, err := tree.node(obj)
+		if err != nil {
+			return err
+		}
+		if visited[node] {
+			common.Log.Debug("ERROR: Tree loop")
+			return errors.New("Tree loop")
+		}
+		visited[node] = true
+		if tree.visit != nil {
+			tree.visit(node)
+		}
+
+		kids, err := tree.array(node, "Kids")
+		if err != nil {
+			return err
+		}
+		if kids != nil {
+			for _, kid := range *kids {
+				if err := walk(kid); err != nil {
+					return err
+				}
+			}
+		}
+		entries, err := tree.array(node, tree.entriesKey)
+		if err != nil || entries == nil {
+			return err
+		}
+		for i := 0; i+1 < len(*entries); i += 2 {
+			key, err := tree.parseKey((*entries)[i])
+			if err != nil {
+				return err
+			}
+			value, err := tree.resolve((*entries)[i+1])
+			if err != nil {
+				return err
+			}
+			if err := callback(key, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(tree.root)
+}
+
+// search returns the index of the first entry with a key not less than `key`.
+func (tree *pdfTree) search(key treeKey) int {
+	return sort.Search(len(tree.entries), func(i int) bool {
+		return !tree.less(tree.entries[i].key, key)
+	})
+}
+
+// load loads all entries of the tree for modification.  Of duplicate keys, the first is kept.
+func (tree *pdfTree) load() error {
+	if tree.modified {
+		return nil
+	}
+	var entries []treeEntry
+	err := tree.iterate(func(key treeKey, value PdfObject) error {
+		entries = append(entries, treeEntry{key, value})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return tree.less(entries[i].key, entries[j].key)
+	})
+	tree.entries = nil
+	for i, entry := range entries {
+		if i > 0 && entry.key == entries[i-1].key {
+			common.Log.Debug("Incompatibility: Duplicate %s tree key %v, ignoring", tree.entriesKey, entry.key)
+			continue
+		}
+		tree.entries = append(tree.entries, entry)
+	}
+	tree.modified = true
+	return nil
+}
+
+// insert sets the value of `key` to `value`.
+func (tree *pdfTree) insert(key treeKey, value PdfObject) error {
+	if err := tree.load(); err != nil {
+		return err
+	}
+	i := tree.search(key)
+	if i < len(tree.entries) && tree.entries[i].key == key {
+		tree.entries[i].value = value
+		return nil
+	}
+	tree.entries = append(tree.entries, treeEntry{})
+	copy(tree.entries[i+1:], tree.entries[i:])
+	tree.entries[i] = treeEntry{key, value}
+	return nil
+}
+
+// remove deletes `key`, returning false if not in the tree.
+func (tree *pdfTree) remove(key treeKey) (bool, error) {
+	if err := tree.load(); err != nil {
+		return false, err
+	}
+	i := tree.search(key)
+	if i == len(tree.entries) || tree.entries[i].key != key {
+		return false, nil
+	}
+	tree.entries = append(tree.entries[:i], tree.entries[i+1:]...)
+	return true, nil
+}
+
+// toPdfObject returns the root node of the tree.  Modified trees with more than
+// maxTreeNodeEntries entries are written with leaves of that many entries under as many levels of
+// intermediate nodes as needed, all with Limits.
+func (tree *pdfTree) toPdfObject() PdfObject {
+	if !tree.modified && tree.root != nil {
+		return tree.root
+	}
+
+	type treeNode struct {
+		obj       PdfObject
+		low, high treeKey
+	}
+	makeLimits := func(low, high treeKey) *PdfObjectArray {
+		return MakeArray(tree.makeKey(low), tree.makeKey(high))
+	}
+
+	makeLeaf := func(entries []treeEntry) *PdfObjectDictionary {
+		arr := PdfObjectArray{}
+		for _, entry := range entries {
+			arr = append(arr, tree.makeKey(entry.key), entry.value)
+		}
+		leaf := MakeDict()
+		leaf.Set(tree.entriesKey, &arr)
+		return leaf
+	}
+	if len(tree.entries) <= maxTreeNodeEntries {
+		return makeLeaf(tree.entries)
+	}
+
+	var nodes []treeNode
+	for i := 0; i < len(tree.entries); i += maxTreeNodeEntries {
+		end := i + maxTreeNodeEntries
+		if end > len(tree.entries) {
+			end = len(tree.entries)
+		}
+		entries := tree.entries[i:end]
+		low, high := entries[0].key, entries[len(entries)-1].key
+		leaf := makeLeaf(entries)
+		leaf.Set("Limits", makeLimits(low, high))
+		nodes = append(nodes, treeNode{MakeIndirectObject(leaf), low, high})
+	}
+	for len(nodes) > maxTreeNodeEntries {
+		var parents []treeNode
+		for i := 0; i < len(nodes); i += maxTreeNodeEntries {
+			end := i + maxTreeNodeEntries
+			if end > len(nodes) {
+				end = len(nodes)
+			}
+			kids := nodes[i:end]
+			arr := PdfObjectArray{}
+			for _, kid := range kids {
+				arr = append(arr, kid.obj)
+			}
+			low, high := kids[0].low, kids[len(kids)-1].high
+			parent := MakeDict()
+			parent.Set("Kids", &arr)
+			parent.Set("Limits", makeLimits(low, high))
+			parents = append(parents, treeNode{MakeIndirectObject(parent), low, high})
+		}
+		nodes = parents
+	}
+
+	arr := PdfObjectArray{}
+	for _, node := range nodes {
+		arr = append(arr, node.obj)
+	}
+	root := MakeDict()
+	root.Set("Kids", &arr)
+	return root
+}
+
+// NameTree is a name tree (7.9.6), mapping strings to objects, as used for the named destinations
+// (Dests), embedded files (EmbeddedFiles) and document JavaScript of the Names dictionary of the
+// catalog.  Trees are loaded as needed: Lookup only loads the nodes whose Limits include the name.
+// Modified trees are rebuilt, balanced, when written.
+type NameTree struct {
+	tree pdfTree
+}
+
+// NewNameTree returns an empty name tree.
+func NewNameTree() *NameTree {
+	return &NameTree{pdfTree{entriesKey: "Names", resolve: resolveDirect, modified: true}}
+}
+
+// NewNameTreeFromPdfObject returns the name tree with root node `obj`.
+func NewNameTreeFromPdfObject(obj PdfObject) *NameTree {
+	return &NameTree{pdfTree{root: obj, entriesKey: "Names", resolve: resolveDirect}}
+}
+
+// Lookup returns the value of `name`, or false if `name` is not in the tree.
+func (t *NameTree) Lookup(name string) (PdfObject, bool, error) {
+	return t.tree.lookup(treeKey{name: name})
+}
+
+// Iterate calls `callback` for each name and value of the tree in order, stopping at the first
+// error returned by `callback`, which is returned.
+func (t *NameTree) Iterate(callback func(name string, value PdfObject) error) error {
+	return t.tree.iterate(func(key treeKey, value PdfObject) error {
+		return callback(key.name, value)
+	})
+}
+
+// Insert sets the value of `name` to `value`, replacing any previous value.
+func (t *NameTree) Insert(name string, value PdfObject) error {
+	return t.tree.insert(treeKey{name: name}, value)
+}
+
+// Delete removes `name` from the tree, returning false if it was not in the tree.
+func (t *NameTree) Delete(name string) (bool, error) {
+	return t.tree.remove(treeKey{name: name})
+}
+
+// ToPdfObject returns the root node of the tree.
+func (t *NameTree) ToPdfObject() PdfObject {
+	return t.tree.toPdfObject()
+}
+
+// NumberTree is a number tree (7.9.7), mapping integers to objects, as used for the page labels
+// (PageLabels) and the structure ParentTree.  It is loaded and written as NameTree.
+type NumberTree struct {
+	tree pdfTree
+}
+
+// NewNumberTree returns an empty number tree.
+func NewNumberTree() *NumberTree {
+	return &NumberTree{pdfTree{entriesKey: "Nums", resolve: resolveDirect, modified: true}}
+}
+
+// NewNumberTreeFromPdfObject returns the number tree with root node `obj`.
+func NewNumberTreeFromPdfObject(obj PdfObject) *NumberTree {
+	return &NumberTree{pdfTree{root: obj, entriesKey: "Nums", resolve: resolveDirect}}
+}
+
+// Lookup returns the value of `key`, or false if `key` is not in the tree.
+func (t *NumberTree) Lookup(key int64) (PdfObject, bool, error) {
+	return t.tree.lookup(treeKey{num: key})
+}
+
+// Iterate calls `callback` for each key and value of the tree in order, stopping at the first
+// error returned by `callback`, which is returned.
+func (t *NumberTree) Iterate(callback func(key int64, value PdfObject) error) error {
+	return t.tree.iterate(func(key treeKey, value PdfObject) error {
+		return callback(key.num, value)
+	})
+}
+
+// Insert sets the value of `key` to `value`, replacing any previous value.
+func (t *NumberTree) Insert(key int64, value PdfObject) error {
+	return t.tree.insert(treeKey{num: key}, value)
+}
+
+// Delete removes `key` from the tree, returning false if it was not in the tree.
+func (t *NumberTree) Delete(key int64) (bool, error) {
+	return t.tree.remove(treeKey{num: key})
+}
+
+// ToPdfObject returns the root node of the tree.
+func (t *NumberTree) ToPdfObject() PdfObject {
+	return t.tree.toPdfObject()
+}
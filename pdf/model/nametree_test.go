@@ -0,0 +1,219 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// checkTree checks that the tree with root `root` is valid: intermediate and leaf nodes are
+// indirect objects with Limits matching their entries, with sorted entries and at most
+// maxTreeNodeEntries entries or kids per node.  Returns the keys of the tree in order.
+func checkTree(t *testing.T, tree *pdfTree, root PdfObject) []treeKey {
+	var keys []treeKey
+	var check func(obj PdfObject, isRoot bool) (treeKey, treeKey)
+	check = func(obj PdfObject, isRoot bool) (treeKey, treeKey) {
+		if _, ok := obj.(*PdfIndirectObject); !ok && !isRoot {
+			t.Fatalf("Kid not an indirect object (%T)", obj)
+		}
+		node := TraceToDirectObject(obj).(*PdfObjectDictionary)
+		var low, high treeKey
+		if kids, ok := node.Get("Kids").(*PdfObjectArray); ok {
+			if len(*kids) > maxTreeNodeEntries {
+				t.Errorf("Node with %d kids", len(*kids))
+			}
+			for i, kid := range *kids {
+				kidLow, kidHigh := check(kid, false)
+				if i == 0 {
+					low = kidLow
+				}
+				high = kidHigh
+			}
+		} else {
+			entries := node.Get(tree.entriesKey).(*PdfObjectArray)
+			if len(*entries) > 2*maxTreeNodeEntries {
+				t.Errorf("Leaf with %d entries", len(*entries)/2)
+			}
+			for i := 0; i < len(*entries); i += 2 {
+				key, err := tree.parseKey((*entries)[i])
+				if err != nil {
+					t.Fatalf("Error: %v", err)
+				}
+				if len(keys) > 0 && !tree.less(keys[len(keys)-1], key) {
+					t.Errorf("Key %v not ascending", key)
+				}
+				keys = append(keys, key)
+				if i == 0 {
+					low = key
+				}
+				high = key
+			}
+		}
+		if isRoot {
+			if node.Get("Limits") != nil {
+				t.Errorf("Root with Limits")
+			}
+		} else if l, h, ok := tree.limits(node); !ok || l != low || h != high {
+			t.Errorf("Limits %v, expected %v %v", node.Get("Limits"), low, high)
+		}
+		return low, high
+	}
+	check(root, true)
+	return keys
+}
+
+// Test that looking up a key of a large number tree only loads the nodes on the path to the key,
+// and that modifications keep the tree valid.
+func TestNumberTree(t *testing.T) {
+	tree := NewNumberTree()
+	// Insert in an order other than sorted.
+	for i := int64(0); i < 10000; i++ {
+		key := (i * 7919) % 10000
+		if err := tree.Insert(key, MakeInteger(2*key)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	root := tree.ToPdfObject()
+	if keys := checkTree(t, &tree.tree, root); len(keys) != 10000 {
+		t.Fatalf("%d keys, expected 10000", len(keys))
+	}
+
+	loaded := NewNumberTreeFromPdfObject(root)
+	visited := 0
+	loaded.tree.visit = func(node *PdfObjectDictionary) {
+		visited++
+	}
+	testcases := []struct {
+		Key     int64
+		Found   bool
+		Visited int
+	}{
+		// Root, intermediate node and leaf: 10000 entries make 157 leaves under 3 intermediate nodes.
+		{0, true, 3},
+		{5000, true, 3},
+		{9999, true, 3},
+		// Keys outside the Limits of the kids of the root.
+		{-1, false, 1},
+		{10000, false, 1},
+	}
+	for _, tcase := range testcases {
+		visited = 0
+		value, found, err := loaded.Lookup(tcase.Key)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if found != tcase.Found || visited != tcase.Visited {
+			t.Errorf("%d: found %t with %d nodes visited, expected %t with %d", tcase.Key, found,
+				visited, tcase.Found, tcase.Visited)
+		}
+		if found && *(value.(*PdfObjectInteger)) != PdfObjectInteger(2*tcase.Key) {
+			t.Errorf("%d: value %v", tcase.Key, value)
+		}
+	}
+
+	for key := int64(0); key < 10000; key += 2 {
+		if deleted, err := loaded.Delete(key); err != nil || !deleted {
+			t.Fatalf("Key %d not deleted (%v)", key, err)
+		}
+	}
+	if deleted, _ := loaded.Delete(0); deleted {
+		t.Errorf("Key 0 deleted twice")
+	}
+	loaded.Insert(-5, MakeNull())
+	loaded.Insert(1, MakeInteger(1))
+	keys := checkTree(t, &loaded.tree, loaded.ToPdfObject())
+	if len(keys) != 5001 || keys[0].num != -5 || keys[1].num != 1 || keys[5000].num != 9999 {
+		t.Errorf("Unexpected keys after modification: %d keys", len(keys))
+	}
+	if value, found, _ := loaded.Lookup(1); !found || *(value.(*PdfObjectInteger)) != 1 {
+		t.Errorf("Replaced value %v", value)
+	}
+
+	count := 0
+	err := loaded.Iterate(func(key int64, value PdfObject) error {
+		count++
+		if count == 3 {
+			return ErrRangeError
+		}
+		return nil
+	})
+	if err != ErrRangeError || count != 3 {
+		t.Errorf("Iteration not stopped: %v after %d entries", err, count)
+	}
+}
+
+// Test a name tree written to a file and loaded by the reader as needed.
+func TestNameTreeReader(t *testing.T) {
+	tree := NewNameTree()
+	for i := 0; i < 1000; i++ {
+		dest := MakeArray(MakeInteger(int64(i)), MakeName("Fit"))
+		tree.Insert(fmt.Sprintf("dest%04d", i), MakeIndirectObject(dest))
+	}
+
+	w := NewPdfWriter()
+	page := NewPdfPage()
+	page.Resources = NewPdfPageResources()
+	page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	names := MakeDict()
+	names.Set("Dests", MakeIndirectObject(tree.ToPdfObject()))
+	w.catalog.Set("Names", names)
+	if err := w.addObjects(names); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if tree, err := reader.GetNameTree("EmbeddedFiles"); err != nil || tree != nil {
+		t.Errorf("Unexpected EmbeddedFiles tree (%v)", err)
+	}
+	dests, err := reader.GetNameTree("Dests")
+	if err != nil || dests == nil {
+		t.Fatalf("Dests missing (%v)", err)
+	}
+	visited := 0
+	dests.tree.visit = func(node *PdfObjectDictionary) {
+		visited++
+	}
+	value, found, err := dests.Lookup("dest0777")
+	if err != nil || !found {
+		t.Fatalf("dest0777 not found (%v)", err)
+	}
+	dest, ok := TraceToDirectObject(value).(*PdfObjectArray)
+	if !ok || len(*dest) != 2 || *((*dest)[0].(*PdfObjectInteger)) != 777 {
+		t.Errorf("Unexpected destination %v", value)
+	}
+	if visited != 2 {
+		t.Errorf("%d nodes visited, expected 2", visited)
+	}
+	if _, found, _ := dests.Lookup("dest1000"); found {
+		t.Errorf("dest1000 found")
+	}
+
+	count := 0
+	err = dests.Iterate(func(name string, value PdfObject) error {
+		if expected := fmt.Sprintf("dest%04d", count); name != expected {
+			return fmt.Errorf("Name %q, expected %q", name, expected)
+		}
+		count++
+		return nil
+	})
+	if err != nil || count != 1000 {
+		t.Errorf("Iterated %d names (%v)", count, err)
+	}
+}
@@ -0,0 +1,564 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"errors"
+
+	"github.com/unidoc/unidoc/common"
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// PdfOptionalContentGroup represents an optional content group (OCG), i.e. a layer whose content
+// viewers can show or hide (8.11.2 - Table 98).
+type PdfOptionalContentGroup struct {
+	Name   string
+	Intent PdfObject // Name or array of names (View, Design).
+	Usage  PdfObject // Usage dictionary, kept as is.
+
+	primitive *PdfIndirectObject
+}
+
+// NewPdfOptionalContentGroup returns a new optional content group (layer) named `name`.
+func NewPdfOptionalContentGroup(name string) *PdfOptionalContentGroup {
+	ocg := &PdfOptionalContentGroup{}
+	ocg.Name = name
+	ocg.primitive = MakeIndirectObject(MakeDict())
+	return ocg
+}
+
+func newPdfOptionalContentGroupFromPdfObject(obj PdfObject) (*PdfOptionalContentGroup, error) {
+	ind, ok := obj.(*PdfIndirectObject)
+	if !ok {
+		common.Log.Debug("OCG not an indirect object (%T)", obj)
+		return nil, errors.New("Type check error")
+	}
+	dict, ok := ind.PdfObject.(*PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("OCG not a dictionary (%T)", ind.PdfObject)
+		return nil, errors.New("Type check error")
+	}
+
+	ocg := &PdfOptionalContentGroup{}
+	ocg.primitive = ind
+
+	if name, ok := TraceToDirectObject(dict.Get("Name")).(*PdfObjectString); ok {
+		ocg.Name = string(*name)
+	} else {
+		common.Log.Debug("Incompatibility: OCG Name missing")
+	}
+	ocg.Intent = dict.Get("Intent")
+	ocg.Usage = dict.Get("Usage")
+
+	return ocg, nil
+}
+
+func (ocg *PdfOptionalContentGroup) GetContainingPdfObject() PdfObject {
+	return ocg.primitive
+}
+
+func (ocg *PdfOptionalContentGroup) ToPdfObject() PdfObject {
+	dict := ocg.primitive.PdfObject.(*PdfObjectDictionary)
+
+	setIfChanged(dict, "Type", MakeName("OCG"))
+	setIfChanged(dict, "Name", MakeString(ocg.Name))
+	setIfChanged(dict, "Intent", ocg.Intent)
+	setIfChanged(dict, "Usage", ocg.Usage)
+
+	return ocg.primitive
+}
+
+// PdfOCMembership represents an optional content membership dictionary (OCMD), which makes the
+// visibility of content depend on several groups (8.11.2.2 - Table 99).
+type PdfOCMembership struct {
+	OCGs []*PdfOptionalContentGroup
+	P    string    // Visibility policy: AllOn, AnyOn (default), AnyOff or AllOff.
+	VE   PdfObject // Visibility expression, kept as is (not evaluated).
+}
+
+// PdfOCOrderItem is an item in the Order tree of an optional content configuration, which
+// specifies how the groups are presented in the layers panel of a viewer.  An item is either a
+// group (possibly with nested child items) or a collection of items with an optional label.
+type PdfOCOrderItem struct {
+	Group    *PdfOptionalContentGroup
+	Label    string
+	Children []*PdfOCOrderItem
+}
+
+// PdfOCConfig represents an optional content configuration dictionary (8.11.4.3 - Table 101).
+// Entries not represented here are kept as is.
+type PdfOCConfig struct {
+	Name      PdfObject
+	Creator   PdfObject
+	BaseState string // ON (default), OFF or Unchanged.
+	ON        []*PdfOptionalContentGroup
+	OFF       []*PdfOptionalContentGroup
+	Order     []*PdfOCOrderItem
+
+	primitive *PdfObjectDictionary
+	container PdfObject // The dictionary as loaded, possibly an indirect object.
+}
+
+// NewPdfOCConfig returns a new optional content configuration with all groups on by default.
+func NewPdfOCConfig() *PdfOCConfig {
+	config := &PdfOCConfig{}
+	config.BaseState = "ON"
+	config.primitive = MakeDict()
+	return config
+}
+
+// PdfOCProperties represents the optional content properties dictionary (OCProperties) of the
+// document catalog, listing the optional content groups (layers) of the document and their
+// configurations (8.11.4.2 - Table 100).
+//
+// Entries are only regenerated if modified, so that loading and saving leaves the OCProperties
+// unchanged.
+type PdfOCProperties struct {
+	OCGs    []*PdfOptionalContentGroup
+	D       *PdfOCConfig
+	Configs []*PdfOCConfig
+
+	primitive PdfObject
+}
+
+// NewPdfOCProperties returns new empty optional content properties.
+func NewPdfOCProperties() *PdfOCProperties {
+	props := &PdfOCProperties{}
+	props.D = NewPdfOCConfig()
+	props.primitive = MakeDict()
+	return props
+}
+
+func newPdfOCPropertiesFromPdfObject(obj PdfObject) (*PdfOCProperties, error) {
+	dict, ok := TraceToDirectObject(obj).(*PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("OCProperties not a dictionary (%T)", obj)
+		return nil, errors.New("Type check error")
+	}
+
+	props := &PdfOCProperties{}
+	props.primitive = obj
+
+	if arr, ok := TraceToDirectObject(dict.Get("OCGs")).(*PdfObjectArray); ok {
+		for _, o := range *arr {
+			ocg, err := newPdfOptionalContentGroupFromPdfObject(o)
+			if err != nil {
+				return nil, err
+			}
+			props.OCGs = append(props.OCGs, ocg)
+		}
+	}
+
+	dObj := dict.Get("D")
+	if dObj == nil {
+		common.Log.Debug("Incompatibility: OCProperties D missing")
+		props.D = NewPdfOCConfig()
+	} else {
+		config, err := props.newOCConfigFromPdfObject(dObj)
+		if err != nil {
+			return nil, err
+		}
+		props.D = config
+	}
+
+	if arr, ok := TraceToDirectObject(dict.Get("Configs")).(*PdfObjectArray); ok {
+		for _, o := range *arr {
+			config, err := props.newOCConfigFromPdfObject(o)
+			if err != nil {
+				return nil, err
+			}
+			props.Configs = append(props.Configs, config)
+		}
+	}
+
+	return props, nil
+}
+
+func (this *PdfOCProperties) newOCConfigFromPdfObject(obj PdfObject) (*PdfOCConfig, error) {
+	dict, ok := TraceToDirectObject(obj).(*PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("Optional content configuration not a dictionary (%T)", obj)
+		return nil, errors.New("Type check error")
+	}
+
+	config := &PdfOCConfig{}
+	config.primitive = dict
+	config.container = obj
+	config.Name = dict.Get("Name")
+	config.Creator = dict.Get("Creator")
+
+	config.BaseState = "ON"
+	if name, ok := TraceToDirectObject(dict.Get("BaseState")).(*PdfObjectName); ok {
+		config.BaseState = string(*name)
+	}
+	config.ON = this.getGroupsFromArray(dict.Get("ON"))
+	config.OFF = this.getGroupsFromArray(dict.Get("OFF"))
+
+	if arr, ok := TraceToDirectObject(dict.Get("Order")).(*PdfObjectArray); ok {
+		config.Order = this.parseOrder(*arr)
+	}
+
+	return config, nil
+}
+
+// parseOrder loads the items of an Order array.  An array following a group holds the children
+// of the group, whereas an array starting with a string is a labeled collection.
+func (this *PdfOCProperties) parseOrder(arr PdfObjectArray) []*PdfOCOrderItem {
+	var items []*PdfOCOrderItem
+	for _, obj := range arr {
+		if ocg := this.GetGroup(obj); ocg != nil {
+			items = append(items, &PdfOCOrderItem{Group: ocg})
+			continue
+		}
+
+		sub, ok := TraceToDirectObject(obj).(*PdfObjectArray)
+		if !ok {
+			common.Log.Debug("Invalid Order entry (%T) - skipping", obj)
+			continue
+		}
+
+		item := &PdfOCOrderItem{}
+		elements := *sub
+		if len(elements) > 0 {
+			if label, ok := TraceToDirectObject(elements[0]).(*PdfObjectString); ok {
+				item.Label = string(*label)
+				elements = elements[1:]
+			}
+		}
+		item.Children = this.parseOrder(elements)
+
+		if n := len(items); item.Label == "" && n > 0 && items[n-1].Group != nil && items[n-1].Children == nil {
+			items[n-1].Children = item.Children
+			continue
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func (config *PdfOCConfig) toPdfObject() PdfObject {
+	dict := config.primitive
+
+	setIfChanged(dict, "Name", config.Name)
+	setIfChanged(dict, "Creator", config.Creator)
+	baseState := config.BaseState
+	if baseState == "" {
+		baseState = "ON"
+	}
+	// Only set if not the default, or already present.
+	if baseState != "ON" || dict.Get("BaseState") != nil {
+		setIfChanged(dict, "BaseState", MakeName(baseState))
+	}
+	setIfChanged(dict, "ON", makeGroupsArray(config.ON))
+	setIfChanged(dict, "OFF", makeGroupsArray(config.OFF))
+	setIfChanged(dict, "Order", makeOrderArray(config.Order))
+
+	if config.container != nil {
+		return config.container
+	}
+	return dict
+}
+
+// makeOrderArray returns the Order array for `items`.  Returns nil if `items` is empty.
+func makeOrderArray(items []*PdfOCOrderItem) *PdfObjectArray {
+	if len(items) == 0 {
+		return nil
+	}
+
+	arr := PdfObjectArray{}
+	for _, item := range items {
+		if item.Group != nil {
+			arr = append(arr, item.Group.ToPdfObject())
+			if len(item.Children) > 0 {
+				arr = append(arr, makeOrderArray(item.Children))
+			}
+			continue
+		}
+
+		sub := PdfObjectArray{}
+		if item.Label != "" {
+			sub = append(sub, MakeString(item.Label))
+		}
+		if children := makeOrderArray(item.Children); children != nil {
+			sub = append(sub, *children...)
+		}
+		arr = append(arr, &sub)
+	}
+	return &arr
+}
+
+// makeGroupsArray returns an array of the groups.  Returns nil if `groups` is empty.
+func makeGroupsArray(groups []*PdfOptionalContentGroup) *PdfObjectArray {
+	if len(groups) == 0 {
+		return nil
+	}
+	arr := PdfObjectArray{}
+	for _, ocg := range groups {
+		arr = append(arr, ocg.ToPdfObject())
+	}
+	return &arr
+}
+
+// setIfChanged sets `key` to `val` in `dict` unless the current value is equivalent, so that
+// unmodified entries are kept as loaded.  A current value in an indirect object is replaced within
+// the indirect object.  A nil (or nil array) value removes the key.
+func setIfChanged(dict *PdfObjectDictionary, key PdfObjectName, val PdfObject) {
+	if arr, ok := val.(*PdfObjectArray); ok && arr == nil {
+		val = nil
+	}
+	cur := dict.Get(key)
+	if val == nil {
+		if cur != nil {
+			dict.Remove(key)
+		}
+		return
+	}
+	if cur != nil && equivalentObjects(cur, val) {
+		return
+	}
+	if ind, ok := cur.(*PdfIndirectObject); ok && !isIndirect(val) {
+		ind.PdfObject = val
+		return
+	}
+	dict.Set(key, val)
+}
+
+// isIndirect returns true if `obj` is an indirect object or a stream.
+func isIndirect(obj PdfObject) bool {
+	switch obj.(type) {
+	case *PdfIndirectObject, *PdfObjectStream:
+		return true
+	}
+	return false
+}
+
+// equivalentObjects returns true if `a` and `b` are written identically and refer to the same
+// indirect objects, except that an indirect object in `a` is equivalent to a direct object in `b`
+// with the same contents.
+func equivalentObjects(a, b PdfObject) bool {
+	switch ta := a.(type) {
+	case *PdfIndirectObject:
+		if !isIndirect(b) {
+			return equivalentObjects(ta.PdfObject, b)
+		}
+		return a == b
+	case *PdfObjectStream:
+		return a == b
+	case *PdfObjectArray:
+		tb, ok := b.(*PdfObjectArray)
+		if !ok || len(*ta) != len(*tb) {
+			return false
+		}
+		for i := range *ta {
+			if !equivalentObjects((*ta)[i], (*tb)[i]) {
+				return false
+			}
+		}
+		return true
+	case *PdfObjectDictionary:
+		tb, ok := b.(*PdfObjectDictionary)
+		if !ok {
+			return false
+		}
+		if ta == tb {
+			return true
+		}
+		keys := ta.Keys()
+		if len(keys) != len(tb.Keys()) {
+			return false
+		}
+		for _, key := range keys {
+			if !equivalentObjects(ta.Get(key), tb.Get(key)) {
+				return false
+			}
+		}
+		return true
+	}
+	if b == nil {
+		return false
+	}
+	return a.DefaultWriteString() == b.DefaultWriteString()
+}
+
+func (this *PdfOCProperties) GetContainingPdfObject() PdfObject {
+	return this.primitive
+}
+
+// ToPdfObject returns the OCProperties dictionary, updated for any changes.
+func (this *PdfOCProperties) ToPdfObject() PdfObject {
+	dict := TraceToDirectObject(this.primitive).(*PdfObjectDictionary)
+
+	if arr := makeGroupsArray(this.OCGs); arr != nil {
+		setIfChanged(dict, "OCGs", arr)
+	} else {
+		setIfChanged(dict, "OCGs", &PdfObjectArray{})
+	}
+	if this.D != nil {
+		setIfChanged(dict, "D", this.D.toPdfObject())
+	}
+	if len(this.Configs) > 0 {
+		arr := PdfObjectArray{}
+		for _, config := range this.Configs {
+			arr = append(arr, config.toPdfObject())
+		}
+		setIfChanged(dict, "Configs", &arr)
+	} else {
+		setIfChanged(dict, "Configs", nil)
+	}
+
+	return this.primitive
+}
+
+// AddGroup adds the optional content group `ocg` to the document, initially visible if `visible`
+// is true, and appends it to the layers panel (Order) of the default configuration.
+func (this *PdfOCProperties) AddGroup(ocg *PdfOptionalContentGroup, visible bool) {
+	this.OCGs = append(this.OCGs, ocg)
+	if this.D == nil {
+		this.D = NewPdfOCConfig()
+	}
+	if visible {
+		this.D.ON = append(this.D.ON, ocg)
+	} else {
+		this.D.OFF = append(this.D.OFF, ocg)
+	}
+	this.D.Order = append(this.D.Order, &PdfOCOrderItem{Group: ocg})
+}
+
+// GetGroupByName returns the first optional content group named `name`, or nil if not found.
+func (this *PdfOCProperties) GetGroupByName(name string) *PdfOptionalContentGroup {
+	for _, ocg := range this.OCGs {
+		if ocg.Name == name {
+			return ocg
+		}
+	}
+	return nil
+}
+
+// GetGroup returns the optional content group of the document that `obj` refers to (as an
+// indirect object or a reference), or nil if `obj` is not one of the groups.
+func (this *PdfOCProperties) GetGroup(obj PdfObject) *PdfOptionalContentGroup {
+	var objNum int64
+	switch t := obj.(type) {
+	case *PdfIndirectObject:
+		for _, ocg := range this.OCGs {
+			if ocg.primitive == t {
+				return ocg
+			}
+		}
+		objNum = t.ObjectNumber
+	case *PdfObjectReference:
+		objNum = t.ObjectNumber
+	default:
+		return nil
+	}
+	if objNum == 0 {
+		return nil
+	}
+	for _, ocg := range this.OCGs {
+		if ocg.primitive.ObjectNumber == objNum {
+			return ocg
+		}
+	}
+	return nil
+}
+
+// getGroupsFromArray returns the groups referred to by an array of groups (e.g. ON/OFF entries).
+func (this *PdfOCProperties) getGroupsFromArray(obj PdfObject) []*PdfOptionalContentGroup {
+	arr, ok := TraceToDirectObject(obj).(*PdfObjectArray)
+	if !ok {
+		return nil
+	}
+	var groups []*PdfOptionalContentGroup
+	for _, o := range *arr {
+		if ocg := this.GetGroup(o); ocg != nil {
+			groups = append(groups, ocg)
+		} else {
+			common.Log.Debug("Unknown optional content group %v - skipping", o)
+		}
+	}
+	return groups
+}
+
+// GetMembership returns the membership of content with optional content entry `oc` (the OC entry
+// of an XObject or annotation, or a marked-content property list), which refers either to a group
+// or a membership dictionary (OCMD).  Returns nil if `oc` is nil, i.e. the content is not optional.
+func (this *PdfOCProperties) GetMembership(oc PdfObject) (*PdfOCMembership, error) {
+	if oc == nil {
+		return nil, nil
+	}
+	if ocg := this.GetGroup(oc); ocg != nil {
+		return &PdfOCMembership{OCGs: []*PdfOptionalContentGroup{ocg}, P: "AnyOn"}, nil
+	}
+
+	dict, ok := TraceToDirectObject(oc).(*PdfObjectDictionary)
+	if !ok {
+		return nil, errors.New("Type check error")
+	}
+	if t, ok := dict.Get("Type").(*PdfObjectName); !ok || *t != "OCMD" {
+		common.Log.Debug("Optional content entry neither a known OCG nor an OCMD")
+		return nil, errors.New("Invalid optional content entry")
+	}
+
+	membership := &PdfOCMembership{P: "AnyOn"}
+	ocgs := dict.Get("OCGs")
+	if ocg := this.GetGroup(ocgs); ocg != nil {
+		membership.OCGs = []*PdfOptionalContentGroup{ocg}
+	} else {
+		membership.OCGs = this.getGroupsFromArray(ocgs)
+	}
+	if p, ok := TraceToDirectObject(dict.Get("P")).(*PdfObjectName); ok {
+		membership.P = string(*p)
+	}
+	membership.VE = dict.Get("VE")
+	return membership, nil
+}
+
+// IsGroupVisible returns true if `ocg` is visible in the default configuration.
+func (this *PdfOCProperties) IsGroupVisible(ocg *PdfOptionalContentGroup) bool {
+	if this.D == nil {
+		return true
+	}
+	for _, g := range this.D.OFF {
+		if g == ocg {
+			return false
+		}
+	}
+	for _, g := range this.D.ON {
+		if g == ocg {
+			return true
+		}
+	}
+	return this.D.BaseState != "OFF"
+}
+
+// IsVisible returns true if content with optional content entry `oc` is visible in the default
+// configuration.  Content without an entry is always visible.  Visibility expressions (VE) are not
+// evaluated, the visibility policy (P) is used instead.
+func (this *PdfOCProperties) IsVisible(oc PdfObject) (bool, error) {
+	membership, err := this.GetMembership(oc)
+	if err != nil || membership == nil {
+		return true, err
+	}
+	if len(membership.OCGs) == 0 {
+		return true, nil
+	}
+
+	numOn := 0
+	for _, ocg := range membership.OCGs {
+		if this.IsGroupVisible(ocg) {
+			numOn++
+		}
+	}
+	switch membership.P {
+	case "AllOn":
+		return numOn == len(membership.OCGs), nil
+	case "AnyOff":
+		return numOn < len(membership.OCGs), nil
+	case "AllOff":
+		return numOn == 0, nil
+	}
+	return numOn > 0, nil
+}
@@ -0,0 +1,308 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// Test creating layers, assigning a watermark and content to them, and reading them back.
+func TestOptionalContentLayers(t *testing.T) {
+	props := NewPdfOCProperties()
+	wmLayer := NewPdfOptionalContentGroup("Watermark")
+	notesLayer := NewPdfOptionalContentGroup("Notes")
+	props.AddGroup(wmLayer, true)
+	props.AddGroup(notesLayer, false)
+
+	page := NewPdfPage()
+	page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+	img := &Image{Width: 1, Height: 1, BitsPerComponent: 8, ColorComponents: 1, Data: []byte{0x80}}
+	ximg, err := NewXObjectImageFromImage(img, nil, NewRawEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	err = page.AddWatermarkImage(ximg, WatermarkImageOptions{Alpha: 0.5, Layer: wmLayer})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	err = page.AddContentStreamByStringToLayer("BT /F1 12 Tf (Note) Tj ET", notesLayer)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	w := NewPdfWriter()
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	w.SetOCProperties(props.ToPdfObject())
+	data, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	loaded, err := reader.GetOptionalContent()
+	if err != nil || loaded == nil {
+		t.Fatalf("Error loading optional content: %v", err)
+	}
+	if len(loaded.OCGs) != 2 || loaded.OCGs[0].Name != "Watermark" || loaded.OCGs[1].Name != "Notes" {
+		t.Fatalf("Unexpected layers: %d", len(loaded.OCGs))
+	}
+	if len(loaded.D.Order) != 2 || loaded.D.Order[1].Group != loaded.OCGs[1] {
+		t.Errorf("Unexpected Order")
+	}
+	if !loaded.IsGroupVisible(loaded.OCGs[0]) || loaded.IsGroupVisible(loaded.OCGs[1]) {
+		t.Errorf("Unexpected layer visibility")
+	}
+
+	page, err = reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	xobj, xtype := page.Resources.GetXObjectByName("Imw0")
+	if xtype != XObjectTypeImage {
+		t.Fatalf("Watermark image not found")
+	}
+	wm, err := NewXObjectImageFromStream(xobj)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	membership, err := loaded.GetMembership(wm.OC)
+	if err != nil || membership == nil || len(membership.OCGs) != 1 || membership.OCGs[0] != loaded.OCGs[0] {
+		t.Fatalf("Unexpected watermark membership: %v (%v)", membership, err)
+	}
+
+	propsDict, ok := TraceToDirectObject(page.Resources.Properties).(*PdfObjectDictionary)
+	if !ok {
+		t.Fatalf("Missing Properties resources")
+	}
+	if ocg := loaded.GetGroup(propsDict.Get("OC0")); ocg != loaded.OCGs[1] {
+		t.Errorf("Property list OC0 does not refer to the Notes layer")
+	}
+	contents, err := page.GetAllContentStreams()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !strings.Contains(contents, "/OC /OC0 BDC") {
+		t.Errorf("Layer content not marked: %s", contents)
+	}
+}
+
+// Test the visibility of content depending on several groups via a membership dictionary.
+func TestOptionalContentMembershipPolicy(t *testing.T) {
+	props := NewPdfOCProperties()
+	a := NewPdfOptionalContentGroup("A")
+	b := NewPdfOptionalContentGroup("B")
+	props.AddGroup(a, true)
+	props.AddGroup(b, false)
+
+	testcases := []struct {
+		P        string
+		Expected bool
+	}{
+		{"", true},
+		{"AnyOn", true},
+		{"AllOn", false},
+		{"AnyOff", true},
+		{"AllOff", false},
+	}
+	for _, tcase := range testcases {
+		ocmd := MakeDict()
+		ocmd.Set("Type", MakeName("OCMD"))
+		ocmd.Set("OCGs", &PdfObjectArray{a.ToPdfObject(), b.ToPdfObject()})
+		if tcase.P != "" {
+			ocmd.Set("P", MakeName(tcase.P))
+		}
+		visible, err := props.IsVisible(ocmd)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if visible != tcase.Expected {
+			t.Errorf("P=%q: visible %v != %v", tcase.P, visible, tcase.Expected)
+		}
+	}
+
+	if visible, err := props.IsVisible(nil); err != nil || !visible {
+		t.Errorf("Content without OC entry should be visible")
+	}
+	if visible, err := props.IsVisible(b.ToPdfObject()); err != nil || visible {
+		t.Errorf("Content of hidden group should not be visible")
+	}
+}
+
+// Test that loading optional content and converting back without edits leaves the OCProperties
+// subtree unchanged.
+func TestOptionalContentRoundTrip(t *testing.T) {
+	usage := MakeDict()
+	zoom := MakeDict()
+	zoom.Set("min", MakeFloat(1.25))
+	zoom.Set("max", MakeFloat(10.0))
+	usage.Set("Zoom", zoom)
+
+	ocg1 := MakeDict()
+	ocg1.Set("Type", MakeName("OCG"))
+	ocg1.Set("Name", MakeString("Base"))
+	ocg1.Set("Intent", &PdfObjectArray{MakeName("View"), MakeName("Design")})
+	ocg1.Set("Usage", usage)
+	ocg2 := MakeDict()
+	ocg2.Set("Name", MakeString("Detail"))
+	ocg2.Set("Type", MakeName("OCG"))
+	ind1 := MakeIndirectObject(ocg1)
+	ind2 := MakeIndirectObject(ocg2)
+
+	d := MakeDict()
+	d.Set("Name", MakeString("Default"))
+	d.Set("BaseState", MakeName("ON"))
+	d.Set("OFF", &PdfObjectArray{ind2})
+	d.Set("Order", &PdfObjectArray{
+		ind1,
+		&PdfObjectArray{ind2},
+		&PdfObjectArray{MakeString("Group"), ind2},
+	})
+	d.Set("ListMode", MakeName("VisiblePages"))
+	ocprops := MakeDict()
+	ocprops.Set("OCGs", &PdfObjectArray{ind1, ind2})
+	ocprops.Set("D", d)
+
+	page := NewPdfPage()
+	page.Resources = NewPdfPageResources()
+	page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+	w := NewPdfWriter()
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	w.SetOCProperties(ocprops)
+	data, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	obj, err := reader.GetOCProperties()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	snapshot := func() []string {
+		dict := TraceToDirectObject(obj).(*PdfObjectDictionary)
+		strs := []string{dict.DefaultWriteString(), TraceToDirectObject(dict.Get("D")).DefaultWriteString()}
+		for _, o := range *TraceToDirectObject(dict.Get("OCGs")).(*PdfObjectArray) {
+			strs = append(strs, TraceToDirectObject(o).DefaultWriteString())
+		}
+		return strs
+	}
+	before := snapshot()
+
+	props, err := reader.GetOptionalContent()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(props.D.Order) != 2 || len(props.D.Order[0].Children) != 1 || props.D.Order[1].Label != "Group" {
+		t.Fatalf("Unexpected Order")
+	}
+	props.ToPdfObject()
+
+	after := snapshot()
+	if len(before) != len(after) {
+		t.Fatalf("Length mismatch %d != %d", len(before), len(after))
+	}
+	for i := range before {
+		if before[i] != after[i] {
+			t.Errorf("OCProperties changed:\n%s\n%s", before[i], after[i])
+		}
+	}
+}
+
+// Test that the indirect D, OCGs, Configs and Order entries of loaded optional content are kept
+// as the same indirect objects when converting back, with or without edits.
+func TestOptionalContentRoundTripIndirect(t *testing.T) {
+	ocg := MakeDict()
+	ocg.Set("Type", MakeName("OCG"))
+	ocg.Set("Name", MakeString("Base"))
+	ind := MakeIndirectObject(ocg)
+	d := MakeDict()
+	d.Set("Name", MakeString("Default"))
+	d.Set("Order", MakeIndirectObject(&PdfObjectArray{ind}))
+	config := MakeDict()
+	config.Set("Name", MakeString("Other"))
+	config.Set("OFF", &PdfObjectArray{ind})
+	ocprops := MakeDict()
+	ocprops.Set("OCGs", MakeIndirectObject(&PdfObjectArray{ind}))
+	ocprops.Set("D", MakeIndirectObject(d))
+	ocprops.Set("Configs", &PdfObjectArray{MakeIndirectObject(config)})
+
+	page := NewPdfPage()
+	page.Resources = NewPdfPageResources()
+	page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+	w := NewPdfWriter()
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	w.SetOCProperties(ocprops)
+	data, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	obj, err := reader.GetOCProperties()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	dict := TraceToDirectObject(obj).(*PdfObjectDictionary)
+	entries := func() (PdfObject, PdfObject, PdfObject, PdfObject) {
+		configs := TraceToDirectObject(dict.Get("Configs")).(*PdfObjectArray)
+		order := TraceToDirectObject(dict.Get("D")).(*PdfObjectDictionary).Get("Order")
+		return dict.Get("D"), dict.Get("OCGs"), (*configs)[0], order
+	}
+	d1, ocgs1, config1, order1 := entries()
+	for _, o := range []PdfObject{d1, ocgs1, config1, order1} {
+		if _, ok := o.(*PdfIndirectObject); !ok {
+			t.Fatalf("Loaded entry not indirect (%T)", o)
+		}
+	}
+	dStr := TraceToDirectObject(d1).DefaultWriteString()
+
+	props, err := reader.GetOptionalContent()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	props.ToPdfObject()
+	d2, ocgs2, config2, order2 := entries()
+	if d2 != d1 || ocgs2 != ocgs1 || config2 != config1 || order2 != order1 {
+		t.Errorf("Entries replaced without edits: %T %T %T %T", d2, ocgs2, config2, order2)
+	}
+	if s := TraceToDirectObject(d2).DefaultWriteString(); s != dStr {
+		t.Errorf("D changed without edits:\n%s\n%s", dStr, s)
+	}
+
+	// Edits are written into the indirect objects.
+	props.AddGroup(NewPdfOptionalContentGroup("Added"), false)
+	props.D.Order = []*PdfOCOrderItem{{Group: props.OCGs[1]}}
+	props.ToPdfObject()
+	d3, ocgs3, _, order3 := entries()
+	if d3 != d1 || ocgs3 != ocgs1 || order3 != order1 {
+		t.Fatalf("Entries replaced by edits: %T %T %T", d3, ocgs3, order3)
+	}
+	if arr := TraceToDirectObject(ocgs3).(*PdfObjectArray); len(*arr) != 2 {
+		t.Errorf("OCGs %v, expected 2 groups", arr)
+	}
+	if arr := TraceToDirectObject(order3).(*PdfObjectArray); len(*arr) != 1 || (*arr)[0] != props.OCGs[1].ToPdfObject() {
+		t.Errorf("Order %v, expected the added group", arr)
+	}
+}
@@ -16,9 +16,11 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync/atomic"
 
 	"github.com/unidoc/unidoc/common"
 	. "github.com/unidoc/unidoc/pdf/core"
+	"github.com/unidoc/unidoc/pdf/internal/balance"
 )
 
 // PDF page object (7.7.3.3 - Table 30).
@@ -57,6 +59,13 @@ type PdfPage struct {
 	// Primitive container.
 	pageDict  *PdfObjectDictionary
 	primitive *PdfIndirectObject
+
+	// Reader of the document the page was loaded from, nil for new pages.
+	reader *PdfReader
+
+	// Attributes inherited from the ancestor Pages nodes (*pageInheritedAttrs), cached by
+	// getInheritedAttrs.
+	inherited atomic.Value
 }
 
 func NewPdfPage() *PdfPage {
@@ -90,6 +99,7 @@ func (this *PdfPage) Duplicate() *PdfPage {
 func (reader *PdfReader) newPdfPageFromDict(p *PdfObjectDictionary) (*PdfPage, error) {
 	page := NewPdfPage()
 	page.pageDict = p //XXX?
+	page.reader = reader
 
 	d := *p
 
@@ -139,15 +149,12 @@ func (reader *PdfReader) newPdfPageFromDict(p *PdfObjectDictionary) (*PdfPage, e
 			return nil, err
 		}
 	} else {
-		// If Resources not explicitly defined, look up the tree (Parent objects) using
-		// the getResources() function. Resources should always be accessible.
-		resources, err := page.getResources()
+		// If Resources not explicitly defined, look up the tree (Parent objects).
+		// Resources should always be accessible.
+		resources, err := page.EffectiveResources()
 		if err != nil {
 			return nil, err
 		}
-		if resources == nil {
-			resources = NewPdfPageResources()
-		}
 		page.Resources = resources
 	}
 
@@ -361,83 +368,269 @@ func (reader *PdfReader) LoadAnnotations(d *PdfObjectDictionary) ([]*PdfAnnotati
 	return annotations, nil
 }
 
-// Get the inheritable media box value, either from the page
-// or a higher up page/pages struct.
-func (this *PdfPage) GetMediaBox() (*PdfRectangle, error) {
-	if this.MediaBox != nil {
-		return this.MediaBox, nil
+// GetPieceInfo returns the page-piece dictionary (PieceInfo) holding private application data, or
+// nil if not present.  The contents are kept as loaded and written back unchanged.
+func (this *PdfPage) GetPieceInfo() PdfObject {
+	return this.PieceInfo
+}
+
+// SetPieceInfo sets the page-piece dictionary (PieceInfo).  When modifying the page contents in a way
+// that invalidates the private data, the LastModified date of the page should be updated as well.
+func (this *PdfPage) SetPieceInfo(pieceInfo PdfObject) {
+	this.PieceInfo = pieceInfo
+}
+
+// pageInheritedAttrs caches the attributes a page inherits from its ancestor Pages nodes, resolved in
+// one walk up the Parent chain.  Valid while the page Parent, the page dictionary and the dictionaries
+// of the chain and of the inherited resources are unchanged (per ChangeCount).  Not modified once
+// built, so that concurrent readers can share it.
+type pageInheritedAttrs struct {
+	parent PdfObject
+	// The page dictionary followed by the ancestor Pages nodes up to the root (or an invalid node).
+	path []dictState
+	// The inherited resource dictionary and its ColorSpace dictionary (parsed by
+	// NewPdfPageResourcesFromDict rather than referenced).
+	resourceDicts []dictState
+
+	resources    *PdfPageResources
+	resourcesErr error
+	mediaBox     *PdfRectangle
+	mediaBoxErr  error
+	cropBox      *PdfRectangle
+	cropBoxErr   error
+	rotate       int64
+	rotateErr    error
+}
+
+// dictState records the change count of a dictionary, and the indirect object containing it if any.
+type dictState struct {
+	container *PdfIndirectObject
+	dict      *PdfObjectDictionary
+	changes   uint64
+}
+
+func makeDictState(container *PdfIndirectObject, dict *PdfObjectDictionary) dictState {
+	state := dictState{container: container, dict: dict}
+	if dict != nil {
+		state.changes = dict.ChangeCount()
 	}
+	return state
+}
 
+// unchanged checks whether the dictionary has not been modified or replaced in its container since
+// the state was recorded.  An invalid (nil) dictionary is never considered unchanged.
+func (s dictState) unchanged() bool {
+	if s.dict == nil || s.dict.ChangeCount() != s.changes {
+		return false
+	}
+	return s.container == nil || s.container.PdfObject == s.dict
+}
+
+// valid checks whether the cached attributes still apply to `page`.
+func (this *pageInheritedAttrs) valid(page *PdfPage) bool {
+	if this.parent != page.Parent || this.path[0].dict != page.pageDict {
+		return false
+	}
+	for _, state := range this.path {
+		if !state.unchanged() {
+			return false
+		}
+	}
+	for _, state := range this.resourceDicts {
+		if !state.unchanged() {
+			return false
+		}
+	}
+	return true
+}
+
+// getInheritedAttrs returns the attributes inherited by the page, resolving them again if the cached
+// values are no longer valid.
+func (this *PdfPage) getInheritedAttrs() *pageInheritedAttrs {
+	if attrs, _ := this.inherited.Load().(*pageInheritedAttrs); attrs != nil && attrs.valid(this) {
+		return attrs
+	}
+	attrs := this.resolveInheritedAttrs()
+	this.inherited.Store(attrs)
+	return attrs
+}
+
+// resolveInheritedAttrs looks up the inheritable attributes in the ancestor Pages nodes of the page,
+// starting with the direct parent, the nearest definition of each applying.  A cycle or an invalid
+// node in the Parent chain is an error for the attributes not defined below it.
+func (this *PdfPage) resolveInheritedAttrs() *pageInheritedAttrs {
+	attrs := &pageInheritedAttrs{
+		parent: this.Parent,
+		path:   []dictState{makeDictState(nil, this.pageDict)},
+	}
+
+	found := map[PdfObjectName]PdfObject{}
+	var walkErr error
+	visited := map[PdfObject]bool{}
 	node := this.Parent
 	for node != nil {
+		if visited[node] {
+			common.Log.Debug("ERROR: Cycle in page tree Parent chain")
+			walkErr = errors.New("Page tree cycle")
+			break
+		}
+		visited[node] = true
+
 		dictObj, ok := node.(*PdfIndirectObject)
 		if !ok {
-			return nil, errors.New("Invalid parent object")
+			walkErr = errors.New("Invalid parent object")
+			break
 		}
 
 		dict, ok := dictObj.PdfObject.(*PdfObjectDictionary)
+		attrs.path = append(attrs.path, makeDictState(dictObj, dict))
 		if !ok {
-			return nil, errors.New("Invalid parent objects dictionary")
+			walkErr = errors.New("Invalid parent objects dictionary")
+			break
 		}
 
-		if obj := dict.Get("MediaBox"); obj != nil {
-			arr, ok := obj.(*PdfObjectArray)
-			if !ok {
-				return nil, errors.New("Invalid media box")
+		for _, name := range []PdfObjectName{"Resources", "MediaBox", "CropBox", "Rotate"} {
+			if obj := dict.Get(name); obj != nil && found[name] == nil {
+				found[name] = obj
 			}
-			rect, err := NewPdfRectangle(*arr)
+		}
 
-			if err != nil {
-				return nil, err
-			}
+		// Keep moving up the tree...
+		node = dict.Get("Parent")
+	}
 
-			return rect, nil
+	if obj := found["Resources"]; obj != nil {
+		attrs.resources, attrs.resourcesErr = attrs.parseResources(obj)
+	} else if walkErr != nil {
+		attrs.resourcesErr = walkErr
+	} else {
+		attrs.resources = NewPdfPageResources()
+	}
+
+	if obj := found["MediaBox"]; obj != nil {
+		attrs.mediaBox, attrs.mediaBoxErr = parseInheritedRectangle("MediaBox", obj)
+	} else if walkErr != nil {
+		attrs.mediaBoxErr = walkErr
+	} else {
+		attrs.mediaBoxErr = errors.New("Media box not defined")
+	}
+
+	if obj := found["CropBox"]; obj != nil {
+		attrs.cropBox, attrs.cropBoxErr = parseInheritedRectangle("CropBox", obj)
+	} else {
+		attrs.cropBoxErr = walkErr
+	}
+
+	if obj := found["Rotate"]; obj != nil {
+		if iObj, ok := TraceToDirectObject(obj).(*PdfObjectInteger); ok {
+			attrs.rotate = normalizeRotation(int64(*iObj))
+		} else {
+			attrs.rotateErr = errors.New("Invalid Page Rotate object")
 		}
+	} else {
+		attrs.rotateErr = walkErr
+	}
 
-		node = dict.Get("Parent")
+	return attrs
+}
+
+// parseResources parses the inherited resources `obj`, recording the dictionaries parsed.
+func (this *pageInheritedAttrs) parseResources(obj PdfObject) (*PdfPageResources, error) {
+	container, _ := obj.(*PdfIndirectObject)
+	prDict, ok := TraceToDirectObject(obj).(*PdfObjectDictionary)
+	if !ok {
+		return nil, errors.New("Invalid resource dict!")
 	}
+	this.resourceDicts = append(this.resourceDicts, makeDictState(container, prDict))
+	if csObj := prDict.Get("ColorSpace"); csObj != nil {
+		csContainer, _ := csObj.(*PdfIndirectObject)
+		if csDict, ok := TraceToDirectObject(csObj).(*PdfObjectDictionary); ok {
+			this.resourceDicts = append(this.resourceDicts, makeDictState(csContainer, csDict))
+		}
+	}
+	return NewPdfPageResourcesFromDict(prDict)
+}
 
-	return nil, errors.New("Media box not defined")
+// parseInheritedRectangle parses the inherited rectangle attribute `name`.
+func parseInheritedRectangle(name PdfObjectName, obj PdfObject) (*PdfRectangle, error) {
+	arr, ok := TraceToDirectObject(obj).(*PdfObjectArray)
+	if !ok {
+		return nil, fmt.Errorf("Invalid %s", name)
+	}
+	return NewPdfRectangle(*arr)
 }
 
-// Get the inheritable resources, either from the page or or a higher up page/pages struct.
-func (this *PdfPage) getResources() (*PdfPageResources, error) {
+// EffectiveResources returns the resources of the page, either defined by the page itself or
+// inherited from an ancestor Pages node.  If no resources are defined, empty resources are returned.
+// Inherited values are cached on the page until the page dictionary, an ancestor node on the Parent
+// chain or the inherited resource dictionary (or its ColorSpace dictionary) is modified.
+func (this *PdfPage) EffectiveResources() (*PdfPageResources, error) {
 	if this.Resources != nil {
 		return this.Resources, nil
 	}
 
-	node := this.Parent
-	for node != nil {
-		dictObj, ok := node.(*PdfIndirectObject)
-		if !ok {
-			return nil, errors.New("Invalid parent object")
-		}
+	attrs := this.getInheritedAttrs()
+	return attrs.resources, attrs.resourcesErr
+}
 
-		dict, ok := dictObj.PdfObject.(*PdfObjectDictionary)
-		if !ok {
-			return nil, errors.New("Invalid parent objects dictionary")
-		}
+// EffectiveMediaBox returns the media box of the page, either defined by the page itself or
+// inherited from an ancestor Pages node.  The media box is required, an error is returned if
+// not defined.
+func (this *PdfPage) EffectiveMediaBox() (*PdfRectangle, error) {
+	if this.MediaBox != nil {
+		return this.MediaBox, nil
+	}
 
-		if obj := dict.Get("Resources"); obj != nil {
-			prDict, ok := TraceToDirectObject(obj).(*PdfObjectDictionary)
-			if !ok {
-				return nil, errors.New("Invalid resource dict!")
-			}
-			resources, err := NewPdfPageResourcesFromDict(prDict)
+	attrs := this.getInheritedAttrs()
+	return attrs.mediaBox, attrs.mediaBoxErr
+}
 
-			if err != nil {
-				return nil, err
-			}
+// EffectiveCropBox returns the crop box of the page, either defined by the page itself or inherited
+// from an ancestor Pages node.  Defaults to the effective media box if not defined.
+func (this *PdfPage) EffectiveCropBox() (*PdfRectangle, error) {
+	if this.CropBox != nil {
+		return this.CropBox, nil
+	}
 
-			return resources, nil
-		}
+	attrs := this.getInheritedAttrs()
+	if attrs.cropBoxErr != nil {
+		return nil, attrs.cropBoxErr
+	}
+	if attrs.cropBox == nil {
+		return this.EffectiveMediaBox()
+	}
+	return attrs.cropBox, nil
+}
 
-		// Keep moving up the tree...
-		node = dict.Get("Parent")
+// EffectiveRotate returns the rotation of the page in degrees, either defined by the page itself or
+// inherited from an ancestor Pages node.  The value is normalized to 0, 90, 180 or 270, and
+// defaults to 0 if not defined.
+func (this *PdfPage) EffectiveRotate() (int64, error) {
+	if this.Rotate != nil {
+		return normalizeRotation(*this.Rotate), nil
 	}
 
-	// No resources defined...
-	return nil, nil
+	attrs := this.getInheritedAttrs()
+	return attrs.rotate, attrs.rotateErr
+}
+
+// normalizeRotation maps a rotation in degrees to 0, 90, 180 or 270.  Values that are not a multiple
+// of 90 (invalid) are rounded down to the nearest multiple.
+func normalizeRotation(rotate int64) int64 {
+	if rotate%90 != 0 {
+		common.Log.Debug("Invalid page rotation %d, not a multiple of 90", rotate)
+	}
+	rotate = rotate % 360
+	if rotate < 0 {
+		rotate += 360
+	}
+	return rotate - rotate%90
+}
+
+// Get the inheritable media box value, either from the page
+// or a higher up page/pages struct.
+func (this *PdfPage) GetMediaBox() (*PdfRectangle, error) {
+	return this.EffectiveMediaBox()
 }
 
 // Convert the Page to a PDF object dictionary.
@@ -656,6 +849,7 @@ type WatermarkImageOptions struct {
 	Alpha               float64
 	FitToWidth          bool
 	PreserveAspectRatio bool
+	Layer               *PdfOptionalContentGroup // Optional content group (layer) of the watermark, if set.
 }
 
 // Add a watermark to the page.
@@ -685,6 +879,10 @@ func (this *PdfPage) AddWatermarkImage(ximg *XObjectImage, opt WatermarkImageOpt
 		this.Resources = NewPdfPageResources()
 	}
 
+	if opt.Layer != nil {
+		ximg.OC = opt.Layer.ToPdfObject()
+	}
+
 	// Find available image name for this page.
 	i := 0
 	imgName := PdfObjectName(fmt.Sprintf("Imw%d", i))
@@ -698,17 +896,12 @@ func (this *PdfPage) AddWatermarkImage(ximg *XObjectImage, opt WatermarkImageOpt
 		return err
 	}
 
-	i = 0
-	gsName := PdfObjectName(fmt.Sprintf("GS%d", i))
-	for this.HasExtGState(gsName) {
-		i++
-		gsName = PdfObjectName(fmt.Sprintf("GS%d", i))
-	}
-	gs0 := MakeDict()
-	gs0.Set("BM", MakeName("Normal"))
-	gs0.Set("CA", MakeFloat(opt.Alpha))
-	gs0.Set("ca", MakeFloat(opt.Alpha))
-	err = this.AddExtGState(gsName, gs0)
+	gs := NewPdfExtGState()
+	blendMode := PdfObjectName("Normal")
+	gs.BM = &blendMode
+	gs.CA = &opt.Alpha
+	gs.Ca = &opt.Alpha
+	gsName, err := this.Resources.AddPdfExtGState(gs)
 	if err != nil {
 		return err
 	}
@@ -718,11 +911,107 @@ func (this *PdfPage) AddWatermarkImage(ximg *XObjectImage, opt WatermarkImageOpt
 		"%.0f 0 0 %.0f %.4f %.4f cm\n"+
 		"/%s Do\n"+
 		"Q", gsName, wWidth, wHeight, xOffset, yOffset, imgName)
+	err = this.WrapContentsIfNeeded()
+	if err != nil {
+		return err
+	}
 	this.AddContentStreamByString(contentStr)
 
 	return nil
 }
 
+// AddContentStreamByStringToLayer adds the content string `contentStr` as optional content of the
+// layer `ocg`, i.e. wrapped in an /OC marked-content sequence with a property list added to the
+// page resources.
+func (this *PdfPage) AddContentStreamByStringToLayer(contentStr string, ocg *PdfOptionalContentGroup) error {
+	if this.Resources == nil {
+		this.Resources = NewPdfPageResources()
+	}
+	if this.Resources.Properties == nil {
+		this.Resources.Properties = MakeDict()
+	}
+	propsDict, ok := TraceToDirectObject(this.Resources.Properties).(*PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("Expected Properties dictionary is not a dictionary: %v", TraceToDirectObject(this.Resources.Properties))
+		return errors.New("Type check error")
+	}
+
+	// Reuse the name of the layer if already in the resources.
+	ocgObj := ocg.ToPdfObject()
+	var propName PdfObjectName
+	for _, key := range propsDict.Keys() {
+		if propsDict.Get(key) == ocgObj {
+			propName = key
+			break
+		}
+	}
+	if propName == "" {
+		i := 0
+		propName = PdfObjectName(fmt.Sprintf("OC%d", i))
+		for propsDict.Get(propName) != nil {
+			i++
+			propName = PdfObjectName(fmt.Sprintf("OC%d", i))
+		}
+		propsDict.Set(propName, ocgObj)
+	}
+
+	err := this.WrapContentsIfNeeded()
+	if err != nil {
+		return err
+	}
+	this.AddContentStreamByString(fmt.Sprintf("/OC /%s BDC\n%s\nEMC", propName, contentStr))
+	return nil
+}
+
+// WrapContentsIfNeeded wraps the page contents within q ... Q if they are not already wrapped or
+// the q/Q and BT/ET operators are unbalanced: unmatched Qs are absorbed by extra leading qs and
+// an open text object is closed. Ensures that content appended afterwards starts in the default
+// graphics state and outside a text object. The existing content streams are left unchanged; the
+// repair is done by adding content streams before and after them.
+func (this *PdfPage) WrapContentsIfNeeded() error {
+	contents, err := this.GetAllContentStreams()
+	if err != nil {
+		return err
+	}
+	ops := balance.Operators([]byte(contents))
+	if len(ops) == 0 {
+		return nil
+	}
+	result := balance.Check(ops)
+	if result.IsBalanced() && balance.IsWrapped(ops) {
+		return nil
+	}
+	if !result.IsBalanced() {
+		common.Log.Debug("Page contents unbalanced (%+v) - repairing", result)
+	}
+
+	prefix, suffix := result.Repair()
+	this.prependContentStreamByString(strings.Join(prefix, " "))
+	this.AddContentStreamByString(strings.Join(suffix, " "))
+	return nil
+}
+
+// prependContentStreamByString puts the content string into a stream object placed before the
+// existing content streams of the page.
+func (this *PdfPage) prependContentStreamByString(contentStr string) {
+	stream := PdfObjectStream{}
+
+	sDict := MakeDict()
+	stream.PdfObjectDictionary = sDict
+
+	sDict.Set("Length", MakeInteger(int64(len(contentStr))))
+	stream.Stream = []byte(contentStr)
+
+	if this.Contents == nil {
+		this.Contents = &stream
+	} else if contArray, isArray := TraceToDirectObject(this.Contents).(*PdfObjectArray); isArray {
+		*contArray = append(PdfObjectArray{&stream}, *contArray...)
+	} else {
+		contArray := PdfObjectArray{&stream, this.Contents}
+		this.Contents = &contArray
+	}
+}
+
 // Add content stream by string.  Puts the content string into a stream
 // object and points the content stream towards it.
 func (this *PdfPage) AddContentStreamByString(contentStr string) {
@@ -308,3 +308,166 @@ func TestRect(t *testing.T) {
 		return
 	}
 }
+
+// Test resolution of inheritable page attributes defined at different levels of the page tree.
+func TestPageEffectiveAttributes(t *testing.T) {
+	// Root Pages node defines MediaBox, intermediate node Rotate, direct parent Resources.
+	rootDict := MakeDict()
+	rootDict.Set("Type", MakeName("Pages"))
+	rootDict.Set("MediaBox", MakeArrayFromFloats([]float64{0, 0, 612, 792}))
+	root := MakeIndirectObject(rootDict)
+
+	midDict := MakeDict()
+	midDict.Set("Type", MakeName("Pages"))
+	midDict.Set("Parent", root)
+	midDict.Set("Rotate", MakeInteger(-90))
+	mid := MakeIndirectObject(midDict)
+
+	font := MakeDict()
+	font.Set("Type", MakeName("Font"))
+	fonts := MakeDict()
+	fonts.Set("F1", font)
+	resDict := MakeDict()
+	resDict.Set("Font", fonts)
+	parentDict := MakeDict()
+	parentDict.Set("Type", MakeName("Pages"))
+	parentDict.Set("Parent", mid)
+	parentDict.Set("Resources", resDict)
+	parent := MakeIndirectObject(parentDict)
+
+	page := NewPdfPage()
+	page.Parent = parent
+
+	resources, err := page.EffectiveResources()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, has := resources.GetFontByName("F1"); !has {
+		t.Errorf("Inherited font F1 missing")
+	}
+
+	mbox, err := page.EffectiveMediaBox()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if mbox.Urx != 612 || mbox.Ury != 792 {
+		t.Errorf("Invalid media box %+v", mbox)
+	}
+
+	// The inherited values are cached until the page or an ancestor is modified.
+	if again, err := page.EffectiveResources(); err != nil || again != resources {
+		t.Errorf("Resources not cached (%v)", err)
+	}
+	if again, err := page.EffectiveMediaBox(); err != nil || again != mbox {
+		t.Errorf("Media box not cached (%v)", err)
+	}
+	page.pageDict.Set("Dummy", MakeNull())
+	if again, err := page.EffectiveMediaBox(); err != nil || again == mbox || *again != *mbox {
+		t.Errorf("Media box not resolved again after page edit %+v (%v)", again, err)
+	}
+
+	// CropBox defaults to MediaBox.
+	cbox, err := page.EffectiveCropBox()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if *cbox != *mbox {
+		t.Errorf("Crop box %+v != media box %+v", cbox, mbox)
+	}
+
+	rotate, err := page.EffectiveRotate()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if rotate != 270 {
+		t.Errorf("Rotate %d != 270", rotate)
+	}
+
+	// Page overriding only CropBox.
+	page.CropBox = &PdfRectangle{Llx: 10, Lly: 10, Urx: 100, Ury: 100}
+	cbox, err = page.EffectiveCropBox()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if cbox.Urx != 100 {
+		t.Errorf("Invalid crop box %+v", cbox)
+	}
+	mbox, err = page.EffectiveMediaBox()
+	if err != nil || mbox.Urx != 612 {
+		t.Errorf("Invalid media box %+v (%v)", mbox, err)
+	}
+
+	// Changing the parent invalidates the cached values.
+	otherDict := MakeDict()
+	otherDict.Set("Type", MakeName("Pages"))
+	otherDict.Set("MediaBox", MakeArrayFromFloats([]float64{0, 0, 100, 200}))
+	page.Parent = MakeIndirectObject(otherDict)
+	mbox, err = page.EffectiveMediaBox()
+	if err != nil || mbox.Ury != 200 {
+		t.Errorf("Invalid media box after parent change %+v (%v)", mbox, err)
+	}
+	rotate, err = page.EffectiveRotate()
+	if err != nil || rotate != 0 {
+		t.Errorf("Rotate should default to 0 (%d, %v)", rotate, err)
+	}
+
+	// Editing the inherited attributes of an ancestor is reflected as well.
+	page.Parent = parent
+	if _, err := page.EffectiveResources(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	rootDict.Set("MediaBox", MakeArrayFromFloats([]float64{0, 0, 300, 400}))
+	midDict.Set("Rotate", MakeInteger(180))
+	fonts2 := MakeDict()
+	fonts2.Set("F2", font)
+	resDict.Set("Font", fonts2)
+	mbox, err = page.EffectiveMediaBox()
+	if err != nil || mbox.Ury != 400 {
+		t.Errorf("Invalid media box after parent edit %+v (%v)", mbox, err)
+	}
+	rotate, err = page.EffectiveRotate()
+	if err != nil || rotate != 180 {
+		t.Errorf("Invalid rotate after parent edit (%d, %v)", rotate, err)
+	}
+	resources, err = page.EffectiveResources()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, has := resources.GetFontByName("F2"); !has {
+		t.Errorf("Font F2 missing after parent edit")
+	}
+	// Nested edits in place are reflected too.
+	colorspaces := MakeDict()
+	colorspaces.Set("CS1", MakeName("DeviceGray"))
+	resDict.Set("ColorSpace", colorspaces)
+	if _, err := page.EffectiveResources(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	colorspaces.Set("CS2", MakeName("DeviceRGB"))
+	resources, err = page.EffectiveResources()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, has := resources.GetColorspaceByName("CS2"); !has {
+		t.Errorf("Colorspace CS2 missing after nested edit")
+	}
+	rootDict.Set("Resources", MakeDict())
+	midDict.Set("Resources", MakeDict())
+	resources, err = page.EffectiveResources()
+	if err != nil || resources.Font == nil {
+		t.Errorf("Nearest ancestor resources should apply (%v)", err)
+	}
+	parentDict.Remove("Resources")
+	resources, err = page.EffectiveResources()
+	if err != nil || resources.Font != nil {
+		t.Errorf("Resources of intermediate node should apply after removal (%v)", err)
+	}
+
+	// Cycle in the Parent chain.
+	rootDict.Set("Parent", parent)
+	page.Parent = parent
+	page.CropBox = nil
+	if _, err := page.EffectiveCropBox(); err == nil {
+		t.Errorf("Should fail on a Parent cycle")
+	}
+}
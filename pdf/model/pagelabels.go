@@ -0,0 +1,185 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/unidoc/unidoc/common"
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// PdfPageLabelRange is a range of pages with the same page labelling (12.4.2 - Table 159).  The
+// range starts at page index StartIndex and ends at the start of the next range.  The pages are
+// labelled with Prefix followed by the page numbers in Style, the first page of the range having
+// number Start.
+type PdfPageLabelRange struct {
+	StartIndex int    // Index (0-based) of the first page of the range.
+	Style      string // D (decimal), R/r (upper/lower roman), A/a (upper/lower letters) or empty for no numbers.
+	Prefix     string
+	Start      int // Number of the first page of the range (1 or more).
+}
+
+// GetLabel returns the label of the page with index `pageIndex` in the range.
+func (r PdfPageLabelRange) GetLabel(pageIndex int) string {
+	return r.Prefix + FormatPageNumber(r.Style, r.Start+pageIndex-r.StartIndex)
+}
+
+// Largest page number written in roman numerals or letters.  Larger numbers are written in
+// decimal, as these styles grow linearly with the number.
+const maxStyledPageNumber = 9999
+
+// Largest page label start (St) accepted, so that the page numbers of a range fit an int on 32-bit
+// platforms.
+const maxPageLabelStart = 1000000000
+
+// FormatPageNumber returns page number `number` in page label style `style` (see
+// PdfPageLabelRange).  Letters go A to Z for the first 26 pages, AA to ZZ for the next 26 and so
+// on.  Numbers above 9999 are written in decimal in the roman and letter styles.
+func FormatPageNumber(style string, number int) string {
+	if number < 1 {
+		return ""
+	}
+	if style != "" && number > maxStyledPageNumber {
+		style = "D"
+	}
+	switch style {
+	case "D":
+		return strconv.Itoa(number)
+	case "R":
+		return formatRoman(number)
+	case "r":
+		return strings.ToLower(formatRoman(number))
+	case "A":
+		return formatLetters('A', number)
+	case "a":
+		return formatLetters('a', number)
+	}
+	return ""
+}
+
+// formatRoman returns `number` in upper case roman numerals.  Thousands past 3999 are written
+// with repeated M.  The strings are built in a bytes.Buffer (strings.Builder needs Go 1.10).
+func formatRoman(number int) string {
+	values := []int{1000, 900, 500, 400, 100, 90, 50, 40, 10, 9, 5, 4, 1}
+	numerals := []string{"M", "CM", "D", "CD", "C", "XC", "L", "XL", "X", "IX", "V", "IV", "I"}
+	var roman bytes.Buffer
+	for i, value := range values {
+		for number >= value {
+			roman.WriteString(numerals[i])
+			number -= value
+		}
+	}
+	return roman.String()
+}
+
+// formatLetters returns `number` in letters from `a`: the letter of the number modulo 26,
+// repeated once for each 26 pages.
+func formatLetters(a byte, number int) string {
+	letter := []byte{a + byte((number-1)%26)}
+	return string(bytes.Repeat(letter, (number-1)/26+1))
+}
+
+func isValidPageLabelStyle(style string) bool {
+	switch style {
+	case "", "D", "R", "r", "A", "a":
+		return true
+	}
+	return false
+}
+
+// newPdfPageLabelsFromPdfObject returns the label ranges of page labels number tree `obj`, with
+// its references resolved, sorted by start index.
+func newPdfPageLabelsFromPdfObject(obj PdfObject) ([]PdfPageLabelRange, error) {
+	ranges := []PdfPageLabelRange{}
+
+	err := NewNumberTreeFromPdfObject(obj).Iterate(func(key int64, value PdfObject) error {
+		r, err := newPdfPageLabelRangeFromPdfObject(int(key), value)
+		if err != nil {
+			return err
+		}
+		ranges = append(ranges, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].StartIndex < ranges[j].StartIndex
+	})
+	return ranges, nil
+}
+
+func newPdfPageLabelRangeFromPdfObject(startIndex int, obj PdfObject) (PdfPageLabelRange, error) {
+	r := PdfPageLabelRange{StartIndex: startIndex, Start: 1}
+
+	dict, ok := TraceToDirectObject(obj).(*PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("Page label not a dictionary (%T)", obj)
+		return r, errors.New("Type check error")
+	}
+	if style, ok := TraceToDirectObject(dict.Get("S")).(*PdfObjectName); ok {
+		if isValidPageLabelStyle(string(*style)) {
+			r.Style = string(*style)
+		} else {
+			common.Log.Debug("Incompatibility: Invalid page label style %s, using no numbers", *style)
+		}
+	}
+	if prefix, ok := TraceToDirectObject(dict.Get("P")).(*PdfObjectString); ok {
+		r.Prefix = decodePdfTextString(string(*prefix))
+	}
+	if start, ok := TraceToDirectObject(dict.Get("St")).(*PdfObjectInteger); ok {
+		if *start > maxPageLabelStart {
+			common.Log.Debug("Incompatibility: Page label start %d too large, using %d", *start, maxPageLabelStart)
+			r.Start = maxPageLabelStart
+		} else if *start >= 1 {
+			r.Start = int(*start)
+		} else {
+			common.Log.Debug("Incompatibility: Invalid page label start %d, using 1", *start)
+		}
+	}
+	return r, nil
+}
+
+// makePageLabelsNumberTree returns the root node of the page labels number tree of `ranges`.
+func makePageLabelsNumberTree(ranges []PdfPageLabelRange) (PdfObject, error) {
+	tree := NewNumberTree()
+	for i, r := range ranges {
+		if i == 0 && r.StartIndex != 0 {
+			return nil, errors.New("First page label range must start at page index 0")
+		}
+		if i > 0 && r.StartIndex <= ranges[i-1].StartIndex {
+			return nil, fmt.Errorf("Page label range start %d not ascending", r.StartIndex)
+		}
+		if !isValidPageLabelStyle(r.Style) {
+			return nil, fmt.Errorf("Invalid page label style %q", r.Style)
+		}
+		if r.Start < 1 {
+			return nil, fmt.Errorf("Invalid page label start %d", r.Start)
+		}
+
+		label := MakeDict()
+		if len(r.Style) > 0 {
+			label.Set("S", MakeName(r.Style))
+		}
+		if len(r.Prefix) > 0 {
+			label.Set("P", MakeString(encodePdfTextString(r.Prefix)))
+		}
+		if r.Start != 1 {
+			label.Set("St", MakeInteger(int64(r.Start)))
+		}
+		if err := tree.Insert(int64(r.StartIndex), label); err != nil {
+			return nil, err
+		}
+	}
+	return tree.ToPdfObject(), nil
+}
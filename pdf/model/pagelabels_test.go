@@ -0,0 +1,165 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+func TestFormatPageNumber(t *testing.T) {
+	testcases := []struct {
+		Style    string
+		Number   int
+		Expected string
+	}{
+		{"D", 12, "12"},
+		{"R", 4, "IV"},
+		{"r", 14, "xiv"},
+		{"R", 1994, "MCMXCIV"},
+		{"R", 3999, "MMMCMXCIX"},
+		{"r", 3999, "mmmcmxcix"},
+		{"A", 1, "A"},
+		{"A", 26, "Z"},
+		{"A", 27, "AA"},
+		{"A", 28, "BB"},
+		{"a", 52, "zz"},
+		{"a", 53, "aaa"},
+		{"R", 9999, "MMMMMMMMMCMXCIX"},
+		{"R", 10000, "10000"},
+		{"a", 10000, "10000"},
+		{"R", 1<<31 - 1, "2147483647"},
+		{"", 5, ""},
+	}
+	for _, tcase := range testcases {
+		if label := FormatPageNumber(tcase.Style, tcase.Number); label != tcase.Expected {
+			t.Errorf("%s %d: %q, expected %q", tcase.Style, tcase.Number, label, tcase.Expected)
+		}
+	}
+}
+
+// Test that a page label start too large for the page numbers of the range is capped.
+func TestPageLabelStartCap(t *testing.T) {
+	label := MakeDict()
+	label.Set("S", MakeName("R"))
+	label.Set("St", MakeInteger(1<<40))
+	r, err := newPdfPageLabelRangeFromPdfObject(0, label)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if r.Start != maxPageLabelStart {
+		t.Errorf("Start %d, expected %d", r.Start, maxPageLabelStart)
+	}
+	if s := r.GetLabel(2); s != "1000000002" {
+		t.Errorf("Label %q", s)
+	}
+}
+
+// Test a number tree with intermediate nodes and a range with a UTF-16 prefix.
+func TestPageLabelsNumberTree(t *testing.T) {
+	leaf1 := MakeDict()
+	label := MakeDict()
+	label.Set("S", MakeName("r"))
+	leaf1.Set("Nums", MakeArray(MakeInteger(0), label))
+	leaf2 := MakeDict()
+	label = MakeDict()
+	label.Set("S", MakeName("D"))
+	label.Set("P", MakeString("\xfe\xff\x00\xa7\x03\xa0\x00-"))
+	label.Set("St", MakeInteger(3))
+	leaf2.Set("Nums", MakeArray(MakeInteger(4), label))
+	root := MakeDict()
+	root.Set("Kids", MakeArray(MakeIndirectObject(leaf1), MakeIndirectObject(leaf2)))
+
+	ranges, err := newPdfPageLabelsFromPdfObject(root)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expected := []PdfPageLabelRange{
+		{StartIndex: 0, Style: "r", Start: 1},
+		{StartIndex: 4, Style: "D", Prefix: "§Π-", Start: 3},
+	}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("Ranges %+v, expected %+v", ranges, expected)
+	}
+	if label := ranges[1].GetLabel(5); label != "§Π-4" {
+		t.Errorf("Label %q", label)
+	}
+}
+
+func TestPageLabelsRoundTrip(t *testing.T) {
+	ranges := []PdfPageLabelRange{
+		{StartIndex: 0, Style: "r", Start: 1},
+		{StartIndex: 3, Style: "D", Prefix: "A-", Start: 8},
+		{StartIndex: 5, Prefix: "Cover", Start: 1},
+	}
+	invalid := [][]PdfPageLabelRange{
+		{{StartIndex: 1, Style: "D", Start: 1}},
+		{{StartIndex: 0, Style: "D", Start: 1}, {StartIndex: 0, Style: "r", Start: 1}},
+		{{StartIndex: 0, Style: "X", Start: 1}},
+		{{StartIndex: 0, Style: "D", Start: 0}},
+	}
+	for _, labels := range invalid {
+		w := NewPdfWriter()
+		if err := w.SetPageLabels(labels); err == nil {
+			t.Errorf("Invalid ranges %+v accepted", labels)
+		}
+	}
+
+	write := func(labels []PdfPageLabelRange) *PdfReader {
+		w := NewPdfWriter()
+		for i := 0; i < 6; i++ {
+			page := NewPdfPage()
+			page.Resources = NewPdfPageResources()
+			page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+			if err := w.AddPage(page); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+		}
+		if err := w.SetPageLabels(labels); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		data, err := writeToBytes(&w)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		reader, err := NewPdfReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		return reader
+	}
+
+	reader := write(ranges)
+	for i := 0; i < 2; i++ {
+		loaded, err := reader.GetPageLabels()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !reflect.DeepEqual(loaded, ranges) {
+			t.Errorf("Ranges %+v, expected %+v", loaded, ranges)
+		}
+		for pageIndex, expected := range []string{"i", "ii", "iii", "A-8", "A-9", "Cover"} {
+			if label, err := reader.GetPageLabel(pageIndex); err != nil || label != expected {
+				t.Errorf("Page %d: label %q (%v), expected %q", pageIndex, label, err, expected)
+			}
+		}
+		if _, err := reader.GetPageLabel(6); err == nil {
+			t.Errorf("Label of page index 6 of 6 pages")
+		}
+		reader = write(loaded)
+	}
+
+	reader = write(nil)
+	if loaded, err := reader.GetPageLabels(); err != nil || loaded != nil {
+		t.Errorf("Unexpected ranges %+v (%v)", loaded, err)
+	}
+	if label, err := reader.GetPageLabel(2); err != nil || label != "3" {
+		t.Errorf("Label %q (%v), expected page number", label, err)
+	}
+}
@@ -0,0 +1,559 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/unidoc/unidoc/common"
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// ICCProfile is the ICC profile of the output intent of a PDF/A document, describing the output
+// device the document's colors are intended for (14.11.5).
+type ICCProfile struct {
+	Data []byte // ICC profile data (version 2.x for PDF/A-1).
+	N    int    // Number of color components: 1 (gray), 3 (RGB) or 4 (CMYK).
+
+	OutputConditionIdentifier string // E.g. "sRGB IEC61966-2.1".
+	Info                      string // Human readable description of the output condition (optional).
+}
+
+// PDFAIssue is a PDF/A-1b requirement that the document being written does not meet and that the
+// writer cannot fix by itself.
+type PDFAIssue struct {
+	Page         int   // Page number (1-based) where the issue was found, or 0 if not page specific.
+	ObjectNumber int64 // Number of the offending object, or 0 if not applicable.
+	Message      string
+}
+
+func (issue PDFAIssue) String() string {
+	str := issue.Message
+	if issue.ObjectNumber > 0 {
+		str = fmt.Sprintf("%s (object %d)", str, issue.ObjectNumber)
+	}
+	if issue.Page > 0 {
+		str = fmt.Sprintf("page %d: %s", issue.Page, str)
+	}
+	return str
+}
+
+// PDFAError is returned by PdfWriter.Write for a document that cannot be written as PDF/A-1b.
+type PDFAError struct {
+	Issues []PDFAIssue
+}
+
+func (e *PDFAError) Error() string {
+	msgs := []string{}
+	for _, issue := range e.Issues {
+		msgs = append(msgs, issue.String())
+	}
+	return fmt.Sprintf("Not PDF/A-1b compliant: %s", strings.Join(msgs, "; "))
+}
+
+// SetPDFA1b sets the writer to write a PDF/A-1b (ISO 19005-1, level B) document with the output
+// intent `profile`.  When writing, the writer adds the output intent with the ICC profile and XMP
+// metadata identifying the document as PDF/A-1b (with the Info dictionary entries, merged into the
+// existing metadata of the document) to the catalog, replaces LZWDecode filters with FlateDecode
+// unless a filter policy is set, and writes the document ID in the trailer.
+// Other requirements are checked and Write fails with a *PDFAError listing the issues found:
+// encryption, fonts that are not embedded, transparency (soft masks, constant alpha other than
+// 1.0, blend modes other than Normal and transparency groups) and LZWDecode filters chosen by the
+// filter policy.  The document is not validated beyond these checks.  Note that the watermark added
+// to the pages by unlicensed copies uses a font that is not embedded unless set with
+// SetWatermarkFont.
+func (this *PdfWriter) SetPDFA1b(profile ICCProfile) error {
+	data := profile.Data
+	if len(data) < 128 || string(data[36:40]) != "acsp" {
+		return errors.New("Invalid ICC profile")
+	}
+	if data[8] > 2 {
+		return fmt.Errorf("ICC profile version %d not allowed in PDF/A-1 (must be 2.x or lower)", data[8])
+	}
+	colorSpaces := map[int]string{1: "GRAY", 3: "RGB ", 4: "CMYK"}
+	if colorSpaces[profile.N] != string(data[16:20]) {
+		return fmt.Errorf("ICC profile color space %q does not match N=%d", data[16:20], profile.N)
+	}
+	if len(profile.OutputConditionIdentifier) == 0 {
+		return errors.New("Output condition identifier missing")
+	}
+
+	this.pdfaProfile = &profile
+	return nil
+}
+
+// preparePDFA1b adds the output intent and the XMP metadata to the catalog and sets the document
+// ID.
+func (this *PdfWriter) preparePDFA1b() error {
+	profile := this.pdfaProfile
+
+	profileStream, err := MakeStream(profile.Data, NewFlateEncoder())
+	if err != nil {
+		return err
+	}
+	profileStream.Set("N", MakeInteger(int64(profile.N)))
+
+	intent := MakeDict()
+	intent.Set("Type", MakeName("OutputIntent"))
+	intent.Set("S", MakeName("GTS_PDFA1"))
+	intent.Set("OutputConditionIdentifier", MakeString(profile.OutputConditionIdentifier))
+	if len(profile.Info) > 0 {
+		intent.Set("Info", MakeString(profile.Info))
+	}
+	intent.Set("DestOutputProfile", profileStream)
+	this.catalog.Set("OutputIntents", &PdfObjectArray{MakeIndirectObject(intent)})
+
+	// The XMP metadata is written uncompressed (unless it is encrypted, which PDF/A does not allow).
+	metadata, err := MakeStream(this.pdfaXMP(this.existingMetadata()), NewRawEncoder())
+	if err != nil {
+		return err
+	}
+	metadata.Set("Type", MakeName("Metadata"))
+	metadata.Set("Subtype", MakeName("XML"))
+	this.catalog.Set("Metadata", metadata)
+
+	if this.ids == nil {
+		this.ids = this.makeIDs()
+	}
+
+	if err := this.addObjects(this.catalog.Get("OutputIntents")); err != nil {
+		return err
+	}
+	return this.addObjects(metadata)
+}
+
+// Namespaces of the XMP properties written for PDF/A-1b documents.
+const (
+	xmpNamespaceRDF    = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	xmpNamespacePDFAID = "http://www.aiim.org/pdfa/ns/id/"
+	xmpNamespaceDC     = "http://purl.org/dc/elements/1.1/"
+	xmpNamespaceXMP    = "http://ns.adobe.com/xap/1.0/"
+	xmpNamespacePDF    = "http://ns.adobe.com/pdf/1.3/"
+)
+
+// xmpProperty is an XMP property written for a PDF/A-1b document.
+type xmpProperty struct {
+	prefix, local string
+	value         string // XML content of the property element.
+}
+
+// existingMetadata returns the XMP metadata of the document being written: that of the catalog,
+// or else that of the catalog of the source document.  Returns nil if there is none.
+func (this *PdfWriter) existingMetadata() []byte {
+	obj := this.catalog.Get("Metadata")
+	if obj == nil && this.source != nil {
+		var err error
+		obj, err = this.source.traceToObject(this.source.catalog.Get("Metadata"))
+		if err != nil {
+			common.Log.Debug("ERROR: Unable to load the metadata of the source document: %v", err)
+			return nil
+		}
+	}
+	stream, ok := TraceToDirectObject(obj).(*PdfObjectStream)
+	if !ok {
+		return nil
+	}
+	data, err := DecodeStream(stream)
+	if err != nil {
+		common.Log.Debug("ERROR: Unable to decode the existing metadata: %v", err)
+		return nil
+	}
+	return data
+}
+
+// pdfaXMP returns the XMP metadata packet of a PDF/A-1b document, with the properties equivalent
+// to the entries of the Info dictionary (6.7.3 in ISO 19005-1).  The properties of the XMP
+// metadata `existing` of the document are kept, except those replaced and the PDF/A
+// identification.
+func (this *PdfWriter) pdfaXMP(existing []byte) []byte {
+	info, _ := this.infoObj.PdfObject.(*PdfObjectDictionary)
+	value := func(key PdfObjectName) (string, bool) {
+		if info == nil {
+			return "", false
+		}
+		str, ok := TraceToDirectObject(info.Get(key)).(*PdfObjectString)
+		if !ok {
+			return "", false
+		}
+		return decodePdfTextString(string(*str)), true
+	}
+	text := func(key PdfObjectName) (string, bool) {
+		str, ok := value(key)
+		if !ok {
+			return "", false
+		}
+		var buf bytes.Buffer
+		xml.EscapeText(&buf, []byte(str))
+		return buf.String(), true
+	}
+	date := func(key PdfObjectName) (string, bool) {
+		str, ok := value(key)
+		if !ok {
+			return "", false
+		}
+		d, err := NewPdfDate(str)
+		if err != nil {
+			common.Log.Debug("Info %s: %v", key, err)
+			return "", false
+		}
+		return d.xmpString(), true
+	}
+
+	// Properties by namespace, in the order written.
+	namespaces := []struct{ prefix, uri string }{
+		{"pdfaid", xmpNamespacePDFAID}, {"dc", xmpNamespaceDC}, {"xmp", xmpNamespaceXMP}, {"pdf", xmpNamespacePDF},
+	}
+	properties := map[string][]xmpProperty{}
+	add := func(prefix, local, value string) {
+		properties[prefix] = append(properties[prefix], xmpProperty{prefix, local, value})
+	}
+	add("pdfaid", "part", "1")
+	add("pdfaid", "conformance", "B")
+	add("dc", "format", "application/pdf")
+	if title, ok := text("Title"); ok {
+		add("dc", "title", fmt.Sprintf("<rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt>", title))
+	}
+	if author, ok := text("Author"); ok {
+		add("dc", "creator", fmt.Sprintf("<rdf:Seq><rdf:li>%s</rdf:li></rdf:Seq>", author))
+	}
+	if subject, ok := text("Subject"); ok {
+		add("dc", "description", fmt.Sprintf("<rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt>", subject))
+	}
+	if creator, ok := text("Creator"); ok {
+		add("xmp", "CreatorTool", creator)
+	}
+	if created, ok := date("CreationDate"); ok {
+		add("xmp", "CreateDate", created)
+	}
+	if modified, ok := date("ModDate"); ok {
+		add("xmp", "ModifyDate", modified)
+	}
+	if producer, ok := text("Producer"); ok {
+		add("pdf", "Producer", producer)
+	}
+	if keywords, ok := text("Keywords"); ok {
+		add("pdf", "Keywords", keywords)
+	}
+
+	var b bytes.Buffer
+	b.WriteString("<?xpacket begin=\"\xef\xbb\xbf\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	b.WriteString("<rdf:RDF xmlns:rdf=\"" + xmpNamespaceRDF + "\">\n")
+
+	replaced := map[xml.Name]bool{}
+	for _, ns := range namespaces {
+		fmt.Fprintf(&b, "<rdf:Description rdf:about=\"\" xmlns:%s=\"%s\">\n", ns.prefix, ns.uri)
+		for _, prop := range properties[ns.prefix] {
+			fmt.Fprintf(&b, "<%s:%s>%s</%s:%s>\n", prop.prefix, prop.local, prop.value, prop.prefix, prop.local)
+			replaced[xml.Name{Space: ns.uri, Local: prop.local}] = true
+		}
+		b.WriteString("</rdf:Description>\n")
+	}
+
+	if len(existing) > 0 {
+		kept, err := keptXMPDescriptions(existing, replaced)
+		if err != nil {
+			common.Log.Debug("ERROR: Unable to merge the existing XMP metadata: %v", err)
+		} else {
+			b.Write(kept)
+		}
+	}
+
+	b.WriteString("</rdf:RDF>\n")
+	b.WriteString("</x:xmpmeta>\n")
+	b.WriteString("<?xpacket end=\"w\"?>")
+	return b.Bytes()
+}
+
+// keptXMPDescriptions returns the rdf:Description elements of the XMP metadata packet `data` with
+// the properties in `replaced` and those of the PDF/A identification schema left out.  Each
+// element declares the namespaces declared in `data` before it, so that the properties can be
+// copied as they are.
+func keptXMPDescriptions(data []byte, replaced map[xml.Name]bool) ([]byte, error) {
+	isKept := func(name xml.Name) bool {
+		return !replaced[name] && name.Space != xmpNamespacePDFAID
+	}
+
+	var out bytes.Buffer
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	// Namespace prefixes declared so far, in order.
+	var prefixes []xml.Attr
+	depth := 0
+	descriptionDepth := -1
+	var attrs []xml.Attr
+	var props bytes.Buffer
+	for {
+		start := decoder.InputOffset()
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "xmlns" {
+					prefixes = append(prefixes, attr)
+				}
+			}
+			if descriptionDepth < 0 && t.Name.Space == xmpNamespaceRDF && t.Name.Local == "Description" {
+				descriptionDepth = depth
+				attrs = t.Attr
+				props.Reset()
+				continue
+			}
+			if descriptionDepth >= 0 && depth == descriptionDepth+1 {
+				// Property element, copied with its contents.
+				if err := decoder.Skip(); err != nil {
+					return nil, err
+				}
+				depth--
+				if isKept(t.Name) {
+					props.Write(data[start:decoder.InputOffset()])
+					props.WriteString("\n")
+				}
+			}
+		case xml.EndElement:
+			if depth == descriptionDepth {
+				descriptionDepth = -1
+				writeXMPDescription(&out, prefixes, attrs, props.Bytes(), isKept)
+			}
+			depth--
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// writeXMPDescription writes an rdf:Description element with the property elements `props` and
+// the kept properties of the attributes `attrs` of the original element to `out`, unless it has no
+// properties.  The namespace declarations `prefixes` are repeated on the element.
+func writeXMPDescription(out *bytes.Buffer, prefixes, attrs []xml.Attr, props []byte, isKept func(xml.Name) bool) {
+	prefixOf := map[string]string{}
+	for _, prefix := range prefixes {
+		prefixOf[prefix.Value] = prefix.Name.Local
+	}
+
+	var attrProps bytes.Buffer
+	for _, attr := range attrs {
+		if attr.Name.Space == "xmlns" || attr.Name.Space == "" || attr.Name.Space == xmpNamespaceRDF || !isKept(attr.Name) {
+			continue
+		}
+		prefix, ok := prefixOf[attr.Name.Space]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&attrProps, " %s:%s=\"", prefix, attr.Name.Local)
+		xml.EscapeText(&attrProps, []byte(attr.Value))
+		attrProps.WriteString("\"")
+	}
+	if len(props) == 0 && attrProps.Len() == 0 {
+		return
+	}
+
+	out.WriteString("<rdf:Description rdf:about=\"\"")
+	declared := map[string]bool{"rdf": true}
+	for i := len(prefixes) - 1; i >= 0; i-- {
+		// The last declaration of a prefix is the one in scope.
+		prefix := prefixes[i]
+		if declared[prefix.Name.Local] {
+			continue
+		}
+		declared[prefix.Name.Local] = true
+		fmt.Fprintf(out, " xmlns:%s=\"", prefix.Name.Local)
+		xml.EscapeText(out, []byte(prefix.Value))
+		out.WriteString("\"")
+	}
+	out.Write(attrProps.Bytes())
+	out.WriteString(">\n")
+	out.Write(props)
+	out.WriteString("</rdf:Description>\n")
+}
+
+// checkPDFA1b returns the PDF/A-1b issues of the objects to be written.  The objects must be
+// numbered.
+func (this *PdfWriter) checkPDFA1b() []PDFAIssue {
+	issues := []PDFAIssue{}
+	if this.crypter != nil {
+		issues = append(issues, PDFAIssue{Message: "encryption not allowed"})
+	}
+
+	// Resources of the pages, including those of form XObjects and Type 3 fonts.
+	reported := map[PdfObject]bool{}
+	report := func(page int, obj PdfObject, format string, args ...interface{}) {
+		if reported[obj] {
+			return
+		}
+		reported[obj] = true
+		issues = append(issues, PDFAIssue{Page: page, ObjectNumber: pdfaObjectNumber(obj), Message: fmt.Sprintf(format, args...)})
+	}
+	visited := map[PdfObject]bool{}
+	var checkResources func(page int, resources PdfObject)
+	checkGroup := func(page int, obj PdfObject, dict *PdfObjectDictionary) {
+		if group, ok := TraceToDirectObject(dict.Get("Group")).(*PdfObjectDictionary); ok {
+			if s, ok := TraceToDirectObject(group.Get("S")).(*PdfObjectName); ok && *s == "Transparency" {
+				report(page, obj, "transparency group not allowed")
+			}
+		}
+	}
+	checkResources = func(page int, resources PdfObject) {
+		resDict, ok := TraceToDirectObject(resources).(*PdfObjectDictionary)
+		if !ok || visited[resDict] {
+			return
+		}
+		visited[resDict] = true
+
+		if fonts, ok := TraceToDirectObject(resDict.Get("Font")).(*PdfObjectDictionary); ok {
+			for _, name := range fonts.Keys() {
+				fontObj := fonts.Get(name)
+				font, ok := TraceToDirectObject(fontObj).(*PdfObjectDictionary)
+				if !ok {
+					continue
+				}
+				if subtype, ok := TraceToDirectObject(font.Get("Subtype")).(*PdfObjectName); ok && *subtype == "Type3" {
+					checkResources(page, font.Get("Resources"))
+					continue
+				}
+				if !pdfaFontEmbedded(font) {
+					baseFont, _ := TraceToDirectObject(font.Get("BaseFont")).(*PdfObjectName)
+					report(page, fontObj, "font %s (resource /%s) not embedded", baseFont, name)
+				}
+			}
+		}
+
+		if gstates, ok := TraceToDirectObject(resDict.Get("ExtGState")).(*PdfObjectDictionary); ok {
+			for _, name := range gstates.Keys() {
+				gsObj := gstates.Get(name)
+				gs, ok := TraceToDirectObject(gsObj).(*PdfObjectDictionary)
+				if !ok {
+					continue
+				}
+				if smask, ok := TraceToDirectObject(gs.Get("SMask")).(*PdfObjectName); gs.Get("SMask") != nil && (!ok || *smask != "None") {
+					report(page, gsObj, "graphics state /%s: soft mask not allowed", name)
+				}
+				for _, key := range []PdfObjectName{"CA", "ca"} {
+					if alpha, err := getNumberAsFloat(TraceToDirectObject(gs.Get(key))); err == nil && alpha != 1.0 {
+						report(page, gsObj, "graphics state /%s: %s %v not allowed", name, key, alpha)
+					}
+				}
+				if bm, ok := TraceToDirectObject(gs.Get("BM")).(*PdfObjectName); ok && *bm != "Normal" && *bm != "Compatible" {
+					report(page, gsObj, "graphics state /%s: blend mode %s not allowed", name, *bm)
+				}
+			}
+		}
+
+		if xobjects, ok := TraceToDirectObject(resDict.Get("XObject")).(*PdfObjectDictionary); ok {
+			for _, name := range xobjects.Keys() {
+				xobj, ok := xobjects.Get(name).(*PdfObjectStream)
+				if !ok {
+					continue
+				}
+				subtype, _ := TraceToDirectObject(xobj.Get("Subtype")).(*PdfObjectName)
+				switch {
+				case subtype != nil && *subtype == "Form":
+					checkGroup(page, xobj, xobj.PdfObjectDictionary)
+					checkResources(page, xobj.Get("Resources"))
+				case subtype != nil && *subtype == "Image":
+					if xobj.Get("SMask") != nil {
+						report(page, xobj, "image /%s: soft mask not allowed", name)
+					}
+				}
+			}
+		}
+	}
+
+	if pagesDict, ok := this.pages.PdfObject.(*PdfObjectDictionary); ok {
+		if kids, ok := pagesDict.Get("Kids").(*PdfObjectArray); ok {
+			for i, kid := range *kids {
+				pageDict, ok := TraceToDirectObject(kid).(*PdfObjectDictionary)
+				if !ok {
+					continue
+				}
+				checkGroup(i+1, kid, pageDict)
+				checkResources(i+1, pageDict.Get("Resources"))
+			}
+		}
+	}
+
+	// LZW filters are replaced unless a filter policy is set, which must not choose them.
+	if this.filterPolicy != nil {
+		exempt := filterPolicyExemptions(this.objects)
+		for _, obj := range this.objects {
+			stream, ok := obj.(*PdfObjectStream)
+			if !ok {
+				continue
+			}
+			enc, err := NewEncoderFromStream(stream)
+			if err != nil {
+				continue
+			}
+			if !exempt[stream] {
+				if policyEnc := this.filterPolicy.StreamEncoder(stream.ObjectNumber, stream.PdfObjectDictionary, enc); policyEnc != nil {
+					enc = policyEnc
+				}
+			}
+			for _, e := range encoderChain(enc) {
+				if _, isLZW := e.(*LZWEncoder); isLZW {
+					report(0, stream, "LZWDecode filter not allowed")
+				}
+			}
+		}
+	}
+
+	return issues
+}
+
+// pdfaFontEmbedded returns true if the font program of font dictionary `font` is embedded.
+func pdfaFontEmbedded(font *PdfObjectDictionary) bool {
+	if descendants, ok := TraceToDirectObject(font.Get("DescendantFonts")).(*PdfObjectArray); ok {
+		if len(*descendants) == 0 {
+			return false
+		}
+		descendant, ok := TraceToDirectObject((*descendants)[0]).(*PdfObjectDictionary)
+		if !ok {
+			return false
+		}
+		font = descendant
+	}
+	descriptor, ok := TraceToDirectObject(font.Get("FontDescriptor")).(*PdfObjectDictionary)
+	if !ok {
+		return false
+	}
+	for _, key := range []PdfObjectName{"FontFile", "FontFile2", "FontFile3"} {
+		if _, ok := TraceToDirectObject(descriptor.Get(key)).(*PdfObjectStream); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pdfaObjectNumber returns the object number of `obj` if it is an indirect object or stream, or
+// else 0.
+func pdfaObjectNumber(obj PdfObject) int64 {
+	switch obj.(type) {
+	case *PdfIndirectObject, *PdfObjectStream:
+		return getObjectNumber(obj)
+	}
+	return 0
+}
+
+// xmpString returns the date in the XMP date format (e.g. 2006-01-02T15:04:05+07:00).
+func (date *PdfDate) xmpString() string {
+	str := fmt.Sprintf("%.4d-%.2d-%.2dT%.2d:%.2d:%.2d",
+		date.year, date.month, date.day, date.hour, date.minute, date.second)
+	if date.utOffsetSign == 'Z' {
+		return str + "Z"
+	}
+	return fmt.Sprintf("%s%c%.2d:%.2d", str, date.utOffsetSign, date.utOffsetHours, date.utOffsetMins)
+}
@@ -0,0 +1,330 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// makeTestICCProfile returns the header of an ICC profile of version `version` with color space
+// `colorSpace` and no tags.
+func makeTestICCProfile(version byte, colorSpace string) []byte {
+	data := make([]byte, 132)
+	data[3] = 132
+	data[8] = version
+	copy(data[12:], "mntr")
+	copy(data[16:], colorSpace)
+	copy(data[20:], "XYZ ")
+	copy(data[36:], "acsp")
+	return data
+}
+
+// addPDFATestPage adds a page with the resources `resources` and a content stream encoded with
+// LZW to `w`.  The unembedded watermark font added to the pages by unlicensed copies is removed.
+func addPDFATestPage(t *testing.T, w *PdfWriter, resources *PdfPageResources) {
+	lzw := NewLZWEncoder()
+	lzw.EarlyChange = 0
+	page := NewPdfPage()
+	page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+	page.Resources = resources
+	if err := page.SetContentStreams([]string{"0 0 m 100 100 l S"}, lzw); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if fonts, ok := TraceToDirectObject(resources.Font).(*PdfObjectDictionary); ok {
+		fonts.Remove("UF1")
+	}
+}
+
+func TestPDFA1bProfile(t *testing.T) {
+	testcases := []struct {
+		Name    string
+		Profile ICCProfile
+	}{
+		{"short", ICCProfile{Data: makeTestICCProfile(2, "RGB ")[:100], N: 3, OutputConditionIdentifier: "sRGB"}},
+		{"version 4", ICCProfile{Data: makeTestICCProfile(4, "RGB "), N: 3, OutputConditionIdentifier: "sRGB"}},
+		{"N mismatch", ICCProfile{Data: makeTestICCProfile(2, "RGB "), N: 4, OutputConditionIdentifier: "sRGB"}},
+		{"no identifier", ICCProfile{Data: makeTestICCProfile(2, "RGB "), N: 3}},
+	}
+	for _, tcase := range testcases {
+		w := NewPdfWriter()
+		if err := w.SetPDFA1b(tcase.Profile); err == nil {
+			t.Errorf("%s: Invalid profile accepted", tcase.Name)
+		}
+	}
+}
+
+// Test that the issues that the writer cannot fix are reported with their page and object, and
+// that the output intent, XMP metadata and ID are added to a compliant document, with LZW replaced.
+func TestPDFA1b(t *testing.T) {
+	profile := ICCProfile{
+		Data: makeTestICCProfile(2, "RGB "), N: 3,
+		OutputConditionIdentifier: "sRGB IEC61966-2.1", Info: "sRGB",
+	}
+
+	font := MakeDict()
+	font.Set("Type", MakeName("Font"))
+	font.Set("Subtype", MakeName("Type1"))
+	font.Set("BaseFont", MakeName("Helvetica"))
+	gs := MakeDict()
+	gs.Set("ca", MakeFloat(0.5))
+	resources := NewPdfPageResources()
+	resources.SetFontByName("F1", MakeIndirectObject(font))
+	resources.AddExtGState("GS1", gs)
+
+	w := NewPdfWriter()
+	if err := w.SetPDFA1b(profile); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	addPDFATestPage(t, &w, NewPdfPageResources())
+	addPDFATestPage(t, &w, resources)
+	_, err := writeToBytes(&w)
+	pdfaErr, ok := err.(*PDFAError)
+	if !ok || len(pdfaErr.Issues) != 2 {
+		t.Fatalf("Unexpected issues: %v", err)
+	}
+	issues := pdfaErr.Issues
+	for i, expected := range []string{"font Helvetica (resource /F1) not embedded", "graphics state /GS1: ca 0.5 not allowed"} {
+		issue := issues[i]
+		if issue.Page != 2 || issue.Message != expected {
+			t.Errorf("Issue %d: %s, expected %q on page 2", i, issue, expected)
+		}
+	}
+	if issues[0].ObjectNumber == 0 {
+		t.Errorf("Font object number missing")
+	}
+
+	w = NewPdfWriter()
+	w.SetPDFA1b(profile)
+	w.SetDeterministic(true)
+	info := w.infoObj.PdfObject.(*PdfObjectDictionary)
+	info.Set("Title", MakeString("Fish & Chips"))
+	info.Set("CreationDate", MakeString("D:20180325142530+01'00'"))
+	addPDFATestPage(t, &w, NewPdfPageResources())
+	data, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF-1.3\n%")) || data[10] < 128 {
+		t.Errorf("Unexpected header: %q", data[:16])
+	}
+
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	trailer, err := reader.GetTrailer()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if ids, ok := trailer.Get("ID").(*PdfObjectArray); !ok || len(*ids) != 2 {
+		t.Errorf("Trailer ID missing: %v", trailer.Get("ID"))
+	}
+
+	resolve := func(obj PdfObject) PdfObject {
+		obj, err := reader.traceToObject(obj)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		return TraceToDirectObject(obj)
+	}
+	intents, ok := resolve(reader.catalog.Get("OutputIntents")).(*PdfObjectArray)
+	if !ok || len(*intents) != 1 {
+		t.Fatalf("Output intents missing: %v", reader.catalog.Get("OutputIntents"))
+	}
+	intent := resolve((*intents)[0]).(*PdfObjectDictionary)
+	if s, ok := intent.Get("S").(*PdfObjectName); !ok || *s != "GTS_PDFA1" {
+		t.Errorf("Output intent subtype %v", intent.Get("S"))
+	}
+	if id, ok := intent.Get("OutputConditionIdentifier").(*PdfObjectString); !ok || string(*id) != profile.OutputConditionIdentifier {
+		t.Errorf("Output condition identifier %v", intent.Get("OutputConditionIdentifier"))
+	}
+	destProfile, ok := resolve(intent.Get("DestOutputProfile")).(*PdfObjectStream)
+	if !ok {
+		t.Fatalf("Output profile missing")
+	}
+	if iccData, err := DecodeStream(destProfile); err != nil || !bytes.Equal(iccData, profile.Data) {
+		t.Errorf("Output profile differs (%v)", err)
+	}
+
+	metadata, ok := resolve(reader.catalog.Get("Metadata")).(*PdfObjectStream)
+	if !ok {
+		t.Fatalf("Metadata missing")
+	}
+	if metadata.Get("Filter") != nil {
+		t.Errorf("Metadata filtered: %v", metadata.Get("Filter"))
+	}
+	xmp := string(metadata.Stream)
+	for _, expected := range []string{
+		"<pdfaid:part>1</pdfaid:part>",
+		"<pdfaid:conformance>B</pdfaid:conformance>",
+		`<rdf:li xml:lang="x-default">Fish &amp; Chips</rdf:li>`,
+		"<xmp:CreateDate>2018-03-25T14:25:30+01:00</xmp:CreateDate>",
+		"<pdf:Producer>" + getPdfProducer() + "</pdf:Producer>",
+		"<xmp:CreatorTool>" + getPdfCreator() + "</xmp:CreatorTool>",
+	} {
+		if !strings.Contains(xmp, expected) {
+			t.Errorf("XMP metadata without %s:\n%s", expected, xmp)
+		}
+	}
+
+	page, err := reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	// The watermark of unlicensed copies is added as a second content stream.
+	contents := []PdfObject{page.Contents}
+	if arr, ok := resolve(page.Contents).(*PdfObjectArray); ok {
+		contents = *arr
+	}
+	stream, ok := resolve(contents[0]).(*PdfObjectStream)
+	if !ok {
+		t.Fatalf("Contents not a stream (%T)", contents[0])
+	}
+	if filter, ok := stream.Get("Filter").(*PdfObjectName); !ok || *filter != "FlateDecode" {
+		t.Errorf("Contents filter %v, expected FlateDecode", stream.Get("Filter"))
+	}
+}
+
+func TestPDFA1bEncrypted(t *testing.T) {
+	w := NewPdfWriter()
+	w.SetPDFA1b(ICCProfile{Data: makeTestICCProfile(2, "GRAY"), N: 1, OutputConditionIdentifier: "Gray"})
+	addPDFATestPage(t, &w, NewPdfPageResources())
+	if err := w.Encrypt([]byte("user"), []byte("owner"), nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	_, err := writeToBytes(&w)
+	if pdfaErr, ok := err.(*PDFAError); !ok || len(pdfaErr.Issues) != 1 || pdfaErr.Issues[0].Message != "encryption not allowed" {
+		t.Errorf("Expected encryption issue, got %v", err)
+	}
+}
+
+// Test that the existing XMP metadata of the document is merged into that of the PDF/A document:
+// the properties equivalent to Info entries and the PDF/A identification are replaced, and the
+// other properties are kept, in element or attribute form.
+func TestPDFA1bMergeMetadata(t *testing.T) {
+	existing := `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns:dc="http://purl.org/dc/elements/1.1/">
+<rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmlns:xmpMM="http://ns.adobe.com/xap/1.0/mm/"
+ xmp:CreatorTool="Old tool" xmpMM:DocumentID="uuid:1234">
+<dc:title><rdf:Alt><rdf:li xml:lang="x-default">Old title</rdf:li></rdf:Alt></dc:title>
+<dc:rights><rdf:Alt><rdf:li xml:lang="x-default">All rights reserved</rdf:li></rdf:Alt></dc:rights>
+</rdf:Description>
+<rdf:Description rdf:about="" xmlns:pdfaid="http://www.aiim.org/pdfa/ns/id/">
+<pdfaid:part>2</pdfaid:part>
+</rdf:Description>
+</rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+
+	w := NewPdfWriter()
+	w.SetPDFA1b(ICCProfile{Data: makeTestICCProfile(2, "RGB "), N: 3, OutputConditionIdentifier: "sRGB"})
+	info := w.infoObj.PdfObject.(*PdfObjectDictionary)
+	info.Set("Title", MakeString("New title"))
+	metadata, err := MakeStream([]byte(existing), NewFlateEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	w.catalog.Set("Metadata", metadata)
+
+	xmp := string(w.pdfaXMP(w.existingMetadata()))
+	if err := checkWellFormedXML(xmp); err != nil {
+		t.Fatalf("Invalid XMP metadata: %v\n%s", err, xmp)
+	}
+	for _, expected := range []string{
+		"<pdfaid:part>1</pdfaid:part>",
+		`<rdf:li xml:lang="x-default">New title</rdf:li>`,
+		`<rdf:li xml:lang="x-default">All rights reserved</rdf:li>`,
+		`xmpMM:DocumentID="uuid:1234"`,
+		"<xmp:CreatorTool>" + getPdfCreator() + "</xmp:CreatorTool>",
+	} {
+		if !strings.Contains(xmp, expected) {
+			t.Errorf("XMP metadata without %s:\n%s", expected, xmp)
+		}
+	}
+	for _, unexpected := range []string{"Old title", "Old tool", "<pdfaid:part>2</pdfaid:part>"} {
+		if strings.Contains(xmp, unexpected) {
+			t.Errorf("XMP metadata with replaced %s:\n%s", unexpected, xmp)
+		}
+	}
+}
+
+// checkWellFormedXML returns an error if `data` is not well-formed XML.
+func checkWellFormedXML(data string) error {
+	decoder := xml.NewDecoder(strings.NewReader(data))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Test writing an unlicensed copy as PDF/A with an embedded watermark font, and check the output
+// read back: all fonts are embedded and the XMP metadata is well-formed.  This is a partial
+// validation of the output; no PDF/A validator is used.
+func TestPDFA1bWatermarkFont(t *testing.T) {
+	font, err := NewPdfFontFromTTFFile("../../testfiles/roboto/Roboto-Regular.ttf")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	w := NewPdfWriter()
+	w.SetPDFA1b(ICCProfile{Data: makeTestICCProfile(2, "RGB "), N: 3, OutputConditionIdentifier: "sRGB"})
+	w.SetWatermarkFont(font)
+	page := NewPdfPage()
+	page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+	page.Resources = NewPdfPageResources()
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	page, err = reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	fonts, ok := TraceToDirectObject(page.Resources.Font).(*PdfObjectDictionary)
+	if !ok || len(fonts.Keys()) == 0 {
+		t.Fatalf("No fonts: %v", page.Resources.Font)
+	}
+	for _, name := range fonts.Keys() {
+		fontDict, ok := TraceToDirectObject(fonts.Get(name)).(*PdfObjectDictionary)
+		if !ok || !pdfaFontEmbedded(fontDict) {
+			t.Errorf("Font /%s not embedded", name)
+		}
+	}
+
+	obj, err := reader.traceToObject(reader.catalog.Get("Metadata"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	metadata, ok := obj.(*PdfObjectStream)
+	if !ok {
+		t.Fatalf("Metadata missing")
+	}
+	if err := checkWellFormedXML(string(metadata.Stream)); err != nil {
+		t.Errorf("Invalid XMP metadata: %v", err)
+	}
+}
@@ -6,9 +6,12 @@
 package model
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/unidoc/unidoc/common"
@@ -38,13 +41,60 @@ type PdfReader struct {
 // memory or file. Immediately loads and traverses the PDF structure including pages and page contents (if
 // not encrypted).
 func NewPdfReader(rs io.ReadSeeker) (*PdfReader, error) {
+	return NewPdfReaderWithOpts(rs, nil)
+}
+
+// DefaultMaxPasswordAttempts is the number of times the password callback is called by default
+// (ReaderOpts).
+const DefaultMaxPasswordAttempts = 3
+
+// PasswordCallback is called when loading an encrypted document that cannot be opened with the
+// empty password, e.g. to prompt the user or look up a vault.  `attempt` is the number of the
+// attempt, starting at 1, and `info` describes the encryption.  Returns the password to try, or
+// false to decline to provide one, which stops loading the document.
+type PasswordCallback func(attempt int, info EncryptionInfo) ([]byte, bool)
+
+// EncryptionInfo describes the encryption of a document for a PasswordCallback.
+type EncryptionInfo struct {
+	Filter    string // Security handler, e.g. Standard.
+	Algorithm string // Algorithm of the streams: RC4, AESV2 (AES-128), AESV3 (AES-256) or Identity.
+	KeyLength int    // Length of the encryption key in bits.
+
+	// EmptyPasswordTried is true if the empty password was tried and failed.
+	EmptyPasswordTried bool
+}
+
+// ReaderOpts are the options of NewPdfReaderWithOpts.
+type ReaderOpts struct {
+	// PasswordCallback provides the passwords of encrypted documents, which are then decrypted
+	// while loading them.  Without it, encrypted documents are loaded up to Decrypt.
+	PasswordCallback PasswordCallback
+
+	// MaxPasswordAttempts is the number of times PasswordCallback is called before loading fails
+	// with ErrIncorrectPassword, DefaultMaxPasswordAttempts if not set.
+	MaxPasswordAttempts int
+
+	// Options of the parser of the document, e.g. DecodeCaching.
+	ParserOpts
+}
+
+// NewPdfReaderWithOpts returns a new PdfReader for `rs` as NewPdfReader, with options `opts`, which
+// can be nil.  With a password callback, an encrypted document is decrypted with the empty
+// password if possible, otherwise with a password provided by the callback: loading fails with
+// ErrPasswordDeclined if the callback declines to provide one, or ErrIncorrectPassword if none of
+// the passwords it provided is correct.
+func NewPdfReaderWithOpts(rs io.ReadSeeker, opts *ReaderOpts) (*PdfReader, error) {
 	pdfReader := &PdfReader{}
 	pdfReader.traversed = map[PdfObject]bool{}
 
 	pdfReader.modelManager = NewModelManager()
 
 	// Create the parser, loads the cross reference table and trailer.
-	parser, err := NewParser(rs)
+	var parserOpts *ParserOpts
+	if opts != nil {
+		parserOpts = &opts.ParserOpts
+	}
+	parser, err := NewParserWithOpts(rs, parserOpts)
 	if err != nil {
 		return nil, err
 	}
@@ -61,11 +111,71 @@ func NewPdfReader(rs io.ReadSeeker) (*PdfReader, error) {
 		if err != nil {
 			return nil, err
 		}
+	} else if opts != nil && opts.PasswordCallback != nil {
+		err = pdfReader.decryptWithCallback(opts.PasswordCallback, opts.MaxPasswordAttempts)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return pdfReader, nil
 }
 
+// decryptWithCallback decrypts the document with the empty password, or with a password provided
+// by `callback` in up to `maxAttempts` attempts (DefaultMaxPasswordAttempts if not positive).
+func (this *PdfReader) decryptWithCallback(callback PasswordCallback, maxAttempts int) error {
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxPasswordAttempts
+	}
+
+	success, err := this.Decrypt([]byte(""))
+	if err != nil {
+		return err
+	}
+	if success {
+		return nil
+	}
+
+	info := this.getEncryptionInfo()
+	info.EmptyPasswordTried = true
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		password, ok := callback(attempt, info)
+		if !ok {
+			common.Log.Debug("Password declined on attempt %d", attempt)
+			return ErrPasswordDeclined
+		}
+		success, err := this.Decrypt(password)
+		if err != nil {
+			return err
+		}
+		if success {
+			return nil
+		}
+		common.Log.Debug("Incorrect password on attempt %d of %d", attempt, maxAttempts)
+	}
+	return ErrIncorrectPassword
+}
+
+// getEncryptionInfo returns the description of the encryption of the document for password
+// callbacks.
+func (this *PdfReader) getEncryptionInfo() EncryptionInfo {
+	crypter := this.parser.GetCrypter()
+	if crypter == nil {
+		return EncryptionInfo{}
+	}
+	info := EncryptionInfo{Filter: crypter.Filter, Algorithm: "RC4", KeyLength: crypter.KeyLengthBits()}
+	if crypter.V >= 4 {
+		info.Algorithm = "Identity"
+		if cf, has := crypter.CryptFilters[crypter.StreamFilter]; has && cf.Cfm != "" && cf.Cfm != CryptFilterNone {
+			info.Algorithm = cf.Cfm
+			if cf.Cfm == CryptFilterV2 {
+				info.Algorithm = "RC4"
+			}
+		}
+	}
+	return info
+}
+
 // IsEncrypted returns true if the PDF file is encrypted.
 func (this *PdfReader) IsEncrypted() (bool, error) {
 	return this.parser.IsEncrypted()
@@ -100,6 +210,16 @@ func (this *PdfReader) GetEncryptionMethod() string {
 	return str
 }
 
+// GetEncryptionKeyLength returns the length in bits of the document's encryption key, e.g. 128
+// for AESV2, or 0 if the document is not encrypted.
+func (this *PdfReader) GetEncryptionKeyLength() int {
+	crypter := this.parser.GetCrypter()
+	if crypter == nil {
+		return 0
+	}
+	return crypter.KeyLengthBits()
+}
+
 // Decrypt decrypts the PDF file with a specified password.  Also tries to
 // decrypt with an empty password.  Returns true if successful,
 // false otherwise.
@@ -121,6 +241,17 @@ func (this *PdfReader) Decrypt(password []byte) (bool, error) {
 	return true, nil
 }
 
+// TryPassword returns true if `password` is the user or owner password of the encrypted file,
+// without decrypting it.  The state of the reader is not changed, so that candidate passwords can
+// be tested before or after Decrypt.
+func (this *PdfReader) TryPassword(password []byte) (bool, error) {
+	crypter := this.parser.GetCrypter()
+	if crypter == nil {
+		return false, errors.New("File not encrypted")
+	}
+	return crypter.TryPassword(password)
+}
+
 // CheckAccessRights checks access rights and permissions for a specified password.  If either user/owner
 // password is specified,  full rights are granted, otherwise the access rights are specified by the
 // Permissions flag.
@@ -146,7 +277,7 @@ func (this *PdfReader) loadStructure() error {
 	// Catalog.
 	root, ok := trailerDict.Get("Root").(*PdfObjectReference)
 	if !ok {
-		return fmt.Errorf("Invalid Root (trailer: %s)", *trailerDict)
+		return fmt.Errorf("Invalid Root (trailer: %s)", trailerDict)
 	}
 	oc, err := this.parser.LookupByReference(*root)
 	if err != nil {
@@ -605,14 +736,18 @@ func (this *PdfReader) GetNumPages() (int, error) {
 // Resolves a reference, returning the object and indicates whether or not
 // it was cached.
 func (this *PdfReader) resolveReference(ref *PdfObjectReference) (PdfObject, bool, error) {
-	cachedObj, isCached := this.parser.ObjCache[int(ref.ObjectNumber)]
+	objNum, err := ToInt("object number", ref.ObjectNumber, -MaxInt-1, MaxInt)
+	if err != nil {
+		return nil, false, err
+	}
+	cachedObj, isCached := this.parser.ObjCache[objNum]
 	if !isCached {
 		common.Log.Trace("Reader Lookup ref: %s", ref)
 		obj, err := this.parser.LookupByReference(*ref)
 		if err != nil {
 			return nil, false, err
 		}
-		this.parser.ObjCache[int(ref.ObjectNumber)] = obj
+		this.parser.ObjCache[objNum] = obj
 		return obj, false, nil
 	}
 	return cachedObj, true, nil
@@ -760,6 +895,199 @@ func (this *PdfReader) GetOCProperties() (PdfObject, error) {
 	return obj, nil
 }
 
+// GetOptionalContent returns the optional content properties of the document, listing its
+// layers.  Returns nil if the document has no optional content.
+func (this *PdfReader) GetOptionalContent() (*PdfOCProperties, error) {
+	obj, err := this.GetOCProperties()
+	if err != nil {
+		return nil, err
+	}
+	if _, isNull := obj.(*PdfObjectNull); obj == nil || isNull {
+		return nil, nil
+	}
+	return newPdfOCPropertiesFromPdfObject(obj)
+}
+
+// GetPieceInfo returns the document-level page-piece dictionary (PieceInfo) from the catalog with all
+// references resolved, or nil if not present.
+func (this *PdfReader) GetPieceInfo() (PdfObject, error) {
+	obj := this.catalog.Get("PieceInfo")
+	if obj == nil {
+		return nil, nil
+	}
+
+	obj, err := this.traceToObject(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	// The private data does not reference pages, so is safe to resolve fully.
+	err = this.traverseObjectData(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// GetExtensions returns the developer extensions declared in the catalog (Extensions), or nil if
+// not present.
+func (this *PdfReader) GetExtensions() (*PdfExtensions, error) {
+	obj := this.catalog.Get("Extensions")
+	if obj == nil {
+		return nil, nil
+	}
+
+	obj, err := this.traceToObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	err = this.traverseObjectData(obj)
+	if err != nil {
+		return nil, err
+	}
+	if _, isNull := obj.(*PdfObjectNull); isNull {
+		return nil, nil
+	}
+
+	return newPdfExtensionsFromPdfObject(obj)
+}
+
+// GetNameTree returns the name tree `name` (e.g. Dests or EmbeddedFiles) of the Names dictionary of
+// the catalog, or nil if not present.  The nodes of the tree are loaded from the file as needed.
+func (this *PdfReader) GetNameTree(name PdfObjectName) (*NameTree, error) {
+	obj := this.catalog.Get("Names")
+	if obj == nil {
+		return nil, nil
+	}
+
+	obj, err := this.traceToObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	names, ok := TraceToDirectObject(obj).(*PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("Names not a dictionary (%T)", obj)
+		return nil, ErrTypeError
+	}
+	obj = names.Get(name)
+	if obj == nil {
+		return nil, nil
+	}
+
+	tree := NewNameTreeFromPdfObject(obj)
+	tree.tree.resolve = this.traceToObject
+	return tree, nil
+}
+
+// GetNamedDestinations returns the named destinations of the document by name, from the Dests
+// name tree of the Names dictionary and the Dests dictionary of the catalog (PDF 1.1).  Invalid
+// destinations are skipped.
+func (this *PdfReader) GetNamedDestinations() (map[string]Destination, error) {
+	dests := map[string]Destination{}
+
+	if obj := this.catalog.Get("Dests"); obj != nil {
+		obj, err := this.traceToObject(obj)
+		if err != nil {
+			return nil, err
+		}
+		if dict, ok := TraceToDirectObject(obj).(*PdfObjectDictionary); ok {
+			for _, name := range dict.Keys() {
+				dest, err := this.newDestinationFromPdfObject(dict.Get(name))
+				if err != nil {
+					common.Log.Debug("Invalid destination %s: %v - skipping", name, err)
+					continue
+				}
+				dests[string(name)] = dest
+			}
+		}
+	}
+
+	tree, err := this.GetNameTree("Dests")
+	if err != nil || tree == nil {
+		return dests, err
+	}
+	err = tree.Iterate(func(name string, value PdfObject) error {
+		dest, err := this.newDestinationFromPdfObject(value)
+		if err != nil {
+			common.Log.Debug("Invalid destination %q: %v - skipping", name, err)
+			return nil
+		}
+		dests[name] = dest
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dests, nil
+}
+
+// GetDocumentJavaScript returns the document-level JavaScript of the JavaScript name tree of the
+// Names dictionary, in name order.  Entries which are not JavaScript actions are skipped.
+func (this *PdfReader) GetDocumentJavaScript() ([]NamedScript, error) {
+	tree, err := this.GetNameTree("JavaScript")
+	if err != nil || tree == nil {
+		return nil, err
+	}
+	var scripts []NamedScript
+	err = tree.Iterate(func(name string, value PdfObject) error {
+		script, err := this.newNamedScriptFromPdfObject(name, value)
+		if err != nil {
+			common.Log.Debug("Invalid JavaScript %q: %v - skipping", name, err)
+			return nil
+		}
+		scripts = append(scripts, script)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return scripts, nil
+}
+
+// GetPageLabels returns the page label ranges of the document (PageLabels), sorted by start page
+// index, or nil if not present.
+func (this *PdfReader) GetPageLabels() ([]PdfPageLabelRange, error) {
+	obj := this.catalog.Get("PageLabels")
+	if obj == nil {
+		return nil, nil
+	}
+
+	obj, err := this.traceToObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	// The number tree does not reference pages, so is safe to resolve fully.
+	err = this.traverseObjectData(obj)
+	if err != nil {
+		return nil, err
+	}
+	if _, isNull := obj.(*PdfObjectNull); isNull {
+		return nil, nil
+	}
+
+	return newPdfPageLabelsFromPdfObject(obj)
+}
+
+// GetPageLabel returns the label of the page with index `pageIndex` (0-based), e.g. "iv" or "A-3".
+// Pages of documents without page labels, and pages before the first range, are labelled with
+// their page numbers.
+func (this *PdfReader) GetPageLabel(pageIndex int) (string, error) {
+	if pageIndex < 0 || pageIndex >= len(this.PageList) {
+		return "", ErrRangeError
+	}
+	ranges, err := this.GetPageLabels()
+	if err != nil {
+		return "", err
+	}
+	for i := len(ranges) - 1; i >= 0; i-- {
+		if ranges[i].StartIndex <= pageIndex {
+			return ranges[i].GetLabel(pageIndex), nil
+		}
+	}
+	return strconv.Itoa(pageIndex + 1), nil
+}
+
 // Inspect inspects the object types, subtypes and content in the PDF file returning a map of
 // object type to number of instances of each.
 func (this *PdfReader) Inspect() (map[string]int, error) {
@@ -775,12 +1103,87 @@ func (r *PdfReader) GetObjectNums() []int {
 	return r.parser.GetObjectNums()
 }
 
+// GetParserStats returns statistics of the objects of the file for diagnostics: the numbers of
+// objects, duplicate cross-reference entries and free entries.
+func (this *PdfReader) GetParserStats() ParserStats {
+	return this.parser.GetStats()
+}
+
+// LoadErrors returns the problems found while loading the cross-reference sections of the file
+// which did not prevent reading it, such as object numbers with more than one entry in a section.
+func (this *PdfReader) LoadErrors() []error {
+	return this.parser.LoadErrors()
+}
+
 // GetIndirectObjectByNumber retrieves and returns a specific PdfObject by object number.
 func (this *PdfReader) GetIndirectObjectByNumber(number int) (PdfObject, error) {
 	obj, err := this.parser.LookupByNumber(number)
 	return obj, err
 }
 
+// GetObjectByteSpan returns the byte span of object number `objNum` in the original file, from the
+// start of its "N G obj" header to just after its "endobj" keyword.  For objects compressed in an
+// object stream, the span of the object stream is returned with `inObjStm` true.
+func (this *PdfReader) GetObjectByteSpan(objNum int) (start, end int64, inObjStm bool, err error) {
+	return this.parser.GetObjectByteSpan(objNum)
+}
+
+// reObjectHeader matches the "N G obj" header of an indirect object.
+var reObjectHeader = regexp.MustCompile(`^(\d+)\s+(\d+)\s+obj`)
+
+// FitObjectReplacement checks that `data`, the serialization of object number `objNum` from its
+// "N G obj" header to its "endobj" keyword, can replace the object in place in the original file.
+// Returns `data` padded with spaces before endobj to the exact length of the object's byte span
+// (see GetObjectByteSpan), so that the offsets of the other objects are unchanged.  An error is
+// returned if the object is in an object stream, if `data` is not an object with the same object
+// and generation numbers, or if it is longer than the span.
+func (this *PdfReader) FitObjectReplacement(objNum int, data []byte) ([]byte, error) {
+	start, end, inObjStm, err := this.GetObjectByteSpan(objNum)
+	if err != nil {
+		return nil, err
+	}
+	if inObjStm {
+		return nil, fmt.Errorf("object %d is in an object stream", objNum)
+	}
+
+	obj, err := this.parser.LookupByNumber(objNum)
+	if err != nil {
+		return nil, err
+	}
+	var gen int64
+	switch t := obj.(type) {
+	case *PdfIndirectObject:
+		gen = t.GenerationNumber
+	case *PdfObjectStream:
+		gen = t.GenerationNumber
+	}
+
+	data = bytes.TrimSpace(data)
+	result := reObjectHeader.FindSubmatch(data)
+	if len(result) < 3 {
+		return nil, errors.New("replacement does not start with an object header")
+	}
+	if num, _ := strconv.ParseInt(string(result[1]), 10, 64); num != int64(objNum) {
+		return nil, fmt.Errorf("replacement of object %d has object number %d", objNum, num)
+	}
+	if g, _ := strconv.ParseInt(string(result[2]), 10, 64); g != gen {
+		return nil, fmt.Errorf("replacement of object %d has generation %d != %d", objNum, g, gen)
+	}
+	if !bytes.HasSuffix(data, []byte("endobj")) {
+		return nil, errors.New("replacement does not end with endobj")
+	}
+
+	size := int(end - start)
+	if len(data) > size {
+		return nil, fmt.Errorf("replacement of object %d too long (%d > %d bytes)", objNum, len(data), size)
+	}
+	padded := make([]byte, 0, size)
+	padded = append(padded, data[:len(data)-len("endobj")]...)
+	padded = append(padded, bytes.Repeat([]byte(" "), size-len(data))...)
+	padded = append(padded, "endobj"...)
+	return padded, nil
+}
+
 // GetTrailer returns the PDF's trailer dictionary.
 func (this *PdfReader) GetTrailer() (*PdfObjectDictionary, error) {
 	trailerDict := this.parser.GetTrailer()
@@ -0,0 +1,365 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// Test replacing the Info dictionary in place, scrubbing the Producer.  The patched file must
+// parse with the same object offsets.  In the fixture the objects are not separated by EOL
+// markers (...endstreamendobj5 0 obj<<...>>endobjxref).
+func TestObjectReplacementInPlace(t *testing.T) {
+	original, err := ioutil.ReadFile("../../testfiles/lorem.pdf")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	reader, err := NewPdfReader(bytes.NewReader(original))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	trailer, err := reader.GetTrailer()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	infoRef, ok := trailer.Get("Info").(*PdfObjectReference)
+	if !ok {
+		t.Fatalf("Info not a reference")
+	}
+	infoNum := int(infoRef.ObjectNumber)
+
+	spans := map[int][2]int64{}
+	for _, objNum := range reader.GetObjectNums() {
+		start, end, inObjStm, err := reader.GetObjectByteSpan(objNum)
+		if err != nil || inObjStm {
+			t.Fatalf("Object %d: Error: %v (in object stream: %v)", objNum, err, inObjStm)
+		}
+		span := original[start:end]
+		if header := reObjectHeader.FindSubmatch(span); header == nil || string(header[1]) != strconv.Itoa(objNum) {
+			t.Errorf("Object %d span does not start with its header: %q", objNum, span)
+		}
+		if !bytes.HasSuffix(span, []byte("endobj")) {
+			t.Errorf("Object %d span does not end with endobj: %q", objNum, span)
+		}
+		spans[objNum] = [2]int64{start, end}
+	}
+	for objNum, span := range spans {
+		for other, s := range spans {
+			if other != objNum && span[0] < s[1] && s[0] < span[1] {
+				t.Errorf("Spans of objects %d and %d overlap", objNum, other)
+			}
+		}
+	}
+
+	if _, err := reader.FitObjectReplacement(infoNum, bytes.Repeat([]byte("x"), 1000)); err == nil {
+		t.Errorf("Replacement without header should fail")
+	}
+	if _, err := reader.FitObjectReplacement(infoNum, []byte("4 0 obj<</Producer(x)>>endobj")); err == nil {
+		t.Errorf("Replacement with other object number should fail")
+	}
+	long := append([]byte("5 0 obj<</Producer("), bytes.Repeat([]byte("x"), 1000)...)
+	if _, err := reader.FitObjectReplacement(infoNum, append(long, ")>>endobj"...)); err == nil {
+		t.Errorf("Too long replacement should fail")
+	}
+
+	replacement, err := reader.FitObjectReplacement(infoNum, []byte("5 0 obj\n<< /Producer (scrubbed) >>\nendobj\n"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	span := spans[infoNum]
+	if int64(len(replacement)) != span[1]-span[0] {
+		t.Fatalf("Replacement length %d != span length %d", len(replacement), span[1]-span[0])
+	}
+	patched := append([]byte{}, original...)
+	copy(patched[span[0]:span[1]], replacement)
+
+	reader, err = NewPdfReader(bytes.NewReader(patched))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	obj, err := reader.GetIndirectObjectByNumber(infoNum)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	info, ok := TraceToDirectObject(obj).(*PdfObjectDictionary)
+	if !ok {
+		t.Fatalf("Info not a dictionary (%T)", obj)
+	}
+	if producer, ok := info.Get("Producer").(*PdfObjectString); !ok || string(*producer) != "scrubbed" {
+		t.Errorf("Producer not replaced: %v", info.Get("Producer"))
+	}
+	if len(info.Keys()) != 1 {
+		t.Errorf("Unexpected Info entries: %v", info.Keys())
+	}
+	for objNum, span := range spans {
+		start, end, _, err := reader.GetObjectByteSpan(objNum)
+		if err != nil || start != span[0] || end != span[1] {
+			t.Errorf("Object %d: span %d-%d != %d-%d (%v)", objNum, start, end, span[0], span[1], err)
+		}
+	}
+	if _, err := reader.GetPage(1); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+}
+
+// Test loading an encrypted document with passwords provided by a callback, the right one on the
+// last attempt.
+func TestPasswordCallback(t *testing.T) {
+	data := makeEncryptedTestDoc(t, "user", 4, AccessPermissions{})
+
+	passwords := []string{"first", "second", "user"}
+	var infos []EncryptionInfo
+	callback := func(attempt int, info EncryptionInfo) ([]byte, bool) {
+		infos = append(infos, info)
+		return []byte(passwords[attempt-1]), true
+	}
+	reader, err := NewPdfReaderWithOpts(bytes.NewReader(data), &ReaderOpts{PasswordCallback: callback})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(infos) != 3 {
+		t.Fatalf("%d attempts, expected 3", len(infos))
+	}
+	expected := EncryptionInfo{Filter: "Standard", Algorithm: "AESV2", KeyLength: 128, EmptyPasswordTried: true}
+	if infos[0] != expected {
+		t.Errorf("Encryption info %+v, expected %+v", infos[0], expected)
+	}
+	if n, err := reader.GetNumPages(); err != nil || n != 1 {
+		t.Errorf("%d pages (%v), expected 1", n, err)
+	}
+
+	// Wrong passwords until the attempts are exhausted.
+	attempts := 0
+	callback = func(attempt int, info EncryptionInfo) ([]byte, bool) {
+		attempts++
+		return []byte("wrong"), true
+	}
+	_, err = NewPdfReaderWithOpts(bytes.NewReader(data), &ReaderOpts{PasswordCallback: callback, MaxPasswordAttempts: 2})
+	if err != ErrIncorrectPassword || attempts != 2 {
+		t.Errorf("Error %v after %d attempts, expected ErrIncorrectPassword after 2", err, attempts)
+	}
+
+	// Declined on the second attempt.
+	attempts = 0
+	callback = func(attempt int, info EncryptionInfo) ([]byte, bool) {
+		attempts++
+		return []byte("wrong"), attempt < 2
+	}
+	_, err = NewPdfReaderWithOpts(bytes.NewReader(data), &ReaderOpts{PasswordCallback: callback})
+	if err != ErrPasswordDeclined || attempts != 2 {
+		t.Errorf("Error %v after %d attempts, expected ErrPasswordDeclined after 2", err, attempts)
+	}
+
+	// The callback is not called for documents opened with the empty password.
+	callback = func(attempt int, info EncryptionInfo) ([]byte, bool) {
+		t.Errorf("Callback called for the empty user password")
+		return nil, false
+	}
+	reader, err = NewPdfReaderWithOpts(bytes.NewReader(makeEncryptedTestDoc(t, "", 4, AccessPermissions{})), &ReaderOpts{PasswordCallback: callback})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if n, err := reader.GetNumPages(); err != nil || n != 1 {
+		t.Errorf("%d pages (%v), expected 1", n, err)
+	}
+}
+
+// Test that the operation hooks of the writer and of the reader options report the encryption of
+// the document written, and the decryption and decoding of the document loaded.
+func TestOperationHookOptions(t *testing.T) {
+	counts := map[OperationType]int{}
+	hook := func(info OperationInfo) { counts[info.Operation]++ }
+
+	w := NewPdfWriter()
+	w.SetOperationHook(hook)
+	page := NewPdfPage()
+	page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+	page.AddContentStreamByString("BT /F1 12 Tf 10 10 Td (Hello) Tj ET")
+	page.Resources = NewPdfPageResources()
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := w.Encrypt([]byte(""), []byte("owner"), &EncryptOptions{Algorithm: AES_128bit}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if counts[OperationEncrypt] == 0 || counts[OperationDecrypt] != 0 {
+		t.Errorf("Writing reported %v", counts)
+	}
+
+	counts = map[OperationType]int{}
+	opts := &ReaderOpts{ParserOpts: ParserOpts{OperationHook: hook}}
+	reader, err := NewPdfReaderWithOpts(bytes.NewReader(data), opts)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if ok, err := reader.Decrypt([]byte("")); !ok || err != nil {
+		t.Fatalf("Decryption failed (%v)", err)
+	}
+	page, err = reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := page.GetAllContentStreams(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if counts[OperationDecrypt] == 0 || counts[OperationDecode] == 0 || counts[OperationEncrypt] != 0 {
+		t.Errorf("Reading reported %v", counts)
+	}
+}
+
+// Test that the content streams of an encrypted document loaded with ReadOnlyDecryption keep their
+// encrypted data and Length, while decoding them and writing the document out decrypts them.
+func TestReadOnlyDecryption(t *testing.T) {
+	data := makeEncryptedTestDoc(t, "", 4, AccessPermissions{})
+	opts := &ReaderOpts{ParserOpts: ParserOpts{ReadOnlyDecryption: true}}
+	reader, err := NewPdfReaderWithOpts(bytes.NewReader(data), opts)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if ok, err := reader.Decrypt([]byte("")); !ok || err != nil {
+		t.Fatalf("Decryption failed (%v)", err)
+	}
+	page, err := reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	contents, ok := TraceToDirectObject(page.Contents).(*PdfObjectArray)
+	if !ok || len(*contents) == 0 {
+		t.Fatalf("Contents not an array of streams: %v", page.Contents)
+	}
+	stream, ok := TraceToDirectObject((*contents)[0]).(*PdfObjectStream)
+	if !ok {
+		t.Fatalf("Contents not a stream (%T)", (*contents)[0])
+	}
+	encrypted := append([]byte{}, stream.Stream...)
+	length := stream.Get("Length").DefaultWriteString()
+	if !bytes.Contains(data, encrypted) {
+		t.Errorf("Stream data differs from the file")
+	}
+
+	const expected = "BT /F1 12 Tf 10 10 Td (Hello) Tj ET"
+	if content, err := page.GetAllContentStreams(); err != nil || !strings.HasPrefix(content, expected) {
+		t.Errorf("Content %q (%v), expected %q", content, err, expected)
+	}
+	if decoded, err := DecodeStreamReadOnly(stream); err != nil || string(decoded) != expected {
+		t.Errorf("Decoded %q (%v), expected %q", decoded, err, expected)
+	}
+	if !bytes.Equal(stream.Stream, encrypted) {
+		t.Errorf("Stream data modified")
+	}
+	if l := stream.Get("Length").DefaultWriteString(); l != length || l != strconv.Itoa(len(encrypted)) {
+		t.Errorf("Length %s, expected %s", l, length)
+	}
+
+	// Written out unencrypted.
+	w := NewPdfWriter()
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	out, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !bytes.Equal(stream.Stream, encrypted) {
+		t.Errorf("Stream data modified by writing")
+	}
+	reader, err = NewPdfReader(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	page, err = reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if content, err := page.GetAllContentStreams(); err != nil || !strings.HasPrefix(content, expected) {
+		t.Errorf("Written content %q (%v), expected %q", content, err, expected)
+	}
+
+	// MutableStream replaces the data with its decrypted form.
+	if mutable := stream.MutableStream(); bytes.Equal(mutable, encrypted) {
+		t.Errorf("Mutable stream data still encrypted")
+	}
+	if decoded, err := DecodeStream(stream); err != nil || string(decoded) != expected {
+		t.Errorf("Decoded %q (%v) after MutableStream, expected %q", decoded, err, expected)
+	}
+}
+
+// Test that images of an encrypted document loaded with ReadOnlyDecryption are taken decrypted, so
+// that changing their filter re-encodes the image data.
+func TestReadOnlyDecryptionImage(t *testing.T) {
+	samples := []byte{0x10, 0x20, 0x30, 0x40}
+	img := &Image{Width: 2, Height: 2, BitsPerComponent: 8, ColorComponents: 1, Data: samples}
+	ximg, err := NewXObjectImageFromImage(img, nil, NewRawEncoder())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	page := NewPdfPage()
+	page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+	page.Resources = NewPdfPageResources()
+	if err := page.AddImageResource("Im1", ximg); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	w := NewPdfWriter()
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := w.Encrypt([]byte(""), []byte("owner"), &EncryptOptions{Algorithm: AES_128bit}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	opts := &ReaderOpts{ParserOpts: ParserOpts{ReadOnlyDecryption: true}}
+	reader, err := NewPdfReaderWithOpts(bytes.NewReader(data), opts)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if ok, err := reader.Decrypt([]byte("")); !ok || err != nil {
+		t.Fatalf("Decryption failed (%v)", err)
+	}
+	page, err = reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	obj, found := page.GetXObjectByName("Im1")
+	if !found {
+		t.Fatalf("Image not found")
+	}
+	stream, ok := TraceToDirectObject(obj).(*PdfObjectStream)
+	if !ok {
+		t.Fatalf("Image not a stream (%T)", obj)
+	}
+	encrypted := append([]byte{}, stream.Stream...)
+
+	ximg, err = NewXObjectImageFromStream(stream)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !bytes.Equal(ximg.Stream, samples) {
+		t.Errorf("Image data % x, expected % x", ximg.Stream, samples)
+	}
+	if err := ximg.SetFilter(NewFlateEncoder()); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if decoded, err := ximg.Filter.DecodeBytes(ximg.Stream); err != nil || !bytes.Equal(decoded, samples) {
+		t.Errorf("Re-encoded image data % x (%v), expected % x", decoded, err, samples)
+	}
+	if !bytes.Equal(stream.Stream, encrypted) {
+		t.Errorf("Stream data modified")
+	}
+}
@@ -125,9 +125,9 @@ func (r *PdfPageResources) GetExtGState(keyName PdfObjectName) (PdfObject, bool)
 	}
 }
 
-// Check whether a font is defined by the specified keyName.
+// Check whether an ExtGState is defined by the specified keyName.
 func (r *PdfPageResources) HasExtGState(keyName PdfObjectName) bool {
-	_, has := r.GetFontByName(keyName)
+	_, has := r.GetExtGState(keyName)
 	return has
 }
 
@@ -80,6 +80,8 @@ type PdfDate struct {
 	utOffsetSign  byte  // O ('+' / '-' / 'Z')
 	utOffsetHours int64 // HH' (00-23 followed by ')
 	utOffsetMins  int64 // mm (00-59)
+
+	raw string // Original date string, if loaded from one.
 }
 
 var reDate = regexp.MustCompile(`\s*D\s*:\s*(\d{4})(\d{2})(\d{2})(\d{2})(\d{2})(\d{2})([+-Z])?(\d{2})?'?(\d{2})?`)
@@ -120,12 +122,19 @@ func NewPdfDate(dateStr string) (PdfDate, error) {
 	} else {
 		d.utOffsetMins = 0
 	}
+	d.raw = dateStr
 
 	return d, nil
 }
 
-// Convert to a PDF string object.
+// Convert to a PDF string object.  A date loaded from a string is written back unchanged, which
+// matters for LastModified dates that are compared against private application data (PieceInfo).
 func (date *PdfDate) ToPdfObject() PdfObject {
+	if len(date.raw) > 0 {
+		pdfStr := PdfObjectString(date.raw)
+		return &pdfStr
+	}
+
 	str := fmt.Sprintf("D:%.4d%.2d%.2d%.2d%.2d%.2d%c%.2d'%.2d'",
 		date.year, date.month, date.day, date.hour, date.minute, date.second,
 		date.utOffsetSign, date.utOffsetHours, date.utOffsetMins)
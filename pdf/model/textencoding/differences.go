@@ -0,0 +1,148 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package textencoding
+
+import (
+	"sort"
+
+	"github.com/unidoc/unidoc/pdf/core"
+)
+
+// DifferencesEncoder is the encoding given by a font Encoding dictionary: a base encoding with the
+// character codes of the Differences array mapped to other glyphs (9.6.6.1 - Table 114).
+type DifferencesEncoder struct {
+	base        TextEncoder
+	differences map[byte]string
+	glyphCodes  map[string]byte
+}
+
+// NewDifferencesEncoder returns the encoder of the encoding `base` with the character codes of
+// `differences` mapped to their glyph names.
+func NewDifferencesEncoder(base TextEncoder, differences map[byte]string) DifferencesEncoder {
+	enc := DifferencesEncoder{
+		base:        base,
+		differences: map[byte]string{},
+		glyphCodes:  map[string]byte{},
+	}
+	codes := []int{}
+	for code := range differences {
+		codes = append(codes, int(code))
+	}
+	// The lowest code is used for glyphs appearing more than once.
+	sort.Sort(sort.Reverse(sort.IntSlice(codes)))
+	for _, code := range codes {
+		glyph := differences[byte(code)]
+		enc.differences[byte(code)] = glyph
+		enc.glyphCodes[glyph] = byte(code)
+	}
+	return enc
+}
+
+// ToPdfObject returns the Encoding dictionary with the base encoding as BaseEncoding and the
+// Differences array.
+func (enc DifferencesEncoder) ToPdfObject() core.PdfObject {
+	dict := core.MakeDict()
+	dict.Set("Type", core.MakeName("Encoding"))
+	if name, ok := enc.base.ToPdfObject().(*core.PdfObjectName); ok {
+		dict.Set("BaseEncoding", name)
+	}
+
+	codes := []int{}
+	for code := range enc.differences {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+	differences := core.PdfObjectArray{}
+	for i, code := range codes {
+		if i == 0 || code != codes[i-1]+1 {
+			differences = append(differences, core.MakeInteger(int64(code)))
+		}
+		differences = append(differences, core.MakeName(enc.differences[byte(code)]))
+	}
+	dict.Set("Differences", &differences)
+	return dict
+}
+
+// Encode converts a raw utf8 string (series of runes) to an encoded string (series of character
+// codes) to be used in PDF.
+func (enc DifferencesEncoder) Encode(raw string) string {
+	encoded := []byte{}
+	for _, r := range raw {
+		if code, has := enc.RuneToCharcode(r); has {
+			encoded = append(encoded, code)
+		}
+	}
+	return string(encoded)
+}
+
+// CharcodeToGlyph returns the glyph name of character code `code`, from the Differences or else
+// the base encoding.  The bool return flag is true if there was a match, and false otherwise.
+func (enc DifferencesEncoder) CharcodeToGlyph(code byte) (string, bool) {
+	if glyph, has := enc.differences[code]; has {
+		return glyph, true
+	}
+	return enc.base.CharcodeToGlyph(code)
+}
+
+// GlyphToCharcode returns the character code of glyph `glyph`.  Codes of the base encoding that
+// the Differences map to another glyph are not used.
+// The bool return flag is true if there was a match, and false otherwise.
+func (enc DifferencesEncoder) GlyphToCharcode(glyph string) (byte, bool) {
+	if code, has := enc.glyphCodes[glyph]; has {
+		return code, true
+	}
+	code, found := enc.base.GlyphToCharcode(glyph)
+	if !found {
+		return 0, false
+	}
+	if _, replaced := enc.differences[code]; replaced {
+		return 0, false
+	}
+	return code, true
+}
+
+// RuneToCharcode converts rune `val` to a character code.
+// The bool return flag is true if there was a match, and false otherwise.
+func (enc DifferencesEncoder) RuneToCharcode(val rune) (byte, bool) {
+	glyph, found := enc.RuneToGlyph(val)
+	if !found {
+		return 0, false
+	}
+	return enc.GlyphToCharcode(glyph)
+}
+
+// CharcodeToRune converts character code `charcode` to a rune.
+// The bool return flag is true if there was a match, and false otherwise.
+func (enc DifferencesEncoder) CharcodeToRune(charcode byte) (rune, bool) {
+	glyph, found := enc.CharcodeToGlyph(charcode)
+	if !found {
+		return 0, false
+	}
+	return enc.GlyphToRune(glyph)
+}
+
+// RuneToGlyph converts rune `val` to a glyph name, with the glyph names of the base encoding or
+// else of the Adobe Glyph List.
+// The bool return flag is true if there was a match, and false otherwise.
+func (enc DifferencesEncoder) RuneToGlyph(val rune) (string, bool) {
+	if glyph, found := enc.base.RuneToGlyph(val); found {
+		return glyph, true
+	}
+	return runeToGlyph(val, glyphlistRuneToGlyphMap)
+}
+
+// GlyphToRune converts glyph `glyph` to a rune, with the glyph names of the base encoding or else
+// of the Adobe Glyph List, also for glyph names of other conventions (see NormalizeGlyphName).
+// The bool return flag is true if there was a match, and false otherwise.
+func (enc DifferencesEncoder) GlyphToRune(glyph string) (rune, bool) {
+	if r, found := enc.base.GlyphToRune(glyph); found {
+		return r, true
+	}
+	if r, found := glyphToRune(glyph, glyphlistGlyphToRuneMap); found {
+		return r, true
+	}
+	return glyphToRune(NormalizeGlyphName(glyph), glyphlistGlyphToRuneMap)
+}
@@ -0,0 +1,42 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package textencoding
+
+import (
+	"testing"
+
+	"github.com/unidoc/unidoc/pdf/core"
+)
+
+func TestDifferencesEncoder(t *testing.T) {
+	enc := NewDifferencesEncoder(NewWinAnsiTextEncoder(), map[byte]string{65: "Euro", 66: "Aring", 200: "Euro"})
+
+	if glyph, found := enc.CharcodeToGlyph(65); !found || glyph != "Euro" {
+		t.Errorf("Code 65: %q != Euro", glyph)
+	}
+	if glyph, found := enc.CharcodeToGlyph(67); !found || glyph != "C" {
+		t.Errorf("Code 67: %q != C", glyph)
+	}
+	// The lowest code of the Differences, not the WinAnsiEncoding code 128.
+	if code, found := enc.GlyphToCharcode("Euro"); !found || code != 65 {
+		t.Errorf("Euro: code %d != 65", code)
+	}
+	// Code 65 of the base encoding is replaced.
+	if code, found := enc.GlyphToCharcode("A"); found {
+		t.Errorf("A should not be encoded (code %d)", code)
+	}
+	if r, found := enc.CharcodeToRune(66); !found || r != 'Å' {
+		t.Errorf("Code 66: %q != Å", r)
+	}
+	if s := enc.Encode("€CÅA"); s != "\x41\x43\x42" {
+		t.Errorf("Encoded %q", s)
+	}
+
+	expected := "<</Type /Encoding/BaseEncoding /WinAnsiEncoding/Differences [65 /Euro /Aring 200 /Euro]>>"
+	if s := enc.ToPdfObject().(*core.PdfObjectDictionary).DefaultWriteString(); s != expected {
+		t.Errorf("Encoding %s != %s", s, expected)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package textencoding
+
+import (
+	"strconv"
+	"strings"
+)
+
+// combiningMarkSuffixes are the suffixes of the Adobe Glyph List names of the precomposed
+// characters of a letter and a combining diacritical mark, e.g. Adieresis for A and U+0308.
+var combiningMarkSuffixes = map[rune]string{
+	0x0300: "grave",
+	0x0301: "acute",
+	0x0302: "circumflex",
+	0x0303: "tilde",
+	0x0304: "macron",
+	0x0306: "breve",
+	0x0307: "dotaccent",
+	0x0308: "dieresis",
+	0x030a: "ring",
+	0x030b: "hungarumlaut",
+	0x030c: "caron",
+	0x0327: "cedilla",
+	0x0328: "ogonek",
+}
+
+// NormalizeGlyphName returns the Adobe Glyph List name of the character of glyph name `glyph`, so
+// that glyph names of different conventions can be matched: uniXXXX and uXXXX[XX] names, letters
+// followed by combining diacritical marks (e.g. uni00410308 or A_uni0308 for Adieresis) and the
+// components of Latin ligatures (e.g. f_i for fi).  A suffix starting with a period is kept, e.g.
+// uni00C4.sc gives Adieresis.sc.  Returns `glyph` if it is an Adobe Glyph List name or has no
+// such equivalent.
+func NormalizeGlyphName(glyph string) string {
+	if _, found := glyphlistGlyphToRuneMap[glyph]; found {
+		return glyph
+	}
+	name, suffix := glyph, ""
+	if i := strings.IndexByte(glyph, '.'); i > 0 {
+		name, suffix = glyph[:i], glyph[i:]
+	}
+	runes, ok := glyphNameRunes(name)
+	if !ok {
+		return glyph
+	}
+
+	base, found := glyphlistRuneToGlyphMap[runes[0]]
+	if !found {
+		return glyph
+	}
+	if len(runes) == 1 {
+		return base + suffix
+	}
+
+	// Letter followed by combining marks.
+	composed := base
+	for _, r := range runes[1:] {
+		mark, found := combiningMarkSuffixes[r]
+		if !found {
+			composed = ""
+			break
+		}
+		composed += mark
+	}
+	if _, found := glyphlistGlyphToRuneMap[composed]; found && composed != "" {
+		return composed + suffix
+	}
+
+	// Components of a Latin ligature (U+FB00 to U+FB06).
+	joined := ""
+	for _, r := range runes {
+		name, found := glyphlistRuneToGlyphMap[r]
+		if !found {
+			return glyph
+		}
+		joined += name
+	}
+	if r, found := glyphlistGlyphToRuneMap[joined]; found && r >= 0xfb00 && r <= 0xfb06 {
+		return joined + suffix
+	}
+	return glyph
+}
+
+// glyphNameRunes returns the characters of glyph name `name` (without suffix) following the Adobe
+// Glyph List Specification: components separated by underscores which are Adobe Glyph List names,
+// uni names with one or more groups of 4 uppercase hexadecimal digits, or u names with 4 to 6
+// uppercase hexadecimal digits.  The bool return flag is false if a component is none of these.
+func glyphNameRunes(name string) ([]rune, bool) {
+	var runes []rune
+	for _, component := range strings.Split(name, "_") {
+		if r, found := glyphlistGlyphToRuneMap[component]; found {
+			runes = append(runes, r)
+			continue
+		}
+		if strings.HasPrefix(component, "uni") && len(component) > 3 && (len(component)-3)%4 == 0 {
+			for i := 3; i < len(component); i += 4 {
+				r, ok := parseGlyphCodePoint(component[i : i+4])
+				if !ok {
+					return nil, false
+				}
+				runes = append(runes, r)
+			}
+			continue
+		}
+		if strings.HasPrefix(component, "u") && len(component) >= 5 && len(component) <= 7 {
+			r, ok := parseGlyphCodePoint(component[1:])
+			if !ok {
+				return nil, false
+			}
+			runes = append(runes, r)
+			continue
+		}
+		return nil, false
+	}
+	return runes, len(runes) > 0
+}
+
+// parseGlyphCodePoint parses the code point of uppercase hexadecimal digits `digits` of a uni or u
+// glyph name.  Surrogates and values beyond U+10FFFF are invalid.
+func parseGlyphCodePoint(digits string) (rune, bool) {
+	if strings.ToUpper(digits) != digits {
+		return 0, false
+	}
+	val, err := strconv.ParseUint(digits, 16, 32)
+	if err != nil || (val >= 0xd800 && val <= 0xdfff) || val > 0x10ffff {
+		return 0, false
+	}
+	return rune(val), true
+}
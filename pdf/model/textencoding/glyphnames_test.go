@@ -0,0 +1,46 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package textencoding
+
+import "testing"
+
+func TestNormalizeGlyphName(t *testing.T) {
+	testcases := []struct {
+		Glyph    string
+		Expected string
+	}{
+		// Equivalent names of Adieresis.
+		{"Adieresis", "Adieresis"},
+		{"uni00C4", "Adieresis"},
+		{"u00C4", "Adieresis"},
+		{"uni00410308", "Adieresis"},
+		{"A_uni0308", "Adieresis"},
+		{"A_u0308", "Adieresis"},
+		{"uni00C4.sc", "Adieresis.sc"},
+		// Ligatures.
+		{"f_i", "fi"},
+		{"uni00660069", "fi"},
+		{"f_f_l", "ffl"},
+		// Other names of the Adobe Glyph List are kept.
+		{"nonbreakingspace", "nonbreakingspace"},
+		{"uni00A0", "nbspace"},
+		{"u1F600", "u1F600"},
+		// No equivalent names.
+		{"uni00c4", "uni00c4"},
+		{"uniD800", "uniD800"},
+		{"uni00C", "uni00C"},
+		{"T_h", "T_h"},
+		{"d_e_l_t_a", "d_e_l_t_a"},
+		{"A_uni0301_x", "A_uni0301_x"},
+		{"g123", "g123"},
+		{".notdef", ".notdef"},
+	}
+	for _, tcase := range testcases {
+		if glyph := NormalizeGlyphName(tcase.Glyph); glyph != tcase.Expected {
+			t.Errorf("%s: %q, expected %q", tcase.Glyph, glyph, tcase.Expected)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package textencoding
+
+import "testing"
+
+// TestStandardVsWinAnsi checks the code points where StandardEncoding and WinAnsiEncoding differ.
+func TestStandardVsWinAnsi(t *testing.T) {
+	std := NewStandardEncoder()
+	win := NewWinAnsiTextEncoder()
+
+	testcases := []struct {
+		code     byte
+		stdGlyph string
+		winGlyph string
+	}{
+		{39, "quoteright", "quotesingle"},
+		{96, "quoteleft", "grave"},
+		{0xA4, "fraction", "currency"},
+		{0xA9, "quotesingle", "copyright"},
+		{0xAE, "fi", "registered"},
+		{0xB1, "endash", "plusminus"},
+		{0xC1, "grave", "Aacute"},
+		{0xE1, "AE", "aacute"},
+		{0xFB, "germandbls", "ucircumflex"},
+	}
+
+	for _, tc := range testcases {
+		glyph, found := std.CharcodeToGlyph(tc.code)
+		if !found || glyph != tc.stdGlyph {
+			t.Errorf("Standard: code %d -> %q (%v), expected %q", tc.code, glyph, found, tc.stdGlyph)
+		}
+		glyph, found = win.CharcodeToGlyph(tc.code)
+		if !found || glyph != tc.winGlyph {
+			t.Errorf("WinAnsi: code %d -> %q (%v), expected %q", tc.code, glyph, found, tc.winGlyph)
+		}
+	}
+
+	r, found := std.CharcodeToRune(39)
+	if !found || r != '’' {
+		t.Errorf("Standard: code 39 -> %q, expected right single quotation mark", r)
+	}
+	r, found = win.CharcodeToRune(39)
+	if !found || r != '\'' {
+		t.Errorf("WinAnsi: code 39 -> %q, expected apostrophe", r)
+	}
+
+	// Codes not in StandardEncoding.
+	if _, found := std.CharcodeToGlyph(0x80); found {
+		t.Errorf("Standard: code 0x80 should not be mapped")
+	}
+	if code, found := std.RuneToCharcode('’'); !found || code != 39 {
+		t.Errorf("Standard: rune ’ -> %d (%v), expected 39", code, found)
+	}
+}
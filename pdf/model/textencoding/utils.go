@@ -7,6 +7,12 @@ package textencoding
 
 import "github.com/unidoc/unidoc/common"
 
+// GlyphToRune returns the Unicode value of the glyph according to the Adobe Glyph List.
+// The bool return flag is true if there was a match, and false otherwise.
+func GlyphToRune(glyph string) (rune, bool) {
+	return glyphToRune(glyph, glyphlistGlyphToRuneMap)
+}
+
 func glyphToRune(glyph string, glyphToRuneMap map[string]rune) (rune, bool) {
 	ucode, found := glyphToRuneMap[glyph]
 	if found {
@@ -17,6 +23,17 @@ func glyphToRune(glyph string, glyphToRuneMap map[string]rune) (rune, bool) {
 	return 0, false
 }
 
+// NumMappedCharcodes returns the number of character codes (0-255) that `encoder` maps to a rune.
+func NumMappedCharcodes(encoder TextEncoder) int {
+	count := 0
+	for code := 0; code < 256; code++ {
+		if _, found := encoder.CharcodeToRune(byte(code)); found {
+			count++
+		}
+	}
+	return count
+}
+
 func runeToGlyph(ucode rune, runeToGlyphMap map[rune]string) (string, bool) {
 	glyph, found := runeToGlyphMap[ucode]
 	if found {
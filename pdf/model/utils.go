@@ -7,6 +7,7 @@ package model
 
 import (
 	"errors"
+	"unicode/utf16"
 
 	"github.com/unidoc/unidoc/common"
 	. "github.com/unidoc/unidoc/pdf/core"
@@ -82,6 +83,41 @@ func getNumberAsFloatOrNull(obj PdfObject) (*float64, error) {
 	return nil, errors.New("Not a number")
 }
 
+// decodePdfTextString returns the text of PDF text string `str` (7.9.2.2), which is either UTF-16BE
+// with a byte order mark, or PDFDocEncoding which is treated as Latin-1 here.
+func decodePdfTextString(str string) string {
+	if len(str) >= 2 && str[0] == 0xfe && str[1] == 0xff {
+		units := []uint16{}
+		for i := 2; i+1 < len(str); i += 2 {
+			units = append(units, uint16(str[i])<<8|uint16(str[i+1]))
+		}
+		return string(utf16.Decode(units))
+	}
+	runes := make([]rune, len(str))
+	for i := 0; i < len(str); i++ {
+		runes[i] = rune(str[i])
+	}
+	return string(runes)
+}
+
+// encodePdfTextString returns the PDF text string of `text`, in PDFDocEncoding (treated as
+// Latin-1) if possible and else in UTF-16BE with a byte order mark.
+func encodePdfTextString(text string) string {
+	latin1 := []byte{}
+	for _, r := range text {
+		if r > 0xff {
+			units := utf16.Encode([]rune(text))
+			encoded := []byte{0xfe, 0xff}
+			for _, u := range units {
+				encoded = append(encoded, byte(u>>8), byte(u))
+			}
+			return string(encoded)
+		}
+		latin1 = append(latin1, byte(r))
+	}
+	return string(latin1)
+}
+
 // Handy function for debugging in development.
 func debugObject(obj PdfObject) {
 	common.Log.Debug("obj: %T %s", obj, obj.String())
@@ -10,13 +10,14 @@ package model
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/md5"
 	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -77,6 +78,49 @@ type PdfWriter struct {
 
 	// Forms.
 	acroForm *PdfAcroForm
+
+	// Deterministic output mode and explicit object number assignments.
+	deterministic bool
+	renumbering   map[int64]int64
+
+	// Policy deciding the stream filters when writing (optional).
+	filterPolicy FilterPolicy
+
+	// Maximum number of significant digits of the reals written, 0 if not limited.
+	floatPrecision int
+
+	// Hook reporting the encryption of the objects written (optional).
+	operationHook OperationHook
+
+	// Developer extensions declared in the catalog and private trailer entries (optional), and
+	// whether they were set explicitly rather than carried over from the source document.
+	extensions     *PdfExtensions
+	trailerEntries *PdfObjectDictionary
+	extensionsSet  bool
+	trailerKeysSet map[PdfObjectName]bool
+
+	// Reader of the first added page loaded from a document, whose document-level entries are
+	// carried over by default.
+	source *PdfReader
+	// Check of the owner rights to the source document for the encryption set by Encrypt or
+	// SetEncryption before the source document was known, run by AddPage.
+	ownerRightsCheck func(source *PdfReader) error
+
+	// Output intent profile if writing a PDF/A-1b document.
+	pdfaProfile *ICCProfile
+
+	// Font of the watermark added to the pages by unlicensed copies, Helvetica if not set.
+	watermarkFont *PdfFont
+
+	// Named destinations and document-level JavaScript of the Names dictionary (optional).  Those of
+	// the source document are merged in, except the destinations removed and, if javaScriptSet,
+	// the scripts.
+	namedDests    map[string]Destination
+	removedDests  map[string]bool
+	javaScript    []NamedScript
+	javaScriptSet bool
+	// Context of the objects imported from other documents by ImportObject.
+	importContext *ImportContext
 }
 
 func NewPdfWriter() PdfWriter {
@@ -135,6 +179,75 @@ func (this *PdfWriter) SetVersion(majorVersion, minorVersion int) {
 	this.minorVersion = minorVersion
 }
 
+// SetDeterministic enables or disables deterministic output.  When enabled, objects are numbered
+// depth-first from the document catalog (dictionary keys visited in sorted order), and the trailer
+// ID is derived from the document contents and information rather than time and random data, so
+// that two writes from identical inputs produce identical files.
+// Must be called prior to Encrypt for the ID to be deterministic, and the ID is that of the
+// contents added before Encrypt.
+func (this *PdfWriter) SetDeterministic(deterministic bool) {
+	this.deterministic = deterministic
+}
+
+// SetFloatPrecision sets the maximum number of significant digits of the reals written in the
+// objects of the document, e.g. 6 to drop the noise digits of computed values.  By default (0)
+// reals are not rounded and values parsed from a source document are written back exactly.  Does
+// not apply to the contents of streams: see ContentCreator.SetFloatPrecision for content streams.
+func (this *PdfWriter) SetFloatPrecision(digits int) {
+	if digits < 0 {
+		digits = 0
+	}
+	this.floatPrecision = digits
+}
+
+// SetOperationHook sets `hook` to be called after the encryption of each string and stream written
+// when encrypting the document, as for the decryption of a document loaded with
+// ParserOpts.OperationHook.  Nil (the default) disables the reports.
+func (this *PdfWriter) SetOperationHook(hook OperationHook) {
+	this.operationHook = hook
+}
+
+// RenumberObjects requests specific object numbers for the output file.  The mapping keys are the
+// object numbers the writer would otherwise assign (as seen in the output of a previous write with
+// the same inputs, e.g. in deterministic mode) and the values are the requested numbers.
+// Objects that are not in the mapping are numbered sequentially, skipping the requested numbers.
+// All references, including /Parent back-references, the xref table and the encryption keys
+// follow the new numbers.
+func (this *PdfWriter) RenumberObjects(mapping map[int64]int64) error {
+	used := map[int64]bool{}
+	for from, to := range mapping {
+		if from <= 0 || to <= 0 {
+			common.Log.Debug("ERROR: Invalid object number mapping %d -> %d", from, to)
+			return errors.New("Range check error")
+		}
+		if used[to] {
+			common.Log.Debug("ERROR: Object number %d requested more than once", to)
+			return errors.New("Duplicate object number")
+		}
+		used[to] = true
+	}
+
+	this.renumbering = map[int64]int64{}
+	for from, to := range mapping {
+		this.renumbering[from] = to
+	}
+
+	return nil
+}
+
+// SetPieceInfo sets the document-level page-piece dictionary (PieceInfo) in the catalog.
+// The objects are written as-is, with stream data kept byte for byte.
+func (this *PdfWriter) SetPieceInfo(pieceInfo PdfObject) error {
+	if pieceInfo == nil {
+		this.catalog.Remove("PieceInfo")
+		return nil
+	}
+
+	common.Log.Trace("Setting PieceInfo...")
+	this.catalog.Set("PieceInfo", pieceInfo)
+	return this.addObjects(pieceInfo)
+}
+
 // Set the optional content properties.
 func (this *PdfWriter) SetOCProperties(ocProperties PdfObject) error {
 	dict := this.catalog
@@ -149,6 +262,271 @@ func (this *PdfWriter) SetOCProperties(ocProperties PdfObject) error {
 	return nil
 }
 
+// SetPageLabels sets the page label ranges of the document (PageLabels), or nil for none.  The
+// ranges must be sorted by start page index, the first starting at index 0.
+func (this *PdfWriter) SetPageLabels(ranges []PdfPageLabelRange) error {
+	if ranges == nil {
+		this.catalog.Remove("PageLabels")
+		return nil
+	}
+
+	tree, err := makePageLabelsNumberTree(ranges)
+	if err != nil {
+		return err
+	}
+	common.Log.Trace("Setting PageLabels...")
+	obj := MakeIndirectObject(tree)
+	this.catalog.Set("PageLabels", obj)
+	return this.addObjects(obj)
+}
+
+// SetNamedDestination sets the named destination `name` (Dests of the Names dictionary) to
+// `dest`.  The page of the destination is dest.Page, which must be added to the writer with
+// AddPage, or if nil the page with index dest.PageIndex of the written document.  The destination
+// page is resolved when writing, so the destinations read from a document remain valid when its
+// pages are added to the writer and renumbered.  The named destinations of the source document
+// (the document of the first page added) are carried over unless replaced or removed, as long as
+// their pages are written.
+func (this *PdfWriter) SetNamedDestination(name string, dest Destination) error {
+	if dest.Page == nil && dest.PageIndex < 0 {
+		return ErrRangeError
+	}
+	if dest.Fit == "" {
+		return errors.New("destination without Fit")
+	}
+	if this.namedDests == nil {
+		this.namedDests = map[string]Destination{}
+	}
+	this.namedDests[name] = dest
+	delete(this.removedDests, name)
+	return nil
+}
+
+// RemoveNamedDestination removes the named destination `name`, set with SetNamedDestination or
+// carried over from the source document.  Returns false if there was no such destination.
+func (this *PdfWriter) RemoveNamedDestination(name string) bool {
+	_, has := this.namedDests[name]
+	delete(this.namedDests, name)
+	if !has && this.source != nil && !this.removedDests[name] {
+		dests, err := this.source.GetNamedDestinations()
+		if err != nil {
+			common.Log.Debug("ERROR: Unable to load the named destinations of the source document: %v", err)
+		}
+		_, has = dests[name]
+	}
+	if this.removedDests == nil {
+		this.removedDests = map[string]bool{}
+	}
+	this.removedDests[name] = true
+	return has
+}
+
+// SetDocumentJavaScript sets the document-level JavaScript (JavaScript of the Names dictionary),
+// or nil for none, replacing that of the source document.  The script names must be unique.
+func (this *PdfWriter) SetDocumentJavaScript(scripts []NamedScript) error {
+	names := map[string]bool{}
+	for _, script := range scripts {
+		if names[script.Name] {
+			return fmt.Errorf("JavaScript name %q not unique", script.Name)
+		}
+		names[script.Name] = true
+	}
+	this.javaScript = append([]NamedScript{}, scripts...)
+	this.javaScriptSet = true
+	return nil
+}
+
+// setNames sets the Names dictionary of the catalog with the named destinations and the
+// document-level JavaScript, as balanced name trees, merged with the Names dictionary and the
+// Dests dictionary of the source document.  The other name trees of the source document are
+// carried over as they are, except the Pages tree, whose pages may not be written.
+func (this *PdfWriter) setNames() error {
+	names := MakeDict()
+	dests := map[string]Destination{}
+	scripts := this.javaScript
+	if this.source != nil {
+		this.copySourceNames(names)
+
+		sourceDests, err := this.source.GetNamedDestinations()
+		if err != nil {
+			common.Log.Debug("ERROR: Unable to load the named destinations of the source document: %v", err)
+		}
+		for name, dest := range sourceDests {
+			if this.removedDests[name] {
+				continue
+			}
+			if dest.Page == nil || !this.hasObject(dest.Page) {
+				common.Log.Debug("Dropping named destination %q of the source document: page not written", name)
+				continue
+			}
+			dests[name] = dest
+		}
+
+		if !this.javaScriptSet {
+			scripts, err = this.source.GetDocumentJavaScript()
+			if err != nil {
+				common.Log.Debug("ERROR: Unable to load the JavaScript of the source document: %v", err)
+			}
+		}
+	}
+	for name, dest := range this.namedDests {
+		dests[name] = dest
+	}
+
+	if len(dests) > 0 {
+		tree := NewNameTree()
+		for name, dest := range dests {
+			arr, err := this.makeDestination(dest)
+			if err != nil {
+				return fmt.Errorf("named destination %q: %v", name, err)
+			}
+			tree.Insert(name, arr)
+		}
+		names.Set("Dests", MakeIndirectObject(tree.ToPdfObject()))
+	}
+
+	if len(scripts) > 0 {
+		tree := NewNameTree()
+		for _, script := range scripts {
+			tree.Insert(script.Name, makeJavaScriptAction(script))
+		}
+		names.Set("JavaScript", MakeIndirectObject(tree.ToPdfObject()))
+	}
+
+	if len(names.Keys()) == 0 {
+		return nil
+	}
+	common.Log.Trace("Setting Names...")
+	this.catalog.Set("Names", names)
+	return this.addObjects(names)
+}
+
+// copySourceNames copies the entries of the Names dictionary of the source document to `names`,
+// except the Dests and JavaScript trees, which are rebuilt, and the Pages tree.
+func (this *PdfWriter) copySourceNames(names *PdfObjectDictionary) {
+	obj := this.source.catalog.Get("Names")
+	if obj == nil {
+		return
+	}
+	obj, err := this.source.traceToObject(obj)
+	if err != nil {
+		common.Log.Debug("ERROR: Unable to load the Names of the source document: %v", err)
+		return
+	}
+	sourceNames, ok := TraceToDirectObject(obj).(*PdfObjectDictionary)
+	if !ok {
+		common.Log.Debug("Names of the source document not a dictionary (%T) - skipping", obj)
+		return
+	}
+	for _, key := range sourceNames.Keys() {
+		switch key {
+		case "Dests", "JavaScript":
+			continue
+		case "Pages":
+			common.Log.Debug("Dropping the Pages name tree of the source document")
+			continue
+		}
+		val, err := this.source.traceToObject(sourceNames.Get(key))
+		if err == nil {
+			err = this.source.traverseObjectData(val)
+		}
+		if err != nil {
+			common.Log.Debug("ERROR: Skipping name tree %s of the source document: %v", key, err)
+			continue
+		}
+		names.Set(key, val)
+	}
+}
+
+// SetExtensions sets the developer extensions declared in the catalog (Extensions), or nil for
+// none.  The document version is raised to the base version of the extensions if lower.  Unless
+// set, the extensions of the document of the first page added from a PdfReader are written.
+func (this *PdfWriter) SetExtensions(exts *PdfExtensions) error {
+	this.extensions = exts
+	this.extensionsSet = true
+	if exts == nil {
+		this.catalog.Remove("Extensions")
+		return nil
+	}
+
+	common.Log.Trace("Setting Extensions...")
+	obj := exts.ToPdfObject()
+	this.catalog.Set("Extensions", obj)
+	return this.addObjects(obj)
+}
+
+// SetTrailerEntry sets the entry `key` of the trailer dictionary to `val`, or removes the entry if
+// `val` is nil.  The entries written by the writer itself (Size, Prev, Root, Encrypt, Info, ID and
+// XRefStm) cannot be set.  Unless set or removed, the other entries of the trailer of the document
+// of the first page added from a PdfReader, such as private entries, are written.
+func (this *PdfWriter) SetTrailerEntry(key PdfObjectName, val PdfObject) error {
+	if reservedTrailerKeys[key] {
+		return fmt.Errorf("Trailer entry %s is reserved", key)
+	}
+	if this.trailerEntries == nil {
+		this.trailerEntries = MakeDict()
+		this.trailerKeysSet = map[PdfObjectName]bool{}
+	}
+	this.trailerKeysSet[key] = true
+	if val == nil {
+		this.trailerEntries.Remove(key)
+		return nil
+	}
+	this.trailerEntries.Set(key, val)
+	return this.addObjects(val)
+}
+
+// reservedTrailerKeys are the trailer entries written by the writer itself.
+var reservedTrailerKeys = map[PdfObjectName]bool{
+	"Size": true, "Prev": true, "Root": true, "Encrypt": true, "Info": true, "ID": true, "XRefStm": true,
+}
+
+// xrefStreamKeys are the entries of cross-reference stream dictionaries, which serve as the trailer
+// of documents with cross-reference streams, that are not trailer entries.
+var xrefStreamKeys = map[PdfObjectName]bool{
+	"Type": true, "W": true, "Index": true, "Length": true, "Filter": true, "DecodeParms": true,
+	"F": true, "FFilter": true, "FDecodeParms": true, "DL": true,
+}
+
+// copySourceEntries carries over the developer extensions and the trailer entries of the document
+// the pages were loaded from (see SetExtensions and SetTrailerEntry), unless set explicitly.
+// Entries that cannot be loaded are skipped.
+func (this *PdfWriter) copySourceEntries() error {
+	if this.source == nil {
+		return nil
+	}
+	if !this.extensionsSet {
+		exts, err := this.source.GetExtensions()
+		if err != nil {
+			common.Log.Debug("ERROR: Unable to load the extensions of the source document: %v", err)
+		} else if exts != nil {
+			if err := this.SetExtensions(exts); err != nil {
+				return err
+			}
+		}
+	}
+
+	trailer, err := this.source.GetTrailer()
+	if err != nil {
+		common.Log.Debug("ERROR: Unable to load the trailer of the source document: %v", err)
+		return nil
+	}
+	for _, key := range trailer.Keys() {
+		if reservedTrailerKeys[key] || xrefStreamKeys[key] || this.trailerKeysSet[key] {
+			continue
+		}
+		val, err := copyDirectObject(this.source, trailer.Get(key))
+		if err != nil {
+			common.Log.Debug("ERROR: Skipping trailer entry %s of the source document: %v", key, err)
+			continue
+		}
+		if err := this.SetTrailerEntry(key, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (this *PdfWriter) hasObject(obj PdfObject) bool {
 	// Check if already added.
 	for _, o := range this.objects {
@@ -264,10 +642,19 @@ func (this *PdfWriter) addObjects(obj PdfObject) error {
 // Add a page to the PDF file. The new page should be an indirect
 // object.
 func (this *PdfWriter) AddPage(page *PdfPage) error {
+	if this.source == nil && page.reader != nil {
+		if this.ownerRightsCheck != nil {
+			if err := this.ownerRightsCheck(page.reader); err != nil {
+				return err
+			}
+			this.ownerRightsCheck = nil
+		}
+		this.source = page.reader
+	}
 	obj := page.ToPdfObject()
 	common.Log.Trace("==========")
 	common.Log.Trace("Appending to page list %T", obj)
-	procPage(page)
+	this.procPage(page)
 
 	pageObj, ok := obj.(*PdfIndirectObject)
 	if !ok {
@@ -352,15 +739,36 @@ func (this *PdfWriter) AddPage(page *PdfPage) error {
 	return nil
 }
 
-func procPage(p *PdfPage) {
+// GetImportContext returns the context of the objects imported into the document by ImportObject,
+// e.g. to set its SkipKeys before importing.
+func (this *PdfWriter) GetImportContext() *ImportContext {
+	if this.importContext == nil {
+		this.importContext = NewImportContext(this, nil)
+	}
+	return this.importContext
+}
+
+// SetWatermarkFont sets the font of the watermark added to the pages by unlicensed copies, instead
+// of Helvetica which is not embedded.  This is needed to write PDF/A documents (see SetPDFA1b).
+// The font must be a simple font with an encoding compatible with ASCII, e.g. a TrueType font
+// loaded with NewPdfFontFromTTFFile.  Must be set before adding pages.
+func (this *PdfWriter) SetWatermarkFont(font *PdfFont) {
+	this.watermarkFont = font
+}
+
+func (this *PdfWriter) procPage(p *PdfPage) {
 	lk := license.GetLicenseKey()
 	if lk != nil && lk.IsLicensed() {
 		return
 	}
 
 	// Add font as needed.
-	f := fonts.NewFontHelvetica()
-	p.Resources.SetFontByName("UF1", f.ToPdfObject())
+	if this.watermarkFont != nil {
+		p.Resources.SetFontByName("UF1", this.watermarkFont.ToPdfObject())
+	} else {
+		f := fonts.NewFontHelvetica()
+		p.Resources.SetFontByName("UF1", f.ToPdfObject())
+	}
 
 	ops := []string{}
 	ops = append(ops, "q")
@@ -436,8 +844,8 @@ func (this *PdfWriter) writeObject(num int, obj PdfObject) {
 	common.Log.Trace("Write obj #%d\n", num)
 
 	if pobj, isIndirect := obj.(*PdfIndirectObject); isIndirect {
-		outStr := fmt.Sprintf("%d 0 obj\n", num)
-		outStr += pobj.PdfObject.DefaultWriteString()
+		outStr := fmt.Sprintf("%d %d obj\n", num, pobj.GenerationNumber)
+		outStr += RoundFloats(pobj.PdfObject, this.floatPrecision).DefaultWriteString()
 		outStr += "\nendobj\n"
 		this.writer.WriteString(outStr)
 		return
@@ -446,11 +854,23 @@ func (this *PdfWriter) writeObject(num int, obj PdfObject) {
 	// XXX/TODO: Add a default encoder if Filter not specified?
 	// Still need to make sure is encrypted.
 	if pobj, isStream := obj.(*PdfObjectStream); isStream {
-		outStr := fmt.Sprintf("%d 0 obj\n", num)
-		outStr += pobj.PdfObjectDictionary.DefaultWriteString()
+		// Data left encrypted by a reader with ReadOnlyDecryption is written decrypted.
+		dict := pobj.PdfObjectDictionary
+		data, err := pobj.DecryptedStream()
+		if err != nil {
+			common.Log.Debug("ERROR: Unable to decrypt stream %d: %v", num, err)
+			data = pobj.Stream
+		} else if len(data) != len(pobj.Stream) {
+			dict = MakeDict()
+			dict.Merge(pobj.PdfObjectDictionary)
+			dict.Set("Length", MakeInteger(int64(len(data))))
+		}
+
+		outStr := fmt.Sprintf("%d %d obj\n", num, pobj.GenerationNumber)
+		outStr += RoundFloats(dict, this.floatPrecision).DefaultWriteString()
 		outStr += "\nstream\n"
 		this.writer.WriteString(outStr)
-		this.writer.Write(pobj.Stream)
+		this.writer.Write(data)
 		this.writer.WriteString("\nendstream\nendobj\n")
 		return
 	}
@@ -458,18 +878,180 @@ func (this *PdfWriter) writeObject(num int, obj PdfObject) {
 	this.writer.WriteString(obj.DefaultWriteString())
 }
 
-// Update all the object numbers prior to writing.
+// Update all the object numbers prior to writing.  Objects are numbered sequentially in the order
+// of the objects list, followed by any explicit renumbering.  On return the objects list is sorted
+// by object number.
 func (this *PdfWriter) updateObjectNumbers() {
+	if this.deterministic {
+		this.sortObjectsDeterministic()
+	}
+
 	// Update numbers
 	for idx, obj := range this.objects {
-		if io, isIndirect := obj.(*PdfIndirectObject); isIndirect {
-			io.ObjectNumber = int64(idx + 1)
-			io.GenerationNumber = 0
+		setObjectNumber(obj, int64(idx+1))
+	}
+
+	if len(this.renumbering) == 0 {
+		return
+	}
+
+	// Requested numbers are reserved, the remaining objects fill up the gaps in order.
+	reserved := map[int64]bool{}
+	for _, to := range this.renumbering {
+		reserved[to] = true
+	}
+	next := int64(1)
+	for _, obj := range this.objects {
+		if to, has := this.renumbering[getObjectNumber(obj)]; has {
+			setObjectNumber(obj, to)
+			continue
 		}
-		if so, isStream := obj.(*PdfObjectStream); isStream {
-			so.ObjectNumber = int64(idx + 1)
-			so.GenerationNumber = 0
+		for reserved[next] {
+			next++
 		}
+		setObjectNumber(obj, next)
+		next++
+	}
+
+	sort.SliceStable(this.objects, func(i, j int) bool {
+		return getObjectNumber(this.objects[i]) < getObjectNumber(this.objects[j])
+	})
+}
+
+// sortObjectsDeterministic orders the objects list depth-first from the catalog, followed by the
+// information dictionary, the encryption dictionary and any objects that were not reached, in the
+// order they were added.
+func (this *PdfWriter) sortObjectsDeterministic() {
+	ordered := this.deterministicOrder(this.root)
+	ordered = append(ordered, this.deterministicOrder(this.infoObj, ordered...)...)
+	if this.encryptObj != nil {
+		ordered = append(ordered, this.deterministicOrder(this.encryptObj, ordered...)...)
+	}
+
+	visited := map[PdfObject]bool{}
+	for _, obj := range ordered {
+		visited[obj] = true
+	}
+	for _, obj := range this.objects {
+		if !visited[obj] {
+			visited[obj] = true
+			ordered = append(ordered, obj)
+		}
+	}
+
+	this.objects = ordered
+}
+
+// deterministicOrder returns the objects of the objects list reached depth-first from `root`,
+// other than those of `skip`.  Dictionary keys are traversed in sorted order (of a copy of the
+// keys, leaving the dictionaries unchanged) and /Parent entries are not followed as they are
+// back-references.
+func (this *PdfWriter) deterministicOrder(root PdfObject, skip ...PdfObject) []PdfObject {
+	included := map[PdfObject]bool{}
+	for _, obj := range this.objects {
+		included[obj] = true
+	}
+	visited := map[PdfObject]bool{}
+	for _, obj := range skip {
+		visited[obj] = true
+	}
+	var ordered []PdfObject
+
+	var traverse func(obj PdfObject)
+	traverse = func(obj PdfObject) {
+		switch t := obj.(type) {
+		case *PdfIndirectObject:
+			if visited[t] || !included[t] {
+				return
+			}
+			visited[t] = true
+			ordered = append(ordered, t)
+			traverse(t.PdfObject)
+		case *PdfObjectStream:
+			if visited[t] || !included[t] {
+				return
+			}
+			visited[t] = true
+			ordered = append(ordered, t)
+			traverse(t.PdfObjectDictionary)
+		case *PdfObjectDictionary:
+			keys := append([]PdfObjectName{}, t.Keys()...)
+			sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+			for _, k := range keys {
+				if k != "Parent" {
+					traverse(t.Get(k))
+				}
+			}
+		case *PdfObjectArray:
+			for _, v := range *t {
+				traverse(v)
+			}
+		}
+	}
+
+	traverse(root)
+	return ordered
+}
+
+// documentDigest returns the MD5 digest of the objects reached from the catalog in deterministic
+// order (see deterministicOrder), with the stream data, so that documents of different contents
+// have different digests.
+func (this *PdfWriter) documentDigest() []byte {
+	h := md5.New()
+	for _, obj := range this.deterministicOrder(this.root) {
+		switch t := obj.(type) {
+		case *PdfIndirectObject:
+			io.WriteString(h, t.PdfObject.DefaultWriteString())
+		case *PdfObjectStream:
+			io.WriteString(h, t.PdfObjectDictionary.DefaultWriteString())
+			data, err := t.DecryptedStream()
+			if err != nil {
+				data = t.Stream
+			}
+			h.Write(data)
+		}
+	}
+	return h.Sum(nil)
+}
+
+func getObjectNumber(obj PdfObject) int64 {
+	switch t := obj.(type) {
+	case *PdfIndirectObject:
+		return t.ObjectNumber
+	case *PdfObjectStream:
+		return t.ObjectNumber
+	}
+	return 0
+}
+
+func getGenerationNumber(obj PdfObject) int64 {
+	switch t := obj.(type) {
+	case *PdfIndirectObject:
+		return t.GenerationNumber
+	case *PdfObjectStream:
+		return t.GenerationNumber
+	}
+	return 0
+}
+
+// setObjectNumber sets the object number of `obj`.  The generation number is kept, so objects
+// loaded from a document are written with their original generation.
+func setObjectNumber(obj PdfObject, num int64) {
+	switch t := obj.(type) {
+	case *PdfIndirectObject:
+		t.ObjectNumber = num
+	case *PdfObjectStream:
+		t.ObjectNumber = num
+	}
+}
+
+// setGenerationNumber sets the generation number of `obj`.
+func setGenerationNumber(obj PdfObject, gen int64) {
+	switch t := obj.(type) {
+	case *PdfIndirectObject:
+		t.GenerationNumber = gen
+	case *PdfObjectStream:
+		t.GenerationNumber = gen
 	}
 }
 
@@ -491,10 +1073,269 @@ const (
 )
 
 // Encrypt the output file with a specified user/owner password.
+// New encryption parameters are generated, which requires the owner rights to the document the
+// pages were loaded from, if encrypted: it must have been decrypted with its owner password or
+// `ownerPass` must be that password, or else ErrOwnerPasswordRequired is returned (by AddPage for
+// pages added after the call).  To keep the encryption of such a document, use PreserveEncryption.
 func (this *PdfWriter) Encrypt(userPass, ownerPass []byte, options *EncryptOptions) error {
-	crypter := PdfCrypt{}
+	err := this.setOwnerRightsCheck(func(source *PdfReader) error {
+		return checkOwnerRights(source, ownerPass)
+	})
+	if err != nil {
+		return err
+	}
+	return this.encrypt(userPass, ownerPass, options, nil)
+}
+
+// setOwnerRightsCheck runs `check` against the source document, or once it is known (AddPage).
+func (this *PdfWriter) setOwnerRightsCheck(check func(source *PdfReader) error) error {
+	if this.source == nil {
+		this.ownerRightsCheck = check
+		return nil
+	}
+	this.ownerRightsCheck = nil
+	return check(this.source)
+}
+
+// EncryptLike encrypts the output file as Encrypt, for saving a document loaded (and decrypted) by
+// `reader` again.  If the passwords and options match the encryption of the original document, the
+// original O and U entries (and the document ID they depend on) are reused verbatim, so that they do
+// not change between saves.  Otherwise new encryption parameters are generated, which requires the
+// owner rights to the original document: it must have been decrypted with its owner password or
+// `ownerPass` must be that password, or else ErrOwnerPasswordRequired is returned.  To keep the
+// encryption of a document decrypted with the user password, use PreserveEncryption.
+func (this *PdfWriter) EncryptLike(reader *PdfReader, userPass, ownerPass []byte, options *EncryptOptions) error {
+	return this.encrypt(userPass, ownerPass, options, reader)
+}
+
+// originalEncryption returns the encryption of the document loaded by `reader` if it can be reused
+// for encrypting with `crypter` (with the algorithm and permissions set) and the given passwords,
+// along with the document ID.  Returns nil if not.
+func originalEncryption(reader *PdfReader, crypter *PdfCrypt, userPass, ownerPass []byte) (*PdfCrypt, *PdfObjectArray) {
+	if reader == nil {
+		return nil, nil
+	}
+	orig := reader.parser.GetCrypter()
+	if orig == nil || !reader.parser.IsAuthenticated() {
+		return nil, nil
+	}
+	if orig.V != crypter.V || orig.R != crypter.R || orig.Length != crypter.Length ||
+		int32(orig.P) != int32(crypter.P) || orig.EncryptMetadata != crypter.EncryptMetadata {
+		common.Log.Debug("Encryption parameters changed - generating new")
+		return nil, nil
+	}
+	if crypter.V >= 4 {
+		cf, ok := orig.CryptFilters[orig.StreamFilter]
+		if !ok || orig.StreamFilter != orig.StringFilter || cf.Cfm != crypter.CryptFilters[StandardCryptFilter].Cfm {
+			common.Log.Debug("Crypt filters changed - generating new")
+			return nil, nil
+		}
+	}
+
+	ids, ok := TraceToDirectObject(reader.parser.GetTrailer().Get("ID")).(*PdfObjectArray)
+	if !ok || len(*ids) != 2 {
+		return nil, nil
+	}
+	id0, ok := TraceToDirectObject((*ids)[0]).(*PdfObjectString)
+	if !ok || string(*id0) != orig.Id0 {
+		return nil, nil
+	}
+
+	if same, err := orig.CheckPasswords(userPass, ownerPass); !same || err != nil {
+		common.Log.Debug("Passwords changed - generating new encryption parameters")
+		return nil, nil
+	}
+
+	idsCopy := PdfObjectArray{}
+	for _, obj := range *ids {
+		if str, ok := TraceToDirectObject(obj).(*PdfObjectString); ok {
+			idsCopy = append(idsCopy, MakeString(string(*str)))
+		}
+	}
+	return orig, &idsCopy
+}
+
+// checkOwnerRights returns ErrOwnerPasswordRequired if the document loaded by `reader` is encrypted
+// and neither was decrypted with the owner password nor has owner password `ownerPass`.
+func checkOwnerRights(reader *PdfReader, ownerPass []byte) error {
+	orig := reader.parser.GetCrypter()
+	if orig == nil || orig.IsOwnerAuthenticated() {
+		return nil
+	}
+	isOwner, err := orig.CheckOwnerPassword(ownerPass)
+	if err != nil {
+		return err
+	}
+	if !isOwner {
+		common.Log.Debug("ERROR: New encryption parameters without the owner password")
+		return ErrOwnerPasswordRequired
+	}
+	return nil
+}
+
+// checkHandlerOwnerRights returns ErrOwnerPasswordRequired if the document loaded by `reader` is
+// encrypted, was not decrypted with the owner password and the security handler `crypter` does not
+// keep its O, U and P entries.
+func checkHandlerOwnerRights(reader *PdfReader, crypter *PdfCrypt) error {
+	orig := reader.parser.GetCrypter()
+	if orig == nil || orig.IsOwnerAuthenticated() {
+		return nil
+	}
+	if bytes.Equal(crypter.O, orig.O) && bytes.Equal(crypter.U, orig.U) && int32(crypter.P) == int32(orig.P) {
+		return nil
+	}
+	common.Log.Debug("ERROR: New security handler without the owner password")
+	return ErrOwnerPasswordRequired
+}
+
+// PreserveEncryption encrypts the output file as the document loaded by `reader`, which must have
+// been decrypted, whichever password was used: the original Encrypt dictionary (with O, U, P, V, R
+// and Length) and document ID are written verbatim, and objects are encrypted with the file key
+// derived when decrypting.  The passwords and permissions of the document are unchanged.
+func (this *PdfWriter) PreserveEncryption(reader *PdfReader) error {
+	orig := reader.parser.GetCrypter()
+	if orig == nil {
+		return errors.New("Document not encrypted")
+	}
+	if !reader.parser.IsAuthenticated() {
+		return errors.New("Document not decrypted")
+	}
+
+	trailer := reader.parser.GetTrailer()
+	obj, err := reader.traceToObject(trailer.Get("Encrypt"))
+	if err != nil {
+		return err
+	}
+	origDict, ok := TraceToDirectObject(obj).(*PdfObjectDictionary)
+	if !ok {
+		return ErrTypeError
+	}
+	// The O and U entries depend on the first ID for R <= 4.
+	origIDs, ok := TraceToDirectObject(trailer.Get("ID")).(*PdfObjectArray)
+	if !ok || len(*origIDs) != 2 {
+		return errors.New("Document ID missing")
+	}
+
+	ed, err := copyDirectObject(reader, origDict)
+	if err != nil {
+		return err
+	}
+	ids, err := copyDirectObject(reader, origIDs)
+	if err != nil {
+		return err
+	}
+
+	crypter := PdfCrypt{
+		Filter:          orig.Filter,
+		Subfilter:       orig.Subfilter,
+		V:               orig.V,
+		Length:          orig.Length,
+		R:               orig.R,
+		O:               append([]byte{}, orig.O...),
+		U:               append([]byte{}, orig.U...),
+		OE:              append([]byte{}, orig.OE...),
+		UE:              append([]byte{}, orig.UE...),
+		P:               orig.P,
+		Perms:           append([]byte{}, orig.Perms...),
+		EncryptMetadata: orig.EncryptMetadata,
+		Id0:             orig.Id0,
+		EncryptionKey:   append([]byte{}, orig.EncryptionKey...),
+		CryptFilters:    CryptFilters{},
+		StreamFilter:    orig.StreamFilter,
+		StringFilter:    orig.StringFilter,
+
+		EmbeddedFileFilter: orig.EmbeddedFileFilter,
+	}
+	for name, filter := range orig.CryptFilters {
+		crypter.CryptFilters[name] = filter
+	}
+	crypter.EncryptedObjects = map[PdfObject]bool{}
+
+	switch {
+	case crypter.V >= 5:
+		this.SetVersion(2, 0)
+	case crypter.V == 4:
+		this.SetVersion(1, 5)
+	}
 	this.crypter = &crypter
+	this.encryptDict = ed.(*PdfObjectDictionary)
+	this.ids = ids.(*PdfObjectArray)
+	this.encryptObj = MakeIndirectObject(this.encryptDict)
+	this.addObject(this.encryptObj)
+	return nil
+}
+
+// copyDirectObject returns a copy of `obj` of the document loaded by `reader`, with all references
+// resolved and indirect objects replaced by their direct objects, e.g. for writing an Encrypt
+// dictionary, which must not be encrypted itself.
+func copyDirectObject(reader *PdfReader, obj PdfObject) (PdfObject, error) {
+	obj, err := reader.traceToObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	switch t := TraceToDirectObject(obj).(type) {
+	case *PdfObjectDictionary:
+		dict := MakeDict()
+		for _, key := range t.Keys() {
+			value, err := copyDirectObject(reader, t.Get(key))
+			if err != nil {
+				return nil, err
+			}
+			dict.Set(key, value)
+		}
+		return dict, nil
+	case *PdfObjectArray:
+		arr := PdfObjectArray{}
+		for _, item := range *t {
+			value, err := copyDirectObject(reader, item)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+		return &arr, nil
+	case *PdfObjectString:
+		return MakeString(string(*t)), nil
+	case *PdfObjectStream:
+		return nil, errors.New("Unexpected stream")
+	default:
+		return t, nil
+	}
+}
 
+// EncryptDocument returns the security handler and the encryption dictionary for encrypting a
+// document with user password `userPass` and owner password `ownerPass`, granting the permissions
+// `perms` with the user password, using algorithm `algo`: V 2 and R 3 for RC4_128bit, V 4 and R 4
+// with the AESV2 crypt filter for AES_128bit, and V 5 and R 6 with the AESV3 crypt filter for
+// AES_256bit.  The dictionary has the generated O and U entries (and OE, UE and Perms for AES
+// 256), and the crypt filters.  The first file identifier is generated randomly and returned as
+// the Id0 of the PdfCrypt: the ID array of the trailer must start with it, as the entries depend
+// on it for RC4 and AES 128 bit encryption.  PdfWriter.SetEncryption encrypts a written document
+// with the returned handler and dictionary, and PdfWriter.Encrypt with the same parameters.
+func EncryptDocument(userPass, ownerPass []byte, perms AccessPermissions, algo EncryptionAlgorithm) (*PdfCrypt, *PdfObjectDictionary, error) {
+	crypter, ed, err := newEncryption(&EncryptOptions{Permissions: perms, Algorithm: algo})
+	if err != nil {
+		return nil, nil, err
+	}
+	id0 := make([]byte, 16)
+	if _, err := rand.Read(id0); err != nil {
+		return nil, nil, err
+	}
+	if err := generateEncryptionParams(crypter, ed, userPass, ownerPass, string(id0)); err != nil {
+		return nil, nil, err
+	}
+	if crypter.V >= 4 {
+		if err := crypter.SaveCryptFilters(ed); err != nil {
+			return nil, nil, err
+		}
+	}
+	return crypter, ed, nil
+}
+
+// newEncryption returns the security handler and the encryption dictionary for `options`, without
+// the password dependent entries.  Nil options are RC4 128 bit encryption with all permissions.
+func newEncryption(options *EncryptOptions) (*PdfCrypt, *PdfObjectDictionary, error) {
+	crypter := &PdfCrypt{}
 	crypter.EncryptedObjects = map[PdfObject]bool{}
 
 	crypter.CryptFilters = CryptFilters{}
@@ -511,17 +1352,15 @@ func (this *PdfWriter) Encrypt(userPass, ownerPass []byte, options *EncryptOptio
 		crypter.R = 3
 		cf = NewCryptFilterV2(16)
 	case AES_128bit:
-		this.SetVersion(1, 5)
 		crypter.V = 4
 		crypter.R = 4
 		cf = NewCryptFilterAESV2()
 	case AES_256bit:
-		this.SetVersion(2, 0)
 		crypter.V = 5
 		crypter.R = 6 // TODO(dennwc): a way to set R=5?
 		cf = NewCryptFilterAESV3()
 	default:
-		return fmt.Errorf("unsupported algorithm: %v", options.Algorithm)
+		return nil, nil, fmt.Errorf("unsupported algorithm: %v", algo)
 	}
 	crypter.Length = cf.Length * 8
 
@@ -535,7 +1374,7 @@ func (this *PdfWriter) Encrypt(userPass, ownerPass []byte, options *EncryptOptio
 	}
 
 	// Set
-	crypter.P = math.MaxUint32
+	crypter.P = int(int32(-1))
 	crypter.EncryptMetadata = true
 	if options != nil {
 		crypter.P = int(options.Permissions.GetP())
@@ -548,24 +1387,15 @@ func (this *PdfWriter) Encrypt(userPass, ownerPass []byte, options *EncryptOptio
 	ed.Set("V", MakeInteger(int64(crypter.V)))
 	ed.Set("R", MakeInteger(int64(crypter.R)))
 	ed.Set("Length", MakeInteger(int64(crypter.Length)))
-	this.encryptDict = ed
-
-	// Prepare the ID object for the trailer.
-	hashcode := md5.Sum([]byte(time.Now().Format(time.RFC850)))
-	id0 := PdfObjectString(hashcode[:])
-	b := make([]byte, 100)
-	rand.Read(b)
-	hashcode = md5.Sum(b)
-	id1 := PdfObjectString(hashcode[:])
-	common.Log.Trace("Random b: % x", b)
-
-	this.ids = &PdfObjectArray{&id0, &id1}
-	common.Log.Trace("Gen Id 0: % x", id0)
+	return crypter, ed, nil
+}
 
-	// Generate encryption parameters
+// generateEncryptionParams generates the O and U entries of `crypter` for the passwords (and OE,
+// UE and Perms for R >= 5) and sets them in the encryption dictionary `ed`.  `id0` is the first
+// file identifier, which the entries depend on for R < 5.
+func generateEncryptionParams(crypter *PdfCrypt, ed *PdfObjectDictionary, userPass, ownerPass []byte, id0 string) error {
+	crypter.Id0 = id0
 	if crypter.R < 5 {
-		crypter.Id0 = string(id0)
-
 		// Make the O and U objects.
 		O, err := crypter.Alg3(userPass, ownerPass)
 		if err != nil {
@@ -599,6 +1429,104 @@ func (this *PdfWriter) Encrypt(userPass, ownerPass []byte, options *EncryptOptio
 			ed.Set("Perms", MakeString(string(crypter.Perms)))
 		}
 	}
+	return nil
+}
+
+func (this *PdfWriter) encrypt(userPass, ownerPass []byte, options *EncryptOptions, reader *PdfReader) error {
+	crypter, ed, err := newEncryption(options)
+	if err != nil {
+		return err
+	}
+	this.crypter = crypter
+	switch crypter.V {
+	case 4:
+		this.SetVersion(1, 5)
+	case 5:
+		this.SetVersion(2, 0)
+	}
+	this.encryptDict = ed
+
+	if orig, ids := originalEncryption(reader, crypter, userPass, ownerPass); orig != nil {
+		this.ids = ids
+		crypter.Id0 = orig.Id0
+		crypter.O = append([]byte{}, orig.O...)
+		crypter.U = append([]byte{}, orig.U...)
+		crypter.OE = append([]byte{}, orig.OE...)
+		crypter.UE = append([]byte{}, orig.UE...)
+		crypter.Perms = append([]byte{}, orig.Perms...)
+		crypter.EncryptionKey = append([]byte{}, orig.EncryptionKey...)
+		ed.Set("O", MakeString(string(crypter.O)))
+		ed.Set("U", MakeString(string(crypter.U)))
+		if crypter.R >= 5 {
+			ed.Set("OE", MakeString(string(crypter.OE)))
+			ed.Set("UE", MakeString(string(crypter.UE)))
+			ed.Set("EncryptMetadata", MakeBool(crypter.EncryptMetadata))
+			if crypter.R > 5 {
+				ed.Set("Perms", MakeString(string(crypter.Perms)))
+			}
+		}
+		return this.finishEncrypt(crypter, ed)
+	}
+
+	if reader != nil {
+		if err := checkOwnerRights(reader, ownerPass); err != nil {
+			return err
+		}
+	}
+
+	// Prepare the ID object for the trailer.
+	this.ids = this.makeIDs()
+	id0 := *(*this.ids)[0].(*PdfObjectString)
+	common.Log.Trace("Gen Id 0: % x", id0)
+
+	// Generate encryption parameters
+	if err := generateEncryptionParams(crypter, ed, userPass, ownerPass, string(id0)); err != nil {
+		return err
+	}
+	return this.finishEncrypt(crypter, ed)
+}
+
+// SetEncryption encrypts the output file with the security handler `crypter` and its encryption
+// dictionary `ed`, as returned by EncryptDocument.  The ID of the trailer starts with the Id0 of
+// `crypter`, which the O and U entries depend on for R < 5, and a new identifier is generated if it
+// is not set for R >= 5.
+// If the pages were loaded from an encrypted document decrypted without its owner password, the
+// handler must keep the O, U and P entries of that document, or else ErrOwnerPasswordRequired is
+// returned (by AddPage for pages added after the call).
+func (this *PdfWriter) SetEncryption(crypter *PdfCrypt, ed *PdfObjectDictionary) error {
+	if crypter == nil || ed == nil {
+		return ErrRequiredAttributeMissing
+	}
+	err := this.setOwnerRightsCheck(func(source *PdfReader) error {
+		return checkHandlerOwnerRights(source, crypter)
+	})
+	if err != nil {
+		return err
+	}
+	ids := this.makeIDs()
+	if crypter.Id0 != "" {
+		(*ids)[0] = MakeString(crypter.Id0)
+	} else if crypter.R < 5 {
+		return errors.New("Id0 missing")
+	}
+	if crypter.EncryptedObjects == nil {
+		crypter.EncryptedObjects = map[PdfObject]bool{}
+	}
+
+	switch {
+	case crypter.V >= 5:
+		this.SetVersion(2, 0)
+	case crypter.V == 4:
+		this.SetVersion(1, 5)
+	}
+	this.crypter = crypter
+	this.encryptDict = ed
+	this.ids = ids
+	return this.finishEncrypt(crypter, ed)
+}
+
+// finishEncrypt adds the encryption dictionary `ed` of `crypter`, completed with the crypt filters.
+func (this *PdfWriter) finishEncrypt(crypter *PdfCrypt, ed *PdfObjectDictionary) error {
 	if crypter.V >= 4 {
 		if err := crypter.SaveCryptFilters(ed); err != nil {
 			return err
@@ -613,6 +1541,29 @@ func (this *PdfWriter) Encrypt(userPass, ownerPass []byte, options *EncryptOptio
 	return nil
 }
 
+// makeIDs returns the file identifiers for the trailer ID entry.  In deterministic mode the first
+// is the digest of the document contents (documentDigest) and the second the hash of the first and
+// of the information dictionary, or else the first is a hash of the current time and the second
+// is random.
+func (this *PdfWriter) makeIDs() *PdfObjectArray {
+	var id0, id1 PdfObjectString
+	if this.deterministic {
+		digest := this.documentDigest()
+		id0 = PdfObjectString(digest)
+		hashcode := md5.Sum(append(digest, this.infoObj.PdfObject.DefaultWriteString()...))
+		id1 = PdfObjectString(hashcode[:])
+	} else {
+		hashcode := md5.Sum([]byte(time.Now().Format(time.RFC850)))
+		id0 = PdfObjectString(hashcode[:])
+		b := make([]byte, 100)
+		rand.Read(b)
+		hashcode = md5.Sum(b)
+		id1 = PdfObjectString(hashcode[:])
+		common.Log.Trace("Random b: % x", b)
+	}
+	return &PdfObjectArray{&id0, &id1}
+}
+
 // Write the pdf out.
 func (this *PdfWriter) Write(ws io.WriteSeeker) error {
 	common.Log.Trace("Write()")
@@ -635,6 +1586,15 @@ func (this *PdfWriter) Write(ws io.WriteSeeker) error {
 		}
 	}
 
+	if err := this.copySourceEntries(); err != nil {
+		return err
+	}
+
+	// Named destinations and document-level JavaScript.
+	if err := this.setNames(); err != nil {
+		return err
+	}
+
 	// Form fields.
 	if this.acroForm != nil {
 		common.Log.Trace("Writing acro forms")
@@ -661,9 +1621,34 @@ func (this *PdfWriter) Write(ws io.WriteSeeker) error {
 			}
 		}
 	}
+	if this.pdfaProfile != nil {
+		if err := this.preparePDFA1b(); err != nil {
+			return err
+		}
+	}
+
+	// A document declaring developer extensions has at least their base version.
+	if this.extensions != nil {
+		if major, minor, ok := this.extensions.GetMinimumVersion(); ok &&
+			(major > this.majorVersion || major == this.majorVersion && minor > this.minorVersion) {
+			common.Log.Debug("Raising version %d.%d to extensions base version %d.%d",
+				this.majorVersion, this.minorVersion, major, minor)
+			this.majorVersion, this.minorVersion = major, minor
+		}
+	}
+
 	// Set version in the catalog.
 	this.catalog.Set("Version", MakeName(fmt.Sprintf("%d.%d", this.majorVersion, this.minorVersion)))
 
+	this.updateObjectNumbers()
+
+	// Nothing is written if the document cannot be made PDF/A compliant.
+	if this.pdfaProfile != nil {
+		if issues := this.checkPDFA1b(); len(issues) > 0 {
+			return &PDFAError{Issues: issues}
+		}
+	}
+
 	w := bufio.NewWriter(ws)
 	this.writer = w
 
@@ -671,41 +1656,80 @@ func (this *PdfWriter) Write(ws io.WriteSeeker) error {
 	w.WriteString("%âãÏÓ\n")
 	w.Flush()
 
-	this.updateObjectNumbers()
+	// Offsets by object number.
+	offsets := map[int64]int64{}
+	gens := map[int64]int64{}
+	maxNum := int64(0)
 
-	offsets := []int64{}
+	var filterExempt map[*PdfObjectStream]bool
+	if this.streamFilterPolicy() != nil {
+		filterExempt = filterPolicyExemptions(this.objects)
+	}
+
+	if this.crypter != nil {
+		this.crypter.OperationHook = this.operationHook
+	}
 
 	// Write objects
 	common.Log.Trace("Writing %d obj", len(this.objects))
 	for idx, obj := range this.objects {
 		common.Log.Trace("Writing %d", idx)
+		num := getObjectNumber(obj)
 		this.writer.Flush()
 		offset, _ := ws.Seek(0, os.SEEK_CUR)
-		offsets = append(offsets, offset)
+		offsets[num] = offset
+		gens[num] = getGenerationNumber(obj)
+		if num > maxNum {
+			maxNum = num
+		}
+
+		if stream, isStream := obj.(*PdfObjectStream); isStream && this.streamFilterPolicy() != nil && !filterExempt[stream] {
+			obj = this.applyFilterPolicy(num, stream)
+		}
 
 		// Encrypt prior to writing.
 		// Encrypt dictionary should not be encrypted.
 		if this.crypter != nil && obj != this.encryptObj {
-			err := this.crypter.Encrypt(obj, int64(idx+1), 0)
+			err := this.crypter.Encrypt(obj, num, getGenerationNumber(obj))
 			if err != nil {
 				common.Log.Debug("ERROR: Failed encrypting (%s)", err)
 				return err
 			}
 
 		}
-		this.writeObject(idx+1, obj)
+		this.writeObject(int(num), obj)
 	}
 	w.Flush()
 
 	xrefOffset, _ := ws.Seek(0, os.SEEK_CUR)
-	// Write xref table.
+	// Write xref table, with the generation numbers of the objects.  Numbers not in use (if
+	// renumbered) are linked in the free list.
 	this.writer.WriteString("xref\r\n")
-	outStr := fmt.Sprintf("%d %d\r\n", 0, len(this.objects)+1)
-	this.writer.WriteString(outStr)
-	outStr = fmt.Sprintf("%.10d %.5d f\r\n", 0, 65535)
+	outStr := fmt.Sprintf("%d %d\r\n", 0, maxNum+1)
 	this.writer.WriteString(outStr)
-	for _, offset := range offsets {
-		outStr = fmt.Sprintf("%.10d %.5d n\r\n", offset, 0)
+	for num := int64(0); num <= maxNum; num++ {
+		if offset, has := offsets[num]; has && num > 0 {
+			outStr = fmt.Sprintf("%.10d %.5d n\r\n", offset, gens[num])
+			this.writer.WriteString(outStr)
+			continue
+		}
+		nextFree := num + 1
+		for nextFree <= maxNum {
+			if _, has := offsets[nextFree]; !has {
+				break
+			}
+			nextFree++
+		}
+		if nextFree > maxNum {
+			nextFree = 0
+		}
+		// Object number 0, the head of the list, has generation 65535.  Unused numbers can be used
+		// with generation 0.
+		freeGen := 0
+		if num == 0 {
+			freeGen = 65535
+		}
+		outStr = fmt.Sprintf("%.10d %.5d f\r\n", nextFree, freeGen)
 		this.writer.WriteString(outStr)
 	}
 
@@ -713,13 +1737,21 @@ func (this *PdfWriter) Write(ws io.WriteSeeker) error {
 	trailer := MakeDict()
 	trailer.Set("Info", this.infoObj)
 	trailer.Set("Root", this.root)
-	trailer.Set("Size", MakeInteger(int64(len(this.objects)+1)))
+	trailer.Set("Size", MakeInteger(maxNum+1))
 	// If encrypted!
 	if this.crypter != nil {
 		trailer.Set("Encrypt", this.encryptObj)
+	}
+	// The ID is written for encrypted and PDF/A documents.
+	if this.ids != nil {
 		trailer.Set("ID", this.ids)
 		common.Log.Trace("Ids: %s", this.ids)
 	}
+	if this.trailerEntries != nil {
+		for _, key := range this.trailerEntries.Keys() {
+			trailer.Set(key, this.trailerEntries.Get(key))
+		}
+	}
 	this.writer.WriteString("trailer\n")
 	this.writer.WriteString(trailer.DefaultWriteString())
 	this.writer.WriteString("\n")
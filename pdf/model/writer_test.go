@@ -0,0 +1,653 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	. "github.com/unidoc/unidoc/pdf/core"
+)
+
+// writeToBytes writes out the document via a temporary file and returns its contents.
+func writeToBytes(w *PdfWriter) ([]byte, error) {
+	f, err := ioutil.TempFile("", "unidoc_writer_test")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = w.Write(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(f.Name())
+}
+
+func makeDeterministicTestWriter(t *testing.T) *PdfWriter {
+	return makeDeterministicTextWriter(t, "Hello")
+}
+
+// makeDeterministicTextWriter returns a writer in deterministic mode of 3 pages showing `text`.
+func makeDeterministicTextWriter(t *testing.T, text string) *PdfWriter {
+	w := NewPdfWriter()
+	w.SetDeterministic(true)
+
+	for i := 0; i < 3; i++ {
+		page := NewPdfPage()
+		page.Resources = NewPdfPageResources()
+		page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+		page.AddContentStreamByString("BT /F1 12 Tf 10 10 Td (" + text + ") Tj ET")
+		err := w.AddPage(page)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	return &w
+}
+
+func TestWriterDeterministic(t *testing.T) {
+	data1, err := writeToBytes(makeDeterministicTestWriter(t))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data2, err := writeToBytes(makeDeterministicTestWriter(t))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if !bytes.Equal(data1, data2) {
+		t.Fatalf("Output of identical inputs differs")
+	}
+
+	// The catalog comes first in deterministic mode, with its keys in their original order.
+	if !strings.Contains(string(data1), "1 0 obj\n<</Type /Catalog/Pages 2 0 R") {
+		t.Errorf("Catalog is not object 1")
+	}
+}
+
+// Test that the ordering of deterministic mode leaves the dictionaries of the document unchanged.
+func TestWriterDeterministicKeepsKeys(t *testing.T) {
+	w := makeDeterministicTestWriter(t)
+	page := w.pages.PdfObject.(*PdfObjectDictionary).Get("Kids").(*PdfObjectArray)
+	pageDict := (*page)[0].(*PdfIndirectObject).PdfObject.(*PdfObjectDictionary)
+	keys := append([]PdfObjectName{}, pageDict.Keys()...)
+
+	if _, err := writeToBytes(w); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if after := pageDict.Keys(); !reflect.DeepEqual(after, keys) {
+		t.Errorf("Page keys %v changed to %v", keys, after)
+	}
+}
+
+// Test that the IDs of deterministic mode are the same for identical documents and differ for
+// documents of different contents.
+func TestWriterDeterministicIDs(t *testing.T) {
+	getIDs := func(text string) (string, string) {
+		w := makeDeterministicTextWriter(t, text)
+		if err := w.Encrypt([]byte("user"), []byte("owner"), nil); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		data, err := writeToBytes(w)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		reader, err := NewPdfReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		trailer, err := reader.GetTrailer()
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		ids, ok := trailer.Get("ID").(*PdfObjectArray)
+		if !ok || len(*ids) != 2 {
+			t.Fatalf("Invalid ID %v", trailer.Get("ID"))
+		}
+		return (*ids)[0].String(), (*ids)[1].String()
+	}
+
+	id0, id1 := getIDs("Hello")
+	if id0 == id1 {
+		t.Errorf("Same first and second ID")
+	}
+	if again0, again1 := getIDs("Hello"); again0 != id0 || again1 != id1 {
+		t.Errorf("IDs of identical documents differ")
+	}
+	if other0, other1 := getIDs("World"); other0 == id0 || other1 == id1 {
+		t.Errorf("Same IDs for different documents")
+	}
+}
+
+// Test that reals are written exactly by default and rounded with SetFloatPrecision, without
+// modifying the document.
+func TestWriterFloatPrecision(t *testing.T) {
+	for _, digits := range []int{0, 4} {
+		w := NewPdfWriter()
+		w.SetFloatPrecision(digits)
+		page := NewPdfPage()
+		page.Resources = NewPdfPageResources()
+		page.MediaBox = &PdfRectangle{Urx: 612.123456, Ury: 792}
+		if err := w.AddPage(page); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		data, err := writeToBytes(&w)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		expected := "/MediaBox [0 0 612.123456 792]"
+		if digits == 4 {
+			expected = "/MediaBox [0 0 612.1 792]"
+		}
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("%d digits: %s not written", digits, expected)
+		}
+		if page.MediaBox.Urx != 612.123456 {
+			t.Errorf("%d digits: Page modified: %v", digits, page.MediaBox)
+		}
+	}
+}
+
+func TestWriterRenumberObjects(t *testing.T) {
+	w := makeDeterministicTestWriter(t)
+	// Move the catalog (1) to 10 and the page tree root (2) to 1.
+	err := w.RenumberObjects(map[int64]int64{1: 10, 2: 1})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	data, err := writeToBytes(w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if w.root.ObjectNumber != 10 {
+		t.Errorf("Catalog object number != 10 (%d)", w.root.ObjectNumber)
+	}
+	if w.pages.ObjectNumber != 1 {
+		t.Errorf("Pages object number != 1 (%d)", w.pages.ObjectNumber)
+	}
+
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	numPages, err := reader.GetNumPages()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if numPages != 3 {
+		t.Errorf("Number of pages != 3 (%d)", numPages)
+	}
+
+	trailer, err := reader.GetTrailer()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	root, ok := trailer.Get("Root").(*PdfObjectReference)
+	if !ok || root.ObjectNumber != 10 {
+		t.Errorf("Trailer Root should reference object 10 (%v)", trailer.Get("Root"))
+	}
+
+	// Parent back-references follow the new numbering.
+	page, err := reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	parent, ok := page.Parent.(*PdfIndirectObject)
+	if !ok || parent.ObjectNumber != 1 {
+		t.Errorf("Page parent should be object 1 (%v)", page.Parent)
+	}
+
+	err = w.RenumberObjects(map[int64]int64{3: 5, 4: 5})
+	if err == nil {
+		t.Errorf("Duplicate target numbers should fail")
+	}
+}
+
+// Private application data in PieceInfo is kept byte for byte through a load/save round trip.
+func TestPieceInfoRoundTrip(t *testing.T) {
+	makePieceInfo := func(privateData string) (*PdfObjectDictionary, error) {
+		stream, err := MakeStream([]byte(privateData), NewFlateEncoder())
+		if err != nil {
+			return nil, err
+		}
+		private := MakeDict()
+		private.Set("AIPrivateData1", stream)
+		appData := MakeDict()
+		appData.Set("LastModified", MakeString("D:20170405103012Z"))
+		appData.Set("Private", MakeIndirectObject(private))
+		pieceInfo := MakeDict()
+		pieceInfo.Set("Illustrator", appData)
+		return pieceInfo, nil
+	}
+
+	// Write the original document.
+	w := NewPdfWriter()
+	page := NewPdfPage()
+	page.Resources = NewPdfPageResources()
+	page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+	lastMod, err := NewPdfDate("D:20170405103012Z")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	page.LastModified = &lastMod
+	pagePieceInfo, err := makePieceInfo("%AI page private data")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	page.SetPieceInfo(pagePieceInfo)
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	docPieceInfo, err := makePieceInfo("%AI document private data")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := w.SetPieceInfo(docPieceInfo); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data1, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// Load and save.
+	reader, err := NewPdfReader(bytes.NewReader(data1))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	w2 := NewPdfWriter()
+	page1, err := reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if page1.GetPieceInfo() == nil {
+		t.Fatalf("Page PieceInfo missing after load")
+	}
+	if err := w2.AddPage(page1); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	pieceInfo, err := reader.GetPieceInfo()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if pieceInfo == nil {
+		t.Fatalf("Catalog PieceInfo missing after load")
+	}
+	if err := w2.SetPieceInfo(pieceInfo); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data2, err := writeToBytes(&w2)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	// Compare the private data.
+	getPrivate := func(pieceInfo PdfObject) []byte {
+		appData := TraceToDirectObject(pieceInfo).(*PdfObjectDictionary).Get("Illustrator").(*PdfObjectDictionary)
+		private := TraceToDirectObject(appData.Get("Private")).(*PdfObjectDictionary)
+		return private.Get("AIPrivateData1").(*PdfObjectStream).Stream
+	}
+
+	reader2, err := NewPdfReader(bytes.NewReader(data2))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	page2, err := reader2.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !bytes.Equal(getPrivate(page2.GetPieceInfo()), getPrivate(pagePieceInfo)) {
+		t.Errorf("Page private data changed")
+	}
+	pieceInfo2, err := reader2.GetPieceInfo()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !bytes.Equal(getPrivate(pieceInfo2), getPrivate(docPieceInfo)) {
+		t.Errorf("Document private data changed")
+	}
+
+	if page2.LastModified == nil {
+		t.Fatalf("Page LastModified missing")
+	}
+	lastModStr, ok := page2.LastModified.ToPdfObject().(*PdfObjectString)
+	if !ok || string(*lastModStr) != "D:20170405103012Z" {
+		t.Errorf("Page LastModified changed (%v)", page2.LastModified.ToPdfObject())
+	}
+}
+
+// resaveEncrypted loads the encrypted document `data` and saves it again with EncryptLike.
+func resaveEncrypted(t *testing.T, data []byte, userPass, ownerPass []byte, opt *EncryptOptions) []byte {
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if ok, err := reader.Decrypt([]byte("user")); !ok || err != nil {
+		t.Fatalf("Decrypt failed (%v)", err)
+	}
+	page, err := reader.GetPage(1)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	w := NewPdfWriter()
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := w.EncryptLike(reader, userPass, ownerPass, opt); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	out, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return out
+}
+
+// getEncryptionEntries returns the O and U entries and the first ID of the encrypted document `data`.
+func getEncryptionEntries(t *testing.T, data []byte, userPass []byte) (string, string, string) {
+	reader, err := NewPdfReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if ok, err := reader.Decrypt(userPass); !ok || err != nil {
+		t.Fatalf("Decrypt failed (%v)", err)
+	}
+	crypter := reader.parser.GetCrypter()
+	return string(crypter.O), string(crypter.U), crypter.Id0
+}
+
+// Test that the O and U entries are kept when saving an encrypted document again unchanged.
+func TestEncryptLikeStableU(t *testing.T) {
+	for _, algo := range []EncryptionAlgorithm{RC4_128bit, AES_128bit, AES_256bit} {
+		opt := &EncryptOptions{Algorithm: algo}
+		w := NewPdfWriter()
+		page := NewPdfPage()
+		page.Resources = NewPdfPageResources()
+		page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+		page.AddContentStreamByString("BT /F1 12 Tf 10 10 Td (Hello) Tj ET")
+		if err := w.AddPage(page); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := w.Encrypt([]byte("user"), []byte("owner"), opt); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		data, err := writeToBytes(&w)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		O, U, id0 := getEncryptionEntries(t, data, []byte("user"))
+
+		for i := 0; i < 2; i++ {
+			data = resaveEncrypted(t, data, []byte("user"), []byte("owner"), opt)
+			O2, U2, id02 := getEncryptionEntries(t, data, []byte("user"))
+			if O2 != O || U2 != U || id02 != id0 {
+				t.Errorf("Algorithm %d: encryption entries changed on save %d", algo, i+1)
+			}
+		}
+
+		// A new user password gives a new U.
+		changed := resaveEncrypted(t, data, []byte("user2"), []byte("owner"), opt)
+		_, U2, _ := getEncryptionEntries(t, changed, []byte("user2"))
+		if U2 == U {
+			t.Errorf("Algorithm %d: U not regenerated for a new password", algo)
+		}
+	}
+}
+
+// Test documents written with the security handler and encryption dictionary of EncryptDocument
+// (SetEncryption), opened with the user and the owner passwords.
+func TestEncryptDocument(t *testing.T) {
+	perms := AccessPermissions{Printing: true, FillForms: true}
+	for _, algo := range []EncryptionAlgorithm{RC4_128bit, AES_128bit, AES_256bit} {
+		crypter, ed, err := EncryptDocument([]byte("user"), []byte("owner"), perms, algo)
+		if err != nil {
+			t.Fatalf("Algorithm %d: Error: %v", algo, err)
+		}
+		if len(crypter.Id0) != 16 {
+			t.Errorf("Algorithm %d: Id0 % x", algo, crypter.Id0)
+		}
+
+		w := NewPdfWriter()
+		page := NewPdfPage()
+		page.Resources = NewPdfPageResources()
+		page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+		page.AddContentStreamByString("BT /F1 12 Tf 10 10 Td (Hello) Tj ET")
+		if err := w.AddPage(page); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err := w.SetEncryption(crypter, ed); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		data, err := writeToBytes(&w)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if bytes.Contains(data, []byte("(Hello)")) {
+			t.Errorf("Algorithm %d: contents not encrypted", algo)
+		}
+
+		for _, password := range []string{"user", "owner"} {
+			reader, err := NewPdfReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Algorithm %d: Error: %v", algo, err)
+			}
+			if ok, err := reader.TryPassword([]byte("wrong")); ok || err != nil {
+				t.Errorf("Algorithm %d: wrong password accepted (%v)", algo, err)
+			}
+			if ok, err := reader.Decrypt([]byte(password)); !ok || err != nil {
+				t.Fatalf("Algorithm %d: %s password not accepted (%v)", algo, password, err)
+			}
+			loaded := reader.parser.GetCrypter()
+			if loaded.IsOwnerAuthenticated() != (password == "owner") {
+				t.Errorf("Algorithm %d: %s password owner authenticated %t", algo, password, loaded.IsOwnerAuthenticated())
+			}
+			if loaded.Id0 != crypter.Id0 {
+				t.Errorf("Algorithm %d: Id0 % x, expected % x", algo, loaded.Id0, crypter.Id0)
+			}
+			if p := loaded.GetAccessPermissions(); p != perms {
+				t.Errorf("Algorithm %d: permissions %+v, expected %+v", algo, p, perms)
+			}
+			contents, err := reader.PageList[0].GetAllContentStreams()
+			if err != nil || !strings.Contains(contents, "(Hello) Tj") {
+				t.Errorf("Algorithm %d, %s password: contents %q (%v)", algo, password, contents, err)
+			}
+		}
+	}
+}
+
+// makeEncryptedTestDoc returns a one-page document encrypted with revision `r` of the standard
+// security handler (2: RC4 40 bit, 3: RC4 128 bit, 4: AES 128 bit), the passwords `user` and
+// "owner" and permissions `perms`.
+func makeEncryptedTestDoc(t *testing.T, user string, r int, perms AccessPermissions) []byte {
+	algo := RC4_128bit
+	if r == 4 {
+		algo = AES_128bit
+	}
+	w := NewPdfWriter()
+	page := NewPdfPage()
+	page.Resources = NewPdfPageResources()
+	page.MediaBox = &PdfRectangle{Urx: 612, Ury: 792}
+	page.AddContentStreamByString("BT /F1 12 Tf 10 10 Td (Hello) Tj ET")
+	if err := w.AddPage(page); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := w.Encrypt([]byte(user), []byte("owner"), &EncryptOptions{Permissions: perms, Algorithm: algo}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if r == 2 {
+		// Revision 2 with a 40 bit key, which Encrypt does not offer.
+		crypter := w.crypter
+		crypter.V, crypter.R, crypter.Length = 1, 2, 40
+		crypter.CryptFilters = CryptFilters{StandardCryptFilter: NewCryptFilterV2(5)}
+		O, err := crypter.Alg3([]byte(user), []byte("owner"))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		crypter.O = []byte(O)
+		U, key, err := crypter.Alg4([]byte(user))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		crypter.U = []byte(U)
+		crypter.EncryptionKey = key
+		w.encryptDict.Set("V", MakeInteger(1))
+		w.encryptDict.Set("R", MakeInteger(2))
+		w.encryptDict.Set("Length", MakeInteger(40))
+		w.encryptDict.Set("O", &O)
+		w.encryptDict.Set("U", &U)
+	}
+
+	data, err := writeToBytes(&w)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return data
+}
+
+// Test saving encrypted documents of revisions 2 to 4 again, decrypted with the user or owner
+// password, with or without changes: the Encrypt dictionary is kept, so that both passwords still
+// open the document with the original permissions.  New encryption parameters need the owner
+// password.
+func TestPreserveEncryption(t *testing.T) {
+	perms := AccessPermissions{Printing: true, FullPrintQuality: true}
+	for _, r := range []int{2, 3, 4} {
+		data := makeEncryptedTestDoc(t, "user", r, perms)
+		orig, err := NewPdfReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		origCrypter := *orig.parser.GetCrypter()
+		if origCrypter.R != r {
+			t.Fatalf("Document with R %d, expected %d", origCrypter.R, r)
+		}
+
+		for _, password := range []string{"user", "owner"} {
+			for _, modified := range []bool{false, true} {
+				name := fmt.Sprintf("R %d, %s password, modified %t", r, password, modified)
+				reader, err := NewPdfReader(bytes.NewReader(data))
+				if err != nil {
+					t.Fatalf("Error: %v", err)
+				}
+				if ok, err := reader.Decrypt([]byte(password)); !ok || err != nil {
+					t.Fatalf("%s: Decrypt failed (%v)", name, err)
+				}
+				page, err := reader.GetPage(1)
+				if err != nil {
+					t.Fatalf("Error: %v", err)
+				}
+				if modified {
+					page.AddContentStreamByString("BT /F1 12 Tf 10 30 Td (Added) Tj ET")
+				}
+
+				w := NewPdfWriter()
+				if err := w.AddPage(page); err != nil {
+					t.Fatalf("Error: %v", err)
+				}
+				if err := w.PreserveEncryption(reader); err != nil {
+					t.Fatalf("%s: Error: %v", name, err)
+				}
+				out, err := writeToBytes(&w)
+				if err != nil {
+					t.Fatalf("%s: Error: %v", name, err)
+				}
+
+				saved, err := NewPdfReader(bytes.NewReader(out))
+				if err != nil {
+					t.Fatalf("%s: Error: %v", name, err)
+				}
+				crypter := saved.parser.GetCrypter()
+				if crypter == nil {
+					t.Fatalf("%s: not encrypted", name)
+				}
+				if !bytes.Equal(crypter.O, origCrypter.O) || !bytes.Equal(crypter.U, origCrypter.U) ||
+					crypter.P != origCrypter.P || crypter.V != origCrypter.V || crypter.R != origCrypter.R ||
+					crypter.Length != origCrypter.Length || crypter.Id0 != origCrypter.Id0 {
+					t.Errorf("%s: encryption entries changed", name)
+				}
+				if ok, access, err := saved.CheckAccessRights([]byte("user")); !ok || err != nil || access.Modify || !access.Printing {
+					t.Errorf("%s: user access %t %+v (%v)", name, ok, access, err)
+				}
+				if ok, access, err := saved.CheckAccessRights([]byte("owner")); !ok || err != nil || !access.Modify {
+					t.Errorf("%s: owner access %t %+v (%v)", name, ok, access, err)
+				}
+
+				if ok, err := saved.Decrypt([]byte("user")); !ok || err != nil {
+					t.Fatalf("%s: Decrypt failed (%v)", name, err)
+				}
+				savedPage, err := saved.GetPage(1)
+				if err != nil {
+					t.Fatalf("%s: Error: %v", name, err)
+				}
+				contents, err := savedPage.GetAllContentStreams()
+				if err != nil {
+					t.Fatalf("%s: Error: %v", name, err)
+				}
+				if !strings.Contains(contents, "(Hello)") || strings.Contains(contents, "(Added)") != modified {
+					t.Errorf("%s: unexpected contents %q", name, contents)
+				}
+
+				// Changing the permissions needs the owner password.
+				w = NewPdfWriter()
+				w.AddPage(page)
+				opt := &EncryptOptions{Permissions: AccessPermissions{Printing: true, Modify: true}}
+				err = w.EncryptLike(reader, []byte("user"), nil, opt)
+				if password == "user" && err != ErrOwnerPasswordRequired {
+					t.Errorf("%s: new permissions without the owner password: %v", name, err)
+				} else if password == "owner" && err != nil {
+					t.Errorf("%s: Error: %v", name, err)
+				}
+				w = NewPdfWriter()
+				w.AddPage(page)
+				if err := w.EncryptLike(reader, []byte("user"), []byte("owner"), opt); err != nil {
+					t.Errorf("%s: new permissions with the owner password: %v", name, err)
+				}
+				// Likewise with Encrypt and SetEncryption, before or after adding the page.
+				w = NewPdfWriter()
+				w.AddPage(page)
+				err = w.Encrypt([]byte("user"), nil, opt)
+				if password == "user" && err != ErrOwnerPasswordRequired {
+					t.Errorf("%s: Encrypt without the owner password: %v", name, err)
+				} else if password == "owner" && err != nil {
+					t.Errorf("%s: Error: %v", name, err)
+				}
+				crypter, ed, err := EncryptDocument([]byte("user"), []byte("other"), opt.Permissions, RC4_128bit)
+				if err != nil {
+					t.Fatalf("Error: %v", err)
+				}
+				w = NewPdfWriter()
+				if err := w.SetEncryption(crypter, ed); err != nil {
+					t.Fatalf("%s: Error: %v", name, err)
+				}
+				err = w.AddPage(page)
+				if password == "user" && err != ErrOwnerPasswordRequired {
+					t.Errorf("%s: SetEncryption without the owner password: %v", name, err)
+				} else if password == "owner" && err != nil {
+					t.Errorf("%s: Error: %v", name, err)
+				}
+				w = NewPdfWriter()
+				if err := w.Encrypt([]byte("user"), []byte("owner"), opt); err != nil {
+					t.Fatalf("%s: Error: %v", name, err)
+				}
+				if err := w.AddPage(page); err != nil {
+					t.Errorf("%s: Encrypt with the owner password: %v", name, err)
+				}
+			}
+		}
+	}
+}
@@ -7,6 +7,9 @@ package model
 
 import (
 	"errors"
+	goimage "image"
+	"image/png"
+	"io"
 
 	"github.com/unidoc/unidoc/common"
 	. "github.com/unidoc/unidoc/pdf/core"
@@ -109,7 +112,12 @@ func NewXObjectFormFromStream(stream *PdfObjectStream) (*XObjectForm, error) {
 	form.OC = dict.Get("OC")
 	form.Name = dict.Get("Name")
 
-	form.Stream = stream.Stream
+	// Data left encrypted by a reader with ReadOnlyDecryption is taken decrypted.
+	data, err := stream.DecryptedStream()
+	if err != nil {
+		return nil, err
+	}
+	form.Stream = data
 
 	return form, nil
 }
@@ -293,6 +301,9 @@ func UpdateXObjectImageFromImage(xobjIn *XObjectImage, img *Image, cs PdfColorsp
 		smask.Width = &img.Width
 		smask.Height = &img.Height
 		smask.ColorSpace = NewPdfColorspaceDeviceGray()
+		if len(img.matte) == img.ColorComponents {
+			smask.Matte = MakeArrayFromFloats(img.matte)
+		}
 		xobj.SMask = smask.ToPdfObject()
 	} else {
 		xobj.SMask = xobjIn.SMask
@@ -380,49 +391,27 @@ func NewXObjectImageFromStream(stream *PdfObjectStream) (*XObjectImage, error) {
 	}
 	img.Filter = encoder
 
-	if obj := TraceToDirectObject(dict.Get("Width")); obj != nil {
-		iObj, ok := obj.(*PdfObjectInteger)
-		if !ok {
-			return nil, errors.New("Invalid image width object")
-		}
-		iVal := int64(*iObj)
-		img.Width = &iVal
-	} else {
-		return nil, errors.New("Width missing")
+	params, err := NewImageParamsFromDict(&dict)
+	if err != nil {
+		return nil, err
 	}
-
-	if obj := TraceToDirectObject(dict.Get("Height")); obj != nil {
-		iObj, ok := obj.(*PdfObjectInteger)
-		if !ok {
-			return nil, errors.New("Invalid image height object")
-		}
-		iVal := int64(*iObj)
-		img.Height = &iVal
-	} else {
-		return nil, errors.New("Height missing")
+	img.Width = &params.Width
+	img.Height = &params.Height
+	if params.BitsPerComponent != 0 {
+		img.BitsPerComponent = &params.BitsPerComponent
 	}
 
-	if obj := TraceToDirectObject(dict.Get("ColorSpace")); obj != nil {
-		cs, err := NewPdfColorspaceFromPdfObject(obj)
+	if params.ColorSpace != nil {
+		cs, err := NewPdfColorspaceFromPdfObject(params.ColorSpace)
 		if err != nil {
 			return nil, err
 		}
 		img.ColorSpace = cs
 	} else {
-		// If not specified, assume gray..
-		common.Log.Debug("XObject Image colorspace not specified - assuming 1 color component")
+		// Image masks and JPXDecode images without ColorSpace.
 		img.ColorSpace = NewPdfColorspaceDeviceGray()
 	}
 
-	if obj := TraceToDirectObject(dict.Get("BitsPerComponent")); obj != nil {
-		iObj, ok := obj.(*PdfObjectInteger)
-		if !ok {
-			return nil, errors.New("Invalid image height object")
-		}
-		iVal := int64(*iObj)
-		img.BitsPerComponent = &iVal
-	}
-
 	img.Intent = dict.Get("Intent")
 	img.ImageMask = dict.Get("ImageMask")
 	img.Mask = dict.Get("Mask")
@@ -439,7 +428,12 @@ func NewXObjectImageFromStream(stream *PdfObjectStream) (*XObjectImage, error) {
 	img.Metadata = dict.Get("Metadata")
 	img.OC = dict.Get("OC")
 
-	img.Stream = stream.Stream
+	// Data left encrypted by a reader with ReadOnlyDecryption is taken decrypted.
+	data, err := stream.DecryptedStream()
+	if err != nil {
+		return nil, err
+	}
+	img.Stream = data
 
 	return img, nil
 }
@@ -509,10 +503,23 @@ func (ximg *XObjectImage) ToImage() (*Image, error) {
 	}
 	image.Width = *ximg.Width
 
-	if ximg.BitsPerComponent == nil {
+	if ximg.BitsPerComponent != nil {
+		image.BitsPerComponent = *ximg.BitsPerComponent
+	} else if ximg.isImageMask() {
+		// Optional for image masks, which have 1 bit per component.
+		image.BitsPerComponent = 1
+	} else {
 		return nil, errors.New("Bits per component missing")
 	}
-	image.BitsPerComponent = *ximg.BitsPerComponent
+
+	// The decoded JPEG data follows the dimensions in the JPEG header, which take precedence over
+	// a mismatching Width/Height in the dictionary.
+	if dct, ok := ximg.Filter.(*DCTEncoder); ok {
+		if dct.CheckDimensions(image.Width, image.Height) != nil {
+			image.Width = int64(dct.Width)
+			image.Height = int64(dct.Height)
+		}
+	}
 
 	image.ColorComponents = ximg.ColorSpace.GetNumComponents()
 
@@ -538,6 +545,115 @@ func (ximg *XObjectImage) ToImage() (*Image, error) {
 	return image, nil
 }
 
+// ToGoImage decodes the image and converts it to a Go image, see Image.ToGoImage for the sample
+// interpretation.  Images in other than the device color spaces (and their ICC based and
+// calibrated variants) are converted to RGB by the color space, e.g. Indexed images are expanded
+// through the palette.  The SMask soft mask gives the alpha channel, with the colors un-premultiplied
+// if the soft mask has a Matte entry.  Image masks (stencil masks) are converted to black, with the
+// areas that are not painted transparent.
+func (ximg *XObjectImage) ToGoImage() (goimage.Image, error) {
+	img, err := ximg.ToImage()
+	if err != nil {
+		return nil, err
+	}
+
+	if ximg.isImageMask() {
+		// The mask samples are painted where they decode to 0, so the alpha is given by the mask
+		// with the Decode array reversed.
+		alpha := *img
+		alpha.decode = []float64{1, 0}
+		if len(img.decode) == 2 {
+			alpha.decode = []float64{img.decode[1], img.decode[0]}
+		}
+		black := &Image{Width: img.Width, Height: img.Height, BitsPerComponent: 1, ColorComponents: 1}
+		black.Data = make([]byte, (img.Width+7)/8*img.Height)
+		return black.toGoImage(&alpha)
+	}
+
+	converted := false
+	switch cs := ximg.ColorSpace.(type) {
+	case *PdfColorspaceDeviceGray, *PdfColorspaceDeviceRGB, *PdfColorspaceDeviceCMYK,
+		*PdfColorspaceCalGray, *PdfColorspaceCalRGB:
+	case *PdfColorspaceICCBased:
+		if cs.N != 1 && cs.N != 3 && cs.N != 4 {
+			return nil, errors.New("Unsupported ICC based colorspace")
+		}
+	default:
+		converted = true
+		rgb, err := ximg.ColorSpace.ImageToRGB(*img)
+		if err != nil {
+			return nil, err
+		}
+		img = &rgb
+	}
+
+	var alpha *Image
+	if stream, ok := TraceToDirectObject(ximg.SMask).(*PdfObjectStream); ok {
+		smask, err := NewXObjectImageFromStream(stream)
+		if err != nil {
+			return nil, err
+		}
+		alpha, err = smask.ToImage()
+		if err != nil {
+			return nil, err
+		}
+		if alpha.ColorComponents != 1 {
+			return nil, errors.New("Invalid SMask colorspace")
+		}
+		if smask.Matte != nil {
+			img.matte = getMatte(smask, img, ximg.ColorSpace.GetNumComponents(), converted)
+		}
+	}
+
+	return img.toGoImage(alpha)
+}
+
+// getMatte returns the Matte color of soft mask `smask` of image `img`, which has `n` color
+// components, or nil if the matte cannot be applied to the decoded image: if the Matte is invalid,
+// if the soft mask does not have the size of the image, as required with Matte, or the image was
+// converted to RGB.
+func getMatte(smask *XObjectImage, img *Image, n int, converted bool) []float64 {
+	arr, ok := TraceToDirectObject(smask.Matte).(*PdfObjectArray)
+	if !ok {
+		common.Log.Debug("Incompatibility: Invalid Matte object (%T) - ignored", smask.Matte)
+		return nil
+	}
+	matte, err := arr.ToFloat64Array()
+	if err != nil {
+		common.Log.Debug("Incompatibility: Invalid Matte %s (%v) - ignored", arr, err)
+		return nil
+	}
+	if len(matte) != n {
+		common.Log.Debug("Incompatibility: Matte has %d components, expected %d - ignored", len(matte), n)
+		return nil
+	}
+	if *smask.Width != img.Width || *smask.Height != img.Height {
+		common.Log.Debug("Incompatibility: SMask with Matte is %dx%d, image is %dx%d - Matte ignored",
+			*smask.Width, *smask.Height, img.Width, img.Height)
+		return nil
+	}
+	if converted {
+		common.Log.Debug("Matte not applied to image converted to RGB")
+		return nil
+	}
+	return matte
+}
+
+// WritePNG decodes the image and writes it to `w` in PNG format, as converted by ToGoImage.
+func (ximg *XObjectImage) WritePNG(w io.Writer) error {
+	goimg, err := ximg.ToGoImage()
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, goimg)
+}
+
+// isImageMask returns true if the image is an image mask (stencil mask).
+func (ximg *XObjectImage) isImageMask() bool {
+	isMask, ok := TraceToDirectObject(ximg.ImageMask).(*PdfObjectBool)
+	return ok && bool(*isMask)
+}
+
 func (ximg *XObjectImage) GetContainingPdfObject() PdfObject {
 	return ximg.primitive
 }
@@ -55,6 +55,8 @@ func (this *PSExecutor) Execute(objects []PSObject) ([]PSObject, error) {
 	err := this.program.Exec(this.Stack)
 	if err != nil {
 		common.Log.Debug("Exec failed: %v", err)
+		// Do not leave intermediate values for the next execution.
+		this.Stack.Empty()
 		return nil, err
 	}
 